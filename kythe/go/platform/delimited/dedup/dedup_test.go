@@ -0,0 +1,77 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dedup
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"kythe.io/kythe/go/platform/delimited"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestReader(t *testing.T) {
+	entry, err := proto.Marshal(&spb.Entry{
+		Source:    &spb.VName{Signature: "sig"},
+		FactName:  "/kythe/node/kind",
+		FactValue: []byte("record"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Records need not be entries, or even valid protobufs.
+	records := [][]byte{
+		[]byte("not an entry"),
+		entry,
+		{0xff, 0xff, 0xff},
+		[]byte("not an entry"),
+		{},
+		entry,
+		{0xff, 0xff, 0xff},
+		{},
+	}
+	var buf bytes.Buffer
+	wr := delimited.NewWriter(&buf)
+	for _, rec := range records {
+		if err := wr.Put(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rd, err := NewReader(&buf, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]byte{records[0], records[1], records[2], records[4]} {
+		got, err := rd.Next()
+		if err != nil {
+			t.Fatalf("Unexpected read error: %v", err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("Next record: got %q, want %q", got, want)
+		}
+	}
+	if got, err := rd.Next(); err != io.EOF {
+		t.Errorf("Next record: got %q [%v], want EOF", got, err)
+	}
+	if got := rd.Skipped(); got != 4 {
+		t.Errorf("Skipped: got %d, want 4", got)
+	}
+}
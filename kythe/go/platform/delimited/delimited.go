@@ -48,6 +48,8 @@ import (
 type Reader struct {
 	buf  *bufio.Reader
 	data []byte
+
+	offset, next int64 // of the last record read and of the next
 }
 
 // Next returns the next length-delimited record from the input, or io.EOF if
@@ -58,7 +60,10 @@ type Reader struct {
 //
 // The slice returned is valid only until a subsequent call to Next.
 func (r *Reader) Next() ([]byte, error) {
-	size, err := binary.ReadUvarint(r.buf)
+	r.offset = r.next
+	cr := &countingByteReader{r: r.buf}
+	size, err := binary.ReadUvarint(cr)
+	r.next += cr.n
 	if err != nil {
 		return nil, err
 	}
@@ -68,12 +73,33 @@ func (r *Reader) Next() ([]byte, error) {
 		r.data = r.data[:size]
 	}
 
-	if _, err := io.ReadFull(r.buf, r.data); err != nil {
+	n, err := io.ReadFull(r.buf, r.data)
+	r.next += int64(n)
+	if err != nil {
 		return nil, err
 	}
 	return r.data, nil
 }
 
+// Offset returns the byte offset in the input of the record last returned by
+// Next, or of the record whose reading last failed, so that a corrupt record
+// can be located.
+func (r *Reader) Offset() int64 { return r.offset }
+
+// countingByteReader counts the bytes read from r.
+type countingByteReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
 // NextProto consumes the next available record by calling r.Next, and decodes
 // it into pb with proto.Unmarshal.
 func (r *Reader) NextProto(pb proto.Message) error {
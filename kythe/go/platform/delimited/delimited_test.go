@@ -46,6 +46,18 @@ func TestGoodReader(t *testing.T) {
 	}
 }
 
+func TestReaderOffset(t *testing.T) {
+	const data = testData + "ABCD" // the last record is short
+	rd := NewReader(strings.NewReader(data))
+
+	for _, want := range []int64{0, 1, 3, 6, 10} {
+		_, err := rd.Next()
+		if got := rd.Offset(); got != want {
+			t.Errorf("Offset after Next [%v]: got %d, want %d", err, got, want)
+		}
+	}
+}
+
 func TestCorruptReader(t *testing.T) {
 	const corrupt = "\x05ABCD" // n = 5, only 4 bytes of data
 
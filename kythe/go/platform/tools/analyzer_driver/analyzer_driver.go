@@ -16,7 +16,8 @@
 
 // Binary analyzer_driver drives a CompilationAnalyzer server as a subprocess.
 // Compilations given on the command-line (.kindex files) are sent to the
-// analyzer and all results are written as a delimited stream to stdout.
+// analyzer and all results are written as a delimited stream to stdout (or, if
+// --graphstore is given, written directly to a GraphStore).
 //
 // See --help for more information.
 package main
@@ -36,6 +37,9 @@ import (
 	"kythe.io/kythe/go/platform/analysis/local"
 	"kythe.io/kythe/go/platform/analysis/remote"
 	"kythe.io/kythe/go/platform/delimited"
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/gsutil"
+	"kythe.io/kythe/go/util/datasize"
 	"kythe.io/kythe/go/util/flagutil"
 	"kythe.io/kythe/go/util/netutil"
 	"kythe.io/kythe/go/util/process"
@@ -44,6 +48,11 @@ import (
 	"google.golang.org/grpc"
 
 	apb "kythe.io/kythe/proto/analysis_proto"
+	spb "kythe.io/kythe/proto/storage_proto"
+
+	_ "kythe.io/kythe/go/services/graphstore/grpc"
+	_ "kythe.io/kythe/go/services/graphstore/proxy"
+	_ "kythe.io/kythe/go/storage/leveldb"
 )
 
 func init() {
@@ -54,15 +63,24 @@ AnalysisRequests, and writing the AnalysisOutput values as a delimited stream.
 
 The command for the analyzer is given as non-flag arguments with the string
 @port@ replaced with --analyzer_port.`,
-		`[--analyzer_port int]
+		`[--analyzer_port int] [--graphstore spec]
 <analyzer-command> [analyzer-args...] -- <kindex-file...>`)
 }
 
 var (
 	analyzerPort = flag.Int("analyzer_port", 0, "Listening port of analyzer server (0 indicates to pick an unused port)")
 	fdsPort      = flag.Int("fds_port", 0, "Listening port for local FileDataService server (0 indicates to pick an unused port)")
+
+	batchSize  = flag.Int("batch_size", 1024, "Maximum entries buffered before each write to --graphstore")
+	batchBytes = datasize.Flag("batch_bytes", "3MiB", "Approximate maximum size of the entries buffered before each write to --graphstore")
+
+	gs graphstore.Service
 )
 
+func init() {
+	gsutil.Flag(&gs, "graphstore", "GraphStore to which to write the analysis entries instead of stdout")
+}
+
 func main() {
 	flag.Parse()
 
@@ -107,19 +125,35 @@ func main() {
 	queue := local.NewKIndexQueue(compilations)
 	fds.AddFetcher(queue)
 
-	wr := delimited.NewWriter(os.Stdout)
+	ctx := context.Background()
+	var output analysis.OutputFunc
+	var bw *graphstore.BufferedWriter
+	if gs != nil {
+		defer gsutil.LogClose(ctx, gs)
+		// Analyzers emit one entry at a time; batch them into larger writes.
+		bw = graphstore.NewBufferedWriter(gs, *batchSize, int(batchBytes.Bytes()))
+		output = analysis.EntryOutput(func(_ context.Context, e *spb.Entry) error { return bw.WriteEntry(e) })
+	} else {
+		wr := delimited.NewWriter(os.Stdout)
+		output = func(_ context.Context, out *apb.AnalysisOutput) error { return wr.Put(out.Value) }
+	}
 
 	driver := &driver.Driver{
 		Analyzer: &remote.Analyzer{apb.NewCompilationAnalyzerClient(conn)},
-		Output:   func(_ context.Context, out *apb.AnalysisOutput) error { return wr.Put(out.Value) },
+		Output:   output,
 
 		FileDataService: fdsAddr,
 		Compilations:    queue,
 	}
 
-	if err := driver.Run(context.Background()); err != nil {
+	if err := driver.Run(ctx); err != nil {
 		log.Fatal(err)
 	}
+	if bw != nil {
+		if err := bw.Close(); err != nil {
+			log.Fatalf("GraphStore write error: %v", err)
+		}
+	}
 
 	if err := proc.Signal(os.Interrupt); err != nil {
 		log.Fatalf("Failed to send interrupt to analyzer: %v", err)
@@ -17,6 +17,13 @@
 // Binary dedup_stream reads a delimited stream from stdin and writes a delimited stream to stdout.
 // Each record in the stream will be hashed, and if that hash value has already been seen, the
 // record will not be emitted.
+//
+// With --entries, the stream is instead read as a stream of entries and each entry equal to one
+// already seen (including its fact value) is dropped.  Hashes beyond --cache_size are then spilled
+// to temporary files in --temp_dir, so every duplicate is dropped however long the stream.  If the
+// stream is known to be sorted, --sorted drops consecutive duplicates without the need for a cache
+// of hashes; with --check_sorted, dedup_stream fails on the first entry out of order instead of
+// silently passing through duplicates.
 package main
 
 import (
@@ -24,24 +31,75 @@ import (
 	"log"
 	"os"
 
-	"kythe.io/kythe/go/platform/delimited/dedup"
 	"kythe.io/kythe/go/platform/delimited"
+	"kythe.io/kythe/go/platform/delimited/dedup"
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/storage/stream"
 	"kythe.io/kythe/go/util/datasize"
 	"kythe.io/kythe/go/util/flagutil"
+
+	spb "kythe.io/kythe/proto/storage_proto"
 )
 
 func init() {
-	flag.Usage = flagutil.SimpleUsage("Remove duplicate records from a delimited stream")
+	flag.Usage = flagutil.SimpleUsage("Remove duplicate records from a delimited stream",
+		"[--cache_size size] [--entries [--temp_dir dir] | --entries --sorted [--check_sorted]]")
 }
 
-var cacheSize = datasize.Flag("cache_size", "3GiB", `Maximum size of the cache of known record hashes (e.g. "10B", "12KB", "3GiB", etc.)`)
+var (
+	cacheSize   = datasize.Flag("cache_size", "3GiB", `Maximum size of the cache of known record hashes (e.g. "10B", "12KB", "3GiB", etc.)`)
+	entries     = flag.Bool("entries", false, "Read the stream as entries and drop every duplicate entry, rather than approximately dropping duplicate records")
+	tempDir     = flag.String("temp_dir", "", "Directory for the entry hashes spilled from the cache (requires --entries; default: the system temporary directory)")
+	sorted      = flag.Bool("sorted", false, "Assume the entry stream is sorted, so that all duplicates are consecutive (requires --entries)")
+	checkSorted = flag.Bool("check_sorted", false, "Fail on the first entry out of order (requires --sorted)")
+)
 
 func main() {
 	flag.Parse()
 	if flag.NArg() != 0 {
 		flagutil.UsageErrorf("unknown arguments: %v", flag.Args())
+	} else if !*entries && (*sorted || *tempDir != "") {
+		flagutil.UsageError("--sorted and --temp_dir require --entries")
+	} else if *checkSorted && !*sorted {
+		flagutil.UsageError("--check_sorted requires --sorted")
+	}
+
+	if !*entries {
+		dedupRecords()
+		return
+	}
+
+	wr := delimited.NewWriter(os.Stdout)
+	write := func(e *spb.Entry) error { return wr.PutProto(e) }
+
+	var d *graphstore.Deduped
+	if *sorted {
+		d = graphstore.DedupOrdered(write)
+	} else {
+		d = graphstore.DedupExact(write, compare.EntrySetOptions{
+			MaxBytes: int(cacheSize.Bytes()),
+			WorkDir:  *tempDir,
+		})
+	}
+	read := d.Entry
+	if *checkSorted {
+		read = graphstore.CheckOrdered(d.Entry)
+	}
+	err := stream.NewReader(os.Stdin)(read)
+	if cerr := d.Close(); cerr != nil {
+		log.Printf("Error removing temporary files: %v", cerr)
 	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("dedup_stream: skipped %d entries", d.Dropped())
+}
 
+// dedupRecords copies the records of stdin to stdout, dropping each record
+// whose hash is in the cache of known record hashes.  Records need not be
+// entries.
+func dedupRecords() {
 	rd, err := dedup.NewReader(os.Stdin, int(cacheSize.Bytes()))
 	if err != nil {
 		log.Fatalf("Error creating UniqReader: %v", err)
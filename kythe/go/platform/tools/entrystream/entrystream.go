@@ -25,6 +25,9 @@
 //   $ ... | entrystream --entrysets          # Prints combined entry sets as JSON
 //   $ ... | entrystream --count              # Prints the number of entries in the incoming stream
 //   $ ... | entrystream --read_json          # Reads entry stream as JSON and prints a proto stream
+//
+// With --sort_order corpus, sorted entries are ordered corpus/root/path-major
+// (see compare.VNamesByCorpus) rather than in GraphStore order.
 package main
 
 import (
@@ -32,18 +35,20 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 
 	"kythe.io/kythe/go/platform/delimited"
 	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/services/graphstore/entryfn"
 	"kythe.io/kythe/go/storage/stream"
-	"kythe.io/kythe/go/util/disksort"
 	"kythe.io/kythe/go/util/flagutil"
 
 	spb "kythe.io/kythe/proto/storage_proto"
 
 	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
 )
 
 type entrySet struct {
@@ -61,11 +66,12 @@ var (
 	uniqEntries = flag.Bool("unique", false, "Print only unique entries (implies --sort)")
 	entrySets   = flag.Bool("entrysets", false, "Print Entry protos as JSON EntrySets (implies --sort and --write_json)")
 	countOnly   = flag.Bool("count", false, "Only print the count of protos streamed")
+	sortOrder   = flag.String("sort_order", "standard", `Order of the --sort'ed entry stream: "standard" (GraphStore order) or "corpus" (corpus/root/path-major)`)
 )
 
 func init() {
 	flag.Usage = flagutil.SimpleUsage("Manipulate a stream of delimited Entry messages",
-		"[--read_json] [--unique] ([--write_json] [--sort] | [--entrysets] | [--count])")
+		"[--read_json] [--unique] [--sort_order order] ([--write_json] [--sort] | [--entrysets] | [--count])")
 }
 
 func main() {
@@ -73,35 +79,37 @@ func main() {
 	if len(flag.Args()) > 0 {
 		flagutil.UsageErrorf("unknown arguments: %v", flag.Args())
 	}
+	order, err := compare.ParseEntryOrder(*sortOrder)
+	if err != nil {
+		flagutil.UsageErrorf("invalid --sort_order: %v", err)
+	}
 
 	in := bufio.NewReaderSize(os.Stdin, 2*4096)
 	out := bufio.NewWriter(os.Stdout)
 
 	var rd stream.EntryReader
-	if *readJSON {
+	if *sortStream || *entrySets || *uniqEntries {
+		// Pass os.Stdin to MergeFiles directly so that a redirected file is
+		// recognized as seekable.
+		var sorted io.Reader = os.Stdin
+		if *readJSON {
+			sorted = delimitedEntries(stream.NewJSONReader(in))
+		}
+		rd = sortEntries(sorted, order)
+		if *uniqEntries {
+			rd = dedupEntries(rd)
+		}
+	} else if *readJSON {
 		rd = stream.NewJSONReader(in)
 	} else {
 		rd = stream.NewReader(in)
 	}
 
-	if *sortStream || *entrySets || *uniqEntries {
-		var err error
-		rd, err = sortEntries(rd)
-		failOnErr(err)
-	}
-
-	if *uniqEntries {
-		rd = dedupEntries(rd)
-	}
-
 	switch {
 	case *countOnly:
-		var count int
-		failOnErr(rd(func(_ *spb.Entry) error {
-			count++
-			return nil
-		}))
-		fmt.Println(count)
+		counter := entryfn.Counter(nil)
+		failOnErr(rd(counter.Entry))
+		fmt.Println(counter.Count())
 	case *entrySets:
 		encoder := json.NewEncoder(out)
 		var set entrySet
@@ -141,56 +149,47 @@ func main() {
 	failOnErr(out.Flush())
 }
 
-func sortEntries(rd stream.EntryReader) (stream.EntryReader, error) {
-	sorter, err := disksort.NewMergeSorter(disksort.MergeOptions{
-		Lesser:    entryLesser{},
-		Marshaler: entryMarshaler{},
-	})
-	if err != nil {
-		return nil, fmt.Errorf("error creating entries sorter: %v", err)
-	}
-
-	if err := rd(func(e *spb.Entry) error {
-		return sorter.Add(e)
-	}); err != nil {
-		return nil, fmt.Errorf("error sorting entries: %v", err)
-	}
-
-	return func(f func(*spb.Entry) error) error {
-		return sorter.Read(func(i interface{}) error {
-			return f(i.(*spb.Entry))
-		})
-	}, nil
-}
-
-type entryLesser struct{}
-
-func (entryLesser) Less(a, b interface{}) bool {
-	return compare.Entries(a.(*spb.Entry), b.(*spb.Entry)) == compare.LT
-}
-
-type entryMarshaler struct{}
-
-func (entryMarshaler) Marshal(x interface{}) ([]byte, error) { return proto.Marshal(x.(proto.Message)) }
-
-func (entryMarshaler) Unmarshal(rec []byte) (interface{}, error) {
-	var e spb.Entry
-	return &e, proto.Unmarshal(rec, &e)
+// sortEntries returns a reader of the delimited entries of r, sorted in the
+// given order by compare.MergeFiles.
+func sortEntries(r io.Reader, order compare.EntryOrder) stream.EntryReader {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := compare.MergeFiles(context.Background(), pw, []io.Reader{r}, compare.MergeFilesOptions{Order: order})
+		pw.CloseWithError(err)
+	}()
+	return stream.NewReader(pr)
 }
 
+// dedupEntries returns a reader of the sorted entries of rd, dropping each
+// entry whose key equals that of the entry before it, whatever its fact value.
 func dedupEntries(rd stream.EntryReader) stream.EntryReader {
 	return func(f func(*spb.Entry) error) error {
 		var last *spb.Entry
-		return rd(func(e *spb.Entry) error {
-			if compare.Entries(last, e) != compare.EQ {
-				last = e
-				return f(e)
+		return rd(entryfn.Filter(func(e *spb.Entry) bool {
+			if compare.Entries(last, e) == compare.EQ {
+				return false
 			}
-			return nil
-		})
+			last = e
+			return true
+		}, f))
 	}
 }
 
+// delimitedEntries returns a reader of the entries of rd as a delimited stream.
+func delimitedEntries(rd stream.EntryReader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		buf := bufio.NewWriter(pw)
+		wr := delimited.NewWriter(buf)
+		err := rd(func(e *spb.Entry) error { return wr.PutProto(e) })
+		if err == nil {
+			err = buf.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
 func failOnErr(err error) {
 	if err != nil {
 		log.Fatal(err)
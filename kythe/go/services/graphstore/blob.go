@@ -0,0 +1,84 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// BlobWriter is an optional interface for a Service that can write a node fact
+// value in chunks, rather than as a single []byte.  However it is stored, the
+// value is read as a single entry.
+type BlobWriter interface {
+	Service
+
+	// BeginFact returns a WriteCloser for the value of the given node fact.
+	// The fact is written, replacing any existing value, when the WriteCloser
+	// is successfully closed; nothing is written if it is never closed.
+	BeginFact(ctx context.Context, source *spb.VName, factName string) (io.WriteCloser, error)
+}
+
+// errBlobClosed is returned when writing to a closed fact value writer.
+var errBlobClosed = errors.New("fact value writer is closed")
+
+// BeginFact returns a WriteCloser for the value of the given node fact in s.
+// If s implements BlobWriter, its implementation is used.  Otherwise, the value
+// is buffered in memory and written to s as a single WriteRequest on Close.
+func BeginFact(ctx context.Context, s Service, source *spb.VName, factName string) (io.WriteCloser, error) {
+	if bw, ok := s.(BlobWriter); ok {
+		return bw.BeginFact(ctx, source, factName)
+	} else if factName == "" {
+		return nil, errors.New("missing fact name")
+	}
+	return &bufferedFact{ctx: ctx, s: s, source: source, factName: factName}, nil
+}
+
+type bufferedFact struct {
+	ctx      context.Context
+	s        Service
+	source   *spb.VName
+	factName string
+
+	buf    bytes.Buffer
+	closed bool
+}
+
+// Write implements the io.Writer interface.
+func (b *bufferedFact) Write(p []byte) (int, error) {
+	if b.closed {
+		return 0, errBlobClosed
+	}
+	return b.buf.Write(p)
+}
+
+// Close implements the io.Closer interface by writing the buffered value.
+func (b *bufferedFact) Close() error {
+	if b.closed {
+		return errBlobClosed
+	}
+	b.closed = true
+	return b.s.Write(b.ctx, &spb.WriteRequest{
+		Source: b.source,
+		Update: []*spb.WriteRequest_Update{{FactName: b.factName, FactValue: b.buf.Bytes()}},
+	})
+}
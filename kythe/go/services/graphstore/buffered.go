@@ -0,0 +1,161 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"errors"
+	"sync"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// errWriterClosed is returned when using a closed BufferedWriter.
+var errWriterClosed = errors.New("BufferedWriter is closed")
+
+// BufferedWriter collects entries written one at a time into WriteRequests for
+// a Service.  Consecutive entries with the same source are grouped into a
+// single WriteRequest, as by BatchWrites.  Once the buffered entries reach
+// either threshold given to NewBufferedWriter, they are written to the Service
+// in the background while further entries are buffered.  An error from a
+// background write is returned by the next call to the BufferedWriter, after
+// which all entries are dropped.
+//
+// A BufferedWriter must only be used by a single goroutine.
+type BufferedWriter struct {
+	s                    Service
+	maxUpdates, maxBytes int
+
+	pending       []*spb.WriteRequest
+	updates, size int
+	closed        bool
+
+	writes  chan []*spb.WriteRequest
+	done    chan struct{}  // closed once the background writer exits
+	writing sync.WaitGroup // outstanding writes
+
+	mu  sync.Mutex // guards err
+	err error      // first error from a background write
+}
+
+// NewBufferedWriter returns a BufferedWriter for s that writes its buffered
+// entries once there are maxUpdates of them or they are approximately maxBytes
+// in size.  A threshold ≤ 0 is ignored; if both are, entries are only written
+// on Flush or Close.
+func NewBufferedWriter(s Service, maxUpdates, maxBytes int) *BufferedWriter {
+	w := &BufferedWriter{
+		s:          s,
+		maxUpdates: maxUpdates,
+		maxBytes:   maxBytes,
+		writes:     make(chan []*spb.WriteRequest, 1),
+		done:       make(chan struct{}),
+	}
+	go w.writeLoop()
+	return w
+}
+
+func (w *BufferedWriter) writeLoop() {
+	defer close(w.done)
+	ctx := context.Background()
+	for reqs := range w.writes {
+		if w.error() == nil {
+			if err := WriteBatch(ctx, w.s, reqs); err != nil {
+				w.mu.Lock()
+				w.err = err
+				w.mu.Unlock()
+			}
+		}
+		w.writing.Done()
+	}
+}
+
+func (w *BufferedWriter) error() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// WriteEntry buffers e to be written to the underlying Service.
+func (w *BufferedWriter) WriteEntry(e *spb.Entry) error {
+	if w.closed {
+		return errWriterClosed
+	} else if err := w.error(); err != nil {
+		return err
+	}
+
+	update := &spb.WriteRequest_Update{
+		EdgeKind:  e.EdgeKind,
+		Target:    e.Target,
+		FactName:  e.FactName,
+		FactValue: e.FactValue,
+	}
+	size := fieldSize(update)
+	if n := len(w.pending); n > 0 && compare.VNamesEqual(w.pending[n-1].Source, e.Source) {
+		last := w.pending[n-1]
+		last.Update = append(last.Update, update)
+	} else {
+		w.pending = append(w.pending, &spb.WriteRequest{
+			Source: e.Source,
+			Update: []*spb.WriteRequest_Update{update},
+		})
+		size += fieldSize(e.Source)
+	}
+	w.updates++
+	w.size += size
+
+	if (w.maxUpdates > 0 && w.updates >= w.maxUpdates) || (w.maxBytes > 0 && w.size >= w.maxBytes) {
+		w.send()
+	}
+	return nil
+}
+
+// send hands the pending WriteRequests to the background writer.
+func (w *BufferedWriter) send() {
+	if len(w.pending) == 0 {
+		return
+	}
+	w.writing.Add(1)
+	w.writes <- w.pending
+	w.pending, w.updates, w.size = nil, 0, 0
+}
+
+// Flush writes all buffered entries to the underlying Service and waits for
+// every outstanding write to complete.
+func (w *BufferedWriter) Flush() error {
+	if w.closed {
+		return errWriterClosed
+	}
+	w.send()
+	w.writing.Wait()
+	return w.error()
+}
+
+// Close flushes the BufferedWriter and releases its resources.  The underlying
+// Service is not closed.
+func (w *BufferedWriter) Close() error {
+	if w.closed {
+		return errWriterClosed
+	}
+	err := w.Flush()
+	w.closed = true
+	close(w.writes)
+	<-w.done
+	return err
+}
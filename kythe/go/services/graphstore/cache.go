@@ -0,0 +1,199 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// CachingService is a Service that caches the results of Reads in memory.  The
+// cached entries of a source are invalidated by each Write made through the
+// CachingService; writes made directly to the underlying Service are not
+// observed.  Scans are not cached.  Other optional interfaces of the wrapped
+// Service are hidden.
+type CachingService struct {
+	Service
+	maxBytes int
+
+	mu           sync.Mutex
+	lru          *list.List               // of *cachedRead; most recently used first
+	reads        map[string]*list.Element // keyed by readKey
+	bySource     map[string]map[string]bool
+	size         int
+	writes       uint64 // number of Writes started; guards against caching stale reads
+	hits, misses int64
+}
+
+// CacheStats are counters describing the use of a CachingService.
+type CacheStats struct {
+	// Hits and Misses are the number of Reads served from and not found in the
+	// cache.
+	Hits, Misses int64
+
+	// Reads and Bytes are the number and size of cached Read results.
+	Reads, Bytes int
+}
+
+type cachedRead struct {
+	key, source string
+	entries     []*spb.Entry
+	size        int
+}
+
+// NewCachingService returns a CachingService for s whose cache holds Read
+// results of up to approximately maxBytes serialized bytes, evicting the
+// least recently used results as necessary.
+func NewCachingService(s Service, maxBytes int) *CachingService {
+	return &CachingService{
+		Service:  s,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		reads:    make(map[string]*list.Element),
+		bySource: make(map[string]map[string]bool),
+	}
+}
+
+// Stats returns the current CacheStats for c.
+func (c *CachingService) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Reads: c.lru.Len(), Bytes: c.size}
+}
+
+func readKey(src, edgeKind string) string { return src + "\n" + edgeKind }
+
+// Read implements part of the Service interface.  Entries are delivered from
+// the cache if the same request has been read before; otherwise, the request is
+// forwarded to the underlying Service and, if f consumes all of its results,
+// they are cached.
+func (c *CachingService) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	src := sourceKey(req.Source)
+	key := readKey(src, req.EdgeKind)
+
+	c.mu.Lock()
+	if elt, ok := c.reads[key]; ok {
+		c.lru.MoveToFront(elt)
+		c.hits++
+		entries := elt.Value.(*cachedRead).entries
+		c.mu.Unlock()
+		for _, e := range entries {
+			if err := f(e); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	c.misses++
+	writes := c.writes
+	c.mu.Unlock()
+
+	var (
+		entries  []*spb.Entry
+		size     int
+		complete = true
+	)
+	if err := c.Service.Read(ctx, req, func(e *spb.Entry) error {
+		if complete {
+			entries = append(entries, e)
+			size += proto.Size(e)
+			if size > c.maxBytes {
+				complete, entries = false, nil
+			}
+		}
+		if err := f(e); err != nil {
+			complete = false
+			return err
+		}
+		return nil
+	}); err != nil || !complete {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writes == writes {
+		c.insert(&cachedRead{key: key, source: src, entries: entries, size: size})
+	}
+	return nil
+}
+
+// insert adds r to the cache, evicting older results as needed.  c.mu must be
+// held.
+func (c *CachingService) insert(r *cachedRead) {
+	if _, ok := c.reads[r.key]; ok {
+		return
+	}
+	for c.size+r.size > c.maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	c.reads[r.key] = c.lru.PushFront(r)
+	c.size += r.size
+	keys := c.bySource[r.source]
+	if keys == nil {
+		keys = make(map[string]bool)
+		c.bySource[r.source] = keys
+	}
+	keys[r.key] = true
+}
+
+// remove evicts the given cached result.  c.mu must be held.
+func (c *CachingService) remove(elt *list.Element) {
+	r := c.lru.Remove(elt).(*cachedRead)
+	delete(c.reads, r.key)
+	c.size -= r.size
+	if keys := c.bySource[r.source]; keys != nil {
+		delete(keys, r.key)
+		if len(keys) == 0 {
+			delete(c.bySource, r.source)
+		}
+	}
+}
+
+// Write implements part of the Service interface by forwarding req to the
+// underlying Service and invalidating the cached Reads of its source.
+func (c *CachingService) Write(ctx context.Context, req *spb.WriteRequest) error {
+	src := sourceKey(req.Source)
+	c.mu.Lock()
+	c.writes++
+	c.invalidate(src)
+	c.mu.Unlock()
+
+	err := c.Service.Write(ctx, req)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes++
+	c.invalidate(src)
+	return err
+}
+
+// invalidate evicts every cached Read of the given source key.  c.mu must be
+// held.
+func (c *CachingService) invalidate(src string) {
+	for key := range c.bySource[src] {
+		c.remove(c.reads[key])
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// ErrUnsupported is returned for an optional operation that is not supported
+// by a Service (or by the Service it forwards to).
+var ErrUnsupported = errors.New("operation unsupported by GraphStore")
+
+// CAS is an optional interface for a Service that can atomically update a
+// single node fact conditioned on its current value.
+type CAS interface {
+	Service
+
+	// CompareAndSwap sets the value of the given node fact to newValue if its
+	// current value is oldValue (or, if oldValue is nil, if the fact does not
+	// exist) and reports whether the value was swapped.  A mismatch is not an
+	// error; the caller may re-read the fact and retry.
+	CompareAndSwap(ctx context.Context, source *spb.VName, factName string, oldValue, newValue []byte) (bool, error)
+}
+
+// CompareAndSwap calls the CompareAndSwap method of s if it implements CAS and
+// otherwise returns ErrUnsupported.  Wrappers and proxies of other Services,
+// including remote Services, only support CompareAndSwap if the Services they
+// forward to do.
+func CompareAndSwap(ctx context.Context, s Service, source *spb.VName, factName string, oldValue, newValue []byte) (bool, error) {
+	if c, ok := s.(CAS); ok {
+		return c.CompareAndSwap(ctx, source, factName, oldValue, newValue)
+	}
+	return false, ErrUnsupported
+}
@@ -20,6 +20,10 @@ package compare
 
 import (
 	"bytes"
+	"fmt"
+	"sort"
+
+	"kythe.io/kythe/go/util/schema"
 
 	spb "kythe.io/kythe/proto/storage_proto"
 )
@@ -42,6 +46,52 @@ func (s *ByEntries) Pop() interface{} {
 	return out
 }
 
+// SortEntries sorts entries in the order given by Entries with the given
+// options.
+func SortEntries(entries []*spb.Entry, opts ...Option) {
+	sort.Sort(byEntriesWith{entries, opts})
+}
+
+type byEntriesWith struct {
+	entries []*spb.Entry
+	opts    []Option
+}
+
+func (s byEntriesWith) Len() int { return len(s.entries) }
+func (s byEntriesWith) Less(i, j int) bool {
+	return Entries(s.entries[i], s.entries[j], s.opts...) == LT
+}
+func (s byEntriesWith) Swap(i, j int) { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
+
+// An Option modifies the comparison of entries by Entries, ValueEntries,
+// EntriesEqual, and SortEntries.
+type Option func(*options)
+
+type options struct {
+	ignoreFactValue bool
+	ignoreOrdinal   bool
+}
+
+func makeOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+var (
+	// IgnoreFactValue is an Option to compare entries without their fact
+	// values, even by ValueEntries and EntriesEqual.
+	IgnoreFactValue Option = func(o *options) { o.ignoreFactValue = true }
+
+	// IgnoreOrdinalSuffix is an Option to compare edge kinds without their
+	// ordinal suffixes (see schema.ParseOrdinal), so that the
+	// "/kythe/edge/param.0" and "/kythe/edge/param.1" edges of a source to the
+	// same target are equal.
+	IgnoreOrdinalSuffix Option = func(o *options) { o.ignoreOrdinal = true }
+)
+
 // An Order represents an ordering relationship between values.
 type Order int
 
@@ -54,14 +104,15 @@ const (
 
 // Strings returns LT if s < t, EQ if s == t, or GT if s > t.
 func Strings(s, t string) Order {
-	switch {
-	case s < t:
-		return LT
-	case s > t:
-		return GT
-	default:
+	// Equality is checked first since it is cheap (strings of different
+	// lengths are unequal without examining their bytes) and common in the
+	// shared prefixes of entry keys.
+	if s == t {
 		return EQ
+	} else if s < t {
+		return LT
 	}
+	return GT
 }
 
 var (
@@ -81,27 +132,132 @@ func VNames(v1, v2 *spb.VName) Order {
 	}
 	if v1 == v2 {
 		return EQ
-	} else if c := Strings(v1.Signature, v2.Signature); c != EQ {
-		return c
+	} else if s1, s2 := v1.Signature, v2.Signature; s1 != s2 {
+		return less(s1 < s2)
+	} else if s1, s2 := v1.Corpus, v2.Corpus; s1 != s2 {
+		return less(s1 < s2)
+	} else if s1, s2 := v1.Root, v2.Root; s1 != s2 {
+		return less(s1 < s2)
+	} else if s1, s2 := v1.Path, v2.Path; s1 != s2 {
+		return less(s1 < s2)
+	} else if s1, s2 := v1.Language, v2.Language; s1 != s2 {
+		return less(s1 < s2)
+	}
+	return EQ
+}
+
+// less returns LT if lt is true, and GT otherwise.
+func less(lt bool) Order {
+	if lt {
+		return LT
+	}
+	return GT
+}
+
+// VNamesEqual reports whether v1 and v2 are equal.
+func VNamesEqual(v1, v2 *spb.VName) bool {
+	if v1 == nil {
+		v1 = emptyVName
+	}
+	if v2 == nil {
+		v2 = emptyVName
+	}
+	// The order of fields in which unequal VNames most often first differ
+	// (in practice, their languages and corpora) is unrelated to their
+	// ordering, so equality is checked in that order instead.
+	return v1 == v2 ||
+		v1.Language == v2.Language &&
+			v1.Corpus == v2.Corpus &&
+			v1.Signature == v2.Signature &&
+			v1.Path == v2.Path &&
+			v1.Root == v2.Root
+}
+
+// VNamesByCorpus returns LT if v1 precedes v2, EQ if v1 and v2 are equal, or
+// GT if v1 follows v2, in corpus-major order.  The ordering is defined by
+// lexicographic comparison of [corpus, root, path, signature, language], so
+// that the VNames of each corpus (and of each file within it) are contiguous.
+// As with VNames, a nil VName is equal to an empty VName.
+func VNamesByCorpus(v1, v2 *spb.VName) Order {
+	if v1 == nil {
+		v1 = emptyVName
+	}
+	if v2 == nil {
+		v2 = emptyVName
+	}
+	if v1 == v2 {
+		return EQ
 	} else if c := Strings(v1.Corpus, v2.Corpus); c != EQ {
 		return c
 	} else if c := Strings(v1.Root, v2.Root); c != EQ {
 		return c
 	} else if c := Strings(v1.Path, v2.Path); c != EQ {
 		return c
+	} else if c := Strings(v1.Signature, v2.Signature); c != EQ {
+		return c
 	}
 	return Strings(v1.Language, v2.Language)
 }
 
-// VNamesEqual reports whether v1 and v2 are equal.
-func VNamesEqual(v1, v2 *spb.VName) bool { return VNames(v1, v2) == EQ }
+// An EntryOrder selects the VName ordering used to order entries by EntriesBy.
+type EntryOrder int
+
+const (
+	// StandardOrder orders the VNames of entries by VNames.  This is the
+	// order of Entries and of every graphstore.Service.
+	StandardOrder EntryOrder = iota
+
+	// CorpusOrder orders the VNames of entries by VNamesByCorpus.
+	CorpusOrder
+)
+
+var entryOrderNames = map[EntryOrder]string{
+	StandardOrder: "standard",
+	CorpusOrder:   "corpus",
+}
+
+// String returns the name of the EntryOrder, as accepted by ParseEntryOrder.
+func (o EntryOrder) String() string {
+	if name, ok := entryOrderNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("EntryOrder(%d)", int(o))
+}
+
+// ParseEntryOrder returns the EntryOrder with the given name ("standard" or
+// "corpus").
+func ParseEntryOrder(name string) (EntryOrder, error) {
+	for o, n := range entryOrderNames {
+		if n == name {
+			return o, nil
+		}
+	}
+	return StandardOrder, fmt.Errorf("unknown entry order: %q", name)
+}
+
+// EntriesBy returns a function that reports whether e1 is LT, GT, or EQ to e2
+// in the given entry order, ignoring fact values (if any).  Entries are
+// ordered by lexicographic comparison of [source, edge kind, fact name,
+// target] where the source and target are compared in the given order.
+// EntriesBy(StandardOrder) is equivalent to Entries.
+func EntriesBy(order EntryOrder, opts ...Option) func(e1, e2 *spb.Entry) Order {
+	vnames := VNames
+	if order == CorpusOrder {
+		vnames = VNamesByCorpus
+	}
+	return func(e1, e2 *spb.Entry) Order { return entries(vnames, e1, e2, opts) }
+}
 
 // Entries reports whether e1 is LT, GT, or EQ to e2 in entry order, ignoring
 // fact values (if any).
 //
 // The ordering for entries is defined by lexicographic comparison of
 // [source, edge kind, fact name, target].
-func Entries(e1, e2 *spb.Entry) Order {
+func Entries(e1, e2 *spb.Entry, opts ...Option) Order {
+	return entries(VNames, e1, e2, opts)
+}
+
+func entries(vnames func(v1, v2 *spb.VName) Order, e1, e2 *spb.Entry, opts []Option) Order {
 	if e1 == nil {
 		e1 = emptyEntry
 	}
@@ -111,25 +267,48 @@ func Entries(e1, e2 *spb.Entry) Order {
 	if e1 == e2 {
 		return EQ
 	}
-	if c := VNames(e1.GetSource(), e2.GetSource()); c != EQ {
+	k1, k2 := e1.EdgeKind, e2.EdgeKind
+	if len(opts) > 0 && makeOptions(opts).ignoreOrdinal {
+		k1, _, _ = schema.ParseOrdinal(k1)
+		k2, _, _ = schema.ParseOrdinal(k2)
+	}
+	if c := vnames(e1.Source, e2.Source); c != EQ {
 		return c
-	} else if c := Strings(e1.EdgeKind, e2.EdgeKind); c != EQ {
+	} else if c := Strings(k1, k2); c != EQ {
 		return c
 	} else if c := Strings(e1.FactName, e2.FactName); c != EQ {
 		return c
 	}
-	return VNames(e1.GetTarget(), e2.GetTarget())
+	return vnames(e1.Target, e2.Target)
 }
 
 // ValueEntries reports whether e1 is LT, GT, or EQ to e2 in entry order,
-// including fact values (if any).
-func ValueEntries(e1, e2 *spb.Entry) Order {
-	if c := Entries(e1, e2); c != EQ {
+// including fact values (if any) unless IgnoreFactValue is given.
+func ValueEntries(e1, e2 *spb.Entry, opts ...Option) Order {
+	if c := Entries(e1, e2, opts...); c != EQ {
 		return c
+	} else if len(opts) > 0 && makeOptions(opts).ignoreFactValue {
+		return EQ
 	}
 	return Order(bytes.Compare(e1.FactValue, e2.FactValue))
 }
 
 // EntriesEqual reports whether e1 and e2 are equivalent, including their fact
-// values (if any).
-func EntriesEqual(e1, e2 *spb.Entry) bool { return ValueEntries(e1, e2) == EQ }
+// values (if any) unless IgnoreFactValue is given.
+func EntriesEqual(e1, e2 *spb.Entry, opts ...Option) bool {
+	if len(opts) > 0 {
+		return ValueEntries(e1, e2, opts...) == EQ
+	}
+	if e1 == nil {
+		e1 = emptyEntry
+	}
+	if e2 == nil {
+		e2 = emptyEntry
+	}
+	return e1 == e2 ||
+		e1.FactName == e2.FactName &&
+			e1.EdgeKind == e2.EdgeKind &&
+			bytes.Equal(e1.FactValue, e2.FactValue) &&
+			VNamesEqual(e1.Source, e2.Source) &&
+			VNamesEqual(e1.Target, e2.Target)
+}
@@ -17,7 +17,9 @@
 package compare
 
 import (
+	"bytes"
 	"fmt"
+	"math/rand"
 	"testing"
 
 	spb "kythe.io/kythe/proto/storage_proto"
@@ -105,3 +107,384 @@ func TestCompareEntries(t *testing.T) {
 		}
 	}
 }
+
+func TestEntriesEqualOptions(t *testing.T) {
+	src := &spb.VName{Signature: "src"}
+	tgt := &spb.VName{Signature: "tgt"}
+	param := func(kind string, value string) *spb.Entry {
+		return &spb.Entry{Source: src, EdgeKind: kind, FactName: "/", Target: tgt, FactValue: []byte(value)}
+	}
+	fact := func(name, value string) *spb.Entry {
+		return &spb.Entry{Source: src, FactName: name, FactValue: []byte(value)}
+	}
+
+	tests := []struct {
+		a, b *spb.Entry
+		// Whether a and b are equal with no options, IgnoreFactValue,
+		// IgnoreOrdinalSuffix, and both options.
+		none, noValue, noOrdinal, both bool
+	}{
+		{nil, nil, true, true, true, true},
+		{fact("/a", "v"), fact("/a", "v"), true, true, true, true},
+		{fact("/a", "v"), fact("/a", "w"), false, true, false, true},
+		{fact("/a", "v"), fact("/a", ""), false, true, false, true},
+		{fact("/a", "v"), fact("/b", "v"), false, false, false, false},
+		{fact("/a.0", "v"), fact("/a.1", "v"), false, false, false, false}, // only edge kinds have ordinals
+		{param("/kythe/edge/param.0", ""), param("/kythe/edge/param.0", ""), true, true, true, true},
+		{param("/kythe/edge/param.0", ""), param("/kythe/edge/param.1", ""), false, false, true, true},
+		{param("/kythe/edge/param.0", ""), param("/kythe/edge/param.10", ""), false, false, true, true},
+		{param("/kythe/edge/param.0", ""), param("/kythe/edge/param", ""), false, false, true, true},
+		{param("/kythe/edge/param.0", "v"), param("/kythe/edge/param.1", "w"), false, false, false, true},
+		{param("/kythe/edge/param.0", ""), param("/kythe/edge/ref.0", ""), false, false, false, false},
+		{param("/kythe/edge/param.x", ""), param("/kythe/edge/param.0", ""), false, false, false, false},
+		{param("/kythe/edge/param.", ""), param("/kythe/edge/param", ""), false, false, false, false},
+		{param("/kythe/edge/param.0", ""), fact("/", ""), false, false, false, false},
+	}
+	for _, test := range tests {
+		for _, c := range []struct {
+			opts []Option
+			want bool
+		}{
+			{nil, test.none},
+			{[]Option{IgnoreFactValue}, test.noValue},
+			{[]Option{IgnoreOrdinalSuffix}, test.noOrdinal},
+			{[]Option{IgnoreFactValue, IgnoreOrdinalSuffix}, test.both},
+		} {
+			if test.a == nil {
+				// ValueEntries requires non-nil entries; only Entries accepts nil.
+				if got := Entries(test.a, test.b, c.opts...); got != EQ {
+					t.Errorf("Entries(nil, nil, %d options) = %v; want EQ", len(c.opts), got)
+				}
+				continue
+			}
+			if got := EntriesEqual(test.a, test.b, c.opts...); got != c.want {
+				t.Errorf("EntriesEqual(%v, %v, %d options) = %v; want %v", test.a, test.b, len(c.opts), got, c.want)
+			}
+			if got := EntriesEqual(test.b, test.a, c.opts...); got != c.want {
+				t.Errorf("EntriesEqual(%v, %v, %d options) = %v; want %v", test.b, test.a, len(c.opts), got, c.want)
+			}
+			if got, want := ValueEntries(test.a, test.b, c.opts...) == -ValueEntries(test.b, test.a, c.opts...), true; got != want {
+				t.Errorf("ValueEntries(%v, %v, %d options) is not antisymmetric", test.a, test.b, len(c.opts))
+			}
+		}
+	}
+}
+
+func TestSortEntries(t *testing.T) {
+	src := &spb.VName{Signature: "src"}
+	edge := func(kind, tgt string) *spb.Entry {
+		return &spb.Entry{Source: src, EdgeKind: kind, FactName: "/", Target: &spb.VName{Signature: tgt}}
+	}
+	entries := []*spb.Entry{
+		edge("/kythe/edge/param.1", "a"),
+		edge("/kythe/edge/ref", "a"),
+		edge("/kythe/edge/param.0", "b"),
+		edge("/kythe/edge/param.10", "c"),
+	}
+
+	SortEntries(entries)
+	for i, want := range []string{"/kythe/edge/param.0", "/kythe/edge/param.1", "/kythe/edge/param.10", "/kythe/edge/ref"} {
+		if entries[i].EdgeKind != want {
+			t.Errorf("SortEntries: entry %d has kind %q; want %q", i, entries[i].EdgeKind, want)
+		}
+	}
+
+	SortEntries(entries, IgnoreOrdinalSuffix)
+	for i, want := range []string{"a", "b", "c", "a"} {
+		if entries[i].Target.Signature != want {
+			t.Errorf("SortEntries(IgnoreOrdinalSuffix): entry %d has target %q; want %q", i, entries[i].Target.Signature, want)
+		}
+	}
+}
+
+func TestCompareVNamesByCorpus(t *testing.T) {
+	var ordered []*spb.VName
+	for i := 0; i < 100000; i += 307 {
+		key := fmt.Sprintf("%05d", i)
+		ordered = append(ordered, &spb.VName{
+			Corpus:    key[0:1],
+			Root:      key[1:2],
+			Path:      key[2:3],
+			Signature: key[3:4],
+			Language:  key[4:5],
+		})
+	}
+
+	for i, fst := range ordered {
+		for j, snd := range ordered {
+			want := LT
+			if i == j {
+				want = EQ
+			} else if i > j {
+				want = GT
+			}
+
+			if got := VNamesByCorpus(fst, snd); got != want {
+				t.Errorf("Comparison failed: got %v, want %v\n\tlhs %+v\n\trhs %+v",
+					got, want, fst, snd)
+			}
+		}
+	}
+}
+
+func TestCompareVNamesEmpty(t *testing.T) {
+	tests := []struct {
+		v1, v2           *spb.VName
+		standard, corpus Order
+	}{
+		{nil, nil, EQ, EQ},
+		{nil, &spb.VName{}, EQ, EQ},
+		{&spb.VName{}, nil, EQ, EQ},
+		{nil, &spb.VName{Language: "l"}, LT, LT},
+		{&spb.VName{Signature: "s"}, nil, GT, GT},
+		{&spb.VName{Corpus: "c"}, &spb.VName{Signature: "s"}, LT, GT},
+		{&spb.VName{Path: "p"}, &spb.VName{Signature: "s"}, LT, GT},
+		{&spb.VName{Signature: "s"}, &spb.VName{Signature: "s", Corpus: "c"}, LT, LT},
+		{&spb.VName{Corpus: "c", Signature: "t"}, &spb.VName{Corpus: "c", Root: "r", Signature: "s"}, GT, LT},
+		{&spb.VName{Corpus: "c", Path: "p", Signature: "t"}, &spb.VName{Corpus: "c", Path: "q", Signature: "s"}, GT, LT},
+		{&spb.VName{Corpus: "c", Language: "l"}, &spb.VName{Corpus: "c", Language: "l"}, EQ, EQ},
+	}
+	for _, test := range tests {
+		if got := VNames(test.v1, test.v2); got != test.standard {
+			t.Errorf("VNames(%v, %v) = %v; want %v", test.v1, test.v2, got, test.standard)
+		}
+		if got := VNamesByCorpus(test.v1, test.v2); got != test.corpus {
+			t.Errorf("VNamesByCorpus(%v, %v) = %v; want %v", test.v1, test.v2, got, test.corpus)
+		}
+	}
+}
+
+func TestEntriesBy(t *testing.T) {
+	c1 := &spb.VName{Corpus: "c1", Signature: "z"}
+	c2 := &spb.VName{Corpus: "c2", Signature: "a"}
+	tests := []struct {
+		e1, e2           *spb.Entry
+		standard, corpus Order
+	}{
+		{nil, nil, EQ, EQ},
+		{nil, &spb.Entry{}, EQ, EQ},
+		{nil, &spb.Entry{FactName: "/"}, LT, LT},
+		{&spb.Entry{Source: c1}, &spb.Entry{Source: c2}, GT, LT},
+		{&spb.Entry{Source: c1}, &spb.Entry{}, GT, GT},
+		{&spb.Entry{Source: c1, FactName: "/b"}, &spb.Entry{Source: c1, FactName: "/a"}, GT, GT},
+		{&spb.Entry{Source: c1, EdgeKind: "/e", Target: c1}, &spb.Entry{Source: c1, EdgeKind: "/e", Target: c2}, GT, LT},
+		{&spb.Entry{Source: c1, EdgeKind: "/e"}, &spb.Entry{Source: c1, EdgeKind: "/e", Target: c2}, LT, LT},
+		{&spb.Entry{Source: c1, FactValue: []byte("a")}, &spb.Entry{Source: c1, FactValue: []byte("b")}, EQ, EQ},
+	}
+	for _, test := range tests {
+		for _, c := range []struct {
+			order EntryOrder
+			want  Order
+		}{{StandardOrder, test.standard}, {CorpusOrder, test.corpus}} {
+			cmp := EntriesBy(c.order)
+			if got := cmp(test.e1, test.e2); got != c.want {
+				t.Errorf("EntriesBy(%v)(%v, %v) = %v; want %v", c.order, test.e1, test.e2, got, c.want)
+			}
+			if got := cmp(test.e2, test.e1); got != -c.want {
+				t.Errorf("EntriesBy(%v)(%v, %v) = %v; want %v", c.order, test.e2, test.e1, got, -c.want)
+			}
+		}
+		if got := Entries(test.e1, test.e2); got != test.standard {
+			t.Errorf("Entries(%v, %v) = %v; want %v", test.e1, test.e2, got, test.standard)
+		}
+	}
+}
+
+func TestParseEntryOrder(t *testing.T) {
+	for _, order := range []EntryOrder{StandardOrder, CorpusOrder} {
+		if got, err := ParseEntryOrder(order.String()); err != nil {
+			t.Errorf("ParseEntryOrder(%q): unexpected error: %v", order, err)
+		} else if got != order {
+			t.Errorf("ParseEntryOrder(%q) = %v; want %v", order, got, order)
+		}
+	}
+	if got, err := ParseEntryOrder("signature"); err == nil {
+		t.Errorf("ParseEntryOrder(%q) = %v; want error", "signature", got)
+	}
+}
+
+// benchmarkVNames returns pairs of VNames resembling those of an indexer's
+// output: mostly distinct signatures within a few corpora and languages.
+func benchmarkVNames() [][2]*spb.VName {
+	rng := rand.New(rand.NewSource(7))
+	vname := func() *spb.VName {
+		return &spb.VName{
+			Signature: fmt.Sprintf("signature:%d#%d", rng.Intn(100), rng.Intn(1000)),
+			Corpus:    []string{"kythe", "chromium"}[rng.Intn(2)],
+			Path:      fmt.Sprintf("kythe/go/services/graphstore/file%d.go", rng.Intn(10)),
+			Language:  []string{"go", "c++", "java"}[rng.Intn(3)],
+		}
+	}
+	pairs := make([][2]*spb.VName, 1024)
+	for i := range pairs {
+		v := vname()
+		switch i % 4 {
+		case 0:
+			pairs[i] = [2]*spb.VName{v, vname()}
+		case 1:
+			w := *v
+			pairs[i] = [2]*spb.VName{v, &w}
+		case 2:
+			w := *v
+			w.Language = "python"
+			pairs[i] = [2]*spb.VName{v, &w}
+		case 3:
+			w := *v
+			w.Signature += "x"
+			pairs[i] = [2]*spb.VName{v, &w}
+		}
+	}
+	return pairs
+}
+
+func BenchmarkVNamesCompare(b *testing.B) {
+	pairs := benchmarkVNames()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := pairs[i%len(pairs)]
+		VNames(p[0], p[1])
+	}
+}
+
+func BenchmarkVNamesEqual(b *testing.B) {
+	pairs := benchmarkVNames()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := pairs[i%len(pairs)]
+		VNamesEqual(p[0], p[1])
+	}
+}
+
+func BenchmarkEntriesCompare(b *testing.B) {
+	pairs := benchmarkVNames()
+	entries := make([][2]*spb.Entry, len(pairs))
+	for i, p := range pairs {
+		entries[i] = [2]*spb.Entry{
+			{Source: p[0], EdgeKind: "/kythe/edge/ref", FactName: "/", Target: p[1]},
+			{Source: p[0], EdgeKind: "/kythe/edge/ref", FactName: "/", Target: p[i%2]},
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := entries[i%len(entries)]
+		Entries(p[0], p[1])
+	}
+}
+
+func BenchmarkEntriesEqual(b *testing.B) {
+	pairs := benchmarkVNames()
+	entries := make([][2]*spb.Entry, len(pairs))
+	for i, p := range pairs {
+		entries[i] = [2]*spb.Entry{
+			{Source: p[0], FactName: "/kythe/node/kind", FactValue: []byte("record")},
+			{Source: p[1], FactName: "/kythe/node/kind", FactValue: []byte("record")},
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := entries[i%len(entries)]
+		EntriesEqual(p[0], p[1])
+	}
+}
+
+// The implementations of Strings, VNames, and Entries preceding their
+// optimization, for differential testing.
+
+func legacyStrings(s, t string) Order {
+	switch {
+	case s < t:
+		return LT
+	case s > t:
+		return GT
+	default:
+		return EQ
+	}
+}
+
+func legacyVNames(v1, v2 *spb.VName) Order {
+	if v1 == nil {
+		v1 = emptyVName
+	}
+	if v2 == nil {
+		v2 = emptyVName
+	}
+	if v1 == v2 {
+		return EQ
+	} else if c := legacyStrings(v1.Signature, v2.Signature); c != EQ {
+		return c
+	} else if c := legacyStrings(v1.Corpus, v2.Corpus); c != EQ {
+		return c
+	} else if c := legacyStrings(v1.Root, v2.Root); c != EQ {
+		return c
+	} else if c := legacyStrings(v1.Path, v2.Path); c != EQ {
+		return c
+	}
+	return legacyStrings(v1.Language, v2.Language)
+}
+
+func legacyEntries(e1, e2 *spb.Entry) Order {
+	if e1 == nil {
+		e1 = emptyEntry
+	}
+	if e2 == nil {
+		e2 = emptyEntry
+	}
+	if e1 == e2 {
+		return EQ
+	} else if c := legacyVNames(e1.GetSource(), e2.GetSource()); c != EQ {
+		return c
+	} else if c := legacyStrings(e1.EdgeKind, e2.EdgeKind); c != EQ {
+		return c
+	} else if c := legacyStrings(e1.FactName, e2.FactName); c != EQ {
+		return c
+	}
+	return legacyVNames(e1.GetTarget(), e2.GetTarget())
+}
+
+func legacyValueEntries(e1, e2 *spb.Entry) Order {
+	if c := legacyEntries(e1, e2); c != EQ {
+		return c
+	}
+	return Order(bytes.Compare(e1.FactValue, e2.FactValue))
+}
+
+func TestCompareDifferential(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+	for i := 0; i < 200000; i++ {
+		s1, s2 := randString(rng), randString(rng)
+		if got, want := Strings(s1, s2), legacyStrings(s1, s2); got != want {
+			t.Fatalf("Strings(%q, %q) = %v; want %v", s1, s2, got, want)
+		}
+
+		v1, v2 := randVName(rng), randVName(rng)
+		if rng.Intn(4) == 0 {
+			v2 = v1
+		}
+		want := legacyVNames(v1, v2)
+		if got := VNames(v1, v2); got != want {
+			t.Fatalf("VNames(%v, %v) = %v; want %v", v1, v2, got, want)
+		} else if got := VNamesEqual(v1, v2); got != (want == EQ) {
+			t.Fatalf("VNamesEqual(%v, %v) = %v; want %v", v1, v2, got, want == EQ)
+		}
+
+		e1, e2 := randEntry(rng), randEntry(rng)
+		switch rng.Intn(4) {
+		case 0:
+			e2 = e1
+		case 1:
+			c := *e1
+			c.FactValue = e2.FactValue
+			e2 = &c
+		}
+		want = legacyEntries(e1, e2)
+		if got := Entries(e1, e2); got != want {
+			t.Fatalf("Entries(%v, %v) = %v; want %v", e1, e2, got, want)
+		}
+		want = legacyValueEntries(e1, e2)
+		if got := ValueEntries(e1, e2); got != want {
+			t.Fatalf("ValueEntries(%v, %v) = %v; want %v", e1, e2, got, want)
+		} else if got := EntriesEqual(e1, e2); got != (want == EQ) {
+			t.Fatalf("EntriesEqual(%v, %v) = %v; want %v", e1, e2, got, want == EQ)
+		}
+	}
+}
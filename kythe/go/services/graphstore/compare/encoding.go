@@ -0,0 +1,185 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"errors"
+	"fmt"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// The canonical encoding of a VName is the concatenation of its encoded
+// [signature, corpus, root, path, language] fields, and the canonical encoding
+// of an entry key is the concatenation of its encoded [source, edge kind, fact
+// name, target].  Each string field is encoded as its bytes, with each 0x00
+// byte escaped as 0x00 0xFF, followed by the terminator 0x00 0x01.  The
+// encoding is injective and order-preserving: bytes.Compare of two encoded
+// VNames (or entry keys) agrees with VNames (or Entries) of the originals.  A
+// nil VName is encoded as an empty VName.
+const (
+	escapeByte     = 0x00
+	escapedByte    = 0xFF
+	terminatorByte = 0x01
+)
+
+// EncodeVName returns the canonical encoding of v.
+func EncodeVName(v *spb.VName) []byte { return appendVName(nil, v) }
+
+// EncodeEntryKey returns the canonical encoding of the key of e: its source,
+// edge kind, fact name, and target.  The fact value of e is not encoded.
+func EncodeEntryKey(e *spb.Entry) []byte {
+	if e == nil {
+		e = emptyEntry
+	}
+	key := appendVName(nil, e.Source)
+	key = appendString(key, e.EdgeKind)
+	key = appendString(key, e.FactName)
+	return appendVName(key, e.Target)
+}
+
+// EncodeEntryKeyBy returns an encoding of the key of e such that bytes.Compare
+// of two encoded keys agrees with EntriesBy(order) of the originals.
+// EncodeEntryKeyBy(StandardOrder, e) is equivalent to EncodeEntryKey(e); keys
+// encoded in any other order cannot be decoded by DecodeEntryKey.
+func EncodeEntryKeyBy(order EntryOrder, e *spb.Entry) []byte {
+	if order != CorpusOrder {
+		return EncodeEntryKey(e)
+	} else if e == nil {
+		e = emptyEntry
+	}
+	key := appendVNameByCorpus(nil, e.Source)
+	key = appendString(key, e.EdgeKind)
+	key = appendString(key, e.FactName)
+	return appendVNameByCorpus(key, e.Target)
+}
+
+// EncodeKeyPrefix returns the prefix of the canonical encoding of every entry
+// key with the given source and edge kind.  If edgeKind is "*", the prefix is
+// shared by the keys of every entry with the given source.
+func EncodeKeyPrefix(source *spb.VName, edgeKind string) []byte {
+	prefix := appendVName(nil, source)
+	if edgeKind == "*" {
+		return prefix
+	}
+	return appendString(prefix, edgeKind)
+}
+
+// DecodeVName returns the VName encoded by EncodeVName as key.
+func DecodeVName(key []byte) (*spb.VName, error) {
+	v, rest, err := decodeVName(key)
+	if err != nil {
+		return nil, err
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("invalid VName encoding: %d trailing bytes", len(rest))
+	}
+	return v, nil
+}
+
+// DecodeEntryKey returns the entry whose key was encoded by EncodeEntryKey as
+// key.  The entry has no fact value, and its Target is nil if the encoded
+// target is empty.
+func DecodeEntryKey(key []byte) (*spb.Entry, error) {
+	src, rest, err := decodeVName(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source: %v", err)
+	}
+	e := &spb.Entry{Source: src}
+	if e.EdgeKind, rest, err = decodeString(rest); err != nil {
+		return nil, fmt.Errorf("invalid edge kind: %v", err)
+	} else if e.FactName, rest, err = decodeString(rest); err != nil {
+		return nil, fmt.Errorf("invalid fact name: %v", err)
+	} else if e.Target, rest, err = decodeVName(rest); err != nil {
+		return nil, fmt.Errorf("invalid target: %v", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("invalid entry key encoding: %d trailing bytes", len(rest))
+	}
+	if VNamesEqual(e.Target, emptyVName) {
+		e.Target = nil
+	}
+	return e, nil
+}
+
+func appendVName(buf []byte, v *spb.VName) []byte {
+	if v == nil {
+		v = emptyVName
+	}
+	buf = appendString(buf, v.Signature)
+	buf = appendString(buf, v.Corpus)
+	buf = appendString(buf, v.Root)
+	buf = appendString(buf, v.Path)
+	return appendString(buf, v.Language)
+}
+
+func appendVNameByCorpus(buf []byte, v *spb.VName) []byte {
+	if v == nil {
+		v = emptyVName
+	}
+	buf = appendString(buf, v.Corpus)
+	buf = appendString(buf, v.Root)
+	buf = appendString(buf, v.Path)
+	buf = appendString(buf, v.Signature)
+	return appendString(buf, v.Language)
+}
+
+func appendString(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == escapeByte {
+			buf = append(buf, escapeByte, escapedByte)
+		} else {
+			buf = append(buf, s[i])
+		}
+	}
+	return append(buf, escapeByte, terminatorByte)
+}
+
+func decodeVName(buf []byte) (*spb.VName, []byte, error) {
+	var (
+		v   spb.VName
+		err error
+	)
+	for _, field := range []*string{&v.Signature, &v.Corpus, &v.Root, &v.Path, &v.Language} {
+		if *field, buf, err = decodeString(buf); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &v, buf, nil
+}
+
+var errUnterminated = errors.New("unterminated string encoding")
+
+func decodeString(buf []byte) (string, []byte, error) {
+	var s []byte
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != escapeByte {
+			continue
+		} else if i+1 == len(buf) {
+			return "", nil, errUnterminated
+		}
+		switch buf[i+1] {
+		case terminatorByte:
+			return string(append(s, buf[:i]...)), buf[i+2:], nil
+		case escapedByte:
+			s = append(s, buf[:i+1]...)
+			buf = buf[i+2:]
+			i = -1
+		default:
+			return "", nil, fmt.Errorf("invalid escape sequence: %#x", buf[i:i+2])
+		}
+	}
+	return "", nil, errUnterminated
+}
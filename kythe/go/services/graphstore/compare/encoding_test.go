@@ -0,0 +1,162 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// randString returns a short string over an alphabet including the bytes
+// significant to the canonical encoding.
+func randString(rng *rand.Rand) string {
+	const alphabet = "\x00\x01\xffab"
+	b := make([]byte, rng.Intn(4))
+	for i := range b {
+		b[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+func randVName(rng *rand.Rand) *spb.VName {
+	switch rng.Intn(8) {
+	case 0:
+		return nil
+	case 1:
+		return &spb.VName{}
+	}
+	return &spb.VName{
+		Signature: randString(rng),
+		Corpus:    randString(rng),
+		Root:      randString(rng),
+		Path:      randString(rng),
+		Language:  randString(rng),
+	}
+}
+
+func randEntry(rng *rand.Rand) *spb.Entry {
+	e := &spb.Entry{
+		Source:    randVName(rng),
+		FactName:  randString(rng),
+		FactValue: []byte(randString(rng)),
+	}
+	if rng.Intn(2) == 0 {
+		e.EdgeKind = randString(rng)
+		e.Target = randVName(rng)
+	}
+	return e
+}
+
+func TestEncodeVNameRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 50000; i++ {
+		v1, v2 := randVName(rng), randVName(rng)
+		k1, k2 := EncodeVName(v1), EncodeVName(v2)
+
+		if got, want := Order(bytes.Compare(k1, k2)), VNames(v1, v2); got != want {
+			t.Fatalf("Encoded order of %v and %v is %v; want %v", v1, v2, got, want)
+		}
+		dec, err := DecodeVName(k1)
+		if err != nil {
+			t.Fatalf("DecodeVName(%q): unexpected error: %v", k1, err)
+		} else if !VNamesEqual(dec, v1) {
+			t.Fatalf("DecodeVName(EncodeVName(%v)) = %v", v1, dec)
+		}
+	}
+}
+
+func TestEncodeEntryKeyRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 50000; i++ {
+		e1, e2 := randEntry(rng), randEntry(rng)
+		if rng.Intn(4) == 0 {
+			// Exercise equal prefixes.
+			e2.Source = e1.Source
+		}
+		k1, k2 := EncodeEntryKey(e1), EncodeEntryKey(e2)
+
+		if got, want := Order(bytes.Compare(k1, k2)), Entries(e1, e2); got != want {
+			t.Fatalf("Encoded order of %v and %v is %v; want %v", e1, e2, got, want)
+		}
+		dec, err := DecodeEntryKey(k1)
+		if err != nil {
+			t.Fatalf("DecodeEntryKey(%q): unexpected error: %v", k1, err)
+		} else if Entries(dec, e1) != EQ || dec.FactValue != nil {
+			t.Fatalf("DecodeEntryKey(EncodeEntryKey(%v)) = %v", e1, dec)
+		}
+		if !bytes.HasPrefix(k1, EncodeKeyPrefix(e1.Source, "*")) {
+			t.Fatalf("EncodeEntryKey(%v) lacks the prefix for its source", e1)
+		} else if !bytes.HasPrefix(k1, EncodeKeyPrefix(e1.Source, e1.EdgeKind)) {
+			t.Fatalf("EncodeEntryKey(%v) lacks the prefix for its edge kind", e1)
+		} else if e1.EdgeKind != e2.EdgeKind && bytes.HasPrefix(k2, EncodeKeyPrefix(e1.Source, e1.EdgeKind)) {
+			t.Fatalf("EncodeEntryKey(%v) has the prefix of edge kind %q", e2, e1.EdgeKind)
+		}
+	}
+}
+
+func TestEncodeEntryKey(t *testing.T) {
+	e := &spb.Entry{
+		Source:   &spb.VName{Signature: "s\x00", Corpus: "c"},
+		EdgeKind: "/kythe/edge/ref",
+		FactName: "/",
+		Target:   &spb.VName{Path: "p"},
+	}
+	want := "s\x00\xff\x00\x01c\x00\x01\x00\x01\x00\x01\x00\x01" +
+		"/kythe/edge/ref\x00\x01/\x00\x01" +
+		"\x00\x01\x00\x01\x00\x01p\x00\x01\x00\x01"
+	key := EncodeEntryKey(e)
+	if string(key) != want {
+		t.Errorf("EncodeEntryKey(%v) = %q; want %q", e, key, want)
+	}
+	if dec, err := DecodeEntryKey(key); err != nil {
+		t.Errorf("DecodeEntryKey(%q): unexpected error: %v", key, err)
+	} else if !proto.Equal(dec, e) {
+		t.Errorf("DecodeEntryKey(%q) = %v; want %v", key, dec, e)
+	}
+
+	if dec, err := DecodeEntryKey(EncodeEntryKey(&spb.Entry{FactName: "/f"})); err != nil {
+		t.Errorf("DecodeEntryKey: unexpected error: %v", err)
+	} else if dec.Target != nil {
+		t.Errorf("DecodeEntryKey of a fact: found target %v; want nil", dec.Target)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	valid := EncodeVName(&spb.VName{Signature: "s", Language: "l"})
+	for _, key := range []string{
+		"",
+		"s",
+		"s\x00",
+		"s\x00\x02",
+		"\x00\x01\x00\x01\x00\x01\x00\x01",     // missing field
+		string(valid) + "x",                    // trailing bytes
+		string(valid[:len(valid)-1]),           // truncated terminator
+		string(valid) + "\x00\x01\x00\x01\x00", // trailing partial field
+	} {
+		if v, err := DecodeVName([]byte(key)); err == nil {
+			t.Errorf("DecodeVName(%q) = %v; want error", key, v)
+		}
+		if e, err := DecodeEntryKey([]byte(key)); err == nil {
+			t.Errorf("DecodeEntryKey(%q) = %v; want error", key, e)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// DefaultEntrySetMaxBytes is the default memory budget of an EntrySet.
+const DefaultEntrySetMaxBytes = 256 << 20
+
+const (
+	fingerprintSize = 16
+
+	// memFingerprintCost is the number of bytes charged to an EntrySet's budget
+	// for each fingerprint held in memory, including the overhead of its map
+	// entry.
+	memFingerprintCost = 48
+
+	// runBlockSize is the number of fingerprints in each block of a run on
+	// disk; one fingerprint of each block is held in memory as its index.
+	runBlockSize = 256
+
+	// minInMemory is the minimum number of fingerprints held in memory before
+	// they are spilled, however small the remaining budget.
+	minInMemory = 1024
+
+	// defaultMaxRuns is the default number of runs on disk after which they are
+	// merged into one.
+	defaultMaxRuns = 8
+)
+
+// ErrEntrySetFinished is returned by EntrySet.Add after EntrySet.Finish.
+var ErrEntrySetFinished = errors.New("EntrySet is finished")
+
+// EntrySetOptions controls the behavior of an EntrySet.
+type EntrySetOptions struct {
+	// MaxBytes is the approximate memory budget of the set.  Each fingerprint
+	// held in memory is charged 48 bytes and each run spilled to disk is charged
+	// 16 bytes for every 256 of its fingerprints (for its index).  Once the
+	// in-memory fingerprints exceed the remainder of the budget, they are
+	// written to disk as a sorted run.  The in-memory fingerprints are always
+	// allowed at least a quarter of the budget (and at least 1024 fingerprints),
+	// so a set exceeds a budget too small for the indexes of its runs.  If
+	// non-positive, DefaultEntrySetMaxBytes is used.
+	MaxBytes int
+
+	// MaxRuns is the maximum number of sorted runs kept on disk.  Runs are
+	// merged as they accumulate, each into a run of similar size, and all runs
+	// are merged into one if there are still more than MaxRuns.  Each Add of a
+	// new entry reads a block of each run, so fewer runs make Add faster at the
+	// cost of more merging.  If non-positive, a default of 8 is used.
+	MaxRuns int
+
+	// WorkDir is the directory used for the set's temporary files.  If empty,
+	// the default directory for temporary files is used.
+	WorkDir string
+}
+
+// An EntrySet is a set of entries (including their fact values) supporting
+// exact duplicate detection over more entries than fit in memory.  Entries are
+// represented by 128-bit fingerprints, so membership is exact barring a
+// fingerprint collision (with a chance of roughly n²/2¹²⁹ for n entries).
+// Fingerprints are held in memory up to a budget and then spilled to sorted
+// runs on disk, which are merged as they accumulate.
+//
+// An EntrySet is not safe for concurrent use.  Its temporary files are removed
+// by Finish, and also by an Add that fails, after which the set is unusable.
+type EntrySet struct {
+	opts EntrySetOptions
+
+	mem  map[fingerprint]struct{}
+	runs []*fingerprintRun
+	n    int64
+	err  error
+}
+
+type fingerprint [fingerprintSize]byte
+
+// NewEntrySet returns an empty EntrySet with the given options.
+func NewEntrySet(opts EntrySetOptions) *EntrySet {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultEntrySetMaxBytes
+	}
+	if opts.MaxRuns <= 0 {
+		opts.MaxRuns = defaultMaxRuns
+	}
+	return &EntrySet{
+		opts: opts,
+		mem:  make(map[fingerprint]struct{}),
+	}
+}
+
+// Add adds e to the set, reporting whether it was not already a member.
+func (s *EntrySet) Add(e *spb.Entry) (bool, error) {
+	if s.err != nil {
+		return false, s.err
+	}
+	fp := entryFingerprint128(e)
+	if _, ok := s.mem[fp]; ok {
+		return false, nil
+	}
+	for _, r := range s.runs {
+		if ok, err := r.contains(fp); err != nil {
+			return false, s.fail(err)
+		} else if ok {
+			return false, nil
+		}
+	}
+	s.mem[fp] = struct{}{}
+	s.n++
+	if len(s.mem) >= minInMemory && len(s.mem)*memFingerprintCost > s.memBudget() {
+		if err := s.spill(); err != nil {
+			return false, s.fail(err)
+		}
+	}
+	return true, nil
+}
+
+// Len returns the number of distinct entries added to the set.
+func (s *EntrySet) Len() int64 { return s.n }
+
+// Finish removes the temporary files of the set, after which each Add returns
+// ErrEntrySetFinished.  It is safe to call Finish more than once.
+func (s *EntrySet) Finish() error {
+	if s.err == nil {
+		s.err = ErrEntrySetFinished
+	}
+	err := s.removeRuns()
+	s.mem = nil
+	return err
+}
+
+// memBudget returns the number of bytes of the set's budget available to its
+// in-memory fingerprints.
+func (s *EntrySet) memBudget() int {
+	n := s.opts.MaxBytes
+	for _, r := range s.runs {
+		n -= len(r.index) * fingerprintSize
+	}
+	if min := s.opts.MaxBytes / 4; n < min {
+		return min
+	}
+	return n
+}
+
+// fail records err as the error of every future Add, removes the set's
+// temporary files, and returns err.
+func (s *EntrySet) fail(err error) error {
+	s.err = err
+	s.removeRuns()
+	s.mem = nil
+	return err
+}
+
+func (s *EntrySet) removeRuns() error {
+	var err error
+	for _, r := range s.runs {
+		if rerr := r.remove(); err == nil {
+			err = rerr
+		}
+	}
+	s.runs = nil
+	return err
+}
+
+// spill writes the in-memory fingerprints to a new run.  Each new run is
+// merged with its predecessor while it is at least half its predecessor's size,
+// so that runs grow geometrically, and then all runs are merged if there are
+// more than opts.MaxRuns.
+func (s *EntrySet) spill() error {
+	fps := make([]fingerprint, 0, len(s.mem))
+	for fp := range s.mem {
+		fps = append(fps, fp)
+	}
+	sort.Sort(fingerprints(fps))
+
+	w, err := s.newRunWriter()
+	if err != nil {
+		return err
+	}
+	for _, fp := range fps {
+		if err := w.put(fp); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	r, err := w.finish()
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, r)
+	s.mem = make(map[fingerprint]struct{})
+
+	for k := len(s.runs); k > 1 && 2*s.runs[k-1].n >= s.runs[k-2].n; k-- {
+		if err := s.mergeRuns(2); err != nil {
+			return err
+		}
+	}
+	if len(s.runs) > s.opts.MaxRuns {
+		return s.mergeRuns(len(s.runs))
+	}
+	return nil
+}
+
+// mergeRuns replaces the last k runs of s with a single run of their
+// fingerprints.
+func (s *EntrySet) mergeRuns(k int) error {
+	w, err := s.newRunWriter()
+	if err != nil {
+		return err
+	}
+	runs := append([]*fingerprintRun(nil), s.runs[len(s.runs)-k:]...)
+	var (
+		heads   = make([]fingerprint, k)
+		readers = make([]*bufio.Reader, k)
+		live    int
+	)
+	next := func(i int) (bool, error) {
+		if _, err := io.ReadFull(readers[i], heads[i][:]); err == io.EOF {
+			readers[i] = nil
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("error reading fingerprint run: %v", err)
+		}
+		return true, nil
+	}
+	for i, r := range runs {
+		readers[i] = bufio.NewReader(io.NewSectionReader(r.f, 0, r.n*fingerprintSize))
+		if ok, err := next(i); err != nil {
+			w.abort()
+			return err
+		} else if ok {
+			live++
+		}
+	}
+	// The runs are few, so the least head is found by a linear scan.
+	for live > 0 {
+		min := -1
+		for i, rd := range readers {
+			if rd != nil && (min < 0 || bytes.Compare(heads[i][:], heads[min][:]) < 0) {
+				min = i
+			}
+		}
+		if err := w.put(heads[min]); err != nil {
+			w.abort()
+			return err
+		}
+		if ok, err := next(min); err != nil {
+			w.abort()
+			return err
+		} else if !ok {
+			live--
+		}
+	}
+	r, err := w.finish()
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs[:len(s.runs)-k], r)
+	for _, old := range runs {
+		if rerr := old.remove(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+func (s *EntrySet) newRunWriter() (*runWriter, error) {
+	f, err := ioutil.TempFile(s.opts.WorkDir, "entryset.run")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %v", err)
+	}
+	return &runWriter{run: &fingerprintRun{f: f}, buf: bufio.NewWriter(f)}, nil
+}
+
+// A fingerprintRun is a temporary file of sorted fingerprints, indexed by the
+// first fingerprint of each of its blocks of runBlockSize fingerprints.
+type fingerprintRun struct {
+	f     *os.File
+	n     int64 // number of fingerprints
+	index []fingerprint
+	block []byte // buffer for reading a block
+}
+
+// contains reports whether r contains fp.
+func (r *fingerprintRun) contains(fp fingerprint) (bool, error) {
+	i := sort.Search(len(r.index), func(i int) bool { return bytes.Compare(r.index[i][:], fp[:]) > 0 }) - 1
+	if i < 0 {
+		return false, nil
+	}
+	start := int64(i) * runBlockSize
+	n := r.n - start
+	if n > runBlockSize {
+		n = runBlockSize
+	}
+	if r.block == nil {
+		r.block = make([]byte, runBlockSize*fingerprintSize)
+	}
+	block := r.block[:n*fingerprintSize]
+	if _, err := r.f.ReadAt(block, start*fingerprintSize); err != nil {
+		return false, fmt.Errorf("error reading fingerprint run: %v", err)
+	}
+	j := sort.Search(int(n), func(j int) bool {
+		return bytes.Compare(block[j*fingerprintSize:(j+1)*fingerprintSize], fp[:]) >= 0
+	})
+	return j < int(n) && bytes.Equal(block[j*fingerprintSize:(j+1)*fingerprintSize], fp[:]), nil
+}
+
+// remove closes and removes the file of r.
+func (r *fingerprintRun) remove() error {
+	cerr := r.f.Close()
+	if err := os.Remove(r.f.Name()); err != nil {
+		return err
+	}
+	return cerr
+}
+
+// A runWriter writes sorted fingerprints to a new fingerprintRun.
+type runWriter struct {
+	run *fingerprintRun
+	buf *bufio.Writer
+}
+
+func (w *runWriter) put(fp fingerprint) error {
+	if w.run.n%runBlockSize == 0 {
+		w.run.index = append(w.run.index, fp)
+	}
+	w.run.n++
+	if _, err := w.buf.Write(fp[:]); err != nil {
+		return fmt.Errorf("error writing fingerprint run: %v", err)
+	}
+	return nil
+}
+
+// finish flushes the run being written and returns it.  On error, the run is
+// removed.
+func (w *runWriter) finish() (*fingerprintRun, error) {
+	if err := w.buf.Flush(); err != nil {
+		w.abort()
+		return nil, fmt.Errorf("error writing fingerprint run: %v", err)
+	}
+	return w.run, nil
+}
+
+// abort removes the run being written.
+func (w *runWriter) abort() { w.run.remove() }
+
+type fingerprints []fingerprint
+
+func (s fingerprints) Len() int           { return len(s) }
+func (s fingerprints) Less(i, j int) bool { return bytes.Compare(s[i][:], s[j][:]) < 0 }
+func (s fingerprints) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// entryFingerprint128 returns a 128-bit fingerprint of e, including its fact
+// value: the first 128 bits of the SHA-256 hash of its length-prefixed fields
+// (see EntryFingerprint) followed by its length-prefixed fact value.
+func entryFingerprint128(e *spb.Entry) (fp fingerprint) {
+	if e == nil {
+		e = emptyEntry
+	}
+	h := sha256.New()
+	writeVNameFields(h, e.Source)
+	writeField(h, e.EdgeKind)
+	writeField(h, e.FactName)
+	writeVNameFields(h, e.Target)
+	writeBytesField(h, e.FactValue)
+	copy(fp[:], h.Sum(nil))
+	return
+}
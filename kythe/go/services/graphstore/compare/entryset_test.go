@@ -0,0 +1,185 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func testEntry(i int) *spb.Entry {
+	return &spb.Entry{
+		Source:    &spb.VName{Signature: fmt.Sprint("sig", i/3), Corpus: "kythe"},
+		FactName:  "/kythe/text",
+		FactValue: []byte(fmt.Sprint(i % 3)),
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "entryset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func dirFiles(t *testing.T, dir string) int {
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(names)
+}
+
+func TestEntrySet(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	const n = 50000
+	s := NewEntrySet(EntrySetOptions{
+		MaxBytes: minInMemory * memFingerprintCost,
+		MaxRuns:  3,
+		WorkDir:  dir,
+	})
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < n; i++ {
+			if added, err := s.Add(testEntry(i)); err != nil {
+				t.Fatalf("Add(%d) error: %v", i, err)
+			} else if added != (pass == 0) {
+				t.Fatalf("Add(%d) in pass %d: %v; want %v", i, pass, added, pass == 0)
+			}
+			if len(s.runs) > 3 {
+				t.Fatalf("Found %d runs; want at most 3", len(s.runs))
+			}
+		}
+	}
+	if s.Len() != n {
+		t.Errorf("Len: %d; want %d", s.Len(), n)
+	}
+	if len(s.runs) == 0 {
+		t.Fatal("No fingerprints were spilled to disk")
+	}
+	if files := dirFiles(t, dir); files != len(s.runs) {
+		t.Errorf("Found %d temporary files; want %d", files, len(s.runs))
+	}
+	var spilled int64
+	for _, r := range s.runs {
+		spilled += r.n
+	}
+	if total := spilled + int64(len(s.mem)); total != n {
+		t.Errorf("Found %d fingerprints in memory and on disk; want %d", total, n)
+	}
+
+	if err := s.Finish(); err != nil {
+		t.Fatal(err)
+	} else if files := dirFiles(t, dir); files != 0 {
+		t.Errorf("Found %d temporary files after Finish", files)
+	}
+	if _, err := s.Add(testEntry(n)); err != ErrEntrySetFinished {
+		t.Errorf("Add after Finish error: %v; want %v", err, ErrEntrySetFinished)
+	}
+	if err := s.Finish(); err != nil {
+		t.Errorf("Second Finish error: %v", err)
+	}
+}
+
+func TestEntrySetInMemory(t *testing.T) {
+	s := NewEntrySet(EntrySetOptions{WorkDir: "/nonexistent/dir"})
+	defer s.Finish()
+	for _, e := range []*spb.Entry{nil, testEntry(0), testEntry(1)} {
+		if added, err := s.Add(e); err != nil {
+			t.Fatal(err)
+		} else if !added {
+			t.Errorf("Add(%v) = false for a new entry", e)
+		}
+		if added, err := s.Add(e); err != nil {
+			t.Fatal(err)
+		} else if added {
+			t.Errorf("Add(%v) = true for a duplicate entry", e)
+		}
+	}
+	if added, err := s.Add(new(spb.Entry)); err != nil {
+		t.Fatal(err)
+	} else if added {
+		t.Error("An empty entry was not a duplicate of nil")
+	}
+}
+
+func TestEntrySetBudget(t *testing.T) {
+	const maxBytes = 100 * runBlockSize * memFingerprintCost
+	s := NewEntrySet(EntrySetOptions{MaxBytes: maxBytes})
+	if got := s.memBudget(); got != maxBytes {
+		t.Errorf("Initial budget: %d; want %d", got, maxBytes)
+	}
+	s.runs = []*fingerprintRun{{index: make([]fingerprint, 10)}}
+	if got, want := s.memBudget(), maxBytes-10*fingerprintSize; got != want {
+		t.Errorf("Budget with a run of 10 blocks: %d; want %d", got, want)
+	}
+	s.runs = append(s.runs, &fingerprintRun{index: make([]fingerprint, maxBytes/fingerprintSize)})
+	if got, want := s.memBudget(), maxBytes/4; got != want {
+		t.Errorf("Budget with an oversized index: %d; want %d", got, want)
+	}
+}
+
+func TestEntrySetErrors(t *testing.T) {
+	opts := EntrySetOptions{
+		MaxBytes: minInMemory * memFingerprintCost,
+		WorkDir:  "/nonexistent/dir",
+	}
+	s := NewEntrySet(opts)
+	var err error
+	for i := 0; err == nil; i++ {
+		if i > 2*minInMemory {
+			t.Fatal("Fingerprints were never spilled")
+		}
+		_, err = s.Add(testEntry(i))
+	}
+	if _, err2 := s.Add(testEntry(0)); err2 != err {
+		t.Errorf("Add after failure error: %v; want %v", err2, err)
+	}
+
+	// Fail reading a run, which must remove all temporary files.
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	opts.WorkDir = dir
+	s = NewEntrySet(opts)
+	for i := 0; len(s.runs) < 2; i++ {
+		if _, err := s.Add(testEntry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files := dirFiles(t, dir); files != len(s.runs) {
+		t.Fatalf("Found %d temporary files; want %d", files, len(s.runs))
+	}
+	for _, r := range s.runs {
+		r.f.Close()
+	}
+	if _, err := s.Add(testEntry(0)); err == nil {
+		t.Error("Add succeeded despite an unreadable run")
+	}
+	if files := dirFiles(t, dir); files != 0 {
+		t.Errorf("Found %d temporary files after a failed Add", files)
+	}
+	if err := s.Finish(); err != nil {
+		t.Errorf("Finish after failure error: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"io"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// VNameFingerprint returns a 64-bit fingerprint of v for use in sharding,
+// filtering, and approximate counting.  The fingerprint is the 64-bit FNV-1a
+// hash of the [signature, corpus, root, path, language] fields of v, each
+// preceded by its length as a uvarint, and is stable across releases.  A nil
+// VName has the fingerprint of an empty VName.
+func VNameFingerprint(v *spb.VName) uint64 {
+	h := fnv.New64a()
+	writeVNameFields(h, v)
+	return h.Sum64()
+}
+
+// EntryFingerprint returns a 64-bit fingerprint of the key of e: the 64-bit
+// FNV-1a hash of the length-prefixed fields of its source, edge kind, fact
+// name, and target, in that order (see VNameFingerprint).  The fact value of e
+// is not included.  Like VNameFingerprint, it is stable across releases.  As
+// distinct keys may share a 64-bit fingerprint, it must not be used alone to
+// decide whether two entries are equal; an EntrySet instead hashes the full
+// length-prefixed key fields and fact value of each entry.
+func EntryFingerprint(e *spb.Entry) uint64 {
+	if e == nil {
+		e = emptyEntry
+	}
+	h := fnv.New64a()
+	writeVNameFields(h, e.Source)
+	writeField(h, e.EdgeKind)
+	writeField(h, e.FactName)
+	writeVNameFields(h, e.Target)
+	return h.Sum64()
+}
+
+func writeVNameFields(h hash.Hash, v *spb.VName) {
+	if v == nil {
+		v = emptyVName
+	}
+	writeField(h, v.Signature)
+	writeField(h, v.Corpus)
+	writeField(h, v.Root)
+	writeField(h, v.Path)
+	writeField(h, v.Language)
+}
+
+func writeField(h hash.Hash, s string) {
+	var buf [binary.MaxVarintLen64]byte
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(s)))])
+	io.WriteString(h, s)
+}
+
+func writeBytesField(h hash.Hash, b []byte) {
+	var buf [binary.MaxVarintLen64]byte
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(b)))])
+	h.Write(b)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"testing"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func TestVNameFingerprintCollisions(t *testing.T) {
+	// Each group holds distinct VNames conflated by a naive concatenation of
+	// their fields (with or without a separator).
+	tests := [][]*spb.VName{
+		{{Signature: "a", Corpus: "b"}, {Signature: "ab"}, {Corpus: "ab"}},
+		{{Signature: "a", Language: "b"}, {Signature: "a", Path: "b"}},
+		{{Signature: "a\x00", Corpus: "b"}, {Signature: "a", Corpus: "\x00b"}},
+		{{Signature: "a/", Corpus: "b"}, {Signature: "a", Corpus: "/b"}},
+		{{Signature: "\x01a"}, {Signature: "\x01", Corpus: "a"}},
+		{{}, {Signature: "\x00"}, {Signature: "\x00\x00\x00\x00"}},
+	}
+	for _, group := range tests {
+		for i, v1 := range group {
+			for _, v2 := range group[i+1:] {
+				if VNameFingerprint(v1) == VNameFingerprint(v2) {
+					t.Errorf("VNameFingerprint(%v) == VNameFingerprint(%v)", v1, v2)
+				}
+			}
+		}
+	}
+
+	if VNameFingerprint(nil) != VNameFingerprint(&spb.VName{}) {
+		t.Error("VNameFingerprint(nil) != VNameFingerprint(empty VName)")
+	}
+}
+
+func TestFingerprintStability(t *testing.T) {
+	// These values must never change; stored shard assignments and filters
+	// depend on them.
+	tests := []struct {
+		v    *spb.VName
+		want uint64
+	}{
+		{nil, 0xe4bc4fd9252be94f},
+		{&spb.VName{}, 0xe4bc4fd9252be94f},
+		{&spb.VName{Signature: "sig", Corpus: "kythe", Root: "root", Path: "path", Language: "go"}, 0x1fb68a40dc165306},
+	}
+	for _, test := range tests {
+		if got := VNameFingerprint(test.v); got != test.want {
+			t.Errorf("VNameFingerprint(%v) = %#x; want %#x", test.v, got, test.want)
+		}
+	}
+	if got, want := EntryFingerprint(&spb.Entry{Source: tests[2].v, FactName: "/"}), VNameFingerprint(nil); got == want {
+		t.Errorf("EntryFingerprint = %#x; want a distinct fingerprint", got)
+	}
+}
+
+func TestEntryFingerprintCollisions(t *testing.T) {
+	src := &spb.VName{Signature: "s"}
+	tests := []*spb.Entry{
+		{Source: src, FactName: "/a"},
+		{Source: src, EdgeKind: "/a", FactName: ""},
+		{Source: src, EdgeKind: "/e", FactName: "/", Target: &spb.VName{Signature: "t"}},
+		{Source: src, EdgeKind: "/e/", Target: &spb.VName{Signature: "t"}},
+		{Source: src, EdgeKind: "/e", FactName: "/t"},
+		{Source: &spb.VName{Signature: "s/e"}, FactName: "/"},
+		{Source: src, EdgeKind: "/e", FactName: "/", Target: &spb.VName{Corpus: "t"}},
+	}
+	for i, e1 := range tests {
+		for _, e2 := range tests[i+1:] {
+			if EntryFingerprint(e1) == EntryFingerprint(e2) {
+				t.Errorf("EntryFingerprint(%v) == EntryFingerprint(%v)", e1, e2)
+			}
+		}
+	}
+
+	e := &spb.Entry{Source: src, FactName: "/a", FactValue: []byte("1")}
+	if EntryFingerprint(e) != EntryFingerprint(&spb.Entry{Source: src, FactName: "/a", FactValue: []byte("2")}) {
+		t.Error("EntryFingerprint depends on the fact value")
+	}
+	if EntryFingerprint(nil) != EntryFingerprint(&spb.Entry{}) {
+		t.Error("EntryFingerprint(nil) != EntryFingerprint(empty Entry)")
+	}
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"bytes"
+	"sort"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// A KeyedEntry is an entry with its precomputed canonical key (see
+// EncodeEntryKey).  Comparing the keys of KeyedEntries is equivalent to
+// comparing their entries by Entries, but avoids re-examining each entry's
+// fields on every comparison.
+type KeyedEntry struct {
+	Key   []byte
+	Entry *spb.Entry
+}
+
+// NewKeyedEntry returns a KeyedEntry for e.
+func NewKeyedEntry(e *spb.Entry) KeyedEntry { return KeyedEntry{EncodeEntryKey(e), e} }
+
+// Compare returns LT, EQ, or GT if the entry of k precedes, shares a key with,
+// or follows the entry of o, respectively; as Entries would.
+func (k KeyedEntry) Compare(o KeyedEntry) Order { return Order(bytes.Compare(k.Key, o.Key)) }
+
+// SortKeyed sorts entries by their keys, and so into Entries order.
+func SortKeyed(entries []KeyedEntry) { sort.Sort(byKeys(entries)) }
+
+type byKeys []KeyedEntry
+
+func (s byKeys) Len() int           { return len(s) }
+func (s byKeys) Less(i, j int) bool { return bytes.Compare(s[i].Key, s[j].Key) < 0 }
+func (s byKeys) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func TestSortKeyed(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	entries := make([]*spb.Entry, 10000)
+	keyed := make([]KeyedEntry, len(entries))
+	for i := range entries {
+		entries[i] = randEntry(rng)
+		keyed[i] = NewKeyedEntry(entries[i])
+	}
+	SortEntries(entries)
+	SortKeyed(keyed)
+
+	for i, k := range keyed {
+		if c := Entries(k.Entry, entries[i]); c != EQ {
+			t.Fatalf("SortKeyed: entry %d is %v; want %v", i, k.Entry, entries[i])
+		}
+		if i > 0 {
+			if got, want := keyed[i-1].Compare(k), Entries(keyed[i-1].Entry, k.Entry); got != want {
+				t.Errorf("Compare(%v, %v) = %v; want %v", keyed[i-1].Entry, k.Entry, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeEntryKeyBy(t *testing.T) {
+	rng := rand.New(rand.NewSource(5))
+	for _, order := range []EntryOrder{StandardOrder, CorpusOrder} {
+		cmp := EntriesBy(order)
+		for i := 0; i < 50000; i++ {
+			e1, e2 := randEntry(rng), randEntry(rng)
+			k1, k2 := EncodeEntryKeyBy(order, e1), EncodeEntryKeyBy(order, e2)
+			if got, want := Order(bytes.Compare(k1, k2)), cmp(e1, e2); got != want {
+				t.Fatalf("Encoded %v order of %v and %v is %v; want %v", order, e1, e2, got, want)
+			}
+		}
+	}
+}
+
+// syntheticEntries returns n entries resembling an indexer's output: a
+// handful of facts and edges for each of n/8 nodes, in a random order.
+func syntheticEntries(n int) []*spb.Entry {
+	rng := rand.New(rand.NewSource(4))
+	entries := make([]*spb.Entry, n)
+	for i := range entries {
+		node := rng.Intn(n/8 + 1)
+		e := &spb.Entry{
+			Source: &spb.VName{
+				Signature: fmt.Sprintf("sig%d", node),
+				Corpus:    "kythe",
+				Path:      fmt.Sprintf("kythe/go/file%d.go", node%1000),
+				Language:  "go",
+			},
+			FactName:  fmt.Sprintf("/kythe/fact%d", rng.Intn(4)),
+			FactValue: []byte("value"),
+		}
+		if rng.Intn(2) == 0 {
+			e.EdgeKind = fmt.Sprintf("/kythe/edge/kind%d", rng.Intn(4))
+			e.FactName = "/"
+			e.Target = &spb.VName{Signature: fmt.Sprintf("sig%d", rng.Intn(n/8+1)), Corpus: "kythe", Language: "go"}
+		}
+		entries[i] = e
+	}
+	return entries
+}
+
+const benchmarkEntries = 1000000
+
+func BenchmarkSortEntries(b *testing.B) {
+	entries := syntheticEntries(benchmarkEntries)
+	sorted := make([]*spb.Entry, len(entries))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(sorted, entries)
+		SortEntries(sorted)
+	}
+}
+
+func BenchmarkSortKeyed(b *testing.B) {
+	entries := syntheticEntries(benchmarkEntries)
+	keyed := make([]KeyedEntry, len(entries))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Include the cost of computing the keys.
+		for j, e := range entries {
+			keyed[j] = NewKeyedEntry(e)
+		}
+		SortKeyed(keyed)
+	}
+}
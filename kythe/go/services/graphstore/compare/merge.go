@@ -0,0 +1,155 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+
+	"kythe.io/kythe/go/platform/delimited"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// An EntryStream is a sequence of entries in Entries order.  Next returns a
+// nil entry and io.EOF once the stream is exhausted.
+type EntryStream interface {
+	Next() (*spb.Entry, error)
+}
+
+// DelimitedStream returns an EntryStream of the delimited Entry protos read
+// from rd.
+func DelimitedStream(rd *delimited.Reader) EntryStream { return delimitedStream{rd} }
+
+type delimitedStream struct{ rd *delimited.Reader }
+
+// Next implements the EntryStream interface.
+func (s delimitedStream) Next() (*spb.Entry, error) {
+	var e spb.Entry
+	if err := s.rd.NextProto(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// MergeOptions controls the behavior of MergeEntries.
+type MergeOptions struct {
+	// Order is the order of the streams and of the merged entries (see
+	// EntriesBy).  By default, entries are merged in Entries order.
+	Order EntryOrder
+
+	// DropDuplicates causes each entry equal (by EntriesEqual) to the
+	// previously merged entry to be dropped.  Since entries with equal keys are
+	// merged by fact value, this drops the exact duplicates across streams;
+	// entries sharing a key but with different fact values are all kept.
+	DropDuplicates bool
+}
+
+// A StreamError is returned by MergeEntries when reading from one of its
+// streams fails.
+type StreamError struct {
+	Index int // index of the failing stream
+	Err   error
+}
+
+// Error implements the error interface.
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("error reading entry stream %d: %v", e.Index, e.Err)
+}
+
+// MergeEntries calls f with each entry of the given streams, merged into
+// Entries order (or the given opts.Order).  Entries with equal keys are merged
+// by fact value and then by the index of their stream.  Each step of the merge costs O(log N) for N
+// streams.  If reading a stream fails, or a stream yields its entries out of
+// order, MergeEntries returns a *StreamError.  If f returns io.EOF,
+// MergeEntries stops and returns nil.
+func MergeEntries(streams []EntryStream, f func(*spb.Entry) error, opts MergeOptions) error {
+	h := streamHeap{compare: EntriesBy(opts.Order), heads: make([]*streamHead, 0, len(streams))}
+	for i, s := range streams {
+		e, err := s.Next()
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			return &StreamError{Index: i, Err: err}
+		}
+		h.heads = append(h.heads, &streamHead{entry: e, index: i})
+	}
+	heap.Init(&h)
+
+	var last *spb.Entry
+	for len(h.heads) > 0 {
+		head := h.heads[0]
+		e := head.entry
+		if !opts.DropDuplicates || last == nil || !EntriesEqual(last, e) {
+			if err := f(e); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		last = e
+
+		next, err := streams[head.index].Next()
+		if err == io.EOF {
+			heap.Pop(&h)
+			continue
+		} else if err != nil {
+			return &StreamError{Index: head.index, Err: err}
+		} else if h.compare(e, next) == GT {
+			return &StreamError{Index: head.index, Err: fmt.Errorf("entries out of order: %v followed by %v", e, next)}
+		}
+		head.entry = next
+		heap.Fix(&h, 0)
+	}
+	return nil
+}
+
+// streamHead is the current entry of the stream with the given index.
+type streamHead struct {
+	entry *spb.Entry
+	index int
+}
+
+// streamHeap is a min-heap of streamHeads ordered by their entries (including
+// fact values) and then by stream index, so that equal entries from different
+// streams are adjacent.
+type streamHeap struct {
+	compare func(e1, e2 *spb.Entry) Order
+	heads   []*streamHead
+}
+
+func (h streamHeap) Len() int      { return len(h.heads) }
+func (h streamHeap) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+func (h streamHeap) Less(i, j int) bool {
+	a, b := h.heads[i], h.heads[j]
+	if c := h.compare(a.entry, b.entry); c != EQ {
+		return c == LT
+	} else if c := bytes.Compare(a.entry.FactValue, b.entry.FactValue); c != 0 {
+		return c < 0
+	}
+	return a.index < b.index
+}
+
+func (h *streamHeap) Push(v interface{}) { h.heads = append(h.heads, v.(*streamHead)) }
+func (h *streamHeap) Pop() interface{} {
+	n := len(h.heads) - 1
+	out := h.heads[n]
+	h.heads = h.heads[:n]
+	return out
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"kythe.io/kythe/go/platform/delimited"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// sliceStream is an EntryStream of a slice of entries, failing with err (if
+// non-nil) once they are exhausted.
+type sliceStream struct {
+	entries []*spb.Entry
+	err     error
+}
+
+func (s *sliceStream) Next() (*spb.Entry, error) {
+	if len(s.entries) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	e := s.entries[0]
+	s.entries = s.entries[1:]
+	return e, nil
+}
+
+func mergeAll(t *testing.T, streams []EntryStream, opts MergeOptions) []*spb.Entry {
+	var merged []*spb.Entry
+	if err := MergeEntries(streams, func(e *spb.Entry) error {
+		merged = append(merged, e)
+		return nil
+	}, opts); err != nil {
+		t.Fatalf("MergeEntries: unexpected error: %v", err)
+	}
+	return merged
+}
+
+func TestMergeEntries(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	for _, numStreams := range []int{0, 1, 2, 10, 5000} {
+		var (
+			all     []*spb.Entry
+			streams []EntryStream
+		)
+		for i := 0; i < numStreams; i++ {
+			// Facts with overlapping keys and values, so that some are duplicated
+			// across streams.  Each stream has unique keys.
+			keys := make(map[string]bool)
+			var entries []*spb.Entry
+			for j := rng.Intn(8); j > 0; j-- {
+				e := &spb.Entry{
+					Source:    &spb.VName{Signature: fmt.Sprintf("s%d", rng.Intn(20))},
+					FactName:  fmt.Sprintf("/f%d", rng.Intn(3)),
+					FactValue: []byte(fmt.Sprintf("v%d", rng.Intn(2))),
+				}
+				if key := e.Source.Signature + e.FactName; !keys[key] {
+					keys[key] = true
+					entries = append(entries, e)
+				}
+			}
+			SortEntries(entries)
+			all = append(all, entries...)
+			streams = append(streams, &sliceStream{entries: entries})
+		}
+		sort.Sort(byValueEntries(all))
+
+		streamsCopy := func() []EntryStream {
+			var ss []EntryStream
+			for _, s := range streams {
+				ss = append(ss, &sliceStream{entries: s.(*sliceStream).entries})
+			}
+			return ss
+		}
+
+		if merged := mergeAll(t, streamsCopy(), MergeOptions{}); !reflect.DeepEqual(merged, all) {
+			t.Errorf("MergeEntries of %d streams: found %d entries; want %d entries %v", numStreams, len(merged), len(all), all)
+		}
+
+		var unique []*spb.Entry
+		for _, e := range all {
+			if len(unique) == 0 || !EntriesEqual(unique[len(unique)-1], e) {
+				unique = append(unique, e)
+			}
+		}
+		merged := mergeAll(t, streamsCopy(), MergeOptions{DropDuplicates: true})
+		if !reflect.DeepEqual(merged, unique) {
+			t.Errorf("MergeEntries of %d streams with DropDuplicates: found %d entries; want %d entries", numStreams, len(merged), len(unique))
+		}
+		for i := 1; i < len(merged); i++ {
+			if Entries(merged[i-1], merged[i]) == GT {
+				t.Errorf("MergeEntries of %d streams: entries out of order: %v followed by %v", numStreams, merged[i-1], merged[i])
+			}
+		}
+	}
+}
+
+type byValueEntries []*spb.Entry
+
+func (s byValueEntries) Len() int           { return len(s) }
+func (s byValueEntries) Less(i, j int) bool { return ValueEntries(s[i], s[j]) == LT }
+func (s byValueEntries) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func TestMergeEntriesErrors(t *testing.T) {
+	fact := func(sig string) *spb.Entry {
+		return &spb.Entry{Source: &spb.VName{Signature: sig}, FactName: "/"}
+	}
+	errRead := errors.New("read failure")
+
+	tests := []struct {
+		streams []EntryStream
+		index   int
+	}{
+		{[]EntryStream{&sliceStream{err: errRead}}, 0},
+		{[]EntryStream{
+			&sliceStream{entries: []*spb.Entry{fact("a"), fact("d")}},
+			&sliceStream{entries: []*spb.Entry{fact("b")}},
+			&sliceStream{entries: []*spb.Entry{fact("c")}, err: errRead},
+		}, 2},
+		{[]EntryStream{
+			&sliceStream{entries: []*spb.Entry{fact("a")}},
+			&sliceStream{entries: []*spb.Entry{fact("b"), fact("a")}},
+		}, 1},
+	}
+	for _, test := range tests {
+		err := MergeEntries(test.streams, func(*spb.Entry) error { return nil }, MergeOptions{})
+		if serr, ok := err.(*StreamError); !ok {
+			t.Errorf("MergeEntries: found error %v; want *StreamError", err)
+		} else if serr.Index != test.index {
+			t.Errorf("MergeEntries: found error for stream %d; want stream %d: %v", serr.Index, test.index, err)
+		}
+	}
+
+	errCallback := errors.New("callback failure")
+	streams := []EntryStream{&sliceStream{entries: []*spb.Entry{fact("a")}}}
+	if err := MergeEntries(streams, func(*spb.Entry) error { return errCallback }, MergeOptions{}); err != errCallback {
+		t.Errorf("MergeEntries: found error %v; want %v", err, errCallback)
+	}
+
+	var n int
+	streams = []EntryStream{
+		&sliceStream{entries: []*spb.Entry{fact("a"), fact("c")}},
+		&sliceStream{entries: []*spb.Entry{fact("b")}, err: errRead},
+	}
+	if err := MergeEntries(streams, func(*spb.Entry) error {
+		n++
+		return io.EOF
+	}, MergeOptions{}); err != nil {
+		t.Errorf("MergeEntries: unexpected error: %v", err)
+	} else if n != 1 {
+		t.Errorf("MergeEntries: found %d entries after io.EOF; want 1", n)
+	}
+}
+
+func TestDelimitedStream(t *testing.T) {
+	entries := []*spb.Entry{
+		{Source: &spb.VName{Signature: "a"}, FactName: "/a", FactValue: []byte("1")},
+		{Source: &spb.VName{Signature: "b"}, EdgeKind: "/e", FactName: "/", Target: &spb.VName{Signature: "a"}},
+		{Source: &spb.VName{Signature: "c"}, FactName: "/c"},
+	}
+	var buf bytes.Buffer
+	wr := delimited.NewWriter(&buf)
+	for _, e := range entries {
+		if err := wr.PutProto(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	merged := mergeAll(t, []EntryStream{
+		DelimitedStream(delimited.NewReader(bytes.NewReader(buf.Bytes()))),
+		&sliceStream{entries: entries[1:2]},
+	}, MergeOptions{DropDuplicates: true})
+	if len(merged) != len(entries) {
+		t.Fatalf("Found %d entries; want %d", len(merged), len(entries))
+	}
+	for i, e := range merged {
+		if !EntriesEqual(e, entries[i]) {
+			t.Errorf("Entry %d: found %v; want %v", i, e, entries[i])
+		}
+	}
+
+	// A truncated stream reports its failure.
+	rd := delimited.NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err := MergeEntries([]EntryStream{DelimitedStream(rd)}, func(*spb.Entry) error { return nil }, MergeOptions{}); err == nil {
+		t.Error("MergeEntries of a truncated stream succeeded; expected an error")
+	}
+}
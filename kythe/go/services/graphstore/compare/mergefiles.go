@@ -0,0 +1,304 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"kythe.io/kythe/go/platform/delimited"
+	"kythe.io/kythe/go/util/disksort"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// MergeFilesOptions controls the behavior of MergeFiles.
+type MergeFilesOptions struct {
+	// Order is the order of the merged output (see EntriesBy).  By default,
+	// entries are written in Entries order.
+	Order EntryOrder
+
+	// Dedup causes each set of equal entries (see EntriesEqual) to be written
+	// only once.
+	Dedup bool
+
+	// MaxInMemory is the maximum number of entries of unsorted inputs to hold
+	// in memory before spilling them to a temporary file.  If non-positive,
+	// disksort.DefaultMaxInMemory is used.
+	MaxInMemory int
+
+	// WorkDir is the directory used for temporary files.  If empty, the default
+	// directory for temporary files is used.
+	WorkDir string
+}
+
+// MergeFilesStats reports the totals of a MergeFiles.
+type MergeFilesStats struct {
+	Read    int64 // entries read from the inputs
+	Deduped int64 // duplicate entries dropped
+	Written int64 // entries written to the output
+}
+
+// MergeFiles reads the delimited Entry protos of each input and writes them to
+// output as a single delimited stream, sorted in opts.Order (and then by fact
+// value), dropping duplicates if opts.Dedup is set.
+//
+// Each input is checked to be sorted as it is read.  A sorted input that is an
+// io.Seeker is then re-read from its original offset and merged directly; any
+// other input is copied to a temporary file until its first out-of-order
+// entry.  The remainder of each unsorted input (or all of a seekable one) is
+// externally sorted together with the others, holding at most
+// opts.MaxInMemory entries in memory, and the sorted inputs, copies, and
+// sorted remainders are k-way merged to output.
+func MergeFiles(ctx context.Context, output io.Writer, inputs []io.Reader, opts MergeFilesOptions) (*MergeFilesStats, error) {
+	m := &fileMerger{
+		opts:    opts,
+		compare: EntriesBy(opts.Order),
+	}
+	defer m.cleanup()
+
+	var streams []EntryStream
+	for i, r := range inputs {
+		s, err := m.check(ctx, r)
+		if err != nil {
+			return nil, fmt.Errorf("error reading input %d: %v", i, err)
+		} else if s != nil {
+			streams = append(streams, s)
+		}
+	}
+	if m.sorter != nil {
+		iter, err := m.sorter.Iterator()
+		if err != nil {
+			return nil, fmt.Errorf("error sorting entries: %v", err)
+		}
+		m.iter = iter
+		streams = append(streams, iteratorStream{iter})
+	}
+
+	buf := bufio.NewWriter(output)
+	wr := delimited.NewWriter(buf)
+	var (
+		stats MergeFilesStats
+		last  *spb.Entry
+	)
+	if err := MergeEntries(streams, func(e *spb.Entry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		stats.Read++
+		if opts.Dedup && last != nil && EntriesEqual(last, e) {
+			stats.Deduped++
+			return nil
+		}
+		last = e
+		stats.Written++
+		return wr.PutProto(e)
+	}, MergeOptions{Order: opts.Order}); err != nil {
+		return nil, err
+	}
+	if err := buf.Flush(); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+type fileMerger struct {
+	opts    MergeFilesOptions
+	compare func(e1, e2 *spb.Entry) Order
+
+	runs   []*os.File // temporary copies of sorted input prefixes
+	sorter disksort.Interface
+	iter   disksort.Iterator
+}
+
+// inOrder reports whether e may follow last in a sorted input.
+func (m *fileMerger) inOrder(last, e *spb.Entry) bool {
+	c := m.compare(last, e)
+	return c == LT || c == EQ && bytes.Compare(last.FactValue, e.FactValue) <= 0
+}
+
+// check reads r to determine whether it is sorted, returning the stream from
+// which its sorted entries are to be merged (if any).  Entries that must be
+// sorted are instead added to m.sorter.
+func (m *fileMerger) check(ctx context.Context, r io.Reader) (EntryStream, error) {
+	var start int64 = -1
+	if s, ok := r.(io.Seeker); ok {
+		if off, err := s.Seek(0, io.SeekCurrent); err == nil {
+			start = off
+		}
+	}
+
+	var (
+		run   *bufio.Writer
+		runWr *delimited.Writer
+	)
+	if start < 0 {
+		f, err := ioutil.TempFile(m.opts.WorkDir, "merge.run")
+		if err != nil {
+			return nil, fmt.Errorf("error creating temporary file: %v", err)
+		}
+		m.runs = append(m.runs, f)
+		run = bufio.NewWriter(f)
+		runWr = delimited.NewWriter(run)
+	}
+
+	rd := delimited.NewReader(r)
+	var last *spb.Entry
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rec, err := rd.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		e := new(spb.Entry)
+		if err := proto.Unmarshal(rec, e); err != nil {
+			return nil, fmt.Errorf("invalid entry: %v", err)
+		}
+		if last != nil && !m.inOrder(last, e) {
+			if run == nil {
+				// Sort the whole of a seekable input rather than keeping a copy of
+				// its sorted prefix.
+				if _, err := r.(io.Seeker).Seek(start, io.SeekStart); err != nil {
+					return nil, err
+				}
+				return nil, m.sort(ctx, delimited.NewReader(r), nil)
+			} else if err := m.sort(ctx, rd, e); err != nil {
+				return nil, err
+			}
+			break
+		}
+		last = e
+		if run != nil {
+			if err := runWr.Put(rec); err != nil {
+				return nil, fmt.Errorf("error writing temporary file: %v", err)
+			}
+		}
+	}
+
+	if run == nil {
+		if _, err := r.(io.Seeker).Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return DelimitedStream(delimited.NewReader(r)), nil
+	}
+	f := m.runs[len(m.runs)-1]
+	if err := run.Flush(); err != nil {
+		return nil, fmt.Errorf("error writing temporary file: %v", err)
+	} else if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return DelimitedStream(delimited.NewReader(f)), nil
+}
+
+// sort adds first (if non-nil) and the remaining entries of rd to m.sorter.
+func (m *fileMerger) sort(ctx context.Context, rd *delimited.Reader, first *spb.Entry) error {
+	if m.sorter == nil {
+		sorter, err := disksort.NewMergeSorter(disksort.MergeOptions{
+			Lesser:      keyedLesser{},
+			Marshaler:   keyedMarshaler{m.opts.Order},
+			WorkDir:     m.opts.WorkDir,
+			MaxInMemory: m.opts.MaxInMemory,
+		})
+		if err != nil {
+			return fmt.Errorf("error creating entry sorter: %v", err)
+		}
+		m.sorter = sorter
+	}
+	for e := first; ; {
+		if e != nil {
+			if err := m.sorter.Add(KeyedEntry{EncodeEntryKeyBy(m.opts.Order, e), e}); err != nil {
+				return fmt.Errorf("error sorting entries: %v", err)
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e = new(spb.Entry)
+		if err := rd.NextProto(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// cleanup removes the temporary files of m.
+func (m *fileMerger) cleanup() {
+	if m.iter != nil {
+		m.iter.Close()
+	} else if m.sorter != nil {
+		// Reading the sorter removes its temporary files.
+		m.sorter.Read(func(interface{}) error { return io.EOF })
+	}
+	for _, f := range m.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// iteratorStream is an EntryStream of the KeyedEntry values of a disksort.
+type iteratorStream struct{ disksort.Iterator }
+
+// Next implements the EntryStream interface.
+func (s iteratorStream) Next() (*spb.Entry, error) {
+	x, err := s.Iterator.Next()
+	if err != nil {
+		return nil, err
+	}
+	return x.(KeyedEntry).Entry, nil
+}
+
+// keyedLesser orders KeyedEntry values by key and then by fact value.
+type keyedLesser struct{}
+
+// Less implements the sortutil.Lesser interface.
+func (keyedLesser) Less(a, b interface{}) bool {
+	x, y := a.(KeyedEntry), b.(KeyedEntry)
+	if c := x.Compare(y); c != EQ {
+		return c == LT
+	}
+	return bytes.Compare(x.Entry.FactValue, y.Entry.FactValue) < 0
+}
+
+// keyedMarshaler encodes KeyedEntry values as their entries, restoring their
+// keys in the given order when decoded.
+type keyedMarshaler struct{ order EntryOrder }
+
+// Marshal implements part of the disksort.Marshaler interface.
+func (keyedMarshaler) Marshal(x interface{}) ([]byte, error) {
+	return proto.Marshal(x.(KeyedEntry).Entry)
+}
+
+// Unmarshal implements part of the disksort.Marshaler interface.
+func (m keyedMarshaler) Unmarshal(rec []byte) (interface{}, error) {
+	var e spb.Entry
+	if err := proto.Unmarshal(rec, &e); err != nil {
+		return nil, err
+	}
+	return KeyedEntry{EncodeEntryKeyBy(m.order, &e), &e}, nil
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"kythe.io/kythe/go/platform/delimited"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// unseekable hides the io.Seeker implementation of its Reader.
+type unseekable struct{ io.Reader }
+
+func encodeEntries(t *testing.T, entries []*spb.Entry) []byte {
+	var buf bytes.Buffer
+	wr := delimited.NewWriter(&buf)
+	for _, e := range entries {
+		if err := wr.PutProto(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func decodeEntries(t *testing.T, rec []byte) []*spb.Entry {
+	var entries []*spb.Entry
+	rd := delimited.NewReader(bytes.NewReader(rec))
+	for {
+		var e spb.Entry
+		if err := rd.NextProto(&e); err == io.EOF {
+			return entries
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, &e)
+	}
+}
+
+type byOrder struct {
+	entries []*spb.Entry
+	compare func(e1, e2 *spb.Entry) Order
+}
+
+func (s byOrder) Len() int      { return len(s.entries) }
+func (s byOrder) Swap(i, j int) { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
+func (s byOrder) Less(i, j int) bool {
+	if c := s.compare(s.entries[i], s.entries[j]); c != EQ {
+		return c == LT
+	}
+	return bytes.Compare(s.entries[i].FactValue, s.entries[j].FactValue) < 0
+}
+
+func TestMergeFiles(t *testing.T) {
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(6))
+	for _, order := range []EntryOrder{StandardOrder, CorpusOrder} {
+		for _, dedup := range []bool{false, true} {
+			dir, err := ioutil.TempDir("", "merge_files_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			var (
+				all    []*spb.Entry
+				inputs []io.Reader
+			)
+			for i := 0; i < 8; i++ {
+				entries := make([]*spb.Entry, rng.Intn(50))
+				for j := range entries {
+					entries[j] = randEntry(rng)
+				}
+				all = append(all, entries...)
+
+				// Alternate between sorted, unsorted, and partially sorted inputs
+				// that are (and are not) seekable.
+				switch i % 4 {
+				case 0, 1:
+					sort.Sort(byOrder{entries, EntriesBy(order)})
+				case 2:
+					sort.Sort(byOrder{entries[:len(entries)/2], EntriesBy(order)})
+				}
+				// Duplicate some entries within an input.
+				if len(entries) > 0 && i%2 == 0 {
+					entries = append(entries, entries[len(entries)-1])
+					all = append(all, entries[len(entries)-1])
+				}
+				var r io.Reader = bytes.NewReader(encodeEntries(t, entries))
+				if i%3 == 0 {
+					r = unseekable{r}
+				}
+				inputs = append(inputs, r)
+			}
+			// Duplicate an entire input.
+			inputs = append(inputs, bytes.NewReader(encodeEntries(t, all[:20])))
+			all = append(all, all[:20]...)
+
+			sort.Sort(byOrder{all, EntriesBy(order)})
+			want := all
+			if dedup {
+				want = nil
+				for _, e := range all {
+					if len(want) == 0 || !EntriesEqual(want[len(want)-1], e) {
+						want = append(want, e)
+					}
+				}
+			}
+
+			var out bytes.Buffer
+			stats, err := MergeFiles(ctx, &out, inputs, MergeFilesOptions{
+				Order:       order,
+				Dedup:       dedup,
+				MaxInMemory: 7,
+				WorkDir:     dir,
+			})
+			if err != nil {
+				t.Fatalf("MergeFiles(%v, dedup=%v): unexpected error: %v", order, dedup, err)
+			}
+			found := decodeEntries(t, out.Bytes())
+			if len(found) != len(want) {
+				t.Errorf("MergeFiles(%v, dedup=%v): found %d entries; want %d", order, dedup, len(found), len(want))
+			} else {
+				for i := range found {
+					if !EntriesEqual(found[i], want[i]) {
+						t.Errorf("MergeFiles(%v, dedup=%v): entry %d is %v; want %v", order, dedup, i, found[i], want[i])
+						break
+					}
+				}
+			}
+			if expected := (MergeFilesStats{
+				Read:    int64(len(all)),
+				Deduped: int64(len(all) - len(want)),
+				Written: int64(len(want)),
+			}); !reflect.DeepEqual(*stats, expected) {
+				t.Errorf("MergeFiles(%v, dedup=%v): found stats %+v; want %+v", order, dedup, *stats, expected)
+			}
+
+			if files, err := ioutil.ReadDir(dir); err != nil {
+				t.Fatal(err)
+			} else if len(files) != 0 {
+				t.Errorf("MergeFiles(%v, dedup=%v): left %d temporary files", order, dedup, len(files))
+			}
+		}
+	}
+}
+
+func TestMergeFilesSeekable(t *testing.T) {
+	entries := []*spb.Entry{
+		{Source: &spb.VName{Signature: "a"}, FactName: "/"},
+		{Source: &spb.VName{Signature: "b"}, FactName: "/"},
+	}
+	rec := encodeEntries(t, entries)
+
+	// A seekable input is merged from its original offset.
+	skipped := encodeEntries(t, entries[1:])
+	r := bytes.NewReader(append(skipped, rec...))
+	if _, err := r.Seek(int64(len(skipped)), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := MergeFiles(context.Background(), &out, []io.Reader{r}, MergeFilesOptions{}); err != nil {
+		t.Fatal(err)
+	} else if found := decodeEntries(t, out.Bytes()); len(found) != 2 || !EntriesEqual(found[0], entries[0]) || !EntriesEqual(found[1], entries[1]) {
+		t.Errorf("MergeFiles: found %v; want %v", found, entries)
+	}
+}
+
+func TestMergeFilesErrors(t *testing.T) {
+	ctx := context.Background()
+	valid := encodeEntries(t, []*spb.Entry{{FactName: "/"}})
+	truncated := valid[:len(valid)-1]
+
+	for _, inputs := range [][]io.Reader{
+		{bytes.NewReader(valid), bytes.NewReader(truncated)},
+		{bytes.NewReader(valid), unseekable{bytes.NewReader(truncated)}},
+	} {
+		if _, err := MergeFiles(ctx, ioutil.Discard, inputs, MergeFilesOptions{}); err == nil {
+			t.Error("MergeFiles of a truncated input succeeded; expected an error")
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := MergeFiles(cancelled, ioutil.Discard, []io.Reader{bytes.NewReader(valid)}, MergeFilesOptions{}); err == nil {
+		t.Error("MergeFiles with a cancelled context succeeded; expected an error")
+	}
+}
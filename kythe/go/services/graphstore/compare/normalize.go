@@ -0,0 +1,68 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"path"
+	"strings"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// NormalizeOptions controls the behavior of NormalizeVName.
+type NormalizeOptions struct {
+	// FoldCase causes the path and root of each VName to be lowercased, for
+	// corpora extracted from case-insensitive filesystems.
+	FoldCase bool
+}
+
+// NormalizeVName returns v with its path and root normalized: backslashes are
+// replaced by slashes and redundant "." and ".." segments and slashes are
+// removed (as by path.Clean), and the result is lowercased if opts.FoldCase is
+// set.  Empty fields are left empty.  If v is already normalized, it is
+// returned as-is; otherwise, a modified copy is returned and v is unchanged.
+//
+// Normalizing changes the identity of VNames, so two VNames that differ may
+// become equal; see graphstore.NormalizationCollisions.
+func NormalizeVName(v *spb.VName, opts NormalizeOptions) *spb.VName {
+	if v == nil {
+		return nil
+	}
+	p, r := normalizePath(v.Path, opts), normalizePath(v.Root, opts)
+	if p == v.Path && r == v.Root {
+		return v
+	}
+	return &spb.VName{
+		Signature: v.Signature,
+		Corpus:    v.Corpus,
+		Root:      r,
+		Path:      p,
+		Language:  v.Language,
+	}
+}
+
+// normalizePath returns the normalized form of the VName path or root p.
+func normalizePath(p string, opts NormalizeOptions) string {
+	if p == "" {
+		return ""
+	}
+	p = path.Clean(strings.Replace(p, `\`, "/", -1))
+	if opts.FoldCase {
+		p = strings.ToLower(p)
+	}
+	return p
+}
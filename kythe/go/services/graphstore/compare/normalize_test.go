@@ -0,0 +1,59 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compare
+
+import (
+	"testing"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func TestNormalizeVName(t *testing.T) {
+	tests := []struct {
+		path     string
+		foldCase bool
+		want     string
+	}{
+		{"", false, ""},
+		{"", true, ""},
+		{"src/foo.cs", false, "src/foo.cs"},
+		{`Src\Foo.cs`, false, "Src/Foo.cs"},
+		{`Src\Foo.cs`, true, "src/foo.cs"},
+		{"./src//foo/../foo.cs", false, "src/foo.cs"},
+		{`..\src\.\foo.cs`, false, "../src/foo.cs"},
+		{"/abs/path/", false, "/abs/path"},
+		{".", false, "."},
+	}
+	for _, test := range tests {
+		v := &spb.VName{Signature: "Sig", Corpus: "Corpus", Root: test.path, Path: test.path, Language: "C#"}
+		got := NormalizeVName(v, NormalizeOptions{FoldCase: test.foldCase})
+		want := &spb.VName{Signature: "Sig", Corpus: "Corpus", Root: test.want, Path: test.want, Language: "C#"}
+		if !VNamesEqual(got, want) {
+			t.Errorf("NormalizeVName(%q, fold=%v): %v; want %v", test.path, test.foldCase, got, want)
+		}
+		if v.Path != test.path || v.Root != test.path {
+			t.Errorf("NormalizeVName(%q, fold=%v) modified its argument: %v", test.path, test.foldCase, v)
+		}
+		if test.path == test.want && got != v {
+			t.Errorf("NormalizeVName(%q, fold=%v) copied a normalized VName", test.path, test.foldCase)
+		}
+	}
+
+	if v := NormalizeVName(nil, NormalizeOptions{FoldCase: true}); v != nil {
+		t.Errorf("NormalizeVName(nil): %v; want nil", v)
+	}
+}
@@ -0,0 +1,378 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// CopyOptions control the behavior of Copy.
+type CopyOptions struct {
+	// Corpora, if non-empty, restricts the copy to entries whose source is in
+	// one of the given corpora.
+	Corpora []string
+
+	// EdgeKinds, if non-empty, restricts the copy to entries with one of the
+	// given edge kinds (where "" denotes node facts), as for ScanOptions.
+	EdgeKinds []string
+
+	// FactPrefix restricts the copy to entries whose fact name has the given
+	// prefix.
+	FactPrefix string
+
+	// Workers is the number of shards of a Sharded source to copy concurrently.
+	// If ≤ 1 or if the source is not Sharded, it is copied with a single Scan.
+	Workers int
+
+	// Batch controls how copied entries are collected into WriteRequests.  If
+	// nil, DefaultCopyBatch is used.
+	Batch *BatchOptions
+
+	// Progress, if non-nil, is called with the progress of the copy every
+	// ProgressInterval and a final time once the copy stops.  Calls are
+	// serialized.
+	Progress func(*CopyProgress)
+
+	// ProgressInterval is the period between calls to Progress.  If ≤ 0,
+	// DefaultProgressInterval is used.
+	ProgressInterval time.Duration
+
+	// ResumeToken, if non-empty, continues an interrupted copy from the last
+	// CopyProgress.ResumeToken it reported.  The source must not have changed
+	// and Workers must be the same as for the interrupted copy.  As the copy
+	// is resumed after the last entry written in compare.Entries order, only a
+	// copy of a source that ScansOrdered in a single Scan can be resumed.
+	ResumeToken string
+}
+
+// Defaults for CopyOptions.
+var (
+	DefaultCopyBatch        = &BatchOptions{MaxUpdates: 1024, MaxBytes: 3 * 1024 * 1024}
+	DefaultProgressInterval = 5 * time.Second
+)
+
+// CopyProgress reports the progress of a Copy.
+type CopyProgress struct {
+	// Entries and Bytes are the number of entries and fact value bytes written
+	// to the destination by this Copy.
+	Entries, Bytes int64
+
+	// Scanned is the number of source entries read, including any skipped
+	// while resuming or removed by the filters.
+	Scanned int64
+
+	// Elapsed is the duration of the copy so far.
+	Elapsed time.Duration
+
+	// EntriesPerSec is the average rate at which entries have been written.
+	EntriesPerSec float64
+
+	// ETA is the estimated time remaining, or 0 if unknown.  It is only known
+	// for a Sharded source.
+	ETA time.Duration
+
+	// ResumeToken may be passed as a CopyOptions.ResumeToken to continue the
+	// copy after the last written entry.  It is empty if the copy cannot be
+	// resumed.
+	ResumeToken string
+}
+
+// Copy writes each matching entry of src to dst.  If src is Sharded and
+// opts.Workers > 1, that many shards of src are copied concurrently; otherwise,
+// src is copied in a single Scan.  If src ScansOrdered and is copied in a
+// single Scan, the progress of the copy is tracked so that it may be resumed
+// with opts.ResumeToken; the order of a Shard (or of an unordered Scan) is not
+// known, so any other copy cannot be resumed.
+func Copy(ctx context.Context, dst, src Service, opts *CopyOptions) error {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	batch := opts.Batch
+	if batch == nil {
+		batch = DefaultCopyBatch
+	}
+
+	sharded, isSharded := src.(Sharded)
+	numLanes := 1
+	if isSharded && opts.Workers > 1 {
+		numLanes = opts.Workers
+	} else {
+		isSharded = false
+	}
+	resumable := !isSharded && ScansOrdered(src)
+	if opts.ResumeToken != "" && !resumable {
+		return fmt.Errorf("cannot resume a copy of %T (its entries are not scanned in order)", src)
+	}
+	lanes, err := parseCopyToken(opts.ResumeToken, numLanes)
+	if err != nil {
+		return err
+	}
+
+	c := &copier{
+		dst:       dst,
+		opts:      opts,
+		batch:     batch,
+		lanes:     lanes,
+		resumable: resumable,
+		start:     time.Now(),
+		filter:    copyFilter(opts),
+	}
+	if isSharded {
+		for i := range lanes {
+			n, err := sharded.Count(ctx, &spb.CountRequest{Index: int64(i), Shards: int64(numLanes)})
+			if err != nil {
+				return fmt.Errorf("error counting shard %d: %v", i, err)
+			}
+			c.total += n
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stopProgress := c.reportProgress()
+	err = c.run(ctx, cancel, func(ctx context.Context, lane int, f EntryFunc) error {
+		if isSharded {
+			return sharded.Shard(ctx, &spb.ShardRequest{Index: int64(lane), Shards: int64(numLanes)}, f)
+		}
+		return ScanWithOptions(ctx, src, &spb.ScanRequest{FactPrefix: opts.FactPrefix}, &ScanOptions{EdgeKinds: opts.EdgeKinds}, f)
+	})
+	stopProgress()
+	return err
+}
+
+type copier struct {
+	dst    Service
+	opts   *CopyOptions
+	batch  *BatchOptions
+	filter func(*spb.Entry) bool
+	start  time.Time
+	total  int64 // total source entries, if known
+
+	resumable bool // whether the lanes are scanned in compare.Entries order
+
+	// accessed atomically
+	entries, bytes, scanned int64
+
+	mu    sync.Mutex // guards lanes
+	lanes []*spb.Entry
+}
+
+// run copies every lane concurrently using scan to read each lane's entries
+// (in compare.Entries order if c.resumable).  The first failing lane cancels
+// the others.
+func (c *copier) run(ctx context.Context, cancel func(), scan func(context.Context, int, EntryFunc) error) error {
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	wg.Add(len(c.lanes))
+	for i := range c.lanes {
+		go func(i int) {
+			defer wg.Done()
+			if err := c.copyLane(ctx, i, scan); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (c *copier) copyLane(ctx context.Context, lane int, scan func(context.Context, int, EntryFunc) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c.mu.Lock()
+	after := c.lanes[lane]
+	c.mu.Unlock()
+
+	entries := make(chan *spb.Entry)
+	reqs, batchErr := BatchWritesContext(ctx, entries, c.batch)
+	scanErr := make(chan error, 1)
+	go func() {
+		defer close(entries)
+		scanErr <- scan(ctx, lane, func(e *spb.Entry) error {
+			atomic.AddInt64(&c.scanned, 1)
+			if (after != nil && compare.Entries(e, after) != compare.GT) || !c.filter(e) {
+				return nil
+			}
+			select {
+			case entries <- e:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	var writeErr error
+	for req := range reqs {
+		if writeErr != nil {
+			continue // drain the remaining requests
+		}
+		if err := c.dst.Write(ctx, req); err != nil {
+			writeErr = fmt.Errorf("write error: %v", err)
+			cancel()
+			continue
+		}
+
+		var size int64
+		for _, u := range req.Update {
+			size += int64(len(u.FactValue))
+		}
+		atomic.AddInt64(&c.entries, int64(len(req.Update)))
+		atomic.AddInt64(&c.bytes, size)
+
+		last := req.Update[len(req.Update)-1]
+		c.mu.Lock()
+		c.lanes[lane] = &spb.Entry{
+			Source:   req.Source,
+			EdgeKind: last.EdgeKind,
+			FactName: last.FactName,
+			Target:   last.Target,
+		}
+		c.mu.Unlock()
+	}
+	if err := <-scanErr; writeErr == nil && err != nil {
+		return fmt.Errorf("scan error: %v", err)
+	}
+	if err := <-batchErr; writeErr == nil && err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// reportProgress periodically calls c.opts.Progress until the returned
+// function is called, which then makes the final report.
+func (c *copier) reportProgress() func() {
+	if c.opts.Progress == nil {
+		return func() {}
+	}
+	interval := c.opts.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+	ticker := time.NewTicker(interval)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				c.opts.Progress(c.progress())
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stop)
+		<-stopped
+		c.opts.Progress(c.progress())
+	}
+}
+
+func (c *copier) progress() *CopyProgress {
+	p := &CopyProgress{
+		Entries: atomic.LoadInt64(&c.entries),
+		Bytes:   atomic.LoadInt64(&c.bytes),
+		Scanned: atomic.LoadInt64(&c.scanned),
+		Elapsed: time.Since(c.start),
+	}
+	if secs := p.Elapsed.Seconds(); secs > 0 {
+		p.EntriesPerSec = float64(p.Entries) / secs
+		if scanRate := float64(p.Scanned) / secs; c.total > p.Scanned && scanRate > 0 {
+			p.ETA = time.Duration(float64(c.total-p.Scanned) / scanRate * float64(time.Second))
+		}
+	}
+
+	if c.resumable {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		p.ResumeToken = copyToken(c.lanes)
+	}
+	return p
+}
+
+// copyFilter returns a function reporting whether an entry matches the filters
+// of opts.
+func copyFilter(opts *CopyOptions) func(*spb.Entry) bool {
+	return func(e *spb.Entry) bool {
+		return (len(opts.Corpora) == 0 || (e.Source != nil && containsString(opts.Corpora, e.Source.Corpus))) &&
+			(len(opts.EdgeKinds) == 0 || containsString(opts.EdgeKinds, e.EdgeKind)) &&
+			strings.HasPrefix(e.FactName, opts.FactPrefix)
+	}
+}
+
+// copyTokenSep separates the fields of a Copy resume token.  It cannot appear
+// in a PageToken.
+const copyTokenSep = "."
+
+// copyToken encodes the last entry copied in each lane as a resume token of the
+// form "<lanes>.<PageToken>.<PageToken>...", where a lane yet to copy an entry
+// has an empty PageToken.
+func copyToken(lanes []*spb.Entry) string {
+	parts := []string{strconv.Itoa(len(lanes))}
+	for _, last := range lanes {
+		var tok string
+		if last != nil {
+			tok = PageToken(last)
+		}
+		parts = append(parts, tok)
+	}
+	return strings.Join(parts, copyTokenSep)
+}
+
+// parseCopyToken decodes a resume token from copyToken, requiring it have the
+// given number of lanes.  An empty token starts each lane from the beginning.
+func parseCopyToken(token string, numLanes int) ([]*spb.Entry, error) {
+	lanes := make([]*spb.Entry, numLanes)
+	if token == "" {
+		return lanes, nil
+	}
+	parts := strings.Split(token, copyTokenSep)
+	if n, err := strconv.Atoi(parts[0]); err != nil || n != len(parts)-1 {
+		return nil, fmt.Errorf("invalid copy resume token: %q", token)
+	} else if n != numLanes {
+		return nil, fmt.Errorf("copy resume token is for %d workers, not %d", n, numLanes)
+	}
+	for i, tok := range parts[1:] {
+		e, err := ParsePageToken(tok)
+		if err != nil {
+			return nil, fmt.Errorf("invalid copy resume token: %v", err)
+		}
+		lanes[i] = e
+	}
+	return lanes, nil
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Deduped is an EntryFunc wrapper that drops duplicate entries.  It is not
+// safe for concurrent use.
+type Deduped struct {
+	next    EntryFunc
+	isDup   func(*spb.Entry) (bool, error)
+	finish  func() error
+	dropped int64
+}
+
+// Entry passes e to the wrapped EntryFunc unless it is a duplicate.  It is an
+// EntryFunc.
+func (d *Deduped) Entry(e *spb.Entry) error {
+	if dup, err := d.isDup(e); err != nil {
+		return err
+	} else if dup {
+		d.dropped++
+		return nil
+	}
+	return d.next(e)
+}
+
+// Dropped returns the number of duplicate entries dropped so far.
+func (d *Deduped) Dropped() int64 { return d.dropped }
+
+// Close releases the resources held by d, such as the temporary files of
+// DedupExact.  Entry must not be called after Close.
+func (d *Deduped) Close() error {
+	if d.finish == nil {
+		return nil
+	}
+	return d.finish()
+}
+
+// DedupOrdered returns a Deduped that drops each entry equal to the entry
+// immediately preceding it (including its fact value; see
+// compare.EntriesEqual).  For an ordered stream of entries (such as a Scan of
+// an OrderedScanner), this drops every duplicate; deliver entries to
+// CheckOrdered(d.Entry) to fail on an unordered stream instead.
+func DedupOrdered(next EntryFunc) *Deduped {
+	var last *spb.Entry
+	return &Deduped{next: next, isDup: func(e *spb.Entry) (bool, error) {
+		if last != nil && compare.EntriesEqual(last, e) {
+			return true, nil
+		}
+		last = e
+		return false, nil
+	}}
+}
+
+// DedupExact returns a Deduped that drops each entry equal to any entry
+// previously seen, as recorded by a compare.EntrySet with the given options.
+// It never delivers a duplicate (barring a 128-bit fingerprint collision),
+// spilling fingerprints to temporary files once its memory budget is
+// exhausted.  The returned Deduped must be closed to remove
+// those files.
+func DedupExact(next EntryFunc, opts compare.EntrySetOptions) *Deduped {
+	set := compare.NewEntrySet(opts)
+	return &Deduped{
+		next: next,
+		isDup: func(e *spb.Entry) (bool, error) {
+			added, err := set.Add(e)
+			return !added, err
+		},
+		finish: set.Finish,
+	}
+}
@@ -0,0 +1,300 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/util/disksort"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// OrderedScanner is an optional interface for a Service that reports whether
+// its Scans deliver entries in compare.Entries order.
+type OrderedScanner interface {
+	Service
+
+	// ScansOrdered reports whether every Scan delivers its entries in
+	// compare.Entries order.
+	ScansOrdered() bool
+}
+
+// ScansOrdered reports whether s is known to Scan its entries in
+// compare.Entries order.
+func ScansOrdered(s Service) bool {
+	os, ok := s.(OrderedScanner)
+	return ok && os.ScansOrdered()
+}
+
+// DiffKind is the kind of difference reported by a DiffEntry.
+type DiffKind int
+
+// Kinds of differences between two Services.
+const (
+	OnlyInA DiffKind = iota
+	OnlyInB
+	ValueChanged
+)
+
+// String implements the fmt.Stringer interface.
+func (k DiffKind) String() string {
+	switch k {
+	case OnlyInA:
+		return "only in a"
+	case OnlyInB:
+		return "only in b"
+	case ValueChanged:
+		return "value changed"
+	default:
+		return fmt.Sprintf("DiffKind(%d)", int(k))
+	}
+}
+
+// A DiffEntry is a difference between two Services found by Diff.  A is nil for
+// an OnlyInB entry and B is nil for an OnlyInA entry; for a ValueChanged
+// entry, A and B share a key but have different fact values.
+type DiffEntry struct {
+	Kind DiffKind
+	A, B *spb.Entry
+}
+
+// Diff calls f with each difference between the entries of a and b, in
+// compare.Entries order.  The entries of each Service are merge-joined from a
+// Scan if the Service is an OrderedScanner; otherwise, they are first sorted
+// using a disksort.  Only a bounded number of entries are held in memory.  If f
+// returns io.EOF, Diff stops and returns nil.
+func Diff(ctx context.Context, a, b Service, f func(DiffEntry) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	iterA, err := scanIterator(ctx, a)
+	if err != nil {
+		return err
+	}
+	defer iterA.Close()
+	iterB, err := scanIterator(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer iterB.Close()
+
+	ea, err := iterA.Next()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	eb, err := iterB.Next()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for ea != nil || eb != nil {
+		var (
+			d          *DiffEntry
+			advA, advB bool
+		)
+		switch {
+		case eb == nil || (ea != nil && compare.Entries(ea, eb) == compare.LT):
+			d, advA = &DiffEntry{Kind: OnlyInA, A: ea}, true
+		case ea == nil || compare.Entries(ea, eb) == compare.GT:
+			d, advB = &DiffEntry{Kind: OnlyInB, B: eb}, true
+		default:
+			advA, advB = true, true
+			if !bytes.Equal(ea.FactValue, eb.FactValue) {
+				d = &DiffEntry{Kind: ValueChanged, A: ea, B: eb}
+			}
+		}
+		if d != nil {
+			if err := f(*d); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		if advA {
+			if ea, err = iterA.Next(); err != nil && err != io.EOF {
+				return err
+			}
+		}
+		if advB {
+			if eb, err = iterB.Next(); err != nil && err != io.EOF {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// entryIterator yields entries in compare.Entries order.  Next returns a nil
+// entry and io.EOF once the entries are exhausted.
+type entryIterator interface {
+	Next() (*spb.Entry, error)
+	Close() error
+}
+
+// scanIterator returns an entryIterator over every entry of s.
+func scanIterator(ctx context.Context, s Service) (entryIterator, error) {
+	return sortedScan(ctx, ScansOrdered(s), func(ctx context.Context, f EntryFunc) error {
+		return s.Scan(ctx, &spb.ScanRequest{}, f)
+	})
+}
+
+// sortedScan returns an entryIterator over the entries delivered by scan.  If
+// ordered is true, scan must deliver them in compare.Entries order; otherwise,
+// they are first sorted using a disksort.
+func sortedScan(ctx context.Context, ordered bool, scan func(context.Context, EntryFunc) error) (entryIterator, error) {
+	if ordered {
+		return newStreamIterator(ctx, scan), nil
+	}
+
+	sorter, err := disksort.NewMergeSorter(disksort.MergeOptions{
+		Lesser:    entryLesser{},
+		Marshaler: entryMarshaler{},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating entry sorter: %v", err)
+	}
+	if err := scan(ctx, func(e *spb.Entry) error {
+		return sorter.Add(compare.NewKeyedEntry(e))
+	}); err != nil {
+		return nil, fmt.Errorf("error sorting entries: %v", err)
+	}
+	iter, err := sorter.Iterator()
+	if err != nil {
+		return nil, fmt.Errorf("error sorting entries: %v", err)
+	}
+	return sortedIterator{iter}, nil
+}
+
+type sortedIterator struct{ disksort.Iterator }
+
+// Next implements part of the entryIterator interface.
+func (i sortedIterator) Next() (*spb.Entry, error) {
+	e, err := i.Iterator.Next()
+	if err != nil {
+		return nil, err
+	}
+	return e.(compare.KeyedEntry).Entry, nil
+}
+
+// A ScanStream is a compare.EntryStream of the entries of a Scan.  It must be
+// closed once it is no longer needed.
+type ScanStream interface {
+	compare.EntryStream
+	io.Closer
+}
+
+// NewScanStream returns a ScanStream of the entries of s matching req, such as
+// for merging with compare.MergeEntries.  s must be an OrderedScanner.  The
+// Scan runs in a separate goroutine until the ScanStream is exhausted or
+// closed.
+func NewScanStream(ctx context.Context, s Service, req *spb.ScanRequest) (ScanStream, error) {
+	if !ScansOrdered(s) {
+		return nil, fmt.Errorf("scan stream unsupported for GraphStore type %T: Scan is not ordered", s)
+	}
+	return newOrderedIterator(ctx, s, req), nil
+}
+
+// orderedIterator pulls entries from a Scan running in a separate goroutine.
+type orderedIterator struct {
+	entries <-chan *spb.Entry
+	errc    <-chan error
+	cancel  func()
+	last    *spb.Entry
+}
+
+func newOrderedIterator(ctx context.Context, s Service, req *spb.ScanRequest) *orderedIterator {
+	return newStreamIterator(ctx, func(ctx context.Context, f EntryFunc) error {
+		return s.Scan(ctx, req, f)
+	})
+}
+
+// newStreamIterator returns an orderedIterator over the entries delivered by
+// scan, which is called in a separate goroutine.
+func newStreamIterator(ctx context.Context, scan func(context.Context, EntryFunc) error) *orderedIterator {
+	ctx, cancel := context.WithCancel(ctx)
+	entries := make(chan *spb.Entry, 64)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(entries)
+		errc <- scan(ctx, func(e *spb.Entry) error {
+			select {
+			case entries <- e:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return &orderedIterator{entries: entries, errc: errc, cancel: cancel}
+}
+
+// Next implements part of the entryIterator interface.
+func (i *orderedIterator) Next() (*spb.Entry, error) {
+	e, ok := <-i.entries
+	if !ok {
+		if err := <-i.errc; err != nil {
+			return nil, fmt.Errorf("scan error: %v", err)
+		}
+		return nil, io.EOF
+	}
+	if i.last != nil && compare.Entries(i.last, e) != compare.LT {
+		return nil, fmt.Errorf("entries scanned out of order: %v followed by %v", i.last, e)
+	}
+	i.last = e
+	return e, nil
+}
+
+// Close implements part of the entryIterator interface.
+func (i *orderedIterator) Close() error {
+	i.cancel()
+	for range i.entries {
+	}
+	return nil
+}
+
+// entryLesser orders compare.KeyedEntry values by their keys.
+type entryLesser struct{}
+
+// Less implements the sortutil.Lesser interface.
+func (entryLesser) Less(a, b interface{}) bool {
+	return a.(compare.KeyedEntry).Compare(b.(compare.KeyedEntry)) == compare.LT
+}
+
+// entryMarshaler encodes compare.KeyedEntry values as their entries, restoring
+// their keys when decoded.
+type entryMarshaler struct{}
+
+// Marshal implements part of the disksort.Marshaler interface.
+func (entryMarshaler) Marshal(x interface{}) ([]byte, error) {
+	return proto.Marshal(x.(compare.KeyedEntry).Entry)
+}
+
+// Unmarshal implements part of the disksort.Marshaler interface.
+func (entryMarshaler) Unmarshal(rec []byte) (interface{}, error) {
+	var e spb.Entry
+	if err := proto.Unmarshal(rec, &e); err != nil {
+		return nil, err
+	}
+	return compare.NewKeyedEntry(&e), nil
+}
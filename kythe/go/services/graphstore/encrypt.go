@@ -0,0 +1,364 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// A Keyset is a set of AES keys for encrypting fact values.  Each key has a
+// numeric ID, recorded with each value it encrypts, so that a store may hold
+// values encrypted with several keys while they are rotated (see Reencrypt).
+type Keyset struct {
+	// Primary is the ID of the key that encrypts written fact values.
+	Primary uint32
+
+	// Keys are the 16, 24, or 32 byte AES keys of the keyset by ID.
+	Keys map[uint32][]byte
+}
+
+// Errors reported by a DecryptError.
+var (
+	// ErrUnknownKey is reported for a fact value encrypted with a key whose ID
+	// is not in the Keyset.
+	ErrUnknownKey = errors.New("fact value is encrypted with an unknown key")
+
+	// ErrWrongKey is reported for a fact value encrypted with a different key
+	// than the Keyset's key of the same ID.
+	ErrWrongKey = errors.New("fact value is encrypted with a different key of the same ID")
+
+	// ErrCorruptValue is reported for a fact value that is not a valid
+	// encrypted value or that fails authentication.
+	ErrCorruptValue = errors.New("encrypted fact value is corrupt")
+)
+
+// A DecryptError reports an entry whose fact value could not be decrypted.
+type DecryptError struct {
+	Entry *spb.Entry // the entry, with its stored fact value
+	Err   error      // ErrUnknownKey, ErrWrongKey, or ErrCorruptValue
+}
+
+func (e *DecryptError) Error() string {
+	kind := e.Entry.EdgeKind
+	if kind == "" {
+		kind = "fact"
+	}
+	return fmt.Sprintf("cannot decrypt %s %q of %v: %v", kind, e.Entry.FactName, e.Entry.Source, e.Err)
+}
+
+// An encrypted fact value is encryptedVersion, the big-endian ID of its key,
+// the key's check value, the nonce, and the AES-GCM sealed value.
+const (
+	encryptedVersion = 1
+	keyCheckSize     = 4
+	nonceSize        = 12
+	headerSize       = 1 + 4 + keyCheckSize + nonceSize
+)
+
+// An encryptionKey is a key of a Keyset prepared for use.
+type encryptionKey struct {
+	id       uint32
+	aead     cipher.AEAD
+	nonceKey []byte
+	check    []byte // identifies the key among keys with its ID
+}
+
+// deriveKey returns the subkey of key for the given purpose.
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newEncryptionKey(id uint32, key []byte) (*encryptionKey, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("invalid size of AES key %d: %d bytes", id, len(key))
+	}
+	block, err := aes.NewCipher(deriveKey(key, "kythe fact value encryption")[:len(key)])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionKey{
+		id:       id,
+		aead:     aead,
+		nonceKey: deriveKey(key, "kythe fact value nonce"),
+		check:    deriveKey(key, "kythe fact value key check")[:keyCheckSize],
+	}, nil
+}
+
+// A keyring holds the prepared keys of a Keyset.
+type keyring struct {
+	primary *encryptionKey
+	keys    map[uint32]*encryptionKey
+}
+
+func newKeyring(ks Keyset) (*keyring, error) {
+	r := &keyring{keys: make(map[uint32]*encryptionKey)}
+	for id, key := range ks.Keys {
+		k, err := newEncryptionKey(id, key)
+		if err != nil {
+			return nil, err
+		}
+		r.keys[id] = k
+	}
+	if r.primary = r.keys[ks.Primary]; r.primary == nil {
+		return nil, fmt.Errorf("missing primary key %d", ks.Primary)
+	}
+	return r, nil
+}
+
+// encrypt returns value encrypted with the primary key for the entry with the
+// given encoded key.  An empty value is not encrypted.
+//
+// The nonce is derived from the entry key and value, so that rewriting an
+// entry with a different value never reuses a nonce; rewriting the same value
+// gives the same ciphertext.  The entry key is also authenticated, so a value
+// cannot be moved to another entry.
+func (r *keyring) encrypt(entryKey, value []byte) []byte {
+	if len(value) == 0 {
+		return value
+	}
+	k := r.primary
+	mac := hmac.New(sha256.New, k.nonceKey)
+	mac.Write(entryKey)
+	mac.Write(value)
+
+	buf := make([]byte, headerSize, headerSize+len(value)+k.aead.Overhead())
+	buf[0] = encryptedVersion
+	binary.BigEndian.PutUint32(buf[1:], k.id)
+	copy(buf[5:], k.check)
+	nonce := buf[5+keyCheckSize : headerSize]
+	copy(nonce, mac.Sum(nil))
+	return k.aead.Seal(buf, nonce, value, entryKey)
+}
+
+// keyID returns the ID of the key that encrypted value.
+func keyID(value []byte) (uint32, error) {
+	if len(value) < headerSize || value[0] != encryptedVersion {
+		return 0, ErrCorruptValue
+	}
+	return binary.BigEndian.Uint32(value[1:]), nil
+}
+
+// decrypt returns the decryption of the given encrypted fact value for the
+// entry with the given encoded key.
+func (r *keyring) decrypt(entryKey, value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return value, nil
+	}
+	id, err := keyID(value)
+	if err != nil {
+		return nil, err
+	}
+	k := r.keys[id]
+	if k == nil {
+		return nil, ErrUnknownKey
+	} else if !bytes.Equal(value[5:5+keyCheckSize], k.check) {
+		return nil, ErrWrongKey
+	}
+	plain, err := k.aead.Open(nil, value[5+keyCheckSize:headerSize], value[headerSize:], entryKey)
+	if err != nil {
+		return nil, ErrCorruptValue
+	}
+	return plain, nil
+}
+
+// decryptEntry returns a copy of e with its fact value decrypted.
+func (r *keyring) decryptEntry(e *spb.Entry) (*spb.Entry, error) {
+	value, err := r.decrypt(compare.EncodeEntryKey(e), e.FactValue)
+	if err != nil {
+		return nil, &DecryptError{Entry: e, Err: err}
+	}
+	return &spb.Entry{
+		Source:    e.Source,
+		EdgeKind:  e.EdgeKind,
+		Target:    e.Target,
+		FactName:  e.FactName,
+		FactValue: value,
+	}, nil
+}
+
+// NewEncryptedService returns a Service that stores the fact values of its
+// entries in s encrypted with AES-GCM using the primary key of the given
+// keyset, and decrypts them with any of its keys.  The entries' keys are
+// stored unencrypted, so the order and lookups of entries are unchanged.
+// Empty fact values (such as those of most edges) are stored as is.  An entry
+// that cannot be decrypted fails the call reading it with a *DecryptError.  If
+// s is Sharded, so is the returned Service; other optional interfaces of s are
+// hidden.
+func NewEncryptedService(s Service, keyset Keyset) (Service, error) {
+	r, err := newKeyring(keyset)
+	if err != nil {
+		return nil, err
+	}
+	es := &encryptedService{s, r}
+	if sh, ok := s.(Sharded); ok {
+		return &encryptedSharded{es, sh}, nil
+	}
+	return es, nil
+}
+
+type encryptedService struct {
+	s    Service
+	keys *keyring
+}
+
+// decrypting returns an EntryFunc calling f with each entry decrypted.
+func (s *encryptedService) decrypting(f EntryFunc) EntryFunc {
+	return func(e *spb.Entry) error {
+		d, err := s.keys.decryptEntry(e)
+		if err != nil {
+			return err
+		}
+		return f(d)
+	}
+}
+
+// Read implements part of the Service interface.
+func (s *encryptedService) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	return s.s.Read(ctx, req, s.decrypting(f))
+}
+
+// Scan implements part of the Service interface.
+func (s *encryptedService) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	return s.s.Scan(ctx, req, s.decrypting(f))
+}
+
+// Write implements part of the Service interface.
+func (s *encryptedService) Write(ctx context.Context, req *spb.WriteRequest) error {
+	enc := &spb.WriteRequest{Source: req.Source, Update: make([]*spb.WriteRequest_Update, len(req.Update))}
+	for i, u := range req.Update {
+		key := compare.EncodeEntryKey(&spb.Entry{
+			Source:   req.Source,
+			EdgeKind: u.EdgeKind,
+			Target:   u.Target,
+			FactName: u.FactName,
+		})
+		enc.Update[i] = &spb.WriteRequest_Update{
+			EdgeKind:  u.EdgeKind,
+			Target:    u.Target,
+			FactName:  u.FactName,
+			FactValue: s.keys.encrypt(key, u.FactValue),
+		}
+	}
+	return s.s.Write(ctx, enc)
+}
+
+// Close implements part of the Service interface.
+func (s *encryptedService) Close(ctx context.Context) error { return s.s.Close(ctx) }
+
+type encryptedSharded struct {
+	*encryptedService
+	sh Sharded
+}
+
+// Count implements part of the Sharded interface.
+func (s *encryptedSharded) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	return s.sh.Count(ctx, req)
+}
+
+// Shard implements part of the Sharded interface.
+func (s *encryptedSharded) Shard(ctx context.Context, req *spb.ShardRequest, f EntryFunc) error {
+	return s.sh.Shard(ctx, req, s.decrypting(f))
+}
+
+// reencryptBatchSize is the number of entries re-encrypted by each write of
+// Reencrypt.
+const reencryptBatchSize = 1024
+
+// Reencrypt rewrites each fact value of s (the Service underlying an encrypted
+// Service) that is not encrypted with the primary key of the given keyset,
+// re-encrypting it with the primary key, and returns the number of entries
+// rewritten.  Once it completes, keys other than the primary may be removed
+// from the keyset.  s is scanned in batches, each resumed after the last, so s
+// must be a ResumableScanner or scan its entries in order (see
+// OrderedScanner).  A value that cannot be decrypted stops Reencrypt with a
+// *DecryptError.
+func Reencrypt(ctx context.Context, s Service, keyset Keyset) (int64, error) {
+	if _, ok := s.(ResumableScanner); !ok && !ScansOrdered(s) {
+		return 0, fmt.Errorf("cannot resume a Scan of %T", s)
+	}
+	r, err := newKeyring(keyset)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		last      *spb.Entry
+		rewritten int64
+	)
+	for {
+		var reqs []*spb.WriteRequest
+		err := ScanFrom(ctx, s, new(spb.ScanRequest), last, func(e *spb.Entry) error {
+			last = e
+			if len(e.FactValue) == 0 {
+				return nil
+			} else if id, err := keyID(e.FactValue); err == nil && id == r.primary.id {
+				return nil
+			}
+			d, err := r.decryptEntry(e)
+			if err != nil {
+				return err
+			}
+			key := compare.EncodeEntryKey(e)
+			reqs = append(reqs, &spb.WriteRequest{
+				Source: e.Source,
+				Update: []*spb.WriteRequest_Update{{
+					EdgeKind:  e.EdgeKind,
+					Target:    e.Target,
+					FactName:  e.FactName,
+					FactValue: r.encrypt(key, d.FactValue),
+				}},
+			})
+			if len(reqs) == reencryptBatchSize {
+				return io.EOF
+			}
+			return nil
+		})
+		if err != nil {
+			return rewritten, err
+		} else if len(reqs) == 0 {
+			return rewritten, nil
+		} else if err := WriteBatch(ctx, s, reqs); err != nil {
+			return rewritten, err
+		}
+		rewritten += int64(len(reqs))
+		if len(reqs) < reencryptBatchSize {
+			return rewritten, nil
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package entryfn provides composable graphstore.EntryFuncs.
+//
+// Each combinator preserves the graphstore.EntryFunc convention that returning
+// io.EOF stops the delivery of entries without error: once the EntryFunc
+// wrapped by a combinator returns io.EOF, the combinator returns io.EOF for
+// the same entry.
+package entryfn
+
+import (
+	"io"
+	"sync/atomic"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Filter returns an EntryFunc calling next with each entry satisfying pred.
+func Filter(pred func(*spb.Entry) bool, next graphstore.EntryFunc) graphstore.EntryFunc {
+	return func(e *spb.Entry) error {
+		if !pred(e) {
+			return nil
+		}
+		return next(e)
+	}
+}
+
+// Transform returns an EntryFunc calling next with the result of fn for each
+// entry.  Entries for which fn returns nil are dropped.
+func Transform(fn func(*spb.Entry) *spb.Entry, next graphstore.EntryFunc) graphstore.EntryFunc {
+	return func(e *spb.Entry) error {
+		if e = fn(e); e == nil {
+			return nil
+		}
+		return next(e)
+	}
+}
+
+// Limit returns an EntryFunc calling next with at most n entries.  It returns
+// io.EOF as soon as the nth entry has been delivered so that no further
+// entries are read.
+func Limit(n int, next graphstore.EntryFunc) graphstore.EntryFunc {
+	var delivered int
+	return func(e *spb.Entry) error {
+		if delivered >= n {
+			return io.EOF
+		}
+		delivered++
+		if err := next(e); err != nil {
+			return err
+		} else if delivered >= n {
+			return io.EOF
+		}
+		return nil
+	}
+}
+
+// Tee returns an EntryFunc calling both a and b with each entry.  If one
+// returns io.EOF, it is no longer called but entries continue to be delivered
+// to the other; the returned EntryFunc returns io.EOF once both have.  Any
+// other error from either is returned immediately.
+func Tee(a, b graphstore.EntryFunc) graphstore.EntryFunc {
+	var doneA, doneB bool
+	return func(e *spb.Entry) error {
+		if !doneA {
+			if err := a(e); err == io.EOF {
+				doneA = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if !doneB {
+			if err := b(e); err == io.EOF {
+				doneB = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if doneA && doneB {
+			return io.EOF
+		}
+		return nil
+	}
+}
+
+// A Counting EntryFunc counts the entries passed to it.  It is safe for
+// concurrent use if its wrapped EntryFunc is.
+type Counting struct {
+	next graphstore.EntryFunc
+	n    int64
+}
+
+// Counter returns a Counting EntryFunc that calls next (if non-nil) with each
+// entry.
+func Counter(next graphstore.EntryFunc) *Counting { return &Counting{next: next} }
+
+// Entry counts e and passes it to c's wrapped EntryFunc.  It is a
+// graphstore.EntryFunc.
+func (c *Counting) Entry(e *spb.Entry) error {
+	atomic.AddInt64(&c.n, 1)
+	if c.next == nil {
+		return nil
+	}
+	return c.next(e)
+}
+
+// Count returns the number of entries passed to c.
+func (c *Counting) Count() int64 { return atomic.LoadInt64(&c.n) }
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package entryfn
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func entries(n int) []*spb.Entry {
+	var es []*spb.Entry
+	for i := 0; i < n; i++ {
+		es = append(es, &spb.Entry{
+			Source:    &spb.VName{Signature: fmt.Sprintf("sig%d", i)},
+			FactName:  "/kythe/node/kind",
+			FactValue: []byte("record"),
+		})
+	}
+	return es
+}
+
+// deliver calls f with each entry, following the graphstore.EntryFunc
+// conventions of a Service.
+func deliver(es []*spb.Entry, f graphstore.EntryFunc) error {
+	for _, e := range es {
+		if err := f(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collect returns an EntryFunc appending each entry to *es.
+func collect(es *[]*spb.Entry) graphstore.EntryFunc {
+	return func(e *spb.Entry) error {
+		*es = append(*es, e)
+		return nil
+	}
+}
+
+func TestFilter(t *testing.T) {
+	es := entries(6)
+	var got []*spb.Entry
+	if err := deliver(es, Filter(func(e *spb.Entry) bool {
+		return e.Source.Signature != "sig1" && e.Source.Signature != "sig4"
+	}, collect(&got))); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []*spb.Entry{es[0], es[2], es[3], es[5]}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Filtered entries: %v; want %v", got, expected)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	es := entries(3)
+	var got []*spb.Entry
+	if err := deliver(es, Transform(func(e *spb.Entry) *spb.Entry {
+		if e.Source.Signature == "sig1" {
+			return nil
+		}
+		return &spb.Entry{Source: e.Source, FactName: "/kythe/text"}
+	}, collect(&got))); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].FactName != "/kythe/text" || got[1].Source.Signature != "sig2" {
+		t.Errorf("Transformed entries: %v", got)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	es := entries(10)
+	for _, n := range []int{0, 1, 3, 10, 20} {
+		var (
+			got   []*spb.Entry
+			calls int
+		)
+		limited := Limit(n, collect(&got))
+		if err := deliver(es, func(e *spb.Entry) error {
+			calls++
+			return limited(e)
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		want, wantCalls := n, n
+		if want > len(es) {
+			want, wantCalls = len(es), len(es)
+		} else if n == 0 {
+			wantCalls = 1
+		}
+		if len(got) != want {
+			t.Errorf("Limit(%d) delivered %d entries; want %d", n, len(got), want)
+		}
+		// No entries should be read beyond the limit.
+		if calls != wantCalls {
+			t.Errorf("Limit(%d) was called with %d entries; want %d", n, calls, wantCalls)
+		}
+	}
+}
+
+func TestTee(t *testing.T) {
+	es := entries(5)
+	var a, b []*spb.Entry
+	if err := deliver(es, Tee(Limit(2, collect(&a)), collect(&b))); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, es[:2]) || !reflect.DeepEqual(b, es) {
+		t.Errorf("Tee delivered %d and %d entries; want 2 and 5", len(a), len(b))
+	}
+
+	// Tee stops once both branches have stopped.
+	a, b = nil, nil
+	var calls int
+	tee := Tee(Limit(2, collect(&a)), Limit(3, collect(&b)))
+	if err := deliver(es, func(e *spb.Entry) error {
+		calls++
+		return tee(e)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 2 || len(b) != 3 || calls != 3 {
+		t.Errorf("Tee delivered %d and %d entries from %d; want 2 and 3 from 3", len(a), len(b), calls)
+	}
+
+	// Errors are returned immediately.
+	fail := errors.New("failed")
+	b = nil
+	if err := deliver(es, Tee(func(*spb.Entry) error { return fail }, collect(&b))); err != fail {
+		t.Errorf("Tee error: %v; want %v", err, fail)
+	} else if len(b) != 0 {
+		t.Errorf("Tee delivered %d entries after an error", len(b))
+	}
+}
+
+func TestCounter(t *testing.T) {
+	es := entries(7)
+	var got []*spb.Entry
+	c := Counter(Limit(4, collect(&got)))
+	if err := deliver(es, c.Entry); err != nil {
+		t.Fatal(err)
+	}
+	if c.Count() != 4 || len(got) != 4 {
+		t.Errorf("Counted %d entries and delivered %d; want 4", c.Count(), len(got))
+	}
+
+	c = Counter(nil)
+	if err := deliver(es, c.Entry); err != nil {
+		t.Fatal(err)
+	} else if c.Count() != 7 {
+		t.Errorf("Counted %d entries; want 7", c.Count())
+	}
+}
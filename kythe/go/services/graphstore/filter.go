@@ -0,0 +1,210 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// A ScanFilter restricts the fact names of the entries returned by
+// FilteredScan.  An entry must satisfy each of the non-empty restrictions.
+type ScanFilter struct {
+	// FactGlobs restricts entries to those whose fact name matches one of the
+	// given globs.  In a glob, "**" matches any sequence of characters, "*"
+	// matches any sequence of characters other than '/', and "?" matches any
+	// single character other than '/'.  All other characters match themselves.
+	FactGlobs []string
+
+	// FactRegexp restricts entries to those whose entire fact name matches the
+	// given RE2 regular expression.
+	FactRegexp string
+}
+
+// FilterScanner is an optional interface for a Service that can natively
+// restrict a Scan by a ScanFilter (for example, by sending it to a remote
+// server, so that only the matching entries are returned).
+type FilterScanner interface {
+	Service
+
+	// ScanFiltered is equivalent to Scan, but only delivers the entries whose
+	// fact names are matched by m, which is non-nil.
+	ScanFiltered(ctx context.Context, req *spb.ScanRequest, m *FactMatcher, f EntryFunc) error
+}
+
+// FilteredScan calls f with each entry of s matching both req and filter.  The
+// filter is validated before s is scanned, and then scanned as by ScanMatching.
+func FilteredScan(ctx context.Context, s Service, req *spb.ScanRequest, filter *ScanFilter, f EntryFunc) error {
+	m, err := CompileScanFilter(filter)
+	if err != nil {
+		return err
+	}
+	return ScanMatching(ctx, s, req, m, f)
+}
+
+// ScanMatching calls f with each entry of s matching req whose fact name is
+// matched by m, a compiled ScanFilter (see CompileScanFilter).  If s
+// implements FilterScanner, its implementation is used.  Otherwise, where
+// possible, the literal prefix shared by the filter's globs narrows the
+// request's FactPrefix so that fewer entries are sent by s; all other
+// filtering is done by the caller.
+func ScanMatching(ctx context.Context, s Service, req *spb.ScanRequest, m *FactMatcher, f EntryFunc) error {
+	if m == nil {
+		return s.Scan(ctx, req, f)
+	} else if fs, ok := s.(FilterScanner); ok {
+		return fs.ScanFiltered(ctx, req, m, f)
+	}
+	return s.Scan(ctx, m.NarrowScan(req), func(e *spb.Entry) error {
+		if !m.Matches(e.FactName) {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+// A FactMatcher is a compiled ScanFilter.
+type FactMatcher struct {
+	filter *ScanFilter // the filter compiled
+	globs  []*regexp.Regexp
+	re     *regexp.Regexp
+	prefix string // literal prefix of every glob
+}
+
+// NarrowScan returns a copy of req whose FactPrefix is narrowed, where
+// possible, to the literal prefix shared by the matcher's globs.
+func (m *FactMatcher) NarrowScan(req *spb.ScanRequest) *spb.ScanRequest {
+	scan := &spb.ScanRequest{
+		Target:     req.Target,
+		EdgeKind:   req.EdgeKind,
+		FactPrefix: req.FactPrefix,
+	}
+	if m == nil {
+		return scan
+	}
+	if p := m.prefix; len(p) > len(scan.FactPrefix) && strings.HasPrefix(p, scan.FactPrefix) {
+		scan.FactPrefix = p
+	}
+	return scan
+}
+
+// Filter returns the ScanFilter compiled into m, or nil if m is nil.
+func (m *FactMatcher) Filter() *ScanFilter {
+	if m == nil {
+		return nil
+	}
+	return m.filter
+}
+
+// Matches reports whether the given fact name satisfies the compiled filter.
+// A nil FactMatcher matches every fact name.
+func (m *FactMatcher) Matches(name string) bool {
+	if m == nil {
+		return true
+	} else if m.re != nil && !m.re.MatchString(name) {
+		return false
+	} else if len(m.globs) == 0 {
+		return true
+	}
+	for _, g := range m.globs {
+		if g.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// CompileScanFilter validates filter and returns its FactMatcher, or nil if
+// filter places no restrictions on fact names.
+func CompileScanFilter(filter *ScanFilter) (*FactMatcher, error) {
+	if filter == nil || (len(filter.FactGlobs) == 0 && filter.FactRegexp == "") {
+		return nil, nil
+	}
+	m := &FactMatcher{filter: filter}
+	if filter.FactRegexp != "" {
+		re, err := regexp.Compile("^(?:" + filter.FactRegexp + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid fact regexp %q: %v", filter.FactRegexp, err)
+		}
+		m.re = re
+	}
+	for i, glob := range filter.FactGlobs {
+		re, prefix, err := globToRegexp(glob)
+		if err != nil {
+			return nil, err
+		}
+		m.globs = append(m.globs, re)
+		if i == 0 {
+			m.prefix = prefix
+		} else {
+			m.prefix = commonPrefix(m.prefix, prefix)
+		}
+	}
+	return m, nil
+}
+
+var globOpsRE = regexp.MustCompile(`[*]+|[?]`)
+
+// globToRegexp returns an anchored regexp equivalent to the given fact glob and
+// the glob's literal prefix.
+func globToRegexp(glob string) (*regexp.Regexp, string, error) {
+	if glob == "" {
+		return nil, "", errors.New("invalid fact glob: empty pattern")
+	}
+	prefix := glob
+	if loc := globOpsRE.FindStringIndex(glob); loc != nil {
+		prefix = glob[:loc[0]]
+	}
+
+	re := "^"
+	for {
+		loc := globOpsRE.FindStringIndex(glob)
+		if loc == nil {
+			break
+		}
+		re += regexp.QuoteMeta(glob[:loc[0]])
+		switch op := glob[loc[0]:loc[1]]; op {
+		case "**":
+			re += ".*"
+		case "*":
+			re += "[^/]*"
+		case "?":
+			re += "[^/]"
+		default:
+			return nil, "", fmt.Errorf("invalid fact glob %q: unknown operator %q", glob, op)
+		}
+		glob = glob[loc[1]:]
+	}
+	return regexp.MustCompile(re + regexp.QuoteMeta(glob) + "$"), prefix, nil
+}
+
+func commonPrefix(a, b string) string {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[:i]
+		}
+	}
+	if len(a) < len(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// DefaultGCBatchSize is the default GCOptions.BatchSize.
+const DefaultGCBatchSize = 1024
+
+// GCOptions control the behavior of CollectGarbage.
+type GCOptions struct {
+	// BatchSize is the maximum number of sources (or edges, while pruning
+	// dangling edges) removed after each Scan of the store.  If ≤ 0,
+	// DefaultGCBatchSize is used.
+	BatchSize int
+
+	// PruneDanglingEdges additionally removes the edges targeting the sources
+	// removed by this call, once they are removed.  The removed sources are held
+	// in memory until then, so a collection resumed from a ResumeToken only
+	// prunes the edges of the sources it removed itself.
+	PruneDanglingEdges bool
+
+	// PruneAllDanglingEdges additionally removes every edge in the store whose
+	// target has no entries, including those targeting nodes that were never
+	// written (e.g. unindexed dependencies) or removed by an earlier collection.
+	PruneAllDanglingEdges bool
+
+	// Progress, if non-nil, is called after each batch is removed.
+	Progress func(*GCProgress)
+
+	// ResumeToken, if non-empty, continues an interrupted collection from the
+	// last GCProgress.ResumeToken it reported.
+	ResumeToken string
+}
+
+// GCProgress reports the progress of a CollectGarbage call.
+type GCProgress struct {
+	// Sources is the number of sources removed by this call.
+	Sources int64
+
+	// Edges is the number of dangling edges removed by this call.
+	Edges int64
+
+	// Removed is the total number of entries removed by this call.
+	Removed int64
+
+	// ResumeToken may be passed as a GCOptions.ResumeToken to continue the
+	// collection after the last removed batch.
+	ResumeToken string
+}
+
+// CollectGarbage removes every entry of each source in s for which keep
+// returns false, given the source's node facts (keyed by fact name).  s must be
+// a Deleter whose Scan delivers the entries of each source consecutively, as
+// does an OrderedScanner.  The sources are removed in batches between Scans
+// resumed with ScanFrom, and the number of entries removed is returned along
+// with any error.
+func CollectGarbage(ctx context.Context, s Service, keep func(source *spb.VName, facts map[string][]byte) bool, opts *GCOptions) (int64, error) {
+	if opts == nil {
+		opts = &GCOptions{}
+	}
+	d, ok := s.(Deleter)
+	if !ok {
+		return 0, fmt.Errorf("garbage collection unsupported for GraphStore type %T: not a graphstore.Deleter", s)
+	} else if !ScansOrdered(s) {
+		return 0, fmt.Errorf("garbage collection unsupported for GraphStore type %T: Scan is not ordered", s)
+	}
+	pruning, after, err := parseGCToken(opts.ResumeToken)
+	if err != nil {
+		return 0, err
+	}
+
+	gc := &collector{
+		d:         d,
+		opts:      opts,
+		batchSize: opts.BatchSize,
+		progress:  &GCProgress{},
+	}
+	if gc.batchSize <= 0 {
+		gc.batchSize = DefaultGCBatchSize
+	}
+	if opts.PruneDanglingEdges && !opts.PruneAllDanglingEdges {
+		gc.removed = make(map[string]bool)
+	}
+	if !pruning {
+		if err := gc.removeSources(ctx, keep, after); err != nil {
+			return gc.progress.Removed, err
+		}
+		after = nil
+	}
+	if opts.PruneAllDanglingEdges || len(gc.removed) > 0 {
+		if err := gc.pruneEdges(ctx, after); err != nil {
+			return gc.progress.Removed, err
+		}
+	}
+	return gc.progress.Removed, nil
+}
+
+type collector struct {
+	d         Deleter
+	opts      *GCOptions
+	batchSize int
+	progress  *GCProgress
+
+	// removed holds the vnameKey of each removed source when pruning only the
+	// edges targeting them; nil otherwise.
+	removed map[string]bool
+}
+
+// removeSources removes the rejected sources following after, one batch per
+// Scan.
+func (gc *collector) removeSources(ctx context.Context, keep func(*spb.VName, map[string][]byte) bool, after *spb.Entry) error {
+	for {
+		var (
+			batch   []*spb.VName
+			removed int64
+			full    bool
+
+			cur     *spb.VName
+			facts   map[string][]byte
+			entries int64
+			last    *spb.Entry // the last entry of the current source
+		)
+		// finish evaluates the current source, adding it to the batch if
+		// rejected.
+		finish := func() {
+			if !keep(cur, facts) {
+				batch = append(batch, cur)
+				removed += entries
+			}
+			after = last
+			full = len(batch) >= gc.batchSize
+		}
+		if err := ScanFrom(ctx, gc.d, new(spb.ScanRequest), after, func(e *spb.Entry) error {
+			if cur != nil && !compare.VNamesEqual(cur, e.Source) {
+				if finish(); full {
+					return io.EOF
+				}
+				cur = nil
+			}
+			if cur == nil {
+				cur, facts, entries = e.Source, make(map[string][]byte), 0
+			}
+			if e.EdgeKind == "" {
+				facts[e.FactName] = e.FactValue
+			}
+			entries++
+			last = e
+			return nil
+		}); err != nil {
+			return err
+		}
+		if !full && cur != nil {
+			finish()
+		}
+
+		for _, src := range batch {
+			if err := gc.d.Delete(ctx, &DeleteRequest{Source: src}); err != nil {
+				return fmt.Errorf("error deleting source %v: %v", src, err)
+			}
+			if gc.removed != nil {
+				gc.removed[vnameKey(src)] = true
+			}
+		}
+		gc.progress.Sources += int64(len(batch))
+		gc.progress.Removed += removed
+		gc.report(false, after)
+		if !full {
+			return nil
+		}
+	}
+}
+
+// pruneEdges removes the edges following after whose targets have no entries,
+// checking one batch of edges per Scan.  Unless pruning all dangling edges,
+// only the edges targeting a removed source are considered.
+func (gc *collector) pruneEdges(ctx context.Context, after *spb.Entry) error {
+	for {
+		var edges []*spb.Entry
+		full := false
+		if err := ScanFrom(ctx, gc.d, new(spb.ScanRequest), after, func(e *spb.Entry) error {
+			after = e
+			if e.EdgeKind == "" || (gc.removed != nil && !gc.removed[vnameKey(e.Target)]) {
+				return nil
+			}
+			edges = append(edges, e)
+			if full = len(edges) >= gc.batchSize; full {
+				return io.EOF
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		exists := make(map[string]bool)
+		for _, e := range edges {
+			key := vnameKey(e.Target)
+			found, ok := exists[key]
+			if !ok {
+				var err error
+				if found, err = hasEntries(ctx, gc.d, e.Target); err != nil {
+					return err
+				}
+				exists[key] = found
+			}
+			if found {
+				continue
+			}
+			if err := gc.d.Delete(ctx, &DeleteRequest{
+				Source:   e.Source,
+				EdgeKind: e.EdgeKind,
+				FactName: e.FactName,
+				Target:   e.Target,
+			}); err != nil {
+				return fmt.Errorf("error deleting edge %v: %v", e, err)
+			}
+			gc.progress.Edges++
+			gc.progress.Removed++
+		}
+		gc.report(true, after)
+		if !full {
+			return nil
+		}
+	}
+}
+
+// hasEntries reports whether s has any entries with the given source.
+func hasEntries(ctx context.Context, s Service, source *spb.VName) (bool, error) {
+	var found bool
+	if err := s.Read(ctx, &spb.ReadRequest{Source: source, EdgeKind: "*"}, func(*spb.Entry) error {
+		found = true
+		return io.EOF
+	}); err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
+func (gc *collector) report(pruning bool, after *spb.Entry) {
+	if gc.opts.Progress == nil {
+		return
+	}
+	p := *gc.progress
+	p.ResumeToken = gcToken(pruning, after)
+	gc.opts.Progress(&p)
+}
+
+// The phases of a CollectGarbage resume token.
+const (
+	gcSourcesPhase = "sources"
+	gcEdgesPhase   = "edges"
+)
+
+// gcToken encodes the phase of a collection and the last entry it processed as
+// a resume token of the form "<phase>.<PageToken>".
+func gcToken(pruning bool, after *spb.Entry) string {
+	phase := gcSourcesPhase
+	if pruning {
+		phase = gcEdgesPhase
+	}
+	var tok string
+	if after != nil {
+		tok = PageToken(after)
+	}
+	return phase + copyTokenSep + tok
+}
+
+// parseGCToken decodes a resume token from gcToken.  An empty token starts the
+// collection from the beginning.
+func parseGCToken(token string) (pruning bool, after *spb.Entry, err error) {
+	if token == "" {
+		return false, nil, nil
+	}
+	parts := strings.SplitN(token, copyTokenSep, 2)
+	if len(parts) != 2 || (parts[0] != gcSourcesPhase && parts[0] != gcEdgesPhase) {
+		return false, nil, fmt.Errorf("invalid garbage collection resume token: %q", token)
+	}
+	after, err = ParsePageToken(parts[1])
+	if err != nil {
+		return false, nil, fmt.Errorf("invalid garbage collection resume token: %v", err)
+	}
+	return parts[0] == gcEdgesPhase, after, nil
+}
@@ -19,17 +19,24 @@
 package graphstore
 
 import (
+	"container/list"
 	"errors"
 	"io"
 	"strings"
 
 	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/util/schema"
 
+	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 
 	spb "kythe.io/kythe/proto/storage_proto"
 )
 
+// ErrReadOnly is returned when attempting to modify a read-only Service, such
+// as a Snapshot.
+var ErrReadOnly = errors.New("graphstore is read-only")
+
 // An EntryFunc is a callback from the implementation of a Service to deliver
 // entry messages. If the callback returns an error, the operation stops.  If
 // the error is io.EOF, the operation returns nil; otherwise it returns the
@@ -88,6 +95,130 @@ type Sharded interface {
 	Shard(ctx context.Context, req *spb.ShardRequest, f EntryFunc) error
 }
 
+// Recounter is an optional interface for a Sharded Service that can persist
+// the number of entries in each of its shards, maintaining the counts as it is
+// written so that Count need not read the shard.
+type Recounter interface {
+	Sharded
+
+	// Recount rebuilds the counts of the entries in each shard for every given
+	// number of shards (and for each number of shards already counted) by
+	// scanning the Service's entries.  The counts are then maintained by each
+	// later write.
+	Recount(ctx context.Context, shards ...int64) error
+}
+
+// Transactional is an optional interface for a Service that can atomically
+// apply several WriteRequests, possibly for different sources.
+type Transactional interface {
+	Service
+
+	// WriteBatch atomically applies each of the given WriteRequests, as if by
+	// Write; either every update is applied or none are.
+	WriteBatch(ctx context.Context, reqs []*spb.WriteRequest) error
+}
+
+// WriteBatch applies each of reqs to s.  If s implements Transactional, the
+// requests are applied atomically; otherwise they are written in order, each by
+// a separate Write, stopping at the first error.
+func WriteBatch(ctx context.Context, s Service, reqs []*spb.WriteRequest) error {
+	if t, ok := s.(Transactional); ok {
+		return t.WriteBatch(ctx, reqs)
+	}
+	for _, req := range reqs {
+		if err := s.Write(ctx, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshotter is an optional interface for a Service that can provide a
+// consistent view of its entries while it is concurrently being written.
+type Snapshotter interface {
+	Service
+
+	// Snapshot returns a read-only Service viewing the store as it was at the
+	// time of the call; its write methods return ErrReadOnly.  Closing the
+	// snapshot releases its resources without affecting the parent store.
+	Snapshot() (Service, error)
+}
+
+// StatsWriter is an optional interface for a Service that can report the
+// effect of each Write on the store.
+type StatsWriter interface {
+	Service
+
+	// WriteWithStats is equivalent to Write, but also reports how many of the
+	// request's updates were inserted, updated, or left unchanged.
+	WriteWithStats(ctx context.Context, req *spb.WriteRequest) (*WriteStats, error)
+}
+
+// WriteStats summarizes the effect of one or more WriteRequests.
+type WriteStats struct {
+	Inserted  int64 // updates with no pre-existing entry
+	Updated   int64 // updates replacing an entry's different fact value
+	Unchanged int64 // updates identical to an existing entry
+	Skipped   int64 // updates not applied due to WriteOptions.IfAbsent
+}
+
+// Add accumulates the counts of o into s.
+func (s *WriteStats) Add(o *WriteStats) {
+	s.Inserted += o.Inserted
+	s.Updated += o.Updated
+	s.Unchanged += o.Unchanged
+	s.Skipped += o.Skipped
+}
+
+// ReverseScanner is an optional interface for a Service that can deliver the
+// results of a Scan in descending entry order.
+type ReverseScanner interface {
+	Service
+
+	// ReverseScan is equivalent to Scan except that entries are delivered in
+	// reverse compare.Entries order.
+	ReverseScan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error
+}
+
+// ReverseSharded is an optional interface for a Sharded store that can deliver
+// each shard's entries in descending entry order.
+type ReverseSharded interface {
+	Sharded
+
+	// ReverseShard is equivalent to Shard except that entries are delivered in
+	// reverse compare.Entries order.
+	ReverseShard(ctx context.Context, req *spb.ShardRequest, f EntryFunc) error
+}
+
+// Deleter is an optional interface for a Service that can remove entries from
+// the store.
+type Deleter interface {
+	Service
+
+	// Delete removes each entry selected by the given DeleteRequest.  Deleting
+	// entries that do not exist in the store is not an error.
+	Delete(ctx context.Context, req *DeleteRequest) error
+}
+
+// A DeleteRequest selects a set of entries to remove from a store.  Every entry
+// with the given Source is selected, optionally restricted to those with the
+// given EdgeKind and/or FactName (if non-empty) and/or Target (if non-nil).
+type DeleteRequest struct {
+	Source   *spb.VName
+	EdgeKind string
+	FactName string
+	Target   *spb.VName
+}
+
+// EntryMatchesDelete reports whether entry belongs in the set of entries
+// selected by req.
+func EntryMatchesDelete(req *DeleteRequest, entry *spb.Entry) bool {
+	return compare.VNamesEqual(entry.Source, req.Source) &&
+		(req.EdgeKind == "" || entry.EdgeKind == req.EdgeKind) &&
+		(req.FactName == "" || entry.FactName == req.FactName) &&
+		(req.Target == nil || compare.VNamesEqual(entry.Target, req.Target))
+}
+
 // EntryMatchesScan reports whether entry belongs in the result set for req.
 func EntryMatchesScan(req *spb.ScanRequest, entry *spb.Entry) bool {
 	return (req.GetTarget() == nil || compare.VNamesEqual(entry.Target, req.Target)) &&
@@ -95,41 +226,354 @@ func EntryMatchesScan(req *spb.ScanRequest, entry *spb.Entry) bool {
 		strings.HasPrefix(entry.FactName, req.FactPrefix)
 }
 
+// DefaultNodeBatchSize is the default number of nodes whose facts are read
+// together by ScanNodesOfKind.
+const DefaultNodeBatchSize = 64
+
+// NodeKindOptions control the nodes and facts delivered by ScanNodesOfKind.
+type NodeKindOptions struct {
+	// Subkind, if non-empty, restricts nodes to those whose /kythe/subkind fact
+	// has the given value.
+	Subkind string
+
+	// AllFacts controls whether every fact of each node is delivered, rather
+	// than only its /kythe/node/kind fact.
+	AllFacts bool
+
+	// BatchSize is the number of nodes whose facts are read together (if
+	// Subkind or AllFacts is set).  If ≤ 0, DefaultNodeBatchSize is used.
+	BatchSize int
+
+	// Workers is the number of concurrent Reads for each batch of nodes.
+	Workers int
+}
+
+// ScanNodesOfKind calls f with the /kythe/node/kind fact of each node in s with
+// the given kind, found by scanning the store's node kind facts.  If opts
+// restricts the nodes' subkind or requests all of their facts, the matching
+// nodes are first collected (holding each node's VName in memory), then their
+// facts are read in batches and the facts of each node are delivered
+// contiguously.
+func ScanNodesOfKind(ctx context.Context, s Service, kind string, opts *NodeKindOptions, f EntryFunc) error {
+	if opts == nil {
+		opts = new(NodeKindOptions)
+	}
+	req := &spb.ScanRequest{FactPrefix: schema.NodeKindFact}
+	if opts.Subkind == "" && !opts.AllFacts {
+		return s.Scan(ctx, req, func(e *spb.Entry) error {
+			if e.FactName != schema.NodeKindFact || string(e.FactValue) != kind {
+				return nil
+			}
+			return f(e)
+		})
+	}
+
+	// Reads are not issued while scanning, since a store may not support
+	// concurrent requests within a Scan callback.
+	var nodes []*spb.VName
+	if err := s.Scan(ctx, req, func(e *spb.Entry) error {
+		if e.FactName == schema.NodeKindFact && string(e.FactValue) == kind {
+			nodes = append(nodes, e.Source)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultNodeBatchSize
+	}
+	for len(nodes) > 0 {
+		n := batchSize
+		if n > len(nodes) {
+			n = len(nodes)
+		}
+		reqs := make([]*spb.ReadRequest, n)
+		for i, src := range nodes[:n] {
+			reqs[i] = &spb.ReadRequest{Source: src}
+		}
+		nodes = nodes[n:]
+
+		facts := make(map[string][]*spb.Entry, len(reqs))
+		if err := ReadMultiple(ctx, s, reqs, opts.Workers, func(e *spb.Entry) error {
+			key := sourceKey(e.Source)
+			facts[key] = append(facts[key], e)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, r := range reqs {
+			node := facts[sourceKey(r.Source)]
+			if opts.Subkind != "" && !hasFact(node, schema.SubkindFact, opts.Subkind) {
+				continue
+			}
+			for _, e := range node {
+				if !opts.AllFacts && e.FactName != schema.NodeKindFact {
+					continue
+				}
+				if err := f(e); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hasFact reports whether entries contains the given fact.
+func hasFact(entries []*spb.Entry, name, value string) bool {
+	for _, e := range entries {
+		if e.FactName == name && string(e.FactValue) == value {
+			return true
+		}
+	}
+	return false
+}
+
 // BatchWrites returns a channel of WriteRequests for the given entries.
 // Consecutive entries with the same Source will be collected in the same
 // WriteRequest, with each request containing up to maxSize updates.
 func BatchWrites(entries <-chan *spb.Entry, maxSize int) <-chan *spb.WriteRequest {
+	return BatchWritesOpts(entries, &BatchOptions{MaxUpdates: maxSize})
+}
+
+// BatchOptions control how entries are collected into WriteRequests.
+type BatchOptions struct {
+	// MaxUpdates is the maximum number of updates in each WriteRequest.  If
+	// ≤ 0, requests are not limited by their number of updates.
+	MaxUpdates int
+
+	// MaxBytes is the approximate maximum serialized size of each WriteRequest.
+	// An update that alone exceeds MaxBytes is sent in its own WriteRequest.  If
+	// ≤ 0, requests are not limited by size.
+	MaxBytes int
+
+	// Dedup causes updates identical to one already batched for the same
+	// consecutive run of a Source to be dropped.
+	Dedup bool
+}
+
+// BatchWritesOpts returns a channel of WriteRequests for the given entries.
+// Consecutive entries with the same Source will be collected in the same
+// WriteRequest, with each request limited as specified by opts.
+func BatchWritesOpts(entries <-chan *spb.Entry, opts *BatchOptions) <-chan *spb.WriteRequest {
+	ch, _ := BatchWritesContext(context.Background(), entries, opts)
+	return ch
+}
+
+// BatchWritesContext is equivalent to BatchWritesOpts, except that batching
+// stops early if ctx is cancelled.  After the returned WriteRequest channel is
+// closed, the returned error channel delivers ctx's error if batching stopped
+// early, or nil otherwise.  On cancellation, any remaining entries are left
+// unread.
+func BatchWritesContext(ctx context.Context, entries <-chan *spb.Entry, opts *BatchOptions) (<-chan *spb.WriteRequest, <-chan error) {
 	ch := make(chan *spb.WriteRequest)
+	errc := make(chan error, 1)
 	go func() {
-		defer close(ch)
-		var req *spb.WriteRequest
-		for entry := range entries {
-			update := &spb.WriteRequest_Update{
-				EdgeKind:  entry.EdgeKind,
-				Target:    entry.Target,
-				FactName:  entry.FactName,
-				FactValue: entry.FactValue,
+		err := batchWrites(ctx, entries, opts, ch)
+		close(ch)
+		errc <- err
+		close(errc)
+	}()
+	return ch, errc
+}
+
+func batchWrites(ctx context.Context, entries <-chan *spb.Entry, opts *BatchOptions, ch chan<- *spb.WriteRequest) error {
+	send := func(req *spb.WriteRequest) error {
+		select {
+		case ch <- req:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var (
+		req  *spb.WriteRequest
+		size int // approximate serialized size of req
+
+		seen map[seenEntry]bool // entries batched for the current source (if opts.Dedup)
+	)
+	for {
+		var entry *spb.Entry
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-entries:
+			if !ok {
+				if req != nil {
+					return send(req)
+				}
+				return nil
 			}
+			entry = e
+		}
 
-			if req != nil && (!compare.VNamesEqual(req.Source, entry.Source) || len(req.Update) >= maxSize) {
-				ch <- req
-				req = nil
+		if opts.Dedup {
+			if req == nil || !compare.VNamesEqual(req.Source, entry.Source) {
+				seen = make(map[seenEntry]bool)
 			}
+			k := seenEntry{entryKey(entry), string(entry.FactValue)}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+		}
 
-			if req == nil {
-				req = &spb.WriteRequest{
-					Source: entry.Source,
-					Update: []*spb.WriteRequest_Update{update},
-				}
-			} else {
-				req.Update = append(req.Update, update)
+		update := &spb.WriteRequest_Update{
+			EdgeKind:  entry.EdgeKind,
+			Target:    entry.Target,
+			FactName:  entry.FactName,
+			FactValue: entry.FactValue,
+		}
+		updateSize := fieldSize(update)
+
+		if req != nil && (!compare.VNamesEqual(req.Source, entry.Source) ||
+			(opts.MaxUpdates > 0 && len(req.Update) >= opts.MaxUpdates) ||
+			(opts.MaxBytes > 0 && size+updateSize > opts.MaxBytes)) {
+			if err := send(req); err != nil {
+				return err
 			}
+			req = nil
 		}
-		if req != nil {
-			ch <- req
+
+		if req == nil {
+			req = &spb.WriteRequest{
+				Source: entry.Source,
+				Update: []*spb.WriteRequest_Update{update},
+			}
+			size = fieldSize(entry.Source) + updateSize
+		} else {
+			req.Update = append(req.Update, update)
+			size += updateSize
 		}
+	}
+}
+
+type seenEntry struct{ key, value string }
+
+// BatchWritesUnordered returns a channel of WriteRequests for the given
+// entries.  Unlike BatchWrites, entries need not be grouped by Source: an open
+// WriteRequest is kept for each of the maxSources most recently seen sources,
+// and entries for any of those sources are added to its request.  A request is
+// sent once it contains maxSize updates or when its source is evicted as the
+// least recently used to make room for another.  At most maxSources*maxSize
+// updates are buffered at any time.
+//
+// If set is non-nil, each entry already in set (including those previously
+// batched) is dropped; as set spills to disk once its memory budget is
+// exhausted, every duplicate is dropped however many entries are batched.  The
+// caller owns set and must Finish it once batching is complete.  After the
+// returned WriteRequest channel is closed, the returned error channel delivers
+// the first error of set, or nil.  On error, the requests already open are sent
+// and any remaining entries are drained without being batched.  As with
+// BatchWritesContext, batching stops early if ctx is cancelled, delivering
+// ctx's error and leaving the remaining requests unsent and entries unread.
+func BatchWritesUnordered(ctx context.Context, entries <-chan *spb.Entry, maxSize, maxSources int, set *compare.EntrySet) (<-chan *spb.WriteRequest, <-chan error) {
+	ch := make(chan *spb.WriteRequest)
+	errc := make(chan error, 1)
+	go func() {
+		err := batchWritesUnordered(ctx, entries, maxSize, maxSources, set, ch)
+		if err != nil && ctx.Err() == nil {
+			for range entries {
+			}
+		}
+		close(ch)
+		errc <- err
+		close(errc)
 	}()
-	return ch
+	return ch, errc
+}
+
+func batchWritesUnordered(ctx context.Context, entries <-chan *spb.Entry, maxSize, maxSources int, set *compare.EntrySet, ch chan<- *spb.WriteRequest) error {
+	if maxSources < 1 {
+		maxSources = 1
+	}
+	send := func(req *spb.WriteRequest) error {
+		select {
+		case ch <- req:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	lru := list.New()                      // of *spb.WriteRequest; most recently used first
+	open := make(map[string]*list.Element) // keyed by sourceKey
+	flush := func() error {
+		for elt := lru.Back(); elt != nil; elt = elt.Prev() {
+			if err := send(elt.Value.(*spb.WriteRequest)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for {
+		var entry *spb.Entry
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-entries:
+			if !ok {
+				return flush()
+			}
+			entry = e
+		}
+		if set != nil {
+			if added, err := set.Add(entry); err != nil {
+				if ferr := flush(); ferr != nil {
+					return ferr
+				}
+				return err
+			} else if !added {
+				continue
+			}
+		}
+		key := sourceKey(entry.Source)
+		elt, ok := open[key]
+		if ok {
+			lru.MoveToFront(elt)
+		} else {
+			if lru.Len() >= maxSources {
+				oldest := lru.Back()
+				req := lru.Remove(oldest).(*spb.WriteRequest)
+				delete(open, sourceKey(req.Source))
+				if err := send(req); err != nil {
+					return err
+				}
+			}
+			elt = lru.PushFront(&spb.WriteRequest{Source: entry.Source})
+			open[key] = elt
+		}
+
+		req := elt.Value.(*spb.WriteRequest)
+		req.Update = append(req.Update, &spb.WriteRequest_Update{
+			EdgeKind:  entry.EdgeKind,
+			Target:    entry.Target,
+			FactName:  entry.FactName,
+			FactValue: entry.FactValue,
+		})
+		if len(req.Update) >= maxSize {
+			lru.Remove(elt)
+			delete(open, key)
+			if err := send(req); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sourceKey returns a string uniquely identifying the given VName.
+func sourceKey(v *spb.VName) string { return entryKey(&spb.Entry{Source: v}) }
+
+// fieldSize returns the approximate size of msg when serialized as a field of
+// another message.
+func fieldSize(msg proto.Message) int {
+	const fieldOverhead = 6 // upper bound on the size of a field's tag and length
+	return proto.Size(msg) + fieldOverhead
 }
 
 // ValidEntry determines if the given Entry is correctly constructed.
@@ -158,6 +602,8 @@ type grpcClient struct{ spb.GraphStoreClient }
 
 // Read implements part of Service interface.
 func (c *grpcClient) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the server once f is done with the stream
 	s, err := c.GraphStoreClient.Read(ctx, req)
 	if err != nil {
 		return err
@@ -167,6 +613,8 @@ func (c *grpcClient) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc
 
 // Scan implements part of Service interface.
 func (c *grpcClient) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the server once f is done with the stream
 	s, err := c.GraphStoreClient.Scan(ctx, req)
 	if err != nil {
 		return err
@@ -174,6 +622,9 @@ func (c *grpcClient) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc
 	return streamEntries(s, f)
 }
 
+// streamEntries passes each entry received from s to f.  The caller must
+// cancel the stream's context once streamEntries returns, since the server may
+// still be sending entries if f stopped early.
 func streamEntries(s entryStream, f EntryFunc) error {
 	for {
 		e, err := s.Recv()
@@ -183,11 +634,9 @@ func streamEntries(s entryStream, f EntryFunc) error {
 			return err
 		}
 
-		err = f(e)
-		if err == io.EOF {
-			return s.CloseSend()
+		if err := f(e); err == io.EOF {
+			return nil
 		} else if err != nil {
-			s.CloseSend()
 			return err
 		}
 	}
@@ -195,7 +644,6 @@ func streamEntries(s entryStream, f EntryFunc) error {
 
 type entryStream interface {
 	Recv() (*spb.Entry, error)
-	CloseSend() error
 }
 
 // Write implements part of Service interface.
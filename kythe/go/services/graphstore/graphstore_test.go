@@ -0,0 +1,3425 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+var ctx = context.Background()
+
+// sliceStore is a simple Service over a sorted slice of entries.
+type sliceStore struct {
+	mu       sync.Mutex
+	entries  []*spb.Entry
+	readErr  map[string]error // Read errors keyed by source signature
+	scans    int              // number of calls to Scan
+	lastScan *spb.ScanRequest // most recent ScanRequest
+}
+
+func (s *sliceStore) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	if err := s.readErr[req.Source.Signature]; err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if !compare.VNamesEqual(e.Source, req.Source) ||
+			(req.EdgeKind != "*" && e.EdgeKind != req.EdgeKind) {
+			continue
+		}
+		if err := f(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sliceStore) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scans++
+	s.lastScan = req
+	for _, e := range s.entries {
+		if !EntryMatchesScan(req, e) {
+			continue
+		} else if err := f(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sliceStore) Write(ctx context.Context, req *spb.WriteRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range req.Update {
+		e := &spb.Entry{
+			Source:    req.Source,
+			EdgeKind:  u.EdgeKind,
+			Target:    u.Target,
+			FactName:  u.FactName,
+			FactValue: u.FactValue,
+		}
+		i := sort.Search(len(s.entries), func(i int) bool { return compare.Entries(e, s.entries[i]) != compare.GT })
+		if i < len(s.entries) && compare.Entries(e, s.entries[i]) == compare.EQ {
+			s.entries[i] = e
+		} else {
+			s.entries = append(s.entries[:i], append([]*spb.Entry{e}, s.entries[i:]...)...)
+		}
+	}
+	return nil
+}
+
+func (s *sliceStore) Close(ctx context.Context) error { return nil }
+
+func vname(sig string) *spb.VName { return &spb.VName{Signature: sig} }
+
+func fact(src, name, value string) *spb.Entry {
+	return &spb.Entry{Source: vname(src), FactName: name, FactValue: []byte(value)}
+}
+
+func edge(src, kind, tgt string) *spb.Entry {
+	return &spb.Entry{Source: vname(src), EdgeKind: kind, Target: vname(tgt), FactName: "/"}
+}
+
+func TestReadMultiple(t *testing.T) {
+	failure := errors.New("bad source")
+	s := &sliceStore{
+		entries: []*spb.Entry{
+			fact("a", "/kythe/node/kind", "record"),
+			edge("a", "/kythe/edge/ref", "b"),
+			fact("b", "/kythe/node/kind", "function"),
+			fact("c", "/kythe/node/kind", "variable"),
+			fact("d", "/kythe/node/kind", "file"),
+		},
+		readErr: map[string]error{"bad": failure},
+	}
+
+	reqs := []*spb.ReadRequest{
+		{Source: vname("d")},
+		{Source: vname("bad")},
+		{Source: vname("a"), EdgeKind: "*"},
+		{Source: vname("missing")},
+		{Source: vname("b")},
+	}
+	var got []*spb.Entry
+	err := ReadMultiple(ctx, s, reqs, 2, func(e *spb.Entry) error {
+		got = append(got, e)
+		return nil
+	})
+	if errs, ok := err.(MultiError); !ok || len(errs) != 1 {
+		t.Errorf("ReadMultiple error: got %v; want 1 error", err)
+	}
+
+	want := []*spb.Entry{s.entries[4], s.entries[0], s.entries[1], s.entries[2]}
+	if len(got) != len(want) {
+		t.Fatalf("ReadMultiple returned %d entries; want %d", len(got), len(want))
+	}
+	for i, e := range want {
+		if !proto.Equal(got[i], e) {
+			t.Errorf("ReadMultiple result %d: got {%+v}; want {%+v}", i, got[i], e)
+		}
+	}
+
+	var n int
+	if err := ReadMultiple(ctx, s, reqs[2:], 1, func(*spb.Entry) error {
+		n++
+		return io.EOF
+	}); err != nil {
+		t.Errorf("ReadMultiple unexpected error: %v", err)
+	} else if n != 1 {
+		t.Errorf("ReadMultiple delivered %d entries after io.EOF; want 1", n)
+	}
+}
+
+func TestScanPageFallback(t *testing.T) {
+	s := &sliceStore{
+		entries: []*spb.Entry{
+			fact("a", "/kythe/node/kind", "record"),
+			edge("a", "/kythe/edge/ref", "b"),
+			fact("b", "/kythe/node/kind", "function"),
+			fact("c", "/kythe/node/kind", "variable"),
+			fact("d", "/kythe/node/kind", "file"),
+		},
+	}
+	req := &spb.ScanRequest{FactPrefix: "/kythe/node/"}
+
+	var pages [][]*spb.Entry
+	var token string
+	for {
+		page, next, err := ScanPage(ctx, orderedStore{s}, req, 3, token)
+		if err != nil {
+			t.Fatalf("ScanPage error: %v", err)
+		}
+		pages = append(pages, page)
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if len(pages) != 2 || len(pages[0]) != 3 || len(pages[1]) != 1 {
+		t.Fatalf("ScanPage returned pages %v; want sizes [3 1]", pages)
+	}
+	if !proto.Equal(pages[1][0], s.entries[4]) {
+		t.Errorf("Last page: got {%v}; want {%v}", pages[1][0], s.entries[4])
+	}
+
+	if _, _, err := ScanPage(ctx, orderedStore{s}, req, 3, "!invalid!"); err == nil {
+		t.Error("ScanPage succeeded with an invalid page token")
+	}
+
+	// A Service whose Scan is unordered cannot be paged.
+	if _, _, err := ScanPage(ctx, s, req, 3, ""); err != ErrUnsupported {
+		t.Errorf("ScanPage of an unordered Service: got error %v; want %v", err, ErrUnsupported)
+	}
+}
+
+func TestScanFromFallback(t *testing.T) {
+	s := &sliceStore{
+		entries: []*spb.Entry{
+			fact("a", "/kythe/node/kind", "record"),
+			edge("a", "/kythe/edge/ref", "b"),
+			fact("b", "/kythe/node/kind", "function"),
+			fact("d", "/kythe/node/kind", "file"),
+		},
+	}
+
+	tests := []struct {
+		after *spb.Entry
+		want  []*spb.Entry
+	}{
+		{nil, s.entries},
+		{s.entries[0], s.entries[1:]},
+		{s.entries[3], nil},
+		// Entries absent from the store resume at the next greater entry.
+		{fact("b", "/kythe/node/kind", ""), s.entries[3:]},
+		{fact("c", "/kythe/node/kind", ""), s.entries[3:]},
+	}
+	for _, test := range tests {
+		var got []*spb.Entry
+		if err := ScanFrom(ctx, orderedStore{s}, new(spb.ScanRequest), test.after, func(e *spb.Entry) error {
+			got = append(got, e)
+			return nil
+		}); err != nil {
+			t.Fatalf("ScanFrom error: %v", err)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("ScanFrom(%v) found %v; want %v", test.after, got, test.want)
+			continue
+		}
+		for i := range got {
+			if !proto.Equal(got[i], test.want[i]) {
+				t.Errorf("ScanFrom(%v) found %v; want %v", test.after, got, test.want)
+				break
+			}
+		}
+	}
+
+	// A Service whose Scan is unordered can only be scanned from the beginning.
+	if err := ScanFrom(ctx, s, new(spb.ScanRequest), nil, func(*spb.Entry) error { return nil }); err != nil {
+		t.Errorf("ScanFrom(nil) of an unordered Service: %v", err)
+	}
+	if err := ScanFrom(ctx, s, new(spb.ScanRequest), s.entries[0], func(*spb.Entry) error { return nil }); err != ErrUnsupported {
+		t.Errorf("ScanFrom of an unordered Service: got error %v; want %v", err, ErrUnsupported)
+	}
+}
+
+func TestNewProfile(t *testing.T) {
+	s := &sliceStore{
+		entries: []*spb.Entry{
+			fact("a", "/kythe/node/kind", "record"),
+			fact("a", "/kythe/text", "class A {}"),
+			edge("a", "/kythe/edge/ref", "b"),
+			fact("b", "/kythe/node/kind", "function"),
+			edge("b", "/kythe/edge/ref", "a"),
+			edge("b", "/kythe/edge/childof", "a"),
+			fact("c", "/kythe/node/kind", "variable"),
+		},
+	}
+	s.entries[6].Source.Corpus = "other"
+
+	p, err := NewProfile(ctx, s, &ProfileOptions{TopSources: 2, MaxKeys: 2})
+	if err != nil {
+		t.Fatalf("NewProfile error: %v", err)
+	}
+	if p.Total.Entries != 7 || p.Total.FactBytes != 32 {
+		t.Errorf("Total: got %+v; want 7 entries and 32 fact bytes", p.Total)
+	}
+	if s := p.Corpora["other"]; s == nil || s.Entries != 1 {
+		t.Errorf("Corpus %q: got %+v; want 1 entry", "other", s)
+	}
+	if s := p.FactNames["/kythe/node/kind"]; s == nil || s.Entries != 3 {
+		t.Errorf("Fact %q: got %+v; want 3 entries", "/kythe/node/kind", s)
+	}
+	if s := p.EdgeKinds["/kythe/edge/ref"]; s == nil || s.Entries != 2 {
+		t.Errorf("Edge kind %q: got %+v; want 2 entries", "/kythe/edge/ref", s)
+	}
+	if p.Truncated {
+		t.Error("Profile truncated with no more than MaxKeys of each key")
+	}
+
+	if len(p.TopSources) != 2 {
+		t.Fatalf("Found %d top sources; want 2", len(p.TopSources))
+	} else if sig := p.TopSources[0].Source.Signature; sig != "a" || p.TopSources[0].FactBytes != 16 {
+		t.Errorf("Largest source: got %q with %d fact bytes; want %q with 16", sig, p.TopSources[0].FactBytes, "a")
+	} else if sig := p.TopSources[1].Source.Signature; sig != "b" {
+		t.Errorf("Second largest source: got %q; want %q", sig, "b")
+	}
+
+	p, err = NewProfile(ctx, s, &ProfileOptions{MaxKeys: 1})
+	if err != nil {
+		t.Fatalf("NewProfile error: %v", err)
+	}
+	if !p.Truncated {
+		t.Error("Profile not truncated with more than MaxKeys of each key")
+	} else if s := p.EdgeKinds[ProfileOtherKey]; s == nil || s.Entries != 1 {
+		t.Errorf("Edge kind %q: got %+v; want 1 entry", ProfileOtherKey, s)
+	}
+}
+
+func TestCollectGarbageUnsupported(t *testing.T) {
+	s := &sliceStore{entries: []*spb.Entry{fact("a", "/kythe/node/kind", "record")}}
+	if _, err := CollectGarbage(ctx, s, func(*spb.VName, map[string][]byte) bool { return false }, nil); err == nil {
+		t.Error("CollectGarbage succeeded for a store that is not a Deleter")
+	}
+	if len(s.entries) != 1 {
+		t.Errorf("Store has %d entries after failed CollectGarbage; want 1", len(s.entries))
+	}
+}
+
+func TestNotifyingWriter(t *testing.T) {
+	store := &sliceStore{}
+	w := NewNotifyingWriter(store, 1)
+	writeFact := func(name string) error {
+		return w.Write(ctx, &spb.WriteRequest{
+			Source: vname("src"),
+			Update: []*spb.WriteRequest_Update{{FactName: name, FactValue: []byte("v")}},
+		})
+	}
+	if err := writeFact("/unwatched"); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	got := make(chan string)
+	done := make(chan error)
+	go func() {
+		done <- w.Watch(cctx, func(e *spb.Entry) error {
+			got <- e.FactName
+			return nil
+		})
+	}()
+	for w.NumWatchers() == 0 {
+		runtime.Gosched()
+	}
+
+	// With a buffer of 1, the second write blocks until the first entry has been
+	// consumed.
+	written := make(chan error)
+	go func() {
+		for _, name := range []string{"/a", "/b", "/c"} {
+			if err := writeFact(name); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+	for _, want := range []string{"/a", "/b", "/c"} {
+		if name := <-got; name != want {
+			t.Errorf("Watched %q; want %q", name, want)
+		}
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Watch: got error %v; want %v", err, context.Canceled)
+	}
+	if n := w.NumWatchers(); n != 0 {
+		t.Errorf("Found %d watchers after cancellation; want 0", n)
+	}
+	if err := writeFact("/d"); err != nil {
+		t.Errorf("Write error: %v", err)
+	}
+	if len(store.entries) != 5 {
+		t.Errorf("Found %d entries in store; want 5", len(store.entries))
+	}
+}
+
+func TestBatchWritesOpts(t *testing.T) {
+	big := strings.Repeat("x", 100)
+	entries := []*spb.Entry{
+		fact("a", "/1", "small"),
+		fact("a", "/2", "small"),
+		fact("a", "/3", big),     // exceeds the limit with the preceding updates
+		fact("a", "/4", big+big), // exceeds the limit alone
+		fact("a", "/5", "small"),
+		fact("b", "/1", "small"),
+		fact("b", "/2", "small"),
+		fact("b", "/3", "small"),
+		fact("b", "/4", "small"),
+	}
+	ch := make(chan *spb.Entry, len(entries))
+	for _, e := range entries {
+		ch <- e
+	}
+	close(ch)
+
+	var got [][]string
+	for req := range BatchWritesOpts(ch, &BatchOptions{MaxUpdates: 3, MaxBytes: 150}) {
+		facts := []string{req.Source.Signature}
+		for _, u := range req.Update {
+			facts = append(facts, u.FactName)
+		}
+		got = append(got, facts)
+	}
+	want := [][]string{
+		{"a", "/1", "/2"},
+		{"a", "/3"},
+		{"a", "/4"},
+		{"a", "/5"},
+		{"b", "/1", "/2", "/3"},
+		{"b", "/4"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BatchWritesOpts: got %v; want %v", got, want)
+	}
+}
+
+func TestBatchWritesContextCancel(t *testing.T) {
+	// The entries channel remains open, so batching only stops once cancelled.
+	entries := make(chan *spb.Entry, 2)
+	defer close(entries)
+	entries <- fact("src0", "/fact", "value")
+	entries <- fact("src1", "/fact", "value")
+
+	cctx, cancel := context.WithCancel(ctx)
+	reqs, errc := BatchWritesContext(cctx, entries, &BatchOptions{MaxUpdates: 10})
+	if req := <-reqs; req.Source.Signature != "src0" {
+		t.Errorf("First request for %q; want %q", req.Source.Signature, "src0")
+	}
+
+	// Stop reading; the batching goroutine must still exit once cancelled.
+	cancel()
+	for range reqs {
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("BatchWritesContext: got error %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestBatchWritesContextComplete(t *testing.T) {
+	entries := make(chan *spb.Entry, 2)
+	entries <- fact("a", "/1", "v")
+	entries <- fact("b", "/1", "v")
+	close(entries)
+
+	reqs, errc := BatchWritesContext(ctx, entries, &BatchOptions{MaxUpdates: 10})
+	var n int
+	for range reqs {
+		n++
+	}
+	if n != 2 {
+		t.Errorf("Found %d requests; want 2", n)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("BatchWritesContext error: %v", err)
+	}
+}
+
+func TestBatchWritesDedup(t *testing.T) {
+	entries := []*spb.Entry{
+		fact("a", "/kind", "record"),
+		edge("a", "/ref", "b"),
+		fact("a", "/kind", "record"),
+		fact("a", "/kind", "other"), // differs in value
+		edge("a", "/ref", "b"),
+		fact("b", "/kind", "record"),
+		fact("a", "/kind", "record"), // a new run of the source
+	}
+	for _, dedup := range []bool{false, true} {
+		ch := make(chan *spb.Entry, len(entries))
+		for _, e := range entries {
+			ch <- e
+		}
+		close(ch)
+
+		var got []int
+		for req := range BatchWritesOpts(ch, &BatchOptions{MaxUpdates: 2, Dedup: dedup}) {
+			got = append(got, len(req.Update))
+		}
+		want := []int{2, 2, 1, 1, 1}
+		if dedup {
+			want = []int{2, 1, 1, 1}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("BatchWritesOpts(Dedup: %v): got request sizes %v; want %v", dedup, got, want)
+		}
+	}
+}
+
+func BenchmarkBatchWrites(b *testing.B)      { benchmarkBatchWrites(b, false) }
+func BenchmarkBatchWritesDedup(b *testing.B) { benchmarkBatchWrites(b, true) }
+
+// benchmarkBatchWrites batches an indexer-like stream in which each anchor
+// repeats the node facts of its file.
+func benchmarkBatchWrites(b *testing.B, dedup bool) {
+	var entries []*spb.Entry
+	for f := 0; f < 100; f++ {
+		file := fmt.Sprintf("file%d", f)
+		for a := 0; a < 50; a++ {
+			entries = append(entries,
+				fact(file, "/kythe/node/kind", "file"),
+				fact(file, "/kythe/text/encoding", "utf-8"),
+				edge(file, "/kythe/edge/childof", fmt.Sprintf("anchor%d", a)))
+		}
+	}
+
+	var updates int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch := make(chan *spb.Entry, len(entries))
+		for _, e := range entries {
+			ch <- e
+		}
+		close(ch)
+
+		updates = 0
+		for req := range BatchWritesOpts(ch, &BatchOptions{MaxUpdates: 1024, Dedup: dedup}) {
+			updates += len(req.Update)
+		}
+	}
+	b.StopTimer()
+	b.Logf("Batched %d of %d entries", updates, len(entries))
+}
+
+func TestBatchWritesUnordered(t *testing.T) {
+	// A round-robin interleaving of the facts of 3 sources.
+	var entries []*spb.Entry
+	for i := 0; i < 4; i++ {
+		for _, src := range []string{"a", "b", "c"} {
+			entries = append(entries, fact(src, fmt.Sprintf("/%d", i), "v"))
+		}
+	}
+
+	tests := []struct {
+		maxSize, maxSources int
+		want                []string // each request's source and number of updates
+	}{
+		{maxSize: 10, maxSources: 3, want: []string{"a4", "b4", "c4"}},
+		{maxSize: 3, maxSources: 3, want: []string{"a3", "b3", "c3", "a1", "b1", "c1"}},
+		{maxSize: 10, maxSources: 2, want: []string{
+			"a1", "b1", "c1", "a1", "b1", "c1", "a1", "b1", "c1", "a1", "b1", "c1",
+		}},
+	}
+	for _, test := range tests {
+		ch := make(chan *spb.Entry, len(entries))
+		for _, e := range entries {
+			ch <- e
+		}
+		close(ch)
+
+		var got []string
+		var facts int
+		reqs, errc := BatchWritesUnordered(ctx, ch, test.maxSize, test.maxSources, nil)
+		for req := range reqs {
+			got = append(got, fmt.Sprintf("%s%d", req.Source.Signature, len(req.Update)))
+			facts += len(req.Update)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("BatchWritesUnordered(maxSize: %d, maxSources: %d): got %v; want %v",
+				test.maxSize, test.maxSources, got, test.want)
+		}
+		if facts != len(entries) {
+			t.Errorf("BatchWritesUnordered(maxSize: %d, maxSources: %d): got %d updates; want %d",
+				test.maxSize, test.maxSources, facts, len(entries))
+		}
+	}
+}
+
+func TestBatchWritesUnorderedCancel(t *testing.T) {
+	// The entries channel remains open, so batching only stops once cancelled.
+	entries := make(chan *spb.Entry, 3)
+	defer close(entries)
+	entries <- fact("src0", "/fact", "value")
+	entries <- fact("src1", "/fact", "value")
+	entries <- fact("src2", "/fact", "value")
+
+	cctx, cancel := context.WithCancel(ctx)
+	reqs, errc := BatchWritesUnordered(cctx, entries, 10, 1, nil)
+	if req := <-reqs; req.Source.Signature != "src0" {
+		t.Errorf("First request for %q; want %q", req.Source.Signature, "src0")
+	}
+
+	// Stop reading; the batching goroutine must still exit once cancelled.
+	cancel()
+	for range reqs {
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("BatchWritesUnordered: got error %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestTargetMatches(t *testing.T) {
+	fields := []struct {
+		name     string
+		set      func(*spb.VName, string)
+		prefixed bool
+	}{
+		{"Signature", func(v *spb.VName, s string) { v.Signature = s }, true},
+		{"Corpus", func(v *spb.VName, s string) { v.Corpus = s }, false},
+		{"Root", func(v *spb.VName, s string) { v.Root = s }, false},
+		{"Path", func(v *spb.VName, s string) { v.Path = s }, true},
+		{"Language", func(v *spb.VName, s string) { v.Language = s }, false},
+	}
+	target := &spb.VName{
+		Signature: "value",
+		Corpus:    "value",
+		Root:      "value",
+		Path:      "value",
+		Language:  "value",
+	}
+	modes := []ScanOptions{
+		{},
+		{PartialTarget: true},
+		{PrefixTarget: true},
+		{PartialTarget: true, PrefixTarget: true},
+	}
+
+	for _, field := range fields {
+		for _, mode := range modes {
+			prefix := mode.PrefixTarget && field.prefixed
+			tests := []struct {
+				value string
+				want  bool
+			}{
+				{"value", true},
+				{"other", false},
+				{"val", prefix},
+				{"", prefix || mode.PartialTarget},
+			}
+			for _, test := range tests {
+				pattern := *target
+				field.set(&pattern, test.value)
+				if got := TargetMatches(&pattern, target, &mode); got != test.want {
+					t.Errorf("TargetMatches(%s: %q) with %+v: got %v; want %v",
+						field.name, test.value, mode, got, test.want)
+				}
+			}
+		}
+	}
+}
+
+func TestScanWithOptionsFallback(t *testing.T) {
+	store := &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kind", "anchor"),
+		{Source: vname("a"), EdgeKind: "/ref", Target: &spb.VName{Corpus: "x", Path: "src/foo/a.go"}, FactName: "/"},
+		{Source: vname("a"), EdgeKind: "/ref", Target: &spb.VName{Corpus: "x", Path: "src/bar/b.go"}, FactName: "/"},
+		{Source: vname("b"), EdgeKind: "/ref", Target: &spb.VName{Corpus: "y", Path: "src/foo/c.go"}, FactName: "/"},
+	}}
+	tests := []struct {
+		target *spb.VName
+		opts   *ScanOptions
+		want   []int // indices into store.entries
+	}{
+		{&spb.VName{Corpus: "x"}, nil, nil},
+		{&spb.VName{Corpus: "x"}, &ScanOptions{PartialTarget: true}, []int{1, 2}},
+		{&spb.VName{Path: "src/foo/"}, &ScanOptions{PartialTarget: true, PrefixTarget: true}, []int{1, 3}},
+		{&spb.VName{Corpus: "x", Path: "src/foo/"}, &ScanOptions{PartialTarget: true, PrefixTarget: true}, []int{1}},
+		{&spb.VName{Path: "src/"}, &ScanOptions{PrefixTarget: true}, nil},
+	}
+	for _, test := range tests {
+		var got []int
+		if err := ScanWithOptions(ctx, store, &spb.ScanRequest{Target: test.target}, test.opts, func(e *spb.Entry) error {
+			for i, se := range store.entries {
+				if e == se {
+					got = append(got, i)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Errorf("ScanWithOptions error: %v", err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ScanWithOptions(%v, %+v): got %v; want %v", test.target, test.opts, got, test.want)
+		}
+	}
+}
+
+func TestScanKinds(t *testing.T) {
+	store := &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kind", "function"),
+		edge("a", "/call", "b"),
+		edge("a", "/defines", "c"),
+		edge("a", "/ref", "d"),
+		edge("b", "/call", "c"),
+	}}
+	tests := []struct {
+		kinds []string
+		req   *spb.ScanRequest
+		want  []int // indices into store.entries
+	}{
+		{nil, new(spb.ScanRequest), []int{0, 1, 2, 3, 4}},
+		{[]string{"/call", "/defines"}, new(spb.ScanRequest), []int{1, 2, 4}},
+		{[]string{"/call", "/defines"}, &spb.ScanRequest{Target: vname("c")}, []int{2, 4}},
+		{[]string{"/call", "/defines"}, &spb.ScanRequest{EdgeKind: "/call"}, []int{1, 4}},
+		{[]string{"/missing"}, new(spb.ScanRequest), nil},
+	}
+	for _, test := range tests {
+		store.scans = 0
+		var got []int
+		if err := ScanKinds(ctx, store, test.kinds, test.req, func(e *spb.Entry) error {
+			for i, se := range store.entries {
+				if e == se {
+					got = append(got, i)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Errorf("ScanKinds error: %v", err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ScanKinds(%v, {%v}): got %v; want %v", test.kinds, test.req, got, test.want)
+		}
+		if store.scans != 1 {
+			t.Errorf("ScanKinds(%v, {%v}) used %d scans; want 1", test.kinds, test.req, store.scans)
+		}
+	}
+}
+
+func TestFilteredScan(t *testing.T) {
+	store := &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/loc/end", "2"),
+		fact("a", "/kythe/loc/start", "1"),
+		fact("a", "/kythe/node/kind", "anchor"),
+		fact("a", "/kythe/text", "text"),
+		fact("a", "/kythe/text/encoding", "utf-8"),
+	}}
+	tests := []struct {
+		filter     *ScanFilter
+		factPrefix string // of the underlying Scan
+		want       []int  // indices into store.entries
+	}{
+		{nil, "", []int{0, 1, 2, 3, 4}},
+		{&ScanFilter{FactGlobs: []string{"/kythe/loc/*"}}, "/kythe/loc/", []int{0, 1}},
+		{&ScanFilter{FactGlobs: []string{"/kythe/**"}}, "/kythe/", []int{0, 1, 2, 3, 4}},
+		{&ScanFilter{FactGlobs: []string{"/kythe/*"}}, "/kythe/", []int{3}},
+		{&ScanFilter{FactGlobs: []string{"/kythe/text"}}, "/kythe/text", []int{3}},
+		{&ScanFilter{FactGlobs: []string{"/kythe/loc/*", "/kythe/node/*"}}, "/kythe/", []int{0, 1, 2}},
+		{&ScanFilter{FactGlobs: []string{"/kythe/loc/??d"}}, "/kythe/loc/", []int{0}},
+		{&ScanFilter{FactRegexp: "/kythe/(loc|text)/.*"}, "", []int{0, 1, 4}},
+		{&ScanFilter{FactGlobs: []string{"/kythe/**"}, FactRegexp: ".*/e[a-z]+"}, "/kythe/", []int{0, 4}},
+	}
+	for _, test := range tests {
+		var got []int
+		if err := FilteredScan(ctx, store, new(spb.ScanRequest), test.filter, func(e *spb.Entry) error {
+			for i, se := range store.entries {
+				if e == se {
+					got = append(got, i)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Errorf("FilteredScan(%+v) error: %v", test.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("FilteredScan(%+v): got %v; want %v", test.filter, got, test.want)
+		}
+		if store.lastScan.FactPrefix != test.factPrefix {
+			t.Errorf("FilteredScan(%+v): scanned FactPrefix %q; want %q", test.filter, store.lastScan.FactPrefix, test.factPrefix)
+		}
+	}
+
+	store.scans = 0
+	for _, filter := range []*ScanFilter{
+		{FactGlobs: []string{""}},
+		{FactGlobs: []string{"/kythe/***"}},
+		{FactRegexp: "/kythe/(loc"},
+	} {
+		if err := FilteredScan(ctx, store, new(spb.ScanRequest), filter, func(*spb.Entry) error { return nil }); err == nil {
+			t.Errorf("FilteredScan(%+v): expected error", filter)
+		}
+	}
+	if store.scans != 0 {
+		t.Errorf("Invalid filters caused %d scans; want 0", store.scans)
+	}
+}
+
+// filteringStore is a FilterScanner recording the FactMatcher of its last
+// ScanFiltered.
+type filteringStore struct {
+	*sliceStore
+	m *FactMatcher
+}
+
+func (s *filteringStore) ScanFiltered(ctx context.Context, req *spb.ScanRequest, m *FactMatcher, f EntryFunc) error {
+	s.m = m
+	return s.Scan(ctx, req, func(e *spb.Entry) error {
+		if !m.Matches(e.FactName) {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+func TestScanMatching(t *testing.T) {
+	store := &filteringStore{sliceStore: &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "anchor"),
+		fact("a", "/kythe/text", "text"),
+	}}}
+	filter := &ScanFilter{FactRegexp: "/kythe/t.*"}
+	m, err := CompileScanFilter(filter)
+	if err != nil {
+		t.Fatalf("CompileScanFilter(%+v) error: %v", filter, err)
+	} else if m.Filter() != filter {
+		t.Errorf("Filter(): got %+v; want %+v", m.Filter(), filter)
+	}
+
+	var got []string
+	if err := ScanMatching(ctx, store, new(spb.ScanRequest), m, func(e *spb.Entry) error {
+		got = append(got, e.FactName)
+		return nil
+	}); err != nil {
+		t.Fatalf("ScanMatching error: %v", err)
+	}
+	if want := []string{"/kythe/text"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanMatching: got %v; want %v", got, want)
+	}
+	if store.m != m {
+		t.Errorf("ScanFiltered was given matcher %p; want the compiled %p", store.m, m)
+	}
+}
+
+func TestFuncSharded(t *testing.T) {
+	s := &sliceStore{}
+	for _, corpus := range []string{"a", "b", "c", "d", "e", "f"} {
+		for _, sig := range []string{"1", "2", "3"} {
+			s.entries = append(s.entries, &spb.Entry{
+				Source:    &spb.VName{Signature: sig, Corpus: corpus},
+				FactName:  "/kythe/node/kind",
+				FactValue: []byte("test"),
+			})
+		}
+	}
+
+	if _, err := NewFuncSharded(s, "unknown"); err == nil {
+		t.Error("NewFuncSharded with an unknown ShardFunc succeeded; expected an error")
+	}
+
+	fs, err := NewFuncSharded(s, CorpusShardFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := fs.ShardFunc(); name != CorpusShardFunc {
+		t.Errorf("ShardFunc() = %q; want %q", name, CorpusShardFunc)
+	}
+
+	const shards = 4
+	corpusShard := make(map[string]int64)
+	var total int
+	for i := int64(0); i < shards; i++ {
+		count, err := fs.Count(ctx, &spb.CountRequest{Index: i, Shards: shards})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found int64
+		if err := fs.Shard(ctx, &spb.ShardRequest{Index: i, Shards: shards}, func(e *spb.Entry) error {
+			if prev, ok := corpusShard[e.Source.Corpus]; ok && prev != i {
+				t.Errorf("corpus %q split across shards %d and %d", e.Source.Corpus, prev, i)
+			}
+			corpusShard[e.Source.Corpus] = i
+			found++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if found != count {
+			t.Errorf("Shard %d has %d entries; Count reported %d", i, found, count)
+		}
+		total += int(found)
+	}
+	if total != len(s.entries) {
+		t.Errorf("Found %d entries across shards; want %d", total, len(s.entries))
+	}
+
+	if _, err := fs.Count(ctx, &spb.CountRequest{Index: shards, Shards: shards}); err == nil {
+		t.Error("Count with an out-of-range index succeeded; expected an error")
+	}
+}
+
+func TestShardFuncsInRange(t *testing.T) {
+	for _, name := range []string{HashShardFunc, CorpusShardFunc} {
+		f, err := LookupShardFunc(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, shards := range []int{1, 2, 7} {
+			for _, sig := range []string{"", "a", "b", "sig"} {
+				src := &spb.VName{Signature: sig, Corpus: sig + "corpus"}
+				if i := f(src, shards); i < 0 || i >= shards {
+					t.Errorf("%s(%v, %d) = %d; out of range", name, src, shards, i)
+				}
+			}
+		}
+	}
+}
+
+// failingShard is a Sharded store whose shard with the given index fails.
+type failingShard struct {
+	FuncSharded
+	index int64
+}
+
+var errShardFailed = errors.New("shard failed")
+
+func (s *failingShard) Shard(ctx context.Context, req *spb.ShardRequest, f EntryFunc) error {
+	if req.Index == s.index {
+		return errShardFailed
+	}
+	return s.FuncSharded.Shard(ctx, req, f)
+}
+
+func shardedSliceStore(t testing.TB, n int) FuncSharded {
+	s := &sliceStore{}
+	for i := 0; i < n; i++ {
+		s.entries = append(s.entries, &spb.Entry{
+			Source:    vname(fmt.Sprintf("sig%03d", i)),
+			FactName:  "/kythe/node/kind",
+			FactValue: []byte("test"),
+		})
+	}
+	fs, err := NewFuncSharded(s, HashShardFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestParallelShards(t *testing.T) {
+	const n = 100
+	s := shardedSliceStore(t, n)
+
+	seen := make(map[string]int)
+	if err := ParallelShards(ctx, s, 4, func(e *spb.Entry) error {
+		seen[e.Source.Signature]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != n {
+		t.Errorf("Found %d distinct sources; want %d", len(seen), n)
+	}
+	for sig, count := range seen {
+		if count != 1 {
+			t.Errorf("Source %q delivered %d times", sig, count)
+		}
+	}
+
+	var delivered int
+	if err := ParallelShards(ctx, s, 4, func(e *spb.Entry) error {
+		delivered++
+		if delivered == 10 {
+			return io.EOF
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Unexpected error after io.EOF: %v", err)
+	}
+	if delivered != 10 {
+		t.Errorf("Delivered %d entries after io.EOF; want 10", delivered)
+	}
+}
+
+func TestParallelShardsFunc(t *testing.T) {
+	const workers = 3
+	s := shardedSliceStore(t, 50)
+
+	var mu sync.Mutex
+	counts := make(map[int64]int64)
+	if err := ParallelShardsFunc(ctx, s, workers, func(shard int64, e *spb.Entry) error {
+		if want := int64(HashShards(e.Source, workers)); shard != want {
+			t.Errorf("Entry %v delivered for shard %d; want %d", e, shard, want)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		counts[shard]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < workers; i++ {
+		count, err := s.Count(ctx, &spb.CountRequest{Index: i, Shards: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts[i] != count {
+			t.Errorf("Shard %d delivered %d entries; Count reported %d", i, counts[i], count)
+		}
+	}
+}
+
+func TestParallelShardsError(t *testing.T) {
+	s := &failingShard{shardedSliceStore(t, 50), 1}
+	err := ParallelShards(ctx, s, 4, func(*spb.Entry) error { return nil })
+	errs, ok := err.(MultiError)
+	if !ok {
+		t.Fatalf("Expected MultiError; found %T: %v", err, err)
+	} else if len(errs) != 1 || !strings.Contains(errs[0].Error(), errShardFailed.Error()) {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+}
+
+func TestParallelShardsStopAfterError(t *testing.T) {
+	s := shardedSliceStore(t, 100)
+	failure := errors.New("callback failed")
+	var calls int32
+	err := ParallelShards(ctx, s, 4, func(*spb.Entry) error {
+		atomic.AddInt32(&calls, 1)
+		return failure
+	})
+	if errs, ok := err.(MultiError); !ok || len(errs) != 1 || !strings.Contains(errs[0].Error(), failure.Error()) {
+		t.Errorf("ParallelShards: got error %v; want a MultiError of %v", err, failure)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Callback called %d times; want 1", n)
+	}
+
+	calls = 0
+	err = ParallelShardsFunc(ctx, s, 4, func(int64, *spb.Entry) error {
+		atomic.AddInt32(&calls, 1)
+		return failure
+	})
+	if errs, ok := err.(MultiError); !ok || len(errs) == 0 {
+		t.Errorf("ParallelShardsFunc: got error %v; want a MultiError of %v", err, failure)
+	}
+	if n := atomic.LoadInt32(&calls); n > 4 {
+		t.Errorf("Callback called %d times for 4 shards; want at most 4", n)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := &sliceStore{}
+	for _, corpus := range []string{"a", "b"} {
+		for i := 0; i < 50; i++ {
+			src := &spb.VName{Signature: fmt.Sprintf("sig%d", i), Corpus: corpus}
+			s.entries = append(s.entries,
+				&spb.Entry{Source: src, FactName: "/kythe/node/kind", FactValue: []byte("test")},
+				&spb.Entry{Source: src, EdgeKind: "/kythe/edge/childof", Target: vname("parent"), FactName: "/"})
+		}
+	}
+	fs, err := NewFuncSharded(s, CorpusShardFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		s    Service
+		opts *StatsOptions
+	}{
+		{s, nil},
+		{fs, nil},
+		{fs, &StatsOptions{Workers: 3}},
+	} {
+		stats, err := Stats(ctx, test.s, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Entries != 200 {
+			t.Errorf("Entries = %d; want 200", stats.Entries)
+		}
+		if stats.Sources < 95 || stats.Sources > 105 {
+			t.Errorf("Sources = %d; want ~100", stats.Sources)
+		}
+		if stats.FactBytes != 400 {
+			t.Errorf("FactBytes = %d; want 400", stats.FactBytes)
+		}
+		if want := map[string]int64{"a": 100, "b": 100}; !reflect.DeepEqual(stats.Corpora, want) {
+			t.Errorf("Corpora = %v; want %v", stats.Corpora, want)
+		}
+	}
+
+	stats, err := Stats(ctx, fs, &StatsOptions{EntriesOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (&StoreStats{Entries: 200}); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("EntriesOnly stats = %+v; want %+v", stats, expected)
+	}
+}
+
+// indexedStore is a TargetIndexed sliceStore recording its ReverseEdges calls.
+type indexedStore struct {
+	*sliceStore
+	reverseEdges int
+}
+
+func (s *indexedStore) ReverseEdges(ctx context.Context, target *spb.VName, kinds []string, f EntryFunc) error {
+	s.reverseEdges++
+	return s.sliceStore.Scan(ctx, &spb.ScanRequest{Target: target}, func(e *spb.Entry) error {
+		if len(kinds) > 0 && !containsString(kinds, e.EdgeKind) {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+func reverseEdgesStore() *sliceStore {
+	return &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		edge("a", "/kythe/edge/childof", "target"),
+		edge("a", "/kythe/edge/ref", "target"),
+		fact("b", "/kythe/node/kind", "function"),
+		fact("b", "/kythe/subkind", "method"),
+		edge("b", "/kythe/edge/ref", "target"),
+		fact("c", "/kythe/node/kind", "variable"),
+		edge("c", "/kythe/edge/ref", "a"),
+		fact("target", "/kythe/node/kind", "record"),
+	}}
+}
+
+func TestReverseEdges(t *testing.T) {
+	s := reverseEdgesStore()
+	indexed := &indexedStore{sliceStore: reverseEdgesStore()}
+
+	tests := []struct {
+		target string
+		kinds  []string
+		edges  []string
+	}{
+		{"target", nil, []string{"a /kythe/edge/childof", "a /kythe/edge/ref", "b /kythe/edge/ref"}},
+		{"target", []string{"/kythe/edge/ref"}, []string{"a /kythe/edge/ref", "b /kythe/edge/ref"}},
+		{"target", []string{"/kythe/edge/childof", "/kythe/edge/ref"}, []string{"a /kythe/edge/childof", "a /kythe/edge/ref", "b /kythe/edge/ref"}},
+		{"a", nil, []string{"c /kythe/edge/ref"}},
+		{"c", nil, nil},
+		{"missing", []string{"/kythe/edge/ref"}, nil},
+	}
+	for _, gs := range []Service{s, indexed} {
+		for _, test := range tests {
+			var edges []string
+			if err := ReverseEdges(ctx, gs, vname(test.target), test.kinds, func(e *spb.Entry) error {
+				edges = append(edges, e.Source.Signature+" "+e.EdgeKind)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(edges, test.edges) {
+				t.Errorf("%T: ReverseEdges(%q, %v) = %v; want %v", gs, test.target, test.kinds, edges, test.edges)
+			}
+		}
+	}
+	if indexed.reverseEdges != len(tests) {
+		t.Errorf("TargetIndexed.ReverseEdges called %d times; want %d", indexed.reverseEdges, len(tests))
+	} else if indexed.scans != indexed.reverseEdges {
+		t.Errorf("Found %d Scans of TargetIndexed store; want only those from ReverseEdges", indexed.scans)
+	}
+}
+
+func TestReverseEdgesWithFacts(t *testing.T) {
+	s := reverseEdgesStore()
+
+	var edges int
+	var facts []string
+	if err := ReverseEdgesWithFacts(ctx, s, vname("target"), nil, 2, func(e *spb.Entry) error {
+		edges++
+		return nil
+	}, func(e *spb.Entry) error {
+		facts = append(facts, e.Source.Signature+" "+e.FactName)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if edges != 3 {
+		t.Errorf("Found %d edges; want 3", edges)
+	}
+	if expected := []string{"a /kythe/node/kind", "b /kythe/node/kind", "b /kythe/subkind"}; !reflect.DeepEqual(facts, expected) {
+		t.Errorf("Found facts %v; want %v", facts, expected)
+	}
+
+	if err := ReverseEdgesWithFacts(ctx, s, vname("c"), nil, 2, func(e *spb.Entry) error {
+		t.Errorf("Unexpected edge: %v", e)
+		return nil
+	}, func(e *spb.Entry) error {
+		t.Errorf("Unexpected fact: %v", e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateEntry(t *testing.T) {
+	tests := []struct {
+		e    *spb.Entry
+		rule ValidationRule
+	}{
+		{fact("node", "/kythe/node/kind", "record"), ""},
+		{edge("node", "/kythe/edge/ref", "target"), ""},
+		{&spb.Entry{Source: vname("a"), EdgeKind: "/kythe/edge/param", Target: vname("b"), FactName: OrdinalFact, FactValue: []byte("2")}, ""},
+
+		{&spb.Entry{FactName: "/kythe/node/kind", FactValue: []byte("record")}, RuleEmptySource},
+		{&spb.Entry{Source: &spb.VName{}, FactName: "/kythe/node/kind"}, RuleEmptySource},
+		{fact("node", "kythe/node/kind", "record"), RuleFactName},
+		{fact("node", "", "record"), RuleFactName},
+		{&spb.Entry{Source: vname("a"), EdgeKind: "/kythe/edge/ref", FactName: "/"}, RuleEdgeTarget},
+		{&spb.Entry{Source: vname("a"), Target: vname("b"), FactName: "/kythe/node/kind"}, RuleNodeTarget},
+		{&spb.Entry{Source: vname("a"), EdgeKind: "/kythe/edge/ref", Target: vname("b"), FactName: "/", FactValue: []byte("x")}, RuleEdgeFactValue},
+		{&spb.Entry{Source: vname("a"), EdgeKind: "/kythe/edge/param", Target: vname("b"), FactName: OrdinalFact, FactValue: []byte("first")}, RuleEdgeFactValue},
+	}
+	for _, test := range tests {
+		err := ValidateEntry(test.e)
+		if test.rule == "" {
+			if err != nil {
+				t.Errorf("ValidateEntry(%v) = %v; want nil", test.e, err)
+			}
+		} else if verr, ok := err.(*ValidationError); !ok || verr.Rule != test.rule {
+			t.Errorf("ValidateEntry(%v) = %v; want rule %q", test.e, err, test.rule)
+		}
+	}
+}
+
+func TestValidatingWriter(t *testing.T) {
+	req := &spb.WriteRequest{
+		Source: vname("a"),
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+			{FactName: "bad", FactValue: []byte("value")},
+			{EdgeKind: "/kythe/edge/ref", FactName: "/"},
+			{EdgeKind: "/kythe/edge/ref", Target: vname("b"), FactName: "/"},
+		},
+	}
+
+	s := &sliceStore{}
+	w := NewValidatingWriter(s, false)
+	if err := w.Write(ctx, req); err == nil {
+		t.Error("Write of invalid entries succeeded; expected an error")
+	} else if len(s.entries) != 0 {
+		t.Errorf("Rejected Write stored entries: %v", s.entries)
+	}
+
+	s = &sliceStore{}
+	w = NewValidatingWriter(s, true)
+	if err := w.Write(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(ctx, &spb.WriteRequest{
+		Source: &spb.VName{},
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.entries) != 2 {
+		t.Errorf("Found %d stored entries; want 2: %v", len(s.entries), s.entries)
+	}
+	expected := map[ValidationRule]int64{
+		RuleFactName:    1,
+		RuleEdgeTarget:  1,
+		RuleEmptySource: 1,
+	}
+	if found := w.Violations(); !reflect.DeepEqual(found, expected) {
+		t.Errorf("Violations() = %v; want %v", found, expected)
+	}
+}
+
+// limitedWriter is a sliceStore that fails every Write after its first limit.
+type limitedWriter struct {
+	*sliceStore
+
+	mu            sync.Mutex
+	limit, writes int
+}
+
+func (s *limitedWriter) Write(ctx context.Context, req *spb.WriteRequest) error {
+	s.mu.Lock()
+	if s.writes >= s.limit {
+		s.mu.Unlock()
+		return errors.New("write limit reached")
+	}
+	s.writes++
+	s.mu.Unlock()
+	return s.sliceStore.Write(ctx, req)
+}
+
+func copySource() *sliceStore {
+	s := &sliceStore{}
+	for _, corpus := range []string{"a", "b", "c"} {
+		for i := 0; i < 20; i++ {
+			src := &spb.VName{Signature: fmt.Sprintf("sig%02d", i), Corpus: corpus}
+			s.entries = append(s.entries,
+				&spb.Entry{Source: src, FactName: "/kythe/node/kind", FactValue: []byte("record")},
+				&spb.Entry{Source: src, EdgeKind: "/kythe/edge/childof", Target: vname("parent"), FactName: "/"})
+		}
+	}
+	sort.Sort(byEntry(s.entries))
+	return s
+}
+
+type byEntry []*spb.Entry
+
+func (s byEntry) Len() int           { return len(s) }
+func (s byEntry) Less(i, j int) bool { return compare.Entries(s[i], s[j]) == compare.LT }
+func (s byEntry) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func TestCopy(t *testing.T) {
+	src := copySource()
+	sharded, err := NewFuncSharded(src, HashShardFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		src   Service
+		opts  *CopyOptions
+		count int
+	}{
+		{src, nil, 120},
+		{sharded, &CopyOptions{Workers: 4}, 120},
+		{src, &CopyOptions{Corpora: []string{"a", "c"}}, 80},
+		{sharded, &CopyOptions{Workers: 3, EdgeKinds: []string{""}}, 60},
+		{src, &CopyOptions{FactPrefix: "/kythe/node/", Corpora: []string{"b"}}, 20},
+	} {
+		dst := &sliceStore{}
+		var final *CopyProgress
+		opts := &CopyOptions{}
+		if test.opts != nil {
+			*opts = *test.opts
+		}
+		opts.Progress = func(p *CopyProgress) { final = p }
+		if err := Copy(ctx, dst, test.src, opts); err != nil {
+			t.Fatalf("Copy(%+v) error: %v", test.opts, err)
+		}
+		if len(dst.entries) != test.count {
+			t.Errorf("Copy(%+v) wrote %d entries; want %d", test.opts, len(dst.entries), test.count)
+		}
+		if final == nil {
+			t.Errorf("Copy(%+v) did not report progress", test.opts)
+		} else if final.Entries != int64(test.count) || final.Scanned < final.Entries {
+			t.Errorf("Copy(%+v) final progress: %+v", test.opts, final)
+		}
+	}
+}
+
+func TestCopyResume(t *testing.T) {
+	src := copySource()
+	sharded, err := NewFuncSharded(orderedStore{src}, CorpusShardFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only an ordered Scan can be resumed.
+	for _, test := range []struct {
+		src     Service
+		workers int
+	}{{src, 1}, {sharded, 3}} {
+		var progress *CopyProgress
+		dst := &limitedWriter{sliceStore: &sliceStore{}, limit: 5}
+		if err := Copy(ctx, dst, test.src, &CopyOptions{
+			Workers:  test.workers,
+			Progress: func(p *CopyProgress) { progress = p },
+		}); err == nil {
+			t.Fatalf("Copy with %d workers succeeded; expected write error", test.workers)
+		} else if progress.ResumeToken != "" {
+			t.Errorf("Copy of %T with %d workers reported resume token %q", test.src, test.workers, progress.ResumeToken)
+		}
+		if err := Copy(ctx, &sliceStore{}, test.src, &CopyOptions{
+			Workers:     test.workers,
+			ResumeToken: "1.",
+		}); err == nil {
+			t.Errorf("Copy of %T with %d workers accepted a resume token", test.src, test.workers)
+		}
+	}
+
+	for _, test := range []struct {
+		src     Service
+		workers int
+	}{{orderedStore{src}, 1}} {
+		dst := &limitedWriter{sliceStore: &sliceStore{}, limit: 5}
+		var (
+			progress *CopyProgress
+			written  int64
+		)
+		opts := &CopyOptions{
+			Workers: test.workers,
+			Batch:   &BatchOptions{MaxUpdates: 1},
+			Progress: func(p *CopyProgress) {
+				progress = p
+			},
+		}
+		if err := Copy(ctx, dst, test.src, opts); err == nil {
+			t.Fatalf("Copy with %d workers succeeded; expected write error", test.workers)
+		}
+		written += progress.Entries
+
+		if _, err := parseCopyToken(progress.ResumeToken, test.workers+1); err == nil {
+			t.Errorf("Resume token %q accepted for wrong number of workers", progress.ResumeToken)
+		}
+
+		dst.limit = 1000
+		opts.ResumeToken = progress.ResumeToken
+		if err := Copy(ctx, dst, test.src, opts); err != nil {
+			t.Fatalf("Resumed Copy with %d workers error: %v", test.workers, err)
+		}
+		written += progress.Entries
+
+		if written != int64(len(src.entries)) {
+			t.Errorf("Copy with %d workers wrote %d entries in total; want %d", test.workers, written, len(src.entries))
+		}
+		if !reflect.DeepEqual(dst.entries, src.entries) {
+			t.Errorf("Copy with %d workers produced %d entries; want %d", test.workers, len(dst.entries), len(src.entries))
+		}
+	}
+}
+
+// orderedStore is a sliceStore whose Scans are claimed to be ordered.
+type orderedStore struct{ *sliceStore }
+
+func (orderedStore) ScansOrdered() bool { return true }
+
+func TestDiff(t *testing.T) {
+	a := &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		edge("a", "/kythe/edge/childof", "p"),
+		fact("b", "/kythe/node/kind", "function"),
+		fact("c", "/kythe/node/kind", "variable"),
+		fact("d", "/kythe/node/kind", "file"),
+	}}
+	b := &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("b", "/kythe/node/kind", "record"),
+		fact("b", "/kythe/subkind", "class"),
+		fact("d", "/kythe/node/kind", "file"),
+		fact("e", "/kythe/node/kind", "anchor"),
+	}}
+	expected := []string{
+		"only in a: a /kythe/edge/childof/",
+		"value changed: b /kythe/node/kind",
+		"only in b: b /kythe/subkind",
+		"only in a: c /kythe/node/kind",
+		"only in b: e /kythe/node/kind",
+	}
+
+	// Scan b in reverse to exercise sorting an unordered Service.
+	reversed := &sliceStore{}
+	for i := len(b.entries) - 1; i >= 0; i-- {
+		reversed.entries = append(reversed.entries, b.entries[i])
+	}
+
+	for _, test := range []struct{ a, b Service }{
+		{orderedStore{a}, orderedStore{b}},
+		{a, reversed},
+		{orderedStore{a}, reversed},
+	} {
+		var found []string
+		if err := Diff(ctx, test.a, test.b, func(d DiffEntry) error {
+			e := d.A
+			if e == nil {
+				e = d.B
+			}
+			found = append(found, fmt.Sprintf("%s: %s %s%s", d.Kind, e.Source.Signature, e.EdgeKind, e.FactName))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(found, expected) {
+			t.Errorf("Diff(%T, %T):\n  found %q\n   want %q", test.a, test.b, found, expected)
+		}
+	}
+
+	var diffs int
+	if err := Diff(ctx, a, a, func(DiffEntry) error {
+		diffs++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if diffs != 0 {
+		t.Errorf("Found %d differences between identical stores", diffs)
+	}
+
+	if err := Diff(ctx, orderedStore{reversed}, a, func(DiffEntry) error { return nil }); err == nil {
+		t.Error("Diff of an out-of-order OrderedScanner succeeded; expected an error")
+	}
+}
+
+func TestScanStream(t *testing.T) {
+	a := &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("c", "/kythe/node/kind", "variable"),
+		fact("d", "/kythe/node/kind", "file"),
+	}}
+	b := &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("b", "/kythe/node/kind", "function"),
+		fact("d", "/kythe/node/kind", "anchor"),
+		fact("d", "/kythe/subkind", "class"),
+	}}
+	expected := []string{
+		"a /kythe/node/kind record",
+		"b /kythe/node/kind function",
+		"c /kythe/node/kind variable",
+		"d /kythe/node/kind anchor",
+		"d /kythe/node/kind file",
+	}
+
+	var streams []compare.EntryStream
+	for _, s := range []Service{orderedStore{a}, orderedStore{b}} {
+		stream, err := NewScanStream(ctx, s, &spb.ScanRequest{FactPrefix: "/kythe/node/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		streams = append(streams, stream)
+	}
+	var found []string
+	if err := compare.MergeEntries(streams, func(e *spb.Entry) error {
+		found = append(found, fmt.Sprintf("%s %s %s", e.Source.Signature, e.FactName, e.FactValue))
+		if e.Source.Signature == "d" && string(e.FactValue) == "file" {
+			return io.EOF // skip the remainder of the streams
+		}
+		return nil
+	}, compare.MergeOptions{DropDuplicates: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("MergeEntries:\n  found %q\n   want %q", found, expected)
+	}
+
+	if _, err := NewScanStream(ctx, a, &spb.ScanRequest{}); err == nil {
+		t.Error("NewScanStream of an unordered Service succeeded; expected an error")
+	}
+}
+
+// countingWriter is a sliceStore recording each Write.
+type countingWriter struct {
+	*sliceStore
+	writeErr error
+
+	mu   sync.Mutex
+	reqs []*spb.WriteRequest
+}
+
+func (s *countingWriter) Write(ctx context.Context, req *spb.WriteRequest) error {
+	s.mu.Lock()
+	s.reqs = append(s.reqs, req)
+	s.mu.Unlock()
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	return s.sliceStore.Write(ctx, req)
+}
+
+func TestBufferedWriter(t *testing.T) {
+	s := &countingWriter{sliceStore: &sliceStore{}}
+	w := NewBufferedWriter(s, 4, 0)
+	for _, e := range []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("a", "/kythe/subkind", "class"),
+		fact("b", "/kythe/node/kind", "function"),
+		fact("c", "/kythe/node/kind", "variable"),
+		fact("c", "/kythe/subkind", "local"),
+		fact("c", "/kythe/text", "x"),
+	} {
+		if err := w.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []int
+	for _, req := range s.reqs {
+		sizes = append(sizes, len(req.Update))
+	}
+	// The first 4 entries are written together; the remaining 2 on Flush.
+	if expected := []int{2, 1, 1, 2}; !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("WriteRequest sizes: %v; want %v", sizes, expected)
+	}
+	if len(s.entries) != 6 {
+		t.Errorf("Found %d written entries; want 6", len(s.entries))
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteEntry(fact("d", "/kythe/node/kind", "file")); err == nil {
+		t.Error("WriteEntry after Close succeeded; expected an error")
+	}
+}
+
+func TestBufferedWriterError(t *testing.T) {
+	writeErr := errors.New("write failed")
+	s := &countingWriter{sliceStore: &sliceStore{}, writeErr: writeErr}
+	w := NewBufferedWriter(s, 1, 0)
+
+	if err := w.WriteEntry(fact("a", "/kythe/node/kind", "record")); err != nil {
+		t.Fatalf("First WriteEntry error: %v", err)
+	}
+	// The background write fails; its error must surface on a later call.
+	if err := w.Flush(); err != writeErr {
+		t.Errorf("Flush error: %v; want %v", err, writeErr)
+	}
+	if err := w.WriteEntry(fact("b", "/kythe/node/kind", "record")); err != writeErr {
+		t.Errorf("WriteEntry error after failed write: %v; want %v", err, writeErr)
+	}
+	if err := w.Close(); err != writeErr {
+		t.Errorf("Close error: %v; want %v", err, writeErr)
+	}
+}
+
+type readCounter struct {
+	*sliceStore
+	reads int
+}
+
+func (s *readCounter) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	s.reads++
+	return s.sliceStore.Read(ctx, req, f)
+}
+
+func TestCachingService(t *testing.T) {
+	s := &readCounter{sliceStore: &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		edge("a", "/kythe/edge/childof", "b"),
+		fact("b", "/kythe/node/kind", "package"),
+	}}}
+	c := NewCachingService(s, 1<<20)
+
+	read := func(src, kind string) []*spb.Entry {
+		var entries []*spb.Entry
+		if err := c.Read(ctx, &spb.ReadRequest{Source: vname(src), EdgeKind: kind}, func(e *spb.Entry) error {
+			entries = append(entries, e)
+			return nil
+		}); err != nil {
+			t.Fatalf("Read error: %v", err)
+		}
+		return entries
+	}
+
+	for i := 0; i < 3; i++ {
+		if entries := read("a", "*"); len(entries) != 2 {
+			t.Errorf("Read(a, *) returned %d entries; want 2", len(entries))
+		}
+	}
+	if entries := read("a", ""); len(entries) != 1 {
+		t.Errorf("Read(a) returned %d entries; want 1", len(entries))
+	}
+	if s.reads != 2 {
+		t.Errorf("Underlying Reads: %d; want 2", s.reads)
+	}
+	if stats := c.Stats(); stats.Hits != 2 || stats.Misses != 2 || stats.Reads != 2 {
+		t.Errorf("Stats: %+v; want 2 hits, 2 misses, and 2 cached reads", stats)
+	}
+
+	// Writes through the cache invalidate every Read of their source.
+	if err := c.Write(ctx, &spb.WriteRequest{
+		Source: vname("a"),
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/subkind", FactValue: []byte("class")}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); stats.Reads != 0 || stats.Bytes != 0 {
+		t.Errorf("Stats after Write: %+v; want an empty cache", stats)
+	}
+	if entries := read("a", ""); len(entries) != 2 {
+		t.Errorf("Read(a) after Write returned %d entries; want 2", len(entries))
+	}
+
+	// Reads stopped early are not cached.
+	if err := c.Read(ctx, &spb.ReadRequest{Source: vname("b")}, func(*spb.Entry) error { return io.EOF }); err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); stats.Reads != 1 {
+		t.Errorf("Cached reads: %d; want 1", stats.Reads)
+	}
+}
+
+func TestCachingServiceEviction(t *testing.T) {
+	s := &readCounter{sliceStore: &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("b", "/kythe/node/kind", "record"),
+	}}}
+	size := proto.Size(fact("a", "/kythe/node/kind", "record"))
+	c := NewCachingService(s, size)
+
+	for _, src := range []string{"a", "b", "a"} {
+		if err := c.Read(ctx, &spb.ReadRequest{Source: vname(src)}, func(*spb.Entry) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Each read evicted the one before it.
+	if s.reads != 3 {
+		t.Errorf("Underlying Reads: %d; want 3", s.reads)
+	}
+	if stats := c.Stats(); stats.Reads != 1 || stats.Bytes != size {
+		t.Errorf("Stats: %+v; want 1 cached read of %d bytes", stats, size)
+	}
+}
+
+func TestMeteredService(t *testing.T) {
+	s := &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		edge("a", "/kythe/edge/childof", "b"),
+		fact("b", "/kythe/node/kind", "package"),
+	}}
+	if NewMeteredService(s, nil) != Service(s) {
+		t.Error("NewMeteredService with a nil sink did not return the Service unchanged")
+	}
+
+	m := NewMetrics()
+	gs := NewMeteredService(s, m)
+	if _, ok := gs.(Sharded); ok {
+		t.Errorf("Metered %T is unexpectedly Sharded", s)
+	}
+	if err := gs.Read(ctx, &spb.ReadRequest{Source: vname("a"), EdgeKind: "*"}, func(*spb.Entry) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	readErr := errors.New("read failed")
+	gs.Read(ctx, &spb.ReadRequest{Source: vname("b")}, func(*spb.Entry) error { return readErr })
+
+	snap := m.Snapshot()
+	if read := snap["Read"]; read.Calls != 2 || read.Errors != 1 || read.Entries != 3 {
+		t.Errorf("Read metrics: %+v; want 2 calls, 1 error, and 3 entries", read)
+	}
+	if scan := snap["Scan"]; scan.Calls != 1 || scan.Errors != 0 || scan.Entries != 3 {
+		t.Errorf("Scan metrics: %+v; want 1 call and 3 entries", scan)
+	}
+	var latencies int64
+	for _, n := range snap["Read"].Latency {
+		latencies += n
+	}
+	if latencies != 2 {
+		t.Errorf("Read latency histogram has %d calls; want 2", latencies)
+	}
+
+	sharded, ok := NewMeteredService(shardedSliceStore(t, 10), m).(Sharded)
+	if !ok {
+		t.Fatal("Metered Sharded store is not Sharded")
+	}
+	if err := ParallelShards(ctx, sharded, 2, func(*spb.Entry) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if shard := m.Snapshot()["Shard"]; shard.Entries != 10 {
+		t.Errorf("Shard metrics: %+v; want 10 entries", shard)
+	}
+}
+
+// writeMetrics is a WriteMetricsSink recording the sizes of Writes.
+type writeMetrics struct {
+	*Metrics
+	bytes int64
+}
+
+func (m *writeMetrics) ObserveWrite(bytes int64) { m.bytes += bytes }
+
+func TestMeteredServiceWrites(t *testing.T) {
+	m := &writeMetrics{Metrics: NewMetrics()}
+	gs := NewMeteredService(new(sliceStore), m)
+	req := &spb.WriteRequest{
+		Source: vname("a"),
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("record")}},
+	}
+	if err := gs.Write(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(proto.Size(req)); m.bytes != want {
+		t.Errorf("Observed %d bytes written; want %d", m.bytes, want)
+	}
+	if write := m.Snapshot()["Write"]; write.Calls != 1 || write.Errors != 0 {
+		t.Errorf("Write metrics: %+v; want 1 call", write)
+	}
+}
+
+type unhealthyStore struct {
+	sliceStore
+	err error
+}
+
+func (s *unhealthyStore) CheckHealth(ctx context.Context) error { return s.err }
+
+func TestMeteredServiceHealth(t *testing.T) {
+	m := NewMetrics()
+	errDown := errors.New("down")
+	gs := NewMeteredService(&unhealthyStore{err: errDown}, m)
+	if err := CheckHealth(ctx, gs); err != errDown {
+		t.Errorf("CheckHealth: got %v; want %v", err, errDown)
+	}
+	if calls := m.Snapshot(); len(calls) != 0 {
+		t.Errorf("CheckHealth was metered: %+v", calls)
+	}
+	if !ScansOrdered(NewMeteredService(orderedStore{new(sliceStore)}, m)) {
+		t.Error("Metered ordered store does not report ordered scans")
+	}
+}
+
+func BenchmarkReadUnmetered(b *testing.B) { benchmarkMeteredRead(b, nil) }
+func BenchmarkReadNilSink(b *testing.B) {
+	benchmarkMeteredRead(b, func(s Service) Service { return NewMeteredService(s, nil) })
+}
+func BenchmarkReadMetered(b *testing.B) {
+	benchmarkMeteredRead(b, func(s Service) Service { return NewMeteredService(s, NewMetrics()) })
+}
+
+func benchmarkMeteredRead(b *testing.B, wrap func(Service) Service) {
+	var s Service = &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("a", "/kythe/subkind", "class"),
+	}}
+	if wrap != nil {
+		s = wrap(s)
+	}
+	req := &spb.ReadRequest{Source: vname("a")}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.Read(ctx, req, func(*spb.Entry) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var errTransient = errors.New("connection reset")
+
+// flakyStore fails its first failures calls of each kind; streaming calls fail
+// after delivering failAfter entries.
+type flakyStore struct {
+	*sliceStore
+	failures, failAfter int
+
+	calls map[string]int
+}
+
+func (s *flakyStore) fail(method string) bool {
+	if s.calls == nil {
+		s.calls = make(map[string]int)
+	}
+	s.calls[method]++
+	return s.calls[method] <= s.failures
+}
+
+func (s *flakyStore) stream(method string, f EntryFunc, call func(EntryFunc) error) error {
+	if !s.fail(method) {
+		return call(f)
+	}
+	var n int
+	if err := call(func(e *spb.Entry) error {
+		if n == s.failAfter {
+			return errTransient
+		}
+		n++
+		return f(e)
+	}); err != nil {
+		return err
+	}
+	return errTransient
+}
+
+func (s *flakyStore) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	return s.stream("Read", f, func(g EntryFunc) error { return s.sliceStore.Read(ctx, req, g) })
+}
+
+func (s *flakyStore) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	return s.stream("Scan", f, func(g EntryFunc) error { return s.sliceStore.Scan(ctx, req, g) })
+}
+
+func (s *flakyStore) Write(ctx context.Context, req *spb.WriteRequest) error {
+	if s.fail("Write") {
+		return errTransient
+	}
+	return s.sliceStore.Write(ctx, req)
+}
+
+// pagedFlakyStore is a PagedScanner whose pages of at most 2 entries are read
+// in the order of its slice, which need not be sorted, and whose second page
+// fails to be read.
+type pagedFlakyStore struct{ *flakyStore }
+
+func (s pagedFlakyStore) ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	if s.calls == nil {
+		s.calls = make(map[string]int)
+	}
+	if s.calls["ScanPage"]++; s.calls["ScanPage"] == 2 {
+		return nil, "", errTransient
+	}
+	var i int
+	if token != "" {
+		var err error
+		if i, err = strconv.Atoi(token); err != nil {
+			return nil, "", err
+		}
+	}
+	var page []*spb.Entry
+	for ; i < len(s.entries) && len(page) < 2; i++ {
+		if EntryMatchesScan(req, s.entries[i]) {
+			page = append(page, s.entries[i])
+		}
+	}
+	if i == len(s.entries) {
+		return page, "", nil
+	}
+	return page, strconv.Itoa(i), nil
+}
+
+var testRetryPolicy = RetryPolicy{InitialBackoff: time.Microsecond, Jitter: 0.5}
+
+func TestRetryingServiceWrite(t *testing.T) {
+	s := &flakyStore{sliceStore: &sliceStore{}, failures: 2}
+	r := NewRetryingService(s, testRetryPolicy)
+	if err := r.Write(ctx, &spb.WriteRequest{
+		Source: vname("a"),
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("record")}},
+	}); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if s.calls["Write"] != 3 || len(s.entries) != 1 {
+		t.Errorf("Made %d Writes of %d entries; want 3 Writes of 1 entry", s.calls["Write"], len(s.entries))
+	}
+
+	// Exhaust the attempts.
+	s.failures, s.calls = 10, nil
+	policy := testRetryPolicy
+	policy.MaxAttempts = 3
+	if err := NewRetryingService(s, policy).Write(ctx, &spb.WriteRequest{Source: vname("b")}); err != errTransient {
+		t.Errorf("Write error: %v; want %v", err, errTransient)
+	} else if s.calls["Write"] != 3 {
+		t.Errorf("Made %d Writes; want 3", s.calls["Write"])
+	}
+
+	// Errors not classified as retryable are returned immediately.
+	s.calls = nil
+	policy.Retryable = func(err error) bool { return err != errTransient }
+	if err := NewRetryingService(s, policy).Write(ctx, &spb.WriteRequest{Source: vname("b")}); err != errTransient {
+		t.Errorf("Write error: %v; want %v", err, errTransient)
+	} else if s.calls["Write"] != 1 {
+		t.Errorf("Made %d Writes; want 1", s.calls["Write"])
+	}
+}
+
+func TestRetryingServiceStreams(t *testing.T) {
+	entries := []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("a", "/kythe/subkind", "class"),
+		fact("a", "/kythe/text", "x"),
+		fact("b", "/kythe/node/kind", "package"),
+		fact("c", "/kythe/node/kind", "file"),
+	}
+	tests := []struct {
+		name string
+		s    Service
+	}{
+		{"unordered", &flakyStore{sliceStore: &sliceStore{entries: entries}, failures: 2, failAfter: 1}},
+		{"ordered", orderedFlakyStore{&flakyStore{sliceStore: &sliceStore{entries: entries}, failures: 3, failAfter: 2}}},
+		{"paged", pagedFlakyStore{&flakyStore{sliceStore: &sliceStore{entries: entries}, failures: 1, failAfter: 2}}},
+	}
+	for _, test := range tests {
+		r := NewRetryingService(test.s, testRetryPolicy)
+
+		var scanned []*spb.Entry
+		if err := r.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+			scanned = append(scanned, e)
+			return nil
+		}); err != nil {
+			t.Errorf("%s: Scan error: %v", test.name, err)
+		} else if !reflect.DeepEqual(scanned, entries) {
+			t.Errorf("%s: Scanned %v; want %v", test.name, scanned, entries)
+		}
+
+		var read []*spb.Entry
+		if err := r.Read(ctx, &spb.ReadRequest{Source: vname("a")}, func(e *spb.Entry) error {
+			read = append(read, e)
+			return nil
+		}); err != nil {
+			t.Errorf("%s: Read error: %v", test.name, err)
+		} else if !reflect.DeepEqual(read, entries[:3]) {
+			t.Errorf("%s: Read %v; want %v", test.name, read, entries[:3])
+		}
+	}
+	if p := tests[2].s.(pagedFlakyStore); p.calls["Scan"] != 0 || p.calls["ScanPage"] != 4 {
+		t.Errorf("Paged store calls: %v; want 4 ScanPages", p.calls)
+	}
+
+	// A PagedScanner is resumed in its own order, even if it is not that of
+	// compare.Entries.
+	unsorted := []*spb.Entry{entries[4], entries[0], entries[3], entries[2], entries[1]}
+	var scanned []*spb.Entry
+	if err := NewRetryingService(pagedFlakyStore{&flakyStore{sliceStore: &sliceStore{entries: unsorted}}}, testRetryPolicy).Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		scanned = append(scanned, e)
+		return nil
+	}); err != nil {
+		t.Errorf("Unordered paged Scan error: %v", err)
+	} else if !reflect.DeepEqual(scanned, unsorted) {
+		t.Errorf("Unordered paged Scan: scanned %v; want %v", scanned, unsorted)
+	}
+
+	// Errors from the EntryFunc are not retried.
+	s := &flakyStore{sliceStore: &sliceStore{entries: entries}}
+	stop := errors.New("stop")
+	if err := NewRetryingService(s, testRetryPolicy).Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error { return stop }); err != stop {
+		t.Errorf("Scan error: %v; want %v", err, stop)
+	} else if s.calls["Scan"] != 1 {
+		t.Errorf("Made %d Scans; want 1", s.calls["Scan"])
+	}
+}
+
+type orderedFlakyStore struct{ *flakyStore }
+
+func (orderedFlakyStore) ScansOrdered() bool { return true }
+
+func TestThrottledServiceWrites(t *testing.T) {
+	s := &sliceStore{}
+	th := NewThrottledService(s, Throttle{UpdatesPerSec: 100})
+	req := &spb.WriteRequest{
+		Source: vname("a"),
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+			{FactName: "/kythe/subkind", FactValue: []byte("class")},
+		},
+	}
+
+	// The first 50 writes use the initial burst; the next 10 must wait for
+	// 20 updates' worth of budget.
+	start := time.Now()
+	for i := 0; i < 60; i++ {
+		if err := th.Write(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("60 throttled writes took %v; expected at least 200ms", elapsed)
+	}
+	if len(s.entries) != 2 {
+		t.Errorf("Found %d written entries; want 2", len(s.entries))
+	}
+}
+
+func TestThrottledServiceCancel(t *testing.T) {
+	th := NewThrottledService(&sliceStore{}, Throttle{WritesPerSec: 1})
+	req := &spb.WriteRequest{Source: vname("a")}
+	if err := th.Write(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := th.Write(ctx, req); err != context.DeadlineExceeded {
+		t.Errorf("Write error: %v; want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Cancelled Write blocked for %v", elapsed)
+	}
+}
+
+func TestThrottledServiceRefund(t *testing.T) {
+	// Each failed write returns its budget, so failures never wait.
+	th := NewThrottledService(ReadOnly(&sliceStore{}), Throttle{WritesPerSec: 1, UpdatesPerSec: 1})
+	req := &spb.WriteRequest{
+		Source: vname("a"),
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("record")}},
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := th.Write(ctx, req); err != ErrReadOnly {
+			t.Fatalf("Write error: %v; want %v", err, ErrReadOnly)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("5 failed writes took %v; expected no wait", elapsed)
+	}
+
+	// A write abandoned while waiting for its updates returns the write it took.
+	th = NewThrottledService(&sliceStore{}, Throttle{WritesPerSec: 1, UpdatesPerSec: 1})
+	big := &spb.WriteRequest{Source: vname("a"), Update: make([]*spb.WriteRequest_Update, 100)}
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := th.WaitWrite(cctx, big); err != context.DeadlineExceeded {
+		t.Errorf("WaitWrite error: %v; want %v", err, context.DeadlineExceeded)
+	}
+	start = time.Now()
+	if err := th.Write(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Write after an abandoned write took %v; expected no wait", elapsed)
+	}
+}
+
+func TestThrottledServiceScan(t *testing.T) {
+	s := &sliceStore{}
+	for i := 0; i < 30; i++ {
+		s.entries = append(s.entries, fact(fmt.Sprintf("sig%02d", i), "/kythe/node/kind", "record"))
+	}
+	th := NewThrottledService(s, Throttle{EntriesPerSec: 200})
+
+	start := time.Now()
+	var n int
+	for i := 0; i < 8; i++ {
+		if err := th.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != 240 {
+		t.Errorf("Scanned %d entries; want 240", n)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Scanning 240 entries took %v; expected at least 200ms", elapsed)
+	}
+}
+
+type span struct {
+	method, parent string
+	err            error
+	entries        int
+}
+
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []span
+}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, method string, req proto.Message) (context.Context, func(error, int)) {
+	parent := TraceParent(ctx)
+	return WithTraceParent(ctx, method), func(err error, entries int) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.spans = append(t.spans, span{method, parent, err, entries})
+	}
+}
+
+// parentRecorder records the TraceParent of each Read made to it.
+type parentRecorder struct {
+	*sliceStore
+	parents []string
+}
+
+func (s *parentRecorder) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	s.parents = append(s.parents, TraceParent(ctx))
+	return s.sliceStore.Read(ctx, req, f)
+}
+
+func TestTracedService(t *testing.T) {
+	s := &parentRecorder{sliceStore: &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("a", "/kythe/subkind", "class"),
+	}}}
+	if NewTracedService(s, nil) != Service(s) {
+		t.Error("NewTracedService with a nil Tracer did not return the Service unchanged")
+	}
+
+	tracer := &recordingTracer{}
+	gs := NewTracedService(s, tracer)
+	if err := gs.Read(WithTraceParent(ctx, "root"), &spb.ReadRequest{Source: vname("a")}, func(*spb.Entry) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	writeErr := errors.New("write failed")
+	err := NewTracedService(&countingWriter{sliceStore: s.sliceStore, writeErr: writeErr}, tracer).Write(ctx, &spb.WriteRequest{Source: vname("b")})
+	if err != writeErr {
+		t.Errorf("Write error: %v; want %v", err, writeErr)
+	}
+
+	expected := []span{
+		{method: "Read", parent: "root", entries: 2},
+		{method: "Write", err: writeErr},
+	}
+	if !reflect.DeepEqual(tracer.spans, expected) {
+		t.Errorf("Spans: %+v; want %+v", tracer.spans, expected)
+	}
+	if expected := []string{"Read"}; !reflect.DeepEqual(s.parents, expected) {
+		t.Errorf("Underlying Read trace parents: %q; want %q", s.parents, expected)
+	}
+}
+
+func TestDedupOrdered(t *testing.T) {
+	in := []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("a", "/kythe/node/kind", "record"),
+		fact("a", "/kythe/node/kind", "other"), // differs in value
+		fact("a", "/kythe/subkind", "class"),
+		fact("a", "/kythe/subkind", "class"),
+		fact("a", "/kythe/subkind", "class"),
+		fact("b", "/kythe/node/kind", "record"),
+	}
+	var out []*spb.Entry
+	d := DedupOrdered(func(e *spb.Entry) error {
+		out = append(out, e)
+		return nil
+	})
+	for _, e := range in {
+		if err := d.Entry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := []*spb.Entry{in[0], in[2], in[3], in[6]}; !reflect.DeepEqual(out, expected) {
+		t.Errorf("DedupOrdered delivered %v; want %v", out, expected)
+	}
+	if d.Dropped() != 3 {
+		t.Errorf("Dropped %d entries; want 3", d.Dropped())
+	}
+}
+
+type closeFailer struct {
+	*sliceStore
+	closeErr error
+	closed   bool
+}
+
+func (s *closeFailer) Close(ctx context.Context) error {
+	s.closed = true
+	return s.closeErr
+}
+
+func TestMirroredService(t *testing.T) {
+	primary, mirror := &sliceStore{}, &sliceStore{}
+	writeErr := errors.New("write failed")
+	failing := &countingWriter{sliceStore: &sliceStore{}, writeErr: writeErr}
+	m := NewMirroredService(primary, mirror, failing)
+	m.Workers = 1
+
+	req := &spb.WriteRequest{
+		Source: vname("a"),
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("record")}},
+	}
+	if err := m.Write(ctx, req); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if len(primary.entries) != 1 || len(mirror.entries) != 1 {
+		t.Errorf("Wrote %d entries to the primary and %d to the mirror; want 1 each", len(primary.entries), len(mirror.entries))
+	}
+	if failures := m.MirrorFailures(); !reflect.DeepEqual(failures, []int64{0, 1}) {
+		t.Errorf("MirrorFailures: %v; want [0 1]", failures)
+	}
+
+	m.FailOnMirrorError = true
+	if err := m.Write(ctx, req); err == nil {
+		t.Error("Write succeeded despite a failing mirror")
+	}
+
+	// Reads are served by the primary alone.
+	mirror.entries = nil
+	var n int
+	if err := m.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Scanned %d entries; want 1", n)
+	}
+}
+
+func TestMirroredServiceClose(t *testing.T) {
+	closeErr := errors.New("close failed")
+	stores := []*closeFailer{
+		{sliceStore: &sliceStore{}},
+		{sliceStore: &sliceStore{}, closeErr: closeErr},
+		{sliceStore: &sliceStore{}, closeErr: closeErr},
+	}
+	err := NewMirroredService(stores[0], stores[1], stores[2]).Close(ctx)
+	if errs, ok := err.(MultiError); !ok || len(errs) != 2 {
+		t.Errorf("Close error: %v; want a MultiError of 2 errors", err)
+	}
+	for i, s := range stores {
+		if !s.closed {
+			t.Errorf("Store %d was not closed", i)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s := &sliceStore{entries: []*spb.Entry{fact("a", "/kythe/node/kind", "record")}}
+	ro := ReadOnly(s)
+	if _, ok := ro.(Sharded); ok {
+		t.Errorf("ReadOnly(%T) is unexpectedly Sharded", s)
+	}
+	if err := ro.Write(ctx, &spb.WriteRequest{Source: vname("b")}); err != ErrReadOnly {
+		t.Errorf("Write error: %v; want %v", err, ErrReadOnly)
+	}
+	if d, ok := ro.(Deleter); !ok {
+		t.Error("ReadOnly Service is not a Deleter")
+	} else if err := d.Delete(ctx, &DeleteRequest{Source: vname("a")}); err != ErrReadOnly {
+		t.Errorf("Delete error: %v; want %v", err, ErrReadOnly)
+	}
+	if len(s.entries) != 1 {
+		t.Errorf("Found %d entries after writes; want 1", len(s.entries))
+	}
+	var n int
+	if err := ro.Read(ctx, &spb.ReadRequest{Source: vname("a")}, func(*spb.Entry) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Read %d entries; want 1", n)
+	}
+
+	const shards = 40
+	sh, ok := ReadOnly(shardedSliceStore(t, shards)).(Sharded)
+	if !ok {
+		t.Fatal("ReadOnly of a Sharded Service is not Sharded")
+	}
+	n = 0
+	if err := ParallelShards(ctx, sh, 4, func(*spb.Entry) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if n != shards {
+		t.Errorf("Read %d entries from shards; want %d", n, shards)
+	}
+	if err := sh.Write(ctx, &spb.WriteRequest{Source: vname("b")}); err != ErrReadOnly {
+		t.Errorf("Sharded Write error: %v; want %v", err, ErrReadOnly)
+	}
+}
+
+func TestScanNodesOfKind(t *testing.T) {
+	s := &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("a", "/kythe/subkind", "class"),
+		fact("b", "/kythe/node/kind", "function"),
+		fact("c", "/kythe/node/kind", "record"),
+		fact("c", "/kythe/subkind", "struct"),
+		fact("c", "/kythe/text", "c"),
+		edge("c", "/kythe/edge/childof", "a"),
+		fact("d", "/kythe/node/kind", "record"),
+		fact("d", "/kythe/node/kinds", "record"), // not a node kind fact
+	}}
+	scan := func(opts *NodeKindOptions) []string {
+		var found []string
+		if err := ScanNodesOfKind(ctx, s, "record", opts, func(e *spb.Entry) error {
+			found = append(found, e.Source.Signature+" "+e.FactName)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+
+	tests := []struct {
+		opts  *NodeKindOptions
+		found []string
+	}{
+		{nil, []string{"a /kythe/node/kind", "c /kythe/node/kind", "d /kythe/node/kind"}},
+		{&NodeKindOptions{Subkind: "struct"}, []string{"c /kythe/node/kind"}},
+		{&NodeKindOptions{Subkind: "class", AllFacts: true, BatchSize: 1}, []string{"a /kythe/node/kind", "a /kythe/subkind"}},
+		{&NodeKindOptions{AllFacts: true, BatchSize: 2}, []string{
+			"a /kythe/node/kind", "a /kythe/subkind",
+			"c /kythe/node/kind", "c /kythe/subkind", "c /kythe/text",
+			"d /kythe/node/kind", "d /kythe/node/kinds",
+		}},
+	}
+	for _, test := range tests {
+		if found := scan(test.opts); !reflect.DeepEqual(found, test.found) {
+			t.Errorf("ScanNodesOfKind(%+v): found %q; want %q", test.opts, found, test.found)
+		}
+	}
+
+	var n int
+	if err := ScanNodesOfKind(ctx, s, "record", &NodeKindOptions{AllFacts: true, BatchSize: 2}, func(*spb.Entry) error {
+		n++
+		if n == 3 {
+			return io.EOF
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("ScanNodesOfKind stopped early: %v", err)
+	} else if n != 3 {
+		t.Errorf("Delivered %d entries after io.EOF; want 3", n)
+	}
+}
+
+func TestNormalized(t *testing.T) {
+	s := new(sliceStore)
+	ns := Normalized(s, compare.NormalizeOptions{FoldCase: true})
+	if _, ok := ns.(Sharded); ok {
+		t.Errorf("Normalized(%T) is unexpectedly Sharded", s)
+	}
+
+	winFile := &spb.VName{Corpus: "kythe", Path: `Src\Foo.cs`}
+	file := &spb.VName{Corpus: "kythe", Path: "src/foo.cs"}
+	if err := ns.Write(ctx, &spb.WriteRequest{
+		Source: winFile,
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("file")},
+			{EdgeKind: "/kythe/edge/childof", Target: &spb.VName{Corpus: "kythe", Path: `./Src\`}, FactName: "/"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if winFile.Path != `Src\Foo.cs` {
+		t.Errorf("Write modified its request: %v", winFile)
+	}
+
+	want := []*spb.Entry{
+		{Source: file, FactName: "/kythe/node/kind", FactValue: []byte("file")},
+		{Source: file, EdgeKind: "/kythe/edge/childof", Target: &spb.VName{Corpus: "kythe", Path: "src"}, FactName: "/"},
+	}
+	if !reflect.DeepEqual(s.entries, want) {
+		t.Errorf("Stored entries: %v; want %v", s.entries, want)
+	}
+
+	for _, src := range []*spb.VName{winFile, file, {Corpus: "kythe", Path: "SRC/foo.cs"}} {
+		var got []*spb.Entry
+		if err := ns.Read(ctx, &spb.ReadRequest{Source: src, EdgeKind: "*"}, func(e *spb.Entry) error {
+			got = append(got, e)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("Read(%v): %v; want %v", src, got, want)
+		}
+	}
+
+	var n int
+	if err := ns.Scan(ctx, &spb.ScanRequest{Target: &spb.VName{Corpus: "kythe", Path: `Src\`}}, func(*spb.Entry) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Scanned %d entries by target; want 1", n)
+	}
+
+	if _, ok := Normalized(shardedSliceStore(t, 4), compare.NormalizeOptions{}).(Sharded); !ok {
+		t.Error("Normalized of a Sharded Service is not Sharded")
+	}
+}
+
+// deletingStore is a sliceStore recording the requests of its Deletes.
+type deletingStore struct {
+	*sliceStore
+	deleted []*DeleteRequest
+}
+
+func (s *deletingStore) Delete(ctx context.Context, req *DeleteRequest) error {
+	s.deleted = append(s.deleted, req)
+	return nil
+}
+
+func TestNormalizedOptional(t *testing.T) {
+	file := &spb.VName{Corpus: "kythe", Path: "src/foo.cs"}
+	dir := &spb.VName{Corpus: "kythe", Path: "src"}
+	s := &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "file"),
+		{Source: file, EdgeKind: "/kythe/edge/childof", Target: dir, FactName: "/"},
+	}}
+	opts := compare.NormalizeOptions{FoldCase: true}
+	winDir := &spb.VName{Corpus: "kythe", Path: `Src\`}
+
+	ns := Normalized(orderedStore{s}, opts)
+	if !ScansOrdered(ns) {
+		t.Error("Normalized of an ordered Service does not ScansOrdered")
+	}
+	page, next, err := ns.(PagedScanner).ScanPage(ctx, &spb.ScanRequest{Target: winDir}, 10, "")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(page) != 1 || next != "" {
+		t.Errorf("ScanPage by target: %v, %q; want 1 entry and no next page", page, next)
+	}
+	var n int
+	if err := ns.(ResumableScanner).ScanFrom(ctx, &spb.ScanRequest{Target: winDir}, nil, func(*spb.Entry) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("ScanFrom by target found %d entries; want 1", n)
+	}
+	if err := ns.(HealthChecker).CheckHealth(ctx); err != nil {
+		t.Errorf("CheckHealth: %v", err)
+	}
+	if err := ns.(Deleter).Delete(ctx, &DeleteRequest{Source: file}); err != ErrUnsupported {
+		t.Errorf("Delete from a store without deletion: got error %v; want %v", err, ErrUnsupported)
+	}
+
+	ds := &deletingStore{sliceStore: s}
+	if err := Normalized(ds, opts).(Deleter).Delete(ctx, &DeleteRequest{
+		Source: &spb.VName{Corpus: "kythe", Path: `Src\Foo.cs`},
+		Target: winDir,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []*DeleteRequest{{Source: file, Target: dir}}
+	if !reflect.DeepEqual(ds.deleted, want) {
+		t.Errorf("Deleted %v; want %v", ds.deleted, want)
+	}
+}
+
+func TestNormalizationCollisions(t *testing.T) {
+	file := func(path string) *spb.VName { return &spb.VName{Corpus: "kythe", Path: path} }
+	var entries []*spb.Entry
+	for _, path := range []string{"src/foo.cs", `Src\Foo.cs`, "src/bar.cs", `src\bar.cs`, "src/./bar.cs", "src/baz.cs"} {
+		entries = append(entries,
+			&spb.Entry{Source: file(path), FactName: "/kythe/node/kind", FactValue: []byte("file")},
+			&spb.Entry{Source: file(path), FactName: "/kythe/text", FactValue: []byte(path)})
+	}
+	compare.SortEntries(entries)
+	s := &sliceStore{entries: entries}
+
+	tests := []struct {
+		opts   compare.NormalizeOptions
+		report NormalizationReport
+		groups map[string]int
+	}{
+		{compare.NormalizeOptions{}, NormalizationReport{Sources: 6, Changed: 3, Colliding: 3, Groups: 1}, map[string]int{"src/bar.cs": 3}},
+		{compare.NormalizeOptions{FoldCase: true}, NormalizationReport{Sources: 6, Changed: 3, Colliding: 5, Groups: 2}, map[string]int{"src/bar.cs": 3, "src/foo.cs": 2}},
+	}
+	for _, test := range tests {
+		groups := make(map[string]int)
+		report, err := NormalizationCollisions(ctx, s, test.opts, func(norm *spb.VName, srcs []*spb.VName) error {
+			groups[norm.Path] = len(srcs)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *report != test.report {
+			t.Errorf("NormalizationCollisions(%+v): %+v; want %+v", test.opts, *report, test.report)
+		}
+		if !reflect.DeepEqual(groups, test.groups) {
+			t.Errorf("NormalizationCollisions(%+v) groups: %v; want %v", test.opts, groups, test.groups)
+		}
+	}
+}
+
+func TestCheckOrdered(t *testing.T) {
+	entries := []*spb.Entry{
+		fact("a", "/kythe/node/kind", "file"),
+		fact("a", "/kythe/text", "x"),
+		fact("a", "/kythe/text", "x"),
+		fact("a", "/kythe/text", "y"),
+		edge("a", "/kythe/edge/ref", "b"),
+		fact("b", "/kythe/node/kind", "record"),
+	}
+	var n int
+	check := CheckOrdered(func(*spb.Entry) error {
+		n++
+		return nil
+	})
+	for _, e := range entries {
+		if err := check(e); err != nil {
+			t.Fatalf("Unexpected error for ordered entry %v: %v", e, err)
+		}
+	}
+	if n != len(entries) {
+		t.Errorf("Delivered %d entries; want %d", n, len(entries))
+	}
+
+	bad := fact("a", "/kythe/text", "z")
+	if err := check(bad); err == nil {
+		t.Errorf("Out-of-order entry %v was accepted", bad)
+	} else if oe, ok := err.(*OrderError); !ok {
+		t.Errorf("Error %v is a %T; want *OrderError", err, err)
+	} else if oe.Index != int64(len(entries)) || oe.Prev != entries[len(entries)-1] || oe.Next != bad {
+		t.Errorf("Unexpected OrderError: %+v", oe)
+	} else if msg := err.Error(); !strings.Contains(msg, "/kythe/text") || !strings.Contains(msg, "record") {
+		t.Errorf("OrderError message does not name both entries: %q", msg)
+	}
+	if n != len(entries) {
+		t.Errorf("Out-of-order entry was delivered")
+	}
+}
+
+func TestScanSource(t *testing.T) {
+	entries := []*spb.Entry{fact("a", "/kythe/node/kind", "file"), edge("a", "/kythe/edge/ref", "b")}
+	if ScanSource(&sliceStore{entries: entries}, new(spb.ScanRequest)).Ordered() {
+		t.Error("ScanSource of an unordered store is Ordered")
+	}
+	src := ScanSource(orderedStore{&sliceStore{entries: entries}}, &spb.ScanRequest{EdgeKind: "/kythe/edge/ref"})
+	if !src.Ordered() {
+		t.Error("ScanSource of an OrderedScanner is not Ordered")
+	}
+	var got []*spb.Entry
+	if err := src.Entries(ctx, func(e *spb.Entry) error {
+		got = append(got, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, entries[1:]) {
+		t.Errorf("Entries: %v; want %v", got, entries[1:])
+	}
+}
+
+func TestBatchWritesUnorderedEntrySet(t *testing.T) {
+	// The facts of 3 sources, each delivered twice, with interleaved sources.
+	var entries []*spb.Entry
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < 4; i++ {
+			for _, src := range []string{"a", "b", "c"} {
+				entries = append(entries, fact(src, fmt.Sprintf("/%d", i), "v"))
+			}
+		}
+	}
+	ch := make(chan *spb.Entry, len(entries))
+	for _, e := range entries {
+		ch <- e
+	}
+	close(ch)
+
+	set := compare.NewEntrySet(compare.EntrySetOptions{})
+	defer set.Finish()
+	reqs, errc := BatchWritesUnordered(ctx, ch, 10, 2, set)
+	var facts int
+	for req := range reqs {
+		facts += len(req.Update)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if facts != len(entries)/2 {
+		t.Errorf("Batched %d updates; want %d", facts, len(entries)/2)
+	}
+
+	// Failing to spill the set's fingerprints stops batching with an error.
+	const n = 5000
+	ch = make(chan *spb.Entry)
+	go func() {
+		defer close(ch)
+		for i := 0; i < n; i++ {
+			ch <- fact(fmt.Sprint(i), "/kythe/node/kind", "file")
+		}
+	}()
+	set = compare.NewEntrySet(compare.EntrySetOptions{MaxBytes: 1, WorkDir: "/nonexistent/dir"})
+	defer set.Finish()
+	reqs, errc = BatchWritesUnordered(ctx, ch, 10, 2, set)
+	facts = 0
+	for req := range reqs {
+		facts += len(req.Update)
+	}
+	if err := <-errc; err == nil {
+		t.Error("Batching succeeded despite a failing EntrySet")
+	}
+	if facts == 0 || facts >= n {
+		t.Errorf("Batched %d updates before failing; want between 0 and %d", facts, n)
+	}
+}
+
+func TestDedupExact(t *testing.T) {
+	var out []*spb.Entry
+	d := DedupExact(func(e *spb.Entry) error {
+		out = append(out, e)
+		return nil
+	}, compare.EntrySetOptions{MaxBytes: 1})
+	defer func() {
+		if err := d.Close(); err != nil {
+			t.Errorf("Close error: %v", err)
+		}
+	}()
+
+	// Even a tiny memory budget drops every duplicate.
+	const unique = 2000
+	for i := 0; i < 5*unique; i++ {
+		if err := d.Entry(fact(fmt.Sprintf("sig%d", i%unique), "/kythe/node/kind", "record")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(out) != unique {
+		t.Errorf("Delivered %d entries; want %d", len(out), unique)
+	}
+	if d.Dropped() != 4*unique {
+		t.Errorf("Dropped %d entries; want %d", d.Dropped(), 4*unique)
+	}
+}
+
+func testKeyset(primary uint32, ids ...uint32) Keyset {
+	ks := Keyset{Primary: primary, Keys: make(map[uint32][]byte)}
+	for _, id := range ids {
+		ks.Keys[id] = []byte(fmt.Sprintf("test key number %016d", id))
+	}
+	return ks
+}
+
+// readAll returns each entry of s, or the error of its Scan.
+func readAll(s Service) ([]*spb.Entry, error) {
+	var entries []*spb.Entry
+	err := s.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+func TestEncryptedService(t *testing.T) {
+	inner := &sliceStore{}
+	es, err := NewEncryptedService(inner, testKeyset(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := es.(Sharded); ok {
+		t.Errorf("Encrypted %T is unexpectedly Sharded", inner)
+	}
+	written := []*spb.Entry{
+		fact("a", "/kythe/node/kind", "file"),
+		fact("a", "/kythe/text", "secret source text"),
+		edge("a", "/kythe/edge/childof", "b"),
+		fact("b", "/kythe/text", "more secret text"),
+	}
+	for _, e := range written {
+		if err := es.Write(ctx, &spb.WriteRequest{
+			Source: e.Source,
+			Update: []*spb.WriteRequest_Update{{EdgeKind: e.EdgeKind, Target: e.Target, FactName: e.FactName, FactValue: e.FactValue}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, e := range inner.entries {
+		if strings.Contains(string(e.FactValue), "secret") {
+			t.Errorf("Stored entry has a plaintext fact value: %v", e)
+		} else if e.EdgeKind != "" && len(e.FactValue) != 0 {
+			t.Errorf("Stored edge has a non-empty value: %v", e)
+		}
+	}
+	got, err := readAll(es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(byEntry(written))
+	if !reflect.DeepEqual(got, written) {
+		t.Errorf("Scanned entries: got %v; want %v", got, written)
+	}
+	var text []string
+	if err := es.Read(ctx, &spb.ReadRequest{Source: vname("a")}, func(e *spb.Entry) error {
+		text = append(text, string(e.FactValue))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if got := strings.Join(text, ","); got != "file,secret source text" {
+		t.Errorf("Read fact values: got %q; want %q", got, "file,secret source text")
+	}
+
+	// A rewritten value gets a new nonce; an unchanged value is rewritten
+	// identically.
+	stored := func() []byte { return inner.entries[1].FactValue }
+	old := stored()
+	for _, test := range []struct {
+		value string
+		same  bool
+	}{{"secret source text", true}, {"new text", false}} {
+		if err := es.Write(ctx, &spb.WriteRequest{
+			Source: vname("a"),
+			Update: []*spb.WriteRequest_Update{{FactName: "/kythe/text", FactValue: []byte(test.value)}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if same := bytes.Equal(old[:headerSize], stored()[:headerSize]); same != test.same {
+			t.Errorf("Rewriting %q: reused header %v; want %v", test.value, same, test.same)
+		}
+	}
+
+	sharded, err := NewEncryptedService(shardedSliceStore(t, 10), testKeyset(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	} else if _, ok := sharded.(Sharded); !ok {
+		t.Error("Encrypted Sharded store is not Sharded")
+	}
+}
+
+func TestEncryptedServiceErrors(t *testing.T) {
+	for _, ks := range []Keyset{
+		{Primary: 1},
+		testKeyset(2, 1),
+		{Primary: 1, Keys: map[uint32][]byte{1: []byte("short")}},
+	} {
+		if _, err := NewEncryptedService(&sliceStore{}, ks); err == nil {
+			t.Errorf("NewEncryptedService with keyset %v succeeded; expected an error", ks)
+		}
+	}
+
+	inner := &sliceStore{}
+	es, err := NewEncryptedService(inner, testKeyset(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := es.Write(ctx, &spb.WriteRequest{
+		Source: vname("a"),
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("file")},
+			{FactName: "/kythe/text", FactValue: []byte("text")},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check := func(s Service, want error) {
+		_, err := readAll(s)
+		if de, ok := err.(*DecryptError); !ok || de.Err != want {
+			t.Errorf("Scan error: got %v; want a DecryptError of %v", err, want)
+		}
+	}
+
+	wrong := testKeyset(1, 1)
+	wrong.Keys[1] = []byte("some other key for decrypting...")
+	ws, err := NewEncryptedService(inner, wrong)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(ws, ErrWrongKey)
+	us, err := NewEncryptedService(inner, testKeyset(2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(us, ErrUnknownKey)
+
+	// A corrupted value, a value moved to another entry, and a plaintext value
+	// all fail authentication.
+	value := inner.entries[1].FactValue
+	corrupt := append([]byte(nil), value...)
+	corrupt[len(corrupt)-1] ^= 1
+	for _, v := range [][]byte{corrupt, inner.entries[0].FactValue, []byte("text")} {
+		inner.entries[1].FactValue = v
+		check(es, ErrCorruptValue)
+	}
+	inner.entries[1].FactValue = value
+	if _, err := readAll(es); err != nil {
+		t.Errorf("Scan error after restoring value: %v", err)
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	inner := orderedStore{&sliceStore{}}
+	old, err := NewEncryptedService(inner, testKeyset(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough values to need several batches.
+	const n = 2*reencryptBatchSize + 10
+	for i := 0; i < n; i++ {
+		if err := old.Write(ctx, &spb.WriteRequest{
+			Source: vname(fmt.Sprintf("sig%04d", i)),
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))},
+				{EdgeKind: "/kythe/edge/ref", Target: vname("target"), FactName: "/"},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := readAll(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := testKeyset(2, 1, 2)
+	if _, err := Reencrypt(ctx, &sliceStore{}, rotated); err == nil {
+		t.Error("Reencrypt of an unordered store succeeded; expected an error")
+	}
+	if num, err := Reencrypt(ctx, inner, rotated); err != nil {
+		t.Fatal(err)
+	} else if num != n {
+		t.Errorf("Reencrypt rewrote %d entries; want %d", num, n)
+	}
+	if num, err := Reencrypt(ctx, inner, rotated); err != nil {
+		t.Fatal(err)
+	} else if num != 0 {
+		t.Errorf("Second Reencrypt rewrote %d entries; want 0", num)
+	}
+
+	// The old key is no longer needed.
+	es, err := NewEncryptedService(inner, testKeyset(2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readAll(es)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("Reencrypted store has %d entries differing from the %d original entries", len(got), len(want))
+	}
+}
+
+func checkEntries(t *testing.T, tag string, got, want []*spb.Entry) {
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d entries %v; want %d entries %v", tag, len(got), got, len(want), want)
+		return
+	}
+	for i := range want {
+		if !proto.Equal(got[i], want[i]) {
+			t.Errorf("%s entry %d: got {%+v}; want {%+v}", tag, i, got[i], want[i])
+		}
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	base := orderedStore{&sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("a", "/kythe/text", "base"),
+		edge("a", "/kythe/edge/childof", "b"),
+		fact("b", "/kythe/node/kind", "file"),
+	}}}
+	overlay := &sliceStore{}
+	o := NewOverlay(base, overlay)
+	if _, ok := o.(Sharded); ok {
+		t.Errorf("NewOverlay(%T, %T) is unexpectedly Sharded", base, overlay)
+	}
+
+	for _, e := range []*spb.Entry{
+		fact("a", "/kythe/text", "overlay"),
+		fact("c", "/kythe/node/kind", "anchor"),
+	} {
+		if err := o.Write(ctx, &spb.WriteRequest{
+			Source: e.Source,
+			Update: []*spb.WriteRequest_Update{{FactName: e.FactName, FactValue: e.FactValue}},
+		}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if len(base.entries) != 4 {
+		t.Errorf("Found %d base entries after writes; want 4", len(base.entries))
+	}
+	entries, err := readAll(o)
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	checkEntries(t, "Scan", entries, []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("a", "/kythe/text", "overlay"),
+		edge("a", "/kythe/edge/childof", "b"),
+		fact("b", "/kythe/node/kind", "file"),
+		fact("c", "/kythe/node/kind", "anchor"),
+	})
+
+	var read []*spb.Entry
+	if err := o.Read(ctx, &spb.ReadRequest{Source: vname("a")}, func(e *spb.Entry) error {
+		read = append(read, e)
+		return nil
+	}); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	checkEntries(t, "Read", read, []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("a", "/kythe/text", "overlay"),
+	})
+
+	// Deletes mask the entries of both stores.
+	for _, req := range []*DeleteRequest{
+		{Source: vname("a"), FactName: "/kythe/node/kind"},
+		{Source: vname("c")},
+		{Source: vname("missing")},
+	} {
+		if err := o.Delete(ctx, req); err != nil {
+			t.Fatalf("Delete(%+v): %v", req, err)
+		}
+	}
+	if len(base.entries) != 4 {
+		t.Errorf("Found %d base entries after deletes; want 4", len(base.entries))
+	}
+	want := []*spb.Entry{
+		fact("a", "/kythe/text", "overlay"),
+		edge("a", "/kythe/edge/childof", "b"),
+		fact("b", "/kythe/node/kind", "file"),
+	}
+	if entries, err = readAll(o); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	checkEntries(t, "Scan after Delete", entries, want)
+
+	flat := &sliceStore{}
+	if err := o.Flatten(ctx, flat); err != nil {
+		t.Fatalf("Flatten: %v", err)
+	}
+	checkEntries(t, "Flatten", flat.entries, want)
+
+	// A deleted entry may be written again.
+	if err := o.Write(ctx, &spb.WriteRequest{
+		Source: vname("c"),
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("name")}},
+	}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if entries, err = readAll(o); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	checkEntries(t, "Scan after rewrite", entries, append(want, fact("c", "/kythe/node/kind", "name")))
+}
+
+func TestOverlaySharded(t *testing.T) {
+	const shards = 40
+	overlay, err := NewFuncSharded(&sliceStore{}, HashShardFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, ok := NewOverlay(shardedSliceStore(t, shards), overlay).(FuncSharded)
+	if !ok {
+		t.Fatal("Overlay of FuncSharded Services is not FuncSharded")
+	}
+	for _, e := range []*spb.Entry{
+		fact("sig005", "/kythe/node/kind", "replaced"),
+		fact("sig100", "/kythe/node/kind", "test"),
+	} {
+		if err := o.Write(ctx, &spb.WriteRequest{
+			Source: e.Source,
+			Update: []*spb.WriteRequest_Update{{FactName: e.FactName, FactValue: e.FactValue}},
+		}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := o.(Deleter).Delete(ctx, &DeleteRequest{Source: vname("sig007")}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	var (
+		mu      sync.Mutex
+		sharded []*spb.Entry
+	)
+	if err := ParallelShards(ctx, o, 4, func(e *spb.Entry) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sharded = append(sharded, e)
+		return nil
+	}); err != nil {
+		t.Fatalf("ParallelShards: %v", err)
+	}
+	compare.SortEntries(sharded)
+	entries, err := readAll(o)
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if len(entries) != shards {
+		t.Errorf("Scan found %d entries; want %d", len(entries), shards)
+	}
+	checkEntries(t, "Shards", sharded, entries)
+
+	var count int64
+	for i := int64(0); i < 4; i++ {
+		n, err := o.Count(ctx, &spb.CountRequest{Index: i, Shards: 4})
+		if err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+		count += n
+	}
+	if count != shards {
+		t.Errorf("Counted %d entries; want %d", count, shards)
+	}
+
+	corpus, err := NewFuncSharded(&sliceStore{}, CorpusShardFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := NewOverlay(shardedSliceStore(t, shards), corpus).(Sharded); ok {
+		t.Error("Overlay of Services with different ShardFuncs is unexpectedly Sharded")
+	}
+}
+
+func readSourceEntries(t testing.TB, s Service, src, kind string) []*spb.Entry {
+	var entries []*spb.Entry
+	if err := s.Read(ctx, &spb.ReadRequest{Source: vname(src), EdgeKind: kind}, func(e *spb.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		t.Fatalf("Read(%q, %q): %v", src, kind, err)
+	}
+	return entries
+}
+
+func checkTierStats(t *testing.T, tag string, ts *TieredService, want TierStats) {
+	if got := ts.Stats(); got != want {
+		t.Errorf("%s: got stats %+v; want %+v", tag, got, want)
+	}
+}
+
+func TestTieredService(t *testing.T) {
+	cold := &readCounter{sliceStore: &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		edge("a", "/kythe/edge/childof", "b"),
+		fact("b", "/kythe/node/kind", "package"),
+	}}}
+	hot := &sliceStore{}
+	ts := NewTiered(hot, cold, TierWriteThrough)
+
+	want := []*spb.Entry{fact("a", "/kythe/node/kind", "record")}
+	checkEntries(t, "Read miss", readSourceEntries(t, ts, "a", ""), want)
+	checkTierStats(t, "Read miss", ts, TierStats{Misses: 1, Promotions: 1, Promoted: 1})
+	checkEntries(t, "Promoted", hot.entries, cold.entries[:2])
+
+	checkEntries(t, "Read hit", readSourceEntries(t, ts, "a", ""), want)
+	checkEntries(t, "Read hit", readSourceEntries(t, ts, "a", "*"), cold.entries[:2])
+	checkTierStats(t, "Read hit", ts, TierStats{Hits: 2, Misses: 1, Promotions: 1, Promoted: 1})
+	if cold.reads != 1 {
+		t.Errorf("Cold store read %d times; want 1", cold.reads)
+	}
+
+	// A source with no entries is not promoted.
+	if entries := readSourceEntries(t, ts, "missing", "*"); len(entries) != 0 {
+		t.Errorf("Read of missing source found %v", entries)
+	}
+	checkTierStats(t, "Read missing", ts, TierStats{Hits: 2, Misses: 2, Promotions: 1, Promoted: 1})
+
+	// Writes of a promoted source go to both stores; others go only to the cold
+	// store.
+	for _, src := range []string{"a", "b"} {
+		if err := ts.Write(ctx, &spb.WriteRequest{
+			Source: vname(src),
+			Update: []*spb.WriteRequest_Update{{FactName: "/kythe/text", FactValue: []byte(src)}},
+		}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	checkEntries(t, "Hot after Write", hot.entries, []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("a", "/kythe/text", "a"),
+		edge("a", "/kythe/edge/childof", "b"),
+	})
+	if len(cold.entries) != 5 {
+		t.Errorf("Found %d cold entries after Writes; want 5", len(cold.entries))
+	}
+
+	// Scans use the cold store.
+	if entries, err := readAll(ts); err != nil {
+		t.Fatalf("Scan: %v", err)
+	} else {
+		checkEntries(t, "Scan", entries, cold.entries)
+	}
+	if hot.scans != 0 {
+		t.Errorf("Hot store scanned %d times; want 0", hot.scans)
+	}
+
+	// An evicted source is promoted again.
+	ts.Evicted(vname("a"))
+	readSourceEntries(t, ts, "a", "")
+	checkTierStats(t, "Read evicted", ts, TierStats{Hits: 2, Misses: 3, Promotions: 2, Promoted: 1})
+}
+
+func TestTieredServiceInvalidate(t *testing.T) {
+	cold := &sliceStore{entries: []*spb.Entry{fact("a", "/kythe/node/kind", "record")}}
+	hot := &sliceStore{}
+	ts := NewTiered(hot, cold, TierInvalidate)
+
+	readSourceEntries(t, ts, "a", "")
+	readSourceEntries(t, ts, "a", "")
+	checkTierStats(t, "Reads", ts, TierStats{Hits: 1, Misses: 1, Promotions: 1, Promoted: 1})
+
+	if err := ts.Write(ctx, &spb.WriteRequest{
+		Source: vname("a"),
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("variable")}},
+	}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	checkTierStats(t, "Write", ts, TierStats{Hits: 1, Misses: 1, Promotions: 1})
+	checkEntries(t, "Hot after Write", hot.entries, []*spb.Entry{fact("a", "/kythe/node/kind", "record")})
+
+	want := []*spb.Entry{fact("a", "/kythe/node/kind", "variable")}
+	checkEntries(t, "Read after Write", readSourceEntries(t, ts, "a", ""), want)
+	checkEntries(t, "Read after Write", readSourceEntries(t, ts, "a", ""), want)
+	checkTierStats(t, "Reads after Write", ts, TierStats{Hits: 2, Misses: 2, Promotions: 2, Promoted: 1})
+}
+
+func TestTieredServicePromotionFailure(t *testing.T) {
+	cold := &sliceStore{entries: []*spb.Entry{
+		fact("a", "/kythe/node/kind", "record"),
+		fact("b", "/kythe/node/kind", "record"),
+	}}
+	hot := &limitedWriter{sliceStore: &sliceStore{}, limit: 1}
+	ts := NewTiered(hot, cold, TierWriteThrough)
+
+	for _, src := range []string{"a", "b", "b"} {
+		checkEntries(t, "Read "+src, readSourceEntries(t, ts, src, ""), []*spb.Entry{fact(src, "/kythe/node/kind", "record")})
+	}
+	checkTierStats(t, "Reads", ts, TierStats{Misses: 3, Promotions: 1, PromotionFailures: 2, Promoted: 1})
+}
+
+// gatedReader is a sliceStore whose Reads are counted, and wait for proceed to
+// be closed.
+type gatedReader struct {
+	*sliceStore
+	reads   int32 // atomic
+	proceed chan struct{}
+}
+
+func (s *gatedReader) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	atomic.AddInt32(&s.reads, 1)
+	<-s.proceed
+	return s.sliceStore.Read(ctx, req, f)
+}
+
+func TestTieredServiceConcurrentMisses(t *testing.T) {
+	cold := &gatedReader{
+		sliceStore: &sliceStore{entries: []*spb.Entry{
+			fact("a", "/kythe/node/kind", "record"),
+			edge("a", "/kythe/edge/childof", "b"),
+		}},
+		proceed: make(chan struct{}),
+	}
+	ts := NewTiered(&sliceStore{}, cold, TierWriteThrough)
+
+	const readers = 8
+	var wg sync.WaitGroup
+	wg.Add(readers)
+	for i := 0; i < readers; i++ {
+		go func() {
+			defer wg.Done()
+			var n int
+			if err := ts.Read(ctx, &spb.ReadRequest{Source: vname("a"), EdgeKind: "*"}, func(*spb.Entry) error {
+				n++
+				return nil
+			}); err != nil {
+				t.Errorf("Read: %v", err)
+			} else if n != 2 {
+				t.Errorf("Read %d entries; want 2", n)
+			}
+		}()
+	}
+	for ts.Stats().Misses != readers {
+		runtime.Gosched() // wait for every Read to miss
+	}
+	close(cold.proceed)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&cold.reads); n != 1 {
+		t.Errorf("Cold store read %d times; want 1", n)
+	}
+	checkTierStats(t, "Reads", ts, TierStats{Misses: readers, Promotions: 1, Promoted: 1})
+}
+
+func TestTieredServiceCancelledRead(t *testing.T) {
+	cold := &gatedReader{
+		sliceStore: &sliceStore{entries: []*spb.Entry{fact("a", "/kythe/node/kind", "record")}},
+		proceed:    make(chan struct{}),
+	}
+	ts := NewTiered(&sliceStore{}, cold, TierWriteThrough)
+
+	// The first Read, which starts the promotion, is cancelled; the second
+	// still receives the promoted entries.
+	first, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 2)
+	go func() {
+		errc <- ts.Read(first, &spb.ReadRequest{Source: vname("a")}, func(*spb.Entry) error { return nil })
+	}()
+	for ts.Stats().Misses != 1 {
+		runtime.Gosched()
+	}
+	var n int
+	go func() {
+		errc <- ts.Read(ctx, &spb.ReadRequest{Source: vname("a")}, func(*spb.Entry) error {
+			n++
+			return nil
+		})
+	}()
+	for ts.Stats().Misses != 2 {
+		runtime.Gosched()
+	}
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Cancelled Read: got error %v; want %v", err, context.Canceled)
+	}
+	close(cold.proceed)
+	if err := <-errc; err != nil {
+		t.Errorf("Read: %v", err)
+	} else if n != 1 {
+		t.Errorf("Read %d entries; want 1", n)
+	}
+	checkTierStats(t, "Reads", ts, TierStats{Misses: 2, Promotions: 1, Promoted: 1})
+}
+
+func TestTieredServiceWriteDuringPromotion(t *testing.T) {
+	cold := &gatedReader{
+		sliceStore: &sliceStore{entries: []*spb.Entry{
+			fact("a", "/kythe/node/kind", "record"),
+			fact("b", "/kythe/node/kind", "record"),
+		}},
+		proceed: make(chan struct{}),
+	}
+	ts := NewTiered(&sliceStore{}, cold, TierWriteThrough)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for _, src := range []string{"a", "b"} {
+		src := src
+		go func() {
+			defer wg.Done()
+			readSourceEntries(t, ts, src, "")
+		}()
+	}
+	for ts.Stats().Misses != 2 {
+		runtime.Gosched()
+	}
+	// Only the promotion of the written source is made stale.
+	if err := ts.Write(ctx, &spb.WriteRequest{
+		Source: vname("b"),
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/text", FactValue: []byte("b")}},
+	}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	close(cold.proceed)
+	wg.Wait()
+	checkTierStats(t, "Reads", ts, TierStats{Misses: 2, Promotions: 1, Promoted: 1})
+
+	readSourceEntries(t, ts, "a", "")
+	readSourceEntries(t, ts, "b", "")
+	checkTierStats(t, "Reads after promotion", ts, TierStats{Hits: 1, Misses: 3, Promotions: 2, Promoted: 2})
+}
+
+// mapStore is a Service that reads sources from a map, for benchmarks.
+type mapStore struct {
+	mu      sync.Mutex
+	sources map[string][]*spb.Entry
+}
+
+func (s *mapStore) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	s.mu.Lock()
+	entries := s.sources[req.Source.Signature]
+	s.mu.Unlock()
+	for _, e := range entries {
+		if req.EdgeKind != "*" && e.EdgeKind != req.EdgeKind {
+			continue
+		} else if err := f(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mapStore) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	return ErrUnsupported
+}
+
+func (s *mapStore) Write(ctx context.Context, req *spb.WriteRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range req.Update {
+		s.sources[req.Source.Signature] = append(s.sources[req.Source.Signature], &spb.Entry{
+			Source:    req.Source,
+			EdgeKind:  u.EdgeKind,
+			Target:    u.Target,
+			FactName:  u.FactName,
+			FactValue: u.FactValue,
+		})
+	}
+	return nil
+}
+
+func (s *mapStore) Close(ctx context.Context) error { return nil }
+
+// slowStore is a Service whose Reads take at least delay, as from disk.
+type slowStore struct {
+	Service
+	delay time.Duration
+}
+
+func (s *slowStore) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	time.Sleep(s.delay)
+	return s.Service.Read(ctx, req, f)
+}
+
+// benchmarkZipfReads benchmarks Reads of sources chosen with a Zipfian
+// distribution from a slow cold store, through wrap.
+func benchmarkZipfReads(b *testing.B, wrap func(cold Service) Service) {
+	const numSources = 10000
+	cold := &mapStore{sources: make(map[string][]*spb.Entry)}
+	for i := 0; i < numSources; i++ {
+		sig := fmt.Sprintf("sig%05d", i)
+		cold.sources[sig] = []*spb.Entry{
+			fact(sig, "/kythe/node/kind", "record"),
+			edge(sig, "/kythe/edge/childof", "parent"),
+		}
+	}
+	s := wrap(&slowStore{cold, 20 * time.Microsecond})
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, numSources-1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &spb.ReadRequest{Source: vname(fmt.Sprintf("sig%05d", zipf.Uint64())), EdgeKind: "*"}
+		if err := s.Read(ctx, req, func(*spb.Entry) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if ts, ok := s.(*TieredService); ok {
+		b.Logf("Hit rate %.3f for %d reads", ts.Stats().HitRate(), b.N)
+	}
+}
+
+func BenchmarkZipfReadsCold(b *testing.B) {
+	benchmarkZipfReads(b, func(cold Service) Service { return cold })
+}
+
+func BenchmarkZipfReadsTiered(b *testing.B) {
+	benchmarkZipfReads(b, func(cold Service) Service {
+		return NewTiered(&mapStore{sources: make(map[string][]*spb.Entry)}, cold, TierWriteThrough)
+	})
+}
+
+func TestOpen(t *testing.T) {
+	var locs []string
+	Register("test-open", func(ctx context.Context, u *url.URL) (Service, error) {
+		locs = append(locs, SpecLocation(u))
+		return &sliceStore{}, nil
+	})
+
+	for spec, want := range map[string]string{
+		"test-open:///data/gs":   "/data/gs",
+		"test-open:/data/gs":     "/data/gs",
+		"test-open:data/gs":      "data/gs",
+		"test-open://host:1234":  "host:1234",
+		" test-open:a,b:///c ":   "a,b:///c",
+		"TEST-OPEN://h/p?x=1":    "h/p?x=1",
+		"test-open://u:p@h:1/db": "u:p@h:1/db",
+	} {
+		locs = nil
+		if _, err := Open(ctx, spec); err != nil {
+			t.Errorf("Open(%q) error: %v", spec, err)
+		} else if len(locs) != 1 || locs[0] != want {
+			t.Errorf("Open(%q) opened %q; want %q", spec, locs, want)
+		}
+	}
+
+	for spec, want := range map[string]string{
+		"/data/gs":              `GraphStore spec "/data/gs" has no scheme (registered schemes: `,
+		"no-such-scheme:/x":     `unknown GraphStore scheme "no-such-scheme" in spec "no-such-scheme:/x" (registered schemes: `,
+		"test-open://bad host/": `malformed GraphStore spec "test-open://bad host/": `,
+	} {
+		if _, err := Open(ctx, spec); err == nil {
+			t.Errorf("Open(%q) succeeded; expected an error", spec)
+		} else if !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("Open(%q) error: %q; want prefix %q", spec, err, want)
+		} else if strings.Contains(want, "schemes") && !strings.Contains(err.Error(), "test-open") {
+			t.Errorf("Open(%q) error %q does not list the registered schemes", spec, err)
+		}
+	}
+}
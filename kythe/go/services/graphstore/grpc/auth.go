@@ -0,0 +1,270 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// The full gRPC names of the GraphStore methods, as passed to an Authorizer.
+const (
+	ReadMethod        = "/kythe.proto.GraphStore/Read"
+	ScanMethod        = "/kythe.proto.GraphStore/Scan"
+	WriteMethod       = "/kythe.proto.GraphStore/Write"
+	WriteStreamMethod = "/kythe.proto.GraphStore/WriteStream"
+)
+
+// WriteMethods are the GraphStore methods that modify the store.
+var WriteMethods = []string{WriteMethod, WriteStreamMethod}
+
+// An Authorizer decides whether the callers of a gRPC server may call its
+// methods.
+type Authorizer interface {
+	// Authorize returns nil if the call of method (its full gRPC name, e.g.
+	// WriteMethod) whose incoming metadata ctx carries is allowed, or else an
+	// error saying why not.  An error without a gRPC status code is reported
+	// to the caller as codes.PermissionDenied.
+	Authorize(ctx context.Context, method string) error
+}
+
+// AuthServerOptions returns the options of a gRPC server, to be passed to
+// grpc.NewServer, that allow each call only if a authorizes it.  A stream,
+// such as a WriteStream, is authorized once, when it starts.
+func AuthServerOptions(a Authorizer) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := authorize(ctx, a, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorize(stream.Context(), a, info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+}
+
+func authorize(ctx context.Context, a Authorizer, method string) error {
+	err := a.Authorize(ctx, method)
+	if err != nil && grpc.Code(err) == codes.Unknown {
+		return grpc.Errorf(codes.PermissionDenied, "%v", err)
+	}
+	return err
+}
+
+// authorizationKey is the metadata key of a call's bearer token.
+const authorizationKey = "authorization"
+
+// AuthorizeHTTP returns nil if a allows the HTTP request r to call method, or
+// else an error saying why not.  The bearer token of r's Authorization header
+// is passed to a as a gRPC call's would be, so that an HTTP endpoint may share
+// the tokens of a gRPC server.
+func AuthorizeHTTP(a Authorizer, r *http.Request, method string) error {
+	md := metadata.MD{}
+	if h := r.Header.Get("Authorization"); h != "" {
+		md = metadata.Pairs(authorizationKey, h)
+	}
+	return a.Authorize(metadata.NewContext(r.Context(), md), method)
+}
+
+// NewTokenAuthorizer returns an Authorizer that allows a call of one of
+// methods (or, if none are given, of any method) only if it carries a bearer
+// token listed in file, one per line.  Calls of other methods are allowed.
+// The file is reread once it changes, so that its tokens may be rotated while
+// the server runs.
+func NewTokenAuthorizer(file string, methods ...string) (Authorizer, error) {
+	a := &tokenAuthorizer{tokens: &tokenFile{path: file}}
+	if _, err := a.tokens.get(); err != nil {
+		return nil, err
+	}
+	if len(methods) > 0 {
+		a.methods = make(map[string]bool)
+		for _, m := range methods {
+			a.methods[m] = true
+		}
+	}
+	return a, nil
+}
+
+type tokenAuthorizer struct {
+	tokens  *tokenFile
+	methods map[string]bool // nil if every method requires a token
+}
+
+// Authorize implements the Authorizer interface.
+func (a *tokenAuthorizer) Authorize(ctx context.Context, method string) error {
+	if a.methods != nil && !a.methods[method] {
+		return nil
+	}
+	md, _ := metadata.FromContext(ctx)
+	if len(md[authorizationKey]) == 0 {
+		return fmt.Errorf("%s requires a bearer token", method)
+	}
+	token := strings.TrimPrefix(md[authorizationKey][0], "Bearer ")
+	tokens, err := a.tokens.get()
+	if err != nil {
+		return grpc.Errorf(codes.Internal, "loading tokens: %v", err)
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid bearer token for %s", method)
+}
+
+// tokenFile is a file of tokens, one per line, reread once it changes.
+type tokenFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	tokens  []string
+}
+
+// get returns the tokens of the file, rereading it if its modification time or
+// size has changed since it was last read.
+func (f *tokenFile) get() ([]string, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.tokens != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.tokens, nil
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if t := strings.TrimSpace(s.Text()); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("token file %q holds no tokens", f.path)
+	}
+	f.tokens, f.modTime, f.size = tokens, fi.ModTime(), fi.Size()
+	return tokens, nil
+}
+
+// A TokenSource returns the bearer token to attach to a call.  It is called
+// for each call, so that the token may change over a connection's lifetime.
+type TokenSource func(ctx context.Context) (string, error)
+
+// StaticToken returns a TokenSource that always returns token.
+func StaticToken(token string) TokenSource {
+	return func(context.Context) (string, error) { return token, nil }
+}
+
+// TokenFromFile returns a TokenSource that returns the first token in file,
+// rereading it once it changes.
+func TokenFromFile(file string) TokenSource {
+	f := &tokenFile{path: file}
+	return func(context.Context) (string, error) {
+		tokens, err := f.get()
+		if err != nil {
+			return "", err
+		}
+		return tokens[0], nil
+	}
+}
+
+// TokenCredentials returns the per-call credentials of a client, to be passed
+// to grpc.Dial by grpc.WithPerRPCCredentials, that attach the token of src to
+// each call.  The credentials require a TLS connection (see DialTLS), so that
+// the token is not sent in the clear.
+func TokenCredentials(src TokenSource) credentials.PerRPCCredentials {
+	return tokenCreds(src)
+}
+
+type tokenCreds TokenSource
+
+// GetRequestMetadata implements part of the credentials.PerRPCCredentials
+// interface.
+func (c tokenCreds) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := c(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting bearer token: %v", err)
+	}
+	return map[string]string{authorizationKey: "Bearer " + token}, nil
+}
+
+// RequireTransportSecurity implements part of the
+// credentials.PerRPCCredentials interface.
+func (tokenCreds) RequireTransportSecurity() bool { return true }
+
+// A PermissionError reports that the server refused a call of a method because
+// its caller is not authorized to make it, e.g. for lack of a valid token.
+type PermissionError struct {
+	Method string // the full gRPC name of the method
+	Reason string // the server's description of the refusal
+}
+
+// Error implements the error interface.
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("permission denied for %s: %s", e.Method, e.Reason)
+}
+
+// IsPermissionDenied reports whether err is a *PermissionError, or a
+// *PipelineError each of whose failures is one.
+func IsPermissionDenied(err error) bool {
+	switch e := err.(type) {
+	case *PermissionError:
+		return true
+	case *PipelineError:
+		for _, f := range e.Failures {
+			if !IsPermissionDenied(f.Err) {
+				return false
+			}
+		}
+		return len(e.Failures) > 0
+	}
+	return false
+}
+
+// permissionError returns a *PermissionError for err if it is a gRPC error
+// with codes.PermissionDenied from a call of method; otherwise it returns err.
+func permissionError(method string, err error) error {
+	if err == nil || grpc.Code(err) != codes.PermissionDenied {
+		return err
+	}
+	return &PermissionError{Method: method, Reason: grpc.ErrorDesc(err)}
+}
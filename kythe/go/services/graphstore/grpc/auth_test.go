@@ -0,0 +1,255 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// authServer starts a TLS GraphStore server whose writes require a token in
+// the returned token file, and returns the CA's certificate file, the server's
+// address, and a function to stop it.
+func authServer(t *testing.T, p *pki, token string) (caFile, tokenFile, addr string, stop func()) {
+	now := time.Now()
+	ca := p.issue("ca", nil, now.Add(-time.Hour), now.Add(time.Hour))
+	server := p.issue("server", ca, now.Add(-time.Hour), now.Add(time.Hour))
+	tokenFile = filepath.Join(p.dir, "server_tokens")
+	writeToken(t, tokenFile, token, now)
+	a, err := NewTokenAuthorizer(tokenFile, WriteMethods...)
+	if err != nil {
+		t.Fatalf("NewTokenAuthorizer: %v", err)
+	}
+	addr, stop = serveTLS(t, &TLSOptions{CertFile: server.certFile, KeyFile: server.keyFile}, AuthServerOptions(a)...)
+	return ca.certFile, tokenFile, addr, stop
+}
+
+// writeToken replaces file with token, setting its modification time to mod so
+// that the change is seen regardless of the file system's time granularity.
+func writeToken(t *testing.T, file, token string, mod time.Time) {
+	if err := ioutil.WriteFile(file, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := os.Chtimes(file, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dialToken connects to the server at addr trusting caFile, attaching the
+// tokens of src to its calls if src is non-nil.
+func dialToken(t *testing.T, addr, caFile string, src TokenSource) *grpc.ClientConn {
+	var opts []grpc.DialOption
+	if src != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(TokenCredentials(src)))
+	}
+	conn, err := DialTLS(addr, &TLSOptions{CAFile: caFile}, opts...)
+	if err != nil {
+		t.Fatalf("DialTLS: %v", err)
+	}
+	return conn
+}
+
+func TestAuthReadAllowedWriteDenied(t *testing.T) {
+	p := newPKI(t)
+	defer p.cleanup()
+	caFile, _, addr, stop := authServer(t, p, "secret")
+	defer stop()
+
+	for _, test := range []struct {
+		src   TokenSource
+		allow bool
+	}{
+		{nil, false},
+		{StaticToken("wrong"), false},
+		{StaticToken("secret"), true},
+	} {
+		conn := dialToken(t, addr, caFile, test.src)
+		unary := NewServiceWithOptions(conn, &Options{UnaryWrites: true})
+		streaming := NewService(conn)
+
+		if err := unary.Read(ctx, &spb.ReadRequest{Source: &spb.VName{Signature: "any"}}, func(*spb.Entry) error { return nil }); err != nil {
+			t.Errorf("Read: unexpected error: %v", err)
+		}
+
+		err := unary.Write(ctx, request("unary", 1))
+		if test.allow {
+			if err != nil {
+				t.Errorf("unary Write: unexpected error: %v", err)
+			}
+		} else if pe, ok := err.(*PermissionError); !ok {
+			t.Errorf("unary Write: got error %v; want a *PermissionError", err)
+		} else if pe.Method != WriteMethod {
+			t.Errorf("unary Write: got PermissionError for %q; want %q", pe.Method, WriteMethod)
+		}
+
+		if err := streaming.Write(ctx, request("stream", 2)); err != nil {
+			t.Errorf("streaming Write: unexpected error: %v", err)
+		}
+		err = streaming.(*remote).Flush(ctx)
+		if test.allow {
+			if err != nil {
+				t.Errorf("Flush: unexpected error: %v", err)
+			}
+		} else if !IsPermissionDenied(err) {
+			t.Errorf("Flush: got error %v; want a denied *PipelineError", err)
+		}
+
+		want := 0
+		if test.allow {
+			want = 1
+		}
+		if n := countEntries(t, unary, "unary"); n != want {
+			t.Errorf("Read %d unary entries; want %d", n, want)
+		}
+		if n := countEntries(t, unary, "stream"); n != 2*want {
+			t.Errorf("Read %d streamed entries; want %d", n, 2*want)
+		}
+		conn.Close()
+	}
+}
+
+func TestAuthTokenRotation(t *testing.T) {
+	p := newPKI(t)
+	defer p.cleanup()
+	caFile, serverTokens, addr, stop := authServer(t, p, "old")
+	defer stop()
+
+	// The client reads its token from a file, also rotated, over a single
+	// connection.  Each unary Write is authorized anew.
+	clientToken := filepath.Join(p.dir, "client_token")
+	now := time.Now()
+	writeToken(t, clientToken, "old", now)
+	conn := dialToken(t, addr, caFile, TokenFromFile(clientToken))
+	defer conn.Close()
+	gs := NewServiceWithOptions(conn, &Options{UnaryWrites: true})
+
+	write := func(sig string) error { return gs.Write(ctx, request(sig, 1)) }
+	if err := write("before"); err != nil {
+		t.Fatalf("Write before rotation: %v", err)
+	}
+
+	writeToken(t, serverTokens, "new", now.Add(time.Minute))
+	if err := write("during"); !IsPermissionDenied(err) {
+		t.Errorf("Write with the rotated-out token: got error %v; want permission denied", err)
+	}
+
+	writeToken(t, clientToken, "new", now.Add(time.Minute))
+	if err := write("after"); err != nil {
+		t.Errorf("Write after rotation: %v", err)
+	}
+
+	// A grpcs spec's token_file is read likewise.
+	specGS, err := graphstore.Open(ctx, spec(addr, "ca", caFile, "token_file", clientToken))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer specGS.Close(ctx)
+	if err := specGS.Write(ctx, request("spec", 1)); err != nil {
+		t.Errorf("Write: %v", err)
+	} else if err := specGS.(*remote).Flush(ctx); err != nil {
+		t.Errorf("Flush: %v", err)
+	}
+
+	for sig, want := range map[string]int{"before": 1, "during": 0, "after": 1, "spec": 1} {
+		if n := countEntries(t, gs, sig); n != want {
+			t.Errorf("Read %d %q entries; want %d", n, sig, want)
+		}
+	}
+}
+
+// codeAuthorizer refuses every call with a fixed gRPC status code.
+type codeAuthorizer struct {
+	mu      sync.Mutex
+	methods []string
+}
+
+func (a *codeAuthorizer) Authorize(ctx context.Context, method string) error {
+	a.mu.Lock()
+	a.methods = append(a.methods, method)
+	a.mu.Unlock()
+	return grpc.Errorf(codes.Unauthenticated, "go away")
+}
+
+func TestAuthorizeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "tokens")
+	writeToken(t, tokenFile, "secret", time.Now())
+	const method = "/admin/backup"
+	a, err := NewTokenAuthorizer(tokenFile, method)
+	if err != nil {
+		t.Fatalf("NewTokenAuthorizer: %v", err)
+	}
+
+	for _, test := range []struct {
+		method, header string
+		ok             bool
+	}{
+		{method, "Bearer secret", true},
+		{method, "Bearer wrong", false},
+		{method, "", false},
+		{"/other", "", true},
+	} {
+		r, err := http.NewRequest("POST", "http://localhost"+test.method, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if err := AuthorizeHTTP(a, r, test.method); (err == nil) != test.ok {
+			t.Errorf("AuthorizeHTTP(%q, %q): got error %v; want allowed %v", test.method, test.header, err, test.ok)
+		}
+	}
+}
+
+func TestAuthorizerCodes(t *testing.T) {
+	p := newPKI(t)
+	defer p.cleanup()
+	now := time.Now()
+	ca := p.issue("ca", nil, now.Add(-time.Hour), now.Add(time.Hour))
+	server := p.issue("server", ca, now.Add(-time.Hour), now.Add(time.Hour))
+	a := new(codeAuthorizer)
+	addr, stop := serveTLS(t, &TLSOptions{CertFile: server.certFile, KeyFile: server.keyFile}, AuthServerOptions(a)...)
+	defer stop()
+
+	conn := dialToken(t, addr, ca.certFile, nil)
+	defer conn.Close()
+	gs := NewServiceWithOptions(conn, &Options{UnaryWrites: true})
+	err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error { return nil })
+	if grpc.Code(err) != codes.Unauthenticated {
+		t.Errorf("Scan: got error %v; want code %v", err, codes.Unauthenticated)
+	}
+	if want := []string{ScanMethod}; len(a.methods) != 1 || a.methods[0] != want[0] {
+		t.Errorf("Authorized methods: got %v; want %v", a.methods, want)
+	}
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"google.golang.org/grpc"
+)
+
+// A Compression compresses the gRPC messages of clients and servers on the
+// wire.
+type Compression interface {
+	// Type names the Compression, as the grpc-encoding of its messages.
+	Type() string
+
+	// Compress writes the compression of the message p to w.
+	Compress(w io.Writer, p []byte) error
+
+	// Decompress returns the decompression of the message read from r, or
+	// just its first max+1 bytes if it is longer than max bytes.
+	Decompress(r io.Reader, max int) ([]byte, error)
+}
+
+// NoCompression names the absence of a Compression.
+const NoCompression = "none"
+
+// DefaultServerMaxMessageBytes bounds the size of each message received by a
+// server configured by ServerCompressionOptions, as gRPC does by default.
+const DefaultServerMaxMessageBytes = 4 << 20
+
+var (
+	compressionsMu sync.RWMutex
+	compressions   = make(map[string]Compression)
+)
+
+func init() {
+	RegisterCompression(NewGzipCompression(gzip.DefaultCompression))
+	RegisterCompression(snappyCompression{})
+}
+
+// RegisterCompression makes c available by its Type to CompressionDialOptions
+// and ServerCompressionOptions.  The "gzip" and "snappy" Compressions are
+// registered by default; registering another of the same Type replaces it,
+// e.g. to change the gzip level.
+func RegisterCompression(c Compression) {
+	compressionsMu.Lock()
+	defer compressionsMu.Unlock()
+	compressions[c.Type()] = c
+}
+
+// Compressions returns the Types of the registered Compressions, in order.
+func Compressions() []string {
+	compressionsMu.RLock()
+	defer compressionsMu.RUnlock()
+	names := make([]string, 0, len(compressions))
+	for name := range compressions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupCompression returns the registered Compression named name, or nil for
+// NoCompression.
+func lookupCompression(name string) (Compression, error) {
+	if name == NoCompression {
+		return nil, nil
+	}
+	compressionsMu.RLock()
+	c, ok := compressions[name]
+	compressionsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q (known: %s, %s)", name, NoCompression, strings.Join(Compressions(), ", "))
+	}
+	return c, nil
+}
+
+// CompressionDialOptions returns the options of a client connection, to be
+// passed to grpc.Dial, that compress its requests with the named Compression
+// (or not at all for NoCompression) and decompress the responses of a server
+// using it.  If name is empty, the requests are not compressed, but the
+// responses of a server using gzip are decompressed.  Each response is
+// decompressed to at most maxMessageBytes (or, if 0, DefaultMaxMessageBytes),
+// which should match the client's Options.MaxMessageBytes, so that a small
+// compressed message cannot expand without bound.
+//
+// gRPC compresses all the messages of a connection, or of a server, alike, so
+// the client and server must use the same Compression, which applies to each
+// of their calls; a client wanting some calls compressed and others not must
+// make them over separate connections.
+func CompressionDialOptions(name string, maxMessageBytes int) ([]grpc.DialOption, error) {
+	if maxMessageBytes == 0 {
+		maxMessageBytes = DefaultMaxMessageBytes
+	}
+	if name == "" {
+		c, err := lookupCompression("gzip")
+		if err != nil {
+			return nil, err
+		}
+		return []grpc.DialOption{grpc.WithDecompressor(decompressor{c, maxMessageBytes})}, nil
+	}
+	c, err := lookupCompression(name)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	return []grpc.DialOption{
+		grpc.WithCompressor(compressor{c}),
+		grpc.WithDecompressor(decompressor{c, maxMessageBytes}),
+	}, nil
+}
+
+// ServerCompressionOptions returns the options of a server, to be passed to
+// grpc.NewServer, that compress its responses with the named Compression (or
+// not at all for NoCompression or "") and decompress the requests of clients
+// using it.  Each request is limited to maxMessageBytes (or, if 0,
+// DefaultServerMaxMessageBytes) once decompressed.
+func ServerCompressionOptions(name string, maxMessageBytes int) ([]grpc.ServerOption, error) {
+	if maxMessageBytes == 0 {
+		maxMessageBytes = DefaultServerMaxMessageBytes
+	}
+	opts := []grpc.ServerOption{grpc.MaxMsgSize(maxMessageBytes)}
+	if name == "" {
+		return opts, nil
+	}
+	c, err := lookupCompression(name)
+	if err != nil {
+		return nil, err
+	} else if c != nil {
+		opts = append(opts,
+			grpc.RPCCompressor(compressor{c}),
+			grpc.RPCDecompressor(decompressor{c, maxMessageBytes}))
+	}
+	return opts, nil
+}
+
+// compressor adapts a Compression to the grpc.Compressor interface.
+type compressor struct{ c Compression }
+
+func (c compressor) Do(w io.Writer, p []byte) error { return c.c.Compress(w, p) }
+func (c compressor) Type() string                   { return c.c.Type() }
+
+// decompressor adapts a Compression to the grpc.Decompressor interface,
+// decompressing at most max+1 bytes of each message.  gRPC checks a message's
+// size once it is decompressed; a message longer than max is truncated, and
+// so fails that check (on a server) or the entry's (see boundedEntry), rather
+// than its decompression, which would end a stream without resetting it.
+type decompressor struct {
+	c   Compression
+	max int
+}
+
+func (d decompressor) Do(r io.Reader) ([]byte, error) { return d.c.Decompress(r, d.max) }
+func (d decompressor) Type() string                   { return d.c.Type() }
+
+// NewGzipCompression returns the gzip Compression at the given level (see the
+// compress/gzip package).
+func NewGzipCompression(level int) Compression {
+	return &gzipCompression{level: level}
+}
+
+type gzipCompression struct {
+	level   int
+	writers sync.Pool // of *gzip.Writer
+	readers sync.Pool // of *gzip.Reader
+}
+
+// Type implements part of the Compression interface.
+func (*gzipCompression) Type() string { return "gzip" }
+
+// Compress implements part of the Compression interface.
+func (c *gzipCompression) Compress(w io.Writer, p []byte) error {
+	z, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		z.Reset(w)
+	} else {
+		var err error
+		if z, err = gzip.NewWriterLevel(w, c.level); err != nil {
+			return err
+		}
+	}
+	defer c.writers.Put(z)
+	if _, err := z.Write(p); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// Decompress implements part of the Compression interface.
+func (c *gzipCompression) Decompress(r io.Reader, max int) ([]byte, error) {
+	z, ok := c.readers.Get().(*gzip.Reader)
+	if ok {
+		if err := z.Reset(r); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if z, err = gzip.NewReader(r); err != nil {
+			return nil, err
+		}
+	}
+	defer c.readers.Put(z)
+	return ioutil.ReadAll(io.LimitReader(z, int64(max)+1))
+}
+
+// snappyCompression is the Compression of the snappy block format.
+type snappyCompression struct{}
+
+// Type implements part of the Compression interface.
+func (snappyCompression) Type() string { return "snappy" }
+
+// Compress implements part of the Compression interface.
+func (snappyCompression) Compress(w io.Writer, p []byte) error {
+	_, err := w.Write(snappy.Encode(nil, p))
+	return err
+}
+
+// Decompress implements part of the Compression interface.
+func (snappyCompression) Decompress(r io.Reader, max int) ([]byte, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	} else if n > max {
+		return make([]byte, max+1), nil // too long to decode
+	}
+	return snappy.Decode(nil, src)
+}
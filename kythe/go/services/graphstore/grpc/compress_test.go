@@ -0,0 +1,259 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/inmemory"
+
+	"google.golang.org/grpc"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// countingListener counts the bytes written to its connections.
+type countingListener struct {
+	net.Listener
+	written int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{c, &l.written}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written *int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
+// serveCompressed starts a GraphStore server for gs using the named
+// compression and message limit, and returns its address, its listener
+// (counting the bytes it sends), and a function to stop it.
+func serveCompressed(t testing.TB, gs graphstore.Service, compression string, maxMessageBytes int) (string, *countingListener, func()) {
+	opts, err := ServerCompressionOptions(compression, maxMessageBytes)
+	if err != nil {
+		t.Fatalf("ServerCompressionOptions: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	cl := &countingListener{Listener: l}
+	s := grpc.NewServer(opts...)
+	spb.RegisterGraphStoreServer(s, NewServer(gs, nil))
+	go s.Serve(cl)
+	return l.Addr().String(), cl, s.Stop
+}
+
+// sourceEntries returns entries whose fact values are chunks of this
+// package's source files, as realistic compressible data, and their total
+// size.
+func sourceEntries(t testing.TB, chunk int) ([]*spb.Entry, int64) {
+	files, err := filepath.Glob("*.go")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("Globbing source files: %v", err)
+	}
+	var entries []*spb.Entry
+	var size int64
+	for _, file := range files {
+		text, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; len(text) > 0; i++ {
+			n := chunk
+			if n > len(text) {
+				n = len(text)
+			}
+			entries = append(entries, &spb.Entry{
+				Source:    &spb.VName{Corpus: "kythe", Path: file, Signature: strings.Repeat("x", i%7)},
+				FactName:  "/kythe/text",
+				FactValue: text[:n],
+			})
+			size += int64(n)
+			text = text[n:]
+		}
+	}
+	return entries, size
+}
+
+func writeAll(t testing.TB, gs graphstore.Service, entries []*spb.Entry) {
+	for _, e := range entries {
+		if err := gs.Write(ctx, &spb.WriteRequest{
+			Source: e.Source,
+			Update: []*spb.WriteRequest_Update{{FactName: e.FactName, FactValue: e.FactValue}},
+		}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+}
+
+// scanAll scans every entry of gs, returning their total fact value size.
+func scanAll(t testing.TB, gs graphstore.Service) int64 {
+	var size int64
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		size += int64(len(e.FactValue))
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	return size
+}
+
+func TestCompression(t *testing.T) {
+	entries, size := sourceEntries(t, 2048)
+	wire := make(map[string]int64)
+	for _, c := range []string{NoCompression, "gzip", "snappy"} {
+		addr, l, stop := serveCompressed(t, inmemory.Create(), c, 0)
+		gs, err := graphstore.Open(ctx, "grpc://"+addr+"?compression="+c)
+		if err != nil {
+			t.Fatalf("Open (%s): %v", c, err)
+		}
+		writeAll(t, gs, entries)
+		before := atomic.LoadInt64(&l.written)
+		if got := scanAll(t, gs); got != size {
+			t.Errorf("Scan (%s): got %d bytes of fact values; want %d", c, got, size)
+		}
+		wire[c] = atomic.LoadInt64(&l.written) - before
+		gs.Close(ctx)
+		stop()
+	}
+	t.Logf("Scan of %d bytes of fact values sent: %v", size, wire)
+	for _, c := range []string{"gzip", "snappy"} {
+		if wire[c] >= wire[NoCompression]*2/3 {
+			t.Errorf("Scan with %s sent %d bytes; want well under the %d sent uncompressed", c, wire[c], wire[NoCompression])
+		}
+	}
+}
+
+func TestCompressionDefaultClient(t *testing.T) {
+	gs := inmemory.Create()
+	entries, size := sourceEntries(t, 2048)
+	writeAll(t, gs, entries)
+	addr, _, stop := serveCompressed(t, gs, "gzip", 0)
+	defer stop()
+
+	// A client not naming a compression reads a gzip server's responses.
+	remote, err := graphstore.Open(ctx, "grpc://"+addr)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer remote.Close(ctx)
+	if got := scanAll(t, remote); got != size {
+		t.Errorf("Scan: got %d bytes of fact values; want %d", got, size)
+	}
+
+	if _, err := graphstore.Open(ctx, "grpc://"+addr+"?compression=lz77"); err == nil || !strings.Contains(err.Error(), "unknown compression") {
+		t.Errorf("Open with an unknown compression: got error %v; want an unknown compression", err)
+	}
+}
+
+func TestCompressedMaxMessageBytes(t *testing.T) {
+	const max = 64 << 10
+	big := bytes.Repeat([]byte{'x'}, 1<<20) // compresses to a few KiB
+
+	for _, c := range []string{"gzip", "snappy"} {
+		// A response decompressing past the client's limit fails the Scan.
+		gs := inmemory.Create()
+		if err := gs.Write(ctx, &spb.WriteRequest{
+			Source: &spb.VName{Signature: "big"},
+			Update: []*spb.WriteRequest_Update{{FactName: "/fact", FactValue: big}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		addr, _, stop := serveCompressed(t, gs, c, 2<<20)
+		dialOpts, err := CompressionDialOptions(c, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := grpc.Dial(addr, append(dialOpts, grpc.WithInsecure())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote := NewServiceWithOptions(conn, &Options{MaxMessageBytes: max})
+		err = remote.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+			t.Errorf("Scan (%s) of a large entry: got error %v; want it to exceed the maximum", c, err)
+		}
+		conn.Close()
+		stop()
+
+		// A request decompressing past the server's limit fails the Write.
+		gs = inmemory.Create()
+		addr, _, stop = serveCompressed(t, gs, c, max)
+		conn, err = grpc.Dial(addr, append(dialOpts, grpc.WithInsecure())...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote = NewServiceWithOptions(conn, &Options{UnaryWrites: true})
+		if err := remote.Write(ctx, &spb.WriteRequest{
+			Source: &spb.VName{Signature: "big"},
+			Update: []*spb.WriteRequest_Update{{FactName: "/fact", FactValue: big}},
+		}); err == nil {
+			t.Errorf("Write (%s) of a large request succeeded; want an error", c)
+		}
+		if n := countEntries(t, gs, "big"); n != 0 {
+			t.Errorf("Write (%s) of a large request wrote %d entries", c, n)
+		}
+		conn.Close()
+		stop()
+	}
+}
+
+func BenchmarkScanCompression(b *testing.B) {
+	entries, size := sourceEntries(b, 2048)
+	for _, c := range []string{NoCompression, "gzip", "snappy"} {
+		b.Run(c, func(b *testing.B) {
+			store := inmemory.Create()
+			writeAll(b, store, entries)
+			addr, l, stop := serveCompressed(b, store, c, 0)
+			defer stop()
+			gs, err := graphstore.Open(ctx, "grpc://"+addr+"?compression="+c)
+			if err != nil {
+				b.Fatalf("Open: %v", err)
+			}
+			defer gs.Close(ctx)
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			before := atomic.LoadInt64(&l.written)
+			for i := 0; i < b.N; i++ {
+				scanAll(b, gs)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&l.written)-before)/float64(b.N), "wire-B/op")
+		})
+	}
+}
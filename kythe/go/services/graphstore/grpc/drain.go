@@ -0,0 +1,142 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// DrainingMessage is the message of the codes.Unavailable status with which a
+// Drainer aborts the calls in progress.  A client whose Scan is aborted may
+// resume it, e.g. from another server, by graphstore.ScanFrom after the last
+// entry it received.
+const DrainingMessage = "server draining"
+
+// drainGrace bounds the wait by DrainStop for the calls it aborts to end before
+// it stops its server outright.
+const drainGrace = 5 * time.Second
+
+var errDraining = grpc.Errorf(codes.Unavailable, DrainingMessage)
+
+// IsDraining reports whether err is the status of a call aborted by a
+// Drainer.
+func IsDraining(err error) bool {
+	return grpc.Code(err) == codes.Unavailable && grpc.ErrorDesc(err) == DrainingMessage
+}
+
+// A Drainer aborts the streaming calls (Reads, Scans, and WriteStreams) of a
+// GraphStore server (see ServerOptions) once it is drained.
+type Drainer struct {
+	mu       sync.Mutex // guards the fields below
+	draining bool
+	calls    map[*drainedCall]bool
+}
+
+// NewDrainer returns a Drainer that has not been drained.
+func NewDrainer() *Drainer { return &Drainer{calls: make(map[*drainedCall]bool)} }
+
+// Drain aborts each call of d in progress with codes.Unavailable and
+// DrainingMessage, as it does any call started later, and returns the number
+// of calls aborted.
+func (d *Drainer) Drain() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.draining = true
+	for c := range d.calls {
+		c.drained = true
+		c.cancel()
+	}
+	return len(d.calls)
+}
+
+type drainedCall struct {
+	d       *Drainer
+	cancel  func()
+	drained bool // guarded by d.mu
+}
+
+// start begins a call of d, returning the context the call must use.  d may be
+// nil, in which case the call is never aborted.
+func (d *Drainer) start(ctx context.Context) (context.Context, *drainedCall, error) {
+	if d == nil {
+		return ctx, nil, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return nil, nil, errDraining
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c := &drainedCall{d: d, cancel: cancel}
+	d.calls[c] = true
+	return ctx, c, nil
+}
+
+// end ends c, returning the status of the call given that it failed with err.
+// c may be nil.
+func (c *drainedCall) end(err error) error {
+	if c == nil {
+		return err
+	}
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	delete(c.d.calls, c)
+	c.cancel()
+	if err != nil && c.drained {
+		return errDraining
+	}
+	return err
+}
+
+// DrainStop is GracefulStop with a deadline: it shuts down h, waits for delay,
+// and then stops s gracefully, but once deadline has passed it aborts the calls
+// of d still in progress by d.Drain, so that their clients receive
+// DrainingMessage instead of a broken connection.  If deadline is 0, it waits
+// for the calls in progress to end, as GracefulStop does.
+func DrainStop(s *grpc.Server, h *HealthServer, d *Drainer, delay, deadline time.Duration) {
+	h.Shutdown()
+	time.Sleep(delay)
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	if deadline <= 0 || d == nil {
+		<-stopped
+		return
+	}
+
+	select {
+	case <-stopped:
+		return
+	case <-time.After(deadline):
+	}
+	log.Printf("Aborting %d GraphStore calls still in progress after %v", d.Drain(), deadline)
+	select {
+	case <-stopped:
+	case <-time.After(drainGrace):
+		log.Printf("Stopping GraphStore server with calls still in progress after %v", drainGrace)
+		s.Stop()
+		<-stopped
+	}
+}
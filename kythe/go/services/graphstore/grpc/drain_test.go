@@ -0,0 +1,197 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/inmemory"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// slowStore is a GraphStore whose Scans deliver each entry after its delay.
+type slowStore struct {
+	graphstore.Service
+	delay time.Duration
+}
+
+func (s slowStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return s.Service.Scan(ctx, req, func(e *spb.Entry) error {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return f(e)
+	})
+}
+
+// serveDrained starts a gRPC server for gs whose calls d may drain, and
+// returns it with a client of it.
+// orderedRemote is a Service known to Scan its entries in order.
+type orderedRemote struct{ graphstore.Service }
+
+func (orderedRemote) ScansOrdered() bool { return true }
+
+func serveDrained(t *testing.T, gs graphstore.Service, d *Drainer) (*grpc.Server, *HealthServer, graphstore.Service) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := grpc.NewServer()
+	h := NewHealthServer(gs, 0)
+	spb.RegisterGraphStoreServer(s, NewServer(gs, &ServerOptions{Drainer: d}))
+	go s.Serve(l)
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		s.Stop()
+		t.Fatalf("Dial: %v", err)
+	}
+	return s, h, NewService(conn)
+}
+
+// drainedScan starts a Scan of gs, returning a channel of its entries and a
+// channel of its result.
+func drainedScan(gs graphstore.Service) (<-chan *spb.Entry, <-chan error) {
+	entries := make(chan *spb.Entry, 100)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(entries)
+		errc <- gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+			entries <- e
+			return nil
+		})
+	}()
+	return entries, errc
+}
+
+func TestDrainStop(t *testing.T) {
+	store := inmemory.Create()
+	if err := store.Write(ctx, request("node", 50)); err != nil {
+		t.Fatal(err)
+	}
+	var want []*spb.Entry
+	if err := store.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		want = append(want, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDrainer()
+	s, h, remote := serveDrained(t, slowStore{store, 20 * time.Millisecond}, d)
+	defer remote.Close(ctx)
+	entries, errc := drainedScan(remote)
+	var got []*spb.Entry
+	for len(got) < 3 {
+		got = append(got, <-entries)
+	}
+
+	const deadline = 200 * time.Millisecond
+	start := time.Now()
+	DrainStop(s, h, d, 0, deadline)
+	if elapsed := time.Since(start); elapsed < deadline || elapsed > deadline+drainGrace/2 {
+		t.Errorf("DrainStop took %v; want about %v", elapsed, deadline)
+	}
+	for e := range entries {
+		got = append(got, e)
+	}
+	if err := <-errc; !IsDraining(err) {
+		t.Fatalf("Scan past the drain deadline: got error %v; want %q", err, DrainingMessage)
+	} else if len(got) >= len(want) {
+		t.Fatalf("Scan past the drain deadline returned all %d entries", len(got))
+	}
+	if _, _, err := d.start(ctx); !IsDraining(err) {
+		t.Errorf("Call after Drain: got error %v; want %q", err, DrainingMessage)
+	}
+
+	// The client may resume its Scan from another server after the last entry
+	// it received, as it knows the servers' store to scan in order.
+	s, _, remote = serveDrained(t, store, nil)
+	defer s.Stop()
+	defer remote.Close(ctx)
+	if err := graphstore.ScanFrom(ctx, orderedRemote{remote}, new(spb.ScanRequest), got[len(got)-1], func(e *spb.Entry) error {
+		got = append(got, e)
+		return nil
+	}); err != nil {
+		t.Fatalf("Resumed Scan: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Drained and resumed Scan returned %d entries; want the %d of a whole Scan", len(got), len(want))
+	}
+}
+
+func TestDrainStopWaits(t *testing.T) {
+	store := inmemory.Create()
+	if err := store.Write(ctx, request("node", 5)); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDrainer()
+	s, h, remote := serveDrained(t, slowStore{store, 20 * time.Millisecond}, d)
+	defer remote.Close(ctx)
+	entries, errc := drainedScan(remote)
+	<-entries
+
+	start := time.Now()
+	DrainStop(s, h, d, 0, 5*time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DrainStop took %v; want it to end with the Scan", elapsed)
+	}
+	n := 1
+	for range entries {
+		n++
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("Scan within the drain deadline: %v", err)
+	} else if n != 5 {
+		t.Errorf("Scan within the drain deadline returned %d entries; want 5", n)
+	}
+}
+
+func TestDrainStopWriteStream(t *testing.T) {
+	d := NewDrainer()
+	s, h, gs := serveDrained(t, inmemory.Create(), d)
+	defer gs.Close(ctx)
+	stream, err := gs.(*remote).client.WriteStream(ctx)
+	if err != nil {
+		t.Fatalf("WriteStream: %v", err)
+	}
+	if err := stream.Send(request("node", 1)); err != nil {
+		t.Fatalf("Send: %v", err)
+	} else if ack, err := stream.Recv(); err != nil || ack.Count != 1 {
+		t.Fatalf("Recv: got %v, %v; want an ack of 1 request", ack, err)
+	}
+
+	// The idle WriteStream is aborted once the deadline passes.
+	const deadline = 100 * time.Millisecond
+	start := time.Now()
+	DrainStop(s, h, d, 0, deadline)
+	if elapsed := time.Since(start); elapsed < deadline || elapsed > deadline+drainGrace/2 {
+		t.Errorf("DrainStop took %v with an idle WriteStream; want about %v", elapsed, deadline)
+	}
+	if _, err := stream.Recv(); !IsDraining(err) {
+		t.Errorf("Idle WriteStream past the drain deadline: got error %v; want %q", err, DrainingMessage)
+	}
+}
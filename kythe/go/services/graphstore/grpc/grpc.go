@@ -14,26 +14,345 @@
  * limitations under the License.
  */
 
-// Package grpc registers the "grpc" kind to the gsutil package.
+// Package grpc registers the "grpc", "grpcs" (TLS), and "grpc+unix" (Unix
+// domain socket) GraphStore schemes, and implements a GraphStore server.
+//
+// Clients created for the "grpc" kind propagate the graphstore.TraceParent of
+// each call's context to the remote GraphStore in the call's metadata; servers
+// can recover it using TraceContext.
 package grpc
 
 import (
+	"fmt"
+	"net/url"
+	"time"
+
 	"kythe.io/kythe/go/services/graphstore"
-	"kythe.io/kythe/go/storage/gsutil"
 
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	spb "kythe.io/kythe/proto/storage_proto"
 )
 
+// TraceParentKey is the gRPC metadata key holding the trace parent of a call.
+const TraceParentKey = "kythe-trace-parent"
+
+// DialTimeout bounds the time DialTLS waits to connect to a server and
+// complete the TLS handshake.
+const DialTimeout = 30 * time.Second
+
 func init() {
-	gsutil.Register("grpc", handler)
+	graphstore.Register("grpc", openPlaintext)
+	graphstore.Register("grpcs", openTLS)
+	graphstore.Register("grpc+unix", openUnix)
+}
+
+// openPlaintext opens a "grpc:host:port" spec, connecting without TLS.  Its
+// optional query parameters are compression, naming the Compression of its
+// messages (see CompressionDialOptions), unary_timeout and idle_timeout,
+// setting the Options of the same names (as durations, e.g. "30s"; a zero
+// duration disables the timeout), pool, the number of connections of the
+// Service's Pool (by default, 1 for a server named by its IP address and
+// otherwise DefaultPoolSize), and hedge_delay and max_hedges, which hedge the
+// Service's Reads by a Hedger with that delay and maximum (by default,
+// DefaultMaxHedges).
+func openPlaintext(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+	return openInsecure(u, false)
+}
+
+// openInsecure opens a spec without TLS, as by openPlaintext, or, if unix is
+// set, as by openUnix.
+func openInsecure(u *url.URL, unix bool) (graphstore.Service, error) {
+	q := u.Query()
+	for p := range q {
+		switch p {
+		case "compression", "unary_timeout", "idle_timeout", "pool", "hedge_delay", "max_hedges":
+		default:
+			if unix {
+				return nil, fmt.Errorf("unknown grpc+unix spec parameter %q", p)
+			}
+			return nil, fmt.Errorf("unknown grpc spec parameter %q (did you mean grpcs?)", p)
+		}
+	}
+	var opts Options
+	if err := specTimeouts(q, &opts); err != nil {
+		return nil, err
+	}
+	hedger, err := specHedger(q)
+	if err != nil {
+		return nil, err
+	}
+	opts.Hedger = hedger
+	dialOpts, err := CompressionDialOptions(q.Get("compression"), 0)
+	if err != nil {
+		return nil, err
+	}
+	loc := *u
+	loc.RawQuery = ""
+	addr := graphstore.SpecLocation(&loc)
+	size, err := specPoolSize(addr, q.Get("pool"))
+	if err != nil {
+		return nil, err
+	}
+	if unix {
+		if q.Get("pool") == "" {
+			size = 1
+		}
+		dialOpts = append(dialOpts, grpc.WithDialer(dialUnix))
+	}
+	p, err := DialPool(size, func() (*grpc.ClientConn, error) {
+		return grpc.Dial(addr, append([]grpc.DialOption{
+			grpc.WithInsecure(),
+			grpc.WithUnaryInterceptor(traceUnary),
+			grpc.WithStreamInterceptor(traceStream),
+		}, dialOpts...)...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewPoolService(p, &opts), nil
+}
+
+// openTLS opens a "grpcs:host:port" spec, connecting with TLS as configured by
+// the spec's optional query parameters: ca (the file of the trusted CA
+// bundle), cert and key (the files of the client's certificate, for mutual
+// TLS), server_name (the name expected in the server's certificate),
+// token_file (a file whose first line is the bearer token attached to each
+// call; see TokenFromFile), and compression, unary_timeout, idle_timeout, pool,
+// hedge_delay, and max_hedges (as for a "grpc" spec).
+func openTLS(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+	q := u.Query()
+	opts := &TLSOptions{
+		CAFile:     q.Get("ca"),
+		CertFile:   q.Get("cert"),
+		KeyFile:    q.Get("key"),
+		ServerName: q.Get("server_name"),
+	}
+	for p := range q {
+		switch p {
+		case "ca", "cert", "key", "server_name", "token_file", "compression", "unary_timeout", "idle_timeout", "pool", "hedge_delay", "max_hedges":
+		default:
+			return nil, fmt.Errorf("unknown grpcs spec parameter %q", p)
+		}
+	}
+	var svcOpts Options
+	if err := specTimeouts(q, &svcOpts); err != nil {
+		return nil, err
+	}
+	hedger, err := specHedger(q)
+	if err != nil {
+		return nil, err
+	}
+	svcOpts.Hedger = hedger
+	loc := *u
+	loc.RawQuery = ""
+	dialOpts, err := CompressionDialOptions(q.Get("compression"), 0)
+	if err != nil {
+		return nil, err
+	}
+	if file := q.Get("token_file"); file != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(TokenCredentials(TokenFromFile(file))))
+	}
+	addr := graphstore.SpecLocation(&loc)
+	size, err := specPoolSize(addr, q.Get("pool"))
+	if err != nil {
+		return nil, err
+	}
+	p, err := DialPool(size, func() (*grpc.ClientConn, error) {
+		return DialTLS(addr, opts, dialOpts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewPoolService(p, &svcOpts), nil
 }
 
-func handler(spec string) (graphstore.Service, error) {
-	conn, err := grpc.Dial(spec)
+// DialTLS connects to the GraphStore server at addr with TLS, as configured by
+// opts, and waits for the handshake, so that a failure is reported with its
+// cause.  Each call's graphstore.TraceParent is propagated to the server.  The
+// dialOpts are passed on to grpc.Dial, e.g. to attach TokenCredentials.
+func DialTLS(addr string, opts *TLSOptions, dialOpts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	creds, err := ClientCredentials(opts)
 	if err != nil {
 		return nil, err
 	}
-	return graphstore.GRPC(spb.NewGraphStoreClient(conn)), nil
+	conn, err := grpc.Dial(addr, append([]grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithBlock(), grpc.WithTimeout(DialTimeout),
+		grpc.WithUnaryInterceptor(traceUnary),
+		grpc.WithStreamInterceptor(traceStream),
+	}, dialOpts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %v", addr, err)
+	}
+	return conn, nil
+}
+
+// NewService returns a graphstore.Service backed by the GraphStore server at
+// the other end of conn, as from NewServiceWithOptions with the default
+// options.
+func NewService(conn *grpc.ClientConn) graphstore.Service {
+	return NewServiceWithOptions(conn, nil)
+}
+
+// NewServiceWithOptions returns a graphstore.Service backed by the GraphStore
+// server at the other end of conn.  The Service is a graphstore.HealthChecker
+// reporting the server's health as by the standard gRPC health service, if the
+// server implements it, or else by a trial read.
+//
+// Reads and Scans receive their entries ahead of the EntryFunc, up to a bounded
+// window, and end the call as soon as the EntryFunc returns an error or io.EOF.
+// Reads are hedged by opts.Hedger, if it is set.
+//
+// Unless opts.UnaryWrites is set, Writes are pipelined over a WriteStream: a
+// Write returns once its request is sent, and a request that the server fails
+// to apply is reported, as part of a *PipelineError, by a later Write or by
+// the Service's Flush or Close methods.  Reads and Scans first wait for the
+// writes in flight to be acknowledged.  If the server does not implement
+// WriteStream, the Service falls back to unary Writes.  A call the server
+// refuses with codes.PermissionDenied fails with a *PermissionError (see
+// IsPermissionDenied).  If opts is nil, the defaults are used.
+func NewServiceWithOptions(conn *grpc.ClientConn, opts *Options) graphstore.Service {
+	return newRemote(spb.NewGraphStoreClient(conn), healthpb.NewHealthClient(conn), opts)
+}
+
+func newRemote(client spb.GraphStoreClient, health healthpb.HealthClient, opts *Options) *remote {
+	if opts == nil {
+		opts = new(Options)
+	}
+	r := &remote{
+		client:       client,
+		health:       health,
+		window:       DefaultReceiveWindow,
+		maxSize:      DefaultMaxMessageBytes,
+		unaryTimeout: DefaultUnaryTimeout,
+		idleTimeout:  DefaultIdleTimeout,
+		hedger:       opts.Hedger,
+	}
+	if opts.ReceiveWindow != 0 {
+		r.window = opts.ReceiveWindow
+	}
+	if opts.MaxMessageBytes != 0 {
+		r.maxSize = opts.MaxMessageBytes
+	}
+	if opts.UnaryTimeout != 0 {
+		r.unaryTimeout = opts.UnaryTimeout
+	}
+	if opts.IdleTimeout != 0 {
+		r.idleTimeout = opts.IdleTimeout
+	}
+	r.Service = unaryTimeout{graphstore.GRPC(client), r.unaryTimeout}
+	if !opts.UnaryWrites {
+		r.writer = newStreamWriter(client, r.Service, opts)
+	}
+	return r
+}
+
+type remote struct {
+	graphstore.Service // for unary Writes and trial reads
+	client             spb.GraphStoreClient
+	health             healthpb.HealthClient
+	writer             *streamWriter // nil if writes are unary
+	pool               *Pool         // closed with the remote, if non-nil
+	hedger             *Hedger       // nil if Reads are not hedged
+
+	window       int           // see Options.ReceiveWindow
+	maxSize      int           // see Options.MaxMessageBytes
+	unaryTimeout time.Duration // see Options.UnaryTimeout
+	idleTimeout  time.Duration // see Options.IdleTimeout
+}
+
+// Write implements part of the graphstore.Service interface.
+func (r *remote) Write(ctx context.Context, req *spb.WriteRequest) error {
+	if r.writer == nil {
+		return deadlineError(permissionError(WriteMethod, r.Service.Write(ctx, req)))
+	}
+	return deadlineError(r.writer.Write(ctx, req))
+}
+
+// Flush waits for every pipelined Write to be acknowledged by the server and
+// returns the *PipelineError of those that failed, if any.
+func (r *remote) Flush(ctx context.Context) error {
+	if r.writer == nil {
+		return nil
+	}
+	return deadlineError(r.writer.Flush(ctx))
+}
+
+// Close implements part of the graphstore.Service interface.
+func (r *remote) Close(ctx context.Context) error {
+	var err error
+	if r.writer != nil {
+		err = r.writer.Close(ctx)
+	}
+	if cerr := r.Service.Close(ctx); err == nil {
+		err = cerr
+	}
+	if r.pool != nil {
+		if cerr := r.pool.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// wait blocks until the pipelined Writes in flight, if any, are acknowledged,
+// so that reads observe them.
+func (r *remote) wait(ctx context.Context) error {
+	if r.writer == nil {
+		return nil
+	}
+	return r.writer.wait(ctx)
+}
+
+// CheckHealth implements the graphstore.HealthChecker interface.
+func (r *remote) CheckHealth(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, r.unaryTimeout)
+	defer cancel()
+	resp, err := r.health.Check(ctx, &healthpb.HealthCheckRequest{})
+	if grpc.Code(err) == codes.Unimplemented {
+		return graphstore.TrialRead(ctx, r.Service)
+	} else if grpc.Code(err) == codes.DeadlineExceeded {
+		return ErrDeadline
+	} else if err != nil {
+		return fmt.Errorf("health check failed: %v", err)
+	} else if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("server is %v", resp.Status)
+	}
+	return nil
+}
+
+// outgoingTraceParent adds the graphstore.TraceParent of ctx, if any, to its
+// outgoing metadata.
+func outgoingTraceParent(ctx context.Context) context.Context {
+	parent := graphstore.TraceParent(ctx)
+	if parent == "" {
+		return ctx
+	}
+	md, _ := metadata.FromContext(ctx)
+	return metadata.NewContext(ctx, metadata.Join(md, metadata.Pairs(TraceParentKey, parent)))
+}
+
+func traceUnary(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(outgoingTraceParent(ctx), method, req, reply, cc, opts...)
+}
+
+func traceStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(outgoingTraceParent(ctx), desc, cc, method, opts...)
+}
+
+// TraceContext returns a copy of the server-side context ctx carrying the
+// trace parent sent by the remote client as its graphstore.TraceParent.  If the
+// client sent no trace parent, ctx is returned unchanged.
+func TraceContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromContext(ctx)
+	if !ok || len(md[TraceParentKey]) == 0 {
+		return ctx
+	}
+	return graphstore.WithTraceParent(ctx, md[TraceParentKey][0])
 }
@@ -0,0 +1,361 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/inmemory"
+	gstest "kythe.io/kythe/go/test/services/graphstore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+var ctx = context.Background()
+
+// serve starts a gRPC server for srv on a local port and returns a connection
+// to it, and a function to stop them both.
+func serve(t testing.TB, srv spb.GraphStoreServer) (*grpc.ClientConn, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := grpc.NewServer()
+	spb.RegisterGraphStoreServer(s, srv)
+	go s.Serve(l)
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		s.Stop()
+		t.Fatalf("Dial: %v", err)
+	}
+	return conn, func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func request(sig string, n int) *spb.WriteRequest {
+	req := &spb.WriteRequest{Source: &spb.VName{Signature: sig}}
+	for i := 0; i < n; i++ {
+		req.Update = append(req.Update, &spb.WriteRequest_Update{
+			FactName:  fmt.Sprintf("/fact/%d", i),
+			FactValue: []byte(sig),
+		})
+	}
+	return req
+}
+
+func countEntries(t *testing.T, gs graphstore.Service, sig string) int {
+	var n int
+	if err := gs.Read(ctx, &spb.ReadRequest{Source: &spb.VName{Signature: sig}}, func(*spb.Entry) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return n
+}
+
+func TestWriteStreamOrder(t *testing.T) {
+	gstest.OrderTest(t, func() (gstest.Service, gstest.DestroyFunc, error) {
+		conn, stop := serve(t, NewServer(inmemory.Create(), &ServerOptions{AckEvery: 3}))
+		gs := NewServiceWithOptions(conn, &Options{MaxInFlightRequests: 8, MaxInFlightBytes: 1024})
+		return gs, func() error { stop(); return nil }, nil
+	}, 4)
+}
+
+var errBad = errors.New("bad source")
+
+// failingStore is a graphstore.Service whose Writes of the "bad" source fail.
+type failingStore struct{ graphstore.Service }
+
+func (s failingStore) Write(ctx context.Context, req *spb.WriteRequest) error {
+	if req.Source.Signature == "bad" {
+		return errBad
+	}
+	return s.Service.Write(ctx, req)
+}
+
+func TestWriteStreamFailures(t *testing.T) {
+	conn, stop := serve(t, NewServer(failingStore{inmemory.Create()}, nil))
+	defer stop()
+	gs := NewService(conn)
+	defer gs.Close(ctx)
+
+	for _, sig := range []string{"a", "bad", "b"} {
+		if err := gs.Write(ctx, request(sig, 2)); err != nil {
+			t.Fatalf("Write(%q): %v", sig, err)
+		}
+	}
+	err := gs.(*remote).Flush(ctx)
+	perr, ok := err.(*PipelineError)
+	if !ok {
+		t.Fatalf("Flush: got error %v, want a *PipelineError", err)
+	}
+	if len(perr.Failures) != 1 {
+		t.Fatalf("Failures: got %+v, want 1", perr.Failures)
+	}
+	if f := perr.Failures[0]; f.Request.Source.Signature != "bad" || len(f.Request.Update) != 2 || f.Err.Error() != errBad.Error() {
+		t.Errorf("Failure: got {%v %v}, want {bad %v}", f.Request, f.Err, errBad)
+	}
+	if err := gs.(*remote).Flush(ctx); err != nil {
+		t.Errorf("Flush: failures were reported twice: %v", err)
+	}
+
+	if err := gs.Write(ctx, request("c", 1)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	for sig, want := range map[string]int{"a": 2, "bad": 0, "b": 2, "c": 1} {
+		if n := countEntries(t, gs, sig); n != want {
+			t.Errorf("Read(%q) found %d entries; want %d", sig, n, want)
+		}
+	}
+
+	// A failure not yet flushed is reported by the next Write.
+	if err := gs.Write(ctx, request("bad", 1)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	gs.(*remote).writer.wait(ctx)
+	if err := gs.Write(ctx, request("d", 1)); err == nil {
+		t.Error("Write: expected the earlier failure to be reported")
+	}
+	if err := gs.Close(ctx); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+// oldServer is a GraphStore server that predates WriteStream.
+type oldServer struct{ spb.GraphStoreServer }
+
+func (oldServer) WriteStream(spb.GraphStore_WriteStreamServer) error {
+	return grpc.Errorf(codes.Unimplemented, "unknown method WriteStream")
+}
+
+func TestWriteStreamFallback(t *testing.T) {
+	conn, stop := serve(t, oldServer{NewServer(failingStore{inmemory.Create()}, nil)})
+	defer stop()
+	gs := NewService(conn)
+	defer gs.Close(ctx)
+
+	for i := 0; i < 10; i++ {
+		if err := gs.Write(ctx, request(fmt.Sprintf("s%d", i), 3)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := gs.(*remote).Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if !gs.(*remote).writer.fallback {
+		t.Error("Writer did not fall back to unary Writes")
+	}
+	for i := 0; i < 10; i++ {
+		if n := countEntries(t, gs, fmt.Sprintf("s%d", i)); n != 3 {
+			t.Errorf("Read found %d entries; want 3", n)
+		}
+	}
+	if err := gs.Write(ctx, request("bad", 1)); err != errBad && grpc.ErrorDesc(err) != errBad.Error() {
+		t.Errorf("Write: got error %v, want %v", err, errBad)
+	}
+}
+
+// gatedStore is a graphstore.Service whose Writes wait for proceed to be
+// closed.
+type gatedStore struct {
+	graphstore.Service
+	proceed chan struct{}
+}
+
+func (s gatedStore) Write(ctx context.Context, req *spb.WriteRequest) error {
+	<-s.proceed
+	return s.Service.Write(ctx, req)
+}
+
+func TestWriteStreamFlowControl(t *testing.T) {
+	proceed := make(chan struct{})
+	conn, stop := serve(t, NewServer(gatedStore{inmemory.Create(), proceed}, nil))
+	defer stop()
+	gs := NewServiceWithOptions(conn, &Options{MaxInFlightRequests: 2})
+	defer gs.Close(ctx)
+
+	for _, sig := range []string{"a", "b"} {
+		if err := gs.Write(ctx, request(sig, 1)); err != nil {
+			t.Fatalf("Write(%q): %v", sig, err)
+		}
+	}
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := gs.Write(timeout, request("c", 1)); err != ErrDeadline {
+		t.Errorf("Write beyond the bound: got error %v, want %v", err, ErrDeadline)
+	}
+
+	close(proceed)
+	if err := gs.Write(ctx, request("c", 1)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n := countEntries(t, gs, "c"); n != 1 {
+		t.Errorf("Read found %d entries; want 1", n)
+	}
+}
+
+func TestWriteStreamClose(t *testing.T) {
+	conn, stop := serve(t, NewServer(inmemory.Create(), nil))
+	defer stop()
+	mem := inmemory.Create()
+	gs := NewService(conn)
+	for i := 0; i < 100; i++ {
+		req := request(fmt.Sprintf("s%d", i), 2)
+		if err := gs.Write(ctx, req); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		mem.Write(ctx, req)
+	}
+	if err := gs.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := gs.Write(ctx, request("late", 1)); err != errWriterClosed {
+		t.Errorf("Write after Close: got error %v, want %v", err, errWriterClosed)
+	}
+
+	// The writes were all applied before Close returned.
+	check := NewServiceWithOptions(conn, &Options{UnaryWrites: true})
+	for i := 0; i < 100; i++ {
+		if n := countEntries(t, check, fmt.Sprintf("s%d", i)); n != 2 {
+			t.Fatalf("Read(s%d) found %d entries; want 2", i, n)
+		}
+	}
+}
+
+// benchmarkWrite measures the throughput of writing requests of 8 updates to a
+// local server over an in-memory store, until they are all acknowledged.
+func benchmarkWrite(b *testing.B, opts *Options) {
+	conn, stop := serve(b, NewServer(inmemory.Create(), nil))
+	defer stop()
+	gs := NewServiceWithOptions(conn, opts)
+	reqs := make([]*spb.WriteRequest, 1024)
+	for i := range reqs {
+		reqs[i] = request(fmt.Sprintf("node%d", i), 8)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := gs.Write(ctx, reqs[i%len(reqs)]); err != nil {
+			b.Fatalf("Write: %v", err)
+		}
+	}
+	if err := gs.Close(ctx); err != nil {
+		b.Fatalf("Close: %v", err)
+	}
+}
+
+func BenchmarkWriteUnary(b *testing.B)  { benchmarkWrite(b, &Options{UnaryWrites: true}) }
+func BenchmarkWriteStream(b *testing.B) { benchmarkWrite(b, nil) }
+
+// endlessServer is a GraphStore server whose Scans send entries of the given
+// size until the client ends the call, counting the entries sent.
+type endlessServer struct {
+	spb.GraphStoreServer
+	size    int
+	sent    int64         // atomic
+	stopped chan struct{} // closed once a Scan returns
+}
+
+func (s *endlessServer) Scan(req *spb.ScanRequest, stream spb.GraphStore_ScanServer) error {
+	defer close(s.stopped)
+	e := &spb.Entry{
+		Source:    &spb.VName{Signature: "node"},
+		FactName:  "/fact",
+		FactValue: make([]byte, s.size),
+	}
+	for {
+		if err := stream.Send(e); err != nil {
+			return err
+		}
+		atomic.AddInt64(&s.sent, 1)
+	}
+}
+
+func TestScanStopsServer(t *testing.T) {
+	for _, window := range []int{-1, 0, 16} {
+		srv := &endlessServer{size: 16, stopped: make(chan struct{})}
+		conn, stop := serve(t, srv)
+		gs := NewServiceWithOptions(conn, &Options{ReceiveWindow: window})
+
+		var n int
+		if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+			n++
+			return io.EOF
+		}); err != nil {
+			t.Errorf("Scan (window %d): %v", window, err)
+		}
+		if n != 1 {
+			t.Errorf("Scan (window %d) passed %d entries after io.EOF; want 1", window, n)
+		}
+		select {
+		case <-srv.stopped:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Server Scan (window %d) still running after the client stopped; sent %d entries", window, atomic.LoadInt64(&srv.sent))
+		}
+		stop()
+	}
+}
+
+func TestScanWindow(t *testing.T) {
+	srv := &endlessServer{size: 1024, stopped: make(chan struct{})}
+	conn, stop := serve(t, srv)
+	defer stop()
+	gs := NewServiceWithOptions(conn, &Options{ReceiveWindow: 16})
+
+	// With the EntryFunc stalled, the server may only get as far ahead as the
+	// receive window and the transport's flow control allow.
+	errStop := errors.New("stop")
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		time.Sleep(200 * time.Millisecond)
+		return errStop
+	}); err != errStop {
+		t.Errorf("Scan: got error %v, want %v", err, errStop)
+	}
+	if sent := atomic.LoadInt64(&srv.sent); sent > 1000 {
+		t.Errorf("Server sent %d entries to a stalled client", sent)
+	}
+	<-srv.stopped
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	srv := &endlessServer{size: 1024, stopped: make(chan struct{})}
+	conn, stop := serve(t, srv)
+	defer stop()
+	gs := NewServiceWithOptions(conn, &Options{MaxMessageBytes: 512})
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		t.Error("Oversized entry was passed to the EntryFunc")
+		return nil
+	}); err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Errorf("Scan: got error %v, want an oversized entry error", err)
+	}
+	<-srv.stopped
+}
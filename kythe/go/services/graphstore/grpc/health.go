@@ -0,0 +1,112 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// GraphStoreServiceName is the name of the GraphStore service, by which its
+// health may be checked.
+const GraphStoreServiceName = "kythe.proto.GraphStore"
+
+// DefaultHealthCheckTimeout bounds each check of a HealthServer's backend.
+const DefaultHealthCheckTimeout = 5 * time.Second
+
+// A HealthServer, to be registered with a gRPC server by
+// healthpb.RegisterHealthServer, serves the standard gRPC health service for a
+// GraphStore server: the server (named "") and its GraphStore service (named
+// GraphStoreServiceName) are SERVING as long as their backend is healthy, as by
+// graphstore.CheckHealth, until the HealthServer is shut down.
+type HealthServer struct {
+	gs      graphstore.Service
+	timeout time.Duration
+
+	mu       sync.Mutex // guards the fields below
+	last     healthpb.HealthCheckResponse_ServingStatus
+	shutdown bool
+}
+
+// NewHealthServer returns a HealthServer reporting the health of gs.  Each
+// check of gs is bounded by timeout (or, if 0, DefaultHealthCheckTimeout) and
+// by the deadline of the call.
+func NewHealthServer(gs graphstore.Service, timeout time.Duration) *HealthServer {
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	return &HealthServer{gs: gs, timeout: timeout, last: healthpb.HealthCheckResponse_SERVING}
+}
+
+// Check implements the healthpb.HealthServer interface.
+func (h *HealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if req.Service != "" && req.Service != GraphStoreServiceName {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service %q", req.Service)
+	}
+	h.mu.Lock()
+	shutdown := h.shutdown
+	h.mu.Unlock()
+	if shutdown {
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	status := healthpb.HealthCheckResponse_SERVING
+	err := graphstore.CheckHealth(ctx, h.gs)
+	if err != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	} else if status != h.last {
+		if err != nil {
+			log.Printf("GraphStore server is unhealthy: %v", err)
+		} else {
+			log.Print("GraphStore server is healthy again")
+		}
+		h.last = status
+	}
+	return &healthpb.HealthCheckResponse{Status: status}, nil
+}
+
+// Shutdown causes h to report NOT_SERVING from then on, whatever the health of
+// its backend.
+func (h *HealthServer) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shutdown = true
+}
+
+// GracefulStop shuts down h, so that the load balancers checking it stop
+// sending calls to s, waits for drain, and then stops s gracefully, closing its
+// listeners and waiting for its calls in progress to end (see also DrainStop).
+func GracefulStop(s *grpc.Server, h *HealthServer, drain time.Duration) {
+	DrainStop(s, h, nil, drain, 0)
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/inmemory"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// flakyStore is a graphstore.HealthChecker whose health is set by the test.
+type flakyStore struct {
+	graphstore.Service
+
+	mu  sync.Mutex
+	err error
+}
+
+func (s *flakyStore) setHealth(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *flakyStore) CheckHealth(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// serveHealth starts a gRPC server for gs, with a HealthServer, and returns
+// them and a connection to the server.
+func serveHealth(t *testing.T, gs graphstore.Service) (*grpc.Server, *HealthServer, *grpc.ClientConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := grpc.NewServer()
+	h := NewHealthServer(gs, 0)
+	spb.RegisterGraphStoreServer(s, NewServer(gs, nil))
+	healthpb.RegisterHealthServer(s, h)
+	go s.Serve(l)
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		s.Stop()
+		t.Fatalf("Dial: %v", err)
+	}
+	return s, h, conn
+}
+
+func checkStatus(t *testing.T, client healthpb.HealthClient, want healthpb.HealthCheckResponse_ServingStatus) {
+	for _, service := range []string{"", GraphStoreServiceName} {
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Errorf("Check(%q): %v", service, err)
+		} else if resp.Status != want {
+			t.Errorf("Check(%q): got %v; want %v", service, resp.Status, want)
+		}
+	}
+}
+
+func TestHealthServer(t *testing.T) {
+	gs := &flakyStore{Service: inmemory.Create()}
+	s, _, conn := serveHealth(t, gs)
+	defer s.Stop()
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	remote := NewService(conn)
+
+	checkStatus(t, client, healthpb.HealthCheckResponse_SERVING)
+	if err := graphstore.CheckHealth(ctx, remote); err != nil {
+		t.Errorf("CheckHealth of a healthy server: %v", err)
+	}
+
+	gs.setHealth(errors.New("disk full"))
+	checkStatus(t, client, healthpb.HealthCheckResponse_NOT_SERVING)
+	if err := graphstore.CheckHealth(ctx, remote); err == nil || !strings.Contains(err.Error(), "NOT_SERVING") {
+		t.Errorf("CheckHealth of an unhealthy server: got error %v; want NOT_SERVING", err)
+	}
+
+	gs.setHealth(nil)
+	checkStatus(t, client, healthpb.HealthCheckResponse_SERVING)
+
+	if _, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "kythe.proto.Other"}); grpc.Code(err) != codes.NotFound {
+		t.Errorf("Check of an unknown service: got error %v; want codes.NotFound", err)
+	}
+}
+
+func TestGracefulStop(t *testing.T) {
+	s, h, conn := serveHealth(t, inmemory.Create())
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	checkStatus(t, client, healthpb.HealthCheckResponse_SERVING)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		GracefulStop(s, h, 200*time.Millisecond)
+	}()
+
+	// The server reports NOT_SERVING, and still serves, while it drains.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := client.Check(ctx, new(healthpb.HealthCheckRequest))
+		if err != nil {
+			t.Fatalf("Check while draining: %v", err)
+		} else if resp.Status == healthpb.HealthCheckResponse_NOT_SERVING {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Server still SERVING after GracefulStop began")
+		}
+	}
+	select {
+	case <-stopped:
+		t.Fatal("Server stopped before it reported NOT_SERVING")
+	default:
+	}
+	remote := NewService(conn)
+	if err := remote.Write(ctx, request("node", 1)); err != nil {
+		t.Errorf("Write while draining: %v", err)
+	}
+	if err := remote.Close(ctx); err != nil {
+		t.Errorf("Close while draining: %v", err)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("GracefulStop did not return")
+	}
+}
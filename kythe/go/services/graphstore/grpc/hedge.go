@@ -0,0 +1,233 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// DefaultMaxHedges is the default bound on the outstanding hedges of a
+// Hedger.
+const DefaultMaxHedges = 4
+
+// A Hedger hedges the Reads of remote GraphStores (see Options): a Read to
+// which the server has responded neither with an entry nor with its end within
+// the Hedger's delay is issued again (on a Pool, by the next connection), the
+// first of the two calls to respond is used, and the other is cancelled.
+// Scans and Writes are never hedged.  So that hedging cannot double the load on
+// a server already too slow to respond, no Read is hedged while the Hedger's
+// maximum number of hedges are outstanding.  A Hedger may be shared by several
+// Services, and implements expvar.Var, reporting its HedgeStats.
+type Hedger struct {
+	delay time.Duration
+	max   int
+
+	mu    sync.Mutex // guards stats
+	stats HedgeStats
+}
+
+// HedgeStats are the counts of the hedges of a Hedger.
+type HedgeStats struct {
+	Issued      int64 `json:"issued"`      // hedges issued
+	Won         int64 `json:"won"`         // hedges that responded first
+	Refused     int64 `json:"refused"`     // hedges not issued for want of budget
+	Outstanding int   `json:"outstanding"` // hedges still in progress
+}
+
+// NewHedger returns a Hedger that hedges each Read once delay has passed, with
+// at most max hedges (or, if 0, DefaultMaxHedges) outstanding at once.
+func NewHedger(delay time.Duration, max int) *Hedger {
+	if max <= 0 {
+		max = DefaultMaxHedges
+	}
+	return &Hedger{delay: delay, max: max}
+}
+
+// Stats returns the current counts of the hedges of h.
+func (h *Hedger) Stats() HedgeStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+// String implements the expvar.Var interface by returning the HedgeStats of h
+// encoded as JSON.
+func (h *Hedger) String() string {
+	rec, err := json.Marshal(h.Stats())
+	if err != nil {
+		return "{}"
+	}
+	return string(rec)
+}
+
+// acquire reports whether a hedge may be issued, counting it as outstanding
+// until release is called if so.
+func (h *Hedger) acquire() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stats.Outstanding >= h.max {
+		h.stats.Refused++
+		return false
+	}
+	h.stats.Issued++
+	h.stats.Outstanding++
+	return true
+}
+
+func (h *Hedger) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stats.Outstanding--
+}
+
+func (h *Hedger) win() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stats.Won++
+}
+
+// specHedger returns the Hedger of a spec with the given optional hedge_delay
+// and max_hedges query parameters, or nil if it has neither.
+func specHedger(q url.Values) (*Hedger, error) {
+	delay, max := q.Get("hedge_delay"), q.Get("max_hedges")
+	if delay == "" {
+		if max != "" {
+			return nil, fmt.Errorf("max_hedges spec parameter requires hedge_delay")
+		}
+		return nil, nil
+	}
+	d, err := time.ParseDuration(delay)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid hedge_delay spec parameter %q", delay)
+	}
+	n := 0
+	if max != "" {
+		if n, err = strconv.Atoi(max); err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid max_hedges spec parameter %q", max)
+		}
+	}
+	return NewHedger(d, n), nil
+}
+
+// A readAttempt is one of the calls of a hedged Read.
+type readAttempt struct {
+	s      spb.GraphStore_ReadClient
+	cancel context.CancelFunc // cancels the call, releasing its hedge if any
+
+	first *spb.Entry // the first entry of the call, if any
+	err   error      // the error of the call or its first entry; io.EOF if it had none
+}
+
+// next returns a function returning the entries of a in turn.
+func (a *readAttempt) next(r *remote) func() (*spb.Entry, error) {
+	started := false
+	return func() (*spb.Entry, error) {
+		if !started {
+			started = true
+			return a.first, a.err
+		}
+		return r.recv(a.s)
+	}
+}
+
+// hedgedRead begins a Read of req hedged by r.hedger, returning the function
+// returning the entries of the call that responded first, and the function
+// cancelling it.  If every call fails before responding, the first error is
+// returned.
+func (r *remote) hedgedRead(ctx context.Context, req *spb.ReadRequest) (func() (*spb.Entry, error), context.CancelFunc, error) {
+	h := r.hedger
+	responses := make(chan *readAttempt, 2)
+	start := func(hedge bool) *readAttempt {
+		ctx, cancel := context.WithCancel(ctx)
+		a := &readAttempt{cancel: cancel}
+		if hedge {
+			var once sync.Once
+			a.cancel = func() {
+				cancel()
+				once.Do(h.release)
+			}
+		}
+		go func() {
+			s, err := r.client.Read(ctx, req)
+			if err == nil {
+				a.s = s
+				a.first, a.err = r.recv(s)
+			} else {
+				a.err = err
+			}
+			responses <- a
+		}()
+		return a
+	}
+
+	attempts := []*readAttempt{start(false)}
+	hedge := time.NewTimer(h.delay)
+	defer hedge.Stop()
+	var idle <-chan time.Time
+	if r.idleTimeout > 0 {
+		t := time.NewTimer(r.idleTimeout)
+		defer t.Stop()
+		idle = t.C
+	}
+
+	var failed *readAttempt
+	for pending := 1; pending > 0; {
+		select {
+		case <-hedge.C:
+			if h.acquire() {
+				attempts = append(attempts, start(true))
+				pending++
+			}
+		case <-idle:
+			for _, a := range attempts {
+				a.cancel()
+			}
+			return nil, nil, ErrIdleTimeout
+		case a := <-responses:
+			pending--
+			if a.err != nil && a.err != io.EOF {
+				if failed == nil {
+					failed = a
+				}
+				continue
+			}
+			for _, b := range attempts {
+				if b != a {
+					b.cancel()
+				}
+			}
+			if a != attempts[0] {
+				h.win() // and released once the Read is done with it
+			}
+			return a.next(r), a.cancel, nil
+		}
+	}
+	for _, a := range attempts {
+		a.cancel()
+	}
+	return nil, nil, failed.err
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/inmemory"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// slowReadServer is a GraphStore server whose Reads for which slow returns
+// true, given their indices, and all of whose Writes respond only after delay.
+// It counts its Reads and Writes, and the Reads cancelled while delayed.
+type slowReadServer struct {
+	spb.GraphStoreServer
+	delay time.Duration
+	slow  func(int) bool
+
+	mu        sync.Mutex
+	reads     int
+	writes    int
+	cancelled int
+}
+
+func (s *slowReadServer) Read(req *spb.ReadRequest, stream spb.GraphStore_ReadServer) error {
+	s.mu.Lock()
+	i := s.reads
+	s.reads++
+	s.mu.Unlock()
+	if s.slow(i) {
+		select {
+		case <-time.After(s.delay):
+		case <-stream.Context().Done():
+			s.mu.Lock()
+			s.cancelled++
+			s.mu.Unlock()
+			return stream.Context().Err()
+		}
+	}
+	return s.GraphStoreServer.Read(req, stream)
+}
+
+func (s *slowReadServer) Write(ctx context.Context, req *spb.WriteRequest) (*spb.WriteReply, error) {
+	s.mu.Lock()
+	s.writes++
+	s.mu.Unlock()
+	time.Sleep(s.delay)
+	return s.GraphStoreServer.Write(ctx, req)
+}
+
+// counts returns the numbers of the Reads, Writes, and cancelled Reads of s.
+func (s *slowReadServer) counts() (reads, writes, cancelled int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads, s.writes, s.cancelled
+}
+
+// serveHedged starts a slowReadServer of a store holding the entries of req
+// and returns it with a client hedged by h.
+func serveHedged(t *testing.T, req *spb.WriteRequest, delay time.Duration, slow func(int) bool, h *Hedger) (*slowReadServer, graphstore.Service, func()) {
+	store := inmemory.Create()
+	if err := store.Write(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	srv := &slowReadServer{GraphStoreServer: NewServer(store, nil), delay: delay, slow: slow}
+	conn, stop := serve(t, srv)
+	return srv, NewServiceWithOptions(conn, &Options{UnaryWrites: true, Hedger: h}), stop
+}
+
+func readAll(t *testing.T, gs graphstore.Service, source *spb.VName) []*spb.Entry {
+	var entries []*spb.Entry
+	if err := gs.Read(ctx, &spb.ReadRequest{Source: source}, func(e *spb.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return entries
+}
+
+func TestHedgedRead(t *testing.T) {
+	req := request("node", 3)
+	h := NewHedger(20*time.Millisecond, 1)
+	srv, gs, stop := serveHedged(t, req, 10*time.Second, func(i int) bool { return i == 0 }, h)
+	defer stop()
+
+	start := time.Now()
+	got := readAll(t, gs, req.Source)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Hedged Read took %v; want the hedge to respond first", elapsed)
+	}
+	local := inmemory.Create()
+	if err := local.Write(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if want := readAll(t, local, req.Source); !reflect.DeepEqual(got, want) {
+		t.Errorf("Hedged Read returned %v; want %v", got, want)
+	}
+	if stats, want := h.Stats(), (HedgeStats{Issued: 1, Won: 1}); stats != want {
+		t.Errorf("Stats: got %+v; want %+v", stats, want)
+	}
+
+	// The slow Read lost, and was cancelled.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if reads, _, cancelled := srv.counts(); reads == 2 && cancelled == 1 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Server saw %d Reads, %d of them cancelled; want 2, and the slow one cancelled", reads, cancelled)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A prompt Read is not hedged.
+	readAll(t, gs, req.Source)
+	if stats := h.Stats(); stats.Issued != 1 {
+		t.Errorf("Stats after a prompt Read: got %+v; want no further hedge", stats)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	req := request("node", 1)
+	h := NewHedger(20*time.Millisecond, 1)
+	srv, gs, stop := serveHedged(t, req, 300*time.Millisecond, func(int) bool { return true }, h)
+	defer stop()
+
+	// Of three Reads of an overloaded server, only one is hedged.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readAll(t, gs, req.Source)
+		}()
+	}
+	wg.Wait()
+	if stats, want := h.Stats(), (HedgeStats{Issued: 1, Refused: 2}); stats.Issued != want.Issued || stats.Refused != want.Refused || stats.Outstanding != 0 {
+		t.Errorf("Stats: got %+v; want %+v", stats, want)
+	}
+	if reads, _, _ := srv.counts(); reads != 4 {
+		t.Errorf("Server saw %d Reads; want 4", reads)
+	}
+}
+
+func TestHedgedReadIdleTimeout(t *testing.T) {
+	h := NewHedger(10*time.Millisecond, 1)
+	srv := &slowReadServer{GraphStoreServer: NewServer(inmemory.Create(), nil), delay: 10 * time.Second, slow: func(int) bool { return true }}
+	conn, stop := serve(t, srv)
+	defer stop()
+	gs := NewServiceWithOptions(conn, &Options{Hedger: h, IdleTimeout: 100 * time.Millisecond})
+	if err := gs.Read(ctx, &spb.ReadRequest{Source: &spb.VName{Signature: "node"}}, func(*spb.Entry) error { return nil }); err != ErrIdleTimeout {
+		t.Errorf("Read: got error %v; want %v", err, ErrIdleTimeout)
+	}
+	if stats, want := h.Stats(), (HedgeStats{Issued: 1}); stats != want {
+		t.Errorf("Stats: got %+v; want %+v", stats, want)
+	}
+}
+
+func TestHedgeNeverWrites(t *testing.T) {
+	h := NewHedger(time.Millisecond, 1)
+	srv, gs, stop := serveHedged(t, request("node", 1), 100*time.Millisecond, func(int) bool { return false }, h)
+	defer stop()
+	if err := gs.Write(ctx, request("other", 1)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, writes, _ := srv.counts(); writes != 1 {
+		t.Errorf("Server saw %d Writes; want 1", writes)
+	}
+	if stats := h.Stats(); stats != (HedgeStats{}) {
+		t.Errorf("Stats after a slow Write: got %+v; want no hedges", stats)
+	}
+}
+
+func TestSpecHedger(t *testing.T) {
+	tests := []struct {
+		query string
+		want  *Hedger
+	}{
+		{"", nil},
+		{"hedge_delay=20ms", &Hedger{delay: 20 * time.Millisecond, max: DefaultMaxHedges}},
+		{"hedge_delay=1s&max_hedges=2", &Hedger{delay: time.Second, max: 2}},
+	}
+	for _, test := range tests {
+		q, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h, err := specHedger(q); err != nil {
+			t.Errorf("specHedger(%q): %v", test.query, err)
+		} else if !reflect.DeepEqual(h, test.want) {
+			t.Errorf("specHedger(%q): got %+v; want %+v", test.query, h, test.want)
+		}
+	}
+
+	for _, query := range []string{
+		"max_hedges=2",
+		"hedge_delay=soon",
+		"hedge_delay=0",
+		"hedge_delay=1s&max_hedges=0",
+	} {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h, err := specHedger(q); err == nil {
+			t.Errorf("specHedger(%q): got %+v; want an error", query, h)
+		}
+	}
+}
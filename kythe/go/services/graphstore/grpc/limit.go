@@ -0,0 +1,357 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// RetryAfterKey is the gRPC trailer key of the number of seconds after which a
+// call refused by a Limiter may be retried.
+const RetryAfterKey = "retry-after"
+
+// streamRetryAfter is the retry-after hint of a call refused for exceeding a
+// limit on concurrent streams, whose end cannot be foreseen.
+const streamRetryAfter = time.Second
+
+// Limits bound the streaming calls (Reads, Scans, and WriteStreams) of a
+// GraphStore server, in total and per peer, a peer being identified by the
+// bearer token of its calls, if any, and otherwise by its IP address.  A zero
+// field is unlimited.
+type Limits struct {
+	// MaxStreams bounds the number of concurrent streaming calls.
+	MaxStreams        int `json:"max_streams,omitempty"`
+	MaxStreamsPerPeer int `json:"max_streams_per_peer,omitempty"`
+
+	// EntriesPerSecond bounds the rate at which the entries of Reads and Scans
+	// are sent, allowing bursts of a second's worth.  A stream is slowed to
+	// the rate; a new stream is refused while the rate is exhausted.
+	EntriesPerSecond        float64 `json:"entries_per_second,omitempty"`
+	EntriesPerSecondPerPeer float64 `json:"entries_per_second_per_peer,omitempty"`
+}
+
+// LoadLimits returns the Limits of a JSON file, e.g.
+//   {"max_streams_per_peer": 4, "entries_per_second_per_peer": 100000}
+func LoadLimits(file string) (Limits, error) {
+	var l Limits
+	f, err := os.Open(file)
+	if err != nil {
+		return l, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&l); err != nil {
+		return l, fmt.Errorf("invalid limits file %q: %v", file, err)
+	}
+	return l, nil
+}
+
+// A Limiter enforces Limits on the calls of a GraphStore server (see
+// ServerOptions).  A call exceeding them is refused with
+// codes.ResourceExhausted and a RetryAfterKey trailer.  A Limiter implements
+// expvar.Var, reporting its limits and its current usage per peer.
+type Limiter struct {
+	mu      sync.Mutex // guards the fields below
+	limits  Limits
+	streams int
+	rate    bucket
+	peers   map[string]*peerUsage
+}
+
+// NewLimiter returns a Limiter enforcing limits.
+func NewLimiter(limits Limits) *Limiter {
+	l := &Limiter{peers: make(map[string]*peerUsage)}
+	l.SetLimits(limits)
+	return l
+}
+
+// SetLimits replaces the limits of l.  The calls in progress are unaffected,
+// but for the rate of their entries.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	now := time.Now()
+	l.rate.setRate(limits.EntriesPerSecond, now)
+	for _, p := range l.peers {
+		p.rate.setRate(limits.EntriesPerSecondPerPeer, now)
+	}
+}
+
+// Limits returns the current limits of l.
+func (l *Limiter) Limits() Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits
+}
+
+// A PeerUsage is the current usage of a GraphStore server by a peer.
+type PeerUsage struct {
+	Streams  int   `json:"streams"`  // the peer's streaming calls in progress
+	Entries  int64 `json:"entries"`  // entries sent to the peer
+	Refused  int64 `json:"refused"`  // calls of the peer refused
+	Throttle int64 `json:"throttle"` // times the peer's streams were slowed
+}
+
+// Usage returns the current usage of each peer with a streaming call in
+// progress or a rate yet to recover.
+func (l *Limiter) Usage() map[string]PeerUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(time.Now())
+	usage := make(map[string]PeerUsage, len(l.peers))
+	for key, p := range l.peers {
+		usage[key] = p.PeerUsage
+	}
+	return usage
+}
+
+// String implements the expvar.Var interface by returning the limits and
+// usage of l encoded as JSON.
+func (l *Limiter) String() string {
+	usage := l.Usage()
+	l.mu.Lock()
+	v := struct {
+		Limits  Limits               `json:"limits"`
+		Streams int                  `json:"streams"`
+		Peers   map[string]PeerUsage `json:"peers"`
+	}{l.limits, l.streams, usage}
+	l.mu.Unlock()
+	rec, err := json.Marshal(v)
+	if err != nil {
+		return "{}"
+	}
+	return string(rec)
+}
+
+// prune forgets the peers without streams whose rates have recovered.  l.mu
+// must be held.
+func (l *Limiter) prune(now time.Time) {
+	for key, p := range l.peers {
+		if p.Streams == 0 && p.rate.full(now) {
+			delete(l.peers, key)
+		}
+	}
+}
+
+type peerUsage struct {
+	PeerUsage
+	rate bucket
+}
+
+// A bucket is a token bucket, holding up to a second's worth of its rate of
+// tokens.  A bucket of rate 0 is unlimited.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) setRate(rate float64, now time.Time) {
+	b.refill(now)
+	if b.rate == 0 || b.tokens > rate {
+		b.tokens = rate
+	}
+	b.rate = rate
+}
+
+func (b *bucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+func (b *bucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.rate == 0 || b.tokens >= b.rate
+}
+
+// wait returns the time until b holds a token, refilling it first.
+func (b *bucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.rate == 0 || b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// peerKey returns the identity of the peer of a call with the given context:
+// a hash of the bearer token of the call, if any, and otherwise the IP address
+// of the peer.
+func peerKey(ctx context.Context) string {
+	md, _ := metadata.FromContext(ctx)
+	if len(md[authorizationKey]) > 0 {
+		return "token:" + tokenHash(strings.TrimPrefix(md[authorizationKey][0], "Bearer "))
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return "unknown"
+}
+
+// tokenHash returns a short hash of a bearer token, identifying it without
+// revealing it.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+// A limitError refuses a call that exceeds a limit.
+type limitError struct {
+	msg        string
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string { return e.msg }
+
+// trailer returns the trailer reporting e's retry-after hint, in whole seconds
+// (rounded up).
+func (e *limitError) trailer() metadata.MD {
+	secs := int64(math.Ceil(e.retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return metadata.Pairs(RetryAfterKey, strconv.FormatInt(secs, 10))
+}
+
+// refuse returns the ResourceExhausted status of err, a *limitError, after
+// setting its retry-after trailer on stream.
+func refuse(stream grpc.ServerStream, err error) error {
+	le := err.(*limitError)
+	stream.SetTrailer(le.trailer())
+	return grpc.Errorf(codes.ResourceExhausted, "%s; retry after %v", le.msg, le.retryAfter)
+}
+
+// A limitedCall is a streaming call admitted by a Limiter.
+type limitedCall struct {
+	l *Limiter
+	p *peerUsage
+}
+
+// start admits a new streaming call of the given method and peer context, or
+// refuses it with a *limitError.  An admitted call must be ended.  A nil
+// Limiter admits every call.
+func (l *Limiter) start(ctx context.Context, method string) (*limitedCall, error) {
+	if l == nil {
+		return nil, nil
+	}
+	key := peerKey(ctx)
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+	p := l.peers[key]
+	if p == nil {
+		p = new(peerUsage)
+		p.rate.setRate(l.limits.EntriesPerSecondPerPeer, now)
+		l.peers[key] = p
+	}
+	var err *limitError
+	switch {
+	case l.limits.MaxStreams > 0 && l.streams >= l.limits.MaxStreams:
+		err = &limitError{fmt.Sprintf("%s: the server's %d concurrent streams are in use", method, l.limits.MaxStreams), streamRetryAfter}
+	case l.limits.MaxStreamsPerPeer > 0 && p.Streams >= l.limits.MaxStreamsPerPeer:
+		err = &limitError{fmt.Sprintf("%s: peer %s is using its %d concurrent streams", method, key, l.limits.MaxStreamsPerPeer), streamRetryAfter}
+	default:
+		if d := l.rate.wait(now); d > 0 {
+			err = &limitError{fmt.Sprintf("%s: the server's rate of %v entries/s is exhausted", method, l.limits.EntriesPerSecond), d}
+		} else if d := p.rate.wait(now); d > 0 {
+			err = &limitError{fmt.Sprintf("%s: peer %s's rate of %v entries/s is exhausted", method, key, l.limits.EntriesPerSecondPerPeer), d}
+		}
+	}
+	if err != nil {
+		p.Refused++
+		return nil, err
+	}
+	l.streams++
+	p.Streams++
+	return &limitedCall{l, p}, nil
+}
+
+// end ends c.  It is a no-op for the nil limitedCall of a nil Limiter.
+func (c *limitedCall) end() {
+	if c == nil {
+		return
+	}
+	c.l.mu.Lock()
+	defer c.l.mu.Unlock()
+	c.l.streams--
+	c.p.Streams--
+}
+
+// pace waits until an entry may be sent on c within the rates of its Limiter,
+// or until ctx is done, and counts the entry.
+func (c *limitedCall) pace(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	var throttled bool
+	for {
+		c.l.mu.Lock()
+		now := time.Now()
+		d := c.l.rate.wait(now)
+		if pd := c.p.rate.wait(now); pd > d {
+			d = pd
+		}
+		if d == 0 {
+			if c.l.rate.rate > 0 {
+				c.l.rate.tokens--
+			}
+			if c.p.rate.rate > 0 {
+				c.p.rate.tokens--
+			}
+			c.p.Entries++
+			if throttled {
+				c.p.Throttle++
+			}
+			c.l.mu.Unlock()
+			return nil
+		}
+		c.l.mu.Unlock()
+
+		throttled = true
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
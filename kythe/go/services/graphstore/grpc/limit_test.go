@@ -0,0 +1,205 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/inmemory"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// gatedScanStore is a graphstore.Service whose Scans signal started and then
+// block until gate is closed.
+type gatedScanStore struct {
+	graphstore.Service
+	started chan struct{}
+	gate    chan struct{}
+}
+
+func (s gatedScanStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	s.started <- struct{}{}
+	select {
+	case <-s.gate:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// peerContext returns a context of the calls of the peer with the given
+// bearer token.
+func peerContext(token string) context.Context {
+	return metadata.NewContext(ctx, metadata.Pairs(authorizationKey, "Bearer "+token))
+}
+
+// startScan starts a Scan of client, returning its stream.
+func startScan(t *testing.T, client spb.GraphStoreClient, ctx context.Context) spb.GraphStore_ScanClient {
+	s, err := client.Scan(ctx, new(spb.ScanRequest))
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	return s
+}
+
+// checkRefused checks that the Scan s was refused with a retry-after hint.
+func checkRefused(t *testing.T, desc string, s spb.GraphStore_ScanClient) {
+	_, err := s.Recv()
+	if grpc.Code(err) != codes.ResourceExhausted {
+		t.Errorf("%s: got error %v; want codes.ResourceExhausted", desc, err)
+	} else if got := s.Trailer()[RetryAfterKey]; len(got) != 1 || got[0] == "" {
+		t.Errorf("%s: got %s trailer %q; want a retry-after hint", desc, RetryAfterKey, got)
+	}
+}
+
+func TestLimitStreams(t *testing.T) {
+	store := gatedScanStore{inmemory.Create(), make(chan struct{}, 8), make(chan struct{})}
+	l := NewLimiter(Limits{MaxStreams: 3, MaxStreamsPerPeer: 2})
+	conn, stop := serve(t, NewServer(store, &ServerOptions{Limiter: l}))
+	defer stop()
+	client := spb.NewGraphStoreClient(conn)
+
+	for i := 0; i < 2; i++ {
+		startScan(t, client, peerContext("a"))
+		<-store.started
+	}
+	checkRefused(t, "Scan beyond the peer's limit", startScan(t, client, peerContext("a")))
+
+	startScan(t, client, peerContext("b"))
+	<-store.started
+	checkRefused(t, "Scan beyond the server's limit", startScan(t, client, peerContext("b")))
+
+	want := map[string]PeerUsage{
+		"token:" + tokenHash("a"): {Streams: 2, Refused: 1},
+		"token:" + tokenHash("b"): {Streams: 1, Refused: 1},
+	}
+	if usage := l.Usage(); !reflect.DeepEqual(usage, want) {
+		t.Errorf("Usage: got %+v; want %+v", usage, want)
+	}
+	var vars map[string]interface{}
+	if err := json.Unmarshal([]byte(l.String()), &vars); err != nil || vars["streams"] != float64(3) {
+		t.Errorf("String: got %s (%v); want JSON of 3 streams", l.String(), err)
+	}
+
+	// Raising the limits admits more streams; ending streams frees theirs.
+	l.SetLimits(Limits{MaxStreams: 4, MaxStreamsPerPeer: 2})
+	startScan(t, client, peerContext("b"))
+	<-store.started
+	close(store.gate)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(l.Usage()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if usage := l.Usage(); len(usage) > 0 {
+		t.Errorf("Usage after the streams ended: %v", usage)
+	}
+}
+
+func TestLimitThroughput(t *testing.T) {
+	const (
+		entries = 150
+		rate    = 200 // per second, per peer, with a burst of a second's worth
+	)
+	gs := inmemory.Create()
+	for i := 0; i < entries; i++ {
+		if err := gs.Write(ctx, request(fmt.Sprint(i), 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := NewLimiter(Limits{EntriesPerSecondPerPeer: rate})
+	conn, stop := serve(t, NewServer(gs, &ServerOptions{Limiter: l}))
+	defer stop()
+	client := spb.NewGraphStoreClient(conn)
+	scan := func(ctx context.Context) (int, error) {
+		s, err := client.Scan(ctx, new(spb.ScanRequest))
+		if err != nil {
+			return 0, err
+		}
+		var n int
+		for {
+			if _, err := s.Recv(); err == io.EOF {
+				return n, nil
+			} else if err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+
+	// The first Scan takes most of the burst.
+	if n, err := scan(peerContext("a")); err != nil || n != entries {
+		t.Fatalf("Scan: got %d entries, %v; want %d", n, err, entries)
+	}
+	// The second is slowed to the rate once the burst is taken, by at least
+	// (2*entries-rate)/rate seconds.
+	start := time.Now()
+	if n, err := scan(peerContext("a")); err != nil || n != entries {
+		t.Fatalf("Scan: got %d entries, %v; want %d", n, err, entries)
+	}
+	if elapsed, min := time.Since(start), time.Duration(2*entries-rate)*time.Second/rate; elapsed < min*4/5 {
+		t.Errorf("Scan beyond the rate took %v; want at least %v", elapsed, min)
+	}
+	// The rate is now exhausted, so a new Scan is refused, but another peer's
+	// is not.
+	checkRefused(t, "Scan beyond the rate", startScan(t, client, peerContext("a")))
+	if n, err := scan(peerContext("b")); err != nil || n != entries {
+		t.Errorf("Scan by another peer: got %d entries, %v; want %d", n, err, entries)
+	}
+	if u := l.Usage()["token:"+tokenHash("a")]; u.Entries != 2*entries || u.Throttle == 0 || u.Refused != 1 {
+		t.Errorf("Usage of the throttled peer: %+v", u)
+	}
+}
+
+func TestLoadLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "limits.json")
+
+	if err := ioutil.WriteFile(file, []byte(`{"max_streams_per_peer": 4, "entries_per_second": 1e6}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := LoadLimits(file); err != nil {
+		t.Errorf("LoadLimits: %v", err)
+	} else if want := (Limits{MaxStreamsPerPeer: 4, EntriesPerSecond: 1e6}); l != want {
+		t.Errorf("LoadLimits: got %+v; want %+v", l, want)
+	}
+
+	if err := ioutil.WriteFile(file, []byte(`{"max_stream": 4}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := LoadLimits(file); err == nil {
+		t.Errorf("LoadLimits of an unknown limit: got %+v; want an error", l)
+	}
+}
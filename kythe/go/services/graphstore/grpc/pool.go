@@ -0,0 +1,374 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// DefaultPoolSize is the number of the connections of a Pool opened by a
+// "grpc" or "grpcs" spec naming its server by a DNS name, rather than an IP
+// address, which may resolve to the servers behind a load balancer.
+const DefaultPoolSize = 4
+
+// errPoolClosed is returned by the calls made once a Pool is closed.
+var errPoolClosed = errors.New("remote GraphStore pool is closed")
+
+// A Pool is a fixed number of connections to a GraphStore server, over which
+// the calls of a remote Service are spread, each call (or stream) using the
+// next connection in turn, so that concurrent calls are not limited by the
+// stream concurrency and flow control of a single HTTP/2 connection.  Each
+// connection is dialed when it is first used; once a call on a connection
+// fails with codes.Unavailable, the connection is retired, to be closed once
+// its calls end, and replaced by a new connection, dialed when next used
+// (resolving the server's name anew).  A Pool implements spb.GraphStoreClient
+// and the gRPC health service's client.
+type Pool struct {
+	dial func() (*grpc.ClientConn, error)
+	next uint32 // atomic; the index of the next connection to use
+
+	mu      sync.Mutex // guards the fields below
+	conns   []*pooledConn
+	retired int
+	closed  bool
+}
+
+// A pooledConn is a connection of a Pool.
+type pooledConn struct {
+	active, calls int64 // atomic; see ConnStats
+	retired       int32 // atomic; set once the connection is retired
+
+	mu     sync.Mutex // guards the fields below, and serializes dialing
+	conn   *grpc.ClientConn
+	client spb.GraphStoreClient
+	health healthpb.HealthClient
+	closed bool
+}
+
+// DialPool returns a Pool of size connections (at least 1), each dialed by
+// dial.  The first connection is dialed at once, so that an unreachable server
+// or a failed handshake is reported by DialPool, and the others when first
+// used.
+func DialPool(size int, dial func() (*grpc.ClientConn, error)) (*Pool, error) {
+	if size < 1 {
+		size = 1
+	}
+	p := &Pool{dial: dial, conns: make([]*pooledConn, size)}
+	for i := range p.conns {
+		p.conns[i] = new(pooledConn)
+	}
+	if err := p.conns[0].connect(dial); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// connect dials c, unless it is already connected.
+func (c *pooledConn) connect(dial func() (*grpc.ClientConn, error)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errPoolClosed
+	} else if c.conn != nil {
+		return nil
+	}
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	c.conn, c.client, c.health = conn, spb.NewGraphStoreClient(conn), healthpb.NewHealthClient(conn)
+	return nil
+}
+
+// close closes c's connection, if dialed and not already closed.
+func (c *pooledConn) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// A ConnStats describes a connection of a Pool.
+type ConnStats struct {
+	Dialed bool  // whether the connection has been dialed
+	Active int64 // the number of its calls (including open streams) in progress
+	Calls  int64 // the number of its calls started
+}
+
+// A PoolStats describes the connections of a Pool.
+type PoolStats struct {
+	Conns   []ConnStats // in the order they are used
+	Retired int         // the number of connections retired as broken
+}
+
+// Stats returns the current statistics of p.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := PoolStats{Retired: p.retired}
+	for _, c := range p.conns {
+		c.mu.Lock()
+		dialed := c.conn != nil
+		c.mu.Unlock()
+		stats.Conns = append(stats.Conns, ConnStats{
+			Dialed: dialed,
+			Active: atomic.LoadInt64(&c.active),
+			Calls:  atomic.LoadInt64(&c.calls),
+		})
+	}
+	return stats
+}
+
+// Close closes the connections of p, ending their calls in progress.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	var err error
+	for _, c := range p.conns {
+		if cerr := c.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// start returns the connection for the next call, dialing it if needed, and
+// counts the call among its active calls.  The call's pooledCall must be ended.
+func (p *Pool) start() (*pooledCall, error) {
+	i := int((atomic.AddUint32(&p.next, 1) - 1) % uint32(len(p.conns)))
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errPoolClosed
+	}
+	c := p.conns[i]
+	p.mu.Unlock()
+	if err := c.connect(p.dial); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.active, 1)
+	atomic.AddInt64(&c.calls, 1)
+	return &pooledCall{p: p, c: c}, nil
+}
+
+// retire replaces c by a new connection, if it has not already been, and
+// closes c if its calls have ended (or else the last of them closes it).
+func (p *Pool) retire(c *pooledConn) {
+	if !atomic.CompareAndSwapInt32(&c.retired, 0, 1) {
+		return
+	}
+	p.mu.Lock()
+	for i, pc := range p.conns {
+		if pc == c && !p.closed {
+			p.conns[i] = new(pooledConn)
+			p.retired++
+		}
+	}
+	p.mu.Unlock()
+	if atomic.LoadInt64(&c.active) == 0 {
+		c.close()
+	}
+}
+
+// A pooledCall is a call in progress on a connection of a Pool.
+type pooledCall struct {
+	p    *Pool
+	c    *pooledConn
+	once sync.Once
+}
+
+// end ends the call, which failed with err (if non-nil), retiring its
+// connection if err shows it to be broken.  Only the first call of end has an
+// effect.
+func (pc *pooledCall) end(err error) {
+	pc.once.Do(func() {
+		active := atomic.AddInt64(&pc.c.active, -1)
+		if grpc.Code(err) == codes.Unavailable {
+			pc.p.retire(pc.c)
+		}
+		if active == 0 && atomic.LoadInt32(&pc.c.retired) != 0 {
+			pc.c.close()
+		}
+	})
+}
+
+// recvd ends the call of a stream once a receive fails with err, and returns
+// err.
+func (pc *pooledCall) recvd(err error) error {
+	if err != nil {
+		pc.end(err)
+	}
+	return err
+}
+
+// watch ends the call of a stream once ctx is done.
+func (pc *pooledCall) watch(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		pc.end(nil)
+	}()
+}
+
+// Read implements part of the spb.GraphStoreClient interface.
+func (p *Pool) Read(ctx context.Context, req *spb.ReadRequest, opts ...grpc.CallOption) (spb.GraphStore_ReadClient, error) {
+	pc, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	s, err := pc.c.client.Read(ctx, req, opts...)
+	if err != nil {
+		pc.end(err)
+		return nil, err
+	}
+	pc.watch(ctx)
+	return entryStream{s, pc}, nil
+}
+
+// Scan implements part of the spb.GraphStoreClient interface.
+func (p *Pool) Scan(ctx context.Context, req *spb.ScanRequest, opts ...grpc.CallOption) (spb.GraphStore_ScanClient, error) {
+	pc, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	s, err := pc.c.client.Scan(ctx, req, opts...)
+	if err != nil {
+		pc.end(err)
+		return nil, err
+	}
+	pc.watch(ctx)
+	return entryStream{s, pc}, nil
+}
+
+// Write implements part of the spb.GraphStoreClient interface.
+func (p *Pool) Write(ctx context.Context, req *spb.WriteRequest, opts ...grpc.CallOption) (*spb.WriteReply, error) {
+	pc, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := pc.c.client.Write(ctx, req, opts...)
+	pc.end(err)
+	return reply, err
+}
+
+// WriteStream implements part of the spb.GraphStoreClient interface.
+func (p *Pool) WriteStream(ctx context.Context, opts ...grpc.CallOption) (spb.GraphStore_WriteStreamClient, error) {
+	pc, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	s, err := pc.c.client.WriteStream(ctx, opts...)
+	if err != nil {
+		pc.end(err)
+		return nil, err
+	}
+	pc.watch(ctx)
+	return writeStream{s, pc}, nil
+}
+
+// Check implements the healthpb.HealthClient interface.
+func (p *Pool) Check(ctx context.Context, req *healthpb.HealthCheckRequest, opts ...grpc.CallOption) (*healthpb.HealthCheckResponse, error) {
+	pc, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := pc.c.health.Check(ctx, req, opts...)
+	pc.end(err)
+	return resp, err
+}
+
+// entryStream is the stream of a Read or Scan on a connection of a Pool.
+type entryStream struct {
+	spb.GraphStore_ReadClient // or GraphStore_ScanClient, alike
+	pc                        *pooledCall
+}
+
+func (s entryStream) RecvMsg(m interface{}) error {
+	return s.pc.recvd(s.GraphStore_ReadClient.RecvMsg(m))
+}
+
+func (s entryStream) Recv() (*spb.Entry, error) {
+	e, err := s.GraphStore_ReadClient.Recv()
+	return e, s.pc.recvd(err)
+}
+
+// writeStream is a WriteStream on a connection of a Pool.
+type writeStream struct {
+	spb.GraphStore_WriteStreamClient
+	pc *pooledCall
+}
+
+func (s writeStream) RecvMsg(m interface{}) error {
+	return s.pc.recvd(s.GraphStore_WriteStreamClient.RecvMsg(m))
+}
+
+func (s writeStream) Recv() (*spb.WriteAck, error) {
+	ack, err := s.GraphStore_WriteStreamClient.Recv()
+	return ack, s.pc.recvd(err)
+}
+
+// NewPoolService returns a graphstore.Service backed by the GraphStore server
+// at the other end of the connections of p, as by NewServiceWithOptions, whose
+// calls are spread over those connections.  Closing the Service closes p.
+func NewPoolService(p *Pool, opts *Options) graphstore.Service {
+	r := newRemote(p, p, opts)
+	r.pool = p
+	return r
+}
+
+// specPoolSize returns the size of the Pool of a spec with the given address
+// and optional pool query parameter.
+func specPoolSize(addr, size string) (int, error) {
+	if size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid pool spec parameter %q", size)
+		}
+		return n, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if net.ParseIP(host) != nil {
+		return 1, nil
+	}
+	return DefaultPoolSize, nil
+}
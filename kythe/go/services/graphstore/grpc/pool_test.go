@@ -0,0 +1,251 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/storage/inmemory"
+	gstest "kythe.io/kythe/go/test/services/graphstore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// servePool starts a gRPC server for srv on a local port and returns a Pool of
+// size connections to it, the number of connections dialed so far, and a
+// function to stop them both.
+func servePool(t testing.TB, srv spb.GraphStoreServer, size int) (*Pool, *int32, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := grpc.NewServer()
+	spb.RegisterGraphStoreServer(s, srv)
+	go s.Serve(l)
+	var dials int32
+	p, err := DialPool(size, func() (*grpc.ClientConn, error) {
+		atomic.AddInt32(&dials, 1)
+		return grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	})
+	if err != nil {
+		s.Stop()
+		t.Fatalf("DialPool: %v", err)
+	}
+	return p, &dials, func() {
+		p.Close()
+		s.Stop()
+	}
+}
+
+// poolSettles waits for the calls of p to end, and returns its stats.
+func poolSettles(p *Pool) PoolStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := p.Stats()
+		var active int64
+		for _, c := range stats.Conns {
+			active += c.Active
+		}
+		if active == 0 || time.Now().After(deadline) {
+			return stats
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolOrder(t *testing.T) {
+	gstest.OrderTest(t, func() (gstest.Service, gstest.DestroyFunc, error) {
+		p, _, stop := servePool(t, NewServer(inmemory.Create(), nil), 3)
+		return NewPoolService(p, nil), func() error { stop(); return nil }, nil
+	}, 4)
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	p, dials, stop := servePool(t, NewServer(inmemory.Create(), nil), 3)
+	defer stop()
+	if n := atomic.LoadInt32(dials); n != 1 {
+		t.Errorf("DialPool dialed %d connections; want 1", n)
+	}
+	gs := NewPoolService(p, &Options{UnaryWrites: true})
+
+	for i := 0; i < 6; i++ {
+		if i%2 == 0 {
+			if err := gs.Write(ctx, request("node", 1)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		} else {
+			countEntries(t, gs, "node")
+		}
+	}
+	stats := poolSettles(p)
+	for i, c := range stats.Conns {
+		if want := (ConnStats{Dialed: true, Calls: 2}); c != want {
+			t.Errorf("Connection %d: got %+v; want %+v", i, c, want)
+		}
+	}
+	if n := atomic.LoadInt32(dials); n != 3 {
+		t.Errorf("Pool dialed %d connections; want 3", n)
+	}
+}
+
+func TestPoolActiveStreams(t *testing.T) {
+	p, _, stop := servePool(t, newStallingServer(1, 0, true), 2)
+	defer stop()
+	gs := NewPoolService(p, &Options{IdleTimeout: -1})
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	started := make(chan struct{}, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+				started <- struct{}{}
+				return nil
+			})
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-started
+	}
+	for i, c := range p.Stats().Conns {
+		if c.Active != 2 {
+			t.Errorf("Connection %d has %d active streams; want 2", i, c.Active)
+		}
+	}
+	cancel()
+	wg.Wait()
+	for i, c := range poolSettles(p).Conns {
+		if c.Active != 0 {
+			t.Errorf("Connection %d has %d active streams after they ended; want 0", i, c.Active)
+		}
+	}
+}
+
+// unavailableServer is a GraphStoreServer whose Writes fail as if its
+// connection were broken.
+type unavailableServer struct{ spb.GraphStoreServer }
+
+func (unavailableServer) Write(context.Context, *spb.WriteRequest) (*spb.WriteReply, error) {
+	return nil, grpc.Errorf(codes.Unavailable, "connection broken")
+}
+
+func TestPoolRetiresBrokenConns(t *testing.T) {
+	p, dials, stop := servePool(t, unavailableServer{}, 1)
+	defer stop()
+	gs := NewPoolService(p, &Options{UnaryWrites: true})
+
+	for i := 1; i <= 3; i++ {
+		if err := gs.Write(ctx, request("node", 1)); grpc.Code(err) != codes.Unavailable {
+			t.Errorf("Write: got error %v; want codes.Unavailable", err)
+		}
+		if stats := p.Stats(); stats.Retired != i {
+			t.Errorf("Pool retired %d connections; want %d", stats.Retired, i)
+		}
+		// Each retired connection is replaced by a new one.
+		if n := atomic.LoadInt32(dials); n != int32(i) {
+			t.Errorf("Pool dialed %d connections; want %d", n, i)
+		}
+	}
+
+	if err := gs.Close(ctx); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if err := gs.Write(ctx, request("node", 1)); err != errPoolClosed {
+		t.Errorf("Write after Close: got error %v; want %v", err, errPoolClosed)
+	}
+}
+
+func TestSpecPoolSize(t *testing.T) {
+	tests := []struct {
+		addr, size string
+		want       int
+	}{
+		{"127.0.0.1:9999", "", 1},
+		{"[::1]:9999", "", 1},
+		{"graphstore.example.com:9999", "", DefaultPoolSize},
+		{"localhost:9999", "8", 8},
+		{"127.0.0.1:9999", "2", 2},
+	}
+	for _, test := range tests {
+		if got, err := specPoolSize(test.addr, test.size); err != nil || got != test.want {
+			t.Errorf("specPoolSize(%q, %q): got %d, %v; want %d", test.addr, test.size, got, err, test.want)
+		}
+	}
+	for _, size := range []string{"0", "-1", "many"} {
+		if got, err := specPoolSize("localhost:9999", size); err == nil {
+			t.Errorf("specPoolSize(%q): got %d; want an error", size, got)
+		}
+	}
+}
+
+// BenchmarkReadParallel compares the throughput of 64 concurrent Reads of
+// 32KiB nodes over Pools of different sizes.
+func BenchmarkReadParallel(b *testing.B) {
+	const nodes = 256
+	gs := inmemory.Create()
+	for i := 0; i < nodes; i++ {
+		req := &spb.WriteRequest{Source: &spb.VName{Signature: fmt.Sprint(i)}}
+		for j := 0; j < 8; j++ {
+			req.Update = append(req.Update, &spb.WriteRequest_Update{
+				FactName:  fmt.Sprintf("/fact/%d", j),
+				FactValue: make([]byte, 4096),
+			})
+		}
+		if err := gs.Write(ctx, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+	parallelism := 64 / runtime.GOMAXPROCS(0)
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	for _, size := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("conns=%d", size), func(b *testing.B) {
+			p, _, stop := servePool(b, NewServer(gs, nil), size)
+			defer stop()
+			remote := NewPoolService(p, nil)
+
+			b.SetBytes(8 * 4096)
+			b.SetParallelism(parallelism)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for pb.Next() {
+					req := &spb.ReadRequest{Source: &spb.VName{Signature: fmt.Sprint(rng.Intn(nodes))}}
+					if err := remote.Read(ctx, req, func(*spb.Entry) error { return nil }); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
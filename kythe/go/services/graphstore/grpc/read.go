@@ -0,0 +1,176 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"fmt"
+	"io"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Read implements part of the graphstore.Service interface.  The Read is
+// hedged if the remote has a Hedger.
+func (r *remote) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	if err := r.wait(ctx); err != nil {
+		return deadlineError(err)
+	}
+	var next func() (*spb.Entry, error)
+	var cancel context.CancelFunc
+	if r.hedger != nil {
+		var err error
+		next, cancel, err = r.hedgedRead(ctx, req)
+		if err != nil {
+			return deadlineError(permissionError(ReadMethod, err))
+		}
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+		s, err := r.client.Read(ctx, req)
+		if err != nil {
+			cancel()
+			return deadlineError(permissionError(ReadMethod, err))
+		}
+		next = func() (*spb.Entry, error) { return r.recv(s) }
+	}
+	defer cancel() // stops the server once f is done with the stream
+	return deadlineError(permissionError(ReadMethod, r.receive(next, cancel, f)))
+}
+
+// Scan implements part of the graphstore.Service interface.  The server's
+// ScanStats are recorded if ctx carries them (see WithScanStats).
+func (r *remote) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	if err := r.wait(ctx); err != nil {
+		return deadlineError(err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the server once f is done with the stream
+	s, err := r.client.Scan(ctx, req)
+	if err != nil {
+		return deadlineError(permissionError(ScanMethod, err))
+	}
+	err = r.receive(func() (*spb.Entry, error) { return r.recv(s) }, cancel, f)
+	recordScanStats(ctx, s.Trailer())
+	return deadlineError(permissionError(ScanMethod, err))
+}
+
+// receive passes each entry of a stream, as returned by next, to f, receiving
+// up to r.window entries ahead of f.  If the server sends no entry for
+// r.idleTimeout, receive calls cancel, which must cancel the context of the
+// stream, and returns ErrIdleTimeout.  The caller must cancel the context of
+// the stream once receive returns.
+func (r *remote) receive(next func() (*spb.Entry, error), cancel context.CancelFunc, f graphstore.EntryFunc) error {
+	recv := next
+	if r.idleTimeout > 0 {
+		w := newWatchdog(r.idleTimeout, cancel)
+		defer w.stop()
+		recv = func() (*spb.Entry, error) {
+			w.start()
+			e, err := next()
+			if !w.stop() {
+				return nil, ErrIdleTimeout
+			}
+			return e, err
+		}
+	}
+
+	if r.window < 0 {
+		for {
+			e, err := recv()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := f(e); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	entries := make(chan *spb.Entry, r.window)
+	errc := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(entries)
+		for {
+			e, err := recv()
+			if err != nil {
+				if err != io.EOF {
+					errc <- err
+				}
+				return
+			}
+			select {
+			case entries <- e:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for e := range entries {
+		if err := f(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	select {
+	case err := <-errc:
+		return err
+	default:
+		return nil
+	}
+}
+
+// recv receives the next entry of s, checking its size.
+func (r *remote) recv(s grpc.ClientStream) (*spb.Entry, error) {
+	e := &boundedEntry{max: r.maxSize}
+	if err := s.RecvMsg(e); e.tooLarge > 0 {
+		return nil, fmt.Errorf("received entry of %d bytes exceeds the maximum of %d", e.tooLarge, r.maxSize)
+	} else if err != nil {
+		return nil, err
+	}
+	return &e.Entry, nil
+}
+
+// boundedEntry is an spb.Entry that refuses to decode from more than max
+// bytes, if max > 0.  A refused encoding is recorded rather than reported as a
+// decoding error, since gRPC would then close the stream without resetting it,
+// leaving the server blocked in its sends; recv instead returns an error, for
+// which the caller cancels the call.
+type boundedEntry struct {
+	spb.Entry
+	max      int
+	tooLarge int // the size of the refused encoding, if any
+}
+
+func (e *boundedEntry) Unmarshal(data []byte) error {
+	if e.max > 0 && len(data) > e.max {
+		e.tooLarge = len(data)
+		return nil
+	}
+	return e.Entry.Unmarshal(data)
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// gRPC metadata keys of a Scan.  A client's ScanOpts sends the original
+// ScanRequest (as a binary protobuf) and its graphstore.ScanOptions (as JSON)
+// in the call's metadata, and its ScanFiltered sends its graphstore.ScanFilter
+// (as JSON); the server reports the call's ScanStats (as decimal integers) in
+// its trailer.
+const (
+	ScanRequestKey  = "kythe-scan-request-bin"
+	ScanOptionsKey  = "kythe-scan-options-bin"
+	ScanFilterKey   = "kythe-scan-filter-bin"
+	ScanExaminedKey = "kythe-scan-examined"
+	ScanReturnedKey = "kythe-scan-returned"
+)
+
+// ScanStats reports the selectivity of a remote Scan: the number of entries
+// the server examined, and the number of those matching the request that it
+// returned.
+type ScanStats struct {
+	Examined, Returned int64
+}
+
+type scanStatsKey struct{}
+
+// WithScanStats returns a copy of ctx in which each remote Scan records the
+// ScanStats reported by the server in stats.  A server not reporting its
+// ScanStats, or a Scan ended early by its EntryFunc, leaves stats unchanged.
+func WithScanStats(ctx context.Context, stats *ScanStats) context.Context {
+	return context.WithValue(ctx, scanStatsKey{}, stats)
+}
+
+// recordScanStats records the ScanStats in trailer, if any, in those of ctx.
+func recordScanStats(ctx context.Context, trailer metadata.MD) {
+	stats, ok := ctx.Value(scanStatsKey{}).(*ScanStats)
+	if !ok || len(trailer[ScanExaminedKey]) == 0 || len(trailer[ScanReturnedKey]) == 0 {
+		return
+	}
+	examined, err := strconv.ParseInt(trailer[ScanExaminedKey][0], 10, 64)
+	if err != nil {
+		return
+	}
+	returned, err := strconv.ParseInt(trailer[ScanReturnedKey][0], 10, 64)
+	if err != nil {
+		return
+	}
+	*stats = ScanStats{Examined: examined, Returned: returned}
+}
+
+// ScanOpts implements the graphstore.OptionsScanner interface.  The server is
+// sent the request it would be by graphstore.ScanWithOptions, along with req
+// and opts, by which it matches the entries itself; the entries of a server
+// ignoring them are matched by the client, as by ScanWithOptions.
+func (r *remote) ScanOpts(ctx context.Context, req *spb.ScanRequest, opts *graphstore.ScanOptions, f graphstore.EntryFunc) error {
+	if opts == nil {
+		return r.Scan(ctx, req, f)
+	}
+	ctx, err := outgoingScanOptions(ctx, req, opts, nil)
+	if err != nil {
+		return err
+	}
+	scan := &spb.ScanRequest{
+		Target:     req.Target,
+		EdgeKind:   req.EdgeKind,
+		FactPrefix: req.FactPrefix,
+	}
+	if opts.PartialTarget || opts.PrefixTarget {
+		scan.Target = nil
+	}
+	return r.Scan(ctx, scan, func(e *spb.Entry) error {
+		if !graphstore.EntryMatchesScanOpts(req, opts, e) {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+// ScanFiltered implements the graphstore.FilterScanner interface.  The server
+// is sent m's filter, by which it matches the entries itself, along with req
+// narrowed as by graphstore.ScanMatching; the entries of a server ignoring the
+// filter are matched by the client.
+func (r *remote) ScanFiltered(ctx context.Context, req *spb.ScanRequest, m *graphstore.FactMatcher, f graphstore.EntryFunc) error {
+	ctx, err := outgoingScanOptions(ctx, req, nil, m.Filter())
+	if err != nil {
+		return err
+	}
+	return r.Scan(ctx, m.NarrowScan(req), func(e *spb.Entry) error {
+		if !m.Matches(e.FactName) {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+// outgoingScanOptions adds req and opts, if opts is non-nil, and filter, if
+// non-nil, to the outgoing metadata of ctx.
+func outgoingScanOptions(ctx context.Context, req *spb.ScanRequest, opts *graphstore.ScanOptions, filter *graphstore.ScanFilter) (context.Context, error) {
+	var pairs metadata.MD
+	if opts != nil {
+		encReq, err := proto.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		encOpts, err := json.Marshal(opts)
+		if err != nil {
+			return nil, err
+		}
+		pairs = metadata.Pairs(ScanRequestKey, string(encReq), ScanOptionsKey, string(encOpts))
+	}
+	if filter != nil {
+		encFilter, err := json.Marshal(filter)
+		if err != nil {
+			return nil, err
+		}
+		pairs = metadata.Join(pairs, metadata.Pairs(ScanFilterKey, string(encFilter)))
+	}
+	md, _ := metadata.FromContext(ctx)
+	return metadata.NewContext(ctx, metadata.Join(md, pairs)), nil
+}
+
+// incomingScanOptions returns the ScanRequest and ScanOptions sent by the
+// client of a Scan in its metadata, or req and nil options if it sent none,
+// along with the compiled ScanFilter it sent, if any.  An invalid filter is
+// refused as an invalid argument.
+func incomingScanOptions(ctx context.Context, req *spb.ScanRequest) (*spb.ScanRequest, *graphstore.ScanOptions, *graphstore.FactMatcher, error) {
+	md, _ := metadata.FromContext(ctx)
+	var m *graphstore.FactMatcher
+	if len(md[ScanFilterKey]) > 0 {
+		filter := new(graphstore.ScanFilter)
+		if err := json.Unmarshal([]byte(md[ScanFilterKey][0]), filter); err != nil {
+			return nil, nil, nil, grpc.Errorf(codes.InvalidArgument, "invalid %s metadata: %v", ScanFilterKey, err)
+		}
+		var err error
+		if m, err = graphstore.CompileScanFilter(filter); err != nil {
+			return nil, nil, nil, grpc.Errorf(codes.InvalidArgument, "invalid %s metadata: %v", ScanFilterKey, err)
+		}
+	}
+	if len(md[ScanRequestKey]) == 0 || len(md[ScanOptionsKey]) == 0 {
+		return req, nil, m, nil
+	}
+	orig := new(spb.ScanRequest)
+	if err := proto.Unmarshal([]byte(md[ScanRequestKey][0]), orig); err != nil {
+		return nil, nil, nil, grpc.Errorf(codes.InvalidArgument, "invalid %s metadata: %v", ScanRequestKey, err)
+	}
+	opts := new(graphstore.ScanOptions)
+	if err := json.Unmarshal([]byte(md[ScanOptionsKey][0]), opts); err != nil {
+		return nil, nil, nil, grpc.Errorf(codes.InvalidArgument, "invalid %s metadata: %v", ScanOptionsKey, err)
+	}
+	return orig, opts, m, nil
+}
+
+// scanStatsTrailer returns the trailer reporting the given ScanStats.
+func scanStatsTrailer(stats ScanStats) metadata.MD {
+	return metadata.Pairs(
+		ScanExaminedKey, strconv.FormatInt(stats.Examined, 10),
+		ScanReturnedKey, strconv.FormatInt(stats.Returned, 10))
+}
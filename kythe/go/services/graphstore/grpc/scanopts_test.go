@@ -0,0 +1,209 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"reflect"
+	"testing"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// unfilteredStore is a graphstore.Service whose Scans ignore their requests,
+// delivering all its entries.
+type unfilteredStore struct {
+	graphstore.Service
+	entries []*spb.Entry
+}
+
+func (s unfilteredStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	for _, e := range s.entries {
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// oldScanServer is a GraphStoreServer whose Scans ignore the ScanOptions
+// metadata and report no ScanStats, as a server predating them.
+type oldScanServer struct {
+	spb.GraphStoreServer
+	gs graphstore.Service
+}
+
+func (s oldScanServer) Scan(req *spb.ScanRequest, stream spb.GraphStore_ScanServer) error {
+	return s.gs.Scan(stream.Context(), req, stream.Send)
+}
+
+var scanEntries = []*spb.Entry{
+	{Source: &spb.VName{Signature: "a"}, FactName: "/kind", FactValue: []byte("anchor")},
+	{Source: &spb.VName{Signature: "a"}, EdgeKind: "/ref", Target: &spb.VName{Corpus: "x", Path: "src/foo/a.go"}, FactName: "/"},
+	{Source: &spb.VName{Signature: "a"}, EdgeKind: "/ref", Target: &spb.VName{Corpus: "x", Path: "src/bar/b.go"}, FactName: "/"},
+	{Source: &spb.VName{Signature: "b"}, EdgeKind: "/call", Target: &spb.VName{Corpus: "y", Path: "src/foo/c.go"}, FactName: "/"},
+	{Source: &spb.VName{Signature: "b"}, FactName: "/text", FactValue: []byte("text")},
+}
+
+var scanTests = []struct {
+	req  *spb.ScanRequest
+	opts *graphstore.ScanOptions
+	want []int // indices into scanEntries
+}{
+	{new(spb.ScanRequest), nil, []int{0, 1, 2, 3, 4}},
+	{&spb.ScanRequest{FactPrefix: "/t"}, nil, []int{4}},
+	{&spb.ScanRequest{EdgeKind: "/ref"}, nil, []int{1, 2}},
+	{&spb.ScanRequest{Target: &spb.VName{Corpus: "x"}}, nil, nil},
+	{&spb.ScanRequest{Target: &spb.VName{Corpus: "x"}}, &graphstore.ScanOptions{PartialTarget: true}, []int{1, 2}},
+	{&spb.ScanRequest{Target: &spb.VName{Path: "src/foo/"}}, &graphstore.ScanOptions{PartialTarget: true, PrefixTarget: true}, []int{1, 3}},
+	{new(spb.ScanRequest), &graphstore.ScanOptions{EdgeKinds: []string{"/call"}}, []int{3}},
+}
+
+// scanIndices returns the indices into scanEntries of the entries matched by
+// the given options, as scanned by gs.
+func scanIndices(t *testing.T, ctx context.Context, gs graphstore.Service, req *spb.ScanRequest, opts *graphstore.ScanOptions) []int {
+	var got []int
+	if err := graphstore.ScanWithOptions(ctx, gs, req, opts, func(e *spb.Entry) error {
+		for i, se := range scanEntries {
+			if reflect.DeepEqual(e, se) {
+				got = append(got, i)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("ScanWithOptions(%v, %+v): %v", req, opts, err)
+	}
+	return got
+}
+
+func TestScanPushdown(t *testing.T) {
+	conn, stop := serve(t, NewServer(unfilteredStore{entries: scanEntries}, nil))
+	defer stop()
+	gs := NewService(conn)
+	if _, ok := gs.(graphstore.OptionsScanner); !ok {
+		t.Fatal("remote Service is not an OptionsScanner")
+	}
+
+	for _, test := range scanTests {
+		var stats ScanStats
+		got := scanIndices(t, WithScanStats(ctx, &stats), gs, test.req, test.opts)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Scan(%v, %+v): got entries %v; want %v", test.req, test.opts, got, test.want)
+		}
+		// Only the matching entries are sent by the server.
+		if want := (ScanStats{Examined: int64(len(scanEntries)), Returned: int64(len(test.want))}); stats != want {
+			t.Errorf("Scan(%v, %+v): got %+v; want %+v", test.req, test.opts, stats, want)
+		}
+	}
+}
+
+func TestScanPushdownCompatibility(t *testing.T) {
+	store := unfilteredStore{entries: scanEntries}
+
+	// A client's ScanOpts of an old server is matched by the client (and its
+	// plain Scans are as the store returns them).
+	conn, stop := serve(t, oldScanServer{gs: store})
+	defer stop()
+	gs := NewService(conn)
+	for _, test := range scanTests {
+		stats := ScanStats{Examined: -1}
+		got := scanIndices(t, WithScanStats(ctx, &stats), gs, test.req, test.opts)
+		if test.opts != nil {
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Scan(%v, %+v) of an old server: got entries %v; want %v", test.req, test.opts, got, test.want)
+			}
+		}
+		if stats.Examined != -1 {
+			t.Errorf("Scan(%v, %+v) of an old server recorded %+v", test.req, test.opts, stats)
+		}
+	}
+
+	// An old client's Scan of a server is unchanged, but for being matched by
+	// the server.
+	conn, stop = serve(t, NewServer(store, nil))
+	defer stop()
+	old := graphstore.GRPC(spb.NewGraphStoreClient(conn))
+	for _, test := range scanTests {
+		if got := scanIndices(t, ctx, old, test.req, test.opts); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Scan(%v, %+v) by an old client: got entries %v; want %v", test.req, test.opts, got, test.want)
+		}
+	}
+}
+
+func TestScanFilterPushdown(t *testing.T) {
+	store := unfilteredStore{entries: scanEntries}
+	conn, stop := serve(t, NewServer(store, nil))
+	defer stop()
+	gs := NewService(conn)
+	if _, ok := gs.(graphstore.FilterScanner); !ok {
+		t.Fatal("remote Service is not a FilterScanner")
+	}
+	oldConn, oldStop := serve(t, oldScanServer{gs: store})
+	defer oldStop()
+	old := NewService(oldConn)
+
+	tests := []struct {
+		filter *graphstore.ScanFilter
+		want   []int
+	}{
+		{&graphstore.ScanFilter{FactGlobs: []string{"/t*"}}, []int{4}},
+		{&graphstore.ScanFilter{FactRegexp: "/(kind|text)"}, []int{0, 4}},
+		{&graphstore.ScanFilter{FactGlobs: []string{"/"}}, []int{1, 2, 3}},
+	}
+	for _, test := range tests {
+		scan := func(ctx context.Context, gs graphstore.Service) []int {
+			var got []int
+			if err := graphstore.FilteredScan(ctx, gs, new(spb.ScanRequest), test.filter, func(e *spb.Entry) error {
+				for i, se := range scanEntries {
+					if reflect.DeepEqual(e, se) {
+						got = append(got, i)
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Errorf("FilteredScan(%+v): %v", test.filter, err)
+			}
+			return got
+		}
+
+		var stats ScanStats
+		if got := scan(WithScanStats(ctx, &stats), gs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("FilteredScan(%+v): got entries %v; want %v", test.filter, got, test.want)
+		}
+		// Only the matching entries are sent by the server.
+		if want := (ScanStats{Examined: int64(len(scanEntries)), Returned: int64(len(test.want))}); stats != want {
+			t.Errorf("FilteredScan(%+v): got %+v; want %+v", test.filter, stats, want)
+		}
+
+		// The entries of an old server are matched by the client.
+		if got := scan(ctx, old); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("FilteredScan(%+v) of an old server: got entries %v; want %v", test.filter, got, test.want)
+		}
+	}
+
+	// The server refuses an invalid filter.
+	bad := metadata.NewContext(ctx, metadata.Pairs(ScanFilterKey, `{"FactRegexp":"("}`))
+	if err := gs.Scan(bad, new(spb.ScanRequest), func(*spb.Entry) error { return nil }); grpc.Code(err) != codes.InvalidArgument {
+		t.Errorf("Scan with an invalid filter: got error %v; want InvalidArgument", err)
+	}
+}
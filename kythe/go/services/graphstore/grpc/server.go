@@ -0,0 +1,209 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"io"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// DefaultAckEvery is the default value of ServerOptions.AckEvery.
+const DefaultAckEvery = 256
+
+// ServerOptions configures a GraphStore server.
+type ServerOptions struct {
+	// AckEvery is the largest number of the requests of a WriteStream
+	// acknowledged by a single WriteAck.  The server acknowledges the requests
+	// it has applied sooner if it has applied every request it has received.
+	// If 0, DefaultAckEvery is used.
+	AckEvery int
+
+	// Limiter, if non-nil, limits the server's streaming calls.
+	Limiter *Limiter
+
+	// Drainer, if non-nil, may abort the server's streaming calls.
+	Drainer *Drainer
+}
+
+// NewServer returns a GraphStore server, to be registered with a gRPC server
+// by spb.RegisterGraphStoreServer, that serves gs.  The graphstore.TraceParent
+// of each call is recovered as by TraceContext.  If opts is nil, the defaults
+// are used.
+func NewServer(gs graphstore.Service, opts *ServerOptions) spb.GraphStoreServer {
+	s := &server{gs: gs, ackEvery: DefaultAckEvery}
+	if opts != nil {
+		if opts.AckEvery > 0 {
+			s.ackEvery = opts.AckEvery
+		}
+		s.limiter = opts.Limiter
+		s.drainer = opts.Drainer
+	}
+	return s
+}
+
+type server struct {
+	gs       graphstore.Service
+	ackEvery int
+	limiter  *Limiter // nil if unlimited
+	drainer  *Drainer // nil if never drained
+}
+
+// Read implements part of the spb.GraphStoreServer interface.
+func (s *server) Read(req *spb.ReadRequest, stream spb.GraphStore_ReadServer) (err error) {
+	ctx, drain, err := s.drainer.start(stream.Context())
+	if err != nil {
+		return err
+	}
+	defer func() { err = drain.end(err) }()
+	call, err := s.limiter.start(ctx, ReadMethod)
+	if err != nil {
+		return refuse(stream, err)
+	}
+	defer call.end()
+	ctx = TraceContext(ctx)
+	return s.gs.Read(ctx, req, func(e *spb.Entry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		} else if err := call.pace(ctx); err != nil {
+			return err
+		}
+		return stream.Send(e)
+	})
+}
+
+// Scan implements part of the spb.GraphStoreServer interface.  If the client
+// sent the original request and graphstore.ScanOptions of a ScanOpts, the
+// store is scanned with them if it is a graphstore.OptionsScanner, and
+// otherwise with the request sent.  Either way, each entry is matched against
+// the original request, and the graphstore.ScanFilter of a ScanFiltered, before
+// it is sent, and the call's ScanStats are reported in its trailer.
+func (s *server) Scan(req *spb.ScanRequest, stream spb.GraphStore_ScanServer) (err error) {
+	ctx, drain, err := s.drainer.start(stream.Context())
+	if err != nil {
+		return err
+	}
+	defer func() { err = drain.end(err) }()
+	ctx = TraceContext(ctx)
+	orig, opts, filter, err := incomingScanOptions(ctx, req)
+	if err != nil {
+		return err
+	}
+	call, err := s.limiter.start(ctx, ScanMethod)
+	if err != nil {
+		return refuse(stream, err)
+	}
+	defer call.end()
+	var stats ScanStats
+	send := func(e *spb.Entry) error {
+		stats.Examined++
+		if err := ctx.Err(); err != nil {
+			return err
+		} else if !graphstore.EntryMatchesScanOpts(orig, opts, e) || !filter.Matches(e.FactName) {
+			return nil
+		} else if err := call.pace(ctx); err != nil {
+			return err
+		}
+		stats.Returned++
+		return stream.Send(e)
+	}
+	if o, ok := s.gs.(graphstore.OptionsScanner); ok && opts != nil {
+		err = o.ScanOpts(ctx, orig, opts, send)
+	} else {
+		err = s.gs.Scan(ctx, req, send)
+	}
+	stream.SetTrailer(scanStatsTrailer(stats))
+	return err
+}
+
+// Write implements part of the spb.GraphStoreServer interface.
+func (s *server) Write(ctx context.Context, req *spb.WriteRequest) (*spb.WriteReply, error) {
+	if err := s.gs.Write(TraceContext(ctx), req); err != nil {
+		return nil, err
+	}
+	return &spb.WriteReply{}, nil
+}
+
+// WriteStream implements part of the spb.GraphStoreServer interface.  The
+// stream's requests are received while earlier requests are applied, so the
+// client's pipeline does not stall on the acknowledgements; a WriteAck is sent
+// once AckEvery requests have been applied or no received request remains.
+func (s *server) WriteStream(stream spb.GraphStore_WriteStreamServer) (err error) {
+	ctx, drain, err := s.drainer.start(stream.Context())
+	if err != nil {
+		return err
+	}
+	defer func() { err = drain.end(err) }()
+	call, err := s.limiter.start(ctx, WriteStreamMethod)
+	if err != nil {
+		return refuse(stream, err)
+	}
+	defer call.end()
+	ctx = TraceContext(ctx)
+	reqs := make(chan *spb.WriteRequest, s.ackEvery)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(reqs)
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				if err != io.EOF {
+					errc <- err
+				}
+				return
+			}
+			select {
+			case reqs <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	ack := new(spb.WriteAck)
+	for {
+		var req *spb.WriteRequest
+		select {
+		case req = <-reqs:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if req == nil {
+			break
+		}
+		if err := s.gs.Write(ctx, req); err != nil {
+			ack.Failure = append(ack.Failure, &spb.WriteAck_Failure{Index: ack.Count, Error: err.Error()})
+		}
+		ack.Count++
+		if ack.Count >= int64(s.ackEvery) || len(reqs) == 0 {
+			if err := stream.Send(ack); err != nil {
+				return err
+			}
+			ack = new(spb.WriteAck)
+		}
+	}
+	select {
+	case err := <-errc:
+		return err
+	default:
+		return nil
+	}
+}
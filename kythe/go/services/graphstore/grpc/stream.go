@@ -0,0 +1,396 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Defaults for the fields of Options.
+const (
+	DefaultMaxInFlightBytes    = 16 << 20
+	DefaultMaxInFlightRequests = 4096
+	DefaultReceiveWindow       = 256
+	DefaultMaxMessageBytes     = 64 << 20
+)
+
+// Options configures a remote GraphStore client.
+type Options struct {
+	// UnaryWrites sends each Write as its own RPC rather than pipelining the
+	// writes over a WriteStream.
+	UnaryWrites bool
+
+	// MaxInFlightBytes bounds the encoded size of the pipelined requests that
+	// the server has yet to acknowledge; a Write blocks until its request fits.
+	// A single request larger than the bound is sent once no other request is
+	// in flight.  If 0, DefaultMaxInFlightBytes is used.
+	MaxInFlightBytes int
+
+	// MaxInFlightRequests bounds the number of the pipelined requests that the
+	// server has yet to acknowledge.  If 0, DefaultMaxInFlightRequests is used.
+	MaxInFlightRequests int
+
+	// ReceiveWindow is the number of the entries of a Read or Scan that may be
+	// received ahead of the EntryFunc.  Once the window is full, the client
+	// stops reading the stream and gRPC's flow control holds back the server's
+	// sends, so a slow EntryFunc does not grow the server's memory.  If 0,
+	// DefaultReceiveWindow is used; if negative, each entry is received only
+	// once the EntryFunc has returned for the previous one.
+	ReceiveWindow int
+
+	// MaxMessageBytes bounds the encoded size of each entry received by a Read
+	// or Scan; a larger entry fails the call.  If 0, DefaultMaxMessageBytes is
+	// used; if negative, entries are not bounded.
+	MaxMessageBytes int
+
+	// UnaryTimeout bounds each unary call, i.e. each unary Write and health
+	// check, within the deadline of its context; a call that times out fails
+	// with ErrDeadline.  If 0, DefaultUnaryTimeout is used; if negative, only
+	// the context's deadline applies.
+	UnaryTimeout time.Duration
+
+	// IdleTimeout bounds the time a Read or Scan waits for the server to send
+	// its next entry, not counting the time spent in the EntryFunc; a call
+	// that waits longer is cancelled and fails with ErrIdleTimeout.  A long
+	// Scan is thus bounded only by the deadline of its context.  If 0,
+	// DefaultIdleTimeout is used; if negative, a stream may be idle
+	// indefinitely.
+	IdleTimeout time.Duration
+
+	// Hedger, if non-nil, hedges the Service's Reads.
+	Hedger *Hedger
+}
+
+// A WriteFailure is a pipelined write that the server failed to apply.
+type WriteFailure struct {
+	Request *spb.WriteRequest
+	Err     error
+}
+
+// A PipelineError reports the pipelined writes that failed since the error
+// was last reported.
+type PipelineError struct {
+	Failures []WriteFailure // in the order the writes were made
+}
+
+// Error implements the error interface.
+func (e *PipelineError) Error() string {
+	msg := fmt.Sprintf("pipelined write failed: %v", e.Failures[0].Err)
+	if n := len(e.Failures); n > 1 {
+		msg += fmt.Sprintf(" (and %d more)", n-1)
+	}
+	return msg
+}
+
+// errWriterClosed is returned by a Write after the remote is closed.
+var errWriterClosed = errors.New("remote GraphStore is closed")
+
+// encodedRequest is a WriteRequest that is marshaled once both to be sent on a
+// WriteStream and to be kept until it is acknowledged, since the caller of
+// Write may reuse its request once Write returns.
+type encodedRequest []byte
+
+func (r encodedRequest) Reset()                   {}
+func (r encodedRequest) String() string           { return fmt.Sprintf("<%d-byte WriteRequest>", len(r)) }
+func (r encodedRequest) ProtoMessage()            {}
+func (r encodedRequest) Marshal() ([]byte, error) { return r, nil }
+
+func (r encodedRequest) decode() *spb.WriteRequest {
+	req := new(spb.WriteRequest)
+	if err := proto.Unmarshal(r, req); err != nil {
+		panic(fmt.Sprintf("unmarshaling encoded WriteRequest: %v", err))
+	}
+	return req
+}
+
+// A streamWriter pipelines Writes over a WriteStream, reconnecting once a
+// stream fails and falling back to unary Writes if the server does not
+// implement WriteStream.
+type streamWriter struct {
+	client spb.GraphStoreClient
+	unary  graphstore.Service // for the fallback to unary Writes
+
+	maxBytes, maxRequests int
+
+	sendMu sync.Mutex // serializes Writes, so requests are sent in order
+
+	mu       sync.Mutex // guards the fields below
+	stream   spb.GraphStore_WriteStreamClient
+	cancel   context.CancelFunc // cancels stream
+	done     chan struct{}      // closed once stream's acks are processed
+	pending  []encodedRequest   // sent but not yet acknowledged, in order
+	bytes    int                // total size of pending
+	changed  chan struct{}      // closed (and replaced) when pending shrinks
+	failures []WriteFailure     // not yet reported
+	fallback bool               // set once the server lacks WriteStream
+	closed   bool
+}
+
+func newStreamWriter(client spb.GraphStoreClient, unary graphstore.Service, opts *Options) *streamWriter {
+	w := &streamWriter{
+		client:      client,
+		unary:       unary,
+		maxBytes:    DefaultMaxInFlightBytes,
+		maxRequests: DefaultMaxInFlightRequests,
+		changed:     make(chan struct{}),
+	}
+	if opts.MaxInFlightBytes > 0 {
+		w.maxBytes = opts.MaxInFlightBytes
+	}
+	if opts.MaxInFlightRequests > 0 {
+		w.maxRequests = opts.MaxInFlightRequests
+	}
+	return w
+}
+
+// fits reports whether a request of the given size may be sent without
+// exceeding the bounds on the requests in flight.  w.mu must be held.
+func (w *streamWriter) fits(size int) bool {
+	return len(w.pending) == 0 || len(w.pending) < w.maxRequests && w.bytes+size <= w.maxBytes
+}
+
+// await releases w.mu until pending shrinks or ctx is done.  w.mu must be held,
+// and is held again when await returns.
+func (w *streamWriter) await(ctx context.Context) error {
+	changed := w.changed
+	w.mu.Unlock()
+	defer w.mu.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// signal wakes the callers waiting in await.  w.mu must be held.
+func (w *streamWriter) signal() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// takeErr returns and forgets the unreported failures, if any.  w.mu must be
+// held.
+func (w *streamWriter) takeErr() error {
+	if len(w.failures) == 0 {
+		return nil
+	}
+	err := &PipelineError{w.failures}
+	w.failures = nil
+	return err
+}
+
+// Write sends req on the writer's stream, once it fits among the requests in
+// flight, and returns without waiting for it to be acknowledged.  If earlier
+// requests have failed, Write returns their *PipelineError and req is not
+// sent.
+func (w *streamWriter) Write(ctx context.Context, req *spb.WriteRequest) error {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	data, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	for {
+		if w.closed {
+			w.mu.Unlock()
+			return errWriterClosed
+		} else if err := w.takeErr(); err != nil {
+			w.mu.Unlock()
+			return err
+		} else if w.fallback && len(w.pending) == 0 {
+			w.mu.Unlock()
+			return permissionError(WriteMethod, w.unary.Write(ctx, req))
+		} else if !w.fallback && w.fits(len(data)) {
+			break
+		}
+		if err := w.await(ctx); err != nil {
+			w.mu.Unlock()
+			return err
+		}
+	}
+	if w.stream == nil {
+		if err := w.open(); err != nil {
+			w.mu.Unlock()
+			return err
+		}
+	}
+	stream := w.stream
+	w.pending = append(w.pending, encodedRequest(data))
+	w.bytes += len(data)
+	w.mu.Unlock()
+
+	// If the stream has failed, the status is found by receiveAcks, which
+	// accounts for req with the rest of the pending requests.
+	stream.SendMsg(encodedRequest(data))
+	return nil
+}
+
+// open starts a new WriteStream and the goroutine receiving its acks.  w.mu
+// must be held.
+func (w *streamWriter) open() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := w.client.WriteStream(ctx)
+	if err != nil {
+		cancel()
+		return permissionError(WriteStreamMethod, err)
+	}
+	w.stream, w.cancel, w.done = stream, cancel, make(chan struct{})
+	go w.receiveAcks(stream, w.done)
+	return nil
+}
+
+// receiveAcks processes the acks of stream until it ends.
+func (w *streamWriter) receiveAcks(stream spb.GraphStore_WriteStreamClient, done chan struct{}) {
+	defer close(done)
+	for {
+		ack, err := stream.Recv()
+		if err != nil {
+			w.streamFailed(err)
+			return
+		}
+
+		w.mu.Lock()
+		if n := len(w.pending); ack.Count <= 0 || ack.Count > int64(n) {
+			w.mu.Unlock()
+			w.streamFailed(fmt.Errorf("server acknowledged %d of %d pending requests", ack.Count, n))
+			return
+		}
+		acked := w.pending[:ack.Count]
+		for _, f := range ack.Failure {
+			if f.Index >= 0 && f.Index < ack.Count {
+				w.failures = append(w.failures, WriteFailure{acked[f.Index].decode(), errors.New(f.Error)})
+			}
+		}
+		for _, r := range acked {
+			w.bytes -= len(r)
+		}
+		w.pending = w.pending[ack.Count:]
+		w.signal()
+		w.mu.Unlock()
+	}
+}
+
+// streamFailed ends the current stream after it fails with err.  If the server
+// does not implement WriteStream, the pending requests are written with unary
+// Writes, as are all later requests; otherwise they fail with err, and the
+// next Write starts a new stream.
+func (w *streamWriter) streamFailed(err error) {
+	w.mu.Lock()
+	w.cancel()
+	w.stream = nil
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF // the server ended the stream too soon
+	}
+	if grpc.Code(err) != codes.Unimplemented {
+		err = permissionError(WriteStreamMethod, err)
+		for _, r := range w.pending {
+			w.failures = append(w.failures, WriteFailure{r.decode(), err})
+		}
+		w.pending, w.bytes = nil, 0
+		w.signal()
+		w.mu.Unlock()
+		return
+	}
+
+	// Later Writes wait for the pending requests to be replayed, so the writes
+	// are still made in order.
+	w.fallback = true
+	pending := w.pending
+	w.mu.Unlock()
+	var failures []WriteFailure
+	for _, r := range pending {
+		req := r.decode()
+		if err := w.unary.Write(context.Background(), req); err != nil {
+			failures = append(failures, WriteFailure{req, permissionError(WriteMethod, err)})
+		}
+	}
+	w.mu.Lock()
+	w.failures = append(w.failures, failures...)
+	w.pending, w.bytes = nil, 0
+	w.signal()
+	w.mu.Unlock()
+}
+
+// wait blocks until every request sent has been acknowledged, but leaves any
+// failures to be reported by a later Write or Flush.
+func (w *streamWriter) wait(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.pending) > 0 {
+		if err := w.await(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush blocks until every request sent has been acknowledged and returns the
+// *PipelineError of the requests that failed, if any.
+func (w *streamWriter) Flush(ctx context.Context) error {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	if err := w.wait(ctx); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.takeErr()
+}
+
+// Close ends the writer's stream, once every request sent has been
+// acknowledged (or ctx is done, failing the rest), and returns the *PipelineError of the requests that failed,
+// if any.
+func (w *streamWriter) Close(ctx context.Context) error {
+	w.sendMu.Lock()
+	defer w.sendMu.Unlock()
+	err := w.wait(ctx)
+
+	w.mu.Lock()
+	stream, done := w.stream, w.done
+	if stream != nil && err != nil {
+		w.cancel()
+	}
+	w.closed = true
+	w.mu.Unlock()
+	if stream != nil {
+		stream.CloseSend()
+		<-done
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if ferr := w.takeErr(); err == nil {
+		err = ferr
+	}
+	return err
+}
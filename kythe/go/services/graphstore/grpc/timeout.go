@@ -0,0 +1,120 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Defaults for the timeouts of Options.
+const (
+	DefaultUnaryTimeout = time.Minute
+	DefaultIdleTimeout  = 10 * time.Minute
+)
+
+var (
+	// ErrDeadline is returned by a remote call whose deadline, that of its
+	// context or its Options.UnaryTimeout, expired before the call completed.
+	ErrDeadline = errors.New("remote GraphStore call exceeded its deadline")
+
+	// ErrIdleTimeout is returned by a remote Read or Scan that received no
+	// entry for its Options.IdleTimeout.
+	ErrIdleTimeout = errors.New("remote GraphStore stream was idle for too long")
+)
+
+// deadlineError returns ErrDeadline if err reports an expired deadline, and
+// otherwise err.
+func deadlineError(err error) error {
+	if err == context.DeadlineExceeded || grpc.Code(err) == codes.DeadlineExceeded {
+		return ErrDeadline
+	}
+	return err
+}
+
+// specTimeouts sets the timeouts of opts from the unary_timeout and
+// idle_timeout parameters of a spec's query, if given, as parsed by
+// time.ParseDuration.
+func specTimeouts(q url.Values, opts *Options) error {
+	for p, d := range map[string]*time.Duration{
+		"unary_timeout": &opts.UnaryTimeout,
+		"idle_timeout":  &opts.IdleTimeout,
+	} {
+		if v := q.Get(p); v != "" {
+			t, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s spec parameter: %v", p, err)
+			} else if t <= 0 {
+				t = -1 // disabled, rather than the default
+			}
+			*d = t
+		}
+	}
+	return nil
+}
+
+// unaryTimeout bounds each Write of a graphstore.Service by a timeout, if
+// positive.
+type unaryTimeout struct {
+	graphstore.Service
+	timeout time.Duration
+}
+
+// Write implements part of the graphstore.Service interface.
+func (u unaryTimeout) Write(ctx context.Context, req *spb.WriteRequest) error {
+	ctx, cancel := withTimeout(ctx, u.timeout)
+	defer cancel()
+	return u.Service.Write(ctx, req)
+}
+
+// withTimeout returns ctx bounded by timeout, if positive.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// A watchdog cancels a call once it has been started for longer than its
+// timeout without being stopped.
+type watchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newWatchdog(timeout time.Duration, cancel context.CancelFunc) *watchdog {
+	w := &watchdog{timeout, time.AfterFunc(timeout, cancel)}
+	w.timer.Stop()
+	return w
+}
+
+// start restarts the watchdog's timeout.
+func (w *watchdog) start() { w.timer.Reset(w.timeout) }
+
+// stop stops the watchdog, reporting whether it stopped before its timeout
+// cancelled the call.
+func (w *watchdog) stop() bool { return w.timer.Stop() }
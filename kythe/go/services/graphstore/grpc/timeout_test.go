@@ -0,0 +1,205 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// stallingServer is a GraphStoreServer whose Scans send its entries, each
+// after its delay, and then, if stall is set, stall until the client ends the
+// call, and whose Writes always stall.  The error of each stalled call's
+// context is sent on ended.
+type stallingServer struct {
+	spb.GraphStoreServer
+	entries int
+	delay   time.Duration
+	stall   bool
+	ended   chan error
+}
+
+func newStallingServer(entries int, delay time.Duration, stall bool) *stallingServer {
+	return &stallingServer{entries: entries, delay: delay, stall: stall, ended: make(chan error, 1)}
+}
+
+func (s *stallingServer) Scan(req *spb.ScanRequest, stream spb.GraphStore_ScanServer) error {
+	for i := 0; i < s.entries; i++ {
+		time.Sleep(s.delay)
+		if err := stream.Send(&spb.Entry{Source: &spb.VName{Signature: "node"}, FactName: "/fact"}); err != nil {
+			return err
+		}
+	}
+	if !s.stall {
+		return nil
+	}
+	ctx := stream.Context()
+	<-ctx.Done()
+	s.ended <- ctx.Err()
+	return ctx.Err()
+}
+
+func (s *stallingServer) Write(ctx context.Context, req *spb.WriteRequest) (*spb.WriteReply, error) {
+	<-ctx.Done()
+	s.ended <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+// checkEnded checks that the server's stalled call ended with want.
+func (s *stallingServer) checkEnded(t *testing.T, desc string, want error) {
+	select {
+	case err := <-s.ended:
+		if err != want {
+			t.Errorf("%s: server call ended with %v; want %v", desc, err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("%s: server call still running after the client gave up", desc)
+	}
+}
+
+func TestUnaryTimeout(t *testing.T) {
+	tests := []struct {
+		desc    string
+		timeout time.Duration
+		ctx     func() (context.Context, context.CancelFunc)
+	}{
+		{"UnaryTimeout", 50 * time.Millisecond, func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(ctx)
+		}},
+		{"context deadline", -1, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(ctx, 50*time.Millisecond)
+		}},
+	}
+	for _, test := range tests {
+		srv := newStallingServer(0, 0, true)
+		conn, stop := serve(t, srv)
+		gs := NewServiceWithOptions(conn, &Options{UnaryWrites: true, UnaryTimeout: test.timeout})
+
+		ctx, cancel := test.ctx()
+		if err := gs.Write(ctx, request("node", 1)); err != ErrDeadline {
+			t.Errorf("Write (%s): got error %v; want %v", test.desc, err, ErrDeadline)
+		}
+		cancel()
+		// The deadline is propagated to the server.
+		srv.checkEnded(t, test.desc, context.DeadlineExceeded)
+		stop()
+	}
+}
+
+func TestScanDeadline(t *testing.T) {
+	srv := newStallingServer(2, 0, true)
+	conn, stop := serve(t, srv)
+	defer stop()
+	gs := NewServiceWithOptions(conn, &Options{IdleTimeout: -1})
+
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	var n int
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		n++
+		return nil
+	}); err != ErrDeadline {
+		t.Errorf("Scan: got error %v; want %v", err, ErrDeadline)
+	}
+	if n != 2 {
+		t.Errorf("Scan passed %d entries; want 2", n)
+	}
+	srv.checkEnded(t, "Scan", context.DeadlineExceeded)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	for _, window := range []int{-1, 0, 16} {
+		srv := newStallingServer(3, 10*time.Millisecond, true)
+		conn, stop := serve(t, srv)
+		gs := NewServiceWithOptions(conn, &Options{ReceiveWindow: window, IdleTimeout: 100 * time.Millisecond})
+
+		var n int
+		if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+			n++
+			return nil
+		}); err != ErrIdleTimeout {
+			t.Errorf("Scan (window %d): got error %v; want %v", window, err, ErrIdleTimeout)
+		}
+		if n != 3 {
+			t.Errorf("Scan (window %d) passed %d entries; want 3", window, n)
+		}
+		srv.checkEnded(t, "Scan", context.Canceled)
+		stop()
+	}
+}
+
+func TestIdleTimeoutSlowEntryFunc(t *testing.T) {
+	// The time spent in the EntryFunc does not count against the IdleTimeout.
+	for _, window := range []int{-1, 2} {
+		conn, stop := serve(t, newStallingServer(4, 0, false))
+		gs := NewServiceWithOptions(conn, &Options{ReceiveWindow: window, IdleTimeout: 50 * time.Millisecond})
+
+		var n int
+		if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+			n++
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		}); err != nil {
+			t.Errorf("Scan (window %d): %v", window, err)
+		}
+		if n != 4 {
+			t.Errorf("Scan (window %d) passed %d entries; want 4", window, n)
+		}
+		stop()
+	}
+}
+
+func TestSpecTimeouts(t *testing.T) {
+	srv := newStallingServer(1, 0, true)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := grpc.NewServer()
+	spb.RegisterGraphStoreServer(s, srv)
+	go s.Serve(l)
+	defer s.Stop()
+	addr := l.Addr().String()
+
+	gs, err := graphstore.Open(ctx, "grpc://"+addr+"?idle_timeout=50ms&unary_timeout=50ms")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer gs.Close(ctx)
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error { return nil }); err != ErrIdleTimeout {
+		t.Errorf("Scan: got error %v; want %v", err, ErrIdleTimeout)
+	}
+	srv.checkEnded(t, "Scan", context.Canceled)
+
+	for _, spec := range []string{
+		"grpc://" + addr + "?idle_timeout=soon",
+		"grpcs://" + addr + "?unary_timeout=5",
+	} {
+		if gs, err := graphstore.Open(ctx, spec); err == nil {
+			gs.Close(ctx)
+			t.Errorf("Open(%q) succeeded; want an invalid duration", spec)
+		}
+	}
+}
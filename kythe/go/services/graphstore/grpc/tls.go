@@ -0,0 +1,244 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSOptions configures the TLS of a GraphStore client or server.  The files
+// are PEM encoded.
+type TLSOptions struct {
+	// CertFile and KeyFile hold the certificate presented to the peer and its
+	// private key.  A server requires them; a client presents them for mutual
+	// TLS.
+	CertFile, KeyFile string
+
+	// CAFile holds the certificates of the authorities trusted to sign the
+	// peer's certificate.  If it is empty, a client trusts the system's roots.
+	// If it is set, a server requires each client to present a certificate
+	// signed by one of them (mutual TLS).
+	CAFile string
+
+	// ServerName is the name a client expects the server's certificate to
+	// carry.  If empty, the host of the dialed address is used.
+	ServerName string
+}
+
+// ClientCredentials returns the gRPC transport credentials of a client
+// configured by opts.  A failed handshake is reported by an error naming its
+// cause, e.g. an expired server certificate or one issued for another name.
+func ClientCredentials(opts *TLSOptions) (credentials.TransportCredentials, error) {
+	// The server's certificate is verified by verifyingCreds instead.
+	cfg := &tls.Config{ServerName: opts.ServerName, InsecureSkipVerify: true}
+	if err := loadCert(cfg, opts); err != nil {
+		return nil, err
+	}
+	roots, err := loadPool(opts.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingCreds{credentials.NewTLS(cfg), cfg.ServerName, roots}, nil
+}
+
+// ServerCredentials returns the gRPC transport credentials of a server
+// configured by opts, to be passed to grpc.NewServer by grpc.Creds.  A failed
+// handshake is reported, as by ClientCredentials, to the server's log.
+func ServerCredentials(opts *TLSOptions) (credentials.TransportCredentials, error) {
+	if opts.CertFile == "" || opts.KeyFile == "" {
+		return nil, errors.New("a TLS server requires a certificate and key")
+	}
+	cfg := new(tls.Config)
+	if err := loadCert(cfg, opts); err != nil {
+		return nil, err
+	}
+	var clientCAs *x509.CertPool
+	if opts.CAFile != "" {
+		pool, err := loadPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs = pool
+		cfg.ClientAuth = tls.RequireAnyClientCert // verified by verifyingCreds
+	}
+	return &verifyingCreds{credentials.NewTLS(cfg), "", clientCAs}, nil
+}
+
+func loadCert(cfg *tls.Config, opts *TLSOptions) error {
+	if opts.CertFile == "" && opts.KeyFile == "" {
+		return nil
+	} else if opts.CertFile == "" || opts.KeyFile == "" {
+		return errors.New("a TLS certificate and key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate %q: %v", opts.CertFile, err)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+// loadPool returns the certificates of file, or nil if file is empty.
+func loadPool(file string) (*x509.CertPool, error) {
+	if file == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA bundle: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA bundle %q holds no PEM certificates", file)
+	}
+	return pool, nil
+}
+
+// verifyingCreds is a set of TLS transport credentials that verifies the
+// peer's certificate itself, after the handshake, so that a verification
+// failure is reported with its cause rather than as an opaque transport error.
+// The embedded credentials must not verify the peer.
+type verifyingCreds struct {
+	credentials.TransportCredentials
+	serverName string         // for a client; see TLSOptions.ServerName
+	roots      *x509.CertPool // for a server, nil unless clients are verified
+}
+
+// ClientHandshake implements part of the credentials.TransportCredentials
+// interface.
+func (c *verifyingCreds) ClientHandshake(ctx context.Context, addr string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info, err := c.TransportCredentials.ClientHandshake(ctx, addr, rawConn)
+	if err != nil {
+		if strings.Contains(err.Error(), "bad certificate") || strings.Contains(err.Error(), "certificate required") {
+			err = fmt.Errorf("the server rejected the client certificate (mutual TLS requires one signed by a CA the server trusts): %v", err)
+		}
+		return nil, nil, fmt.Errorf("TLS handshake with %s failed: %v", addr, err)
+	}
+	name := c.serverName
+	if name == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			name = host
+		} else {
+			name = addr
+		}
+	}
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if err := verify(certs, c.roots, name, x509.ExtKeyUsageServerAuth); err != nil {
+		conn.Close()
+		return nil, nil, describe("server", addr, certs, err)
+	}
+	return conn, info, nil
+}
+
+// ServerHandshake implements part of the credentials.TransportCredentials
+// interface.
+func (c *verifyingCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info, err := c.TransportCredentials.ServerHandshake(rawConn)
+	if err != nil {
+		if strings.Contains(err.Error(), "client didn't provide a certificate") {
+			err = errors.New("client presented no certificate, but the server requires one (mutual TLS)")
+		}
+		return nil, nil, fmt.Errorf("TLS handshake with %s failed: %v", rawConn.RemoteAddr(), err)
+	}
+	if c.roots == nil {
+		return conn, info, nil
+	}
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if err := verify(certs, c.roots, "", x509.ExtKeyUsageClientAuth); err != nil {
+		conn.Close()
+		return nil, nil, describe("client", rawConn.RemoteAddr().String(), certs, err)
+	}
+	return conn, info, nil
+}
+
+// Clone implements part of the credentials.TransportCredentials interface.
+func (c *verifyingCreds) Clone() credentials.TransportCredentials {
+	return &verifyingCreds{c.TransportCredentials.Clone(), c.serverName, c.roots}
+}
+
+// OverrideServerName implements part of the credentials.TransportCredentials
+// interface.
+func (c *verifyingCreds) OverrideServerName(name string) error {
+	c.serverName = name
+	return c.TransportCredentials.OverrideServerName(name)
+}
+
+// verify checks that the chain of certs (leaf first) is valid for name (if
+// non-empty) and usage, and is signed by one of roots (or, if nil, the
+// system's roots).
+func verify(certs []*x509.Certificate, roots *x509.CertPool, name string, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return errors.New("no certificate presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       name,
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
+
+// describe returns an error explaining why the certificate chain certs (leaf
+// first) that the peer at addr presented failed verification with err.
+func describe(peer, addr string, certs []*x509.Certificate, err error) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("%s at %s presented no certificate", peer, addr)
+	}
+	leaf := certs[0]
+	subject := fmt.Sprintf("%s certificate %q", peer, leaf.Subject.CommonName)
+	switch e := err.(type) {
+	case x509.HostnameError:
+		return fmt.Errorf("%s at %s is valid for %s, not %q (dial that name or set the expected server name)", subject, addr, certNames(leaf), e.Host)
+	case x509.UnknownAuthorityError:
+		return fmt.Errorf("%s at %s is signed by an unknown authority %q (add its CA to the trusted CA bundle)", subject, addr, leaf.Issuer.CommonName)
+	case x509.CertificateInvalidError:
+		now := time.Now()
+		if e.Reason == x509.Expired && now.After(leaf.NotAfter) {
+			return fmt.Errorf("%s at %s expired at %v", subject, addr, leaf.NotAfter.UTC())
+		} else if e.Reason == x509.Expired {
+			return fmt.Errorf("%s at %s is not valid until %v", subject, addr, leaf.NotBefore.UTC())
+		}
+	}
+	return fmt.Errorf("%s at %s failed verification: %v", subject, addr, err)
+}
+
+// certNames returns a description of the names for which cert is valid.
+func certNames(cert *x509.Certificate) string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("no names (its common name is %q)", cert.Subject.CommonName)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,280 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/inmemory"
+
+	"google.golang.org/grpc"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// pki is a set of self-signed test certificates, written to PEM files in dir.
+type pki struct {
+	t   *testing.T
+	dir string
+	n   int64
+}
+
+func newPKI(t *testing.T) *pki {
+	dir, err := ioutil.TempDir("", "tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pki{t: t, dir: dir}
+}
+
+func (p *pki) cleanup() { os.RemoveAll(p.dir) }
+
+// cert is a certificate and its key, as parsed and as written to files.
+type cert struct {
+	cert              *x509.Certificate
+	key               *ecdsa.PrivateKey
+	certFile, keyFile string
+}
+
+// issue writes a new certificate for name valid from notBefore to notAfter,
+// signed by ca, or self-signed as a CA if ca is nil.
+func (p *pki) issue(name string, ca *cert, notBefore, notAfter time.Time) *cert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.n++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(p.n),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.DNSNames, tmpl.IPAddresses = nil, nil
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	c := &cert{
+		key:      key,
+		certFile: filepath.Join(p.dir, name+".pem"),
+		keyFile:  filepath.Join(p.dir, name+".key"),
+	}
+	if c.cert, err = x509.ParseCertificate(der); err != nil {
+		p.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.write(c.certFile, "CERTIFICATE", der)
+	p.write(c.keyFile, "EC PRIVATE KEY", keyDER)
+	return c
+}
+
+func (p *pki) write(file, typ string, der []byte) {
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// serveTLS starts a TLS GraphStore server on a local port using opts and
+// srvOpts and returns its address and a function to stop it.
+func serveTLS(t *testing.T, opts *TLSOptions, srvOpts ...grpc.ServerOption) (string, func()) {
+	creds, err := ServerCredentials(opts)
+	if err != nil {
+		t.Fatalf("ServerCredentials: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := grpc.NewServer(append(srvOpts, grpc.Creds(creds))...)
+	spb.RegisterGraphStoreServer(s, NewServer(inmemory.Create(), nil))
+	go s.Serve(l)
+	return l.Addr().String(), s.Stop
+}
+
+// spec returns a grpcs spec for addr with the given query parameters.
+func spec(addr string, params ...string) string {
+	q := make(url.Values)
+	for i := 0; i+1 < len(params); i += 2 {
+		q.Set(params[i], params[i+1])
+	}
+	return (&url.URL{Scheme: "grpcs", Host: addr, RawQuery: q.Encode()}).String()
+}
+
+// roundTrip writes an entry through gs and reads it back.
+func roundTrip(t *testing.T, gs graphstore.Service) {
+	if err := gs.Write(ctx, request("tls", 1)); err != nil {
+		t.Fatalf("Write: %v", err)
+	} else if n := countEntries(t, gs, "tls"); n != 1 {
+		t.Errorf("Read %d entries; want 1", n)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	p := newPKI(t)
+	defer p.cleanup()
+	now := time.Now()
+	ca := p.issue("ca", nil, now.Add(-time.Hour), now.Add(time.Hour))
+	server := p.issue("server", ca, now.Add(-time.Hour), now.Add(time.Hour))
+
+	addr, stop := serveTLS(t, &TLSOptions{CertFile: server.certFile, KeyFile: server.keyFile})
+	defer stop()
+
+	gs, err := graphstore.Open(ctx, spec(addr, "ca", ca.certFile))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer gs.Close(ctx)
+	roundTrip(t, gs)
+}
+
+func TestMutualTLS(t *testing.T) {
+	p := newPKI(t)
+	defer p.cleanup()
+	now := time.Now()
+	ca := p.issue("ca", nil, now.Add(-time.Hour), now.Add(time.Hour))
+	server := p.issue("server", ca, now.Add(-time.Hour), now.Add(time.Hour))
+	client := p.issue("client", ca, now.Add(-time.Hour), now.Add(time.Hour))
+
+	addr, stop := serveTLS(t, &TLSOptions{
+		CertFile: server.certFile,
+		KeyFile:  server.keyFile,
+		CAFile:   ca.certFile,
+	})
+	defer stop()
+
+	gs, err := graphstore.Open(ctx, spec(addr,
+		"ca", ca.certFile,
+		"cert", client.certFile,
+		"key", client.keyFile))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer gs.Close(ctx)
+	roundTrip(t, gs)
+}
+
+func TestTLSHandshakeErrors(t *testing.T) {
+	p := newPKI(t)
+	defer p.cleanup()
+	now := time.Now()
+	ca := p.issue("ca", nil, now.Add(-time.Hour), now.Add(time.Hour))
+	other := p.issue("other-ca", nil, now.Add(-time.Hour), now.Add(time.Hour))
+	server := p.issue("server", ca, now.Add(-time.Hour), now.Add(time.Hour))
+	expired := p.issue("expired", ca, now.Add(-2*time.Hour), now.Add(-time.Hour))
+
+	addr, stop := serveTLS(t, &TLSOptions{CertFile: server.certFile, KeyFile: server.keyFile})
+	defer stop()
+	expiredAddr, stopExpired := serveTLS(t, &TLSOptions{CertFile: expired.certFile, KeyFile: expired.keyFile})
+	defer stopExpired()
+
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{spec(addr, "ca", other.certFile), []string{`server certificate "server"`, "unknown authority", `"ca"`}},
+		{spec(expiredAddr, "ca", ca.certFile), []string{`server certificate "expired"`, "expired at"}},
+		{spec(addr, "ca", ca.certFile, "server_name", "gs.example.com"), []string{"valid for localhost, 127.0.0.1", `not "gs.example.com"`}},
+	}
+	for _, test := range tests {
+		gs, err := graphstore.Open(ctx, test.spec)
+		if err == nil {
+			gs.Close(ctx)
+			t.Errorf("Open(%q) succeeded; want error", test.spec)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Open(%q) error: %v; want it to contain %q", test.spec, err, want)
+			}
+		}
+	}
+}
+
+func TestTLSMissingClientCert(t *testing.T) {
+	p := newPKI(t)
+	defer p.cleanup()
+	now := time.Now()
+	ca := p.issue("ca", nil, now.Add(-time.Hour), now.Add(time.Hour))
+	server := p.issue("server", ca, now.Add(-time.Hour), now.Add(time.Hour))
+
+	creds, err := ServerCredentials(&TLSOptions{
+		CertFile: server.certFile,
+		KeyFile:  server.keyFile,
+		CAFile:   ca.certFile,
+	})
+	if err != nil {
+		t.Fatalf("ServerCredentials: %v", err)
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		// The client presents no certificate.
+		tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		clientConn.Close()
+	}()
+	if _, _, err := creds.ServerHandshake(serverConn); err == nil {
+		t.Error("ServerHandshake succeeded; want error")
+	} else if !strings.Contains(err.Error(), "presented no certificate") || !strings.Contains(err.Error(), "mutual TLS") {
+		t.Errorf("ServerHandshake error: %v; want it to report the missing client certificate", err)
+	}
+}
+
+func TestTLSSpecErrors(t *testing.T) {
+	for _, s := range []string{
+		"grpcs://127.0.0.1:1?bogus=1",
+		"grpcs://127.0.0.1:1?cert=client.pem",
+		"grpcs://127.0.0.1:1?ca=/nonexistent/ca.pem",
+		"grpc://127.0.0.1:1?ca=ca.pem",
+	} {
+		if gs, err := graphstore.Open(ctx, s); err == nil {
+			gs.Close(ctx)
+			t.Errorf("Open(%q) succeeded; want error", s)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+)
+
+// UnixPrefix prefixes the path of a Unix domain socket given to Listen, as in
+// "unix:///run/kythe/gs.sock".
+const UnixPrefix = "unix:"
+
+// openUnix opens a "grpc+unix:///path/to.sock" spec, connecting without TLS to
+// the server listening on that Unix domain socket (see Listen).  Its optional
+// query parameters are those of a "grpc" spec, except that its pool has a
+// single connection by default.
+func openUnix(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+	return openInsecure(u, true)
+}
+
+// dialUnix is the grpc.WithDialer dialer of the socket at path.
+func dialUnix(path string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", path, timeout)
+}
+
+// Listen announces on addr, which is either a TCP host:port or UnixPrefix
+// followed by the path of a Unix domain socket.  A stale socket file at the
+// path, left by a server that no longer accepts connections on it, is removed
+// first; a socket in use, or a file that is not a socket, is an error.  If mode
+// is non-zero, the socket file is given that mode (e.g. 0660, so that only its
+// owner and group may connect).  Closing the listener removes the socket file.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(addr, UnixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(addr, UnixPrefix), "//")
+	if path == "" {
+		return nil, fmt.Errorf("missing socket path in %q", addr)
+	} else if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file at path if no server accepts
+// connections on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	} else if !refused(err) {
+		return fmt.Errorf("checking socket %s: %v", path, err)
+	}
+	return os.Remove(path)
+}
+
+// refused reports whether err, from dialing a socket, is a refused connection.
+func refused(err error) bool {
+	if oerr, ok := err.(*net.OpError); ok {
+		err = oerr.Err
+	}
+	if serr, ok := err.(*os.SyscallError); ok {
+		err = serr.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package grpc
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/inmemory"
+
+	"google.golang.org/grpc"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// tempSocket returns the path of a socket in a new temporary directory, and a
+// function to remove it.
+func tempSocket(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gs_unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "gs.sock"), func() { os.RemoveAll(dir) }
+}
+
+func TestUnixSocket(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+	l, err := Listen(UnixPrefix+"//"+path, 0600)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := grpc.NewServer()
+	spb.RegisterGraphStoreServer(s, NewServer(inmemory.Create(), nil))
+	go s.Serve(l)
+	defer s.Stop()
+
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if mode := fi.Mode() & os.ModePerm; mode != 0600 {
+		t.Errorf("Socket mode: got %v; want %v", mode, os.FileMode(0600))
+	}
+
+	gs, err := graphstore.Open(ctx, "grpc+unix://"+path+"?unary_timeout=10s")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer gs.Close(ctx)
+	if err := gs.Write(ctx, request("src", 3)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n := countEntries(t, gs, "src"); n != 3 {
+		t.Errorf("Read %d entries over the socket; want 3", n)
+	}
+
+	if _, err := Listen(UnixPrefix+path, 0); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Listen on a socket in use: got error %v; want it in use", err)
+	}
+	if _, err := graphstore.Open(ctx, "grpc+unix://"+path+"?ca=ca.pem"); err == nil {
+		t.Error("Open with a TLS parameter: unexpected success")
+	}
+}
+
+func TestListenStaleSocket(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+	// A listener that is closed without removing its socket file leaves it
+	// stale, as a crashed server would.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Stale socket: %v", err)
+	}
+
+	l, err := Listen(UnixPrefix+path, 0)
+	if err != nil {
+		t.Fatalf("Listen over a stale socket: %v", err)
+	}
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Socket remains after Close: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(UnixPrefix+path, 0); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("Listen over a regular file: got error %v; want it not a socket", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Regular file was removed: %v", err)
+	}
+	if _, err := Listen(UnixPrefix, 0); err == nil {
+		t.Error("Listen without a socket path: unexpected success")
+	}
+}
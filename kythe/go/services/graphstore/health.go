@@ -0,0 +1,57 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// HealthChecker is an optional interface for a Service that can check whether
+// it is able to serve requests, such as a store whose disk may fill or whose
+// server may become unreachable.
+type HealthChecker interface {
+	Service
+
+	// CheckHealth returns nil if the Service is able to serve requests, and
+	// otherwise an error describing why it is not.
+	CheckHealth(ctx context.Context) error
+}
+
+// CheckHealth returns the health of s, as by its CheckHealth method if s is a
+// HealthChecker.  Otherwise, s is healthy if a trial Read succeeds.
+func CheckHealth(ctx context.Context, s Service) error {
+	if hc, ok := s.(HealthChecker); ok {
+		return hc.CheckHealth(ctx)
+	}
+	return TrialRead(ctx, s)
+}
+
+// TrialRead returns the error, if any, of a Read from s of at most one entry
+// of an empty source.
+func TrialRead(ctx context.Context, s Service) error {
+	if err := s.Read(ctx, &spb.ReadRequest{Source: new(spb.VName)}, func(*spb.Entry) error {
+		return io.EOF
+	}); err != nil {
+		return fmt.Errorf("trial read failed: %v", err)
+	}
+	return nil
+}
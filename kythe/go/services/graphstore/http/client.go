@@ -0,0 +1,179 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/web"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func init() {
+	graphstore.Register("http", opener)
+	graphstore.Register("https", opener)
+}
+
+// opener opens an "http://host:port/prefix" or "https://host:port/prefix"
+// spec, naming the handlers registered under prefix.
+func opener(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+	return NewService(u.String(), nil), nil
+}
+
+// maxErrorBytes bounds the size of an error response read by a client.
+const maxErrorBytes = 4096
+
+// NewService returns a graphstore.Service backed by the GraphStore HTTP
+// handlers registered under the URL base (e.g.
+// "http://localhost:8080/graphstore"), sending its requests with client, or
+// http.DefaultClient if nil.  A Read or Scan ends its request as soon as its
+// EntryFunc returns an error or io.EOF.  A Write refused with
+// http.StatusForbidden by a read-only store fails with graphstore.ErrReadOnly.
+func NewService(base string, client *http.Client) graphstore.Service {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &remote{trimSlash(base), client}
+}
+
+type remote struct {
+	base   string
+	client *http.Client
+}
+
+// Read implements part of the graphstore.Service interface.
+func (r *remote) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	return r.entries(ctx, "read", nil, req, f)
+}
+
+// Scan implements part of the graphstore.Service interface.
+func (r *remote) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return r.entries(ctx, "scan", nil, req, f)
+}
+
+// ScanFiltered implements the graphstore.FilterScanner interface.  The handler
+// is sent m's filter, by which it matches the entries itself, along with req
+// narrowed as by graphstore.ScanMatching; the entries of a handler ignoring the
+// filter are matched by the client.
+func (r *remote) ScanFiltered(ctx context.Context, req *spb.ScanRequest, m *graphstore.FactMatcher, f graphstore.EntryFunc) error {
+	filter := m.Filter()
+	query := url.Values{"fact_glob": filter.FactGlobs}
+	if filter.FactRegexp != "" {
+		query.Set("fact_regexp", filter.FactRegexp)
+	}
+	return r.entries(ctx, "scan", query, m.NarrowScan(req), func(e *spb.Entry) error {
+		if !m.Matches(e.FactName) {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+// Write implements part of the graphstore.Service interface.
+func (r *remote) Write(ctx context.Context, req *spb.WriteRequest) error {
+	resp, err := r.post(ctx, "write", nil, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var reply spb.WriteReply
+	if err := jsonpb.Unmarshal(resp.Body, &reply); err != nil {
+		return fmt.Errorf("decoding write reply: %v", err)
+	}
+	return nil
+}
+
+// Close implements part of the graphstore.Service interface.
+func (r *remote) Close(ctx context.Context) error { return nil }
+
+// entries passes each entry of the response to req, sent to method with the
+// given query arguments, to f.
+func (r *remote) entries(ctx context.Context, method string, query url.Values, req proto.Message, f graphstore.EntryFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // ends the request once f is done with the response
+	resp, err := r.post(ctx, method, query, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e spb.Entry
+		if err := jsonpb.UnmarshalNext(dec, &e); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("decoding %s entry: %v", method, err)
+		}
+		if err := f(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	// The trailer is available once the body has been read.
+	if msg := resp.Trailer.Get(ErrorTrailer); msg != "" {
+		return fmt.Errorf("remote %s error: %s", method, msg)
+	}
+	return nil
+}
+
+// post sends req, JSON encoded, to method with the given query arguments and
+// returns the successful response.
+func (r *remote) post(ctx context.Context, method string, query url.Values, req proto.Message) (*http.Response, error) {
+	body := new(bytes.Buffer)
+	if err := web.JSONMarshaler.Marshal(body, req); err != nil {
+		return nil, fmt.Errorf("error marshaling %T: %v", req, err)
+	}
+	target := r.base + "/" + method
+	if enc := query.Encode(); enc != "" {
+		target += "?" + enc
+	}
+	hreq, err := http.NewRequest("POST", target, body)
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json; charset=utf-8")
+	resp, err := r.client.Do(hreq.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("http error: %v", err)
+	} else if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	rec, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBytes))
+	msg := strings.TrimSpace(string(rec))
+	if resp.StatusCode == http.StatusForbidden && msg == graphstore.ErrReadOnly.Error() {
+		return nil, graphstore.ErrReadOnly
+	}
+	return nil, fmt.Errorf("remote %s error (code %d): %s", method, resp.StatusCode, msg)
+}
+
+func trimSlash(base string) string { return strings.TrimSuffix(base, "/") }
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package http exposes a GraphStore over HTTP as JSON, for consumers that
+// cannot use gRPC, and implements a GraphStore client of it, registered for
+// the "http" and "https" spec schemes.
+package http
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/entryfn"
+	"kythe.io/kythe/go/services/web"
+
+	"github.com/golang/protobuf/proto"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+const entriesType = "application/x-ndjson; charset=utf-8"
+
+// ErrorTrailer is the trailer of a /read or /scan response reporting the
+// error that ended the response early, if any.
+const ErrorTrailer = "Graphstore-Error"
+
+// RegisterHTTPHandlers registers JSON HTTP handlers with mux, under prefix
+// (e.g. "/graphstore", or "" for none), for the given GraphStore, as by
+// RegisterHTTPHandlersWithOptions with the default options.
+func RegisterHTTPHandlers(gs graphstore.Service, prefix string, mux *http.ServeMux) {
+	RegisterHTTPHandlersWithOptions(gs, prefix, mux, nil)
+}
+
+// RegisterHTTPHandlersWithOptions registers JSON HTTP handlers with mux, under
+// prefix (e.g. "/graphstore", or "" for none), for the given GraphStore:
+//
+//   POST prefix/read
+//     Request: JSON encoded storage.ReadRequest
+//     Response: newline-delimited JSON encoded storage.Entry messages
+//   POST prefix/scan[?limit=n][&fact_glob=g]...[&fact_regexp=re]
+//     Request: JSON encoded storage.ScanRequest
+//     Response: newline-delimited JSON encoded storage.Entry messages, at
+//       most n of them if the limit is given, restricted to the facts matching
+//       the graphstore.ScanFilter of the fact_glob and fact_regexp arguments
+//   GET prefix/scan[?target=uri][&edge_kind=k][&fact_prefix=p][&page_size=n][&page_token=t]
+//     Response: JSON object of "entries", a page of at most n (by default
+//       DefaultPageSize) JSON encoded storage.Entry messages, and, if more
+//       follow, "next_page_token", the page_token of the next page
+//   POST prefix/write
+//     Request: JSON encoded storage.WriteRequest
+//     Response: JSON encoded storage.WriteReply
+//   POST prefix/upload[?validate=b][&dedup=b][&batch_size=n][&batch_bytes=n]
+//     Request: delimited storage.Entry messages, optionally gzip encoded
+//     Response: JSON encoded UploadSummary (see Upload)
+//
+// The entries of a /read or /scan response are streamed, in a chunked
+// response, as the GraphStore delivers them; if the read fails once they have
+// begun, its error is reported by the response's ErrorTrailer.  A read ends
+// as soon as its caller disconnects.  An upload is batched into writes as it
+// is received; a corrupt entry ends it, reporting its byte offset in the
+// (decoded) stream, once the entries before it are written.
+//
+// A page token of GET /scan holds the position at which the next page begins,
+// so it remains valid across writes, and is signed (see HandlerOptions) for
+// the request that issued it.  A token that is corrupt, forged, from another
+// request, or older than its time to live is refused with status 400.  If opts
+// is nil, the defaults are used.
+func RegisterHTTPHandlersWithOptions(gs graphstore.Service, prefix string, mux *http.ServeMux, opts *HandlerOptions) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	pages := newPager(gs, opts)
+	mux.HandleFunc(prefix+"/read", func(w http.ResponseWriter, r *http.Request) {
+		var req spb.ReadRequest
+		if !readRequest(w, r, &req) {
+			return
+		}
+		writeEntries(w, r, -1, func(f graphstore.EntryFunc) error {
+			return gs.Read(r.Context(), &req, f)
+		})
+	})
+	mux.HandleFunc(prefix+"/scan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			pages.ServeHTTP(w, r)
+			return
+		} else if r.Method != "POST" {
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, r.Method+" not allowed; use GET or POST", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := -1
+		if arg := web.Arg(r, "limit"); arg != "" {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid limit: "+arg, http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		filter := &graphstore.ScanFilter{
+			FactGlobs:  r.URL.Query()["fact_glob"],
+			FactRegexp: web.Arg(r, "fact_regexp"),
+		}
+		m, err := graphstore.CompileScanFilter(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var req spb.ScanRequest
+		if !readRequest(w, r, &req) {
+			return
+		}
+		writeEntries(w, r, limit, func(f graphstore.EntryFunc) error {
+			return graphstore.ScanMatching(r.Context(), gs, &req, m, f)
+		})
+	})
+	mux.HandleFunc(prefix+"/write", func(w http.ResponseWriter, r *http.Request) {
+		var req spb.WriteRequest
+		if !readRequest(w, r, &req) {
+			return
+		}
+		if err := gs.Write(r.Context(), &req); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		if err := web.WriteResponse(w, r, &spb.WriteReply{}); err != nil {
+			log.Println(err)
+		}
+	})
+	mux.HandleFunc(prefix+"/upload", func(w http.ResponseWriter, r *http.Request) {
+		upload(w, r, gs)
+	})
+}
+
+// readRequest reads the JSON encoded body of a POST request into req.  If it
+// cannot, readRequest reports the error to w and returns false.
+func readRequest(w http.ResponseWriter, r *http.Request, req proto.Message) bool {
+	if !allowPost(w, r) {
+		return false
+	} else if err := web.ReadJSONBody(r, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// allowPost reports whether r is a POST request, reporting to w if not.
+func allowPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, r.Method+" not allowed; use POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// writeEntries writes the entries that read delivers, up to limit (if ≥ 0), to
+// w, one JSON encoded entry per line.
+func writeEntries(w http.ResponseWriter, r *http.Request, limit int, read func(graphstore.EntryFunc) error) {
+	w.Header().Set("Content-Type", entriesType)
+	w.Header().Set("Trailer", ErrorTrailer)
+	if limit == 0 {
+		return
+	}
+	counter := entryfn.Counter(func(e *spb.Entry) error {
+		if err := web.JSONMarshaler.Marshal(w, e); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	})
+	f := counter.Entry
+	if limit > 0 {
+		f = entryfn.Limit(limit, f)
+	}
+	err := read(f)
+	n := counter.Count()
+	if err == nil || r.Context().Err() != nil {
+		return // done, or the caller is gone
+	} else if n == 0 {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	log.Printf("Error after %d entries from %s: %v", n, r.URL.Path, err)
+	w.Header().Set(ErrorTrailer, err.Error())
+}
+
+// errorStatus returns the HTTP status reporting err from a GraphStore.
+func errorStatus(err error) int {
+	if err == graphstore.ErrReadOnly {
+		return http.StatusForbidden
+	} else if err == graphstore.ErrUnsupported {
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,600 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/platform/delimited"
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/inmemory"
+	gstest "kythe.io/kythe/go/test/services/graphstore"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	_ "kythe.io/kythe/go/services/graphstore/proxy"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+var ctx = context.Background()
+
+const prefix = "/graphstore"
+
+// serve starts an HTTP server for gs and returns the base URL of its handlers
+// and a function to stop it.
+func serve(gs graphstore.Service) (string, func()) {
+	return serveWithOptions(gs, nil)
+}
+
+// serveWithOptions is serve with the given handler options.
+func serveWithOptions(gs graphstore.Service, opts *HandlerOptions) (string, func()) {
+	mux := http.NewServeMux()
+	RegisterHTTPHandlersWithOptions(gs, prefix, mux, opts)
+	s := httptest.NewServer(mux)
+	return s.URL + prefix, s.Close
+}
+
+func write(t *testing.T, gs graphstore.Service, sig string, n int) {
+	req := &spb.WriteRequest{Source: &spb.VName{Signature: sig}}
+	for i := 0; i < n; i++ {
+		req.Update = append(req.Update, &spb.WriteRequest_Update{
+			FactName:  "/fact/" + string('a'+rune(i)),
+			FactValue: []byte(sig),
+		})
+	}
+	if err := gs.Write(ctx, req); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	gstest.OrderTest(t, func() (gstest.Service, gstest.DestroyFunc, error) {
+		base, stop := serve(inmemory.Create())
+		return NewService(base, nil), func() error { stop(); return nil }, nil
+	}, 4)
+}
+
+func TestScanLimit(t *testing.T) {
+	gs := inmemory.Create()
+	write(t, gs, "node", 10)
+	base, stop := serve(gs)
+	defer stop()
+
+	for _, test := range []struct {
+		query string
+		want  int
+	}{
+		{"", 10},
+		{"?limit=0", 0},
+		{"?limit=3", 3},
+		{"?limit=20", 10},
+	} {
+		resp, err := http.Post(base+"/scan"+test.query, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatalf("POST /scan%s: %v", test.query, err)
+		} else if resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST /scan%s: status %s", test.query, resp.Status)
+		}
+		var n int
+		s := bufio.NewScanner(resp.Body)
+		for s.Scan() {
+			var e spb.Entry
+			if err := jsonpb.UnmarshalString(s.Text(), &e); err != nil {
+				t.Errorf("POST /scan%s: bad entry line %q: %v", test.query, s.Text(), err)
+			}
+			n++
+		}
+		resp.Body.Close()
+		if n != test.want {
+			t.Errorf("POST /scan%s: got %d entries; want %d", test.query, n, test.want)
+		}
+	}
+
+	resp, err := http.Post(base+"/scan?limit=-1", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /scan?limit=-1: status %s; want %d", resp.Status, http.StatusBadRequest)
+	}
+}
+
+func TestScanFilter(t *testing.T) {
+	gs := inmemory.Create()
+	write(t, gs, "node", 5)
+	base, stop := serve(gs)
+	defer stop()
+
+	// The handler matches the filter itself.
+	query := "?" + url.Values{"fact_glob": {"/fact/?"}, "fact_regexp": {"/fact/[ab]"}}.Encode()
+	resp, err := http.Post(base+"/scan"+query, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("POST /scan%s: %v", query, err)
+	} else if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /scan%s: status %s", query, resp.Status)
+	}
+	var n int
+	for s := bufio.NewScanner(resp.Body); s.Scan(); n++ {
+	}
+	resp.Body.Close()
+	if n != 2 {
+		t.Errorf("POST /scan%s: got %d entries; want 2", query, n)
+	}
+
+	remote := NewService(base, nil)
+	if _, ok := remote.(graphstore.FilterScanner); !ok {
+		t.Fatal("remote Service is not a FilterScanner")
+	}
+	var facts []string
+	if err := graphstore.FilteredScan(ctx, remote, new(spb.ScanRequest), &graphstore.ScanFilter{
+		FactGlobs:  []string{"/fact/?"},
+		FactRegexp: "/fact/[^c]",
+	}, func(e *spb.Entry) error {
+		facts = append(facts, e.FactName)
+		return nil
+	}); err != nil {
+		t.Errorf("FilteredScan: %v", err)
+	} else if want := []string{"/fact/a", "/fact/b", "/fact/d", "/fact/e"}; !reflect.DeepEqual(facts, want) {
+		t.Errorf("FilteredScan: got facts %v; want %v", facts, want)
+	}
+
+	resp, err = http.Post(base+"/scan?fact_regexp=(", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /scan?fact_regexp=(: status %s; want %d", resp.Status, http.StatusBadRequest)
+	}
+}
+
+// endlessStore is a graphstore.Service whose Scans deliver entries until their
+// context is done.
+type endlessStore struct {
+	graphstore.Service
+	stopped chan struct{}
+}
+
+func (s *endlessStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	defer close(s.stopped)
+	e := &spb.Entry{Source: &spb.VName{Signature: "node"}, FactName: "/fact"}
+	for ctx.Err() == nil {
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func TestScanStreams(t *testing.T) {
+	srv := &endlessStore{inmemory.Create(), make(chan struct{})}
+	base, stop := serve(srv)
+	defer stop()
+
+	var n int
+	if err := NewService(base, nil).Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		n++
+		return io.EOF
+	}); err != nil {
+		t.Errorf("Scan: %v", err)
+	} else if n != 1 {
+		t.Errorf("Scan passed %d entries after io.EOF; want 1", n)
+	}
+	select {
+	case <-srv.stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("Server Scan still running after the client stopped")
+	}
+}
+
+var errScan = errors.New("disk on fire")
+
+// failingStore is a graphstore.Service whose Scans fail after one entry.
+type failingStore struct{ graphstore.Service }
+
+func (s failingStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	if err := f(&spb.Entry{Source: &spb.VName{Signature: "node"}}); err != nil {
+		return err
+	}
+	return errScan
+}
+
+func (s failingStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	return errScan
+}
+
+func TestErrors(t *testing.T) {
+	base, stop := serve(failingStore{inmemory.Create()})
+	defer stop()
+	gs := NewService(base, nil)
+
+	var n int
+	err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		n++
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), errScan.Error()) {
+		t.Errorf("Scan: got error %v; want one reporting %q", err, errScan)
+	} else if n != 1 {
+		t.Errorf("Scan passed %d entries before failing; want 1", n)
+	}
+
+	err = gs.Read(ctx, &spb.ReadRequest{Source: &spb.VName{Signature: "node"}}, func(*spb.Entry) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "code 500") || !strings.Contains(err.Error(), errScan.Error()) {
+		t.Errorf("Read: got error %v; want a code 500 reporting %q", err, errScan)
+	}
+
+	resp, err := http.Get(base + "/read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /read: status %s; want %d", resp.Status, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	base, stop := serve(graphstore.ReadOnly(inmemory.Create()))
+	defer stop()
+	if err := NewService(base, nil).Write(ctx, &spb.WriteRequest{Source: &spb.VName{Signature: "node"}}); err != graphstore.ErrReadOnly {
+		t.Errorf("Write: got error %v; want %v", err, graphstore.ErrReadOnly)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	a, b := inmemory.Create(), inmemory.Create()
+	write(t, a, "a", 2)
+	write(t, b, "b", 3)
+	baseA, stopA := serve(a)
+	defer stopA()
+	baseB, stopB := serve(b)
+	defer stopB()
+
+	gs, err := graphstore.Open(ctx, "proxy:"+baseA+","+baseB)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer gs.Close(ctx)
+	var n int
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan: %v", err)
+	} else if n != 5 {
+		t.Errorf("Scan through proxy: got %d entries; want 5", n)
+	}
+}
+
+// encode returns the delimited encoding of n entries of the source sig, the
+// offset of each, and the offset of its end.
+func encode(t *testing.T, sig string, n int) ([]byte, []int) {
+	var buf bytes.Buffer
+	var offsets []int
+	wr := delimited.NewWriter(&buf)
+	for i := 0; i < n; i++ {
+		offsets = append(offsets, buf.Len())
+		if err := wr.PutProto(&spb.Entry{
+			Source:    &spb.VName{Signature: sig},
+			FactName:  "/fact/" + string('a'+rune(i)),
+			FactValue: []byte(sig),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes(), append(offsets, buf.Len())
+}
+
+func TestUpload(t *testing.T) {
+	gs := inmemory.Create()
+	base, stop := serve(gs)
+	defer stop()
+
+	data, _ := encode(t, "node", 8)
+	var invalid bytes.Buffer
+	wr := delimited.NewWriter(&invalid)
+	for _, e := range []*spb.Entry{
+		{FactName: "/fact"}, // no source
+		{Source: &spb.VName{Signature: "node"}, FactName: "no-slash"}, // bad fact name
+	} {
+		if err := wr.PutProto(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data = append(data, invalid.Bytes()...)
+
+	for _, gzip := range []bool{false, true} {
+		s, err := Upload(ctx, base, nil, bytes.NewReader(data), &UploadOptions{
+			Validate:  true,
+			BatchSize: 3,
+			Gzip:      gzip,
+		})
+		if err != nil {
+			t.Fatalf("Upload (gzip %v): %v", gzip, err)
+		}
+		want := &UploadSummary{
+			Received: 10,
+			Written:  8,
+			Rejected: 2,
+			Violations: map[graphstore.ValidationRule]int64{
+				graphstore.RuleEmptySource: 1,
+				graphstore.RuleFactName:    1,
+			},
+		}
+		if !reflect.DeepEqual(s, want) {
+			t.Errorf("Upload (gzip %v) summary: got %+v; want %+v", gzip, s, want)
+		}
+	}
+
+	var n int
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if n != 8 {
+		t.Errorf("Scanned %d entries after uploads; want 8", n)
+	}
+}
+
+func TestUploadCorrupt(t *testing.T) {
+	gs := inmemory.Create()
+	base, stop := serve(gs)
+	defer stop()
+
+	data, offsets := encode(t, "node", 3)
+	rec, err := proto.Marshal(&spb.Entry{FactName: "/fact"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A record whose varint length is intact but whose proto is cut short.
+	corrupt := append([]byte{byte(len(rec) - 1)}, rec[:len(rec)-1]...)
+	data = append(data, corrupt...)
+	more, _ := encode(t, "later", 2)
+	data = append(data, more...)
+
+	s, err := Upload(ctx, base, nil, bytes.NewReader(data), nil)
+	if want := fmt.Sprintf("byte offset %d", offsets[3]); err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("Upload: got error %v; want one reporting %q", err, want)
+	} else if s == nil || s.Received != 3 || s.Written != 3 {
+		t.Errorf("Upload summary: got %+v; want the 3 entries before the corrupt one received and written", s)
+	}
+	if n := countSource(t, gs, "later"); n != 0 {
+		t.Errorf("Read %d entries after the corrupt one; want 0", n)
+	}
+}
+
+func TestUploadReadOnly(t *testing.T) {
+	base, stop := serve(graphstore.ReadOnly(inmemory.Create()))
+	defer stop()
+	data, _ := encode(t, "node", 3)
+	if _, err := Upload(ctx, base, nil, bytes.NewReader(data), nil); err == nil || !strings.Contains(err.Error(), "code 403") {
+		t.Errorf("Upload: got error %v; want code 403", err)
+	}
+}
+
+func countSource(t *testing.T, gs graphstore.Service, sig string) int {
+	var n int
+	if err := gs.Read(ctx, &spb.ReadRequest{Source: &spb.VName{Signature: sig}}, func(*spb.Entry) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return n
+}
+
+// getPage returns the page of GET base/scan with the given query, failing t
+// unless its status is 200.
+func getPage(t *testing.T, base string, query url.Values) ([]*spb.Entry, string) {
+	resp, err := http.Get(base + "/scan?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /scan?%s: status %s", query.Encode(), resp.Status)
+	}
+	var page struct {
+		Entries       []json.RawMessage `json:"entries"`
+		NextPageToken string            `json:"next_page_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatalf("Decoding page: %v", err)
+	}
+	var entries []*spb.Entry
+	for _, rec := range page.Entries {
+		var e spb.Entry
+		if err := jsonpb.UnmarshalString(string(rec), &e); err != nil {
+			t.Fatalf("Decoding entry %s: %v", rec, err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, page.NextPageToken
+}
+
+// getPages returns the entries of every page of GET base/scan with the given
+// query, following each next_page_token.
+func getPages(t *testing.T, base string, query url.Values) []*spb.Entry {
+	var all []*spb.Entry
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("GET /scan did not end after 100 pages")
+		}
+		entries, next := getPage(t, base, query)
+		all = append(all, entries...)
+		if next == "" {
+			return all
+		}
+		query.Set("page_token", next)
+	}
+}
+
+func scanAll(t *testing.T, gs graphstore.Service, req *spb.ScanRequest) []*spb.Entry {
+	var all []*spb.Entry
+	if err := gs.Scan(ctx, req, func(e *spb.Entry) error {
+		all = append(all, e)
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	return all
+}
+
+func TestScanPages(t *testing.T) {
+	gs := inmemory.Create()
+	write(t, gs, "a", 4)
+	write(t, gs, "b", 5)
+	write(t, gs, "c", 2)
+	base, stop := serveWithOptions(gs, &HandlerOptions{PageTokenKey: []byte("key")})
+	defer stop()
+
+	tests := []struct {
+		query url.Values
+		req   *spb.ScanRequest
+	}{
+		{url.Values{"page_size": {"3"}}, new(spb.ScanRequest)},
+		{url.Values{"page_size": {"1"}}, new(spb.ScanRequest)},
+		{url.Values{"page_size": {"11"}}, new(spb.ScanRequest)},
+		{url.Values{}, new(spb.ScanRequest)},
+		{url.Values{"page_size": {"2"}, "fact_prefix": {"/fact/b"}}, &spb.ScanRequest{FactPrefix: "/fact/b"}},
+		{url.Values{"page_size": {"2"}, "target": {"kythe:#b"}}, &spb.ScanRequest{Target: &spb.VName{Signature: "b"}}},
+	}
+	for _, test := range tests {
+		q := test.query.Encode()
+		got, want := getPages(t, base, test.query), scanAll(t, gs, test.req)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GET /scan?%s: got %d entries %v; want %d %v", q, len(got), got, len(want), want)
+		}
+	}
+}
+
+func TestScanPageTokenAfterWrite(t *testing.T) {
+	gs := inmemory.Create()
+	write(t, gs, "b", 4)
+	base, stop := serve(gs)
+	defer stop()
+
+	query := url.Values{"page_size": {"2"}}
+	first, next := getPage(t, base, query)
+	if len(first) != 2 || next == "" {
+		t.Fatalf("First page: got %d entries and token %q; want 2 and a token", len(first), next)
+	}
+	write(t, gs, "a", 3) // before the page token
+	write(t, gs, "c", 3) // after it
+
+	query.Set("page_token", next)
+	rest := getPages(t, base, query)
+	seen := make(map[string]bool)
+	for _, e := range first {
+		seen[e.String()] = true
+	}
+	for _, e := range rest {
+		if e.Source.Signature == "a" {
+			t.Errorf("Page after a write returned %v, before its token", e)
+		} else if seen[e.String()] {
+			t.Errorf("Page after a write repeated %v", e)
+		}
+		seen[e.String()] = true
+	}
+	if want := 4 + 3; len(seen) != want {
+		t.Errorf("Pages returned %d distinct entries; want %d", len(seen), want)
+	}
+}
+
+func TestScanPageTokenErrors(t *testing.T) {
+	gs := inmemory.Create()
+	write(t, gs, "node", 4)
+	base, stop := serveWithOptions(gs, &HandlerOptions{PageTokenKey: []byte("key")})
+	defer stop()
+	_, token := getPage(t, base, url.Values{"page_size": {"1"}})
+	if token == "" {
+		t.Fatal("First page has no next_page_token")
+	}
+	tampered := []byte(token)
+	if tampered[20] == 'A' { // within the signature
+		tampered[20] = 'B'
+	} else {
+		tampered[20] = 'A'
+	}
+
+	expiringBase, stopExpiring := serveWithOptions(gs, &HandlerOptions{PageTokenKey: []byte("key"), PageTokenTTL: time.Millisecond})
+	defer stopExpiring()
+	_, expired := getPage(t, expiringBase, url.Values{"page_size": {"1"}})
+	time.Sleep(10 * time.Millisecond)
+
+	otherBase, stopOther := serveWithOptions(gs, &HandlerOptions{PageTokenKey: []byte("other key")})
+	defer stopOther()
+
+	tests := []struct {
+		base  string
+		query url.Values
+		want  string
+	}{
+		{base, url.Values{"page_token": {"garbage!"}}, errInvalidToken.Error()},
+		{base, url.Values{"page_token": {"c2hvcnQ"}}, errInvalidToken.Error()},
+		{base, url.Values{"page_token": {string(tampered)}}, errInvalidToken.Error()},
+		{base, url.Values{"page_token": {token}, "fact_prefix": {"/fact/"}}, errInvalidToken.Error()},
+		{expiringBase, url.Values{"page_token": {expired}}, errExpiredToken.Error()},
+		{otherBase, url.Values{"page_token": {token}}, errInvalidToken.Error()},
+		{base, url.Values{"page_size": {"0"}}, "invalid page_size"},
+		{base, url.Values{"page_size": {"many"}}, "invalid page_size"},
+		{base, url.Values{"target": {"kythe://%zz"}}, "invalid target"},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(test.base + "/scan?" + test.query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest || !strings.Contains(msg.String(), test.want) {
+			t.Errorf("GET /scan?%s: status %s %q; want %d reporting %q", test.query.Encode(), resp.Status, msg.String(), http.StatusBadRequest, test.want)
+		}
+	}
+
+	req, err := http.NewRequest("PUT", base+"/scan", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, POST" {
+		t.Errorf("PUT /scan: status %s, Allow %q; want %d, %q", resp.Status, resp.Header.Get("Allow"), http.StatusMethodNotAllowed, "GET, POST")
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/web"
+	"kythe.io/kythe/go/util/kytheuri"
+
+	"github.com/golang/protobuf/proto"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// DefaultPageSize is the number of entries of a page of GET /scan without a
+// page_size parameter.
+const DefaultPageSize = 100
+
+// MaxPageSize bounds the number of entries of a page of GET /scan.
+const MaxPageSize = 10000
+
+// DefaultPageTokenTTL is the default bound on the age of a page token.
+const DefaultPageTokenTTL = time.Hour
+
+// HandlerOptions configure the handlers registered by
+// RegisterHTTPHandlersWithOptions.
+type HandlerOptions struct {
+	// PageTokenKey, if non-empty, is the key with which the page tokens of GET
+	// /scan are signed, so that a client cannot forge a token to seek to an
+	// arbitrary position.  If empty, a token is only checked for corruption.
+	PageTokenKey []byte
+
+	// PageTokenTTL bounds the age of a page token; an older token is refused.
+	// If 0, DefaultPageTokenTTL is used; if negative, tokens do not expire.
+	PageTokenTTL time.Duration
+}
+
+var (
+	errInvalidToken = errors.New("invalid page token")
+	errExpiredToken = errors.New("expired page token; restart the scan")
+)
+
+// scanPage is the JSON response to GET /scan.
+type scanPage struct {
+	Entries       []json.RawMessage `json:"entries"`
+	NextPageToken string            `json:"next_page_token,omitempty"`
+}
+
+// pager serves the pages of GET /scan.
+type pager struct {
+	gs  graphstore.Service
+	key []byte
+	ttl time.Duration
+}
+
+func newPager(gs graphstore.Service, opts *HandlerOptions) *pager {
+	p := &pager{gs: gs, ttl: DefaultPageTokenTTL}
+	if opts != nil {
+		p.key = opts.PageTokenKey
+		if opts.PageTokenTTL != 0 {
+			p.ttl = opts.PageTokenTTL
+		}
+	}
+	return p
+}
+
+// ServeHTTP serves a page of GET /scan.
+func (p *pager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &spb.ScanRequest{
+		EdgeKind:   web.Arg(r, "edge_kind"),
+		FactPrefix: web.Arg(r, "fact_prefix"),
+	}
+	if arg := web.Arg(r, "target"); arg != "" {
+		u, err := kytheuri.Parse(arg)
+		if err != nil {
+			http.Error(w, "invalid target: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Target = u.VName()
+	}
+	size := DefaultPageSize
+	if arg := web.Arg(r, "page_size"); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid page_size: "+arg, http.StatusBadRequest)
+			return
+		} else if n < MaxPageSize {
+			size = n
+		} else {
+			size = MaxPageSize
+		}
+	}
+	token, err := p.parseToken(req, web.Arg(r, "page_token"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, next, err := graphstore.ScanPage(r.Context(), p.gs, req, size, token)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	page := scanPage{Entries: make([]json.RawMessage, len(entries))}
+	for i, e := range entries {
+		rec, err := web.JSONMarshaler.MarshalToString(e)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Entries[i] = json.RawMessage(rec)
+	}
+	if next != "" {
+		page.NextPageToken = p.token(req, next, time.Now())
+	}
+	if err := web.WriteJSONResponse(w, r, &page); err != nil {
+		log.Println(err)
+	}
+}
+
+// token returns the page token of the GraphStore page token next of req,
+// issued at now: the URL-safe base64 encoding of the time it was issued, its
+// signature, and next.
+func (p *pager) token(req *spb.ScanRequest, next string, now time.Time) string {
+	rec := make([]byte, 8, 8+sha256.Size+len(next))
+	binary.BigEndian.PutUint64(rec, uint64(now.UnixNano()))
+	rec = append(rec, p.sign(req, rec[:8], next)...)
+	rec = append(rec, next...)
+	return base64.RawURLEncoding.EncodeToString(rec)
+}
+
+// parseToken returns the GraphStore page token of a page token of req, which
+// may be empty for the first page.
+func (p *pager) parseToken(req *spb.ScanRequest, token string, now time.Time) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	rec, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(rec) < 8+sha256.Size {
+		return "", errInvalidToken
+	}
+	issued, sig, next := rec[:8], rec[8:8+sha256.Size], string(rec[8+sha256.Size:])
+	if !hmac.Equal(sig, p.sign(req, issued, next)) {
+		return "", errInvalidToken
+	}
+	if age := now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(issued)))); p.ttl > 0 && age > p.ttl {
+		return "", errExpiredToken
+	}
+	return next, nil
+}
+
+// sign returns the signature of a page token of req, issued at the encoded
+// time given, for the GraphStore page token next.
+func (p *pager) sign(req *spb.ScanRequest, issued []byte, next string) []byte {
+	rec, err := proto.Marshal(req)
+	if err != nil {
+		// Marshaling a ScanRequest cannot fail.
+		panic(err)
+	}
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(next)))
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(issued)
+	mac.Write(size[:]) // so that next and rec cannot trade bytes
+	mac.Write([]byte(next))
+	mac.Write(rec)
+	return mac.Sum(nil)
+}
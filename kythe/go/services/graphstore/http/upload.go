@@ -0,0 +1,281 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package http
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"kythe.io/kythe/go/platform/delimited"
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Defaults of the batching of uploaded entries.
+const (
+	DefaultUploadBatchSize  = 1024
+	DefaultUploadBatchBytes = 3 * 1024 * 1024
+)
+
+// An UploadSummary reports the outcome of an upload.
+type UploadSummary struct {
+	Received int64 `json:"received"` // entries decoded from the stream
+	Written  int64 `json:"written"`  // entries written to the GraphStore
+	Rejected int64 `json:"rejected"` // invalid entries skipped
+
+	// Violations counts the rejected entries by the rule they broke.
+	Violations map[graphstore.ValidationRule]int64 `json:"violations,omitempty"`
+
+	// Error reports why the upload ended early, if it did.  The entries
+	// received before then were written.
+	Error string `json:"error,omitempty"`
+}
+
+// UploadOptions configures an upload.
+type UploadOptions struct {
+	// Validate causes the server to skip the entries breaking a
+	// graphstore.ValidationRule, counting them as rejected.
+	Validate bool
+
+	// Dedup, BatchSize, and BatchBytes configure the server's batching of the
+	// entries into writes, as for graphstore.BatchOptions.  If 0, BatchSize
+	// and BatchBytes default to DefaultUploadBatchSize and
+	// DefaultUploadBatchBytes; if negative, they are unlimited.
+	Dedup                 bool
+	BatchSize, BatchBytes int
+
+	// Gzip causes the stream to be gzip encoded in transit.
+	Gzip bool
+}
+
+// Upload streams the delimited storage.Entry messages of r (see the
+// kythe.io/kythe/go/platform/delimited package) to the upload handler
+// registered under the URL base, which batches and writes them, and returns
+// its summary.  If the upload ends early, the summary is returned with the
+// error.  The requests are sent with client, or http.DefaultClient if nil.
+func Upload(ctx context.Context, base string, client *http.Client, r io.Reader, opts *UploadOptions) (*UploadSummary, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if opts == nil {
+		opts = new(UploadOptions)
+	}
+	q := make(url.Values)
+	if opts.Validate {
+		q.Set("validate", "true")
+	}
+	if opts.Dedup {
+		q.Set("dedup", "true")
+	}
+	if opts.BatchSize != 0 {
+		q.Set("batch_size", strconv.Itoa(opts.BatchSize))
+	}
+	if opts.BatchBytes != 0 {
+		q.Set("batch_bytes", strconv.Itoa(opts.BatchBytes))
+	}
+	u := trimSlash(base) + "/upload"
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	body := r
+	if opts.Gzip {
+		pr, pw := io.Pipe()
+		go func() {
+			gz := gzip.NewWriter(pw)
+			_, err := io.Copy(gz, r)
+			if cerr := gz.Close(); err == nil {
+				err = cerr
+			}
+			pw.CloseWithError(err)
+		}()
+		defer pr.Close()
+		body = pr
+	}
+	req, err := http.NewRequest("POST", u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if opts.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("http error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	rec, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading upload summary: %v", err)
+	}
+	var s UploadSummary
+	if err := json.Unmarshal(rec, &s); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("remote upload error (code %d): %s", resp.StatusCode, rec)
+		}
+		return nil, fmt.Errorf("error decoding upload summary: %v", err)
+	} else if resp.StatusCode != http.StatusOK || s.Error != "" {
+		return &s, fmt.Errorf("remote upload error (code %d): %s", resp.StatusCode, s.Error)
+	}
+	return &s, nil
+}
+
+// upload serves an upload of the entries of r to gs.
+func upload(w http.ResponseWriter, r *http.Request, gs graphstore.Service) {
+	if !allowPost(w, r) {
+		return
+	}
+	opts := &graphstore.BatchOptions{
+		MaxUpdates: DefaultUploadBatchSize,
+		MaxBytes:   DefaultUploadBatchBytes,
+	}
+	var validate bool
+	for name, p := range map[string]*int{"batch_size": &opts.MaxUpdates, "batch_bytes": &opts.MaxBytes} {
+		if arg := r.URL.Query().Get(name); arg != "" {
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %s", name, arg), http.StatusBadRequest)
+				return
+			}
+			*p = n
+		}
+	}
+	for name, p := range map[string]*bool{"validate": &validate, "dedup": &opts.Dedup} {
+		if arg := r.URL.Query().Get(name); arg != "" {
+			b, err := strconv.ParseBool(arg)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s: %s", name, arg), http.StatusBadRequest)
+				return
+			}
+			*p = b
+		}
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid gzip stream: %v", err), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	u := &uploader{validate: validate}
+	entries := make(chan *spb.Entry)
+	decodeErr := make(chan error, 1)
+	go func() {
+		defer close(entries)
+		decodeErr <- u.decode(ctx, body, entries)
+	}()
+
+	writes, batchErr := graphstore.BatchWritesContext(ctx, entries, opts)
+	var writeErr error
+	for req := range writes {
+		if err := gs.Write(ctx, req); err != nil {
+			writeErr = err
+			cancel() // stops the decoding and batching
+			break
+		}
+		u.mu.Lock()
+		u.s.Written += int64(len(req.Update))
+		u.mu.Unlock()
+	}
+
+	status := http.StatusOK
+	if writeErr != nil {
+		// The decoder may be blocked reading the body, so it is not awaited.
+		status = errorStatus(writeErr)
+		u.fail(fmt.Errorf("write failed: %v", writeErr))
+	} else if err := <-batchErr; err != nil {
+		status = http.StatusInternalServerError
+		u.fail(err)
+	} else if err := <-decodeErr; err != nil {
+		status = http.StatusBadRequest
+		u.fail(err)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&u.s)
+}
+
+// An uploader decodes the entries of an upload, keeping its summary.
+type uploader struct {
+	validate bool
+
+	mu sync.Mutex
+	s  UploadSummary
+}
+
+// decode sends the entries of r, less the invalid ones if u.validate is set,
+// on entries until r is exhausted or ctx is done.
+func (u *uploader) decode(ctx context.Context, r io.Reader, entries chan<- *spb.Entry) error {
+	rd := delimited.NewReader(r)
+	for {
+		e := new(spb.Entry)
+		if err := rd.NextProto(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("corrupt entry at byte offset %d: %v", rd.Offset(), err)
+		}
+		u.mu.Lock()
+		u.s.Received++
+		if u.validate {
+			if err := graphstore.ValidateEntry(e); err != nil {
+				u.s.Rejected++
+				if u.s.Violations == nil {
+					u.s.Violations = make(map[graphstore.ValidationRule]int64)
+				}
+				u.s.Violations[err.(*graphstore.ValidationError).Rule]++
+				u.mu.Unlock()
+				continue
+			}
+		}
+		u.mu.Unlock()
+
+		select {
+		case entries <- e:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fail records err as the reason the upload ended early.
+func (u *uploader) fail(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.s.Error = err.Error()
+}
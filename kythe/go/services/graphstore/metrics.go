@@ -0,0 +1,218 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// MetricsSink receives a record of each call made through a metered Service.
+// Implementations must be safe for concurrent use.
+type MetricsSink interface {
+	// ObserveCall records a call to the named Service method that took the
+	// given latency, delivered the given number of entries (always 0 for
+	// non-streaming methods), and returned err.
+	ObserveCall(method string, latency time.Duration, entries int64, err error)
+}
+
+// WriteMetricsSink is an optional interface for a MetricsSink that also
+// receives the size of each successful Write made through a metered Service.
+type WriteMetricsSink interface {
+	MetricsSink
+
+	// ObserveWrite records a Write of a request whose encoding was the given
+	// number of bytes.
+	ObserveWrite(bytes int64)
+}
+
+// NewMeteredService returns a Service that reports each call made to s to the
+// given sink.  If s is Sharded, so is the returned Service.  If sink is nil, s
+// is returned unchanged.
+func NewMeteredService(s Service, sink MetricsSink) Service {
+	if sink == nil {
+		return s
+	}
+	m := &meteredService{s, sink}
+	if sh, ok := s.(Sharded); ok {
+		return &meteredSharded{m, sh}
+	}
+	return m
+}
+
+type meteredService struct {
+	s    Service
+	sink MetricsSink
+}
+
+func (m *meteredService) observe(method string, start time.Time, entries int64, err error) {
+	m.sink.ObserveCall(method, time.Since(start), entries, err)
+}
+
+// Read implements part of the Service interface.
+func (m *meteredService) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	start := time.Now()
+	var num int64
+	err := m.s.Read(ctx, req, func(e *spb.Entry) error {
+		num++
+		return f(e)
+	})
+	m.observe("Read", start, num, err)
+	return err
+}
+
+// Scan implements part of the Service interface.
+func (m *meteredService) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	start := time.Now()
+	var num int64
+	err := m.s.Scan(ctx, req, func(e *spb.Entry) error {
+		num++
+		return f(e)
+	})
+	m.observe("Scan", start, num, err)
+	return err
+}
+
+// Write implements part of the Service interface.
+func (m *meteredService) Write(ctx context.Context, req *spb.WriteRequest) error {
+	start := time.Now()
+	err := m.s.Write(ctx, req)
+	m.observe("Write", start, 0, err)
+	if ws, ok := m.sink.(WriteMetricsSink); ok && err == nil {
+		ws.ObserveWrite(int64(proto.Size(req)))
+	}
+	return err
+}
+
+// Close implements part of the Service interface.
+func (m *meteredService) Close(ctx context.Context) error {
+	start := time.Now()
+	err := m.s.Close(ctx)
+	m.observe("Close", start, 0, err)
+	return err
+}
+
+// CheckHealth implements the HealthChecker interface by checking the health of
+// the underlying Service, unmetered, so that probes are not counted as calls.
+func (m *meteredService) CheckHealth(ctx context.Context) error { return CheckHealth(ctx, m.s) }
+
+// ScansOrdered implements the OrderedScanner interface.
+func (m *meteredService) ScansOrdered() bool { return ScansOrdered(m.s) }
+
+type meteredSharded struct {
+	*meteredService
+	sh Sharded
+}
+
+// Count implements part of the Sharded interface.
+func (m *meteredSharded) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	start := time.Now()
+	n, err := m.sh.Count(ctx, req)
+	m.observe("Count", start, 0, err)
+	return n, err
+}
+
+// Shard implements part of the Sharded interface.
+func (m *meteredSharded) Shard(ctx context.Context, req *spb.ShardRequest, f EntryFunc) error {
+	start := time.Now()
+	var num int64
+	err := m.sh.Shard(ctx, req, func(e *spb.Entry) error {
+		num++
+		return f(e)
+	})
+	m.observe("Shard", start, num, err)
+	return err
+}
+
+// LatencyBuckets is the number of buckets in each MethodMetrics latency
+// histogram.
+const LatencyBuckets = 24
+
+// MethodMetrics are the metrics recorded by Metrics for a single method.
+type MethodMetrics struct {
+	Calls   int64 `json:"calls"`
+	Errors  int64 `json:"errors"`
+	Entries int64 `json:"entries"`
+
+	// TotalLatency is the sum of the latencies of all calls.
+	TotalLatency time.Duration `json:"total_latency_ns"`
+
+	// Latency is a histogram of call latencies.  Bucket i counts the calls
+	// taking less than 2^i microseconds (and at least 2^(i-1) microseconds);
+	// the last bucket also counts all longer calls.
+	Latency [LatencyBuckets]int64 `json:"latency_us_log2"`
+}
+
+// Metrics is a simple in-memory MetricsSink.  It implements expvar.Var so that
+// it can be published alongside a binary's other variables.
+type Metrics struct {
+	mu      sync.Mutex
+	methods map[string]*MethodMetrics
+}
+
+// NewMetrics returns an empty Metrics.
+func NewMetrics() *Metrics { return &Metrics{methods: make(map[string]*MethodMetrics)} }
+
+// ObserveCall implements the MetricsSink interface.
+func (m *Metrics) ObserveCall(method string, latency time.Duration, entries int64, err error) {
+	bucket := 0
+	for us := latency / time.Microsecond; us > 0 && bucket < LatencyBuckets-1; us >>= 1 {
+		bucket++
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mm := m.methods[method]
+	if mm == nil {
+		mm = new(MethodMetrics)
+		m.methods[method] = mm
+	}
+	mm.Calls++
+	if err != nil {
+		mm.Errors++
+	}
+	mm.Entries += entries
+	mm.TotalLatency += latency
+	mm.Latency[bucket]++
+}
+
+// Snapshot returns a copy of the current metrics for each observed method.
+func (m *Metrics) Snapshot() map[string]MethodMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := make(map[string]MethodMetrics, len(m.methods))
+	for method, mm := range m.methods {
+		snap[method] = *mm
+	}
+	return snap
+}
+
+// String implements the expvar.Var interface by returning m's Snapshot encoded
+// as JSON.
+func (m *Metrics) String() string {
+	rec, err := json.Marshal(m.Snapshot())
+	if err != nil {
+		return "{}"
+	}
+	return string(rec)
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// MirroredService is a Service that reads from a primary Service and writes
+// to both the primary and each of a set of mirror Services.  Other optional
+// interfaces of the primary are hidden.
+type MirroredService struct {
+	// Service is the primary Service, which serves all reads.
+	Service
+
+	// FailOnMirrorError controls whether a Write fails if it fails for a
+	// mirror.  If false, mirror failures are logged and counted (see
+	// MirrorFailures) but do not fail the Write.  A Write always fails if it
+	// fails for the primary.
+	FailOnMirrorError bool
+
+	// Workers is the maximum number of concurrent writes to the mirrors,
+	// across all Writes.  If ≤ 0, each mirror may be written concurrently.
+	// It must not be changed after the first Write.
+	Workers int
+
+	mirrors  []Service
+	failures []int64
+
+	semOnce sync.Once
+	sem     chan struct{}
+}
+
+// NewMirroredService returns a MirroredService that reads from primary and
+// writes to primary and each of the given mirrors.
+func NewMirroredService(primary Service, mirrors ...Service) *MirroredService {
+	return &MirroredService{
+		Service:  primary,
+		mirrors:  mirrors,
+		failures: make([]int64, len(mirrors)),
+	}
+}
+
+// MirrorFailures returns the number of failed writes to each mirror, in the
+// order the mirrors were given to NewMirroredService.
+func (m *MirroredService) MirrorFailures() []int64 {
+	counts := make([]int64, len(m.failures))
+	for i := range m.failures {
+		counts[i] = atomic.LoadInt64(&m.failures[i])
+	}
+	return counts
+}
+
+// Write implements part of the Service interface.  The request is written to
+// the primary concurrently with the mirrors.
+func (m *MirroredService) Write(ctx context.Context, req *spb.WriteRequest) error {
+	m.semOnce.Do(func() {
+		workers := m.Workers
+		if workers <= 0 {
+			workers = len(m.mirrors)
+		}
+		m.sem = make(chan struct{}, workers)
+	})
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(m.mirrors))
+	)
+	wg.Add(len(m.mirrors))
+	for i, mirror := range m.mirrors {
+		go func(i int, mirror Service) {
+			defer wg.Done()
+			select {
+			case m.sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-m.sem }()
+			errs[i] = mirror.Write(ctx, req)
+		}(i, mirror)
+	}
+	err := m.Service.Write(ctx, req)
+	wg.Wait()
+
+	var merr MultiError
+	if err != nil {
+		merr = append(merr, err)
+	}
+	for i, e := range errs {
+		if e == nil {
+			continue
+		}
+		atomic.AddInt64(&m.failures[i], 1)
+		if m.FailOnMirrorError {
+			merr = append(merr, fmt.Errorf("mirror %d: %v", i, e))
+		} else {
+			log.Printf("WARNING: write to mirror %d failed: %v", i, e)
+		}
+	}
+	if len(merr) == 1 && err != nil {
+		return err
+	} else if len(merr) > 0 {
+		return merr
+	}
+	return nil
+}
+
+// Close implements part of the Service interface by closing the primary and
+// each mirror.  All failures are returned together as a MultiError.
+func (m *MirroredService) Close(ctx context.Context) error {
+	var errs MultiError
+	for _, s := range append([]Service{m.Service}, m.mirrors...) {
+		if err := s.Close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// MultiReader is an optional interface for a Service that can efficiently
+// satisfy many ReadRequests at once.
+type MultiReader interface {
+	Service
+
+	// ReadMultiple calls f with each entry matching any of the given
+	// ReadRequests.  The entries for each request are delivered contiguously,
+	// but the order in which requests are satisfied is unspecified.  A failed
+	// request does not prevent the others from being satisfied; all such
+	// failures are returned together as a MultiError.
+	ReadMultiple(ctx context.Context, reqs []*spb.ReadRequest, f EntryFunc) error
+}
+
+// A MultiError is a collection of errors from independent operations.
+type MultiError []error
+
+// Error implements the error interface.
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors: [%s]", len(e), strings.Join(msgs, "; "))
+}
+
+// ReadMultiple calls f with each entry matching any of reqs.  If s implements
+// MultiReader, its implementation is used.  Otherwise, the requests are issued
+// to s concurrently using up to workers goroutines and each request's results
+// are delivered contiguously, in the order of reqs.  Errors from individual
+// Reads do not prevent the delivery of other results; they are returned
+// together as a MultiError once all requests are complete.
+func ReadMultiple(ctx context.Context, s Service, reqs []*spb.ReadRequest, workers int, f EntryFunc) error {
+	if mr, ok := s.(MultiReader); ok {
+		return mr.ReadMultiple(ctx, reqs, f)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		entries []*spb.Entry
+		err     error
+	}
+	results := make([]chan result, len(reqs))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	// Each worker slot is held from the start of a Read until its results have
+	// been delivered, bounding the number of buffered results to workers.
+	slots := make(chan struct{}, workers)
+	go func() {
+		for i, req := range reqs {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int, req *spb.ReadRequest) {
+				var res result
+				res.err = s.Read(ctx, req, func(e *spb.Entry) error {
+					res.entries = append(res.entries, e)
+					return nil
+				})
+				results[i] <- res
+			}(i, req)
+		}
+	}()
+
+	var errs MultiError
+	for i, req := range reqs {
+		var res result
+		select {
+		case res = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		<-slots
+
+		if res.err != nil {
+			errs = append(errs, fmt.Errorf("read error for %v: %v", req.Source, res.err))
+			continue
+		}
+		for _, e := range res.entries {
+			if err := f(e); err == io.EOF {
+				return errs.orNil()
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return errs.orNil()
+}
+
+func (e MultiError) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package nettrace implements a graphstore.Tracer using the
+// golang.org/x/net/trace package.  Traced calls are shown at /debug/requests
+// on the binary's default HTTP server.
+package nettrace
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+// Tracer is a graphstore.Tracer that creates a trace.Trace for each call.
+type Tracer struct {
+	// Family is the trace family of each call (e.g. "graphstore").  The
+	// method name is used as the title of each trace.
+	Family string
+}
+
+// New returns a Tracer for the given family.
+func New(family string) *Tracer { return &Tracer{Family: family} }
+
+// StartSpan implements the graphstore.Tracer interface.  Each span is given a
+// random identifier that becomes the graphstore.TraceParent of ctx; the trace
+// of a span with a parent records the parent's identifier.
+func (t *Tracer) StartSpan(ctx context.Context, method string, req proto.Message) (context.Context, func(error, int)) {
+	tr := trace.New(t.Family, method)
+	span := fmt.Sprintf("%016x", uint64(rand.Int63()))
+	if parent := graphstore.TraceParent(ctx); parent != "" {
+		tr.LazyPrintf("span %s (parent %s)", span, parent)
+	} else {
+		tr.LazyPrintf("span %s", span)
+	}
+	if req != nil {
+		tr.LazyLog(req, false)
+	}
+
+	ctx = trace.NewContext(graphstore.WithTraceParent(ctx, span), tr)
+	return ctx, func(err error, entries int) {
+		if entries > 0 {
+			tr.LazyPrintf("delivered %d entries", entries)
+		}
+		if err != nil && err != io.EOF {
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError()
+		}
+		tr.Finish()
+	}
+}
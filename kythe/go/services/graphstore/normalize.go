@@ -0,0 +1,217 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"sort"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Normalized returns a Service that normalizes (see compare.NormalizeVName)
+// the source and target VNames of each request before passing it to s, so that
+// entries written through it are stored, and may be read back, under their
+// normalized VNames.  Entries read from s are delivered unchanged.  If s is
+// Sharded, so is the returned Service.  The returned Service is also a
+// PagedScanner, ResumableScanner, HealthChecker, and Deleter, each passing its
+// normalized requests through to s as by the package function of the same name
+// (ScanPage, ScanFrom, or CheckHealth); a Delete fails with ErrUnsupported
+// unless s is a Deleter.
+//
+// Normalization changes the identity of VNames, so a store should only be
+// wrapped once any entries it already holds are normalized; see
+// NormalizationCollisions.
+func Normalized(s Service, opts compare.NormalizeOptions) Service {
+	ns := &normalizedService{s, opts}
+	if sh, ok := s.(Sharded); ok {
+		return &normalizedSharded{ns, sh}
+	}
+	return ns
+}
+
+type normalizedService struct {
+	s    Service
+	opts compare.NormalizeOptions
+}
+
+func (n *normalizedService) normalize(v *spb.VName) *spb.VName {
+	return compare.NormalizeVName(v, n.opts)
+}
+
+// Read implements part of the Service interface.
+func (n *normalizedService) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	if src := n.normalize(req.Source); src != req.Source {
+		req = &spb.ReadRequest{Source: src, EdgeKind: req.EdgeKind}
+	}
+	return n.s.Read(ctx, req, f)
+}
+
+// Scan implements part of the Service interface.
+func (n *normalizedService) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	return n.s.Scan(ctx, n.normalizeScan(req), f)
+}
+
+// normalizeScan returns req with its Target normalized.
+func (n *normalizedService) normalizeScan(req *spb.ScanRequest) *spb.ScanRequest {
+	if tgt := n.normalize(req.Target); tgt != req.Target {
+		return &spb.ScanRequest{Target: tgt, EdgeKind: req.EdgeKind, FactPrefix: req.FactPrefix}
+	}
+	return req
+}
+
+// ScanPage implements the PagedScanner interface.
+func (n *normalizedService) ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	return ScanPage(ctx, n.s, n.normalizeScan(req), pageSize, token)
+}
+
+// ScanFrom implements the ResumableScanner interface.  The entries of s are
+// stored under normalized VNames, so after is passed through unchanged.
+func (n *normalizedService) ScanFrom(ctx context.Context, req *spb.ScanRequest, after *spb.Entry, f EntryFunc) error {
+	return ScanFrom(ctx, n.s, n.normalizeScan(req), after, f)
+}
+
+// Write implements part of the Service interface.
+func (n *normalizedService) Write(ctx context.Context, req *spb.WriteRequest) error {
+	norm := &spb.WriteRequest{
+		Source: n.normalize(req.Source),
+		Update: make([]*spb.WriteRequest_Update, len(req.Update)),
+	}
+	for i, u := range req.Update {
+		if tgt := n.normalize(u.Target); tgt != u.Target {
+			u = &spb.WriteRequest_Update{
+				EdgeKind:  u.EdgeKind,
+				Target:    tgt,
+				FactName:  u.FactName,
+				FactValue: u.FactValue,
+			}
+		}
+		norm.Update[i] = u
+	}
+	return n.s.Write(ctx, norm)
+}
+
+// Delete implements the Deleter interface.
+func (n *normalizedService) Delete(ctx context.Context, req *DeleteRequest) error {
+	d, ok := n.s.(Deleter)
+	if !ok {
+		return ErrUnsupported
+	}
+	return d.Delete(ctx, &DeleteRequest{
+		Source:   n.normalize(req.Source),
+		EdgeKind: req.EdgeKind,
+		FactName: req.FactName,
+		Target:   n.normalize(req.Target),
+	})
+}
+
+// CheckHealth implements the HealthChecker interface.
+func (n *normalizedService) CheckHealth(ctx context.Context) error { return CheckHealth(ctx, n.s) }
+
+// ScansOrdered implements the OrderedScanner interface.
+func (n *normalizedService) ScansOrdered() bool { return ScansOrdered(n.s) }
+
+// Close implements part of the Service interface.
+func (n *normalizedService) Close(ctx context.Context) error { return n.s.Close(ctx) }
+
+type normalizedSharded struct {
+	*normalizedService
+	sh Sharded
+}
+
+// Count implements part of the Sharded interface.
+func (n *normalizedSharded) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	return n.sh.Count(ctx, req)
+}
+
+// Shard implements part of the Sharded interface.
+func (n *normalizedSharded) Shard(ctx context.Context, req *spb.ShardRequest, f EntryFunc) error {
+	return n.sh.Shard(ctx, req, f)
+}
+
+// NormalizationReport summarizes the effect of normalizing the source VNames
+// of a store.
+type NormalizationReport struct {
+	Sources   int64 // distinct source VNames
+	Changed   int64 // sources altered by normalization
+	Colliding int64 // sources that normalize to the same VName as another source
+	Groups    int64 // distinct normalized VNames shared by colliding sources
+}
+
+// NormalizationCollisions scans s to determine how many of its distinct source
+// VNames would collide if normalized with the given options, i.e. how many
+// separate nodes would be merged by wrapping s with Normalized.  If f is
+// non-nil, it is then called with each normalized VName shared by colliding
+// sources, in VNames order, along with those sources.  Every distinct source
+// of s is held in memory.
+func NormalizationCollisions(ctx context.Context, s Service, opts compare.NormalizeOptions, f func(normalized *spb.VName, sources []*spb.VName) error) (*NormalizationReport, error) {
+	var (
+		report NormalizationReport
+		groups = make(map[string][]*spb.VName)
+		last   *spb.VName
+	)
+	if err := s.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		if last != nil && compare.VNamesEqual(last, e.Source) {
+			return nil
+		}
+		last = e.Source
+		norm := compare.NormalizeVName(e.Source, opts)
+		key := string(compare.EncodeVName(norm))
+		for _, src := range groups[key] {
+			if compare.VNamesEqual(src, e.Source) {
+				return nil
+			}
+		}
+		report.Sources++
+		if norm != e.Source {
+			report.Changed++
+		}
+		switch len(groups[key]) {
+		case 0:
+		case 1:
+			report.Groups++
+			report.Colliding += 2
+		default:
+			report.Colliding++
+		}
+		groups[key] = append(groups[key], e.Source)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return &report, nil
+	}
+
+	var keys []string
+	for key, srcs := range groups {
+		if len(srcs) > 1 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		srcs := groups[key]
+		if err := f(compare.NormalizeVName(srcs[0], opts), srcs); err != nil {
+			return nil, err
+		}
+	}
+	return &report, nil
+}
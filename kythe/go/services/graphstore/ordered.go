@@ -0,0 +1,96 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"fmt"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// An EntrySource is a stream of entries that reports whether it is known to be
+// ordered, so that consumers requiring an ordered stream (such as
+// DedupOrdered or compare.MergeEntries) can check it first.
+type EntrySource interface {
+	// Entries calls f with each entry of the source in turn.
+	Entries(ctx context.Context, f EntryFunc) error
+
+	// Ordered reports whether Entries is known to deliver the entries in
+	// compare.ValueEntries order (see CheckOrdered).
+	Ordered() bool
+}
+
+// NewEntrySource returns an EntrySource whose Entries calls read and whose
+// Ordered returns ordered.
+func NewEntrySource(read func(ctx context.Context, f EntryFunc) error, ordered bool) EntrySource {
+	return funcSource{read, ordered}
+}
+
+type funcSource struct {
+	read    func(context.Context, EntryFunc) error
+	ordered bool
+}
+
+// Entries implements part of the EntrySource interface.
+func (s funcSource) Entries(ctx context.Context, f EntryFunc) error { return s.read(ctx, f) }
+
+// Ordered implements part of the EntrySource interface.
+func (s funcSource) Ordered() bool { return s.ordered }
+
+// ScanSource returns an EntrySource of the entries of s matching req, which is
+// Ordered if s ScansOrdered.
+func ScanSource(s Service, req *spb.ScanRequest) EntrySource {
+	return NewEntrySource(func(ctx context.Context, f EntryFunc) error {
+		return s.Scan(ctx, req, f)
+	}, ScansOrdered(s))
+}
+
+// An OrderError reports an entry of a stream that was out of order.
+type OrderError struct {
+	Index      int64 // the position of Next in the stream
+	Prev, Next *spb.Entry
+}
+
+// Error implements the error interface.
+func (e *OrderError) Error() string {
+	return fmt.Sprintf("entry %d is out of order: %v follows %v", e.Index, e.Next, e.Prev)
+}
+
+// CheckOrdered returns an EntryFunc passing each entry to next, but returning
+// an *OrderError instead for the first entry that does not follow its
+// predecessor in compare.Entries order, with entries of equal keys ordered by
+// fact value (i.e. compare.ValueEntries order, as sorted by entrystream
+// --sort).  Duplicate entries are allowed.  The returned EntryFunc is not safe
+// for concurrent use.
+func CheckOrdered(next EntryFunc) EntryFunc {
+	var (
+		last *spb.Entry
+		n    int64
+	)
+	return func(e *spb.Entry) error {
+		if last != nil && compare.ValueEntries(last, e) == compare.GT {
+			return &OrderError{Index: n, Prev: last, Next: e}
+		}
+		last = e
+		n++
+		return next(e)
+	}
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"bytes"
+	"io"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// An Overlay is a Service viewing the union of a read-only base Service and a
+// writable overlay Service.
+type Overlay interface {
+	OrderedScanner
+	Deleter
+
+	// Flatten writes each entry of the merged view to dst.
+	Flatten(ctx context.Context, dst Service) error
+}
+
+// tombstoneValue is the fact value of an overlay entry recording that the
+// entry with its key was deleted from the merged view.
+var tombstoneValue = []byte("\x00kythe.io/overlay/deleted\x00")
+
+// NewOverlay returns an Overlay merging the entries of base and overlay in
+// compare.Entries order, where an overlay entry replaces the base entry with
+// the same key.  Writes go only to overlay; base is never modified.  Deletes
+// are recorded in overlay as entries with a reserved fact value that mask the
+// deleted entries of both stores, so overlay must store arbitrary fact values.
+//
+// If both stores are FuncSharded with the same ShardFunc, so is the Overlay.
+// Scans and Shards of a store that is not an OrderedScanner are sorted with a
+// disksort before they are merged.
+func NewOverlay(base, overlay Service) Overlay {
+	o := &overlayService{base: base, overlay: overlay}
+	b, bok := base.(FuncSharded)
+	v, vok := overlay.(FuncSharded)
+	if bok && vok && b.ShardFunc() == v.ShardFunc() {
+		return &overlaySharded{o, b, v}
+	}
+	return o
+}
+
+type overlayService struct {
+	base, overlay Service
+}
+
+// Read implements part of the Service interface.
+func (o *overlayService) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	read := func(s Service) (entryIterator, error) {
+		var entries []*spb.Entry
+		if err := s.Read(ctx, req, func(e *spb.Entry) error {
+			entries = append(entries, e)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		compare.SortEntries(entries)
+		return &sliceIterator{entries}, nil
+	}
+	base, err := read(o.base)
+	if err != nil {
+		return err
+	}
+	overlay, err := read(o.overlay)
+	if err != nil {
+		return err
+	}
+	return mergeOverlay(base, overlay, f)
+}
+
+// Scan implements part of the Service interface.
+func (o *overlayService) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	return o.merge(ctx, func(ctx context.Context, s Service, f EntryFunc) error {
+		return s.Scan(ctx, req, f)
+	}, f)
+}
+
+// merge merges the entries delivered by scan for each of o's stores, and
+// delivers them to f.  The entries of a store are assumed to be ordered if its
+// Scans are.
+func (o *overlayService) merge(ctx context.Context, scan func(context.Context, Service, EntryFunc) error, f EntryFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	open := func(s Service) (entryIterator, error) {
+		return sortedScan(ctx, ScansOrdered(s), func(ctx context.Context, f EntryFunc) error {
+			return scan(ctx, s, f)
+		})
+	}
+	base, err := open(o.base)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	overlay, err := open(o.overlay)
+	if err != nil {
+		return err
+	}
+	defer overlay.Close()
+	return mergeOverlay(base, overlay, f)
+}
+
+// mergeOverlay delivers the entries of base and overlay to f in entry order,
+// preferring the overlay entry of each key and dropping tombstones (along with
+// the base entries they mask).  If f returns io.EOF, mergeOverlay stops and
+// returns nil.
+func mergeOverlay(base, overlay entryIterator, f EntryFunc) error {
+	eb, err := base.Next()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	eo, err := overlay.Next()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for eb != nil || eo != nil {
+		var (
+			e          *spb.Entry
+			advB, advO bool
+		)
+		switch {
+		case eo == nil || (eb != nil && compare.Entries(eb, eo) == compare.LT):
+			e, advB = eb, true
+		case eb == nil || compare.Entries(eb, eo) == compare.GT:
+			e, advO = eo, true
+		default:
+			e, advB, advO = eo, true, true
+		}
+		if e != eo || !bytes.Equal(e.FactValue, tombstoneValue) {
+			if err := f(e); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		if advB {
+			if eb, err = base.Next(); err != nil && err != io.EOF {
+				return err
+			}
+		}
+		if advO {
+			if eo, err = overlay.Next(); err != nil && err != io.EOF {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Write implements part of the Service interface by writing req to the
+// overlay.
+func (o *overlayService) Write(ctx context.Context, req *spb.WriteRequest) error {
+	return o.overlay.Write(ctx, req)
+}
+
+// Delete implements part of the Deleter interface by writing a tombstone to the
+// overlay for each selected entry of the merged view.
+func (o *overlayService) Delete(ctx context.Context, req *DeleteRequest) error {
+	wr := &spb.WriteRequest{Source: req.Source}
+	if err := o.Read(ctx, &spb.ReadRequest{Source: req.Source, EdgeKind: "*"}, func(e *spb.Entry) error {
+		if EntryMatchesDelete(req, e) {
+			wr.Update = append(wr.Update, &spb.WriteRequest_Update{
+				EdgeKind:  e.EdgeKind,
+				Target:    e.Target,
+				FactName:  e.FactName,
+				FactValue: tombstoneValue,
+			})
+		}
+		return nil
+	}); err != nil {
+		return err
+	} else if len(wr.Update) == 0 {
+		return nil
+	}
+	return o.overlay.Write(ctx, wr)
+}
+
+// ScansOrdered implements the OrderedScanner interface.  The merged Scans are
+// always ordered.
+func (o *overlayService) ScansOrdered() bool { return true }
+
+// Flatten implements part of the Overlay interface.
+func (o *overlayService) Flatten(ctx context.Context, dst Service) error {
+	return Copy(ctx, dst, o, nil)
+}
+
+// Close implements part of the Service interface by closing both stores.
+func (o *overlayService) Close(ctx context.Context) error {
+	err := o.overlay.Close(ctx)
+	if berr := o.base.Close(ctx); err == nil {
+		err = berr
+	}
+	return err
+}
+
+type overlaySharded struct {
+	*overlayService
+	base, overlay FuncSharded
+}
+
+// ShardFunc implements part of the FuncSharded interface.
+func (o *overlaySharded) ShardFunc() string { return o.base.ShardFunc() }
+
+// Count implements part of the Sharded interface.  Since an overlay entry may
+// replace or mask a base entry, the merged shard is read to count it.
+func (o *overlaySharded) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	var count int64
+	err := o.Shard(ctx, &spb.ShardRequest{Index: req.Index, Shards: req.Shards}, func(*spb.Entry) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// Shard implements part of the Sharded interface.  Since both stores assign
+// sources to shards with the same ShardFunc, the merged shard is the merge of
+// the corresponding shards of each store.
+func (o *overlaySharded) Shard(ctx context.Context, req *spb.ShardRequest, f EntryFunc) error {
+	if err := validShard(req.Index, req.Shards); err != nil {
+		return err
+	}
+	return o.merge(ctx, func(ctx context.Context, s Service, f EntryFunc) error {
+		return s.(Sharded).Shard(ctx, req, f)
+	}, f)
+}
+
+// sliceIterator is an entryIterator over a slice of sorted entries.
+type sliceIterator struct{ entries []*spb.Entry }
+
+// Next implements part of the entryIterator interface.
+func (i *sliceIterator) Next() (*spb.Entry, error) {
+	if len(i.entries) == 0 {
+		return nil, io.EOF
+	}
+	e := i.entries[0]
+	i.entries = i.entries[1:]
+	return e, nil
+}
+
+// Close implements part of the entryIterator interface.
+func (i *sliceIterator) Close() error { return nil }
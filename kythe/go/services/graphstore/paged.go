@@ -0,0 +1,168 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// PagedScanner is an optional interface for a Service that can natively
+// resume a Scan from an opaque page token.
+type PagedScanner interface {
+	Service
+
+	// ScanPage returns up to pageSize entries matching req, starting after the
+	// position encoded by token (or at the beginning of the scan if token is
+	// empty).  If more entries may follow, a non-empty token for the next page
+	// is also returned.  Tokens remain valid across process restarts for
+	// persistent stores.
+	ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error)
+}
+
+// ScanPage returns up to pageSize entries from s matching req that follow the
+// position denoted by token, along with a token for the next page (empty if
+// there are no further entries).  If s does not implement PagedScanner, the
+// page is found by re-scanning s from the beginning, relying on Scan
+// delivering entries in compare.Entries order; ErrUnsupported is returned if s
+// is not known to do so (see ScansOrdered).
+func ScanPage(ctx context.Context, s Service, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	if ps, ok := s.(PagedScanner); ok {
+		return ps.ScanPage(ctx, req, pageSize, token)
+	} else if !ScansOrdered(s) {
+		return nil, "", ErrUnsupported
+	}
+	after, err := ParsePageToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var page []*spb.Entry
+	if err := s.Scan(ctx, req, func(e *spb.Entry) error {
+		if after != nil && compare.Entries(e, after) != compare.GT {
+			return nil
+		}
+		page = append(page, e)
+		if len(page) > pageSize {
+			return io.EOF
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	return Page(page, pageSize)
+}
+
+// ResumableScanner is an optional interface for a Service that can natively
+// resume a Scan after a given entry.
+type ResumableScanner interface {
+	Service
+
+	// ScanFrom calls f with each entry matching req that strictly follows
+	// after in the order of the Service's Scan (or with every matching entry if
+	// after is nil), so that a Scan is resumed by its last entry.  For an
+	// OrderedScanner, this is compare.Entries order; otherwise, the position
+	// of an entry is defined by the implementation (e.g. corpus-major order).
+	// after need not exist in the store.
+	ScanFrom(ctx context.Context, req *spb.ScanRequest, after *spb.Entry, f EntryFunc) error
+}
+
+// ScanFrom calls f with each entry from s matching req that follows after in
+// compare.Entries order, ignoring fact values.  If after is nil, every
+// matching entry is scanned.  after need not still exist in s; the scan is
+// resumed at the next greater entry, so a caller may checkpoint a long Scan by
+// persisting the last entry it processed.  If s does not implement
+// ResumableScanner, s is scanned from the beginning and the preceding entries
+// are skipped, which requires that s ScansOrdered; otherwise, ErrUnsupported is
+// returned for a non-nil after.  A ResumableScanner whose Scan is not ordered
+// resumes in the order of its own Scan instead.
+func ScanFrom(ctx context.Context, s Service, req *spb.ScanRequest, after *spb.Entry, f EntryFunc) error {
+	if rs, ok := s.(ResumableScanner); ok {
+		return rs.ScanFrom(ctx, req, after, f)
+	} else if after == nil {
+		return s.Scan(ctx, req, f)
+	} else if !ScansOrdered(s) {
+		return ErrUnsupported
+	}
+	return s.Scan(ctx, req, func(e *spb.Entry) error {
+		if compare.Entries(e, after) != compare.GT {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+// Page splits a prospective page of entries into a page of at most pageSize
+// entries and the token for the following page.  The given entries should
+// include one more entry than pageSize if another page exists.
+func Page(entries []*spb.Entry, pageSize int) ([]*spb.Entry, string, error) {
+	if len(entries) <= pageSize {
+		return entries, "", nil
+	}
+	entries = entries[:pageSize]
+	return entries, PageToken(entries[pageSize-1]), nil
+}
+
+// PageToken returns an opaque token denoting the position immediately after e
+// in compare.Entries order.
+func PageToken(e *spb.Entry) string {
+	return base64.URLEncoding.EncodeToString([]byte(entryKey(e)))
+}
+
+// entryKey returns a string uniquely identifying the key of e, ignoring its
+// fact value.
+func entryKey(e *spb.Entry) string {
+	rec, err := proto.Marshal(&spb.Entry{
+		Source:   e.Source,
+		EdgeKind: e.EdgeKind,
+		FactName: e.FactName,
+		Target:   e.Target,
+	})
+	if err != nil {
+		// Marshaling an Entry cannot fail.
+		panic(err)
+	}
+	return string(rec)
+}
+
+// ParsePageToken returns the entry (without its fact value) encoded by a token
+// from PageToken.  An empty token is parsed as a nil entry.
+func ParsePageToken(token string) (*spb.Entry, error) {
+	if token == "" {
+		return nil, nil
+	}
+	rec, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page token: %v", err)
+	}
+	var e spb.Entry
+	if err := proto.Unmarshal(rec, &e); err != nil {
+		return nil, fmt.Errorf("invalid page token: %v", err)
+	}
+	return &e, nil
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// errStopShards is returned from a shard's callback to stop every shard of a
+// ParallelShards call.
+var errStopShards = errors.New("stop reading shards")
+
+// errOtherShardFailed is returned from a shard's callback to stop the shard
+// once the callback has failed for another shard of a ParallelShards call.
+var errOtherShardFailed = errors.New("another shard failed")
+
+// ParallelShards calls f with every entry in s by splitting s into workers
+// shards and reading them concurrently.  Calls to f are serialized, but the
+// entries of different shards are interleaved in an unspecified order.  If f
+// returns io.EOF, every shard stops and nil is returned.  Otherwise, the first
+// failure cancels the remaining shards and is returned as part of a
+// MultiError; f is not called again once it has failed.
+func ParallelShards(ctx context.Context, s Sharded, workers int, f EntryFunc) error {
+	var (
+		mu              sync.Mutex
+		stopped, failed bool
+	)
+	return ParallelShardsFunc(ctx, s, workers, func(_ int64, e *spb.Entry) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return errStopShards
+		} else if failed {
+			return errOtherShardFailed
+		}
+		if err := f(e); err == io.EOF {
+			stopped = true
+			return errStopShards
+		} else if err != nil {
+			failed = true
+			return err
+		}
+		return nil
+	})
+}
+
+// ParallelShardsFunc is like ParallelShards, but calls f concurrently for
+// entries of different shards along with the index of each entry's shard.  The
+// calls for a single shard are serialized and are made in that shard's order.
+// If f returns io.EOF, only its shard is stopped.  Shards reported as empty by
+// s.Count are skipped.  Once a shard fails, f is not called for the entries
+// the other shards deliver as they stop.
+func ParallelShardsFunc(ctx context.Context, s Sharded, workers int, f func(shard int64, e *spb.Entry) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	shards := int64(workers)
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg sync.WaitGroup
+
+		mu      sync.Mutex // guards errs and stopped
+		errs    MultiError
+		stopped bool
+	)
+	wg.Add(workers)
+	for i := int64(0); i < shards; i++ {
+		go func(i int64) {
+			defer wg.Done()
+			err := readShard(ctx, s, i, shards, f)
+			if err == nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == errOtherShardFailed {
+				return // the failure is reported by its own shard
+			} else if err == errStopShards {
+				stopped = true
+			} else if (stopped || len(errs) > 0) && ctx.Err() != nil {
+				// Ignore errors caused by stopping the shards.
+				return
+			} else {
+				errs = append(errs, fmt.Errorf("shard %d: %v", i, err))
+			}
+			cancel()
+		}(i)
+	}
+	wg.Wait()
+
+	if err := parent.Err(); err != nil && !stopped {
+		return err
+	}
+	return errs.orNil()
+}
+
+// readShard calls f with each entry in the given shard of s, unless s reports
+// the shard as empty.
+func readShard(ctx context.Context, s Sharded, index, shards int64, f func(int64, *spb.Entry) error) error {
+	count, err := s.Count(ctx, &spb.CountRequest{Index: index, Shards: shards})
+	if err != nil {
+		return err
+	} else if count == 0 {
+		return nil
+	}
+	return s.Shard(ctx, &spb.ShardRequest{Index: index, Shards: shards}, func(e *spb.Entry) error {
+		if err := ctx.Err(); err != nil {
+			return err // another shard failed or stopped, or ctx is done
+		}
+		return f(index, e)
+	})
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"container/heap"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/util/sortutil"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// ProfileOtherKey is the key under which a Profile aggregates the entries for
+// keys beyond ProfileOptions.MaxKeys.
+const ProfileOtherKey = "(other)"
+
+// Defaults for ProfileOptions.
+const (
+	DefaultProfileTopSources = 10
+	DefaultProfileMaxKeys    = 10000
+)
+
+// ProfileOptions control the computation of a Profile.
+type ProfileOptions struct {
+	// TopSources is the number of largest sources to report.  If 0,
+	// DefaultProfileTopSources is used.
+	TopSources int
+
+	// MaxKeys bounds the number of distinct corpora, fact names, and edge kinds
+	// each counted separately; the rest are aggregated under ProfileOtherKey.
+	// If 0, DefaultProfileMaxKeys is used.
+	MaxKeys int
+}
+
+// ProfileStats are the sizes of a set of entries.
+type ProfileStats struct {
+	// Entries is the number of entries.
+	Entries int64 `json:"entries"`
+
+	// Bytes is the total encoded size of the entries.
+	Bytes int64 `json:"bytes"`
+
+	// FactBytes is the total size of the entries' fact values.
+	FactBytes int64 `json:"fact_bytes"`
+}
+
+// add adds the size of e to s.
+func (s *ProfileStats) add(e *spb.Entry) {
+	s.Entries++
+	s.Bytes += int64(proto.Size(e))
+	s.FactBytes += int64(len(e.FactValue))
+}
+
+// SourceProfile is the size of the entries of a single source.
+type SourceProfile struct {
+	Source *spb.VName `json:"source"`
+	ProfileStats
+}
+
+// A Profile is a breakdown of the storage used by the entries of a Service.
+type Profile struct {
+	// Total is the size of every entry.
+	Total ProfileStats `json:"total"`
+
+	// Corpora is the size of the entries from each source corpus.
+	Corpora map[string]*ProfileStats `json:"corpora"`
+
+	// FactNames is the size of the node facts with each fact name.
+	FactNames map[string]*ProfileStats `json:"fact_names"`
+
+	// EdgeKinds is the size of the edges of each kind.
+	EdgeKinds map[string]*ProfileStats `json:"edge_kinds"`
+
+	// TopSources are the sources with the most fact bytes, in descending order.
+	TopSources []*SourceProfile `json:"top_sources"`
+
+	// Truncated is true if any keys were aggregated under ProfileOtherKey.
+	Truncated bool `json:"truncated"`
+}
+
+// NewProfile returns the Profile of the entries of s, computed in a single
+// Scan.  Memory use is bounded by ProfileOptions.MaxKeys and TopSources.  The
+// entries of each source are assumed to be scanned consecutively, as are those
+// of an OrderedScanner; otherwise, a source may be reported as several smaller
+// sources.
+func NewProfile(ctx context.Context, s Service, opts *ProfileOptions) (*Profile, error) {
+	if opts == nil {
+		opts = &ProfileOptions{}
+	}
+	p := &profiler{
+		Profile: &Profile{
+			Corpora:   make(map[string]*ProfileStats),
+			FactNames: make(map[string]*ProfileStats),
+			EdgeKinds: make(map[string]*ProfileStats),
+		},
+		topSources: opts.TopSources,
+		maxKeys:    opts.MaxKeys,
+		top: sortutil.ByLesser{Lesser: sortutil.LesserFunc(func(a, b interface{}) bool {
+			return a.(*SourceProfile).FactBytes < b.(*SourceProfile).FactBytes
+		})},
+	}
+	if p.topSources <= 0 {
+		p.topSources = DefaultProfileTopSources
+	}
+	if p.maxKeys <= 0 {
+		p.maxKeys = DefaultProfileMaxKeys
+	}
+
+	if err := s.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		p.add(e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return p.finish(), nil
+}
+
+// profiler computes a Profile over a sequence of calls to add.
+type profiler struct {
+	*Profile
+	topSources, maxKeys int
+
+	cur *SourceProfile    // the current run of entries with the same source
+	top sortutil.ByLesser // min-heap of the largest sources by FactBytes
+}
+
+func (p *profiler) add(e *spb.Entry) {
+	p.Total.add(e)
+	var corpus string
+	if e.Source != nil {
+		corpus = e.Source.Corpus
+	}
+	p.stats(p.Corpora, corpus).add(e)
+	if e.EdgeKind == "" {
+		p.stats(p.FactNames, e.FactName).add(e)
+	} else {
+		p.stats(p.EdgeKinds, e.EdgeKind).add(e)
+	}
+
+	if p.cur == nil || !compare.VNamesEqual(p.cur.Source, e.Source) {
+		p.flushSource()
+		p.cur = &SourceProfile{Source: e.Source}
+	}
+	p.cur.add(e)
+}
+
+// stats returns the ProfileStats for key in m, adding it if possible.
+func (p *profiler) stats(m map[string]*ProfileStats, key string) *ProfileStats {
+	if s, ok := m[key]; ok {
+		return s
+	} else if len(m) >= p.maxKeys {
+		p.Truncated = true
+		key = ProfileOtherKey
+		if s, ok := m[key]; ok {
+			return s
+		}
+	}
+	s := new(ProfileStats)
+	m[key] = s
+	return s
+}
+
+// flushSource adds the current source to the top sources, if it is among them.
+func (p *profiler) flushSource() {
+	if p.cur == nil {
+		return
+	}
+	if p.top.Len() < p.topSources {
+		heap.Push(&p.top, p.cur)
+	} else if p.cur.FactBytes > p.top.Peek().(*SourceProfile).FactBytes {
+		p.top.Slice[0] = p.cur
+		heap.Fix(&p.top, 0)
+	}
+	p.cur = nil
+}
+
+func (p *profiler) finish() *Profile {
+	p.flushSource()
+	p.TopSources = make([]*SourceProfile, p.top.Len())
+	for i := len(p.TopSources) - 1; i >= 0; i-- {
+		p.TopSources[i] = heap.Pop(&p.top).(*SourceProfile)
+	}
+	return p.Profile
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package prometheus exports the call metrics of a metered GraphStore, with
+// its health and the Go runtime's metrics, in the Prometheus text exposition
+// format.
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// DefaultHealthTimeout is the default bound on each check of an Exporter's
+// GraphStore health.
+const DefaultHealthTimeout = 5 * time.Second
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of each
+// method's latency histogram, excluding the implicit +Inf bucket.
+var latencyBuckets = [...]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// methods are the Service methods a metered Service reports.  Any other method
+// is reported as "other", so that the method label stays bounded.
+var methods = map[string]bool{
+	"Read":  true,
+	"Scan":  true,
+	"Write": true,
+	"Close": true,
+	"Count": true,
+	"Shard": true,
+}
+
+// startTime is the approximate start time of the process.
+var startTime = time.Now()
+
+// Options configure an Exporter.
+type Options struct {
+	// Health, if non-nil, is the GraphStore whose health is checked at each
+	// scrape and exported as the graphstore_healthy gauge.  It should not be
+	// metered, so that its checks are not counted as calls.
+	Health graphstore.Service
+
+	// HealthTimeout bounds each check of Health.  If zero,
+	// DefaultHealthTimeout is used.
+	HealthTimeout time.Duration
+}
+
+// An Exporter is a graphstore.WriteMetricsSink that serves the metrics it
+// records as Prometheus metrics over HTTP.  Its labels are bounded: calls are
+// labeled only by method and by gRPC code name, and never by VName.
+type Exporter struct {
+	health        graphstore.Service
+	healthTimeout time.Duration
+
+	mu      sync.Mutex // guards the fields below
+	methods map[string]*methodMetrics
+	written int64
+}
+
+type methodMetrics struct {
+	codes   map[string]int64           // counts of calls by gRPC code name
+	buckets [len(latencyBuckets)]int64 // counts of calls no slower than each bound
+	count   int64
+	seconds float64
+	entries int64
+}
+
+// NewExporter returns an Exporter with no recorded calls.  opts may be nil.
+func NewExporter(opts *Options) *Exporter {
+	e := &Exporter{
+		healthTimeout: DefaultHealthTimeout,
+		methods:       make(map[string]*methodMetrics),
+	}
+	if opts != nil {
+		e.health = opts.Health
+		if opts.HealthTimeout > 0 {
+			e.healthTimeout = opts.HealthTimeout
+		}
+	}
+	return e
+}
+
+// ObserveCall implements the graphstore.MetricsSink interface.
+func (e *Exporter) ObserveCall(method string, latency time.Duration, entries int64, err error) {
+	if !methods[method] {
+		method = "other"
+	}
+	seconds := latency.Seconds()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	mm := e.methods[method]
+	if mm == nil {
+		mm = &methodMetrics{codes: make(map[string]int64)}
+		e.methods[method] = mm
+	}
+	mm.codes[code(err)]++
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			mm.buckets[i]++
+		}
+	}
+	mm.count++
+	mm.seconds += seconds
+	mm.entries += entries
+}
+
+// ObserveWrite implements the graphstore.WriteMetricsSink interface.
+func (e *Exporter) ObserveWrite(bytes int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.written += bytes
+}
+
+// code returns the name of the gRPC code of err, treating context errors as
+// their gRPC equivalents.
+func code(err error) string {
+	switch err {
+	case nil:
+		return "OK"
+	case context.Canceled:
+		return "Canceled"
+	case context.DeadlineExceeded:
+		return "DeadlineExceeded"
+	}
+	return grpc.Code(err).String()
+}
+
+// ServeHTTP implements the http.Handler interface by writing the current
+// metrics in the Prometheus text exposition format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	e.writeCalls(&buf)
+	if e.health != nil {
+		e.writeHealth(r.Context(), &buf)
+	}
+	writeRuntime(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (e *Exporter) writeCalls(buf *bytes.Buffer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	names := make([]string, 0, len(e.methods))
+	for method := range e.methods {
+		names = append(names, method)
+	}
+	sort.Strings(names)
+	header(buf, "graphstore_calls_total", "counter", "GraphStore calls completed, by method and gRPC code.")
+	for _, method := range names {
+		codes := e.methods[method].codes
+		sorted := make([]string, 0, len(codes))
+		for c := range codes {
+			sorted = append(sorted, c)
+		}
+		sort.Strings(sorted)
+		for _, c := range sorted {
+			sample(buf, "graphstore_calls_total", labels("method", method, "code", c), float64(codes[c]))
+		}
+	}
+	header(buf, "graphstore_call_duration_seconds", "histogram", "Latencies of GraphStore calls, by method.")
+	for _, method := range names {
+		mm := e.methods[method]
+		for i, bound := range latencyBuckets {
+			sample(buf, "graphstore_call_duration_seconds_bucket", labels("method", method, "le", formatFloat(bound)), float64(mm.buckets[i]))
+		}
+		sample(buf, "graphstore_call_duration_seconds_bucket", labels("method", method, "le", "+Inf"), float64(mm.count))
+		sample(buf, "graphstore_call_duration_seconds_sum", labels("method", method), mm.seconds)
+		sample(buf, "graphstore_call_duration_seconds_count", labels("method", method), float64(mm.count))
+	}
+	header(buf, "graphstore_entries_total", "counter", "Entries delivered by GraphStore calls, by method.")
+	for _, method := range names {
+		switch method {
+		case "Read", "Scan", "Shard":
+			sample(buf, "graphstore_entries_total", labels("method", method), float64(e.methods[method].entries))
+		}
+	}
+	header(buf, "graphstore_written_bytes_total", "counter", "Encoded size of the successful GraphStore writes.")
+	sample(buf, "graphstore_written_bytes_total", "", float64(e.written))
+}
+
+func (e *Exporter) writeHealth(ctx context.Context, buf *bytes.Buffer) {
+	ctx, cancel := context.WithTimeout(ctx, e.healthTimeout)
+	defer cancel()
+	start := time.Now()
+	var healthy float64
+	if err := graphstore.CheckHealth(ctx, e.health); err == nil {
+		healthy = 1
+	}
+	header(buf, "graphstore_healthy", "gauge", "Whether the GraphStore passed its latest health check.")
+	sample(buf, "graphstore_healthy", "", healthy)
+	header(buf, "graphstore_health_check_duration_seconds", "gauge", "Duration of the GraphStore's latest health check.")
+	sample(buf, "graphstore_health_check_duration_seconds", "", time.Since(start).Seconds())
+}
+
+func writeRuntime(buf *bytes.Buffer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	header(buf, "go_info", "gauge", "Information about the Go environment.")
+	sample(buf, "go_info", labels("version", runtime.Version()), 1)
+	header(buf, "go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	sample(buf, "go_goroutines", "", float64(runtime.NumGoroutine()))
+	header(buf, "go_threads", "gauge", "Number of OS threads created.")
+	sample(buf, "go_threads", "", float64(pprof.Lookup("threadcreate").Count()))
+	header(buf, "go_gc_duration_seconds", "summary", "Pause durations of the garbage collector.")
+	sample(buf, "go_gc_duration_seconds_sum", "", time.Duration(ms.PauseTotalNs).Seconds())
+	sample(buf, "go_gc_duration_seconds_count", "", float64(ms.NumGC))
+	for _, m := range []struct {
+		name, typ, help string
+		value           uint64
+	}{
+		{"go_memstats_alloc_bytes", "gauge", "Bytes allocated and still in use.", ms.Alloc},
+		{"go_memstats_alloc_bytes_total", "counter", "Bytes allocated, even if freed.", ms.TotalAlloc},
+		{"go_memstats_sys_bytes", "gauge", "Bytes obtained from the system.", ms.Sys},
+		{"go_memstats_mallocs_total", "counter", "Number of mallocs.", ms.Mallocs},
+		{"go_memstats_frees_total", "counter", "Number of frees.", ms.Frees},
+		{"go_memstats_heap_inuse_bytes", "gauge", "Bytes in in-use heap spans.", ms.HeapInuse},
+		{"go_memstats_heap_objects", "gauge", "Number of allocated heap objects.", ms.HeapObjects},
+	} {
+		header(buf, m.name, m.typ, m.help)
+		sample(buf, m.name, "", float64(m.value))
+	}
+	header(buf, "process_start_time_seconds", "gauge", "Start time of the process since the Unix epoch, in seconds.")
+	sample(buf, "process_start_time_seconds", "", float64(startTime.UnixNano())/1e9)
+}
+
+func header(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(buf *bytes.Buffer, name, labels string, value float64) {
+	fmt.Fprintf(buf, "%s%s %s\n", name, labels, formatFloat(value))
+}
+
+// labelEscaper escapes a label value as the text exposition format requires.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels returns the Prometheus encoding of the given label names and values,
+// which alternate.
+func labels(kvs ...string) string {
+	pairs := make([]string, 0, len(kvs)/2)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		pairs = append(pairs, kvs[i]+`="`+labelEscaper.Replace(kvs[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package prometheus
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	gsgrpc "kythe.io/kythe/go/services/graphstore/grpc"
+	"kythe.io/kythe/go/storage/inmemory"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+var ctx = context.Background()
+
+// unhealthyStore is a GraphStore whose health checks fail.
+type unhealthyStore struct{ graphstore.Service }
+
+func (unhealthyStore) CheckHealth(context.Context) error { return errors.New("disk full") }
+
+// scrape returns the samples served by h, keyed by metric name and labels.
+func scrape(t *testing.T, h http.Handler) map[string]float64 {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return parseSamples(t, rec.Header().Get("Content-Type"), rec.Body)
+}
+
+// parseSamples returns the samples of a response in the text exposition
+// format, keyed by metric name and labels.
+func parseSamples(t *testing.T, contentType string, body io.Reader) map[string]float64 {
+	if !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type: got %q; want the text exposition format", contentType)
+	}
+	samples := make(map[string]float64)
+	s := bufio.NewScanner(body)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			t.Fatalf("Invalid sample %q", line)
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("Invalid sample %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+func checkSamples(t *testing.T, samples map[string]float64, want map[string]float64) {
+	for name, v := range want {
+		if got, ok := samples[name]; !ok {
+			t.Errorf("Missing sample %s", name)
+		} else if got != v {
+			t.Errorf("Sample %s: got %v; want %v", name, got, v)
+		}
+	}
+}
+
+func TestExporter(t *testing.T) {
+	e := NewExporter(&Options{Health: unhealthyStore{inmemory.Create()}})
+	e.ObserveCall("Read", 2*time.Millisecond, 3, nil)
+	e.ObserveCall("Read", 2*time.Second, 0, context.Canceled)
+	e.ObserveCall("Scan", time.Millisecond, 10, errors.New("broken"))
+	e.ObserveCall("Frob", time.Millisecond, 0, nil)
+	e.ObserveWrite(100)
+	e.ObserveWrite(20)
+
+	samples := scrape(t, e)
+	checkSamples(t, samples, map[string]float64{
+		`graphstore_calls_total{method="Read",code="OK"}`:                    1,
+		`graphstore_calls_total{method="Read",code="Canceled"}`:              1,
+		`graphstore_calls_total{method="Scan",code="Unknown"}`:               1,
+		`graphstore_calls_total{method="other",code="OK"}`:                   1,
+		`graphstore_call_duration_seconds_bucket{method="Read",le="0.0025"}`: 1,
+		`graphstore_call_duration_seconds_bucket{method="Read",le="2.5"}`:    2,
+		`graphstore_call_duration_seconds_bucket{method="Read",le="+Inf"}`:   2,
+		`graphstore_call_duration_seconds_count{method="Read"}`:              2,
+		`graphstore_call_duration_seconds_sum{method="Read"}`:                2.002,
+		`graphstore_entries_total{method="Read"}`:                            3,
+		`graphstore_entries_total{method="Scan"}`:                            10,
+		`graphstore_written_bytes_total`:                                     120,
+		`graphstore_healthy`:                                                 0,
+	})
+	if _, ok := samples[`graphstore_calls_total{method="Frob",code="OK"}`]; ok {
+		t.Error("Unknown method was given its own label")
+	}
+	if samples["go_goroutines"] < 1 {
+		t.Errorf("go_goroutines: got %v; want at least 1", samples["go_goroutines"])
+	}
+}
+
+func TestScrape(t *testing.T) {
+	store := inmemory.Create()
+	e := NewExporter(&Options{Health: store})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	spb.RegisterGraphStoreServer(s, gsgrpc.NewServer(graphstore.NewMeteredService(store, e), nil))
+	go s.Serve(l)
+	defer s.Stop()
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	gs := gsgrpc.NewService(conn)
+
+	metrics := httptest.NewServer(e)
+	defer metrics.Close()
+	get := func() map[string]float64 {
+		resp, err := http.Get(metrics.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return parseSamples(t, resp.Header.Get("Content-Type"), resp.Body)
+	}
+	before := get()
+
+	req := &spb.WriteRequest{
+		Source: &spb.VName{Signature: "a"},
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+			{FactName: "/kythe/subkind", FactValue: []byte("class")},
+		},
+	}
+	if err := gs.Write(ctx, req); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := gs.Read(ctx, &spb.ReadRequest{Source: req.Source}, func(*spb.Entry) error { return nil }); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error { return nil }); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+
+	after := get()
+	for name, delta := range map[string]float64{
+		`graphstore_calls_total{method="Write",code="OK"}`:      1,
+		`graphstore_calls_total{method="Read",code="OK"}`:       1,
+		`graphstore_calls_total{method="Scan",code="OK"}`:       1,
+		`graphstore_call_duration_seconds_count{method="Scan"}`: 1,
+		`graphstore_entries_total{method="Read"}`:               2,
+		`graphstore_entries_total{method="Scan"}`:               2,
+	} {
+		if got := after[name] - before[name]; got != delta {
+			t.Errorf("Sample %s moved by %v; want %v", name, got, delta)
+		}
+	}
+	if after["graphstore_written_bytes_total"] <= before["graphstore_written_bytes_total"] {
+		t.Errorf("graphstore_written_bytes_total did not grow: %v", after["graphstore_written_bytes_total"])
+	}
+	if after["graphstore_healthy"] != 1 {
+		t.Errorf("graphstore_healthy: got %v; want 1", after["graphstore_healthy"])
+	}
+}
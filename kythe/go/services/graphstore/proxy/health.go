@@ -0,0 +1,189 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	"golang.org/x/net/context"
+)
+
+// Defaults for the fields of HealthOptions.
+const (
+	DefaultHealthInterval = 10 * time.Second
+	DefaultRecoverAfter   = 3
+)
+
+// HealthOptions configures the probing of the health of a proxy's stores (see
+// graphstore.CheckHealth).  A store whose probe fails is excluded from the
+// proxy's reads until RecoverAfter consecutive probes succeed.
+type HealthOptions struct {
+	// Interval is the time between probes.  If 0, DefaultHealthInterval is
+	// used.
+	Interval time.Duration
+
+	// Timeout bounds each probe of a store.  If 0, the Interval is used.
+	Timeout time.Duration
+
+	// RecoverAfter is the number of consecutive successful probes after which
+	// an excluded store is used again.  If 0, DefaultRecoverAfter is used.
+	RecoverAfter int
+
+	// ExcludeWrites causes an unhealthy store to be excluded from writes as
+	// well as reads.  The writes made while a store is excluded are not made
+	// to it once it recovers; otherwise they are attempted and may fail with a
+	// *WriteError.
+	ExcludeWrites bool
+}
+
+func (o *HealthOptions) interval() time.Duration {
+	if o.Interval <= 0 {
+		return DefaultHealthInterval
+	}
+	return o.Interval
+}
+
+func (o *HealthOptions) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return o.interval()
+	}
+	return o.Timeout
+}
+
+func (o *HealthOptions) recoverAfter() int {
+	if o.RecoverAfter <= 0 {
+		return DefaultRecoverAfter
+	}
+	return o.RecoverAfter
+}
+
+// NewWithHealth returns a proxy graphstore.Service, as from NewWithPolicy, that
+// probes the health of its stores (including those added as a Dynamic) until
+// it is closed, excluding the unhealthy stores as configured by opts.  If opts
+// is nil, the defaults are used.
+func NewWithHealth(policy Policy, opts *HealthOptions, stores ...graphstore.Service) graphstore.Service {
+	p := newProxy(policy, stores)
+	if opts == nil {
+		opts = new(HealthOptions)
+	}
+	p.startProbes(opts)
+	return p
+}
+
+// startProbes starts probing the proxy's members as configured by opts until
+// stopProbes is called.
+func (p *proxyService) startProbes(opts *HealthOptions) {
+	p.health = opts
+	p.stop, p.stopped = make(chan struct{}), make(chan struct{})
+	go p.probeLoop()
+}
+
+// probeLoop probes the proxy's members every interval until stopProbes is
+// called.
+func (p *proxyService) probeLoop() {
+	defer close(p.stopped)
+	t := time.NewTicker(p.health.interval())
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			p.probe(context.Background())
+		}
+	}
+}
+
+// stopProbes stops the proxy's probing of its members, if any, and waits for
+// any probe in progress to finish.
+func (p *proxyService) stopProbes() {
+	if p.stop == nil {
+		return
+	}
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.stopped
+}
+
+// probe concurrently checks the health of each member and records the result,
+// excluding the members that fail and re-including those that have recovered.
+func (p *proxyService) probe(ctx context.Context) {
+	members := p.acquire()
+	defer p.release(members)
+	errs := make([]error, len(members))
+	waitErr(foreach(members, func(i int, s graphstore.Service) error {
+		ctx, cancel := context.WithTimeout(ctx, p.health.timeout())
+		defer cancel()
+		errs[i] = graphstore.CheckHealth(ctx, s)
+		return nil
+	}))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, m := range members {
+		switch {
+		case errs[i] != nil:
+			if m.unhealthy == nil {
+				log.Printf("proxy: excluding unhealthy store %q: %v", m.name, errs[i])
+			}
+			m.unhealthy, m.recovered = errs[i], 0
+		case m.unhealthy != nil:
+			m.recovered++
+			if m.recovered >= p.health.recoverAfter() {
+				log.Printf("proxy: store %q recovered after %d probes", m.name, m.recovered)
+				m.unhealthy, m.recovered = nil, 0
+			}
+		}
+	}
+}
+
+// CheckHealth implements the graphstore.HealthChecker interface.  The proxy is
+// healthy if the stores required by its policy are.  If the proxy probes its
+// stores, their health is that of their last probes; otherwise each store is
+// checked in turn.
+func (p *proxyService) CheckHealth(ctx context.Context) error {
+	members := p.acquire()
+	defer p.release(members)
+	errs := make([]error, len(members))
+	if p.health != nil {
+		p.mu.Lock()
+		for i, m := range members {
+			errs[i] = m.unhealthy
+		}
+		p.mu.Unlock()
+	} else {
+		waitErr(foreach(members, func(i int, s graphstore.Service) error {
+			errs[i] = graphstore.CheckHealth(ctx, s)
+			return nil
+		}))
+	}
+
+	var msgs []string
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("store %q: %v", members[i].name, err))
+		}
+	}
+	if len(members)-len(msgs) < p.policy.required(len(members)) {
+		return fmt.Errorf("%d of %d stores unhealthy: %s", len(msgs), len(members), strings.Join(msgs, "; "))
+	}
+	return nil
+}
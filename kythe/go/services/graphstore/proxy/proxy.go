@@ -23,6 +23,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -36,14 +38,17 @@ import (
 )
 
 func init() {
-	gsutil.Register("proxy", proxyHandler)
+	graphstore.Register("proxy", proxyOpener)
 }
 
-func proxyHandler(spec string) (graphstore.Service, error) {
+func proxyOpener(ctx context.Context, u *url.URL) (graphstore.Service, error) {
 	var stores []graphstore.Service
-	for _, s := range strings.Split(spec, ",") {
-		gs, err := gsutil.ParseGraphStore(s)
+	for _, s := range strings.Split(graphstore.SpecLocation(u), ",") {
+		gs, err := gsutil.Open(ctx, s)
 		if err != nil {
+			for _, gs := range stores {
+				gs.Close(ctx)
+			}
 			return nil, fmt.Errorf("proxy GraphStore error for %q: %v", s, err)
 		}
 		stores = append(stores, gs)
@@ -54,17 +59,309 @@ func proxyHandler(spec string) (graphstore.Service, error) {
 	return New(stores...), nil
 }
 
+// Dynamic is implemented by each proxy graphstore.Service.  Its stores, called
+// members, may be added and removed while the proxy is in use.  Each operation
+// of the proxy uses the members at its start, until it completes.
+type Dynamic interface {
+	graphstore.Service
+
+	// AddStore adds s as a member with the given name, which must be unique
+	// among the members.  Operations that start afterward will use s.
+	AddStore(name string, s graphstore.Service) error
+
+	// RemoveStore removes the named member so that operations that start
+	// afterward will not use it.  It waits for the operations that are using
+	// the member to complete, then closes it.
+	RemoveStore(ctx context.Context, name string) error
+
+	// Members returns the current members, in the order operations use them.
+	Members() []Member
+}
+
+// A Member describes a member store of a Dynamic proxy.
+type Member struct {
+	Name     string
+	InFlight int // the number of operations using the store
+
+	// Unhealthy is the failed health probe for which the store is excluded
+	// from the proxy's reads, or nil (see NewWithHealth).
+	Unhealthy error
+}
+
+// Errors returned by the methods of Dynamic.
+var (
+	ErrDuplicateStore = errors.New("duplicate proxy store name")
+	ErrUnknownStore   = errors.New("unknown proxy store name")
+)
+
+// ErrNoHealthyStores is returned by an operation of a proxy whose every store
+// is excluded by its health (see NewWithHealth).
+var ErrNoHealthyStores = errors.New("no healthy proxy stores")
+
 type proxyService struct {
-	stores []graphstore.Service
+	policy Policy
+	health *HealthOptions // nil unless the members are probed (see health.go)
+	router *Router        // nil unless writes are routed (see route.go)
+
+	mu      sync.Mutex
+	members []*member // copied on write, since operations retain them
+
+	stopOnce sync.Once
+	stop     chan struct{} // closed to stop probing the members
+	stopped  chan struct{} // closed once probing stops
+}
+
+// A member is a named store of a proxy.  Its fields other than name and store
+// are guarded by the proxy's mu.
+type member struct {
+	name  string
+	store graphstore.Service
+
+	refs    int           // the number of operations using the store
+	removed bool          // whether the store was removed from the proxy
+	drained chan struct{} // closed once the store is removed and refs == 0
+
+	unhealthy error // the probe failure excluding the store, if any
+	recovered int   // the successful probes since the store was excluded
+}
+
+// A Policy determines how many of a proxy's stores must succeed for a Read or
+// Scan (and so a Count or Shard) of the proxy to succeed.  The entries of the
+// stores that fail are merged up to their failures; the failures are recorded
+// in the call's Report (see WithReport).
+type Policy struct {
+	quorum int // the number of stores required; if 0, every store
+}
+
+var (
+	// RequireAll is the Policy requiring every store to succeed.
+	RequireAll = Policy{}
+
+	// Any is the Policy requiring at least one store to succeed.
+	Any = Quorum(1)
+)
+
+// Quorum returns the Policy requiring at least k stores to succeed (or every
+// store, if there are fewer than k).  If k < 1, it returns RequireAll.
+func Quorum(k int) Policy {
+	if k < 1 {
+		return RequireAll
+	}
+	return Policy{k}
+}
+
+// required returns the number of n stores that must succeed.
+func (p Policy) required(n int) int {
+	if p.quorum == 0 || p.quorum > n {
+		return n
+	}
+	return p.quorum
+}
+
+func (p Policy) String() string {
+	if p.quorum == 0 {
+		return "RequireAll"
+	}
+	return fmt.Sprintf("Quorum(%d)", p.quorum)
+}
+
+// A Report records the proxied stores that failed during a Read or Scan.
+type Report struct {
+	// Failures are the failures of the proxied stores, in the order of the
+	// stores.  Once the call returns, Failures are not modified.
+	Failures []Failure
+}
+
+// A Failure is an error returned by one of the proxied stores.
+type Failure struct {
+	Store int    // the index of the store among the call's members
+	Name  string // the name of the store (see Dynamic)
+	Err   error
+}
+
+type reportKey struct{}
+
+// WithReport returns a context for a Read or Scan of a proxy, and the Report in
+// which the failures of that call's proxied stores are recorded.
+func WithReport(ctx context.Context) (context.Context, *Report) {
+	r := new(Report)
+	return context.WithValue(ctx, reportKey{}, r), r
 }
 
 // New returns a graphstore.Service that forwards Reads, Writes, and Scans to a
-// set of stores in parallel, and merges their results.
-func New(stores ...graphstore.Service) graphstore.Service { return &proxyService{stores} }
+// set of stores in parallel, and merges their results.  If each store delivers
+// its entries in entry order, as compare.Entries, so does the proxy; entries
+// with equal keys are delivered once, with the value of the first such store.
+// Since a write cannot be made atomic across the proxied stores, the proxy does
+// not implement graphstore.Transactional; graphstore.WriteBatch may be used for
+// a best-effort sequence of Writes instead.  Every store must succeed for a call
+// to succeed (see NewWithPolicy).  The stores are members of the proxy, as a
+// Dynamic, named by their index.
+func New(stores ...graphstore.Service) graphstore.Service {
+	return NewWithPolicy(RequireAll, stores...)
+}
+
+// NewWithPolicy returns a proxy graphstore.Service, as from New, whose Reads and
+// Scans succeed if the stores required by the given policy succeed.  Writes
+// still require every store to succeed.
+func NewWithPolicy(policy Policy, stores ...graphstore.Service) graphstore.Service {
+	return newProxy(policy, stores)
+}
+
+func newProxy(policy Policy, stores []graphstore.Service) *proxyService {
+	p := &proxyService{policy: policy}
+	for i, s := range stores {
+		p.members = append(p.members, newMember(strconv.Itoa(i), s))
+	}
+	return p
+}
+
+func newMember(name string, s graphstore.Service) *member {
+	return &member{name: name, store: s, drained: make(chan struct{})}
+}
+
+// NewSharded returns a proxy graphstore.Service, as from New, that also
+// implements graphstore.FuncSharded by assigning the merged entries of the
+// proxied stores to shards with the named graphstore.ShardFunc.  Each Count and
+// Shard call scans every proxied store.
+func NewSharded(shardFunc string, stores ...graphstore.Service) (graphstore.FuncSharded, error) {
+	return NewShardedWithPolicy(shardFunc, RequireAll, stores...)
+}
+
+// NewShardedWithPolicy returns a sharded proxy graphstore.Service, as from
+// NewSharded, whose Reads, Scans, Counts, and Shards succeed if the stores
+// required by the given policy succeed.
+func NewShardedWithPolicy(shardFunc string, policy Policy, stores ...graphstore.Service) (graphstore.FuncSharded, error) {
+	p := newProxy(policy, stores)
+	sharded, err := graphstore.NewFuncSharded(p, shardFunc)
+	if err != nil {
+		return nil, err
+	}
+	return &shardedProxy{p, sharded}, nil
+}
+
+type shardedProxy struct {
+	*proxyService
+	sharded graphstore.FuncSharded
+}
+
+// Count implements part of the graphstore.Sharded interface.
+func (p *shardedProxy) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	return p.sharded.Count(ctx, req)
+}
+
+// Shard implements part of the graphstore.Sharded interface.
+func (p *shardedProxy) Shard(ctx context.Context, req *spb.ShardRequest, f graphstore.EntryFunc) error {
+	return p.sharded.Shard(ctx, req, f)
+}
+
+// ShardFunc implements part of the graphstore.FuncSharded interface.
+func (p *shardedProxy) ShardFunc() string { return p.sharded.ShardFunc() }
+
+// AddStore implements part of the Dynamic interface.
+func (p *proxyService) AddStore(name string, s graphstore.Service) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range p.members {
+		if m.name == name {
+			return ErrDuplicateStore
+		}
+	}
+	members := make([]*member, len(p.members), len(p.members)+1)
+	copy(members, p.members)
+	p.members = append(members, newMember(name, s))
+	return nil
+}
+
+// RemoveStore implements part of the Dynamic interface.
+func (p *proxyService) RemoveStore(ctx context.Context, name string) error {
+	p.mu.Lock()
+	var removed *member
+	members := make([]*member, 0, len(p.members))
+	for _, m := range p.members {
+		if m.name == name {
+			removed = m
+		} else {
+			members = append(members, m)
+		}
+	}
+	if removed == nil {
+		p.mu.Unlock()
+		return ErrUnknownStore
+	}
+	p.members = members
+	removed.removed = true
+	if removed.refs == 0 {
+		close(removed.drained)
+	}
+	p.mu.Unlock()
+
+	<-removed.drained
+	return removed.store.Close(ctx)
+}
+
+// Members implements part of the Dynamic interface.
+func (p *proxyService) Members() []Member {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	members := make([]Member, len(p.members))
+	for i, m := range p.members {
+		members[i] = Member{Name: m.name, InFlight: m.refs, Unhealthy: m.unhealthy}
+	}
+	return members
+}
+
+// acquire returns the current members for use by an operation, which must call
+// release once it no longer uses them.
+func (p *proxyService) acquire() []*member {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range p.members {
+		m.refs++
+	}
+	return p.members
+}
+
+// acquireHealthy returns the current members, as by acquire, less those
+// excluded by their health for reads (or, if write is set, writes; see
+// HealthOptions).  It returns ErrNoHealthyStores if every member is excluded.
+func (p *proxyService) acquireHealthy(write bool) ([]*member, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.health == nil || write && !p.health.ExcludeWrites {
+		for _, m := range p.members {
+			m.refs++
+		}
+		return p.members, nil
+	}
+	var members []*member
+	for _, m := range p.members {
+		if m.unhealthy == nil {
+			m.refs++
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 && len(p.members) > 0 {
+		return nil, ErrNoHealthyStores
+	}
+	return members, nil
+}
+
+// release ends an operation's use of members, as returned by acquire.
+func (p *proxyService) release(members []*member) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range members {
+		m.refs--
+		if m.removed && m.refs == 0 {
+			close(m.drained)
+		}
+	}
+}
 
 // Read implements graphstore.Service and forwards the request to the proxied stores.
 func (p *proxyService) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
-	return p.invoke(func(svc graphstore.Service, cb graphstore.EntryFunc) error {
+	return p.invoke(ctx, func(svc graphstore.Service, cb graphstore.EntryFunc) error {
 		return svc.Read(ctx, req, cb)
 	}, f)
 }
@@ -72,24 +369,179 @@ func (p *proxyService) Read(ctx context.Context, req *spb.ReadRequest, f graphst
 // Scan implements part of graphstore.Service by forwarding the request to the
 // proxied stores.
 func (p *proxyService) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
-	return p.invoke(func(svc graphstore.Service, cb graphstore.EntryFunc) error {
+	return p.invoke(ctx, func(svc graphstore.Service, cb graphstore.EntryFunc) error {
 		return svc.Scan(ctx, req, cb)
 	}, f)
 }
 
+// A WriteError reports a write that failed for some, but not all, of the
+// proxied stores.  The failed stores may now be missing entries that the others
+// have; RepairSource restores them.  A write that fails for every store reports
+// the first store's error instead.
+type WriteError struct {
+	Succeeded []int     // the indices of the written stores among the members
+	Failed    []Failure // the failures of the other stores, in order
+
+	members []*member
+}
+
+func (e *WriteError) Error() string {
+	msgs := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		msgs[i] = fmt.Sprintf("store %q: %v", f.Name, f.Err)
+	}
+	return fmt.Sprintf("write failed for %d of %d stores: %s",
+		len(e.Failed), len(e.members), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of the failed stores.
+func (e *WriteError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, f := range e.Failed {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// RepairSource rewrites every entry of the given source, as read from the first
+// store that was written, to each of the failed stores.  Any error is returned
+// after every failed store has been tried.  The stores must not have been
+// removed from the proxy since the write.
+func (e *WriteError) RepairSource(ctx context.Context, src *spb.VName) error {
+	req := &spb.WriteRequest{Source: src}
+	healthy := e.members[e.Succeeded[0]]
+	if err := healthy.store.Read(ctx, &spb.ReadRequest{
+		Source:   src,
+		EdgeKind: "*",
+	}, func(entry *spb.Entry) error {
+		req.Update = append(req.Update, &spb.WriteRequest_Update{
+			EdgeKind:  entry.EdgeKind,
+			Target:    entry.Target,
+			FactName:  entry.FactName,
+			FactValue: entry.FactValue,
+		})
+		return nil
+	}); err != nil {
+		return fmt.Errorf("reading source from store %q: %v", healthy.name, err)
+	} else if len(req.Update) == 0 {
+		return nil
+	}
+
+	var firstErr error
+	for _, f := range e.Failed {
+		if err := e.members[f.Store].store.Write(ctx, req); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("repairing store %q: %v", f.Name, err)
+		}
+	}
+	return firstErr
+}
+
+// writeAll concurrently invokes the write f(i, s) for each member store s of p
+// to which a write of src is made, and returns nil if every write succeeds, the first error if every write
+// fails, and a *WriteError otherwise.
+func (p *proxyService) writeAll(src *spb.VName, f func(int, graphstore.Service) error) error {
+	members, err := p.acquireWriters(src)
+	if err != nil {
+		return err
+	}
+	defer p.release(members)
+	errs := make([]error, len(members))
+	waitErr(foreach(members, func(i int, s graphstore.Service) error {
+		errs[i] = f(i, s)
+		return errs[i]
+	}))
+	werr := &WriteError{members: members}
+	for i, err := range errs {
+		if err != nil {
+			werr.Failed = append(werr.Failed, Failure{Store: i, Name: members[i].name, Err: err})
+		} else {
+			werr.Succeeded = append(werr.Succeeded, i)
+		}
+	}
+	switch {
+	case len(werr.Failed) == 0:
+		return nil
+	case len(werr.Succeeded) == 0:
+		return werr.Failed[0].Err
+	}
+	return werr
+}
+
 // Write implements part of graphstore.Service by forwarding the request to the
-// proxied stores.
+// proxied stores (or, if the proxy is routed, to the store of the source's
+// corpus; see NewRouted).  If the write fails for only some of the stores, a
+// *WriteError is returned.
 func (p *proxyService) Write(ctx context.Context, req *spb.WriteRequest) error {
-	return waitErr(p.foreach(func(i int, s graphstore.Service) error {
+	return p.writeAll(req.Source, func(i int, s graphstore.Service) error {
 		return s.Write(ctx, req)
-	}))
+	})
+}
+
+// WriteOpts implements part of graphstore.OptionsWriter by forwarding the
+// request to the proxied stores.  Since each store is written the same
+// entries, the stats reported are those of the first store (in member order)
+// whose write succeeds, rather than their sum.  If the write fails for only
+// some of the stores, a *WriteError is returned.
+func (p *proxyService) WriteOpts(ctx context.Context, req *spb.WriteRequest, opts *graphstore.WriteOptions) (*graphstore.WriteStats, error) {
+	var (
+		mu    sync.Mutex
+		first = -1 // the member whose stats are reported
+		stats *graphstore.WriteStats
+	)
+	if err := p.writeAll(req.Source, func(i int, s graphstore.Service) error {
+		ws, err := graphstore.WriteWithOptions(ctx, s, req, opts)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if first < 0 || i < first {
+			first, stats = i, ws
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// CompareAndSwap implements the graphstore.CAS interface.  Since a swap cannot
+// be made atomic across several stores, it is only supported when proxying a
+// single store that supports it, or by a routed proxy (see NewRouted);
+// otherwise, graphstore.ErrUnsupported is returned.
+func (p *proxyService) CompareAndSwap(ctx context.Context, source *spb.VName, factName string, oldValue, newValue []byte) (bool, error) {
+	if p.router != nil {
+		return p.compareAndSwapRouted(ctx, source, factName, oldValue, newValue)
+	}
+	members := p.acquire()
+	defer p.release(members)
+	if len(members) != 1 {
+		return false, graphstore.ErrUnsupported
+	}
+	return graphstore.CompareAndSwap(ctx, members[0].store, source, factName, oldValue, newValue)
+}
+
+// ScansOrdered implements the graphstore.OrderedScanner interface.  The merged
+// Scans of the proxied stores are ordered if each store's Scans are.
+func (p *proxyService) ScansOrdered() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range p.members {
+		if !graphstore.ScansOrdered(m.store) {
+			return false
+		}
+	}
+	return true
 }
 
 // Close implements part of graphstore.Service by calling Close on each proxied
 // store.  All the stores are given an opportunity to close, even in case of
 // error, but only one error is returned.
 func (p *proxyService) Close(ctx context.Context) error {
-	return waitErr(p.foreach(func(i int, s graphstore.Service) error {
+	p.stopProbes()
+	members := p.acquire()
+	defer p.release(members)
+	return waitErr(foreach(members, func(i int, s graphstore.Service) error {
 		return s.Close(ctx)
 	}))
 }
@@ -106,16 +558,16 @@ func waitErr(errc <-chan error) error {
 	return err
 }
 
-// foreach concurrently invokes f(i, p.stores[i]) for each proxied store.  The
+// foreach concurrently invokes f(i, members[i].store) for each member.  The
 // return value from each invocation is delivered to the error channel that is
 // returned, which will be closed once all the calls are complete.  The channel
 // is unbuffered, so the caller must drain the channel to avoid deadlock.
-func (p *proxyService) foreach(f func(int, graphstore.Service) error) <-chan error {
+func foreach(members []*member, f func(int, graphstore.Service) error) <-chan error {
 	errc := make(chan error)
 	var wg sync.WaitGroup
-	wg.Add(len(p.stores))
-	for i, s := range p.stores {
-		i, s := i, s
+	wg.Add(len(members))
+	for i, m := range members {
+		i, s := i, m.store
 		go func() {
 			defer wg.Done()
 			errc <- f(i, s)
@@ -125,24 +577,34 @@ func (p *proxyService) foreach(f func(int, graphstore.Service) error) <-chan err
 	return errc
 }
 
-// invoke calls req concurrently for each delegated service in p, merges the
-// results, and delivers them to f.
-func (p *proxyService) invoke(req func(graphstore.Service, graphstore.EntryFunc) error, f graphstore.EntryFunc) error {
+// invoke calls req concurrently for each member service of p, merges the
+// results, and delivers them to f.  If ctx is cancelled, the delegated
+// requests are abandoned and ctx's error is returned.  Otherwise, if fewer
+// services succeed than p.policy requires, the first error is returned.  The
+// failures are recorded in ctx's Report, if any.
+func (p *proxyService) invoke(ctx context.Context, req func(graphstore.Service, graphstore.EntryFunc) error, f graphstore.EntryFunc) error {
+	members, err := p.acquireHealthy(false)
+	if err != nil {
+		return err
+	}
+	defer p.release(members)
 	stop := make(chan struct{}) // Closed to signal cancellation
 
 	// Create a channel for each delegated request, and a callback that
 	// delivers results to that channel.  The callback will handle cancellation
 	// signaled by a close of the stop channel, and exit early.
 
-	rcv := make([]graphstore.EntryFunc, len(p.stores)) // callbacks
-	chs := make([]chan *spb.Entry, len(p.stores))      // channels
-	for i := range p.stores {
-		ch := make(chan *spb.Entry)
+	rcv := make([]graphstore.EntryFunc, len(members)) // callbacks
+	chs := make([]chan *spb.Entry, len(members))      // channels
+	for i := range members {
+		ch := make(chan *spb.Entry, mergeBuffer)
 		chs[i] = ch
 		rcv[i] = func(e *spb.Entry) error {
 			select {
 			case <-stop: // cancellation has been signalled
 				return nil
+			case <-ctx.Done():
+				return ctx.Err()
 			case ch <- e:
 				return nil
 			}
@@ -150,54 +612,116 @@ func (p *proxyService) invoke(req func(graphstore.Service, graphstore.EntryFunc)
 	}
 
 	// Invoke the requests for each service, using the corresponding callback.
-	errc := p.foreach(func(i int, s graphstore.Service) error {
-		err := req(s, rcv[i])
+	errs := make([]error, len(members))
+	errc := foreach(members, func(i int, s graphstore.Service) error {
+		errs[i] = req(s, rcv[i])
 		close(chs[i])
-		return err
+		return errs[i]
 	})
 
-	// Accumulate and merge the results.  This is a straightforward round-robin
-	// n-finger merge of the values from the delegated requests.
+	// Accumulate and merge the results.  This is a k-way merge of the values
+	// from the delegated requests: the heap holds the next value of each
+	// pending request, and the smallest is delivered next.  Since a request's
+	// next value is only received once its previous value is delivered, at most
+	// mergeBuffer values per request are buffered.
 
-	var h compare.ByEntries // used to preserve stream order
-	var last *spb.Entry     // used to deduplicate entries
-	var perr error          // error while accumulating
+	var h mergeHeap     // the next value of each pending request
+	var last *spb.Entry // used to deduplicate entries
+	var perr error      // error while accumulating
+
+	// next pushes the next value of the ith request onto h, if any.  It reports
+	// false if ctx is cancelled first.
+	next := func(i int) bool {
+		select {
+		case <-ctx.Done():
+			perr = ctx.Err()
+			return false
+		case e, ok := <-chs[i]:
+			if ok {
+				heap.Push(&h, mergeHead{e, i})
+			}
+			return true
+		}
+	}
 	go func() {
 		defer close(stop)
-		for {
-			hit := false // are any requests still pending?
-
-			// Give each channel a chance to produce a value, round-robin to
-			// preserve the global ordering.
-			for _, ch := range chs {
-				if e, ok := <-ch; ok {
-					hit = true
-					heap.Push(&h, e)
-				}
+		for i := range chs {
+			if !next(i) {
+				return
 			}
-
-			// If there are any values pending, deliver one to the consumer.
-			// If not, and there are no more values coming, we're finished.
-			if h.Len() != 0 {
-				entry := heap.Pop(&h).(*spb.Entry)
-				if last == nil || !compare.EntriesEqual(last, entry) {
-					last = entry
-					if err := f(entry); err != nil {
-						if err != io.EOF {
-							perr = err
-						}
-						return
+		}
+		for h.Len() != 0 {
+			if err := ctx.Err(); err != nil {
+				perr = err
+				return
+			}
+			head := heap.Pop(&h).(mergeHead)
+			if last == nil || compare.Entries(last, head.entry) != compare.EQ {
+				last = head.entry
+				if err := f(head.entry); err != nil {
+					if err != io.EOF {
+						perr = err
 					}
+					return
 				}
-			} else if !hit {
-				return // no more work to do
+			}
+			if !next(head.store) {
+				return
 			}
 		}
 	}()
-	err := waitErr(errc) // wait for all receives to complete
-	<-stop               // wait for all sends to complete
+	err = waitErr(errc) // wait for all receives to complete
+	<-stop              // wait for all sends to complete
 	if perr != nil {
 		return perr
+	} else if err == nil {
+		return nil
 	}
-	return err
+
+	var failures []Failure
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, Failure{Store: i, Name: members[i].name, Err: err})
+		}
+	}
+	if r, ok := ctx.Value(reportKey{}).(*Report); ok {
+		r.Failures = failures
+	}
+	if len(members)-len(failures) < p.policy.required(len(members)) {
+		return failures[0].Err
+	}
+	return nil
+}
+
+// mergeBuffer is the number of values buffered for each delegated request
+// while they are merged.
+const mergeBuffer = 16
+
+// A mergeHead is the next value of a delegated request.
+type mergeHead struct {
+	entry *spb.Entry
+	store int
+}
+
+// mergeHeap is a min-heap of mergeHeads in entry order.  The heads of equal
+// entries are ordered by store, so that the first store's value is delivered
+// when the stores disagree.
+type mergeHeap []mergeHead
+
+func (h mergeHeap) Len() int      { return len(h) }
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h mergeHeap) Less(i, j int) bool {
+	if c := compare.Entries(h[i].entry, h[j].entry); c != compare.EQ {
+		return c == compare.LT
+	}
+	return h[i].store < h[j].store
+}
+
+func (h *mergeHeap) Push(v interface{}) { *h = append(*h, v.(mergeHead)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	n := len(*h) - 1
+	out := (*h)[n]
+	*h = (*h)[:n]
+	return out
 }
@@ -20,9 +20,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/inmemory"
+	gstest "kythe.io/kythe/go/test/services/graphstore"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
@@ -92,6 +100,93 @@ func TestMergeOrder(t *testing.T) {
 	}
 }
 
+// Verify that overlapping stores are merged in entry order, and that entries
+// with equal keys are delivered once, with the value of the first store.
+func TestMergeOverlapping(t *testing.T) {
+	const numStores, numKeys = 4, 500
+	rng := rand.New(rand.NewSource(1))
+
+	var stores []graphstore.Service
+	mocks := make([]*mockGraphStore, numStores)
+	for i := range mocks {
+		mocks[i] = new(mockGraphStore)
+		stores = append(stores, mocks[i])
+	}
+	var want []*spb.Entry
+	for k := 0; k < numKeys; k++ {
+		first := true
+		for i, mock := range mocks {
+			if rng.Intn(3) != 0 {
+				continue
+			}
+			e := entry{K: fmt.Sprintf("k%04d", k), V: fmt.Sprintf("v%d", i)}.proto()
+			mock.Entries = append(mock.Entries, e)
+			if first {
+				want = append(want, e)
+				first = false
+			}
+		}
+	}
+
+	for _, op := range []struct {
+		name string
+		call func(graphstore.Service, graphstore.EntryFunc) error
+	}{
+		{"Read", func(s graphstore.Service, f graphstore.EntryFunc) error {
+			return s.Read(ctx, new(spb.ReadRequest), f)
+		}},
+		{"Scan", func(s graphstore.Service, f graphstore.EntryFunc) error {
+			return s.Scan(ctx, new(spb.ScanRequest), f)
+		}},
+	} {
+		results := make(chan *spb.Entry)
+		done := checkResults(t, op.name, results, want)
+		if err := op.call(New(stores...), func(e *spb.Entry) error {
+			results <- e
+			return nil
+		}); err != nil {
+			t.Errorf("%s failed: %v", op.name, err)
+		}
+		close(results)
+		<-done
+	}
+}
+
+// Verify that a slow consumer does not cause the proxy to buffer the results
+// of its stores.
+func TestMergeBackpressure(t *testing.T) {
+	var entries []*spb.Entry
+	for i := 0; i < 10*mergeBuffer; i++ {
+		entries = append(entries, entry{K: fmt.Sprintf("k%04d", i)}.proto())
+	}
+	counters := make([]*countingStore, 3)
+	var stores []graphstore.Service
+	for i := range counters {
+		counters[i] = &countingStore{mockGraphStore: mockGraphStore{Entries: entries}}
+		stores = append(stores, counters[i])
+	}
+
+	// Once the consumer stops, the stores are abandoned, so note how many
+	// entries they had sent while it was stalled.
+	sent := make([]int64, len(counters))
+	if err := New(stores...).Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		time.Sleep(50 * time.Millisecond) // let the stores get ahead
+		for i, c := range counters {
+			sent[i] = atomic.LoadInt64(&c.sent)
+		}
+		return io.EOF
+	}); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	// Each store may have buffered mergeBuffer entries, in addition to its
+	// entry in the merge and one more blocked in delivery.
+	for i, n := range sent {
+		if n > mergeBuffer+2 {
+			t.Errorf("Store %d sent %d entries; want at most %d", i, n, mergeBuffer+2)
+		}
+	}
+}
+
 func TestProxy(t *testing.T) {
 	testError := errors.New("test")
 	mocks := []*mockGraphStore{
@@ -144,7 +239,7 @@ func TestProxy(t *testing.T) {
 	}
 
 	writeReq := new(spb.WriteRequest)
-	if err := proxy.Write(ctx, writeReq); err != testError {
+	if err, ok := proxy.Write(ctx, writeReq).(*WriteError); !ok || len(err.Failed) != 1 || err.Failed[0].Err != testError {
 		t.Errorf("Incorrect Write error: %v", err)
 	}
 	for idx, mock := range mocks {
@@ -154,14 +249,113 @@ func TestProxy(t *testing.T) {
 	}
 }
 
+func TestPolicy(t *testing.T) {
+	errA, errB := errors.New("a"), errors.New("b")
+	mocks := func(errs ...error) []graphstore.Service {
+		return []graphstore.Service{
+			&mockGraphStore{Entries: tes(2, 3, 5), Error: errs[0]},
+			&mockGraphStore{Entries: tes(2, 4), Error: errs[1]},
+			&mockGraphStore{Entries: tes(3, 6), Error: errs[2]},
+		}
+	}
+	merged := tes(2, 3, 4, 5, 6)
+
+	tests := []struct {
+		policy  Policy
+		errs    []error
+		wantErr error
+		failed  []int
+	}{
+		{RequireAll, []error{nil, nil, nil}, nil, nil},
+		{RequireAll, []error{nil, errA, nil}, errA, []int{1}},
+		{Quorum(2), []error{nil, errA, nil}, nil, []int{1}},
+		{Quorum(2), []error{errA, nil, errB}, errA, []int{0, 2}},
+		{Quorum(5), []error{nil, errA, nil}, errA, []int{1}},
+		{Quorum(0), []error{nil, errA, nil}, errA, []int{1}},
+		{Any, []error{errA, nil, errB}, nil, []int{0, 2}},
+		{Any, []error{errA, errB, errB}, errA, []int{0, 1, 2}},
+	}
+	for _, test := range tests {
+		tag := fmt.Sprintf("%v %v", test.policy, test.errs)
+		p := NewWithPolicy(test.policy, mocks(test.errs...)...)
+
+		for _, op := range []struct {
+			name string
+			call func(context.Context, graphstore.EntryFunc) error
+		}{
+			{"Read", func(ctx context.Context, f graphstore.EntryFunc) error {
+				return p.Read(ctx, new(spb.ReadRequest), f)
+			}},
+			{"Scan", func(ctx context.Context, f graphstore.EntryFunc) error {
+				return p.Scan(ctx, new(spb.ScanRequest), f)
+			}},
+		} {
+			ctx, report := WithReport(ctx)
+			results := make(chan *spb.Entry)
+			done := checkResults(t, tag+" "+op.name, results, merged)
+			if err := op.call(ctx, func(e *spb.Entry) error {
+				results <- e
+				return nil
+			}); err != test.wantErr {
+				t.Errorf("%s %s: got error %v, want %v", tag, op.name, err, test.wantErr)
+			}
+			close(results)
+			<-done
+
+			if len(report.Failures) != len(test.failed) {
+				t.Errorf("%s %s: got failures %+v, want stores %v", tag, op.name, report.Failures, test.failed)
+				continue
+			}
+			for i, f := range report.Failures {
+				if f.Store != test.failed[i] || f.Err != test.errs[f.Store] {
+					t.Errorf("%s %s failure %d: got %+v, want store %d: %v", tag, op.name, i, f, test.failed[i], test.errs[test.failed[i]])
+				}
+			}
+		}
+	}
+}
+
+func TestPolicyCount(t *testing.T) {
+	testError := errors.New("test")
+	p, err := NewShardedWithPolicy(graphstore.HashShardFunc, Quorum(2),
+		&mockGraphStore{Entries: tes(2, 3)},
+		&mockGraphStore{Entries: tes(2, 4), Error: testError},
+		&mockGraphStore{Entries: tes(3, 5)},
+	)
+	if err != nil {
+		t.Fatalf("NewShardedWithPolicy: %v", err)
+	}
+	ctx, report := WithReport(ctx)
+	n, err := p.Count(ctx, &spb.CountRequest{Index: 0, Shards: 1})
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	} else if n != 4 {
+		t.Errorf("Count: got %d, want 4", n)
+	}
+	if len(report.Failures) != 1 || report.Failures[0].Store != 1 || report.Failures[0].Err != testError {
+		t.Errorf("Count failures: got %+v, want store 1: %v", report.Failures, testError)
+	}
+
+	p, err = NewShardedWithPolicy(graphstore.HashShardFunc, RequireAll,
+		&mockGraphStore{Entries: tes(2, 3)},
+		&mockGraphStore{Entries: tes(2, 4), Error: testError},
+	)
+	if err != nil {
+		t.Fatalf("NewShardedWithPolicy: %v", err)
+	}
+	if n, err := p.Count(ctx, &spb.CountRequest{Index: 0, Shards: 1}); err != testError {
+		t.Errorf("Count: got (%d, %v), want error %v", n, err, testError)
+	}
+}
+
 // Verify that a proxy store behaves sensibly if an operation fails.
 func TestCancellation(t *testing.T) {
 	bomb := entry{K: "bomb", F: "die", V: "horrible catastrophe"}
 	stores := []graphstore.Service{
-		&mockGraphStore{Entries: tes(8, 3, 2, 4, 5, 9, 2, 0)},
+		&mockGraphStore{Entries: tes(0, 2, 2, 3, 4, 5, 8, 9)},
 		&mockGraphStore{Entries: []*spb.Entry{bomb.proto()}},
-		&mockGraphStore{Entries: tes(1, 1, 1, 0, 1, 6, 5)},
-		&mockGraphStore{Entries: tes(3, 10, 7)},
+		&mockGraphStore{Entries: tes(0, 5, 6, 1, 1, 1, 1)},
+		&mockGraphStore{Entries: tes(3, 7, 10)},
 	}
 	p := New(stores...)
 
@@ -199,6 +393,475 @@ func TestCancellation(t *testing.T) {
 	}
 }
 
+// Verify that cancelling the context of a proxied operation stops it.
+func TestContextCancellation(t *testing.T) {
+	stores := []graphstore.Service{
+		&mockGraphStore{Entries: tes(2, 3, 5, 7, 9)},
+		&mockGraphStore{Entries: tes(4, 6, 8, 10)},
+	}
+	p := New(stores...)
+
+	cctx, cancel := context.WithCancel(ctx)
+	var numEntries int
+	if err := p.Scan(cctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		numEntries++
+		if numEntries == 2 {
+			cancel()
+		}
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("Scan: got error %v, want %v", err, context.Canceled)
+	}
+	if numEntries != 2 {
+		t.Errorf("Wrong number of entries scanned: got %d, want 2", numEntries)
+	}
+
+	if err := p.Read(cctx, new(spb.ReadRequest), func(e *spb.Entry) error {
+		t.Errorf("Read: unexpected entry after cancellation: {%+v}", e)
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("Read: got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestWriteIfAbsent(t *testing.T) {
+	// A store that does not itself implement graphstore.OptionsWriter.
+	plain := struct{ graphstore.Service }{inmemory.Create()}
+	p := New(plain).(graphstore.OptionsWriter)
+	gstest.CheckWriteIfAbsent(t, plain, func(req *spb.WriteRequest, opts *graphstore.WriteOptions) (*graphstore.WriteStats, error) {
+		return p.WriteOpts(ctx, req, opts)
+	})
+
+	native := inmemory.Create()
+	src := &spb.VName{Signature: "src"}
+	if err := native.Write(ctx, &spb.WriteRequest{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{{FactName: "/a", FactValue: []byte("0")}},
+	}); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	p = New(native, struct{ graphstore.Service }{inmemory.Create()}).(graphstore.OptionsWriter)
+	stats, err := p.WriteOpts(ctx, &spb.WriteRequest{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/a", FactValue: []byte("1")},
+			{FactName: "/b", FactValue: []byte("2")},
+		},
+	}, &graphstore.WriteOptions{IfAbsent: true})
+	if err != nil {
+		t.Fatalf("WriteOpts error: %v", err)
+	}
+	// The stats are those of the first store, not the sum of both.
+	if want := (graphstore.WriteStats{Inserted: 1, Skipped: 1}); *stats != want {
+		t.Errorf("WriteOpts stats: got %+v; want %+v", *stats, want)
+	}
+
+	p = New(inmemory.Create(), inmemory.Create(), inmemory.Create()).(graphstore.OptionsWriter)
+	stats, err = p.WriteOpts(ctx, &spb.WriteRequest{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{{FactName: "/a", FactValue: []byte("1")}},
+	}, nil)
+	if err != nil {
+		t.Fatalf("WriteOpts error: %v", err)
+	}
+	if want := (graphstore.WriteStats{Inserted: 1}); *stats != want {
+		t.Errorf("WriteOpts stats of 3 replicas: got %+v; want %+v", *stats, want)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	errB, errD := errors.New("b"), errors.New("d")
+	a, c := inmemory.Create(), inmemory.Create()
+	b := &failingWrites{inmemory.Create(), errB}
+	d := &failingWrites{inmemory.Create(), errD}
+	p := New(a, b, c, d)
+
+	src := &spb.VName{Signature: "src"}
+	req := &spb.WriteRequest{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/a", FactValue: []byte("1")},
+			{EdgeKind: "/edge", Target: &spb.VName{Signature: "tgt"}, FactName: "/"},
+		},
+	}
+	err := p.Write(ctx, req)
+	werr, ok := err.(*WriteError)
+	if !ok {
+		t.Fatalf("Write: got error %v, want a *WriteError", err)
+	}
+	if len(werr.Succeeded) != 2 || werr.Succeeded[0] != 0 || werr.Succeeded[1] != 2 {
+		t.Errorf("Succeeded: got %v, want [0 2]", werr.Succeeded)
+	}
+	if len(werr.Failed) != 2 || werr.Failed[0] != (Failure{1, "1", errB}) || werr.Failed[1] != (Failure{3, "3", errD}) {
+		t.Errorf("Failed: got %+v, want [{1 %v} {3 %v}]", werr.Failed, errB, errD)
+	}
+	if errs := werr.Unwrap(); len(errs) != 2 || errs[0] != errB || errs[1] != errD {
+		t.Errorf("Unwrap: got %v, want [%v %v]", errs, errB, errD)
+	}
+	if _, err := p.(graphstore.OptionsWriter).WriteOpts(ctx, req, nil); err == nil {
+		t.Error("WriteOpts: unexpected success")
+	} else if _, ok := err.(*WriteError); !ok {
+		t.Errorf("WriteOpts: got error %v, want a *WriteError", err)
+	}
+
+	// Repair the failed stores once they recover.
+	b.err, d.err = nil, nil
+	if err := werr.RepairSource(ctx, src); err != nil {
+		t.Fatalf("RepairSource: %v", err)
+	}
+	want := readSource(t, a, src)
+	if len(want) != 2 {
+		t.Fatalf("Found %d entries; want 2", len(want))
+	}
+	for _, s := range []graphstore.Service{b, d} {
+		if got := readSource(t, s, src); len(got) != len(want) {
+			t.Errorf("Repaired store has %d entries; want %d", len(got), len(want))
+		} else {
+			for i := range want {
+				if !proto.Equal(got[i], want[i]) {
+					t.Errorf("Repaired entry %d: got {%+v}, want {%+v}", i, got[i], want[i])
+				}
+			}
+		}
+	}
+
+	// A write that fails for every store reports a plain error.
+	all := New(&failingWrites{inmemory.Create(), errB}, &failingWrites{inmemory.Create(), errD})
+	if err := all.Write(ctx, req); err != errB {
+		t.Errorf("Write: got error %v, want %v", err, errB)
+	}
+}
+
+// readSource returns the entries of src in s.
+func readSource(t *testing.T, s graphstore.Service, src *spb.VName) []*spb.Entry {
+	var entries []*spb.Entry
+	if err := s.Read(ctx, &spb.ReadRequest{Source: src, EdgeKind: "*"}, func(e *spb.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	return entries
+}
+
+func TestMembership(t *testing.T) {
+	a := &closeRecorder{Service: &mockGraphStore{Entries: tes(2, 4)}}
+	b := &closeRecorder{Service: &mockGraphStore{Entries: tes(3)}}
+	p := New(a).(Dynamic)
+
+	if err := p.AddStore("b", b); err != nil {
+		t.Fatalf("AddStore: %v", err)
+	}
+	if err := p.AddStore("b", b); err != ErrDuplicateStore {
+		t.Errorf("AddStore: got error %v, want %v", err, ErrDuplicateStore)
+	}
+	checkMembers(t, p, Member{Name: "0"}, Member{Name: "b"})
+	checkScan(t, p, tes(2, 3, 4))
+
+	if err := p.RemoveStore(ctx, "0"); err != nil {
+		t.Fatalf("RemoveStore: %v", err)
+	}
+	if err := p.RemoveStore(ctx, "0"); err != ErrUnknownStore {
+		t.Errorf("RemoveStore: got error %v, want %v", err, ErrUnknownStore)
+	}
+	if n := atomic.LoadInt32(&a.closed); n != 1 {
+		t.Errorf("Removed store was closed %d times; want 1", n)
+	}
+	checkMembers(t, p, Member{Name: "b"})
+	checkScan(t, p, tes(3))
+}
+
+// Verify that a Scan in flight uses the members at its start, and that the
+// members it uses are not closed until it completes.
+func TestMembershipDuringScan(t *testing.T) {
+	started, proceed := make(chan struct{}), make(chan struct{})
+	slow := &closeRecorder{Service: &gatedStore{
+		mockGraphStore: mockGraphStore{Entries: tes(2, 4)},
+		started:        started,
+		proceed:        proceed,
+	}}
+	p := New(slow, &mockGraphStore{Entries: tes(3)}).(Dynamic)
+
+	scanned := make(chan []*spb.Entry)
+	go func() {
+		var entries []*spb.Entry
+		if err := p.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+			entries = append(entries, e)
+			return nil
+		}); err != nil {
+			t.Errorf("Scan: %v", err)
+		}
+		scanned <- entries
+	}()
+	<-started
+	checkMembers(t, p, Member{Name: "0", InFlight: 1}, Member{Name: "1", InFlight: 1})
+
+	if err := p.AddStore("2", &mockGraphStore{Entries: tes(5)}); err != nil {
+		t.Fatalf("AddStore: %v", err)
+	}
+	removed := make(chan error)
+	go func() { removed <- p.RemoveStore(ctx, "0") }()
+	for len(p.Members()) != 2 {
+		runtime.Gosched() // wait for the removal to take effect
+	}
+
+	// New operations use the new members, while the Scan is still in flight.
+	checkMembers(t, p, Member{Name: "1", InFlight: 1}, Member{Name: "2"})
+	checkScan(t, p, tes(3, 5))
+	select {
+	case err := <-removed:
+		t.Fatalf("RemoveStore returned (%v) while its store was in use", err)
+	default:
+	}
+	if n := atomic.LoadInt32(&slow.closed); n != 0 {
+		t.Fatalf("Store closed while in use")
+	}
+
+	close(proceed)
+	if got, want := <-scanned, tes(2, 3, 4); len(got) != len(want) {
+		t.Errorf("In-flight Scan: got %v, want %v", got, want)
+	} else {
+		for i := range want {
+			if !proto.Equal(got[i], want[i]) {
+				t.Errorf("In-flight Scan result %d: got {%+v}, want {%+v}", i, got[i], want[i])
+			}
+		}
+	}
+	if err := <-removed; err != nil {
+		t.Errorf("RemoveStore: %v", err)
+	}
+	if n := atomic.LoadInt32(&slow.closed); n != 1 {
+		t.Errorf("Removed store was closed %d times; want 1", n)
+	}
+	checkMembers(t, p, Member{Name: "1"}, Member{Name: "2"})
+}
+
+// Stress the proxy by repeatedly adding and removing members during Scans.
+func TestMembershipStress(t *testing.T) {
+	// A long Scan, so that members are added and removed while it is in flight.
+	var entries []*spb.Entry
+	for i := 0; i < 2000; i++ {
+		entries = append(entries, entry{K: fmt.Sprintf("k%04d", i)}.proto())
+	}
+	p := New(&mockGraphStore{Entries: entries}).(Dynamic)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var n int
+				if err := p.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+					n++
+					return nil
+				}); err != nil {
+					t.Errorf("Scan: %v", err)
+					return
+				} else if n != len(entries) {
+					t.Errorf("Scan found %d entries; want %d", n, len(entries))
+					return
+				}
+			}
+		}()
+	}
+
+	var stores []*closeRecorder
+	for i := 0; i < 200; i++ {
+		// Each member has a subset of the entries, so the merged Scan is the same.
+		s := &closeRecorder{Service: &mockGraphStore{Entries: entries[i%len(entries):]}}
+		stores = append(stores, s)
+		name := strconv.Itoa(i + 1)
+		if err := p.AddStore(name, s); err != nil {
+			t.Fatalf("AddStore(%q): %v", name, err)
+		}
+		if i%2 == 1 {
+			if err := p.RemoveStore(ctx, strconv.Itoa(i)); err != nil {
+				t.Fatalf("RemoveStore(%q): %v", strconv.Itoa(i), err)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	for i, s := range stores {
+		want := int32(0)
+		if i%2 == 0 {
+			want = 1 // removed
+		}
+		if n := atomic.LoadInt32(&s.closed); n != want {
+			t.Errorf("Store %d was closed %d times; want %d", i+1, n, want)
+		}
+	}
+	for _, m := range p.Members() {
+		if m.InFlight != 0 {
+			t.Errorf("Member %q has %d operations in flight; want 0", m.Name, m.InFlight)
+		}
+	}
+}
+
+func checkMembers(t *testing.T, p Dynamic, want ...Member) {
+	got := p.Members()
+	if len(got) != len(want) {
+		t.Errorf("Members: got %+v, want %+v", got, want)
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Member %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func checkScan(t *testing.T, s graphstore.Service, want []*spb.Entry) {
+	results := make(chan *spb.Entry)
+	done := checkResults(t, "Scan", results, want)
+	if err := s.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		results <- e
+		return nil
+	}); err != nil {
+		t.Errorf("Scan: %v", err)
+	}
+	close(results)
+	<-done
+}
+
+func TestHealth(t *testing.T) {
+	errDown := errors.New("down")
+	a := &flappingStore{Service: inmemory.Create()}
+	b := &flappingStore{Service: inmemory.Create(), results: []error{errDown, errDown, nil, nil}}
+	gs := NewWithHealth(Any, &HealthOptions{Interval: time.Hour, RecoverAfter: 2}, a, b)
+	defer gs.Close(ctx)
+	p := gs.(*proxyService)
+
+	src := &spb.VName{Signature: "src"}
+	write := func(value string) error {
+		return p.Write(ctx, &spb.WriteRequest{
+			Source: src,
+			Update: []*spb.WriteRequest_Update{{FactName: "/a", FactValue: []byte(value)}},
+		})
+	}
+
+	p.probe(ctx)
+	checkMembers(t, p, Member{Name: "0"}, Member{Name: "1", Unhealthy: errDown})
+	if err := p.CheckHealth(ctx); err != nil {
+		t.Errorf("CheckHealth: %v", err)
+	}
+
+	// Writes are still made to the unhealthy store, but reads are not.
+	if err := write("1"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := b.Write(ctx, &spb.WriteRequest{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{{FactName: "/b", FactValue: []byte("b")}},
+	}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := readSource(t, p, src); len(got) != 1 {
+		t.Errorf("Read found %d entries; want 1", len(got))
+	}
+
+	// The store is included again after RecoverAfter successful probes.
+	p.probe(ctx) // fails
+	p.probe(ctx)
+	checkMembers(t, p, Member{Name: "0"}, Member{Name: "1", Unhealthy: errDown})
+	p.probe(ctx)
+	checkMembers(t, p, Member{Name: "0"}, Member{Name: "1"})
+	if got := readSource(t, p, src); len(got) != 2 {
+		t.Errorf("Read found %d entries; want 2", len(got))
+	}
+
+	// With every store unhealthy, reads fail.
+	a.setResults(errDown)
+	b.setResults(errDown)
+	p.probe(ctx)
+	if err := p.Read(ctx, &spb.ReadRequest{Source: src}, func(*spb.Entry) error { return nil }); err != ErrNoHealthyStores {
+		t.Errorf("Read: got error %v, want %v", err, ErrNoHealthyStores)
+	}
+	if err := p.CheckHealth(ctx); err == nil {
+		t.Error("CheckHealth: unexpected success")
+	}
+}
+
+func TestHealthExcludeWrites(t *testing.T) {
+	errDown := errors.New("down")
+	a := &flappingStore{Service: inmemory.Create()}
+	b := &flappingStore{Service: inmemory.Create(), results: []error{errDown}}
+	gs := NewWithHealth(RequireAll, &HealthOptions{Interval: time.Hour, ExcludeWrites: true}, a, b)
+	defer gs.Close(ctx)
+	p := gs.(*proxyService)
+	p.probe(ctx)
+
+	src := &spb.VName{Signature: "src"}
+	if err := p.Write(ctx, &spb.WriteRequest{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{{FactName: "/a", FactValue: []byte("1")}},
+	}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := readSource(t, a, src); len(got) != 1 {
+		t.Errorf("Healthy store has %d entries; want 1", len(got))
+	}
+	if got := readSource(t, b, src); len(got) != 0 {
+		t.Errorf("Excluded store has %d entries; want 0", len(got))
+	}
+	if err := p.CheckHealth(ctx); err == nil {
+		t.Error("CheckHealth: unexpected success under RequireAll")
+	}
+}
+
+func TestHealthProbeLoop(t *testing.T) {
+	errDown := errors.New("down")
+	b := &flappingStore{Service: inmemory.Create(), results: []error{errDown}}
+	p := NewWithHealth(Any, &HealthOptions{Interval: time.Millisecond}, inmemory.Create(), b).(Dynamic)
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Members()[1].Unhealthy == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if p.Members()[1].Unhealthy != errDown {
+		t.Errorf("Store was not excluded: %+v", p.Members()[1])
+	}
+	if err := p.Close(ctx); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestCheckHealthUnprobed(t *testing.T) {
+	errDown := errors.New("down")
+	b := &flappingStore{Service: inmemory.Create(), results: []error{errDown}}
+	if err := graphstore.CheckHealth(ctx, New(inmemory.Create(), b)); err == nil {
+		t.Error("CheckHealth: unexpected success under RequireAll")
+	}
+	b.setResults(errDown)
+	if err := graphstore.CheckHealth(ctx, NewWithPolicy(Any, inmemory.Create(), b)); err != nil {
+		t.Errorf("CheckHealth: %v", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	src := &spb.VName{Signature: "src"}
+	p := New(inmemory.Create())
+	if swapped, err := graphstore.CompareAndSwap(ctx, p, src, "/a", nil, []byte("1")); err != nil || !swapped {
+		t.Errorf("CompareAndSwap of a single store: got (%v, %v); want (true, <nil>)", swapped, err)
+	}
+
+	for _, p := range []graphstore.Service{
+		New(inmemory.Create(), inmemory.Create()),
+		New(struct{ graphstore.Service }{inmemory.Create()}),
+	} {
+		if _, err := graphstore.CompareAndSwap(ctx, p, src, "/a", nil, []byte("1")); err != graphstore.ErrUnsupported {
+			t.Errorf("CompareAndSwap error: got %v; want %v", err, graphstore.ErrUnsupported)
+		}
+	}
+}
+
 type vname struct {
 	S, C, R, P, L string
 }
@@ -232,10 +895,18 @@ type mockGraphStore struct {
 	Entries []*spb.Entry
 	LastReq proto.Message
 	Error   error
+
+	mu sync.Mutex // guards LastReq during concurrent requests
 }
 
-func (m *mockGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+func (m *mockGraphStore) setLastReq(req proto.Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.LastReq = req
+}
+
+func (m *mockGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	m.setLastReq(req)
 	for _, entry := range m.Entries {
 		if err := f(entry); err == io.EOF {
 			return nil
@@ -247,7 +918,7 @@ func (m *mockGraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graph
 }
 
 func (m *mockGraphStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
-	m.LastReq = req
+	m.setLastReq(req)
 	for _, entry := range m.Entries {
 		if err := f(entry); err == io.EOF {
 			return nil
@@ -259,12 +930,156 @@ func (m *mockGraphStore) Scan(ctx context.Context, req *spb.ScanRequest, f graph
 }
 
 func (m *mockGraphStore) Write(ctx context.Context, req *spb.WriteRequest) error {
-	m.LastReq = req
+	m.setLastReq(req)
 	return m.Error
 }
 
 func (m *mockGraphStore) Close(ctx context.Context) error { return m.Error }
 
+// failingWrites is a graphstore.Service whose Writes fail with err, if it is
+// non-nil.
+type failingWrites struct {
+	graphstore.Service
+	err error
+}
+
+func (f *failingWrites) Write(ctx context.Context, req *spb.WriteRequest) error {
+	if f.err != nil {
+		return f.err
+	}
+	return f.Service.Write(ctx, req)
+}
+
+// flappingStore is a graphstore.Service whose health checks return the
+// scripted results in turn, then succeed.
+type flappingStore struct {
+	graphstore.Service
+
+	mu      sync.Mutex
+	results []error
+}
+
+func (f *flappingStore) setResults(results ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results = results
+}
+
+// CheckHealth implements the graphstore.HealthChecker interface.
+func (f *flappingStore) CheckHealth(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.results) == 0 {
+		return nil
+	}
+	err := f.results[0]
+	f.results = f.results[1:]
+	return err
+}
+
+var errClosed = errors.New("store is closed")
+
+// closeRecorder is a graphstore.Service that counts its Closes, rather than
+// closing the underlying store, and whose Scans fail if it is closed before or
+// during them.
+type closeRecorder struct {
+	graphstore.Service
+	closed int32 // atomic
+}
+
+func (c *closeRecorder) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return errClosed
+	}
+	err := c.Service.Scan(ctx, req, f)
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return errClosed
+	}
+	return err
+}
+
+func (c *closeRecorder) Close(ctx context.Context) error {
+	atomic.AddInt32(&c.closed, 1)
+	return nil
+}
+
+// gatedStore is a mockGraphStore whose Scan closes started, then waits for
+// proceed to be closed before sending its entries.
+type gatedStore struct {
+	mockGraphStore
+	started, proceed chan struct{}
+}
+
+func (g *gatedStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	close(g.started)
+	<-g.proceed
+	return g.mockGraphStore.Scan(ctx, req, f)
+}
+
+// countingStore is a mockGraphStore that counts the entries its Scans send.
+type countingStore struct {
+	mockGraphStore
+	sent int64 // atomic
+}
+
+func (c *countingStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return c.mockGraphStore.Scan(ctx, req, func(e *spb.Entry) error {
+		atomic.AddInt64(&c.sent, 1)
+		return f(e)
+	})
+}
+
+// delayedStore is a mockGraphStore whose Scans wait before sending each batch
+// of entries, as a remote store might.
+type delayedStore struct {
+	mockGraphStore
+	batch int
+	delay time.Duration
+}
+
+func (d *delayedStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	var n int
+	return d.mockGraphStore.Scan(ctx, req, func(e *spb.Entry) error {
+		if n%d.batch == 0 {
+			time.Sleep(d.delay)
+		}
+		n++
+		return f(e)
+	})
+}
+
+// benchmarkMerge benchmarks Scans of a proxy over n delayed stores, each with
+// the same number of distinct entries.  If the stores are read concurrently,
+// the time per Scan should not depend much on n.
+func benchmarkMerge(b *testing.B, n int) {
+	const entriesPerStore = 100
+	var stores []graphstore.Service
+	for i := 0; i < n; i++ {
+		s := &delayedStore{batch: 10, delay: time.Millisecond}
+		for j := 0; j < entriesPerStore; j++ {
+			s.Entries = append(s.Entries, entry{K: fmt.Sprintf("k%04d.%d", j, i)}.proto())
+		}
+		stores = append(stores, s)
+	}
+	p := New(stores...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var count int
+		if err := p.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+			count++
+			return nil
+		}); err != nil {
+			b.Fatalf("Scan failed: %v", err)
+		} else if count != n*entriesPerStore {
+			b.Fatalf("Scan found %d entries; want %d", count, n*entriesPerStore)
+		}
+	}
+}
+
+func BenchmarkMerge1(b *testing.B)  { benchmarkMerge(b, 1) }
+func BenchmarkMerge4(b *testing.B)  { benchmarkMerge(b, 4) }
+func BenchmarkMerge16(b *testing.B) { benchmarkMerge(b, 16) }
+
 // checkResults starts a goroutine that consumes entries from results and
 // compares them to corresponding members of want.  If the corresponding values
 // are unequal or if there are more or fewer results than wanted, errors are
@@ -293,3 +1108,97 @@ func checkResults(t *testing.T, tag string, results <-chan *spb.Entry, want []*s
 	}()
 	return done
 }
+
+func writeFact(s graphstore.Service, src *spb.VName, value string) error {
+	return s.Write(ctx, &spb.WriteRequest{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{{FactName: "/a", FactValue: []byte(value)}},
+	})
+}
+
+func TestRouted(t *testing.T) {
+	java, goStore, fallback := inmemory.Create(), inmemory.Create(), inmemory.Create()
+	router := NewRouter(map[string]string{"openjdk": "java", "kythe": "go"}, "")
+	p := NewRouted(router, RequireAll, nil)
+	defer p.Close(ctx)
+	for name, s := range map[string]graphstore.Service{"java": java, "go": goStore, "fallback": fallback} {
+		if err := p.AddStore(name, s); err != nil {
+			t.Fatalf("AddStore: %v", err)
+		}
+	}
+
+	jdk := &spb.VName{Signature: "jdk", Corpus: "openjdk"}
+	ky := &spb.VName{Signature: "ky", Corpus: "kythe"}
+	other := &spb.VName{Signature: "other", Corpus: "other"}
+	for _, src := range []*spb.VName{jdk, ky} {
+		if err := writeFact(p, src, "1"); err != nil {
+			t.Fatalf("Write %v: %v", src, err)
+		}
+	}
+	if err, want := writeFact(p, other, "1"), (&UnroutedError{"other"}); err == nil || err.Error() != want.Error() {
+		t.Errorf("Write of an unrouted corpus: got error %v; want %v", err, want)
+	}
+	for _, test := range []struct {
+		s       graphstore.Service
+		src     *spb.VName
+		entries int
+	}{
+		{java, jdk, 1}, {java, ky, 0},
+		{goStore, jdk, 0}, {goStore, ky, 1},
+		{fallback, jdk, 0}, {fallback, ky, 0}, {fallback, other, 0},
+		{p, jdk, 1}, {p, ky, 1},
+	} {
+		if got := readSource(t, test.s, test.src); len(got) != test.entries {
+			t.Errorf("Read of %v: got %d entries; want %d", test.src, len(got), test.entries)
+		}
+	}
+
+	// Reload the routes: kythe moves to the fallback store, as do unrouted
+	// corpora.
+	router.SetRoutes(map[string]string{"openjdk": "java"}, "fallback")
+	for _, src := range []*spb.VName{ky, other} {
+		if err := writeFact(p, src, "2"); err != nil {
+			t.Fatalf("Write %v: %v", src, err)
+		}
+	}
+	if got := readSource(t, fallback, ky); len(got) != 1 {
+		t.Errorf("Fallback store has %d entries of %v; want 1", len(got), ky)
+	}
+	if got := readSource(t, fallback, other); len(got) != 1 {
+		t.Errorf("Fallback store has %d entries of %v; want 1", len(got), other)
+	}
+	// The proxy merges the stale kythe entry of the go store with that of the
+	// fallback store, in member order.
+	if got := readSource(t, p, ky); len(got) != 1 {
+		t.Errorf("Read of %v through the proxy: got %d entries; want 1", ky, len(got))
+	}
+
+	if swapped, err := graphstore.CompareAndSwap(ctx, p, jdk, "/a", []byte("1"), []byte("3")); err != nil || !swapped {
+		t.Errorf("CompareAndSwap: got (%v, %v); want (true, <nil>)", swapped, err)
+	}
+	if got := readSource(t, java, jdk); len(got) != 1 || string(got[0].FactValue) != "3" {
+		t.Errorf("Routed store after CompareAndSwap: %v", got)
+	}
+
+	router.SetRoutes(map[string]string{"openjdk": "missing"}, "")
+	if err := writeFact(p, jdk, "4"); err == nil {
+		t.Error("Write routed to an unknown store: unexpected success")
+	}
+	if routes, fallback := router.Routes(); len(routes) != 1 || routes["openjdk"] != "missing" || fallback != "" {
+		t.Errorf("Routes: got (%v, %q)", routes, fallback)
+	}
+}
+
+func TestRoutedExcludeWrites(t *testing.T) {
+	errDown := errors.New("down")
+	a := &flappingStore{Service: inmemory.Create(), results: []error{errDown}}
+	p := NewRouted(NewRouter(nil, "a"), RequireAll, &HealthOptions{Interval: time.Hour, ExcludeWrites: true})
+	defer p.Close(ctx)
+	if err := p.AddStore("a", a); err != nil {
+		t.Fatalf("AddStore: %v", err)
+	}
+	p.(*proxyService).probe(ctx)
+	if err := writeFact(p, &spb.VName{Signature: "src"}, "1"); err == nil {
+		t.Error("Write routed to an unhealthy store: unexpected success")
+	}
+}
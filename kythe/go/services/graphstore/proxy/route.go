@@ -0,0 +1,175 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"kythe.io/kythe/go/services/graphstore"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+
+	"golang.org/x/net/context"
+)
+
+// An UnroutedError is returned by a write of a routed proxy (see NewRouted)
+// for a corpus that has no route and no default store.
+type UnroutedError struct {
+	Corpus string
+}
+
+func (e *UnroutedError) Error() string {
+	return fmt.Sprintf("no proxy store for corpus %q", e.Corpus)
+}
+
+// A Router routes the writes of each corpus to the named member store of a
+// proxy that owns it (see NewRouted).  Its routes may be replaced while it is
+// in use.
+type Router struct {
+	mu       sync.RWMutex
+	corpora  map[string]string
+	fallback string
+}
+
+// NewRouter returns a Router of the given routes, from corpus to store name,
+// that routes the corpora without a route to the store named by fallback or,
+// if it is empty, fails their writes with an *UnroutedError.
+func NewRouter(corpora map[string]string, fallback string) *Router {
+	r := new(Router)
+	r.SetRoutes(corpora, fallback)
+	return r
+}
+
+// SetRoutes replaces the routes of r, as given to NewRouter.  Writes that
+// start afterward use the new routes.
+func (r *Router) SetRoutes(corpora map[string]string, fallback string) {
+	routes := make(map[string]string, len(corpora))
+	for corpus, name := range corpora {
+		routes[corpus] = name
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.corpora, r.fallback = routes, fallback
+}
+
+// Routes returns a copy of the routes of r and its fallback store.
+func (r *Router) Routes() (map[string]string, string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	routes := make(map[string]string, len(r.corpora))
+	for corpus, name := range r.corpora {
+		routes[corpus] = name
+	}
+	return routes, r.fallback
+}
+
+// Route returns the name of the store to which the writes of corpus are
+// routed, or an *UnroutedError.
+func (r *Router) Route(corpus string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if name, ok := r.corpora[corpus]; ok {
+		return name, nil
+	} else if r.fallback != "" {
+		return r.fallback, nil
+	}
+	return "", &UnroutedError{corpus}
+}
+
+// LoadRoutes returns the routes of a JSON file mapping each corpus to the name
+// of its store, e.g.
+//   {"kythe": "go", "openjdk": "java"}
+func LoadRoutes(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var routes map[string]string
+	if err := json.NewDecoder(f).Decode(&routes); err != nil {
+		return nil, fmt.Errorf("invalid routes file %q: %v", file, err)
+	}
+	return routes, nil
+}
+
+// NewRouted returns an empty proxy, as from NewWithPolicy, each of whose Writes
+// (and CompareAndSwaps) is made only to the member store to which router
+// routes the corpus of its source, so that each store holds the corpora it
+// owns.  Its Reads and Scans still merge those of every member.  The stores
+// are added, with the names to which router routes, as a Dynamic.  If health
+// is non-nil, the stores are probed as by NewWithHealth; a write routed to a
+// store excluded from writes then fails.
+func NewRouted(router *Router, policy Policy, health *HealthOptions) Dynamic {
+	p := newProxy(policy, nil)
+	p.router = router
+	if health != nil {
+		p.startProbes(health)
+	}
+	return p
+}
+
+// acquireRouted returns the member to which the writes of corpus are routed,
+// as by acquireHealthy.
+func (p *proxyService) acquireRouted(corpus string) ([]*member, error) {
+	name, err := p.router.Route(corpus)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range p.members {
+		if m.name != name {
+			continue
+		} else if m.unhealthy != nil && p.health.ExcludeWrites {
+			return nil, fmt.Errorf("proxy store %q of corpus %q is unhealthy: %v", name, corpus, m.unhealthy)
+		}
+		m.refs++
+		return []*member{m}, nil
+	}
+	return nil, fmt.Errorf("proxy store %q of corpus %q: %v", name, corpus, ErrUnknownStore)
+}
+
+// acquireWriters returns the members to which a write of the given source is
+// made, as by acquireHealthy.
+func (p *proxyService) acquireWriters(src *spb.VName) ([]*member, error) {
+	if p.router != nil {
+		return p.acquireRouted(corpus(src))
+	}
+	return p.acquireHealthy(true)
+}
+
+// corpus returns the corpus of v, which may be nil.
+func corpus(v *spb.VName) string {
+	if v == nil {
+		return ""
+	}
+	return v.Corpus
+}
+
+// compareAndSwapRouted implements CompareAndSwap for a routed proxy by swapping
+// in the store of the source's corpus.
+func (p *proxyService) compareAndSwapRouted(ctx context.Context, source *spb.VName, factName string, oldValue, newValue []byte) (bool, error) {
+	members, err := p.acquireRouted(corpus(source))
+	if err != nil {
+		return false, err
+	}
+	defer p.release(members)
+	return graphstore.CompareAndSwap(ctx, members[0].store, source, factName, oldValue, newValue)
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// FactReader is an optional interface for a Service that can read a subset of
+// a node's facts without reading the rest.
+type FactReader interface {
+	Service
+
+	// ReadFacts calls f with each node fact of src whose name has one of the
+	// given prefixes (or every node fact, if there are no prefixes).
+	ReadFacts(ctx context.Context, src *spb.VName, factPrefixes []string, f EntryFunc) error
+}
+
+// ReadFacts calls f with each node fact (an entry without an edge kind) of src
+// in s whose name has one of the given prefixes.  If factPrefixes is empty,
+// every node fact of src is read.  If s does not implement FactReader, all of
+// src's node facts are read from s and filtered.
+func ReadFacts(ctx context.Context, s Service, src *spb.VName, factPrefixes []string, f EntryFunc) error {
+	if fr, ok := s.(FactReader); ok {
+		return fr.ReadFacts(ctx, src, factPrefixes, f)
+	}
+	return s.Read(ctx, &spb.ReadRequest{Source: src}, func(e *spb.Entry) error {
+		if !HasAnyPrefix(e.FactName, factPrefixes) {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+// HasAnyPrefix reports whether s has any of the given prefixes.  Every string
+// is considered to match an empty set of prefixes.
+func HasAnyPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// ReadOnly returns a Service passing reads through to s but failing each Write
+// and Delete with ErrReadOnly.  If s is Sharded, so is the returned Service.
+func ReadOnly(s Service) Service {
+	ro := &readOnly{s}
+	if sh, ok := s.(Sharded); ok {
+		return &readOnlySharded{ro, sh}
+	}
+	return ro
+}
+
+type readOnly struct{ s Service }
+
+// Read implements part of the Service interface.
+func (r *readOnly) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	return r.s.Read(ctx, req, f)
+}
+
+// Scan implements part of the Service interface.
+func (r *readOnly) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	return r.s.Scan(ctx, req, f)
+}
+
+// Write implements part of the Service interface by returning ErrReadOnly.
+func (r *readOnly) Write(ctx context.Context, req *spb.WriteRequest) error { return ErrReadOnly }
+
+// Delete implements part of the Deleter interface by returning ErrReadOnly.
+func (r *readOnly) Delete(ctx context.Context, req *DeleteRequest) error { return ErrReadOnly }
+
+// ScansOrdered implements the OrderedScanner interface.
+func (r *readOnly) ScansOrdered() bool { return ScansOrdered(r.s) }
+
+// Close implements part of the Service interface.
+func (r *readOnly) Close(ctx context.Context) error { return r.s.Close(ctx) }
+
+type readOnlySharded struct {
+	*readOnly
+	sh Sharded
+}
+
+// Count implements part of the Sharded interface.
+func (r *readOnlySharded) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	return r.sh.Count(ctx, req)
+}
+
+// Shard implements part of the Sharded interface.
+func (r *readOnlySharded) Shard(ctx context.Context, req *spb.ShardRequest, f EntryFunc) error {
+	return r.sh.Shard(ctx, req, f)
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// An Opener opens the Service named by a spec URL whose scheme the Opener was
+// registered with.
+type Opener func(ctx context.Context, u *url.URL) (Service, error)
+
+var openers = make(map[string]Opener)
+
+// Register makes the given Opener available to Open for specs with the given
+// scheme.  Backends register their schemes from their packages' init
+// functions; a scheme can only be registered once.
+func Register(scheme string, o Opener) {
+	if scheme == "" || scheme != strings.ToLower(scheme) {
+		log.Fatalf("invalid GraphStore scheme %q", scheme)
+	} else if _, exists := openers[scheme]; exists {
+		log.Fatalf("GraphStore scheme %q already registered", scheme)
+	}
+	openers[scheme] = o
+}
+
+// Schemes returns the registered GraphStore schemes, in order.
+func Schemes() []string {
+	schemes := make([]string, 0, len(openers))
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open returns the Service named by the given spec, a URL whose scheme has
+// been registered with Register.  For example, "leveldb:///data/gs",
+// "sqlite:///tmp/gs.db", "grpc://host:port", and "proxy:spec1,spec2" each name
+// a Service if the backend of their scheme is linked into the program.
+func Open(ctx context.Context, spec string) (Service, error) {
+	u, err := url.Parse(strings.TrimSpace(spec))
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return nil, fmt.Errorf("malformed GraphStore spec %q: %v", spec, err)
+	} else if u.Scheme == "" {
+		return nil, fmt.Errorf("GraphStore spec %q has no scheme (registered schemes: %s)", spec, strings.Join(Schemes(), ", "))
+	}
+	o, ok := openers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown GraphStore scheme %q in spec %q (registered schemes: %s)", u.Scheme, spec, strings.Join(Schemes(), ", "))
+	}
+	return o(ctx, u)
+}
+
+// SpecLocation returns the part of the spec URL u following its scheme, less
+// the "//" preceding an empty authority.  "leveldb:///data/gs",
+// "leveldb:/data/gs", "grpc://host:port", and "proxy:spec1,spec2" have the
+// locations "/data/gs", "/data/gs", "host:port", and "spec1,spec2".
+func SpecLocation(u *url.URL) string {
+	loc := u.Opaque
+	if loc == "" {
+		if u.User != nil {
+			loc = u.User.String() + "@"
+		}
+		loc += u.Host + u.Path
+	}
+	if u.RawQuery != "" {
+		loc += "?" + u.RawQuery
+	}
+	return loc
+}
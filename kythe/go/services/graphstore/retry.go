@@ -0,0 +1,274 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"io"
+	"math/rand"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Defaults for a zero-valued RetryPolicy.
+const (
+	DefaultRetryAttempts  = 5
+	DefaultInitialBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff     = 10 * time.Second
+	DefaultBackoffFactor  = 2
+)
+
+// retryPageSize is the page size of a retried Scan of a PagedScanner.
+const retryPageSize = 4096
+
+// RetryPolicy controls how a retrying Service retries failed calls.  Zero
+// fields are replaced by their defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts made for each call,
+	// including the first.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry.  Each following
+	// delay is Factor times longer than the last, up to MaxBackoff.
+	InitialBackoff, MaxBackoff time.Duration
+	Factor                     float64
+
+	// Jitter is the fraction (between 0 and 1) of each delay that is
+	// randomized; each delay d is uniformly chosen from [d*(1-Jitter), d].
+	Jitter float64
+
+	// Retryable reports whether a call failing with the given error should be
+	// retried.  If nil, all errors are retried except for the cancellation or
+	// expiration of the call's context.
+	Retryable func(error) bool
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultInitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultMaxBackoff
+	}
+	if p.Factor < 1 {
+		p.Factor = DefaultBackoffFactor
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	} else if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	if p.Retryable == nil {
+		p.Retryable = func(err error) bool {
+			return err != context.Canceled && err != context.DeadlineExceeded
+		}
+	}
+	return p
+}
+
+// NewRetryingService returns a Service that retries the failed calls of s
+// according to the given policy.  Writes (and Counts, if s is Sharded) are
+// simply retried.  A failed Read, Scan, or Shard is restarted without
+// delivering any entry to its EntryFunc twice: a Scan of a PagedScanner is
+// read page by page and resumed at the first page not delivered, a Scan of an
+// OrderedScanner is restarted skipping entries up to the last delivered entry,
+// and any other Read, Scan, or Shard is restarted skipping as many entries as
+// were previously delivered (relying on s delivering the same entries in the
+// same order).
+// Errors returned by an EntryFunc are never retried.  Other optional
+// interfaces of s are hidden.
+func NewRetryingService(s Service, policy RetryPolicy) Service {
+	r := &retryingService{s, policy.withDefaults()}
+	if sh, ok := s.(Sharded); ok {
+		return &retryingSharded{r, sh}
+	}
+	return r
+}
+
+type retryingService struct {
+	s Service
+	p RetryPolicy
+}
+
+// permanentError wraps an error that must not be retried.
+type permanentError struct{ err error }
+
+func (p permanentError) Error() string { return p.err.Error() }
+
+// retry calls f until it succeeds, fails with an error that is not retryable,
+// or the policy's attempts are exhausted.
+func (r *retryingService) retry(ctx context.Context, f func() error) error {
+	backoff := r.p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		} else if p, ok := err.(permanentError); ok {
+			return p.err
+		} else if attempt >= r.p.MaxAttempts || !r.p.Retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := backoff - time.Duration(rand.Float64()*r.p.Jitter*float64(backoff))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff = time.Duration(float64(backoff) * r.p.Factor); backoff > r.p.MaxBackoff {
+			backoff = r.p.MaxBackoff
+		}
+	}
+}
+
+// A resumeMode determines how a retried stream skips the entries delivered by
+// previous attempts.
+type resumeMode int
+
+const (
+	// resumeByCount skips as many entries as were already delivered.
+	resumeByCount resumeMode = iota
+
+	// resumeByOrder skips the entries up to the last delivered in
+	// compare.Entries order, in which the call must deliver its entries.
+	resumeByOrder
+
+	// resumeAfter skips nothing, as the call itself resumes after the entries
+	// already delivered.
+	resumeAfter
+)
+
+// stream retries call, which must deliver its entries to the given EntryFunc,
+// while ensuring f is called at most once for each entry.  The entries
+// delivered to f by previous attempts are skipped as determined by mode.
+func (r *retryingService) stream(ctx context.Context, mode resumeMode, f EntryFunc, call func(g EntryFunc) error) error {
+	var (
+		last      *spb.Entry
+		delivered int
+	)
+	return r.retry(ctx, func() error {
+		var stopped bool
+		skip := delivered
+		err := call(func(e *spb.Entry) error {
+			switch mode {
+			case resumeByOrder:
+				if last != nil && compare.Entries(e, last) != compare.GT {
+					return nil
+				}
+			case resumeByCount:
+				if skip > 0 {
+					skip--
+					return nil
+				}
+			}
+			if err := f(e); err != nil {
+				stopped = true
+				return err
+			}
+			last = e
+			delivered++
+			return nil
+		})
+		if stopped && err != nil {
+			return permanentError{err}
+		}
+		return err
+	})
+}
+
+// Read implements part of the Service interface.
+func (r *retryingService) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	return r.stream(ctx, resumeByCount, f, func(g EntryFunc) error {
+		return r.s.Read(ctx, req, g)
+	})
+}
+
+// Scan implements part of the Service interface.  A PagedScanner is scanned
+// page by page, and a failed Scan is resumed from the page token of the first
+// page not yet delivered, so that the Scan continues in the Service's own
+// order.  The entries of another Service are skipped in compare.Entries order
+// if it ScansOrdered, or otherwise by their number.
+func (r *retryingService) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	ps, ok := r.s.(PagedScanner)
+	if !ok {
+		mode := resumeByCount
+		if ScansOrdered(r.s) {
+			mode = resumeByOrder
+		}
+		return r.stream(ctx, mode, f, func(g EntryFunc) error {
+			return r.s.Scan(ctx, req, g)
+		})
+	}
+
+	var token string
+	return r.stream(ctx, resumeAfter, f, func(g EntryFunc) error {
+		for {
+			page, next, err := ps.ScanPage(ctx, req, retryPageSize, token)
+			if err != nil {
+				return err
+			}
+			for _, e := range page {
+				if err := g(e); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+			if next == "" {
+				return nil
+			}
+			token = next
+		}
+	})
+}
+
+// Write implements part of the Service interface.
+func (r *retryingService) Write(ctx context.Context, req *spb.WriteRequest) error {
+	return r.retry(ctx, func() error { return r.s.Write(ctx, req) })
+}
+
+// Close implements part of the Service interface.
+func (r *retryingService) Close(ctx context.Context) error { return r.s.Close(ctx) }
+
+type retryingSharded struct {
+	*retryingService
+	sh Sharded
+}
+
+// Count implements part of the Sharded interface.
+func (r *retryingSharded) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	var n int64
+	err := r.retry(ctx, func() (err error) {
+		n, err = r.sh.Count(ctx, req)
+		return
+	})
+	return n, err
+}
+
+// Shard implements part of the Sharded interface.
+func (r *retryingSharded) Shard(ctx context.Context, req *spb.ShardRequest, f EntryFunc) error {
+	return r.stream(ctx, resumeByCount, f, func(g EntryFunc) error {
+		return r.sh.Shard(ctx, req, g)
+	})
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// TargetIndexed is an optional interface for a Service that indexes edges by
+// their targets and so can find the incoming edges of a node without a full
+// Scan.
+type TargetIndexed interface {
+	Service
+
+	// ReverseEdges calls f with each edge entry whose target is the given VName
+	// and, if kinds is non-empty, whose edge kind is one of kinds.
+	ReverseEdges(ctx context.Context, target *spb.VName, kinds []string, f EntryFunc) error
+}
+
+// ReverseEdges calls f with each edge of s whose target is the given VName and,
+// if kinds is non-empty, whose edge kind is one of kinds.  If s implements
+// TargetIndexed, its index is used; otherwise, s is Scanned.
+func ReverseEdges(ctx context.Context, s Service, target *spb.VName, kinds []string, f EntryFunc) error {
+	if ti, ok := s.(TargetIndexed); ok {
+		return ti.ReverseEdges(ctx, target, kinds, f)
+	}
+	return ScanKinds(ctx, s, kinds, &spb.ScanRequest{Target: target}, func(e *spb.Entry) error {
+		if e.EdgeKind == "" {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+// ReverseEdgesWithFacts calls edgeFunc with each edge found by ReverseEdges and
+// then calls factFunc with the node facts of each distinct source of those
+// edges.  The facts are read in a single batch using ReadMultiple with the
+// given number of workers; the facts of each source are delivered contiguously.
+// If either function returns io.EOF, the traversal stops without error.
+func ReverseEdgesWithFacts(ctx context.Context, s Service, target *spb.VName, kinds []string, workers int, edgeFunc, factFunc EntryFunc) error {
+	var (
+		reqs    []*spb.ReadRequest
+		seen    = make(map[string]bool)
+		stopped bool
+	)
+	if err := ReverseEdges(ctx, s, target, kinds, func(e *spb.Entry) error {
+		if err := edgeFunc(e); err == io.EOF {
+			stopped = true
+			return io.EOF
+		} else if err != nil {
+			return err
+		}
+		if key := vnameKey(e.Source); !seen[key] {
+			seen[key] = true
+			reqs = append(reqs, &spb.ReadRequest{Source: e.Source})
+		}
+		return nil
+	}); err != nil {
+		return err
+	} else if stopped || len(reqs) == 0 {
+		return nil
+	}
+	return ReadMultiple(ctx, s, reqs, workers, factFunc)
+}
+
+// vnameKey returns a string uniquely identifying v.
+func vnameKey(v *spb.VName) string {
+	rec, err := proto.Marshal(v)
+	if err != nil {
+		// Marshaling a VName cannot fail.
+		panic(err)
+	}
+	return string(rec)
+}
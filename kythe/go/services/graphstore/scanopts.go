@@ -0,0 +1,135 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// ScanOptions extend the matching of a ScanRequest.  The zero ScanOptions match
+// exactly as EntryMatchesScan does.
+type ScanOptions struct {
+	// PartialTarget causes each empty field of the request's Target to match
+	// any value.  For example, a Target with only a Corpus matches every edge
+	// into that corpus.
+	PartialTarget bool
+
+	// PrefixTarget causes the request Target's Signature and Path fields to
+	// match any entry target field having them as a prefix.  The remaining
+	// fields are matched as determined by PartialTarget.
+	PrefixTarget bool
+
+	// EdgeKinds, if non-empty, restricts matches to entries having one of the
+	// given edge kinds (in addition to any restriction by the request's
+	// EdgeKind).
+	EdgeKinds []string
+}
+
+// OptionsScanner is an optional interface for a Service that can natively
+// match ScanRequests according to a set of ScanOptions.
+type OptionsScanner interface {
+	Service
+
+	// ScanOpts is equivalent to Scan, but matches entry targets according to
+	// opts.  A nil opts is equivalent to the zero ScanOptions.
+	ScanOpts(ctx context.Context, req *spb.ScanRequest, opts *ScanOptions, f EntryFunc) error
+}
+
+// ScanWithOptions calls f with each entry of s matching req according to opts.
+// If s does not implement OptionsScanner, the matching is done by a single Scan
+// of s (without the request's Target, if it is not matched exactly) whose
+// results are filtered.
+func ScanWithOptions(ctx context.Context, s Service, req *spb.ScanRequest, opts *ScanOptions, f EntryFunc) error {
+	if o, ok := s.(OptionsScanner); ok {
+		return o.ScanOpts(ctx, req, opts, f)
+	} else if opts == nil {
+		return s.Scan(ctx, req, f)
+	}
+	scan := &spb.ScanRequest{
+		Target:     req.Target,
+		EdgeKind:   req.EdgeKind,
+		FactPrefix: req.FactPrefix,
+	}
+	if opts.PartialTarget || opts.PrefixTarget {
+		scan.Target = nil
+	}
+	return s.Scan(ctx, scan, func(e *spb.Entry) error {
+		if !EntryMatchesScanOpts(req, opts, e) {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+// EntryMatchesScanOpts reports whether entry belongs in the result set for req
+// when matched according to opts.
+func EntryMatchesScanOpts(req *spb.ScanRequest, opts *ScanOptions, entry *spb.Entry) bool {
+	if opts == nil {
+		return EntryMatchesScan(req, entry)
+	}
+	return (req.Target == nil || TargetMatches(req.Target, entry.Target, opts)) &&
+		(req.EdgeKind == "" || entry.EdgeKind == req.EdgeKind) &&
+		(len(opts.EdgeKinds) == 0 || containsString(opts.EdgeKinds, entry.EdgeKind)) &&
+		strings.HasPrefix(entry.FactName, req.FactPrefix)
+}
+
+// ScanKinds calls f with each entry of s matching req that has one of the given
+// edge kinds, using a single pass over s.  If kinds is empty, entries of any
+// kind match, as for Scan.
+func ScanKinds(ctx context.Context, s Service, kinds []string, req *spb.ScanRequest, f EntryFunc) error {
+	return ScanWithOptions(ctx, s, req, &ScanOptions{EdgeKinds: kinds}, f)
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetMatches reports whether the VName v is matched by pattern according to
+// opts.  A nil v is treated as an empty VName.
+func TargetMatches(pattern, v *spb.VName, opts *ScanOptions) bool {
+	var partial, prefix bool
+	if opts != nil {
+		partial, prefix = opts.PartialTarget, opts.PrefixTarget
+	}
+	if v == nil {
+		v = new(spb.VName)
+	}
+	field := func(want, got string, prefixed bool) bool {
+		switch {
+		case prefix && prefixed:
+			return strings.HasPrefix(got, want)
+		case partial && want == "":
+			return true
+		default:
+			return got == want
+		}
+	}
+	return field(pattern.Signature, v.Signature, true) &&
+		field(pattern.Corpus, v.Corpus, false) &&
+		field(pattern.Root, v.Root, false) &&
+		field(pattern.Path, v.Path, true) &&
+		field(pattern.Language, v.Language, false)
+}
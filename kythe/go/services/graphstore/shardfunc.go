@@ -0,0 +1,146 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// A ShardFunc assigns a source VName to one of the given number of shards,
+// returning its index in [0, shards).  Every entry of a source belongs to that
+// source's shard.
+type ShardFunc func(src *spb.VName, shards int) int
+
+// Names of the ShardFuncs registered by default.
+const (
+	HashShardFunc   = "hash"
+	CorpusShardFunc = "corpus"
+)
+
+var shardFuncs = map[string]ShardFunc{
+	HashShardFunc:   HashShards,
+	CorpusShardFunc: CorpusShards,
+}
+
+// RegisterShardFunc makes f available under the given name to LookupShardFunc.
+// Names are recorded by persistent stores to recover their ShardFunc, so a name
+// should never be reused for a different function.
+func RegisterShardFunc(name string, f ShardFunc) {
+	if _, exists := shardFuncs[name]; exists {
+		log.Fatalf("ShardFunc %q already registered", name)
+	}
+	shardFuncs[name] = f
+}
+
+// LookupShardFunc returns the ShardFunc registered with the given name.
+func LookupShardFunc(name string) (ShardFunc, error) {
+	f, ok := shardFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown ShardFunc: %q", name)
+	}
+	return f, nil
+}
+
+// HashShards is a ShardFunc distributing sources by their fingerprint (see
+// compare.VNameFingerprint) modulo the number of shards.
+func HashShards(src *spb.VName, shards int) int {
+	return int(compare.VNameFingerprint(src) % uint64(shards))
+}
+
+// CorpusShards is a ShardFunc assigning every source in a corpus to the same
+// shard, chosen by a hash of the corpus modulo the number of shards.
+func CorpusShards(src *spb.VName, shards int) int {
+	h := fnv.New64a()
+	io.WriteString(h, src.Corpus)
+	return int(h.Sum64() % uint64(shards))
+}
+
+// FuncSharded is an optional interface for a Sharded Service whose shards are
+// assigned by a registered ShardFunc.  Two such Services using the same
+// ShardFunc (and the same number of shards) place each source in the same
+// shard, so their shards can be processed together.
+type FuncSharded interface {
+	Sharded
+
+	// ShardFunc returns the registered name of the ShardFunc assigning entries
+	// to shards.
+	ShardFunc() string
+}
+
+// NewFuncSharded returns a FuncSharded view of s whose shards are assigned by
+// the named ShardFunc.  Each Count and Shard call performs a full Scan of s.
+func NewFuncSharded(s Service, shardFunc string) (FuncSharded, error) {
+	f, err := LookupShardFunc(shardFunc)
+	if err != nil {
+		return nil, err
+	}
+	return &funcSharded{Service: s, name: shardFunc, f: f}, nil
+}
+
+type funcSharded struct {
+	Service
+	name string
+	f    ShardFunc
+}
+
+// ShardFunc implements part of the FuncSharded interface.
+func (s *funcSharded) ShardFunc() string { return s.name }
+
+// Count implements part of the Sharded interface.
+func (s *funcSharded) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	if err := validShard(req.Index, req.Shards); err != nil {
+		return 0, err
+	}
+	var count int64
+	err := s.Shard(ctx, &spb.ShardRequest{Index: req.Index, Shards: req.Shards}, func(*spb.Entry) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// Shard implements part of the Sharded interface.
+func (s *funcSharded) Shard(ctx context.Context, req *spb.ShardRequest, f EntryFunc) error {
+	if err := validShard(req.Index, req.Shards); err != nil {
+		return err
+	}
+	index, shards := int(req.Index), int(req.Shards)
+	return s.Scan(ctx, &spb.ScanRequest{}, func(e *spb.Entry) error {
+		if s.f(e.Source, shards) != index {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+func validShard(index, shards int64) error {
+	if shards < 1 {
+		return fmt.Errorf("invalid number of shards: %d", shards)
+	} else if index < 0 || index >= shards {
+		return fmt.Errorf("invalid index for %d shards: %d", shards, index)
+	}
+	return nil
+}
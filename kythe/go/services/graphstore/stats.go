@@ -0,0 +1,178 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"errors"
+
+	"kythe.io/kythe/go/util/hll"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// ErrDiskSizeUnknown is returned by a DiskSizer that cannot estimate its size.
+var ErrDiskSizeUnknown = errors.New("disk size unknown")
+
+// DiskSizer is an optional interface for a Service that can estimate the
+// amount of storage used by its entries.
+type DiskSizer interface {
+	Service
+
+	// DiskSize returns the approximate number of bytes used to store the
+	// Service's entries or ErrDiskSizeUnknown.
+	DiskSize(ctx context.Context) (int64, error)
+}
+
+// StoreStats are summary statistics for the entries of a Service.
+type StoreStats struct {
+	// Entries is the total number of entries.
+	Entries int64
+
+	// Sources is the approximate number of distinct entry sources.
+	Sources int64
+
+	// FactBytes is the total size of all fact values.
+	FactBytes int64
+
+	// Corpora is the number of entries for each source corpus.
+	Corpora map[string]int64
+
+	// DiskBytes is the approximate storage used by the entries, or 0 if unknown.
+	DiskBytes int64
+}
+
+// StatsOptions control the computation of StoreStats.
+type StatsOptions struct {
+	// EntriesOnly restricts the stats to the number of Entries (and DiskBytes).
+	// For a Sharded Service, this only requires a single Count.
+	EntriesOnly bool
+
+	// Workers is the number of shards of a Sharded Service to scan concurrently.
+	Workers int
+}
+
+// Stats returns summary statistics for the entries of s.  Unless
+// opts.EntriesOnly is set, every entry of s is read: a Sharded Service is read
+// with ParallelShardsFunc, and any other Service with a Scan.
+func Stats(ctx context.Context, s Service, opts *StatsOptions) (*StoreStats, error) {
+	if opts == nil {
+		opts = &StatsOptions{}
+	}
+
+	stats := &StoreStats{}
+	if ds, ok := s.(DiskSizer); ok {
+		size, err := ds.DiskSize(ctx)
+		if err != nil && err != ErrDiskSizeUnknown {
+			return nil, err
+		}
+		stats.DiskBytes = size
+	}
+
+	sharded, isSharded := s.(Sharded)
+	if opts.EntriesOnly && isSharded {
+		count, err := sharded.Count(ctx, &spb.CountRequest{Index: 0, Shards: 1})
+		if err != nil {
+			return nil, err
+		}
+		stats.Entries = count
+		return stats, nil
+	}
+
+	workers := opts.Workers
+	if !isSharded || workers < 1 {
+		workers = 1
+	}
+	accs := make([]*statsAccumulator, workers)
+	for i := range accs {
+		accs[i] = newStatsAccumulator(opts.EntriesOnly)
+	}
+	var err error
+	if isSharded && workers > 1 {
+		err = ParallelShardsFunc(ctx, sharded, workers, func(shard int64, e *spb.Entry) error {
+			accs[shard].add(e)
+			return nil
+		})
+	} else {
+		err = s.Scan(ctx, &spb.ScanRequest{}, func(e *spb.Entry) error {
+			accs[0].add(e)
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	total := accs[0]
+	for _, acc := range accs[1:] {
+		if err := total.merge(acc); err != nil {
+			return nil, err
+		}
+	}
+	total.finish(stats)
+	return stats, nil
+}
+
+// statsAccumulator computes StoreStats over a sequence of single-threaded
+// calls to add.
+type statsAccumulator struct {
+	StoreStats
+	sources *hll.Sketch
+}
+
+func newStatsAccumulator(entriesOnly bool) *statsAccumulator {
+	acc := &statsAccumulator{}
+	if !entriesOnly {
+		acc.sources, _ = hll.New(hll.DefaultPrecision)
+		acc.Corpora = make(map[string]int64)
+	}
+	return acc
+}
+
+func (a *statsAccumulator) add(e *spb.Entry) {
+	a.Entries++
+	if a.sources == nil {
+		return
+	}
+	a.FactBytes += int64(len(e.FactValue))
+	if e.Source == nil {
+		return
+	}
+	a.Corpora[e.Source.Corpus]++
+	a.sources.AddString(vnameKey(e.Source))
+}
+
+func (a *statsAccumulator) merge(o *statsAccumulator) error {
+	a.Entries += o.Entries
+	if a.sources == nil {
+		return nil
+	}
+	a.FactBytes += o.FactBytes
+	for corpus, n := range o.Corpora {
+		a.Corpora[corpus] += n
+	}
+	return a.sources.Merge(o.sources)
+}
+
+// finish copies the accumulated statistics into stats.
+func (a *statsAccumulator) finish(stats *StoreStats) {
+	stats.Entries, stats.FactBytes, stats.Corpora = a.Entries, a.FactBytes, a.Corpora
+	if a.sources != nil {
+		stats.Sources = int64(a.sources.Count())
+	}
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Throttle specifies the maximum rates of a ThrottledService.  A zero rate is
+// unlimited.  Each rate may be exceeded momentarily by a burst of up to one
+// second's worth of its budget.
+type Throttle struct {
+	// WritesPerSec limits the number of WriteRequests.
+	WritesPerSec float64
+
+	// UpdatesPerSec limits the number of updates across all WriteRequests.
+	UpdatesPerSec float64
+
+	// BytesPerSec limits the serialized size of WriteRequests.
+	BytesPerSec float64
+
+	// EntriesPerSec limits the number of entries delivered by Reads and Scans.
+	EntriesPerSec float64
+}
+
+// ThrottledService is a Service whose Writes, Reads, and Scans are limited to
+// the rates of a Throttle.  Calls exceeding the budget block until it becomes
+// available or their context is done.  The budget taken by a Write is refunded
+// if it fails, whether while waiting or in the wrapped Service, so that
+// rejected requests do not delay the requests that follow.  Other optional
+// interfaces of the wrapped Service are hidden.
+type ThrottledService struct {
+	Service
+
+	writes, updates, bytes, entries *tokenBucket
+}
+
+// NewThrottledService returns a ThrottledService limiting calls to s to the
+// given rates.
+func NewThrottledService(s Service, limits Throttle) *ThrottledService {
+	return &ThrottledService{
+		Service: s,
+		writes:  newTokenBucket(limits.WritesPerSec),
+		updates: newTokenBucket(limits.UpdatesPerSec),
+		bytes:   newTokenBucket(limits.BytesPerSec),
+		entries: newTokenBucket(limits.EntriesPerSec),
+	}
+}
+
+// WaitWrite blocks until the write budget of t allows req to be written, or
+// until ctx is done, in which case none of its budget is taken.  It is useful
+// for throttling writes made to the underlying Service through other
+// interfaces; see also RefundWrite.
+func (t *ThrottledService) WaitWrite(ctx context.Context, req *spb.WriteRequest) error {
+	if err := t.writes.wait(ctx, 1); err != nil {
+		return err
+	} else if err := t.updates.wait(ctx, float64(len(req.Update))); err != nil {
+		t.writes.refund(1)
+		return err
+	} else if t.bytes != nil {
+		if err := t.bytes.wait(ctx, float64(proto.Size(req))); err != nil {
+			t.writes.refund(1)
+			t.updates.refund(float64(len(req.Update)))
+			return err
+		}
+	}
+	return nil
+}
+
+// RefundWrite returns the budget taken by a WaitWrite for req to t, as when req
+// could not be written.
+func (t *ThrottledService) RefundWrite(req *spb.WriteRequest) {
+	t.writes.refund(1)
+	t.updates.refund(float64(len(req.Update)))
+	if t.bytes != nil {
+		t.bytes.refund(float64(proto.Size(req)))
+	}
+}
+
+// Write implements part of the Service interface.
+func (t *ThrottledService) Write(ctx context.Context, req *spb.WriteRequest) error {
+	if err := t.WaitWrite(ctx, req); err != nil {
+		return err
+	} else if err := t.Service.Write(ctx, req); err != nil {
+		t.RefundWrite(req)
+		return err
+	}
+	return nil
+}
+
+// Read implements part of the Service interface.
+func (t *ThrottledService) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	return t.Service.Read(ctx, req, t.throttleEntries(ctx, f))
+}
+
+// Scan implements part of the Service interface.
+func (t *ThrottledService) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	return t.Service.Scan(ctx, req, t.throttleEntries(ctx, f))
+}
+
+func (t *ThrottledService) throttleEntries(ctx context.Context, f EntryFunc) EntryFunc {
+	if t.entries == nil {
+		return f
+	}
+	return func(e *spb.Entry) error {
+		if err := t.entries.wait(ctx, 1); err != nil {
+			return err
+		}
+		return f(e)
+	}
+}
+
+// tokenBucket is a token bucket refilled at a constant rate and holding up to
+// one second's worth of tokens.  Takers may overdraw the bucket, waiting until
+// their debt is repaid, so that requests larger than the bucket can proceed.
+// A nil *tokenBucket is unlimited.
+type tokenBucket struct {
+	rate float64 // tokens/sec
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// wait takes n tokens from b, blocking until they are available or ctx is done.
+// The tokens are returned to b if ctx is done first.
+func (b *tokenBucket) wait(ctx context.Context, n float64) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	debt := -b.tokens
+	b.mu.Unlock()
+
+	if debt <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(debt / b.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.refund(n)
+		return ctx.Err()
+	}
+}
+
+// refund returns n tokens taken from b, up to its capacity.
+func (b *tokenBucket) refund(n float64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens += n; b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// A TierPolicy determines how a TieredService applies Writes.
+type TierPolicy int
+
+// TierPolicy values.
+const (
+	// TierWriteThrough writes to the cold store and then, if the source has
+	// been promoted, to the hot store.
+	TierWriteThrough TierPolicy = iota
+
+	// TierInvalidate writes only to the cold store, and invalidates the
+	// source's promotion to the hot store.
+	TierInvalidate
+)
+
+// TieredService is a Service that serves Reads of frequently read sources from
+// a hot store, such as a size-limited in-memory store, and keeps every entry in
+// a cold store.  The first Read of a source copies (promotes) all its entries
+// from the cold store to the hot store; later Reads of the source are served by
+// the hot store.  Scans always use the cold store.  Other optional interfaces
+// of the stores are hidden.
+//
+// If the hot store removes a promoted source, such as to stay within a byte
+// limit, Evicted must be called with the source so that it is read from the
+// cold store again.  If the hot store fails to write a promoted source, the
+// source is not promoted.
+type TieredService struct {
+	hot, cold Service
+	policy    TierPolicy
+
+	mu         sync.Mutex
+	promoted   map[string]bool       // keyed by sourceKey
+	promotions map[string]*promotion // in progress; keyed by sourceKey
+	stats      TierStats
+}
+
+// TierStats are counters describing the use of a TieredService.
+type TierStats struct {
+	// Hits and Misses are the number of Reads served by the hot store and by
+	// the cold store.
+	Hits, Misses int64
+
+	// Promotions and PromotionFailures are the number of sources promoted to
+	// the hot store, and those whose entries the hot store failed to write.
+	Promotions, PromotionFailures int64
+
+	// Promoted is the number of sources currently promoted.
+	Promoted int
+}
+
+// HitRate returns the fraction of Reads served by the hot store, or 0 if there
+// have been none.
+func (s TierStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// A promotion copies the entries of a source from the cold store to the hot
+// store.  Its Reads of the source wait for it, then share its entries.
+type promotion struct {
+	done    chan struct{} // closed once entries and err are set
+	entries []*spb.Entry
+	err     error
+
+	// stale is set, guarded by the TieredService's mu, once a Write of the
+	// source starts or finishes during the promotion, whose entries may then
+	// be out of date.
+	stale bool
+}
+
+// NewTiered returns a TieredService over the given hot and cold stores whose
+// Writes are applied according to policy.  The hot store should initially be
+// empty.
+func NewTiered(hot, cold Service, policy TierPolicy) *TieredService {
+	return &TieredService{
+		hot:        hot,
+		cold:       cold,
+		policy:     policy,
+		promoted:   make(map[string]bool),
+		promotions: make(map[string]*promotion),
+	}
+}
+
+// Stats returns the current TierStats for t.
+func (t *TieredService) Stats() TierStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := t.stats
+	stats.Promoted = len(t.promoted)
+	return stats
+}
+
+// Evicted records that the hot store no longer has the given source.  It may be
+// used as the eviction callback of the hot store.
+func (t *TieredService) Evicted(src *spb.VName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.promoted, sourceKey(src))
+}
+
+// Read implements part of the Service interface.  If the source has not been
+// promoted, its entries are read from the cold store and promoted, once for
+// any number of concurrent Reads.  The promotion is not bound to the context
+// of any of its Reads, so that the cancellation of one, even the first, does
+// not fail the others.
+func (t *TieredService) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	src := sourceKey(req.Source)
+	t.mu.Lock()
+	if t.promoted[src] {
+		t.stats.Hits++
+		t.mu.Unlock()
+		return t.hot.Read(ctx, req, f)
+	}
+	t.stats.Misses++
+	p, ok := t.promotions[src]
+	if !ok {
+		p = &promotion{done: make(chan struct{})}
+		t.promotions[src] = p
+		go t.promote(req.Source, src, p)
+	}
+	t.mu.Unlock()
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if p.err != nil {
+		return p.err
+	}
+
+	for _, e := range p.entries {
+		if req.EdgeKind != "*" && e.EdgeKind != req.EdgeKind {
+			continue
+		}
+		if err := f(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promote reads the entries of the given source from the cold store and writes
+// them to the hot store.  The source is promoted unless p is made stale by a
+// Write of the source.
+func (t *TieredService) promote(vname *spb.VName, src string, p *promotion) {
+	defer close(p.done)
+	ctx := context.Background()
+	req := &spb.WriteRequest{Source: vname}
+	p.err = t.cold.Read(ctx, &spb.ReadRequest{Source: vname, EdgeKind: "*"}, func(e *spb.Entry) error {
+		p.entries = append(p.entries, e)
+		req.Update = append(req.Update, &spb.WriteRequest_Update{
+			EdgeKind:  e.EdgeKind,
+			Target:    e.Target,
+			FactName:  e.FactName,
+			FactValue: e.FactValue,
+		})
+		return nil
+	})
+	var err error
+	if p.err == nil && len(req.Update) != 0 {
+		err = t.hot.Write(ctx, req)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.promotions, src)
+	switch {
+	case p.err != nil, len(req.Update) == 0:
+		// Nothing to promote; a source with no entries would never be evicted.
+	case err != nil:
+		t.stats.PromotionFailures++
+	case !p.stale:
+		t.stats.Promotions++
+		t.promoted[src] = true
+	}
+}
+
+// Scan implements part of the Service interface by scanning the cold store.
+func (t *TieredService) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	return t.cold.Scan(ctx, req, f)
+}
+
+// Write implements part of the Service interface by writing req to the cold
+// store and then, according to t's TierPolicy, either writing it to the hot
+// store (if its source is promoted) or invalidating the source's promotion.
+func (t *TieredService) Write(ctx context.Context, req *spb.WriteRequest) error {
+	src := sourceKey(req.Source)
+	t.noteWrite(src)
+	err := t.cold.Write(ctx, req)
+	if promoted := t.noteWrite(src); err != nil || !promoted {
+		return err
+	}
+	// The cold store has the entries, so a failure only demotes the source.
+	if err := t.hot.Write(ctx, req); err != nil {
+		t.Evicted(req.Source)
+	}
+	return nil
+}
+
+// noteWrite records the start or finish of a Write of the given source,
+// making any promotion of it in progress stale and invalidating its promotion
+// if t's TierPolicy requires it.  It reports whether the source is promoted.
+func (t *TieredService) noteWrite(src string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.promotions[src]; ok {
+		p.stale = true
+	}
+	if t.policy == TierInvalidate {
+		delete(t.promoted, src)
+	}
+	return t.promoted[src]
+}
+
+// ScansOrdered implements the OrderedScanner interface.
+func (t *TieredService) ScansOrdered() bool { return ScansOrdered(t.cold) }
+
+// Close implements part of the Service interface by closing both stores.
+func (t *TieredService) Close(ctx context.Context) error {
+	err := t.hot.Close(ctx)
+	if cerr := t.cold.Close(ctx); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// A Tracer is notified of the start and end of each call made through a
+// traced Service.  Implementations must be safe for concurrent use.
+type Tracer interface {
+	// StartSpan is called at the start of a call to the named Service method
+	// with the given request (nil for Close).  It returns the context in which
+	// the call is made (which should identify the new span, e.g. with
+	// WithTraceParent, so that nested calls become its children) and a
+	// function that is called when the call is complete with its error and the
+	// number of entries it delivered.
+	StartSpan(ctx context.Context, method string, req proto.Message) (context.Context, func(err error, entries int))
+}
+
+type traceParentKey struct{}
+
+// WithTraceParent returns a copy of ctx identifying parent as the current
+// span.  The identifier is opaque to the graphstore packages but is propagated
+// to remote GraphStores (see the graphstore/grpc package).
+func WithTraceParent(ctx context.Context, parent string) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, parent)
+}
+
+// TraceParent returns the identifier of the current span in ctx, or "" if
+// there is none.
+func TraceParent(ctx context.Context) string {
+	parent, _ := ctx.Value(traceParentKey{}).(string)
+	return parent
+}
+
+// NewTracedService returns a Service that reports each call made to s to the
+// given Tracer.  If s is Sharded, so is the returned Service.  If t is nil, s
+// is returned unchanged.
+func NewTracedService(s Service, t Tracer) Service {
+	if t == nil {
+		return s
+	}
+	ts := &tracedService{s, t}
+	if sh, ok := s.(Sharded); ok {
+		return &tracedSharded{ts, sh}
+	}
+	return ts
+}
+
+type tracedService struct {
+	s Service
+	t Tracer
+}
+
+// stream calls f with a span for the named method, counting the entries
+// delivered to f.
+func (t *tracedService) stream(ctx context.Context, method string, req proto.Message, f EntryFunc, call func(context.Context, EntryFunc) error) error {
+	ctx, end := t.t.StartSpan(ctx, method, req)
+	var num int
+	err := call(ctx, func(e *spb.Entry) error {
+		num++
+		return f(e)
+	})
+	end(err, num)
+	return err
+}
+
+// Read implements part of the Service interface.
+func (t *tracedService) Read(ctx context.Context, req *spb.ReadRequest, f EntryFunc) error {
+	return t.stream(ctx, "Read", req, f, func(ctx context.Context, g EntryFunc) error {
+		return t.s.Read(ctx, req, g)
+	})
+}
+
+// Scan implements part of the Service interface.
+func (t *tracedService) Scan(ctx context.Context, req *spb.ScanRequest, f EntryFunc) error {
+	return t.stream(ctx, "Scan", req, f, func(ctx context.Context, g EntryFunc) error {
+		return t.s.Scan(ctx, req, g)
+	})
+}
+
+// Write implements part of the Service interface.
+func (t *tracedService) Write(ctx context.Context, req *spb.WriteRequest) error {
+	ctx, end := t.t.StartSpan(ctx, "Write", req)
+	err := t.s.Write(ctx, req)
+	end(err, 0)
+	return err
+}
+
+// Close implements part of the Service interface.
+func (t *tracedService) Close(ctx context.Context) error {
+	ctx, end := t.t.StartSpan(ctx, "Close", nil)
+	err := t.s.Close(ctx)
+	end(err, 0)
+	return err
+}
+
+type tracedSharded struct {
+	*tracedService
+	sh Sharded
+}
+
+// Count implements part of the Sharded interface.
+func (t *tracedSharded) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	ctx, end := t.t.StartSpan(ctx, "Count", req)
+	n, err := t.sh.Count(ctx, req)
+	end(err, 0)
+	return n, err
+}
+
+// Shard implements part of the Sharded interface.
+func (t *tracedSharded) Shard(ctx context.Context, req *spb.ShardRequest, f EntryFunc) error {
+	return t.stream(ctx, "Shard", req, f, func(ctx context.Context, g EntryFunc) error {
+		return t.sh.Shard(ctx, req, g)
+	})
+}
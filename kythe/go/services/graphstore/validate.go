@@ -0,0 +1,181 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// A ValidationRule is a structural requirement on entries checked by
+// ValidateEntry.
+type ValidationRule string
+
+// The ValidationRules required of every entry by the Kythe schema.
+const (
+	// RuleEmptySource requires each entry to have a non-empty source VName.
+	RuleEmptySource ValidationRule = "empty source"
+
+	// RuleFactName requires each fact name to begin with "/".
+	RuleFactName ValidationRule = "fact name without leading /"
+
+	// RuleEdgeTarget requires each edge entry to have a non-empty target.
+	RuleEdgeTarget ValidationRule = "edge without target"
+
+	// RuleNodeTarget requires each node entry (one without an edge kind) to
+	// have no target.
+	RuleNodeTarget ValidationRule = "node fact with target"
+
+	// RuleEdgeFactValue requires each edge fact value to be empty, except for
+	// the decimal value of an OrdinalFact.
+	RuleEdgeFactValue ValidationRule = "edge with fact value"
+)
+
+// OrdinalFact is the only edge fact that may carry a value, the decimal
+// ordinal of its edge.
+const OrdinalFact = "/kythe/ordinal"
+
+// A ValidationError reports an entry breaking a ValidationRule.
+type ValidationError struct {
+	Rule  ValidationRule
+	Entry *spb.Entry
+}
+
+// Error implements the error interface.
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid entry (%s): %v", e.Rule, e.Entry)
+}
+
+// ValidateEntry returns a *ValidationError if e breaks any ValidationRule.  It
+// is stricter than ValidEntry, which only checks that the fields required of
+// node and edge entries are present.
+func ValidateEntry(e *spb.Entry) error {
+	fail := func(rule ValidationRule) error { return &ValidationError{Rule: rule, Entry: e} }
+	switch {
+	case isEmptyVName(e.Source):
+		return fail(RuleEmptySource)
+	case len(e.FactName) == 0 || e.FactName[0] != '/':
+		return fail(RuleFactName)
+	case IsNodeFact(e) && e.Target != nil:
+		return fail(RuleNodeTarget)
+	case IsEdge(e) && isEmptyVName(e.Target):
+		return fail(RuleEdgeTarget)
+	case IsEdge(e) && len(e.FactValue) > 0 && !isOrdinal(e):
+		return fail(RuleEdgeFactValue)
+	}
+	return nil
+}
+
+func isEmptyVName(v *spb.VName) bool {
+	return v == nil || (v.Signature == "" && v.Corpus == "" && v.Root == "" && v.Path == "" && v.Language == "")
+}
+
+func isOrdinal(e *spb.Entry) bool {
+	if e.FactName != OrdinalFact {
+		return false
+	}
+	_, err := strconv.ParseUint(string(e.FactValue), 10, 31)
+	return err == nil
+}
+
+// ValidatingWriter wraps a Service, validating the updates of each Write with
+// ValidateEntry.  Other optional interfaces of the wrapped Service are hidden.
+type ValidatingWriter struct {
+	Service
+
+	// SkipInvalid causes invalid updates to be dropped (and counted) rather than
+	// rejecting their entire WriteRequest.
+	SkipInvalid bool
+
+	mu         sync.Mutex
+	violations map[ValidationRule]int64
+}
+
+// NewValidatingWriter returns a ValidatingWriter for s.
+func NewValidatingWriter(s Service, skipInvalid bool) *ValidatingWriter {
+	return &ValidatingWriter{Service: s, SkipInvalid: skipInvalid}
+}
+
+// Write implements part of the Service interface.  Unless w.SkipInvalid is
+// set, a request with any invalid update is rejected with a *ValidationError
+// and nothing is written.
+func (w *ValidatingWriter) Write(ctx context.Context, req *spb.WriteRequest) error {
+	req, err := w.Validate(req)
+	if err != nil {
+		return err
+	} else if len(req.Update) == 0 {
+		return nil
+	}
+	return w.Service.Write(ctx, req)
+}
+
+// Validate applies w's validation policy to req without writing it, counting
+// each violation.  If w.SkipInvalid is set, req is returned with its invalid
+// updates removed; otherwise, req is returned unchanged if it is valid.
+func (w *ValidatingWriter) Validate(req *spb.WriteRequest) (*spb.WriteRequest, error) {
+	var (
+		valid    []*spb.WriteRequest_Update
+		firstErr error
+	)
+	for i, e := range WriteRequestEntries(req) {
+		err := ValidateEntry(e)
+		if err == nil {
+			if w.SkipInvalid {
+				valid = append(valid, req.Update[i])
+			}
+			continue
+		}
+		w.count(err.(*ValidationError).Rule)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	switch {
+	case firstErr == nil:
+		return req, nil
+	case !w.SkipInvalid:
+		return nil, firstErr
+	default:
+		return &spb.WriteRequest{Source: req.Source, Update: valid}, nil
+	}
+}
+
+func (w *ValidatingWriter) count(rule ValidationRule) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.violations == nil {
+		w.violations = make(map[ValidationRule]int64)
+	}
+	w.violations[rule]++
+}
+
+// Violations returns the number of invalid updates seen for each broken
+// ValidationRule.
+func (w *ValidatingWriter) Violations() map[ValidationRule]int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	counts := make(map[ValidationRule]int64, len(w.violations))
+	for rule, n := range w.violations {
+		counts[rule] = n
+	}
+	return counts
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Watcher is an optional interface for a Service that can notify clients of
+// the entries written to it.
+type Watcher interface {
+	Service
+
+	// Watch calls f with each entry written to the store after the call
+	// begins, until ctx is cancelled or f returns an error.  If f returns
+	// io.EOF, Watch returns nil; otherwise it returns the error from f or ctx.
+	Watch(ctx context.Context, f EntryFunc) error
+}
+
+// DefaultWatchBufferSize is the number of entries buffered for each watcher of
+// a Broadcaster with no BufferSize.
+const DefaultWatchBufferSize = 1024
+
+// A Broadcaster delivers published entries to a dynamic set of watchers.  Each
+// watcher has a buffer of BufferSize entries; once a watcher's buffer is full,
+// Publish blocks until the watcher catches up or stops watching.  Entries are
+// therefore never dropped, but a slow watcher will slow its publishers.  The
+// zero Broadcaster is ready for use.
+type Broadcaster struct {
+	// BufferSize is the number of unconsumed entries buffered for each
+	// watcher.  If ≤ 0, DefaultWatchBufferSize is used.
+	BufferSize int
+
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+}
+
+type watcher struct {
+	entries chan *spb.Entry
+	done    chan struct{} // closed once the watcher stops receiving
+}
+
+// Watch calls f with each entry published to b after the call begins, until
+// ctx is cancelled or f returns an error.  If f returns io.EOF, Watch returns
+// nil; otherwise it returns the error from f or ctx.
+func (b *Broadcaster) Watch(ctx context.Context, f EntryFunc) error {
+	size := b.BufferSize
+	if size <= 0 {
+		size = DefaultWatchBufferSize
+	}
+	w := &watcher{
+		entries: make(chan *spb.Entry, size),
+		done:    make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	if b.watchers == nil {
+		b.watchers = make(map[*watcher]bool)
+	}
+	b.watchers[w] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.watchers, w)
+		b.mu.Unlock()
+		close(w.done)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e := <-w.entries:
+			if err := f(e); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NumWatchers returns the number of active watchers of b.
+func (b *Broadcaster) NumWatchers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.watchers)
+}
+
+// Publish delivers each of the given entries, in order, to every active
+// watcher of b.  Publish blocks while any watcher's buffer is full; if ctx is
+// cancelled while blocked, the remaining deliveries are abandoned and ctx's
+// error is returned.
+func (b *Broadcaster) Publish(ctx context.Context, entries []*spb.Entry) error {
+	b.mu.Lock()
+	watchers := make([]*watcher, 0, len(b.watchers))
+	for w := range b.watchers {
+		watchers = append(watchers, w)
+	}
+	b.mu.Unlock()
+
+	for _, e := range entries {
+		for _, w := range watchers {
+			select {
+			case w.entries <- e:
+			case <-w.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// NotifyingWriter is a Watcher that wraps any Service, publishing the entries
+// of each successful Write to its watchers.  Only writes made through the
+// NotifyingWriter are observed, and other optional interfaces of the wrapped
+// Service are hidden.
+//
+// The entries of a Write are published once the wrapped Service's Write
+// returns, so a watcher may observe them only after they are readable from the
+// Service, and concurrent Writes may be watched in a different order than the
+// Service applied them.  A caller needing the last watched entry for a key to
+// be the stored entry must not write the same key concurrently.
+type NotifyingWriter struct {
+	Service
+	Broadcaster
+}
+
+// NewNotifyingWriter returns a NotifyingWriter for s with the given buffer
+// size for each watcher (see Broadcaster).
+func NewNotifyingWriter(s Service, bufferSize int) *NotifyingWriter {
+	return &NotifyingWriter{Service: s, Broadcaster: Broadcaster{BufferSize: bufferSize}}
+}
+
+// Write implements part of the Service interface.
+func (w *NotifyingWriter) Write(ctx context.Context, req *spb.WriteRequest) error {
+	if err := w.Service.Write(ctx, req); err != nil {
+		return err
+	}
+	return w.Publish(ctx, WriteRequestEntries(req))
+}
+
+// WriteRequestEntries returns the entries written by each of req's updates.
+func WriteRequestEntries(req *spb.WriteRequest) []*spb.Entry {
+	entries := make([]*spb.Entry, len(req.Update))
+	for i, u := range req.Update {
+		entries[i] = &spb.Entry{
+			Source:    req.Source,
+			EdgeKind:  u.EdgeKind,
+			Target:    u.Target,
+			FactName:  u.FactName,
+			FactValue: u.FactValue,
+		}
+	}
+	return entries
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graphstore
+
+import (
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// WriteOptions control how the updates of a WriteRequest are applied.
+type WriteOptions struct {
+	// IfAbsent requests first-writer-wins semantics: any update whose
+	// (source, kind, target, fact) key already exists in the store (or earlier
+	// in the same request) is skipped rather than replacing the existing value.
+	IfAbsent bool
+}
+
+// OptionsWriter is an optional interface for a Service that can apply writes
+// according to a set of WriteOptions.
+type OptionsWriter interface {
+	Service
+
+	// WriteOpts is equivalent to Write, but applies the request according to
+	// opts and reports the effect of each update.  A nil opts is equivalent to
+	// the zero WriteOptions.
+	WriteOpts(ctx context.Context, req *spb.WriteRequest, opts *WriteOptions) (*WriteStats, error)
+}
+
+// WriteWithOptions writes req to s according to opts, returning the effect of
+// the request's updates.  If s does not implement OptionsWriter, IfAbsent is
+// emulated by reading the existing entries of req.Source before the write;
+// unlike a native implementation, the check and write are then not atomic.
+// When s can report neither, the returned stats only count skipped and
+// inserted updates for IfAbsent writes.
+func WriteWithOptions(ctx context.Context, s Service, req *spb.WriteRequest, opts *WriteOptions) (*WriteStats, error) {
+	if ow, ok := s.(OptionsWriter); ok {
+		return ow.WriteOpts(ctx, req, opts)
+	} else if opts == nil || !opts.IfAbsent {
+		if sw, ok := s.(StatsWriter); ok {
+			return sw.WriteWithStats(ctx, req)
+		}
+		return &WriteStats{}, s.Write(ctx, req)
+	}
+
+	existing := make(map[string]bool)
+	if err := s.Read(ctx, &spb.ReadRequest{Source: req.Source, EdgeKind: "*"}, func(e *spb.Entry) error {
+		existing[entryKey(e)] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	stats := new(WriteStats)
+	absent := &spb.WriteRequest{Source: req.Source}
+	for _, u := range req.Update {
+		key := entryKey(&spb.Entry{
+			Source:   req.Source,
+			EdgeKind: u.EdgeKind,
+			Target:   u.Target,
+			FactName: u.FactName,
+		})
+		if existing[key] {
+			stats.Skipped++
+			continue
+		}
+		existing[key] = true
+		absent.Update = append(absent.Update, u)
+	}
+	if len(absent.Update) == 0 {
+		return stats, nil
+	}
+	stats.Inserted = int64(len(absent.Update))
+	return stats, s.Write(ctx, absent)
+}
@@ -19,6 +19,7 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"log"
 	"net"
@@ -28,10 +29,11 @@ import (
 
 	"kythe.io/kythe/go/services/filetree"
 	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/nettrace"
 	"kythe.io/kythe/go/services/xrefs"
 	ftsrv "kythe.io/kythe/go/serving/filetree"
 	xsrv "kythe.io/kythe/go/serving/xrefs"
-	"kythe.io/kythe/go/storage/gsutil"
+	"kythe.io/kythe/go/storage/gsflag"
 	"kythe.io/kythe/go/storage/leveldb"
 	"kythe.io/kythe/go/storage/table"
 	xstore "kythe.io/kythe/go/storage/xrefs"
@@ -43,14 +45,9 @@ import (
 
 	ftpb "kythe.io/kythe/proto/filetree_proto"
 	xpb "kythe.io/kythe/proto/xref_proto"
-
-	_ "kythe.io/kythe/go/services/graphstore/grpc"
-	_ "kythe.io/kythe/go/services/graphstore/proxy"
-	_ "kythe.io/kythe/go/storage/leveldb"
 )
 
 var (
-	gs           graphstore.Service
 	servingTable = flag.String("serving_table", "", "LevelDB serving table")
 
 	grpcListeningAddr = flag.String("grpc_listen", "", "Listening address for GRPC server")
@@ -59,24 +56,30 @@ var (
 	httpAllowOrigin   = flag.String("http_allow_origin", "", "If set, each HTTP response will contain a Access-Control-Allow-Origin header with the given value")
 	publicResources   = flag.String("public_resources", "", "Path to directory of static resources to serve")
 
+	traceGraphStore = flag.Bool("trace_graphstore", false, "Trace each call to the --graphstore (shown at /debug/requests)")
+	readOnly        = flag.Bool("read_only", false, "Fail any attempt to modify the --graphstore (e.g. to add missing reverse edges)")
+
 	tlsListeningAddr = flag.String("tls_listen", "", "Listening address for TLS HTTP server")
 	tlsCertFile      = flag.String("tls_cert_file", "", "Path to file with concatenation of TLS certificates")
 	tlsKeyFile       = flag.String("tls_key_file", "", "Path to file with TLS private key")
+
+	// The --serving_table or --graphstore is opened once the flags are parsed,
+	// so that the LevelDB options apply regardless of the order of the flags.
+	leveldbOptions = leveldb.FlagOptions("serving")
 )
 
 func init() {
-	gsutil.Flag(&gs, "graphstore", "GraphStore to serve xrefs")
 	flag.Usage = flagutil.SimpleUsage("Exposes HTTP/GRPC interfaces for the xrefs and filetree services",
-		"(--graphstore spec | --serving_table path) [--listen addr] [--grpc_listen addr] [--public_resources dir]")
+		"(--graphstore spec | --serving_table path) [--listen addr] [--grpc_listen addr] [--public_resources dir] [--leveldb_preset name]")
 }
 
 func main() {
 	flag.Parse()
-	if *servingTable == "" && gs == nil {
+	if *servingTable == "" && gsflag.Spec() == "" {
 		flagutil.UsageError("missing either --serving_table or --graphstore")
 	} else if *httpListeningAddr == "" && *grpcListeningAddr == "" && *tlsListeningAddr == "" {
 		flagutil.UsageError("missing either --listen, --tls_listen, or --grpc_listen argument")
-	} else if *servingTable != "" && gs != nil {
+	} else if *servingTable != "" && gsflag.Spec() != "" {
 		flagutil.UsageError("--serving_table and --graphstore are mutually exclusive")
 	} else if *tlsListeningAddr != "" && (*tlsCertFile == "" || *tlsKeyFile == "") {
 		flagutil.UsageError("--tls_cert_file and --tls_key_file are required if given --tls_listen")
@@ -84,14 +87,25 @@ func main() {
 		flagutil.UsageErrorf("unknown non-flag arguments given: %v", flag.Args())
 	}
 
+	opts, err := leveldbOptions()
+	if err != nil {
+		flagutil.UsageError(err.Error())
+	}
+	leveldb.DefaultOptions = opts
+
 	var (
 		xs xrefs.Service
 		ft filetree.Service
+
+		// checkHealth reports whether the server's backing store is healthy.
+		checkHealth = func(context.Context) error { return nil }
 	)
 
 	ctx := context.Background()
 	if *servingTable != "" {
-		db, err := leveldb.Open(*servingTable, &leveldb.Options{MustExist: true})
+		tblOpts := *opts
+		tblOpts.MustExist = true
+		db, err := leveldb.Open(*servingTable, &tblOpts)
 		if err != nil {
 			log.Fatalf("Error opening db at %q: %v", *servingTable, err)
 		}
@@ -101,12 +115,29 @@ func main() {
 		ft = &ftsrv.Table{Proto: tbl, PrefixedKeys: true}
 	} else {
 		log.Println("WARNING: serving directly from a GraphStore can be slow; you may want to use a --serving_table")
+		gs, err := gsflag.Open(ctx)
+		if err != nil {
+			log.Fatalf("Error opening GraphStore %q: %v", gsflag.Spec(), err)
+		}
+		checkHealth = func(ctx context.Context) error { return graphstore.CheckHealth(ctx, gs) }
+
+		// Export the GraphStore's call metrics at /debug/vars.
+		metrics := graphstore.NewMetrics()
+		expvar.Publish("graphstore", metrics)
+		metered := graphstore.NewMeteredService(gs, metrics)
+		if *readOnly {
+			metered = graphstore.ReadOnly(metered)
+		}
+		if *traceGraphStore {
+			metered = graphstore.NewTracedService(metered, nettrace.New("graphstore"))
+		}
+
 		if f, ok := gs.(filetree.Service); ok {
 			log.Printf("Using %T directly as filetree service", gs)
 			ft = f
 		} else {
 			m := filetree.NewMap()
-			if err := m.Populate(ctx, gs); err != nil {
+			if err := m.Populate(ctx, metered); err != nil {
 				log.Fatalf("Error populating file tree from GraphStore: %v", err)
 			}
 			ft = m
@@ -116,10 +147,10 @@ func main() {
 			log.Printf("Using %T directly as xrefs service", gs)
 			xs = x
 		} else {
-			if err := xstore.EnsureReverseEdges(ctx, gs); err != nil {
+			if err := xstore.EnsureReverseEdges(ctx, metered); err != nil {
 				log.Fatalf("Error ensuring reverse edges in GraphStore: %v", err)
 			}
-			xs = xstore.NewGraphStoreService(gs)
+			xs = xstore.NewGraphStoreService(metered)
 		}
 
 	}
@@ -139,6 +170,13 @@ func main() {
 			}
 			apiMux.ServeHTTP(w, r)
 		})
+		http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			if err := checkHealth(ctx); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok\n"))
+		})
 
 		xrefs.RegisterHTTPHandlers(ctx, xs, apiMux)
 		filetree.RegisterHTTPHandlers(ctx, ft, apiMux)
@@ -20,6 +20,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 
 	"kythe.io/kythe/go/platform/vfs"
@@ -55,6 +56,8 @@ var (
 	shardIOBufferSize = datasize.Flag("shard_io_buffer", "16KiB",
 		"Size of the reading/writing buffers for the intermediary data shards.")
 
+	checkSorted = flag.Bool("check_sorted", false, "Fail on the first entry out of GraphStore order, unless the --graphstore is known to scan in order")
+
 	verbose = flag.Bool("verbose", false, "Whether to emit extra, and possibly excessive, log messages")
 )
 
@@ -62,7 +65,7 @@ func init() {
 	gsutil.Flag(&gs, "graphstore", "GraphStore to read (mutually exclusive with --entries)")
 	flag.Usage = flagutil.SimpleUsage(
 		"Creates a combined xrefs/filetree/search serving table based on a given GraphStore or stream of GraphStore-ordered entries",
-		"(--graphstore spec | --entries path) --out path")
+		"(--graphstore spec | --entries path) [--check_sorted] --out path")
 }
 func main() {
 	flag.Parse()
@@ -87,19 +90,38 @@ func main() {
 	}
 	defer profile.Stop()
 
-	var rd stream.EntryReader
+	var src graphstore.EntrySource
 	if gs != nil {
-		rd = func(f func(e *spb.Entry) error) error {
+		src = graphstore.NewEntrySource(func(ctx context.Context, f graphstore.EntryFunc) error {
 			defer gs.Close(ctx)
-			return gs.Scan(ctx, &spb.ScanRequest{}, f)
-		}
+			src := gs
+			if ss, ok := gs.(graphstore.Snapshotter); ok {
+				// Build the tables from a consistent view of the GraphStore in
+				// case it is being concurrently written.
+				snap, err := ss.Snapshot()
+				if err != nil {
+					return fmt.Errorf("GraphStore snapshot error: %v", err)
+				}
+				defer snap.Close(ctx)
+				src = snap
+			}
+			return src.Scan(ctx, &spb.ScanRequest{}, f)
+		}, graphstore.ScansOrdered(gs))
 	} else {
 		f, err := vfs.Open(ctx, *entriesFile)
 		if err != nil {
 			log.Fatalf("Error opening %q: %v", *entriesFile, err)
 		}
 		defer f.Close()
-		rd = stream.NewReader(f)
+		src = graphstore.NewEntrySource(func(_ context.Context, g graphstore.EntryFunc) error {
+			return stream.NewReader(f)(g)
+		}, false)
+	}
+	rd := func(f func(*spb.Entry) error) error {
+		if *checkSorted && !src.Ordered() {
+			f = graphstore.CheckOrdered(f)
+		}
+		return src.Entries(ctx, f)
 	}
 
 	if err := pipeline.Run(ctx, rd, db, &pipeline.Options{
@@ -0,0 +1,699 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package badger implements a graphstore.Service using a Badger database, a
+// pure-Go LSM tree that keeps large values in a separate value log.
+//
+// Each entry is stored under its canonical key (see compare.EncodeEntryKey)
+// with its fact value, so Reads are prefix scans of a source's keys.  Fact
+// values of at least Options.ValueThreshold bytes (such as file contents) are
+// written to the value log rather than the LSM tree, so that compactions need
+// not rewrite them.  Space in the value log is reclaimed by RunValueLogGC.
+package badger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/options"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func init() {
+	graphstore.Register("badger", func(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+		return OpenGraphStore(graphstore.SpecLocation(u), nil)
+	})
+}
+
+// Compression is a compression algorithm for the blocks of a Badger database.
+type Compression int
+
+// Supported compression algorithms.
+const (
+	NoCompression Compression = iota
+	SnappyCompression
+	ZSTDCompression
+)
+
+// Defaults for the fields of Options.
+const (
+	// DefaultValueThreshold is the default size in bytes of the smallest fact
+	// value kept in the value log.
+	DefaultValueThreshold = 256
+
+	// DefaultGCDiscardRatio is the default fraction of a value log file that
+	// must be garbage for RunValueLogGC to rewrite it.
+	DefaultGCDiscardRatio = 0.5
+)
+
+// DefaultOptions is the default Options struct passed to OpenGraphStore when
+// not otherwise given one.
+var DefaultOptions = &Options{
+	Compression: SnappyCompression,
+	GCInterval:  10 * time.Minute,
+}
+
+// Options for customizing a Badger backend.
+type Options struct {
+	// ReadOnly opens the database without its exclusive lock, so that it may be
+	// read by several processes at once.  Each write to the GraphStore fails
+	// with graphstore.ErrReadOnly.  The database must already exist.
+	ReadOnly bool
+
+	// ValueThreshold is the size in bytes of the smallest fact value stored in
+	// the value log instead of the LSM tree.  If zero, DefaultValueThreshold is
+	// used.
+	ValueThreshold int
+
+	// Compression is the compression algorithm of the LSM tree's blocks.
+	Compression Compression
+
+	// SyncWrites causes each write to be synced to disk before it returns.
+	SyncWrites bool
+
+	// GCInterval is the interval at which RunValueLogGC is called in the
+	// background.  If zero, the value log is collected only by explicit calls
+	// to RunValueLogGC.
+	GCInterval time.Duration
+
+	// GCDiscardRatio is the fraction of a value log file that must be garbage
+	// for RunValueLogGC to rewrite it.  If zero, DefaultGCDiscardRatio is used.
+	GCDiscardRatio float64
+}
+
+// GraphStore is a graphstore.Service backed by a Badger database.  It is
+// Sharded by contiguous key ranges.
+type GraphStore struct {
+	db           *badger.DB
+	readOnly     bool
+	discardRatio float64
+
+	// snap is the read transaction of a snapshot, guarded by snapMu.
+	snap   *badger.Txn
+	snapMu sync.Mutex
+
+	stopGC chan struct{} // closed to stop background value log collection
+	gcDone sync.WaitGroup
+
+	shardMu     sync.Mutex
+	generation  uint64 // incremented by each write, invalidating shardTables
+	shardTables map[int64]*shardTable
+}
+
+// OpenGraphStore returns a GraphStore backed by a Badger database in the given
+// directory, which is created if it does not exist (unless opts.ReadOnly).  If
+// opts==nil, the DefaultOptions are used.
+func OpenGraphStore(path string, opts *Options) (*GraphStore, error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	bopts := badger.DefaultOptions(path).
+		WithReadOnly(opts.ReadOnly).
+		WithSyncWrites(opts.SyncWrites).
+		WithLogger(logger{})
+	if opts.ValueThreshold > 0 {
+		bopts = bopts.WithValueThreshold(opts.ValueThreshold)
+	} else {
+		bopts = bopts.WithValueThreshold(DefaultValueThreshold)
+	}
+	switch opts.Compression {
+	case NoCompression:
+		bopts = bopts.WithCompression(options.None)
+	case SnappyCompression:
+		bopts = bopts.WithCompression(options.Snappy)
+	case ZSTDCompression:
+		bopts = bopts.WithCompression(options.ZSTD)
+	default:
+		return nil, fmt.Errorf("unknown compression: %d", opts.Compression)
+	}
+	db, err := badger.Open(bopts)
+	if err != nil {
+		return nil, fmt.Errorf("could not open badger database at %q: %v", path, err)
+	}
+	g := &GraphStore{
+		db:           db,
+		readOnly:     opts.ReadOnly,
+		discardRatio: opts.GCDiscardRatio,
+	}
+	if g.discardRatio == 0 {
+		g.discardRatio = DefaultGCDiscardRatio
+	}
+	if opts.GCInterval > 0 && !opts.ReadOnly {
+		g.stopGC = make(chan struct{})
+		g.gcDone.Add(1)
+		go g.collectGarbage(opts.GCInterval)
+	}
+	return g, nil
+}
+
+// logger passes Badger's warnings and errors to the standard logger, dropping
+// its informational messages.
+type logger struct{}
+
+func (logger) Errorf(format string, args ...interface{}) {
+	log.Printf("badger: ERROR: "+format, args...)
+}
+func (logger) Warningf(format string, args ...interface{}) {
+	log.Printf("badger: WARNING: "+format, args...)
+}
+func (logger) Infof(string, ...interface{})  {}
+func (logger) Debugf(string, ...interface{}) {}
+
+// collectGarbage calls RunValueLogGC at each interval until g.stopGC is closed.
+func (g *GraphStore) collectGarbage(interval time.Duration) {
+	defer g.gcDone.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-g.stopGC:
+			return
+		case <-t.C:
+			if err := g.RunValueLogGC(context.Background()); err != nil {
+				log.Printf("badger: value log GC error: %v", err)
+			}
+		}
+	}
+}
+
+// RunValueLogGC rewrites each file of the value log that is at least the
+// configured GCDiscardRatio garbage (values overwritten or deleted), reclaiming
+// its space.  Collection is not automatic unless Options.GCInterval is set, so
+// a store with many overwritten or deleted large fact values should call
+// RunValueLogGC periodically, or after a large batch of writes.
+func (g *GraphStore) RunValueLogGC(ctx context.Context) error {
+	if g.readOnly {
+		return graphstore.ErrReadOnly
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch err := g.db.RunValueLogGC(g.discardRatio); err {
+		case nil:
+			// A file was rewritten; there may be more to collect.
+		case badger.ErrNoRewrite, badger.ErrRejected:
+			// There is nothing left to collect or another collection is running.
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// view calls f with a read transaction.
+func (g *GraphStore) view(f func(*badger.Txn) error) error {
+	if g.snap != nil {
+		g.snapMu.Lock()
+		defer g.snapMu.Unlock()
+		if g.snap == nil {
+			return errors.New("snapshot is closed")
+		}
+		return f(g.snap)
+	}
+	return g.db.View(f)
+}
+
+// update calls f with a read-write transaction, which is then committed unless
+// f returns an error.  If the commit conflicts with a concurrent transaction,
+// f is retried.
+func (g *GraphStore) update(ctx context.Context, f func(*badger.Txn) error) error {
+	if g.readOnly {
+		return graphstore.ErrReadOnly
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := g.db.Update(f)
+		if err == badger.ErrConflict {
+			continue
+		}
+		g.wrote()
+		return err
+	}
+}
+
+// wrote invalidates the shardTables of g after a write.
+func (g *GraphStore) wrote() {
+	g.shardMu.Lock()
+	g.generation++
+	g.shardMu.Unlock()
+}
+
+// A keyRange is a range of keys to scan.
+type keyRange struct {
+	prefix  []byte // if non-nil, each key in the range has this prefix
+	start   []byte // if non-nil, the least key in the range
+	end     []byte // if non-nil, the (exclusive) limit of the range
+	reverse bool   // scan the range in descending key order
+}
+
+// scan calls f with each entry in the given range that satisfies match (or
+// every entry if match is nil), in a single read transaction.
+func (g *GraphStore) scan(ctx context.Context, r keyRange, match func(*spb.Entry) bool, f graphstore.EntryFunc) error {
+	return g.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{
+			PrefetchValues: true,
+			PrefetchSize:   100,
+			Reverse:        r.reverse,
+			Prefix:         r.prefix,
+		})
+		defer it.Close()
+		if r.start != nil {
+			it.Seek(r.start)
+		} else {
+			it.Rewind()
+		}
+		for ; it.ValidForPrefix(r.prefix); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := it.Item()
+			if r.end != nil && bytes.Compare(item.Key(), r.end) >= 0 {
+				return nil
+			}
+			e, err := decodeItem(item)
+			if err != nil {
+				return err
+			} else if match != nil && !match(e) {
+				continue
+			}
+			if err := f(e); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// decodeItem returns the entry stored in the given item.
+func decodeItem(item *badger.Item) (*spb.Entry, error) {
+	e, err := compare.DecodeEntryKey(item.Key())
+	if err != nil {
+		return nil, fmt.Errorf("invalid entry key %q: %v", item.Key(), err)
+	}
+	if err := item.Value(func(val []byte) error {
+		if len(val) > 0 {
+			e.FactValue = append([]byte(nil), val...)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Read implements part of the graphstore.Service interface.
+func (g *GraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	return g.scan(ctx, keyRange{prefix: compare.EncodeKeyPrefix(req.Source, req.EdgeKind)}, nil, f)
+}
+
+// ReadMultiple implements the graphstore.MultiReader interface.  The requests
+// are satisfied in order.
+func (g *GraphStore) ReadMultiple(ctx context.Context, reqs []*spb.ReadRequest, f graphstore.EntryFunc) error {
+	var errs graphstore.MultiError
+	for _, req := range reqs {
+		if err := g.Read(ctx, req, f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Scan implements part of the graphstore.Service interface.
+func (g *GraphStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return g.ScanOpts(ctx, req, nil, f)
+}
+
+// ScanOpts implements part of the graphstore.OptionsScanner interface.
+func (g *GraphStore) ScanOpts(ctx context.Context, req *spb.ScanRequest, opts *graphstore.ScanOptions, f graphstore.EntryFunc) error {
+	return g.scan(ctx, keyRange{}, func(e *spb.Entry) bool {
+		return graphstore.EntryMatchesScanOpts(req, opts, e)
+	}, f)
+}
+
+// ReverseScan implements part of the graphstore.ReverseScanner interface.
+func (g *GraphStore) ReverseScan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return g.scan(ctx, keyRange{reverse: true}, func(e *spb.Entry) bool {
+		return graphstore.EntryMatchesScan(req, e)
+	}, f)
+}
+
+// ScanFrom implements part of the graphstore.ResumableScanner interface.
+func (g *GraphStore) ScanFrom(ctx context.Context, req *spb.ScanRequest, after *spb.Entry, f graphstore.EntryFunc) error {
+	var r keyRange
+	if after != nil {
+		// The least key greater than after's is after's key with a zero byte
+		// appended.
+		r.start = append(compare.EncodeEntryKey(after), 0)
+	}
+	return g.scan(ctx, r, func(e *spb.Entry) bool {
+		return graphstore.EntryMatchesScan(req, e)
+	}, f)
+}
+
+// ScanPage implements part of the graphstore.PagedScanner interface.
+func (g *GraphStore) ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	after, err := graphstore.ParsePageToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	var page []*spb.Entry
+	if err := g.ScanFrom(ctx, req, after, func(e *spb.Entry) error {
+		page = append(page, e)
+		if len(page) > pageSize {
+			return io.EOF
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	return graphstore.Page(page, pageSize)
+}
+
+// ScansOrdered implements the graphstore.OrderedScanner interface.
+func (g *GraphStore) ScansOrdered() bool { return true }
+
+// Write implements part of the graphstore.Service interface.  A request is
+// applied in a single transaction; a request too large for Badger to commit at
+// once fails with badger.ErrTxnTooBig, leaving the store unchanged.
+func (g *GraphStore) Write(ctx context.Context, req *spb.WriteRequest) error {
+	_, err := g.WriteOpts(ctx, req, nil)
+	return err
+}
+
+// WriteWithStats implements part of the graphstore.StatsWriter interface.
+func (g *GraphStore) WriteWithStats(ctx context.Context, req *spb.WriteRequest) (*graphstore.WriteStats, error) {
+	return g.WriteOpts(ctx, req, nil)
+}
+
+// WriteOpts implements part of the graphstore.OptionsWriter interface.
+func (g *GraphStore) WriteOpts(ctx context.Context, req *spb.WriteRequest, opts *graphstore.WriteOptions) (*graphstore.WriteStats, error) {
+	if g.readOnly {
+		return nil, graphstore.ErrReadOnly
+	}
+	ifAbsent := opts != nil && opts.IfAbsent
+	keys := make([][]byte, len(req.Update))
+	for i, u := range req.Update {
+		keys[i] = compare.EncodeEntryKey(&spb.Entry{
+			Source:   req.Source,
+			EdgeKind: u.EdgeKind,
+			Target:   u.Target,
+			FactName: u.FactName,
+		})
+	}
+	defer g.wrote()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		stats, err := g.writeTxn(keys, req.Update, ifAbsent)
+		if err == badger.ErrConflict {
+			continue
+		}
+		return stats, err
+	}
+}
+
+// writeTxn applies the given updates in one transaction.
+func (g *GraphStore) writeTxn(keys [][]byte, updates []*spb.WriteRequest_Update, ifAbsent bool) (*graphstore.WriteStats, error) {
+	txn := g.db.NewTransaction(true)
+	defer txn.Discard()
+
+	stats := new(graphstore.WriteStats)
+	for i, key := range keys {
+		val := updates[i].FactValue
+		item, err := txn.Get(key)
+		exists := err == nil
+		if err != nil && err != badger.ErrKeyNotFound {
+			return nil, err
+		} else if exists && ifAbsent {
+			stats.Skipped++
+			continue
+		} else if exists {
+			var same bool
+			if err := item.Value(func(old []byte) error {
+				same = bytes.Equal(old, val)
+				return nil
+			}); err != nil {
+				return nil, err
+			} else if same {
+				stats.Unchanged++
+				continue
+			}
+		}
+		if err := txn.Set(key, val); err != nil {
+			return nil, err
+		}
+		if exists {
+			stats.Updated++
+		} else {
+			stats.Inserted++
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// CompareAndSwap implements part of the graphstore.CAS interface.  The
+// comparison and write are made in a single transaction.
+func (g *GraphStore) CompareAndSwap(ctx context.Context, source *spb.VName, factName string, oldValue, newValue []byte) (bool, error) {
+	if factName == "" {
+		return false, errors.New("missing fact name")
+	}
+	key := compare.EncodeEntryKey(&spb.Entry{Source: source, FactName: factName})
+	var swapped bool
+	err := g.update(ctx, func(txn *badger.Txn) error {
+		swapped = false
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			if oldValue != nil {
+				return nil
+			}
+		} else if err != nil {
+			return err
+		} else if oldValue == nil {
+			return nil
+		} else if cur, err := item.ValueCopy(nil); err != nil {
+			return err
+		} else if !bytes.Equal(cur, oldValue) {
+			return nil
+		}
+		swapped = true
+		return txn.Set(key, newValue)
+	})
+	return swapped, err
+}
+
+// Delete implements part of the graphstore.Deleter interface.
+func (g *GraphStore) Delete(ctx context.Context, req *graphstore.DeleteRequest) error {
+	if req.Source == nil {
+		return errors.New("invalid DeleteRequest: missing Source")
+	}
+	kind := req.EdgeKind
+	if kind == "" {
+		kind = "*"
+	}
+	prefix := compare.EncodeKeyPrefix(req.Source, kind)
+	for more := true; more; {
+		// Each transaction deletes matching entries until it is full.
+		if err := g.update(ctx, func(txn *badger.Txn) error {
+			more = false
+			it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+			defer it.Close()
+			var keys [][]byte
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				e, err := decodeItem(it.Item())
+				if err != nil {
+					return err
+				} else if graphstore.EntryMatchesDelete(req, e) {
+					keys = append(keys, it.Item().KeyCopy(nil))
+				}
+			}
+			for i, k := range keys {
+				if err := txn.Delete(k); err == badger.ErrTxnTooBig && i > 0 {
+					more = true
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot implements the graphstore.Snapshotter interface.  The snapshot holds
+// a Badger read transaction, which prevents the value log from reclaiming the
+// values it views, so it should be closed promptly; the snapshot must be
+// closed before its parent store.
+func (g *GraphStore) Snapshot() (graphstore.Service, error) {
+	if g.snap != nil {
+		return nil, errors.New("cannot snapshot a snapshot")
+	}
+	return &GraphStore{db: g.db, readOnly: true, snap: g.db.NewTransaction(false)}, nil
+}
+
+// DiskSize implements the graphstore.DiskSizer interface using the sizes of the
+// LSM tree and the value log (including any uncollected garbage).
+func (g *GraphStore) DiskSize(ctx context.Context) (int64, error) {
+	lsm, vlog := g.db.Size()
+	return lsm + vlog, nil
+}
+
+// Close implements part of the graphstore.Service interface.  Closing a
+// snapshot releases its read transaction.
+func (g *GraphStore) Close(ctx context.Context) error {
+	if g.snap != nil {
+		g.snapMu.Lock()
+		defer g.snapMu.Unlock()
+		if g.snap != nil {
+			g.snap.Discard()
+			g.snap = nil
+		}
+		return nil
+	}
+	if g.stopGC != nil {
+		close(g.stopGC)
+		g.gcDone.Wait()
+	}
+	return g.db.Close()
+}
+
+// A shardTable divides the keys of a store into contiguous ranges with nearly
+// equal numbers of entries, as of a given generation of the store.
+type shardTable struct {
+	generation uint64
+	starts     [][]byte // the first key of each non-empty shard
+	counts     []int64
+}
+
+// shardRange returns the range of keys of the given shard.
+func (t *shardTable) shardRange(index int64) keyRange {
+	r := keyRange{start: t.starts[index]}
+	for i := index + 1; i < int64(len(t.starts)); i++ {
+		if t.counts[i] > 0 {
+			r.end = t.starts[i]
+			break
+		}
+	}
+	return r
+}
+
+// shards returns the current shardTable for the given number of shards,
+// computing it if the store has been written since it was last used.
+func (g *GraphStore) shards(num int64) (*shardTable, error) {
+	g.shardMu.Lock()
+	defer g.shardMu.Unlock()
+	if t, ok := g.shardTables[num]; ok && t.generation == g.generation {
+		return t, nil
+	}
+	t := &shardTable{
+		generation: g.generation,
+		starts:     make([][]byte, num),
+		counts:     make([]int64, num),
+	}
+	if err := g.view(func(txn *badger.Txn) error {
+		// Badger keeps no key count, so the keys are read twice: once to count
+		// them and again to divide them.
+		it := txn.NewIterator(badger.IteratorOptions{})
+		defer it.Close()
+		var total int64
+		for it.Rewind(); it.Valid(); it.Next() {
+			total++
+		}
+		var i, shard int64
+		for it.Rewind(); it.Valid(); it.Next() {
+			// Key i belongs to the shard containing index i of an even division
+			// of total keys into num shards.
+			for (shard+1)*total <= i*num {
+				shard++
+			}
+			if t.counts[shard] == 0 {
+				t.starts[shard] = it.Item().KeyCopy(nil)
+			}
+			t.counts[shard]++
+			i++
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if g.shardTables == nil {
+		g.shardTables = make(map[int64]*shardTable)
+	}
+	g.shardTables[num] = t
+	return t, nil
+}
+
+// Count implements part of the graphstore.Sharded interface.  Shards are
+// contiguous ranges of keys, computed by a scan of the store's keys after each
+// write, so Counts and Shards agree only while the store is not written.
+func (g *GraphStore) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	if req.Shards < 1 {
+		return 0, fmt.Errorf("invalid number of shards: %d", req.Shards)
+	} else if req.Index < 0 || req.Index >= req.Shards {
+		return 0, fmt.Errorf("invalid index for %d shards: %d", req.Shards, req.Index)
+	}
+	t, err := g.shards(req.Shards)
+	if err != nil {
+		return 0, err
+	}
+	return t.counts[req.Index], nil
+}
+
+// Shard implements part of the graphstore.Sharded interface.
+func (g *GraphStore) Shard(ctx context.Context, req *spb.ShardRequest, f graphstore.EntryFunc) error {
+	if req.Shards < 1 {
+		return fmt.Errorf("invalid number of shards: %d", req.Shards)
+	} else if req.Index < 0 || req.Index >= req.Shards {
+		return fmt.Errorf("invalid index for %d shards: %d", req.Shards, req.Index)
+	}
+	t, err := g.shards(req.Shards)
+	if err != nil {
+		return err
+	} else if t.counts[req.Index] == 0 {
+		return nil
+	}
+	return g.scan(ctx, t.shardRange(req.Index), nil, f)
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gspkg "kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/storage/gsutil"
+	"kythe.io/kythe/go/test/services/graphstore"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+const (
+	smallBatchSize  = 4
+	mediumBatchSize = 16
+	largeBatchSize  = 64
+)
+
+func tempGS() (graphstore.Service, graphstore.DestroyFunc, error) {
+	dir, err := ioutil.TempDir("", "badger.test")
+	if err != nil {
+		return nil, graphstore.NullDestroy, err
+	}
+	destroy := func() error { return os.RemoveAll(dir) }
+	gs, err := OpenGraphStore(dir, &Options{})
+	if err != nil {
+		return nil, destroy, fmt.Errorf("error creating temporary DB: %v", err)
+	}
+	return gs, destroy, nil
+}
+
+func BenchmarkGSWriteSingleEntry(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, 1)
+}
+func BenchmarkGSWriteBatchSml(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, smallBatchSize)
+}
+func BenchmarkGSWriteBatchLrg(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, largeBatchSize)
+}
+
+func BenchmarkGSReadAllFacts(b *testing.B) {
+	graphstore.ReadFactsBenchmark(b, tempGS, nil)
+}
+func BenchmarkGSReadFactsNodeKind(b *testing.B) {
+	graphstore.ReadFactsBenchmark(b, tempGS, []string{"/kythe/node/kind"})
+}
+
+func BenchmarkGSSequentialScan(b *testing.B) {
+	graphstore.ShardedScanBenchmark(b, tempGS, 0)
+}
+func BenchmarkGSParallelShards4(b *testing.B) {
+	graphstore.ShardedScanBenchmark(b, tempGS, 4)
+}
+
+func BenchmarkGSZipfRead(b *testing.B) {
+	graphstore.ZipfReadBenchmark(b, tempGS, nil)
+}
+
+func TestOrder(t *testing.T) {
+	graphstore.OrderTest(t, tempGS, largeBatchSize)
+}
+
+func TestDelete(t *testing.T) {
+	graphstore.DeleteTest(t, tempGS)
+}
+
+func TestCAS(t *testing.T) {
+	graphstore.CASTest(t, tempGS)
+}
+
+func TestGarbageCollection(t *testing.T) {
+	graphstore.GarbageCollectionTest(t, tempGS)
+}
+
+func TestReadMultiple(t *testing.T) {
+	graphstore.ReadMultipleTest(t, tempGS)
+}
+
+func TestPagedScan(t *testing.T) {
+	graphstore.PagedScanTest(t, tempGS)
+}
+
+func TestScanFrom(t *testing.T) {
+	graphstore.ScanFromTest(t, tempGS)
+}
+
+func TestReverseOrder(t *testing.T) {
+	graphstore.ReverseOrderTest(t, tempGS, mediumBatchSize)
+}
+
+func TestWriteStats(t *testing.T) {
+	graphstore.WriteStatsTest(t, tempGS)
+}
+
+func TestWriteIfAbsent(t *testing.T) {
+	graphstore.WriteIfAbsentTest(t, tempGS)
+}
+
+func TestWriteIfAbsentRace(t *testing.T) {
+	graphstore.WriteIfAbsentRaceTest(t, tempGS)
+}
+
+func TestSnapshot(t *testing.T) {
+	graphstore.SnapshotTest(t, tempGS)
+}
+
+func TestScanOptions(t *testing.T) {
+	graphstore.ScanOptionsTest(t, tempGS)
+}
+
+func TestReadFacts(t *testing.T) {
+	graphstore.ReadFactsTest(t, tempGS)
+}
+
+func TestBlobWrite(t *testing.T) {
+	graphstore.BlobWriteTest(t, tempGS)
+}
+
+func TestLargeValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger.values")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	gs, err := OpenGraphStore(dir, &Options{
+		ValueThreshold: 64,
+		Compression:    ZSTDCompression,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &spb.VName{Path: "file.go"}
+	text := bytes.Repeat([]byte("package main\n"), 1000)
+	for i := 0; i < 3; i++ {
+		if err := gs.Write(ctx, &spb.WriteRequest{
+			Source: src,
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/node/kind", FactValue: []byte("file")},
+				{FactName: "/kythe/text", FactValue: append(text, byte('0'+i))},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gs.RunValueLogGC(ctx); err != nil {
+		t.Errorf("RunValueLogGC error: %v", err)
+	}
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	gs, err = OpenGraphStore(dir, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+	if err := gs.Write(ctx, &spb.WriteRequest{Source: src}); err != gspkg.ErrReadOnly {
+		t.Errorf("Write to a read-only store: got error %v; want %v", err, gspkg.ErrReadOnly)
+	}
+	if err := gs.RunValueLogGC(ctx); err != gspkg.ErrReadOnly {
+		t.Errorf("RunValueLogGC of a read-only store: got error %v; want %v", err, gspkg.ErrReadOnly)
+	}
+	var facts []*spb.Entry
+	if err := gs.Read(ctx, &spb.ReadRequest{Source: src}, func(e *spb.Entry) error {
+		facts = append(facts, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(facts) != 2 {
+		t.Fatalf("Read %d facts; want 2: %v", len(facts), facts)
+	} else if want := append(text, '2'); !bytes.Equal(facts[1].FactValue, want) {
+		t.Errorf("Read %s of %d bytes; want the last %d written", facts[1].FactName, len(facts[1].FactValue), len(want))
+	}
+}
+
+func TestParseGraphStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger.spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gs, err := gsutil.ParseGraphStore("badger:" + filepath.Join(dir, "gs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gs.(*GraphStore); !ok {
+		t.Errorf("ParseGraphStore returned %T; want *GraphStore", gs)
+	}
+	if err := gs.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShards(t *testing.T) {
+	gs, destroy, err := tempGS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroy()
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := gs.Write(ctx, &spb.WriteRequest{
+				Source: &spb.VName{Signature: fmt.Sprintf("sig%04d", i)},
+				Update: []*spb.WriteRequest_Update{
+					{FactName: "/kythe/node/kind", FactValue: []byte("test")},
+					{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))},
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(entries, shards int64) {
+		sh := gs.(gspkg.Sharded)
+		var (
+			total int64
+			last  *spb.Entry
+		)
+		for i := int64(0); i < shards; i++ {
+			count, err := sh.Count(ctx, &spb.CountRequest{Index: i, Shards: shards})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if max := (entries + shards - 1) / shards; count > max {
+				t.Errorf("Shard %d/%d has %d entries; want at most %d", i, shards, count, max)
+			}
+			var found int64
+			if err := sh.Shard(ctx, &spb.ShardRequest{Index: i, Shards: shards}, func(e *spb.Entry) error {
+				if last != nil && compare.Entries(last, e) != compare.LT {
+					t.Errorf("Shard %d/%d: entry %v is not after %v", i, shards, e, last)
+				}
+				last = e
+				found++
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if found != count {
+				t.Errorf("Shard %d/%d has %d entries; Count reported %d", i, shards, found, count)
+			}
+			total += found
+		}
+		if total != entries {
+			t.Errorf("Found %d total entries across %d shards; want %d", total, shards, entries)
+		}
+	}
+
+	check(0, 3)
+	write(10)
+	check(20, 1)
+	check(20, 3)
+	check(20, 32)
+	write(1000)
+	check(2000, 7)
+}
@@ -0,0 +1,455 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package bigtable implements a graphstore.Service using a Cloud Bigtable
+// table.
+//
+// Each source node is a row of the table keyed by its encoded VName (see
+// compare.EncodeVName).  Each entry of the source is a cell of the row whose
+// column qualifier encodes the entry's edge kind, fact name, and target (so
+// that the row key followed by the qualifier is the entry's canonical key; see
+// compare.EncodeEntryKey) and whose value is the entry's fact value.  A Read
+// is then a single-row fetch and each Write is a single-row mutation, applied
+// atomically.  Scans read the whole table with server-side column filters for
+// their edge kinds, fact prefixes, and targets.  The store is Sharded by the
+// row ranges of the table's tablets.
+package bigtable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud"
+	"google.golang.org/cloud/bigtable"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func init() {
+	graphstore.Register("bigtable", func(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+		spec := graphstore.SpecLocation(u)
+		parts := strings.Split(spec, "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid bigtable spec %q; expected project/instance/table", spec)
+		}
+		return OpenGraphStore(ctx, parts[0], parts[1], parts[2], nil)
+	})
+}
+
+// family is the name of the table's single column family, which holds every
+// cell.
+const family = "e"
+
+// DefaultOptions is the default Options struct passed to OpenGraphStore when
+// not otherwise given one.
+var DefaultOptions = &Options{CreateTable: true}
+
+// Options for customizing a Bigtable backend.
+type Options struct {
+	// CreateTable creates the table and its column family if they do not
+	// exist.  The column family keeps only the latest version of each cell.
+	CreateTable bool
+
+	// ClientOptions are passed to the Bigtable clients (e.g. to use an
+	// emulator's connection with cloud.WithBaseGRPC).
+	ClientOptions []cloud.ClientOption
+}
+
+// OpenGraphStore returns a graphstore.Service backed by the given Bigtable
+// table.  If opts==nil, the DefaultOptions are used.  The returned Service is
+// Sharded by the row ranges of the table's tablets.
+func OpenGraphStore(ctx context.Context, project, instance, table string, opts *Options) (graphstore.Service, error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	if opts.CreateTable {
+		if err := createTable(ctx, project, instance, table, opts.ClientOptions); err != nil {
+			return nil, fmt.Errorf("error creating bigtable table %q: %v", table, err)
+		}
+	}
+	client, err := bigtable.NewClient(ctx, project, instance, opts.ClientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating bigtable client: %v", err)
+	}
+	return &store{client: client, tbl: client.Open(table)}, nil
+}
+
+// createTable creates the given table and its column family if they do not
+// exist.
+func createTable(ctx context.Context, project, instance, table string, opts []cloud.ClientOption) error {
+	admin, err := bigtable.NewAdminClient(ctx, project, instance, opts...)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+	tables, err := admin.Tables(ctx)
+	if err != nil {
+		return err
+	}
+	exists := false
+	for _, t := range tables {
+		if t == table {
+			exists = true
+			break
+		}
+	}
+	if !exists {
+		if err := admin.CreateTable(ctx, table); err != nil {
+			return err
+		}
+	}
+	info, err := admin.TableInfo(ctx, table)
+	if err != nil {
+		return err
+	}
+	for _, f := range info.Families {
+		if f == family {
+			return nil
+		}
+	}
+	if err := admin.CreateColumnFamily(ctx, table, family); err != nil {
+		return err
+	}
+	return admin.SetGCPolicy(ctx, table, family, bigtable.MaxVersionsPolicy(1))
+}
+
+type store struct {
+	client *bigtable.Client
+	tbl    *bigtable.Table
+
+	shardMu     sync.Mutex
+	generation  uint64 // incremented by each write, invalidating shardTables
+	shardTables map[int64]*shardTable
+}
+
+// latest is the filter for the latest version of each cell; older versions
+// may remain until the column family is garbage collected.
+var latest = bigtable.LatestNFilter(1)
+
+// emptyRow is the row key of the empty VName.
+var emptyRow = compare.EncodeVName(nil)
+
+// qualifier returns the column qualifier of the cell of e.
+func qualifier(e *spb.Entry) string {
+	return string(compare.EncodeEntryKey(e)[len(compare.EncodeVName(e.Source)):])
+}
+
+// kindPrefix returns the prefix of the qualifier of each cell with the given
+// edge kind.
+func kindPrefix(edgeKind string) string {
+	return string(compare.EncodeKeyPrefix(nil, edgeKind)[len(emptyRow):])
+}
+
+// escape returns s as it is escaped in the canonical encoding (see
+// compare.EncodeVName), without its terminator: the prefix of the encoding of
+// every string with the prefix s.
+func escape(s string) string { return strings.Replace(s, "\x00", "\x00\xff", -1) }
+
+// quote returns an RE2 pattern matching exactly the bytes of s.  Bigtable
+// matches patterns against raw bytes, so each byte other than a letter, digit,
+// or underscore is written as a hex escape.
+func quote(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, `\x%02x`, c)
+		}
+	}
+	return buf.String()
+}
+
+// anyString is an RE2 pattern matching an encoded string with its terminator.
+const anyString = `(?:[^\x00]|\x00\xff)*\x00\x01`
+
+// scanFilter returns the server-side filter for the cells of entries matching
+// req.  The filter may admit other cells, so entries must still be checked
+// with graphstore.EntryMatchesScan.
+func scanFilter(req *spb.ScanRequest) bigtable.Filter {
+	if req.EdgeKind == "" && req.FactPrefix == "" && req.Target == nil {
+		return latest
+	}
+	pattern := anyString
+	if req.EdgeKind != "" {
+		pattern = quote(kindPrefix(req.EdgeKind))
+	}
+	pattern += quote(escape(req.FactPrefix)) + `\C*`
+	if req.Target != nil {
+		pattern += quote(string(compare.EncodeVName(req.Target)))
+	}
+	return bigtable.ChainFilters(bigtable.ColumnFilter(pattern), latest)
+}
+
+// deliver calls f with each entry of row that satisfies match (or every entry
+// if match is nil).  It returns false if f returned an error (stored in *err)
+// or io.EOF.
+func deliver(row bigtable.Row, match func(*spb.Entry) bool, f graphstore.EntryFunc, err *error) bool {
+	prefix := family + ":"
+	for _, item := range row[family] {
+		e, derr := compare.DecodeEntryKey([]byte(item.Row + strings.TrimPrefix(item.Column, prefix)))
+		if derr != nil {
+			*err = fmt.Errorf("invalid entry in row %q: %v", item.Row, derr)
+			return false
+		} else if len(item.Value) > 0 {
+			e.FactValue = item.Value
+		}
+		if match != nil && !match(e) {
+			continue
+		} else if ferr := f(e); ferr == io.EOF {
+			return false
+		} else if ferr != nil {
+			*err = ferr
+			return false
+		}
+	}
+	return true
+}
+
+// readRows calls f with each entry of the rows of rs that satisfies match (or
+// every entry if match is nil), as filtered by filter.
+func (s *store) readRows(ctx context.Context, rs bigtable.RowSet, filter bigtable.Filter, match func(*spb.Entry) bool, f graphstore.EntryFunc) error {
+	var ferr error
+	if err := s.tbl.ReadRows(ctx, rs, func(row bigtable.Row) bool {
+		return deliver(row, match, f, &ferr)
+	}, bigtable.RowFilter(filter)); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// Read implements part of the graphstore.Service interface.  Each Read is a
+// single-row fetch.
+func (s *store) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	row := string(compare.EncodeVName(req.Source))
+	filter := latest
+	if req.EdgeKind != "*" {
+		filter = bigtable.ChainFilters(bigtable.ColumnFilter(quote(kindPrefix(req.EdgeKind))+`\C*`), latest)
+	}
+	return s.readRows(ctx, bigtable.RowList{row}, filter, nil, f)
+}
+
+// Scan implements part of the graphstore.Service interface.
+func (s *store) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return s.ScanFrom(ctx, req, nil, f)
+}
+
+// ScanFrom implements part of the graphstore.ResumableScanner interface.
+func (s *store) ScanFrom(ctx context.Context, req *spb.ScanRequest, after *spb.Entry, f graphstore.EntryFunc) error {
+	match := func(e *spb.Entry) bool { return graphstore.EntryMatchesScan(req, e) }
+	start := ""
+	if after != nil {
+		afterKey := compare.EncodeEntryKey(after)
+		start = string(compare.EncodeVName(after.Source))
+		match = func(e *spb.Entry) bool {
+			return bytes.Compare(compare.EncodeEntryKey(e), afterKey) > 0 && graphstore.EntryMatchesScan(req, e)
+		}
+	}
+	return s.readRows(ctx, bigtable.InfiniteRange(start), scanFilter(req), match, f)
+}
+
+// ScanPage implements part of the graphstore.PagedScanner interface.
+func (s *store) ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	after, err := graphstore.ParsePageToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	var page []*spb.Entry
+	if err := s.ScanFrom(ctx, req, after, func(e *spb.Entry) error {
+		page = append(page, e)
+		if len(page) > pageSize {
+			return io.EOF
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	return graphstore.Page(page, pageSize)
+}
+
+// ScansOrdered implements the graphstore.OrderedScanner interface.  Rows are
+// read in order of their keys and cells in order of their qualifiers, which is
+// the order of the entries' canonical keys.
+func (s *store) ScansOrdered() bool { return true }
+
+// Write implements part of the graphstore.Service interface.  Each request is
+// applied as a single-row mutation, so it is atomic.
+func (s *store) Write(ctx context.Context, req *spb.WriteRequest) error {
+	if len(req.Update) == 0 {
+		return nil
+	}
+	m := bigtable.NewMutation()
+	for _, u := range req.Update {
+		m.Set(family, qualifier(&spb.Entry{
+			EdgeKind: u.EdgeKind,
+			Target:   u.Target,
+			FactName: u.FactName,
+		}), bigtable.ServerTime, u.FactValue)
+	}
+	return s.apply(ctx, string(compare.EncodeVName(req.Source)), m)
+}
+
+// apply applies m to the given row and invalidates the store's shardTables.
+func (s *store) apply(ctx context.Context, row string, m *bigtable.Mutation) error {
+	defer func() {
+		s.shardMu.Lock()
+		s.generation++
+		s.shardMu.Unlock()
+	}()
+	return s.tbl.Apply(ctx, row, m)
+}
+
+// Delete implements part of the graphstore.Deleter interface.  The matching
+// cells are deleted by a single-row mutation.
+func (s *store) Delete(ctx context.Context, req *graphstore.DeleteRequest) error {
+	if req.Source == nil {
+		return errors.New("invalid DeleteRequest: missing Source")
+	}
+	kind := req.EdgeKind
+	if kind == "" {
+		kind = "*"
+	}
+	m := bigtable.NewMutation()
+	var deletes int
+	if err := s.Read(ctx, &spb.ReadRequest{Source: req.Source, EdgeKind: kind}, func(e *spb.Entry) error {
+		if graphstore.EntryMatchesDelete(req, e) {
+			m.DeleteCellsInColumn(family, qualifier(e))
+			deletes++
+		}
+		return nil
+	}); err != nil {
+		return err
+	} else if deletes == 0 {
+		return nil
+	}
+	return s.apply(ctx, string(compare.EncodeVName(req.Source)), m)
+}
+
+// Close implements part of the graphstore.Service interface.
+func (s *store) Close(ctx context.Context) error { return s.client.Close() }
+
+// A shardTable divides the rows of a store into contiguous ranges of the
+// table's tablets, as sampled at a given generation of the store.
+type shardTable struct {
+	generation uint64
+	starts     []string // the first row key of each shard; "" is the first row
+}
+
+// shardRange returns the range of rows of the given shard, or false if the
+// shard is empty.
+func (t *shardTable) shardRange(index int64) (bigtable.RowRange, bool) {
+	start := t.starts[index]
+	if index+1 == int64(len(t.starts)) {
+		return bigtable.InfiniteRange(start), true
+	} else if end := t.starts[index+1]; end != start {
+		return bigtable.NewRange(start, end), true
+	}
+	return bigtable.RowRange{}, false
+}
+
+// shards returns the current shardTable for the given number of shards,
+// sampling the table's row keys if the store has been written since it was
+// last used.  Each shard is a contiguous range of nearly equal numbers of
+// tablets; if there are fewer tablets than shards, some shards are empty.
+func (s *store) shards(ctx context.Context, num int64) (*shardTable, error) {
+	s.shardMu.Lock()
+	defer s.shardMu.Unlock()
+	if t, ok := s.shardTables[num]; ok && t.generation == s.generation {
+		return t, nil
+	}
+	samples, err := s.tbl.SampleRowKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The sampled keys divide the table into tablets; the last sample may be
+	// empty, denoting the end of the table.
+	var splits []string
+	for _, key := range samples {
+		if key != "" {
+			splits = append(splits, key)
+		}
+	}
+	tablets := int64(len(splits) + 1)
+	t := &shardTable{generation: s.generation, starts: make([]string, num)}
+	for i := int64(1); i < num; i++ {
+		if first := i * tablets / num; first > 0 {
+			t.starts[i] = splits[first-1]
+		}
+	}
+	if s.shardTables == nil {
+		s.shardTables = make(map[int64]*shardTable)
+	}
+	s.shardTables[num] = t
+	return t, nil
+}
+
+// Count implements part of the graphstore.Sharded interface.  Shards are
+// contiguous ranges of the table's tablets, sampled after each write, so
+// Counts and Shards agree only while the table is neither written nor split.
+// Each Count reads the keys of its shard's cells.
+func (s *store) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	if req.Shards < 1 {
+		return 0, fmt.Errorf("invalid number of shards: %d", req.Shards)
+	} else if req.Index < 0 || req.Index >= req.Shards {
+		return 0, fmt.Errorf("invalid index for %d shards: %d", req.Shards, req.Index)
+	}
+	t, err := s.shards(ctx, req.Shards)
+	if err != nil {
+		return 0, err
+	}
+	rs, ok := t.shardRange(req.Index)
+	if !ok {
+		return 0, nil
+	}
+	var count int64
+	if err := s.readRows(ctx, rs, bigtable.ChainFilters(latest, bigtable.StripValueFilter()), nil, func(*spb.Entry) error {
+		count++
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Shard implements part of the graphstore.Sharded interface.
+func (s *store) Shard(ctx context.Context, req *spb.ShardRequest, f graphstore.EntryFunc) error {
+	if req.Shards < 1 {
+		return fmt.Errorf("invalid number of shards: %d", req.Shards)
+	} else if req.Index < 0 || req.Index >= req.Shards {
+		return fmt.Errorf("invalid index for %d shards: %d", req.Shards, req.Index)
+	}
+	t, err := s.shards(ctx, req.Shards)
+	if err != nil {
+		return err
+	}
+	rs, ok := t.shardRange(req.Index)
+	if !ok {
+		return nil
+	}
+	return s.readRows(ctx, rs, latest, nil, f)
+}
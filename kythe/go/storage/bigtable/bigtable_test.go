@@ -0,0 +1,251 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bigtable
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	gspkg "kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/test/services/graphstore"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud"
+	"google.golang.org/cloud/bigtable/bttest"
+	"google.golang.org/grpc"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+const largeBatchSize = 64
+
+// tempGS returns a GraphStore backed by a table of a new in-memory Bigtable
+// emulator.
+func tempGS() (graphstore.Service, graphstore.DestroyFunc, error) {
+	srv, err := bttest.NewServer("127.0.0.1:0")
+	if err != nil {
+		return nil, graphstore.NullDestroy, fmt.Errorf("error starting bigtable emulator: %v", err)
+	}
+	destroy := func() error {
+		srv.Close()
+		return nil
+	}
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, destroy, fmt.Errorf("error connecting to bigtable emulator: %v", err)
+	}
+	gs, err := OpenGraphStore(context.Background(), "project", "instance", "entries", &Options{
+		CreateTable:   true,
+		ClientOptions: []cloud.ClientOption{cloud.WithBaseGRPC(conn)},
+	})
+	if err != nil {
+		return nil, destroy, fmt.Errorf("error opening GraphStore: %v", err)
+	}
+	return gs, destroy, nil
+}
+
+func BenchmarkWriteSingleEntry(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, 1)
+}
+func BenchmarkWriteBatchLrg(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, largeBatchSize)
+}
+
+func BenchmarkReadAllFacts(b *testing.B) {
+	graphstore.ReadFactsBenchmark(b, tempGS, nil)
+}
+
+func TestOrder(t *testing.T) {
+	graphstore.OrderTest(t, tempGS, largeBatchSize)
+}
+
+func TestDelete(t *testing.T) {
+	graphstore.DeleteTest(t, tempGS)
+}
+
+func TestGarbageCollection(t *testing.T) {
+	graphstore.GarbageCollectionTest(t, tempGS)
+}
+
+func TestPagedScan(t *testing.T) {
+	graphstore.PagedScanTest(t, tempGS)
+}
+
+func TestScanFrom(t *testing.T) {
+	graphstore.ScanFromTest(t, tempGS)
+}
+
+func TestReadFacts(t *testing.T) {
+	graphstore.ReadFactsTest(t, tempGS)
+}
+
+func TestBlobWrite(t *testing.T) {
+	graphstore.BlobWriteTest(t, tempGS)
+}
+
+// TestFilters checks that the server-side filters of Reads and Scans admit
+// each matching entry, including entries whose strings contain bytes
+// significant to the encoding or to RE2.
+func TestFilters(t *testing.T) {
+	gs, destroy, err := tempGS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroy()
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	names := []string{"a", "a\x00b", "a.b", "a*", "\xff\x00\x01", "(a|b)"}
+	var entries []*spb.Entry
+	for i, src := range names {
+		req := &spb.WriteRequest{Source: &spb.VName{Signature: src, Corpus: "c"}}
+		for j, name := range names {
+			req.Update = append(req.Update, &spb.WriteRequest_Update{
+				FactName:  "/" + name,
+				FactValue: []byte(fmt.Sprint(j)),
+			}, &spb.WriteRequest_Update{
+				EdgeKind: "/kind/" + name,
+				Target:   &spb.VName{Signature: names[(i+j)%len(names)], Path: name},
+				FactName: "/",
+			})
+		}
+		if err := gs.Write(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range req.Update {
+			entries = append(entries, &spb.Entry{
+				Source:    req.Source,
+				EdgeKind:  u.EdgeKind,
+				Target:    u.Target,
+				FactName:  u.FactName,
+				FactValue: u.FactValue,
+			})
+		}
+	}
+
+	check := func(desc string, want func(*spb.Entry) bool, read func(gspkg.EntryFunc) error) {
+		var got []*spb.Entry
+		if err := read(func(e *spb.Entry) error {
+			got = append(got, e)
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		var expected []*spb.Entry
+		for _, e := range entries {
+			if want(e) {
+				expected = append(expected, e)
+			}
+		}
+		sort.Sort(compare.ByEntries(expected))
+		if len(got) != len(expected) {
+			t.Errorf("%s: found %d entries; want %d", desc, len(got), len(expected))
+			return
+		}
+		for i, e := range got {
+			if !compare.EntriesEqual(e, expected[i]) {
+				t.Errorf("%s: entry %d is %v; want %v", desc, i, e, expected[i])
+			}
+		}
+	}
+
+	for _, name := range names {
+		src := &spb.VName{Signature: name, Corpus: "c"}
+		for _, kind := range []string{"", "*", "/kind/" + name, "/kind/a"} {
+			req := &spb.ReadRequest{Source: src, EdgeKind: kind}
+			check(fmt.Sprintf("Read(%v)", req), func(e *spb.Entry) bool {
+				return compare.VNamesEqual(e.Source, src) && (kind == "*" || e.EdgeKind == kind)
+			}, func(f gspkg.EntryFunc) error { return gs.Read(ctx, req, f) })
+		}
+
+		for _, req := range []*spb.ScanRequest{
+			{FactPrefix: "/" + name},
+			{EdgeKind: "/kind/" + name},
+			{EdgeKind: "/kind/" + name, FactPrefix: "/"},
+			{Target: &spb.VName{Signature: name, Path: "a"}},
+			{Target: &spb.VName{Signature: "a", Path: name}, EdgeKind: "/kind/" + name},
+		} {
+			req := req
+			check(fmt.Sprintf("Scan(%v)", req), func(e *spb.Entry) bool {
+				return gspkg.EntryMatchesScan(req, e)
+			}, func(f gspkg.EntryFunc) error { return gs.Scan(ctx, req, f) })
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+	gs, destroy, err := tempGS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroy()
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := gs.Write(ctx, &spb.WriteRequest{
+				Source: &spb.VName{Signature: fmt.Sprintf("sig%04d", i)},
+				Update: []*spb.WriteRequest_Update{
+					{FactName: "/kythe/node/kind", FactValue: []byte("test")},
+					{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))},
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(entries, shards int64) {
+		sh := gs.(gspkg.Sharded)
+		var total int64
+		var last *spb.Entry
+		for i := int64(0); i < shards; i++ {
+			count, err := sh.Count(ctx, &spb.CountRequest{Index: i, Shards: shards})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var found int64
+			if err := sh.Shard(ctx, &spb.ShardRequest{Index: i, Shards: shards}, func(e *spb.Entry) error {
+				if last != nil && compare.Entries(last, e) != compare.LT {
+					t.Errorf("Shard %d/%d: entry %v follows %v", i, shards, e, last)
+				}
+				last = e
+				found++
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if found != count {
+				t.Errorf("Shard %d/%d has %d entries; Count reported %d", i, shards, found, count)
+			}
+			total += found
+		}
+		if total != entries {
+			t.Errorf("Found %d total entries across %d shards; want %d", total, shards, entries)
+		}
+	}
+
+	check(0, 3)
+	write(10)
+	check(20, 1)
+	check(20, 3)
+	check(20, 32)
+	write(300)
+	check(600, 7)
+}
@@ -0,0 +1,627 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package bolt implements a graphstore.Service using a bbolt database, a
+// pure-Go embedded key-value store kept in a single file.
+//
+// Each entry is stored under its canonical key (see compare.EncodeEntryKey)
+// with its fact value, so Reads are range scans of a source's keys.  Entries
+// are read in a series of short read transactions, so EntryFuncs may write to
+// the store; a Snapshot provides a consistent view.
+package bolt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func init() {
+	graphstore.Register("bolt", func(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+		return OpenGraphStore(graphstore.SpecLocation(u), nil)
+	})
+}
+
+// DefaultOptions is the default Options struct passed to OpenGraphStore when
+// not otherwise given one.
+var DefaultOptions = &Options{Timeout: time.Second}
+
+// Options for customizing a bbolt backend.
+type Options struct {
+	// ReadOnly opens the database with a shared lock, so that it may be read by
+	// several processes at once.  Each write to the GraphStore fails with
+	// graphstore.ErrReadOnly.  The database must already exist.
+	ReadOnly bool
+
+	// InitialMmapSize is the initial size in bytes of the database's memory
+	// map.  Writes are blocked while the map is grown, so a size large enough
+	// for the expected database avoids stalls while it is built.  If zero, the
+	// map is sized to the database file.
+	InitialMmapSize int
+
+	// Timeout is the amount of time to wait to lock the database file, which is
+	// held exclusively by a writable GraphStore.  If zero, OpenGraphStore waits
+	// indefinitely.
+	Timeout time.Duration
+}
+
+// entriesBucket is the bbolt bucket holding the GraphStore's entries.
+var entriesBucket = []byte("entries")
+
+// readBatchSize is the maximum number of keys visited by each read
+// transaction of a Read or Scan.
+const readBatchSize = 1024
+
+// OpenGraphStore returns a graphstore.Service backed by a bbolt database at the
+// given file path, which is created if it does not exist (unless
+// opts.ReadOnly).  If opts==nil, the DefaultOptions are used.  The returned
+// Service is Sharded by contiguous key ranges.
+func OpenGraphStore(path string, opts *Options) (graphstore.Service, error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{
+		ReadOnly:        opts.ReadOnly,
+		InitialMmapSize: opts.InitialMmapSize,
+		Timeout:         opts.Timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not open bolt database at %q: %v", path, err)
+	}
+	if !opts.ReadOnly {
+		if err := db.Update(func(tx *bbolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(entriesBucket)
+			return err
+		}); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error initializing bolt database: %v", err)
+		}
+	}
+	return &store{db: db, readOnly: opts.ReadOnly}, nil
+}
+
+type store struct {
+	db       *bbolt.DB
+	readOnly bool
+
+	// snap is the read transaction of a snapshot, guarded by snapMu, which is
+	// nil once the snapshot is closed.
+	isSnap bool
+	snap   *bbolt.Tx
+	snapMu sync.Mutex
+
+	shardMu     sync.Mutex
+	generation  uint64 // incremented by each write, invalidating shardTables
+	shardTables map[int64]*shardTable
+}
+
+// view calls f with the entries bucket (nil if it does not exist) in a read
+// transaction.
+func (s *store) view(f func(*bbolt.Bucket) error) error {
+	if s.isSnap {
+		s.snapMu.Lock()
+		defer s.snapMu.Unlock()
+		if s.snap == nil {
+			return errors.New("snapshot is closed")
+		}
+		return f(s.snap.Bucket(entriesBucket))
+	}
+	return s.db.View(func(tx *bbolt.Tx) error { return f(tx.Bucket(entriesBucket)) })
+}
+
+// update calls f with the entries bucket, creating it if necessary, in a
+// read-write transaction, which is committed unless f returns an error.
+func (s *store) update(ctx context.Context, f func(*bbolt.Bucket) error) error {
+	if s.readOnly {
+		return graphstore.ErrReadOnly
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return err
+		}
+		return f(b)
+	}); err != nil {
+		return err
+	}
+	s.shardMu.Lock()
+	s.generation++
+	s.shardMu.Unlock()
+	return nil
+}
+
+// scan calls f with each entry whose key is at least start and satisfies
+// inRange, in key order, if it satisfies match (or if match is nil).  The keys
+// are visited in read transactions of readBatchSize keys, and f is called
+// between them.
+func (s *store) scan(ctx context.Context, start []byte, inRange func(key []byte) bool, match func(*spb.Entry) bool, f graphstore.EntryFunc) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var (
+			batch []*spb.Entry
+			done  bool
+		)
+		if err := s.view(func(b *bbolt.Bucket) error {
+			if b == nil {
+				done = true
+				return nil
+			}
+			c := b.Cursor()
+			k, v := c.Seek(start)
+			for n := 0; ; n++ {
+				if k == nil || !inRange(k) {
+					done = true
+					return nil
+				} else if n == readBatchSize {
+					start = append([]byte(nil), k...)
+					return nil
+				}
+				e, err := decodeEntry(k, v)
+				if err != nil {
+					return err
+				} else if match == nil || match(e) {
+					batch = append(batch, e)
+				}
+				k, v = c.Next()
+			}
+		}); err != nil {
+			return err
+		}
+		if stop, err := deliver(batch, f); stop || err != nil {
+			return err
+		} else if done {
+			return nil
+		}
+	}
+}
+
+// reverseScan calls f with each entry satisfying match (or every entry if match
+// is nil) in descending key order, in read transactions of readBatchSize keys.
+func (s *store) reverseScan(ctx context.Context, match func(*spb.Entry) bool, f graphstore.EntryFunc) error {
+	var end []byte // the greatest key remaining to be visited; nil for the last
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var (
+			batch []*spb.Entry
+			done  bool
+		)
+		if err := s.view(func(b *bbolt.Bucket) error {
+			if b == nil {
+				done = true
+				return nil
+			}
+			c := b.Cursor()
+			var k, v []byte
+			if end == nil {
+				k, v = c.Last()
+			} else if k, v = c.Seek(end); k == nil {
+				k, v = c.Last()
+			} else if !bytes.Equal(k, end) {
+				k, v = c.Prev()
+			}
+			for n := 0; ; n++ {
+				if k == nil {
+					done = true
+					return nil
+				} else if n == readBatchSize {
+					end = append([]byte(nil), k...)
+					return nil
+				}
+				e, err := decodeEntry(k, v)
+				if err != nil {
+					return err
+				} else if match == nil || match(e) {
+					batch = append(batch, e)
+				}
+				k, v = c.Prev()
+			}
+		}); err != nil {
+			return err
+		}
+		if stop, err := deliver(batch, f); stop || err != nil {
+			return err
+		} else if done {
+			return nil
+		}
+	}
+}
+
+// deliver calls f with each of the given entries, reporting whether f stopped
+// the delivery by returning io.EOF or another error.
+func deliver(entries []*spb.Entry, f graphstore.EntryFunc) (bool, error) {
+	for _, e := range entries {
+		if err := f(e); err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// decodeEntry returns the entry stored with the given key and value.
+func decodeEntry(key, val []byte) (*spb.Entry, error) {
+	e, err := compare.DecodeEntryKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid entry key %q: %v", key, err)
+	} else if len(val) > 0 {
+		e.FactValue = append([]byte(nil), val...)
+	}
+	return e, nil
+}
+
+func allKeys([]byte) bool { return true }
+
+func hasPrefix(prefix []byte) func([]byte) bool {
+	return func(key []byte) bool { return bytes.HasPrefix(key, prefix) }
+}
+
+// Read implements part of the graphstore.Service interface.
+func (s *store) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	prefix := compare.EncodeKeyPrefix(req.Source, req.EdgeKind)
+	return s.scan(ctx, prefix, hasPrefix(prefix), nil, f)
+}
+
+// ReadMultiple implements the graphstore.MultiReader interface.  The requests
+// are satisfied in order.
+func (s *store) ReadMultiple(ctx context.Context, reqs []*spb.ReadRequest, f graphstore.EntryFunc) error {
+	var errs graphstore.MultiError
+	for _, req := range reqs {
+		if err := s.Read(ctx, req, f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Scan implements part of the graphstore.Service interface.
+func (s *store) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return s.ScanOpts(ctx, req, nil, f)
+}
+
+// ScanOpts implements part of the graphstore.OptionsScanner interface.
+func (s *store) ScanOpts(ctx context.Context, req *spb.ScanRequest, opts *graphstore.ScanOptions, f graphstore.EntryFunc) error {
+	return s.scan(ctx, nil, allKeys, func(e *spb.Entry) bool {
+		return graphstore.EntryMatchesScanOpts(req, opts, e)
+	}, f)
+}
+
+// ReverseScan implements part of the graphstore.ReverseScanner interface.
+func (s *store) ReverseScan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return s.reverseScan(ctx, func(e *spb.Entry) bool {
+		return graphstore.EntryMatchesScan(req, e)
+	}, f)
+}
+
+// ScanFrom implements part of the graphstore.ResumableScanner interface.
+func (s *store) ScanFrom(ctx context.Context, req *spb.ScanRequest, after *spb.Entry, f graphstore.EntryFunc) error {
+	var start []byte
+	if after != nil {
+		// The least key greater than after's is after's key with a zero byte
+		// appended.
+		start = append(compare.EncodeEntryKey(after), 0)
+	}
+	return s.scan(ctx, start, allKeys, func(e *spb.Entry) bool {
+		return graphstore.EntryMatchesScan(req, e)
+	}, f)
+}
+
+// ScanPage implements part of the graphstore.PagedScanner interface.
+func (s *store) ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	after, err := graphstore.ParsePageToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	var page []*spb.Entry
+	if err := s.ScanFrom(ctx, req, after, func(e *spb.Entry) error {
+		page = append(page, e)
+		if len(page) > pageSize {
+			return io.EOF
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	return graphstore.Page(page, pageSize)
+}
+
+// ScansOrdered implements the graphstore.OrderedScanner interface.
+func (s *store) ScansOrdered() bool { return true }
+
+// Write implements part of the graphstore.Service interface.  Each request is
+// applied in a single transaction.
+func (s *store) Write(ctx context.Context, req *spb.WriteRequest) error {
+	_, err := s.write(ctx, []*spb.WriteRequest{req}, nil)
+	return err
+}
+
+// WriteBatch implements part of the graphstore.Transactional interface.  All of
+// the requests are applied in a single transaction.
+func (s *store) WriteBatch(ctx context.Context, reqs []*spb.WriteRequest) error {
+	_, err := s.write(ctx, reqs, nil)
+	return err
+}
+
+// WriteWithStats implements part of the graphstore.StatsWriter interface.
+func (s *store) WriteWithStats(ctx context.Context, req *spb.WriteRequest) (*graphstore.WriteStats, error) {
+	return s.WriteOpts(ctx, req, nil)
+}
+
+// WriteOpts implements part of the graphstore.OptionsWriter interface.
+func (s *store) WriteOpts(ctx context.Context, req *spb.WriteRequest, opts *graphstore.WriteOptions) (*graphstore.WriteStats, error) {
+	return s.write(ctx, []*spb.WriteRequest{req}, opts)
+}
+
+// write applies each of reqs to the store in a single transaction.
+func (s *store) write(ctx context.Context, reqs []*spb.WriteRequest, opts *graphstore.WriteOptions) (*graphstore.WriteStats, error) {
+	ifAbsent := opts != nil && opts.IfAbsent
+	var stats *graphstore.WriteStats
+	if err := s.update(ctx, func(b *bbolt.Bucket) error {
+		stats = new(graphstore.WriteStats)
+		for _, req := range reqs {
+			for _, u := range req.Update {
+				key := compare.EncodeEntryKey(&spb.Entry{
+					Source:   req.Source,
+					EdgeKind: u.EdgeKind,
+					Target:   u.Target,
+					FactName: u.FactName,
+				})
+				if old := b.Get(key); old == nil {
+					stats.Inserted++
+				} else if ifAbsent {
+					stats.Skipped++
+					continue
+				} else if bytes.Equal(old, u.FactValue) {
+					stats.Unchanged++
+					continue
+				} else {
+					stats.Updated++
+				}
+				if err := b.Put(key, u.FactValue); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// CompareAndSwap implements part of the graphstore.CAS interface.  The
+// comparison and write are made in a single transaction.
+func (s *store) CompareAndSwap(ctx context.Context, source *spb.VName, factName string, oldValue, newValue []byte) (bool, error) {
+	if factName == "" {
+		return false, errors.New("missing fact name")
+	}
+	key := compare.EncodeEntryKey(&spb.Entry{Source: source, FactName: factName})
+	var swapped bool
+	err := s.update(ctx, func(b *bbolt.Bucket) error {
+		cur := b.Get(key)
+		if oldValue == nil && cur != nil || oldValue != nil && (cur == nil || !bytes.Equal(cur, oldValue)) {
+			return nil
+		}
+		swapped = true
+		return b.Put(key, newValue)
+	})
+	return swapped, err
+}
+
+// Delete implements part of the graphstore.Deleter interface.
+func (s *store) Delete(ctx context.Context, req *graphstore.DeleteRequest) error {
+	if req.Source == nil {
+		return errors.New("invalid DeleteRequest: missing Source")
+	}
+	kind := req.EdgeKind
+	if kind == "" {
+		kind = "*"
+	}
+	prefix := compare.EncodeKeyPrefix(req.Source, kind)
+	return s.update(ctx, func(b *bbolt.Bucket) error {
+		var keys [][]byte
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			e, err := decodeEntry(k, v)
+			if err != nil {
+				return err
+			} else if graphstore.EntryMatchesDelete(req, e) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Snapshot implements the graphstore.Snapshotter interface.  The snapshot holds
+// a bbolt read transaction, which prevents the database from reusing the pages
+// it views, so it should be closed promptly; the snapshot must be closed
+// before its parent store.
+func (s *store) Snapshot() (graphstore.Service, error) {
+	if s.isSnap {
+		return nil, errors.New("cannot snapshot a snapshot")
+	}
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &store{db: s.db, readOnly: true, isSnap: true, snap: tx}, nil
+}
+
+// DiskSize implements the graphstore.DiskSizer interface using the size of the
+// database file, which includes its free pages.
+func (s *store) DiskSize(ctx context.Context) (int64, error) {
+	if s.isSnap {
+		s.snapMu.Lock()
+		defer s.snapMu.Unlock()
+		if s.snap == nil {
+			return 0, errors.New("snapshot is closed")
+		}
+		return s.snap.Size(), nil
+	}
+	var size int64
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return size, err
+}
+
+// Close implements part of the graphstore.Service interface.  Closing a
+// snapshot releases its read transaction.
+func (s *store) Close(ctx context.Context) error {
+	if s.isSnap {
+		s.snapMu.Lock()
+		defer s.snapMu.Unlock()
+		if s.snap == nil {
+			return nil
+		}
+		err := s.snap.Rollback()
+		s.snap = nil
+		return err
+	}
+	return s.db.Close()
+}
+
+// A shardTable divides the keys of a store into contiguous ranges with nearly
+// equal numbers of entries, as of a given generation of the store.
+type shardTable struct {
+	generation uint64
+	starts     [][]byte // the first key of each non-empty shard
+	counts     []int64
+}
+
+// shardRange returns the range of keys of the given shard: keys at least start
+// and, if end is non-nil, less than end.
+func (t *shardTable) shardRange(index int64) (start, end []byte) {
+	start = t.starts[index]
+	for i := index + 1; i < int64(len(t.starts)); i++ {
+		if t.counts[i] > 0 {
+			return start, t.starts[i]
+		}
+	}
+	return start, nil
+}
+
+// shards returns the current shardTable for the given number of shards,
+// computing it if the store has been written since it was last used.
+func (s *store) shards(num int64) (*shardTable, error) {
+	s.shardMu.Lock()
+	defer s.shardMu.Unlock()
+	if t, ok := s.shardTables[num]; ok && t.generation == s.generation {
+		return t, nil
+	}
+	t := &shardTable{
+		generation: s.generation,
+		starts:     make([][]byte, num),
+		counts:     make([]int64, num),
+	}
+	if err := s.view(func(b *bbolt.Bucket) error {
+		if b == nil {
+			return nil
+		}
+		total := int64(b.Stats().KeyN)
+		if total == 0 {
+			return nil
+		}
+		c := b.Cursor()
+		var i, shard int64
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			// Key i belongs to the shard containing index i of an even division
+			// of total keys into num shards.
+			for (shard+1)*total <= i*num {
+				shard++
+			}
+			if t.counts[shard] == 0 {
+				t.starts[shard] = append([]byte(nil), k...)
+			}
+			t.counts[shard]++
+			i++
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if s.shardTables == nil {
+		s.shardTables = make(map[int64]*shardTable)
+	}
+	s.shardTables[num] = t
+	return t, nil
+}
+
+// Count implements part of the graphstore.Sharded interface.  Shards are
+// contiguous ranges of keys, computed by a scan of the store's keys after each
+// write, so Counts and Shards agree only while the store is not written.
+func (s *store) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	if req.Shards < 1 {
+		return 0, fmt.Errorf("invalid number of shards: %d", req.Shards)
+	} else if req.Index < 0 || req.Index >= req.Shards {
+		return 0, fmt.Errorf("invalid index for %d shards: %d", req.Shards, req.Index)
+	}
+	t, err := s.shards(req.Shards)
+	if err != nil {
+		return 0, err
+	}
+	return t.counts[req.Index], nil
+}
+
+// Shard implements part of the graphstore.Sharded interface.
+func (s *store) Shard(ctx context.Context, req *spb.ShardRequest, f graphstore.EntryFunc) error {
+	if req.Shards < 1 {
+		return fmt.Errorf("invalid number of shards: %d", req.Shards)
+	} else if req.Index < 0 || req.Index >= req.Shards {
+		return fmt.Errorf("invalid index for %d shards: %d", req.Shards, req.Index)
+	}
+	t, err := s.shards(req.Shards)
+	if err != nil {
+		return err
+	} else if t.counts[req.Index] == 0 {
+		return nil
+	}
+	start, end := t.shardRange(req.Index)
+	return s.scan(ctx, start, func(key []byte) bool {
+		return end == nil || bytes.Compare(key, end) < 0
+	}, nil, f)
+}
@@ -0,0 +1,370 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bolt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gspkg "kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/storage/leveldb"
+	"kythe.io/kythe/go/test/services/graphstore"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+const (
+	smallBatchSize  = 4
+	mediumBatchSize = 16
+	largeBatchSize  = 64
+)
+
+func tempGS() (graphstore.Service, graphstore.DestroyFunc, error) {
+	dir, err := ioutil.TempDir("", "bolt.test")
+	if err != nil {
+		return nil, graphstore.NullDestroy, err
+	}
+	destroy := func() error { return os.RemoveAll(dir) }
+	gs, err := OpenGraphStore(filepath.Join(dir, "gs.db"), nil)
+	if err != nil {
+		return nil, destroy, fmt.Errorf("error creating temporary DB: %v", err)
+	}
+	return gs, destroy, nil
+}
+
+func tempLevelDB() (graphstore.Service, graphstore.DestroyFunc, error) {
+	dir, err := ioutil.TempDir("", "levelDB.test")
+	if err != nil {
+		return nil, graphstore.NullDestroy, err
+	}
+	destroy := func() error { return os.RemoveAll(dir) }
+	gs, err := leveldb.OpenGraphStore(dir, nil)
+	if err != nil {
+		return nil, destroy, fmt.Errorf("error creating temporary DB: %v", err)
+	}
+	return gs, destroy, nil
+}
+
+// Each GS benchmark has a LevelDB counterpart on the same workload, for
+// comparison of the two stores.
+
+func BenchmarkGSWriteSingleEntry(b *testing.B) { graphstore.BatchWriteBenchmark(b, tempGS, 1) }
+func BenchmarkLevelDBWriteSingleEntry(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempLevelDB, 1)
+}
+
+func BenchmarkGSWriteBatchSml(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, smallBatchSize)
+}
+func BenchmarkLevelDBWriteBatchSml(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempLevelDB, smallBatchSize)
+}
+
+func BenchmarkGSWriteBatchLrg(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, largeBatchSize)
+}
+func BenchmarkLevelDBWriteBatchLrg(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempLevelDB, largeBatchSize)
+}
+
+func BenchmarkGSReadAllFacts(b *testing.B) { graphstore.ReadFactsBenchmark(b, tempGS, nil) }
+func BenchmarkLevelDBReadAllFacts(b *testing.B) {
+	graphstore.ReadFactsBenchmark(b, tempLevelDB, nil)
+}
+
+func BenchmarkGSReadFactsNodeKind(b *testing.B) {
+	graphstore.ReadFactsBenchmark(b, tempGS, []string{"/kythe/node/kind"})
+}
+func BenchmarkLevelDBReadFactsNodeKind(b *testing.B) {
+	graphstore.ReadFactsBenchmark(b, tempLevelDB, []string{"/kythe/node/kind"})
+}
+
+func BenchmarkGSSequentialScan(b *testing.B) { graphstore.ShardedScanBenchmark(b, tempGS, 0) }
+func BenchmarkLevelDBSequentialScan(b *testing.B) {
+	graphstore.ShardedScanBenchmark(b, tempLevelDB, 0)
+}
+
+func BenchmarkGSParallelShards4(b *testing.B) { graphstore.ShardedScanBenchmark(b, tempGS, 4) }
+func BenchmarkLevelDBParallelShards4(b *testing.B) {
+	graphstore.ShardedScanBenchmark(b, tempLevelDB, 4)
+}
+
+func BenchmarkGSZipfRead(b *testing.B) { graphstore.ZipfReadBenchmark(b, tempGS, nil) }
+func BenchmarkLevelDBZipfRead(b *testing.B) {
+	graphstore.ZipfReadBenchmark(b, tempLevelDB, nil)
+}
+
+func TestOrder(t *testing.T) {
+	graphstore.OrderTest(t, tempGS, largeBatchSize)
+}
+
+func TestDelete(t *testing.T) {
+	graphstore.DeleteTest(t, tempGS)
+}
+
+func TestCAS(t *testing.T) {
+	graphstore.CASTest(t, tempGS)
+}
+
+func TestGarbageCollection(t *testing.T) {
+	graphstore.GarbageCollectionTest(t, tempGS)
+}
+
+func TestReadMultiple(t *testing.T) {
+	graphstore.ReadMultipleTest(t, tempGS)
+}
+
+func TestPagedScan(t *testing.T) {
+	graphstore.PagedScanTest(t, tempGS)
+}
+
+func TestScanFrom(t *testing.T) {
+	graphstore.ScanFromTest(t, tempGS)
+}
+
+func TestReverseOrder(t *testing.T) {
+	graphstore.ReverseOrderTest(t, tempGS, mediumBatchSize)
+}
+
+func TestWriteStats(t *testing.T) {
+	graphstore.WriteStatsTest(t, tempGS)
+}
+
+func TestWriteIfAbsent(t *testing.T) {
+	graphstore.WriteIfAbsentTest(t, tempGS)
+}
+
+func TestWriteIfAbsentRace(t *testing.T) {
+	graphstore.WriteIfAbsentRaceTest(t, tempGS)
+}
+
+func TestSnapshot(t *testing.T) {
+	graphstore.SnapshotTest(t, tempGS)
+}
+
+func TestTransaction(t *testing.T) {
+	graphstore.TransactionTest(t, tempGS)
+}
+
+func TestScanOptions(t *testing.T) {
+	graphstore.ScanOptionsTest(t, tempGS)
+}
+
+func TestReadFacts(t *testing.T) {
+	graphstore.ReadFactsTest(t, tempGS)
+}
+
+func TestBlobWrite(t *testing.T) {
+	graphstore.BlobWriteTest(t, tempGS)
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt.readonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gs.db")
+
+	ctx := context.Background()
+	if _, err := OpenGraphStore(path, &Options{ReadOnly: true}); err == nil {
+		t.Error("Opening a missing database read-only succeeded; expected an error")
+	}
+
+	gs, err := OpenGraphStore(path, &Options{InitialMmapSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &spb.WriteRequest{
+		Source: &spb.VName{Signature: "x"},
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("test")}},
+	}
+	if err := gs.Write(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	gs, err = OpenGraphStore(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+	if err := gs.Write(ctx, req); err != gspkg.ErrReadOnly {
+		t.Errorf("Write to a read-only store: got error %v; want %v", err, gspkg.ErrReadOnly)
+	}
+	var found int
+	if err := gs.Read(ctx, &spb.ReadRequest{Source: req.Source}, func(e *spb.Entry) error {
+		found++
+		if string(e.FactValue) != "test" {
+			t.Errorf("Read unexpected entry: %v", e)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if found != 1 {
+		t.Errorf("Read %d entries; want 1", found)
+	}
+}
+
+func TestEmptyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt.empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gs.db")
+
+	// A database without the entries bucket, as not written by OpenGraphStore.
+	db, err := bbolt.Open(path, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	check := func(name string, gs gspkg.Service) {
+		if err := gs.Scan(ctx, &spb.ScanRequest{}, func(e *spb.Entry) error {
+			t.Errorf("%s: Scan found unexpected entry: %v", name, e)
+			return nil
+		}); err != nil {
+			t.Errorf("%s: Scan error: %v", name, err)
+		}
+		if _, err := gs.(gspkg.DiskSizer).DiskSize(ctx); err != nil {
+			t.Errorf("%s: DiskSize error: %v", name, err)
+		}
+		sh := gs.(gspkg.Sharded)
+		for i := int64(0); i < 3; i++ {
+			if count, err := sh.Count(ctx, &spb.CountRequest{Index: i, Shards: 3}); err != nil {
+				t.Errorf("%s: Count error: %v", name, err)
+			} else if count != 0 {
+				t.Errorf("%s: Shard %d/3 has %d entries; want 0", name, i, count)
+			}
+			if err := sh.Shard(ctx, &spb.ShardRequest{Index: i, Shards: 3}, func(e *spb.Entry) error {
+				t.Errorf("%s: Shard %d/3 found unexpected entry: %v", name, i, e)
+				return nil
+			}); err != nil {
+				t.Errorf("%s: Shard error: %v", name, err)
+			}
+		}
+	}
+
+	gs, err := OpenGraphStore(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("read-only", gs)
+	snap, err := gs.(gspkg.Snapshotter).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("snapshot", snap)
+	if err := snap.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snap.(gspkg.DiskSizer).DiskSize(ctx); err == nil {
+		t.Error("DiskSize of a closed snapshot succeeded; expected an error")
+	}
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	gs, err = OpenGraphStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+	check("fresh", gs)
+}
+
+func TestShards(t *testing.T) {
+	gs, destroy, err := tempGS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroy()
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	write := func(n int) {
+		var reqs []*spb.WriteRequest
+		for i := 0; i < n; i++ {
+			reqs = append(reqs, &spb.WriteRequest{
+				Source: &spb.VName{Signature: fmt.Sprintf("sig%04d", i)},
+				Update: []*spb.WriteRequest_Update{
+					{FactName: "/kythe/node/kind", FactValue: []byte("test")},
+					{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))},
+				},
+			})
+		}
+		if err := gs.(gspkg.Transactional).WriteBatch(ctx, reqs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(entries, shards int64) {
+		sh := gs.(gspkg.Sharded)
+		var (
+			total int64
+			last  *spb.Entry
+		)
+		for i := int64(0); i < shards; i++ {
+			count, err := sh.Count(ctx, &spb.CountRequest{Index: i, Shards: shards})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if max := (entries + shards - 1) / shards; count > max {
+				t.Errorf("Shard %d/%d has %d entries; want at most %d", i, shards, count, max)
+			}
+			var found int64
+			if err := sh.Shard(ctx, &spb.ShardRequest{Index: i, Shards: shards}, func(e *spb.Entry) error {
+				if last != nil && compare.Entries(last, e) != compare.LT {
+					t.Errorf("Shard %d/%d: entry %v is not after %v", i, shards, e, last)
+				}
+				last = e
+				found++
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if found != count {
+				t.Errorf("Shard %d/%d has %d entries; Count reported %d", i, shards, found, count)
+			}
+			total += found
+		}
+		if total != entries {
+			t.Errorf("Found %d total entries across %d shards; want %d", total, shards, entries)
+		}
+	}
+
+	check(0, 3)
+	write(10)
+	check(20, 1)
+	check(20, 3)
+	check(20, 32)
+	write(3000)
+	check(6000, 7)
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package gsflag defines the --graphstore flag shared by the storage tools and
+// servers.  Importing gsflag links in every GraphStore backend, each of which
+// registers its spec scheme with graphstore.Register, so that each tool accepts
+// the same specs.
+package gsflag
+
+import (
+	"errors"
+	"flag"
+	"strings"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/storage/gsutil"
+
+	"golang.org/x/net/context"
+
+	_ "kythe.io/kythe/go/services/graphstore/grpc"
+	_ "kythe.io/kythe/go/services/graphstore/http"
+	_ "kythe.io/kythe/go/services/graphstore/proxy"
+	_ "kythe.io/kythe/go/storage/badger"
+	_ "kythe.io/kythe/go/storage/bigtable"
+	_ "kythe.io/kythe/go/storage/bolt"
+	_ "kythe.io/kythe/go/storage/leveldb"
+	_ "kythe.io/kythe/go/storage/postgres"
+	_ "kythe.io/kythe/go/storage/redis"
+	_ "kythe.io/kythe/go/storage/servingtable"
+	_ "kythe.io/kythe/go/storage/shardedlevel"
+	_ "kythe.io/kythe/go/storage/sortedfiles"
+	_ "kythe.io/kythe/go/storage/sqlite"
+)
+
+// ErrMissing is returned by Open when --graphstore is not given.
+var ErrMissing = errors.New("missing --graphstore")
+
+// The flag's usage lists the schemes registered by the backends above, which
+// are initialized before this package.
+var spec = flag.String("graphstore", "", "GraphStore spec: a URL whose scheme is one of "+
+	strings.Join(graphstore.Schemes(), ", ")+" (e.g. leveldb:///data/gs, grpc://host:port, grpcs://host:port?ca=ca.pem, http://host:port/graphstore, or proxy:spec1,spec2), or a LevelDB path")
+
+// Spec returns the value of the --graphstore flag.
+func Spec() string { return *spec }
+
+// Open returns the GraphStore named by the --graphstore flag (see gsutil.Open),
+// or ErrMissing if the flag is not given.  Open should be called once the
+// flags are parsed, after any flags affecting the backends (such as LevelDB's
+// default options) are applied.
+func Open(ctx context.Context) (graphstore.Service, error) {
+	if *spec == "" {
+		return nil, ErrMissing
+	}
+	return gsutil.Open(ctx, *spec)
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gsflag
+
+import (
+	"flag"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	if _, err := Open(ctx); err != ErrMissing {
+		t.Fatalf("Open without --graphstore: got error %v; want %v", err, ErrMissing)
+	}
+
+	for _, spec := range []string{"in-memory", "in-memory:", "proxy:in-memory:,in-memory"} {
+		if err := flag.Set("graphstore", spec); err != nil {
+			t.Fatal(err)
+		}
+		gs, err := Open(ctx)
+		if err != nil {
+			t.Errorf("Open(%q) error: %v", spec, err)
+			continue
+		}
+		if err := gs.Close(ctx); err != nil {
+			t.Errorf("Close(%q) error: %v", spec, err)
+		}
+	}
+
+	if err := flag.Set("graphstore", "nope:///data"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Open(ctx)
+	if err == nil {
+		t.Fatal("Open of an unknown scheme succeeded; expected an error")
+	}
+	for _, scheme := range []string{"grpc", "leveldb", "proxy", "sqlite"} {
+		if !strings.Contains(err.Error(), scheme) {
+			t.Errorf("Open error %q does not list scheme %q", err, scheme)
+		}
+		if usage := flag.Lookup("graphstore").Usage; !strings.Contains(usage, scheme) {
+			t.Errorf("--graphstore usage %q does not list scheme %q", usage, scheme)
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -32,34 +33,15 @@ import (
 	"golang.org/x/net/context"
 )
 
-// Handler returns a graphstore.Service based on the given specification.
-// See also: Register(string, Handler).
-type Handler func(spec string) (graphstore.Service, error)
+var defaultKind string
 
-var (
-	handlers = map[string]Handler{
-		"in-memory": func(_ string) (graphstore.Service, error) { return inmemory.Create(), nil },
-	}
-	defaultHandlerKind string
-)
-
-// Register exposes the given Handler to ParseGraphStore.  Each string starting
-// with kind+":" will be passed to the given Handler.  A kind can only be
-// registered once.
-func Register(kind string, h Handler) {
-	if _, exists := handlers[kind]; exists {
-		log.Fatalf("gsutil Handler for kind %q already exists", kind)
-	}
-	handlers[kind] = h
-}
-
-// RegisterDefault gives ParseGraphStore a fallback kind if not given any
-// "____:" prefix.  A default can only be set once.
+// RegisterDefault gives Open a fallback scheme (registered with
+// graphstore.Register) for specs without one.  A default can only be set once.
 func RegisterDefault(kind string) {
-	if defaultHandlerKind != "" {
-		log.Fatalf("default gsutil Handler kind already registered as %q", defaultHandlerKind)
+	if defaultKind != "" {
+		log.Fatalf("default GraphStore kind already registered as %q", defaultKind)
 	}
-	defaultHandlerKind = kind
+	defaultKind = kind
 }
 
 type gsFlag struct {
@@ -84,31 +66,25 @@ func Flag(gs *graphstore.Service, name, usage string) {
 	flag.Var(&f, name, usage)
 }
 
-// ParseGraphStore returns a GraphStore for the given specification.
+// ParseGraphStore returns a GraphStore for the given specification, as by
+// Open.
 func ParseGraphStore(str string) (graphstore.Service, error) {
-	str = strings.TrimSpace(str)
-	split := strings.SplitN(str, ":", 2)
-	var kind, spec string
-	if len(split) == 2 {
-		spec = split[1]
-		kind = split[0]
-	} else {
-		spec = str
-		switch {
-		case spec == "" || spec == "in-memory":
-			kind = "in-memory"
-		case defaultHandlerKind != "":
-			kind = defaultHandlerKind
-		default:
-			return nil, fmt.Errorf("unknown GraphStore: %q", str)
-		}
-	}
+	return Open(context.Background(), str)
+}
 
-	h, ok := handlers[kind]
-	if !ok {
-		return nil, fmt.Errorf("no gsutil Handler registered for kind %q", kind)
+// Open returns the GraphStore named by the given spec, as by graphstore.Open.
+// A spec without a scheme names an in-memory store if it is empty or
+// "in-memory", and otherwise a store of the default kind (see RegisterDefault)
+// at the given location, so that "/data/gs" is the same as "leveldb:/data/gs"
+// when the leveldb backend is linked in.
+func Open(ctx context.Context, spec string) (graphstore.Service, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || spec == "in-memory" {
+		return inmemory.Create(), nil
+	} else if u, err := url.Parse(spec); err == nil && u.Scheme == "" && defaultKind != "" {
+		spec = defaultKind + ":" + spec
 	}
-	return h(spec)
+	return graphstore.Open(ctx, spec)
 }
 
 // EnsureGracefulExit will try to close each gs when notified of an Interrupt,
@@ -131,6 +107,23 @@ func EnsureGracefulExit(gs ...graphstore.Service) {
 	}()
 }
 
+// SignalContext returns a copy of ctx that is cancelled when the program is
+// notified of an Interrupt or SIGTERM signal.  Unlike EnsureGracefulExit, the
+// program is not exited; the caller should stop its work once ctx is done.  A
+// second signal is handled by the default behavior (usually exiting).
+func SignalContext(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		log.Printf("graphstore: signal %v", sig)
+		signal.Stop(c)
+		cancel()
+	}()
+	return ctx
+}
+
 // LogClose closes gs and logs any resulting error.
 func LogClose(ctx context.Context, gs graphstore.Service) {
 	if err := gs.Close(ctx); err != nil {
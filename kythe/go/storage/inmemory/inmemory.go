@@ -18,7 +18,12 @@
 package inmemory
 
 import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
 	"io"
+	"net/url"
 	"sort"
 	"sync"
 
@@ -31,83 +36,760 @@ import (
 	"golang.org/x/net/context"
 )
 
+func init() {
+	graphstore.Register("in-memory", func(context.Context, *url.URL) (graphstore.Service, error) { return Create(), nil })
+}
+
 type store struct {
-	entries []*spb.Entry
-	mu      sync.RWMutex
+	mu sync.Mutex
+
+	// records are the store's entries, ordered by key, as of the last merge of
+	// the pending writes.  Once assigned, records is never modified so that it
+	// may be read without holding mu; each merge or deletion replaces it.
+	records []compare.KeyedEntry
+
+	// pending are the records written since the last merge, keyed by their
+	// keys.  They are merged into records before the next read.
+	pending map[string]compare.KeyedEntry
+
+	// runs are the store's spilled entries, newest first (see spill.go), and
+	// memBytes is the size of records and pending, accounted as by recordSize.
+	runs     []*run
+	memBytes int64
+
+	readOnly bool // the store is a snapshot
+
+	opts           Options
+	entries, bytes int64 // accounted as by recordSize
+
+	// When opts.Evict is set, the store's sources are kept in the order in
+	// which they were last read or written, most recent first.
+	lru     *list.List               // of *sourceUsage
+	sources map[string]*list.Element // keyed by encoded source VName
+
+	// publishing is acquired while holding mu by each write before it
+	// publishes its entries, so that watchers observe the writes in the order
+	// in which they were applied.
+	publishing sync.Mutex
+	watchers   graphstore.Broadcaster
+}
+
+// ErrStoreFull is returned by a write that would cause a store to exceed its
+// MaxBytes (see Options).
+var ErrStoreFull = errors.New("in-memory GraphStore is full")
+
+// Options configure an in-memory GraphStore.
+type Options struct {
+	// MaxBytes, if positive, is the maximum number of bytes of entries held by
+	// the store, where each entry is accounted as the size of its encoded key
+	// (see compare.EncodeEntryKey) plus the size of its fact value.  A write
+	// that would exceed MaxBytes fails with ErrStoreFull and is not applied.
+	MaxBytes int64
+
+	// Evict, if non-nil, causes a write that would exceed MaxBytes to instead
+	// first remove all of the entries of the least recently read (or written)
+	// sources, other than those being written, until the write fits.  Evict is
+	// called with each removed source (after the write) so that, for example,
+	// a cache may record that it no longer holds the source.  A write that
+	// cannot fit by evicting sources fails with ErrStoreFull.
+	Evict func(source *spb.VName)
+
+	// SpillBytes, if positive, bounds the bytes of entries held in memory,
+	// accounted as for MaxBytes.  Before a write would exceed it, the entries
+	// held in memory are sorted and spilled to a new temporary run file, and
+	// reads merge the entries remaining in memory with those of every run.
+	// The runs are merged into one once there are several, and are rewritten
+	// by each Delete.  Close removes the store's run files.  SpillBytes is
+	// ignored if Evict is set.
+	SpillBytes int64
+
+	// SpillDir is the directory of the run files written for SpillBytes.  If
+	// empty, the default directory for temporary files is used.
+	SpillDir string
 }
 
-// Create returns a new in-memory graphstore.Service
+// A Service is an in-memory graphstore.Service that reports the sizes of its
+// entries.
+type Service interface {
+	graphstore.Service
+
+	// Stats returns the number and size of the store's entries.
+	Stats() Stats
+}
+
+// Stats are the numbers of entries and bytes held by a Service.
+type Stats struct {
+	// Entries is the number of entries in the store.
+	Entries int64
+
+	// Bytes is the total size of the store's entries, accounted as for
+	// Options.MaxBytes.
+	Bytes int64
+}
+
+// Create returns a new in-memory graphstore.Service.  Writes are buffered and
+// merged into the store's sorted entries at the start of the next read, and
+// each read (or shard) sees an immutable view of the entries as of its start,
+// so long reads do not block writes.
 func Create() graphstore.Service { return &store{} }
 
-// Close implements part of the graphstore.Service interface.
-func (*store) Close(ctx context.Context) error { return nil }
+// CreateWithOptions returns a new in-memory Service configured by opts, as for
+// Create.  If opts == nil, the store is unbounded.
+func CreateWithOptions(opts *Options) Service {
+	s := &store{}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.Evict != nil {
+		s.lru, s.sources = list.New(), make(map[string]*list.Element)
+	}
+	return s
+}
 
-// Write implements part of the graphstore.Service interface.
-func (s *store) Write(ctx context.Context, req *spb.WriteRequest) error {
+// Stats implements part of the Service interface.
+func (s *store) Stats() Stats {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, u := range req.Update {
-		s.insert(proto.Clone(&spb.Entry{
-			Source:    req.Source,
-			EdgeKind:  u.EdgeKind,
-			Target:    u.Target,
-			FactName:  u.FactName,
-			FactValue: u.FactValue,
-		}).(*spb.Entry))
+	return Stats{Entries: s.entries, Bytes: s.bytes}
+}
+
+// recordSize returns the number of bytes accounted for r.
+func recordSize(r compare.KeyedEntry) int64 { return int64(len(r.Key) + len(r.Entry.FactValue)) }
+
+// Watch implements the graphstore.Watcher interface.  Entries are delivered in
+// the order in which their writes were applied, so the last entry watched for
+// a key is the entry stored for it.  Writes block while any watcher's buffer is
+// full (see graphstore.Broadcaster), so f may read the store but must not
+// write to it.
+func (s *store) Watch(ctx context.Context, f graphstore.EntryFunc) error {
+	return s.watchers.Watch(ctx, f)
+}
+
+// publish delivers the written entries to the store's watchers.  s.mu must be
+// held; it is released once the write's turn to publish is taken, so that
+// watchers may read the store while later writes wait to publish after it.
+func (s *store) publish(ctx context.Context, written []*spb.Entry) error {
+	if len(written) == 0 {
+		s.mu.Unlock()
+		return nil
 	}
+	s.publishing.Lock()
+	defer s.publishing.Unlock()
+	s.mu.Unlock()
+	return s.watchers.Publish(ctx, written)
+}
+
+// Snapshot implements the graphstore.Snapshotter interface.  The snapshot
+// shares the current records (and runs) with s.
+func (s *store) Snapshot() (graphstore.Service, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.merge()
+	return &store{records: s.records, runs: s.retainRuns(), readOnly: true, entries: s.entries, bytes: s.bytes}, nil
+}
+
+// view returns a view of the store's current entries, first merging any
+// pending writes into its records.  The view must be released once it is no
+// longer used.
+func (s *store) view() *view {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.merge()
+	return &view{records: s.records, runs: s.retainRuns(), entries: s.entries}
+}
+
+// merge replaces s.records with the union of s.records and s.pending, whose
+// records take precedence.  s.mu must be held.
+func (s *store) merge() {
+	if len(s.pending) == 0 {
+		return
+	}
+	writes := make([]compare.KeyedEntry, 0, len(s.pending))
+	for _, r := range s.pending {
+		writes = append(writes, r)
+	}
+	compare.SortKeyed(writes)
+
+	merged := make([]compare.KeyedEntry, 0, len(s.records)+len(writes))
+	recs := s.records
+	for len(recs) > 0 && len(writes) > 0 {
+		switch c := bytes.Compare(recs[0].Key, writes[0].Key); {
+		case c < 0:
+			merged = append(merged, recs[0])
+			recs = recs[1:]
+		case c > 0:
+			merged = append(merged, writes[0])
+			writes = writes[1:]
+		default:
+			merged = append(merged, writes[0])
+			recs, writes = recs[1:], writes[1:]
+		}
+	}
+	merged = append(append(merged, recs...), writes...)
+	s.records, s.pending = merged, nil
+	s.memBytes = 0
+	for _, r := range merged {
+		s.memBytes += recordSize(r)
+	}
+}
+
+// Delete implements part of the graphstore.Deleter interface.
+func (s *store) Delete(ctx context.Context, req *graphstore.DeleteRequest) error {
+	if req.Source == nil {
+		return errors.New("invalid DeleteRequest: missing Source")
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return graphstore.ErrReadOnly
+	} else if len(s.runs) > 0 {
+		return s.compact(func(e *spb.Entry) bool { return graphstore.EntryMatchesDelete(req, e) })
+	}
+	s.merge()
+	kept := make([]compare.KeyedEntry, 0, len(s.records))
+	for _, r := range s.records {
+		if !graphstore.EntryMatchesDelete(req, r.Entry) {
+			kept = append(kept, r)
+			continue
+		}
+		s.entries--
+		s.bytes -= recordSize(r)
+		s.memBytes -= recordSize(r)
+		if s.lru != nil {
+			s.account(r.Entry.Source, -recordSize(r))
+		}
+	}
+	s.records = kept
 	return nil
 }
 
-func (s *store) insert(e *spb.Entry) {
-	i := sort.Search(len(s.entries), func(i int) bool {
-		return compare.Entries(e, s.entries[i]) == compare.LT
-	})
-	if i == len(s.entries) {
-		s.entries = append(s.entries, e)
-	} else if i < len(s.entries) && compare.EntriesEqual(e, s.entries[i]) {
-		s.entries[i] = e
-	} else if i == 0 {
-		s.entries = append([]*spb.Entry{e}, s.entries...)
+// ScansOrdered implements the graphstore.OrderedScanner interface.
+func (s *store) ScansOrdered() bool { return true }
+
+// Close implements part of the graphstore.Service interface.  The run files
+// of a spilled store are removed once any reads in progress finish.
+func (s *store) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		s.records = nil
+	}
+	s.releaseRuns()
+	return nil
+}
+
+// Write implements part of the graphstore.Service interface.
+func (s *store) Write(ctx context.Context, req *spb.WriteRequest) error {
+	_, err := s.WriteWithStats(ctx, req)
+	return err
+}
+
+// WriteBatch implements part of the graphstore.Transactional interface.  All of
+// the requests are applied under a single acquisition of the store's lock.
+func (s *store) WriteBatch(ctx context.Context, reqs []*spb.WriteRequest) error {
+	_, err := s.write(ctx, reqs, nil)
+	return err
+}
+
+// WriteWithStats implements part of the graphstore.StatsWriter interface.
+func (s *store) WriteWithStats(ctx context.Context, req *spb.WriteRequest) (*graphstore.WriteStats, error) {
+	return s.WriteOpts(ctx, req, nil)
+}
+
+// WriteOpts implements part of the graphstore.OptionsWriter interface.
+func (s *store) WriteOpts(ctx context.Context, req *spb.WriteRequest, opts *graphstore.WriteOptions) (*graphstore.WriteStats, error) {
+	return s.write(ctx, []*spb.WriteRequest{req}, opts)
+}
+
+// write applies each of reqs to the store while holding its lock and then
+// notifies any watchers of the written entries, in the order of the writes.
+func (s *store) write(ctx context.Context, reqs []*spb.WriteRequest, opts *graphstore.WriteOptions) (*graphstore.WriteStats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if s.readOnly {
+		s.mu.Unlock()
+		return nil, graphstore.ErrReadOnly
+	}
+	ifAbsent := opts != nil && opts.IfAbsent
+	var recs []compare.KeyedEntry
+	for _, req := range reqs {
+		for _, e := range graphstore.WriteRequestEntries(req) {
+			recs = append(recs, compare.NewKeyedEntry(proto.Clone(e).(*spb.Entry)))
+		}
+	}
+	olds, err := s.lookupAll(recs)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	evicted, err := s.reserve(recs, olds, ifAbsent)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	} else if err := s.spill(recordsSize(recs)); err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	stats := new(graphstore.WriteStats)
+	var written []*spb.Entry
+	for _, r := range recs {
+		if s.insert(r, olds, ifAbsent, stats) {
+			written = append(written, r.Entry)
+		}
+	}
+
+	// Notify watchers (and the eviction callback) outside of the lock so that
+	// they may read the store.
+	err = s.publish(ctx, written)
+	s.notifyEvicted(evicted)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// insert adds r to the store's pending writes, replacing any entry with the
+// same key unless ifAbsent is set, and records the outcome in stats.  olds
+// holds the current entries with the keys being written (see lookupAll) and
+// is updated with r.  insert reports whether r was written.  s.mu must be
+// held.
+func (s *store) insert(r compare.KeyedEntry, olds map[string]*spb.Entry, ifAbsent bool, stats *graphstore.WriteStats) bool {
+	size := recordSize(r)
+	if old := olds[string(r.Key)]; old != nil {
+		if ifAbsent {
+			stats.Skipped++
+			return false
+		} else if bytes.Equal(r.Entry.FactValue, old.FactValue) {
+			stats.Unchanged++
+		} else {
+			stats.Updated++
+		}
+		size = int64(len(r.Entry.FactValue) - len(old.FactValue))
 	} else {
-		s.entries = append(s.entries[:i], append([]*spb.Entry{e}, s.entries[i:]...)...)
+		stats.Inserted++
+		s.entries++
 	}
+	s.bytes += size
+	if s.lru != nil {
+		s.account(r.Entry.Source, size)
+		s.used(r.Entry.Source)
+	}
+	if s.pending == nil {
+		s.pending = make(map[string]compare.KeyedEntry)
+	}
+	s.pending[string(r.Key)] = r
+	s.memBytes += recordSize(r)
+	olds[string(r.Key)] = r.Entry
+	return true
 }
 
-// Read implements part of the graphstore.Service interface.
-func (s *store) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	start := sort.Search(len(s.entries), func(i int) bool {
-		comp := compare.VNames(s.entries[i].Source, req.Source)
-		return comp != compare.LT && (comp == compare.GT || req.EdgeKind == "*" || s.entries[i].EdgeKind >= req.EdgeKind)
-	})
-	end := sort.Search(len(s.entries), func(i int) bool {
-		comp := compare.VNames(s.entries[i].Source, req.Source)
-		return comp == compare.GT || (comp != compare.LT && req.EdgeKind != "*" && s.entries[i].EdgeKind > req.EdgeKind)
+// recordsSize returns the total number of bytes accounted for recs.
+func recordsSize(recs []compare.KeyedEntry) int64 {
+	var size int64
+	for _, r := range recs {
+		size += recordSize(r)
+	}
+	return size
+}
+
+// reserve ensures that writing recs (as by insert) will not cause the store to
+// exceed its MaxBytes, evicting the least recently used sources not written by
+// recs if the store has an eviction callback.  olds holds the current entries
+// with the keys of recs.  reserve returns the evicted sources, or ErrStoreFull
+// if recs cannot fit.  s.mu must be held.
+func (s *store) reserve(recs []compare.KeyedEntry, olds map[string]*spb.Entry, ifAbsent bool) ([]*spb.VName, error) {
+	if s.opts.MaxBytes <= 0 {
+		return nil, nil
+	}
+
+	// The size of each key written by recs after the write, or -1 if absent.
+	sizes := make(map[string]int64)
+	var delta int64
+	for _, r := range recs {
+		old, known := sizes[string(r.Key)]
+		if !known {
+			old = -1
+			if e := olds[string(r.Key)]; e != nil {
+				old = int64(len(r.Key) + len(e.FactValue))
+			}
+		}
+		if ifAbsent && old >= 0 {
+			sizes[string(r.Key)] = old
+			continue
+		}
+		size := recordSize(r)
+		if old >= 0 {
+			delta += size - old
+		} else {
+			delta += size
+		}
+		sizes[string(r.Key)] = size
+	}
+	need := s.bytes + delta - s.opts.MaxBytes
+	if need <= 0 {
+		return nil, nil
+	} else if s.lru == nil {
+		return nil, ErrStoreFull
+	}
+
+	writing := make(map[string]bool)
+	for _, r := range recs {
+		writing[string(compare.EncodeVName(r.Entry.Source))] = true
+	}
+	var victims []*sourceUsage
+	for el := s.lru.Back(); el != nil && need > 0; el = el.Prev() {
+		if u := el.Value.(*sourceUsage); !writing[string(u.key)] {
+			victims = append(victims, u)
+			need -= u.bytes
+		}
+	}
+	if need > 0 {
+		return nil, ErrStoreFull
+	}
+	return s.evict(victims), nil
+}
+
+// evict removes all of the entries of each of the given sources from the store
+// and returns the sources.  s.mu must be held.
+func (s *store) evict(victims []*sourceUsage) []*spb.VName {
+	s.merge()
+
+	// Each source's entries are a contiguous range of the store's records.
+	ends := make(map[int]int) // end index by start index
+	for _, u := range victims {
+		start, _ := search(s.records, u.key)
+		end := start
+		for end < len(s.records) && bytes.HasPrefix(s.records[end].Key, u.key) {
+			end++
+		}
+		if end > start {
+			ends[start] = end
+		}
+	}
+	kept := make([]compare.KeyedEntry, 0, len(s.records))
+	for i := 0; i < len(s.records); {
+		if end, ok := ends[i]; ok {
+			for _, r := range s.records[i:end] {
+				s.entries--
+				s.bytes -= recordSize(r)
+				s.memBytes -= recordSize(r)
+			}
+			i = end
+			continue
+		}
+		kept = append(kept, s.records[i])
+		i++
+	}
+	s.records = kept
+
+	evicted := make([]*spb.VName, len(victims))
+	for i, u := range victims {
+		s.lru.Remove(s.sources[string(u.key)])
+		delete(s.sources, string(u.key))
+		evicted[i] = u.source
+	}
+	return evicted
+}
+
+// notifyEvicted calls the store's eviction callback, if any, with each of the
+// given sources.  s.mu must not be held.
+func (s *store) notifyEvicted(sources []*spb.VName) {
+	if s.opts.Evict == nil {
+		return
+	}
+	for _, src := range sources {
+		s.opts.Evict(src)
+	}
+}
+
+// A sourceUsage records the size of a source's entries in a store's LRU list.
+type sourceUsage struct {
+	key    []byte // encoded source, the prefix of the keys of its entries
+	source *spb.VName
+	bytes  int64
+}
+
+// account adds delta to the recorded size of the given source's entries,
+// removing the source from the LRU list once it has no entries.  s.mu must be
+// held.
+func (s *store) account(source *spb.VName, delta int64) {
+	key := compare.EncodeVName(source)
+	el, ok := s.sources[string(key)]
+	if !ok {
+		if delta <= 0 {
+			return
+		}
+		el = s.lru.PushFront(&sourceUsage{key: key, source: proto.Clone(source).(*spb.VName)})
+		s.sources[string(key)] = el
+	}
+	u := el.Value.(*sourceUsage)
+	if u.bytes += delta; u.bytes <= 0 {
+		s.lru.Remove(el)
+		delete(s.sources, string(key))
+	}
+}
+
+// used marks the given source, if it has any entries, as the most recently
+// used.  s.mu must be held.
+func (s *store) used(source *spb.VName) {
+	if el, ok := s.sources[string(compare.EncodeVName(source))]; ok {
+		s.lru.MoveToFront(el)
+	}
+}
+
+// lookup returns the current entry with the given key, if any.  s.mu must be
+// held.
+func (s *store) lookup(key []byte) (*spb.Entry, bool, error) {
+	if r, ok := s.pending[string(key)]; ok {
+		return r.Entry, true, nil
+	}
+	if i, found := search(s.records, key); found {
+		return s.records[i].Entry, true, nil
+	}
+	for _, r := range s.runs {
+		if e, found, err := r.get(key); err != nil || found {
+			return e, found, err
+		}
+	}
+	return nil, false, nil
+}
+
+// lookupAll returns the current entries with the keys of recs, keyed by the
+// keys of recs, with a nil entry for each absent key.  Every entry is found
+// before any is written, so that an error reading a spilled run cannot cause
+// a partial write.  s.mu must be held.
+func (s *store) lookupAll(recs []compare.KeyedEntry) (map[string]*spb.Entry, error) {
+	olds := make(map[string]*spb.Entry, len(recs))
+	for _, r := range recs {
+		if _, ok := olds[string(r.Key)]; ok {
+			continue
+		}
+		e, _, err := s.lookup(r.Key)
+		if err != nil {
+			return nil, err
+		}
+		olds[string(r.Key)] = e
+	}
+	return olds, nil
+}
+
+// search returns the index of the first of recs whose key is not less than key
+// and whether that record's key is equal to key.
+func search(recs []compare.KeyedEntry, key []byte) (int, bool) {
+	i := sort.Search(len(recs), func(i int) bool {
+		return bytes.Compare(recs[i].Key, key) >= 0
 	})
-	for i := start; i < end; i++ {
-		if err := f(s.entries[i]); err == io.EOF {
+	return i, i < len(recs) && bytes.Equal(recs[i].Key, key)
+}
+
+// after returns an iterator over the entries of v following after, or over
+// all of them if after is nil.
+func after(v *view, after *spb.Entry) entryIter {
+	if after == nil {
+		return v.iter(nil)
+	}
+	key := compare.EncodeEntryKey(after)
+	return &dropIter{v.iter(key), func(r compare.KeyedEntry) bool {
+		return bytes.Equal(r.Key, key)
+	}}
+}
+
+// CompareAndSwap implements part of the graphstore.CAS interface.  The
+// comparison and write are made while holding the store's lock.
+func (s *store) CompareAndSwap(ctx context.Context, source *spb.VName, factName string, oldValue, newValue []byte) (bool, error) {
+	if factName == "" {
+		return false, errors.New("missing fact name")
+	} else if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	e := &spb.Entry{
+		Source:    proto.Clone(source).(*spb.VName),
+		FactName:  factName,
+		FactValue: append([]byte(nil), newValue...),
+	}
+
+	s.mu.Lock()
+	if s.readOnly {
+		s.mu.Unlock()
+		return false, graphstore.ErrReadOnly
+	}
+	recs := []compare.KeyedEntry{compare.NewKeyedEntry(e)}
+	olds, err := s.lookupAll(recs)
+	if err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	cur := olds[string(recs[0].Key)]
+	if oldValue == nil && cur != nil || oldValue != nil && (cur == nil || !bytes.Equal(cur.FactValue, oldValue)) {
+		s.mu.Unlock()
+		return false, nil
+	}
+	evicted, err := s.reserve(recs, olds, false)
+	if err != nil {
+		s.mu.Unlock()
+		return false, err
+	} else if err := s.spill(recordsSize(recs)); err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	s.insert(recs[0], olds, false, new(graphstore.WriteStats))
+
+	err = s.publish(ctx, []*spb.Entry{e})
+	s.notifyEvicted(evicted)
+	if err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// Read implements part of the graphstore.Service interface.  If the store
+// evicts sources, reading a source marks it as most recently used.
+func (s *store) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	prefix := compare.EncodeKeyPrefix(req.Source, req.EdgeKind)
+	if s.lru != nil {
+		s.mu.Lock()
+		s.used(req.Source)
+		s.mu.Unlock()
+	}
+	v := s.view()
+	defer v.release()
+	it := v.iter(prefix)
+	for {
+		r, err := it.next()
+		if err == io.EOF || err == nil && !bytes.HasPrefix(r.Key, prefix) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
+		} else if err := f(r.Entry); err == io.EOF {
 			return nil
 		} else if err != nil {
 			return err
 		}
 	}
-	return nil
 }
 
 // Scan implements part of the graphstore.Service interface.
 func (s *store) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	return s.ScanOpts(ctx, req, nil, f)
+}
 
-	for _, e := range s.entries {
-		if !graphstore.EntryMatchesScan(req, e) {
+// ScanOpts implements part of the graphstore.OptionsScanner interface.
+func (s *store) ScanOpts(ctx context.Context, req *spb.ScanRequest, opts *graphstore.ScanOptions, f graphstore.EntryFunc) error {
+	v := s.view()
+	defer v.release()
+	return scanRecords(ctx, v.iter(nil), func(e *spb.Entry) bool {
+		return graphstore.EntryMatchesScanOpts(req, opts, e)
+	}, f)
+}
+
+// scanRecords calls f with the entry of each record of it for which match
+// returns true.
+func scanRecords(ctx context.Context, it entryIter, match func(*spb.Entry) bool, f graphstore.EntryFunc) error {
+	for {
+		r, err := it.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
+		} else if match != nil && !match(r.Entry) {
 			continue
-		} else if err := f(e); err == io.EOF {
+		} else if err := f(r.Entry); err == io.EOF {
 			return nil
 		} else if err != nil {
 			return err
 		}
 	}
-	return nil
+}
+
+// ReverseScan implements part of the graphstore.ReverseScanner interface.
+func (s *store) ReverseScan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	v := s.view()
+	defer v.release()
+	return scanRecords(ctx, v.reverseIter(), func(e *spb.Entry) bool {
+		return graphstore.EntryMatchesScan(req, e)
+	}, f)
+}
+
+// ScanFrom implements part of the graphstore.ResumableScanner interface.
+func (s *store) ScanFrom(ctx context.Context, req *spb.ScanRequest, from *spb.Entry, f graphstore.EntryFunc) error {
+	v := s.view()
+	defer v.release()
+	return scanRecords(ctx, after(v, from), func(e *spb.Entry) bool {
+		return graphstore.EntryMatchesScan(req, e)
+	}, f)
+}
+
+// ScanPage implements part of the graphstore.PagedScanner interface.
+func (s *store) ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	from, err := graphstore.ParsePageToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	v := s.view()
+	defer v.release()
+	var page []*spb.Entry
+	if err := scanRecords(ctx, after(v, from), func(e *spb.Entry) bool {
+		return graphstore.EntryMatchesScan(req, e)
+	}, func(e *spb.Entry) error {
+		page = append(page, e)
+		if len(page) > pageSize {
+			return io.EOF
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	return graphstore.Page(page, pageSize)
+}
+
+// Count implements part of the graphstore.Sharded interface.  Each shard is a
+// contiguous range of the store's entries, in order; the shards of a store
+// that is not being written are the same for each call.
+func (s *store) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	v := s.view()
+	v.release()
+	start, end, err := shardRange(v.entries, req.Index, req.Shards)
+	return end - start, err
+}
+
+// Shard implements part of the graphstore.Sharded interface.
+func (s *store) Shard(ctx context.Context, req *spb.ShardRequest, f graphstore.EntryFunc) error {
+	v := s.view()
+	defer v.release()
+	start, end, err := shardRange(v.entries, req.Index, req.Shards)
+	if err != nil {
+		return err
+	}
+	var i int64
+	return scanRecords(ctx, v.iter(nil), func(*spb.Entry) bool {
+		i++
+		return i > start
+	}, func(e *spb.Entry) error {
+		if i > end {
+			return io.EOF
+		}
+		return f(e)
+	})
+}
+
+// shardRange returns the range of the indices of n records in the given shard.
+func shardRange(n int64, index, shards int64) (int64, int64, error) {
+	if shards < 1 {
+		return 0, 0, fmt.Errorf("invalid number of shards: %d", shards)
+	} else if index < 0 || index >= shards {
+		return 0, 0, fmt.Errorf("invalid index for %d shards: %d", shards, index)
+	}
+	return n * index / shards, n * (index + 1) / shards, nil
 }
@@ -0,0 +1,656 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package inmemory
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+
+	gspkg "kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/test/services/graphstore"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func tempGS() (graphstore.Service, graphstore.DestroyFunc, error) {
+	return Create(), graphstore.NullDestroy, nil
+}
+
+func TestOrder(t *testing.T) {
+	graphstore.OrderTest(t, tempGS, 16)
+}
+
+func TestDelete(t *testing.T) {
+	graphstore.DeleteTest(t, tempGS)
+}
+
+func TestCAS(t *testing.T) {
+	graphstore.CASTest(t, tempGS)
+}
+
+func TestGarbageCollection(t *testing.T) {
+	graphstore.GarbageCollectionTest(t, tempGS)
+}
+
+func TestPagedScan(t *testing.T) {
+	graphstore.PagedScanTest(t, tempGS)
+}
+
+func TestScanFrom(t *testing.T) {
+	graphstore.ScanFromTest(t, tempGS)
+}
+
+func TestReverseOrder(t *testing.T) {
+	graphstore.ReverseOrderTest(t, tempGS, 16)
+}
+
+func TestWriteStats(t *testing.T) {
+	graphstore.WriteStatsTest(t, tempGS)
+}
+
+func TestWriteIfAbsent(t *testing.T) {
+	graphstore.WriteIfAbsentTest(t, tempGS)
+}
+
+func TestWriteIfAbsentRace(t *testing.T) {
+	graphstore.WriteIfAbsentRaceTest(t, tempGS)
+}
+
+func TestSnapshot(t *testing.T) {
+	graphstore.SnapshotTest(t, tempGS)
+}
+
+func TestWatch(t *testing.T) {
+	graphstore.WatchTest(t, tempGS)
+}
+
+func TestTransaction(t *testing.T) {
+	graphstore.TransactionTest(t, tempGS)
+}
+
+func TestScanOptions(t *testing.T) {
+	graphstore.ScanOptionsTest(t, tempGS)
+}
+
+func TestReadFacts(t *testing.T) {
+	graphstore.ReadFactsTest(t, tempGS)
+}
+
+func TestBlobWrite(t *testing.T) {
+	graphstore.BlobWriteTest(t, tempGS)
+}
+
+func TestShards(t *testing.T) {
+	ctx := context.Background()
+	gs := Create()
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := gs.Write(ctx, &spb.WriteRequest{
+				Source: &spb.VName{Signature: fmt.Sprintf("sig%04d", i)},
+				Update: []*spb.WriteRequest_Update{
+					{FactName: "/kythe/node/kind", FactValue: []byte("test")},
+					{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))},
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(entries, shards int64) {
+		sh := gs.(gspkg.Sharded)
+		var all []*spb.Entry
+		if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+			all = append(all, e)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		var found []*spb.Entry
+		for i := int64(0); i < shards; i++ {
+			count, err := sh.Count(ctx, &spb.CountRequest{Index: i, Shards: shards})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if max := (entries + shards - 1) / shards; count > max {
+				t.Errorf("Shard %d/%d has %d entries; want at most %d", i, shards, count, max)
+			}
+			start := len(found)
+			if err := sh.Shard(ctx, &spb.ShardRequest{Index: i, Shards: shards}, func(e *spb.Entry) error {
+				found = append(found, e)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if n := int64(len(found) - start); n != count {
+				t.Errorf("Shard %d/%d has %d entries; Count reported %d", i, shards, n, count)
+			}
+		}
+		if int64(len(found)) != entries || len(found) != len(all) {
+			t.Fatalf("Found %d total entries across %d shards; want %d", len(found), shards, entries)
+		}
+		for i, e := range found {
+			if e != all[i] {
+				t.Errorf("Entry %d across %d shards is %v; Scan found %v", i, shards, e, all[i])
+				break
+			}
+		}
+	}
+
+	check(0, 3)
+	write(0, 10)
+	check(20, 1)
+	check(20, 3)
+	check(20, 32)
+	write(10, 1000)
+	check(2000, 7)
+
+	sh := gs.(gspkg.Sharded)
+	if _, err := sh.Count(ctx, &spb.CountRequest{Index: 0, Shards: 0}); err == nil {
+		t.Error("Count of 0 shards succeeded; expected an error")
+	} else if err := sh.Shard(ctx, &spb.ShardRequest{Index: 3, Shards: 3}, func(*spb.Entry) error { return nil }); err == nil {
+		t.Error("Shard with an out of range index succeeded; expected an error")
+	}
+}
+
+func TestWriteDuringScan(t *testing.T) {
+	ctx := context.Background()
+	gs := Create()
+	src := func(i int) *spb.VName { return &spb.VName{Signature: fmt.Sprintf("sig%04d", i)} }
+	for i := 0; i < 10; i++ {
+		if err := gs.Write(ctx, &spb.WriteRequest{
+			Source: src(2 * i),
+			Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("test")}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Writes made during a Scan do not block and are not seen by the Scan.
+	var scanned int
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		scanned++
+		return gs.Write(ctx, &spb.WriteRequest{
+			Source: src(2*scanned - 1),
+			Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("test")}},
+		})
+	}); err != nil {
+		t.Fatal(err)
+	} else if scanned != 10 {
+		t.Errorf("Scan found %d entries; want 10", scanned)
+	}
+
+	var last *spb.Entry
+	var after int
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		if last != nil && compare.Entries(last, e) != compare.LT {
+			t.Errorf("Entry %v is not after %v", e, last)
+		}
+		last = e
+		after++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if after != 20 {
+		t.Errorf("Scan after writes found %d entries; want 20", after)
+	}
+}
+
+func TestConcurrentReadWrite(t *testing.T) {
+	ctx := context.Background()
+	gs := Create()
+	const (
+		writers = 4
+		writes  = 200
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers)
+	done := make(chan struct{})
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				// Each batch writes a pair of entries, so every read must see an
+				// even number of them.
+				if err := gs.(gspkg.Transactional).WriteBatch(ctx, []*spb.WriteRequest{{
+					Source: &spb.VName{Signature: fmt.Sprintf("sig%d.%04d", w, i)},
+					Update: []*spb.WriteRequest_Update{
+						{FactName: "/kythe/node/kind", FactValue: []byte("test")},
+						{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))},
+					},
+				}}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	var readers sync.WaitGroup
+	for r := 0; r < writers; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var (
+					n    int
+					last *spb.Entry
+				)
+				if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+					if last != nil && compare.Entries(last, e) != compare.LT {
+						return fmt.Errorf("entry %v is not after %v", e, last)
+					}
+					last = e
+					n++
+					return nil
+				}); err != nil {
+					errs <- err
+					return
+				} else if n%2 != 0 {
+					errs <- fmt.Errorf("scan found %d entries; want an even number", n)
+					return
+				}
+				count, err := gs.(gspkg.Sharded).Count(ctx, &spb.CountRequest{Index: 0, Shards: 1})
+				if err != nil {
+					errs <- err
+					return
+				} else if count < int64(n) {
+					errs <- fmt.Errorf("count %d is less than the %d entries previously scanned", count, n)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	count, err := gs.(gspkg.Sharded).Count(ctx, &spb.CountRequest{Index: 0, Shards: 1})
+	if err != nil {
+		t.Fatal(err)
+	} else if want := int64(2 * writers * writes); count != want {
+		t.Errorf("Found %d entries; want %d", count, want)
+	}
+}
+
+func TestStoreFull(t *testing.T) {
+	graphstore.StoreFullTest(t, func() (graphstore.Service, graphstore.DestroyFunc, error) {
+		return CreateWithOptions(&Options{MaxBytes: 4096}), graphstore.NullDestroy, nil
+	}, ErrStoreFull)
+}
+
+// checkStats checks that the Stats of gs agree with its entries.
+func checkStats(t *testing.T, gs Service) {
+	var want Stats
+	if err := gs.Scan(context.Background(), new(spb.ScanRequest), func(e *spb.Entry) error {
+		want.Entries++
+		want.Bytes += int64(len(compare.EncodeEntryKey(e)) + len(e.FactValue))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := gs.Stats(); got != want {
+		t.Errorf("Stats: got %+v; want %+v", got, want)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	gs := CreateWithOptions(nil)
+	checkStats(t, gs)
+	for i := 0; i < 10; i++ {
+		if err := gs.Write(ctx, &spb.WriteRequest{
+			Source: &spb.VName{Signature: fmt.Sprintf("sig%d", i)},
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/node/kind", FactValue: []byte("test")},
+				{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))},
+				{EdgeKind: "/kythe/edge/ref", Target: &spb.VName{Signature: "target"}, FactName: "/"},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStats(t, gs)
+
+	// Replacing a fact value changes only its size.
+	if err := gs.Write(ctx, &spb.WriteRequest{
+		Source: &spb.VName{Signature: "sig3"},
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/text", FactValue: []byte("a much longer text")}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	checkStats(t, gs)
+	if ok, err := gs.(gspkg.CAS).CompareAndSwap(ctx, &spb.VName{Signature: "sig4"}, "/kythe/text", []byte("4"), nil); err != nil || !ok {
+		t.Fatalf("CompareAndSwap: got (%v, %v); want (true, nil)", ok, err)
+	}
+	checkStats(t, gs)
+
+	if err := gs.(gspkg.Deleter).Delete(ctx, &gspkg.DeleteRequest{Source: &spb.VName{Signature: "sig5"}}); err != nil {
+		t.Fatal(err)
+	}
+	checkStats(t, gs)
+	if got := gs.Stats().Entries; got != 27 {
+		t.Errorf("Found %d entries; want 27", got)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	ctx := context.Background()
+	var evicted []string
+	const maxBytes = 2048
+	gs := CreateWithOptions(&Options{
+		MaxBytes: maxBytes,
+		Evict:    func(src *spb.VName) { evicted = append(evicted, src.Signature) },
+	})
+	src := func(i int) *spb.VName { return &spb.VName{Signature: fmt.Sprintf("sig%04d", i)} }
+	write := func(i int) {
+		if err := gs.Write(ctx, &spb.WriteRequest{
+			Source: src(i),
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/node/kind", FactValue: []byte("test")},
+				{FactName: "/kythe/text", FactValue: []byte(fmt.Sprintf("%064d", i))},
+			},
+		}); err != nil {
+			t.Fatalf("Write %d error: %v", i, err)
+		}
+	}
+	read := func(i int) int {
+		var n int
+		if err := gs.Read(ctx, &spb.ReadRequest{Source: src(i)}, func(*spb.Entry) error {
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	var n int
+	for ; len(evicted) == 0; n++ {
+		write(n)
+		if n == 0 {
+			continue
+		}
+		// Keep the first source in use so that it is never evicted.
+		if got := read(0); got != 2 {
+			t.Fatalf("Read %d entries of the first source; want 2", got)
+		}
+	}
+	for i := n; i < 3*n; i++ {
+		write(i)
+		read(0)
+	}
+	checkStats(t, gs)
+	if stats := gs.Stats(); stats.Bytes > maxBytes {
+		t.Errorf("Store holds %d bytes; want at most %d", stats.Bytes, maxBytes)
+	}
+
+	// The sources are evicted in the order written, other than the one in use.
+	for i, sig := range evicted {
+		if want := src(i + 1).Signature; sig != want {
+			t.Fatalf("Evicted source %d is %q; want %q", i, sig, want)
+		}
+		if got := read(i + 1); got != 0 {
+			t.Errorf("Read %d entries of evicted source %q; want 0", got, sig)
+		}
+	}
+	if got := read(3*n - 1); got != 2 {
+		t.Errorf("Read %d entries of the last source; want 2", got)
+	}
+
+	// A write larger than the store fails.
+	big := make([]byte, maxBytes)
+	if err := gs.Write(ctx, &spb.WriteRequest{
+		Source: src(0),
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/text", FactValue: big}},
+	}); err != ErrStoreFull {
+		t.Errorf("Write larger than the store: got error %v; want %v", err, ErrStoreFull)
+	}
+	checkStats(t, gs)
+}
+
+// spillBytes is small enough that the stores of the conformance tests spill.
+const spillBytes = 512
+
+func tempSpillGS() (graphstore.Service, graphstore.DestroyFunc, error) {
+	dir, err := ioutil.TempDir("", "inmemory.spill")
+	if err != nil {
+		return nil, graphstore.NullDestroy, err
+	}
+	destroy := func() error { return os.RemoveAll(dir) }
+	return CreateWithOptions(&Options{SpillBytes: spillBytes, SpillDir: dir}), destroy, nil
+}
+
+func TestSpillConformance(t *testing.T) {
+	graphstore.OrderTest(t, tempSpillGS, 16)
+	graphstore.DeleteTest(t, tempSpillGS)
+	graphstore.CASTest(t, tempSpillGS)
+	graphstore.GarbageCollectionTest(t, tempSpillGS)
+	graphstore.PagedScanTest(t, tempSpillGS)
+	graphstore.ScanFromTest(t, tempSpillGS)
+	graphstore.ReverseOrderTest(t, tempSpillGS, 16)
+	graphstore.WriteStatsTest(t, tempSpillGS)
+	graphstore.WriteIfAbsentTest(t, tempSpillGS)
+	graphstore.SnapshotTest(t, tempSpillGS)
+	graphstore.TransactionTest(t, tempSpillGS)
+	graphstore.ScanOptionsTest(t, tempSpillGS)
+	graphstore.ReadFactsTest(t, tempSpillGS)
+	graphstore.BlobWriteTest(t, tempSpillGS)
+}
+
+// runFiles returns the number of files in dir.
+func runFiles(t *testing.T, dir string) int {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+// checkSameEntries checks that gs and want report the same entries to f.
+func checkSameEntries(t *testing.T, desc string, gs, want Service, f func(Service, gspkg.EntryFunc) error) {
+	collect := func(gs Service) []*spb.Entry {
+		var entries []*spb.Entry
+		if err := f(gs, func(e *spb.Entry) error {
+			entries = append(entries, e)
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", desc, err)
+		}
+		return entries
+	}
+	got, exp := collect(gs), collect(want)
+	if len(got) != len(exp) {
+		t.Fatalf("%s: found %d entries; want %d", desc, len(got), len(exp))
+	}
+	for i, e := range got {
+		if !proto.Equal(e, exp[i]) {
+			t.Fatalf("%s: entry %d is %v; want %v", desc, i, e, exp[i])
+		}
+	}
+}
+
+func TestSpill(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "inmemory.spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mem := CreateWithOptions(nil)
+	gs := CreateWithOptions(&Options{SpillBytes: 4096, SpillDir: dir})
+	src := func(i int) *spb.VName { return &spb.VName{Signature: fmt.Sprintf("sig%04d", i%500)} }
+	for i := 0; i < 1500; i++ {
+		// Every source is written three times, replacing its text.
+		req := &spb.WriteRequest{
+			Source: src(i),
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/node/kind", FactValue: []byte("test")},
+				{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))},
+				{EdgeKind: "/kythe/edge/ref", Target: src(i + 1), FactName: "/"},
+			},
+		}
+		for _, s := range []Service{mem, gs} {
+			if err := s.Write(ctx, req); err != nil {
+				t.Fatalf("Write %d: %v", i, err)
+			}
+		}
+	}
+	for _, s := range []Service{mem, gs} {
+		if ok, err := s.(gspkg.CAS).CompareAndSwap(ctx, src(7), "/kythe/text", []byte("1007"), []byte("swapped")); err != nil || !ok {
+			t.Fatalf("CompareAndSwap: got (%v, %v); want (true, nil)", ok, err)
+		}
+	}
+	if n := runFiles(t, dir); n < 2 {
+		t.Fatalf("Store spilled %d runs; want several", n)
+	}
+
+	check := func() {
+		checkSameEntries(t, "Scan", gs, mem, func(s Service, f gspkg.EntryFunc) error {
+			return s.Scan(ctx, new(spb.ScanRequest), f)
+		})
+		checkSameEntries(t, "ReverseScan", gs, mem, func(s Service, f gspkg.EntryFunc) error {
+			return s.(gspkg.ReverseScanner).ReverseScan(ctx, &spb.ScanRequest{FactPrefix: "/kythe/text"}, f)
+		})
+		checkSameEntries(t, "ScanFrom", gs, mem, func(s Service, f gspkg.EntryFunc) error {
+			return s.(gspkg.ResumableScanner).ScanFrom(ctx, new(spb.ScanRequest), &spb.Entry{Source: src(250), FactName: "/kythe/node/kind"}, f)
+		})
+		for _, i := range []int{0, 7, 123, 499, 500} {
+			checkSameEntries(t, fmt.Sprintf("Read %d", i), gs, mem, func(s Service, f gspkg.EntryFunc) error {
+				return s.Read(ctx, &spb.ReadRequest{Source: src(i)}, f)
+			})
+		}
+		checkSameEntries(t, "Shard", gs, mem, func(s Service, f gspkg.EntryFunc) error {
+			return s.(gspkg.Sharded).Shard(ctx, &spb.ShardRequest{Index: 2, Shards: 5}, f)
+		})
+		if got, want := gs.Stats(), mem.Stats(); got != want {
+			t.Errorf("Stats: got %+v; want %+v", got, want)
+		}
+		checkStats(t, gs)
+	}
+	check()
+
+	for _, s := range []Service{mem, gs} {
+		if err := s.(gspkg.Deleter).Delete(ctx, &gspkg.DeleteRequest{Source: src(123)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check()
+
+	// The runs are removed once the store and its snapshots are closed.
+	snap, err := gs.(gspkg.Snapshotter).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := runFiles(t, dir); n == 0 {
+		t.Error("Runs removed before the store's snapshot was closed")
+	}
+	if err := snap.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := runFiles(t, dir); n != 0 {
+		t.Errorf("Found %d run files after Close; want 0", n)
+	}
+}
+
+func TestWatchOrder(t *testing.T) {
+	ctx := context.Background()
+	gs := Create()
+	const (
+		writers = 4
+		writes  = 200
+	)
+
+	// Every writer writes the same fact, so the last entry watched must be the
+	// stored entry.
+	var last []byte
+	watched := make(chan error, 1)
+	go func() {
+		var n int
+		watched <- gs.(gspkg.Watcher).Watch(ctx, func(e *spb.Entry) error {
+			last = e.FactValue
+			if n++; n == writers*writes {
+				return io.EOF
+			}
+			return nil
+		})
+	}()
+	for gs.(*store).watchers.NumWatchers() == 0 {
+		runtime.Gosched()
+	}
+
+	src := &spb.VName{Signature: "src"}
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := gs.Write(ctx, &spb.WriteRequest{
+					Source: src,
+					Update: []*spb.WriteRequest_Update{{FactName: "/kythe/text", FactValue: []byte(fmt.Sprintf("%d.%04d", w, i))}},
+				}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if err := <-watched; err != nil {
+		t.Fatalf("Watch error: %v", err)
+	}
+
+	var stored []byte
+	if err := gs.Read(ctx, &spb.ReadRequest{Source: src}, func(e *spb.Entry) error {
+		stored = e.FactValue
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if string(last) != string(stored) {
+		t.Errorf("Last watched value %q; stored value %q", last, stored)
+	}
+}
@@ -0,0 +1,435 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package inmemory
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"kythe.io/kythe/go/platform/delimited"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// This file implements the spilling of a store's entries to disk (see
+// Options.SpillBytes).  A spilled store's entries are the union of its
+// in-memory records and a list of runs: immutable temporary files of
+// delimited Entry records, ordered by key, each written from the records held
+// in memory when it was spilled.  Where several hold an entry with the same
+// key, the in-memory record takes precedence over every run, and a newer run
+// over an older.
+
+const (
+	// runIndexInterval is the number of records of a run between the keys
+	// kept in memory to seek within it.
+	runIndexInterval = 256
+
+	// spillMaxRuns is the number of runs at which a store merges its runs into
+	// one, bounding the files read by each lookup.
+	spillMaxRuns = 8
+)
+
+// A run is an immutable file of entries spilled by a store, ordered by key.  A
+// run is shared by its store and the store's views and snapshots; its file is
+// removed once each has released it.
+type run struct {
+	f     *os.File
+	size  int64     // of the file, in bytes
+	index []runMark // of every runIndexInterval-th record
+	refs  int32     // accessed atomically
+}
+
+// A runMark is the key and file offset of a record in a run.
+type runMark struct {
+	key    []byte
+	offset int64
+}
+
+// writeRun writes the records of it to a new run in dir (or the default
+// temporary directory, if dir == "").
+func writeRun(dir string, it entryIter) (*run, error) {
+	f, err := ioutil.TempFile(dir, "kythe.inmemory.run")
+	if err != nil {
+		return nil, fmt.Errorf("error creating run file: %v", err)
+	}
+	r := &run{f: f, refs: 1}
+	if err := r.write(it); err != nil {
+		r.release()
+		return nil, err
+	}
+	return r, nil
+}
+
+// write writes the records of it to r's file and indexes them.
+func (r *run) write(it entryIter) error {
+	buf := bufio.NewWriter(r.f)
+	wr := delimited.NewWriter(buf)
+	for n := 0; ; n++ {
+		rec, err := it.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if n%runIndexInterval == 0 {
+			r.index = append(r.index, runMark{rec.Key, r.size})
+		}
+		data, err := proto.Marshal(rec.Entry)
+		if err != nil {
+			return fmt.Errorf("error encoding entry: %v", err)
+		}
+		size, err := wr.WriteRecord(data)
+		if err != nil {
+			return fmt.Errorf("error writing run file: %v", err)
+		}
+		r.size += int64(size)
+	}
+	if err := buf.Flush(); err != nil {
+		return fmt.Errorf("error writing run file: %v", err)
+	}
+	return nil
+}
+
+// retain adds a reference to r.
+func (r *run) retain() { atomic.AddInt32(&r.refs, 1) }
+
+// release removes a reference to r, removing its file once it has none.
+func (r *run) release() {
+	if atomic.AddInt32(&r.refs, -1) == 0 {
+		r.f.Close()
+		os.Remove(r.f.Name())
+	}
+}
+
+// iter returns an iterator over the records of r, in order, starting with the
+// first whose key is not less than start.
+func (r *run) iter(start []byte) entryIter {
+	// Begin with the last indexed record before start.
+	i := sort.Search(len(r.index), func(i int) bool {
+		return bytes.Compare(r.index[i].key, start) >= 0
+	})
+	var offset int64
+	if i > 0 {
+		offset = r.index[i-1].offset
+	}
+	return &runIter{
+		rd:    delimited.NewReader(io.NewSectionReader(r.f, offset, r.size-offset)),
+		start: start,
+	}
+}
+
+// get returns r's record with the given key, if any.
+func (r *run) get(key []byte) (*spb.Entry, bool, error) {
+	rec, err := r.iter(key).next()
+	if err == io.EOF || err == nil && !bytes.Equal(rec.Key, key) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return rec.Entry, true, nil
+}
+
+// block returns the records of r from its i-th indexed record to the next.
+func (r *run) block(i int) ([]compare.KeyedEntry, error) {
+	end := r.size
+	if i+1 < len(r.index) {
+		end = r.index[i+1].offset
+	}
+	it := &runIter{rd: delimited.NewReader(io.NewSectionReader(r.f, r.index[i].offset, end-r.index[i].offset))}
+	var recs []compare.KeyedEntry
+	for {
+		rec, err := it.next()
+		if err == io.EOF {
+			return recs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// An entryIter iterates over a sequence of records.
+type entryIter interface {
+	// next returns the next record, or io.EOF at the end of the sequence.
+	next() (compare.KeyedEntry, error)
+}
+
+// A sliceIter iterates over a slice of records, in order or in reverse.
+type sliceIter struct {
+	recs    []compare.KeyedEntry
+	reverse bool
+}
+
+func (it *sliceIter) next() (compare.KeyedEntry, error) {
+	if len(it.recs) == 0 {
+		return compare.KeyedEntry{}, io.EOF
+	} else if it.reverse {
+		rec := it.recs[len(it.recs)-1]
+		it.recs = it.recs[:len(it.recs)-1]
+		return rec, nil
+	}
+	rec := it.recs[0]
+	it.recs = it.recs[1:]
+	return rec, nil
+}
+
+// A runIter iterates over the records of a run, in order, skipping those
+// whose keys are less than start.
+type runIter struct {
+	rd    *delimited.Reader
+	start []byte
+}
+
+func (it *runIter) next() (compare.KeyedEntry, error) {
+	for {
+		data, err := it.rd.Next()
+		if err == io.EOF {
+			return compare.KeyedEntry{}, io.EOF
+		} else if err != nil {
+			return compare.KeyedEntry{}, fmt.Errorf("error reading run file: %v", err)
+		}
+		e := new(spb.Entry)
+		if err := proto.Unmarshal(data, e); err != nil {
+			return compare.KeyedEntry{}, fmt.Errorf("error decoding run entry: %v", err)
+		}
+		rec := compare.NewKeyedEntry(e)
+		if it.start != nil && bytes.Compare(rec.Key, it.start) < 0 {
+			continue
+		}
+		it.start = nil
+		return rec, nil
+	}
+}
+
+// A reverseRunIter iterates over the records of a run in reverse, reading one
+// indexed block at a time.
+type reverseRunIter struct {
+	r     *run
+	block int // the next block to read
+	recs  []compare.KeyedEntry
+}
+
+func (it *reverseRunIter) next() (compare.KeyedEntry, error) {
+	for len(it.recs) == 0 {
+		if it.block < 0 {
+			return compare.KeyedEntry{}, io.EOF
+		}
+		recs, err := it.r.block(it.block)
+		if err != nil {
+			return compare.KeyedEntry{}, err
+		}
+		it.recs, it.block = recs, it.block-1
+	}
+	rec := it.recs[len(it.recs)-1]
+	it.recs = it.recs[:len(it.recs)-1]
+	return rec, nil
+}
+
+// A mergedIter merges iterators over records in the same order (or reverse
+// order).  Of the records with the same key, only that of the earliest
+// iterator is returned.
+type mergedIter struct {
+	its     []entryIter
+	heads   []compare.KeyedEntry
+	ok      []bool // whether heads[i] is valid
+	reverse bool
+	started bool
+}
+
+func (m *mergedIter) next() (compare.KeyedEntry, error) {
+	if !m.started {
+		m.heads, m.ok = make([]compare.KeyedEntry, len(m.its)), make([]bool, len(m.its))
+		for i := range m.its {
+			if err := m.advance(i); err != nil {
+				return compare.KeyedEntry{}, err
+			}
+		}
+		m.started = true
+	}
+
+	best := -1
+	for i, ok := range m.ok {
+		if !ok {
+			continue
+		} else if best < 0 {
+			best = i
+		} else if c := bytes.Compare(m.heads[i].Key, m.heads[best].Key); c < 0 && !m.reverse || c > 0 && m.reverse {
+			best = i
+		}
+	}
+	if best < 0 {
+		return compare.KeyedEntry{}, io.EOF
+	}
+	rec := m.heads[best]
+	for i, ok := range m.ok {
+		if ok && bytes.Equal(m.heads[i].Key, rec.Key) {
+			if err := m.advance(i); err != nil {
+				return compare.KeyedEntry{}, err
+			}
+		}
+	}
+	return rec, nil
+}
+
+// advance replaces the head of the i-th iterator with its next record.
+func (m *mergedIter) advance(i int) error {
+	rec, err := m.its[i].next()
+	if err == io.EOF {
+		m.ok[i] = false
+		return nil
+	} else if err != nil {
+		return err
+	}
+	m.heads[i], m.ok[i] = rec, true
+	return nil
+}
+
+// A view is an immutable view of a store's entries: its in-memory records and
+// its runs, newest first.  A view's runs must be released once it is no
+// longer used.
+type view struct {
+	records []compare.KeyedEntry
+	runs    []*run
+	entries int64
+}
+
+// iter returns an iterator over the entries of v, in order, starting with the
+// first whose key is not less than start.
+func (v *view) iter(start []byte) entryIter {
+	i, _ := search(v.records, start)
+	mem := &sliceIter{recs: v.records[i:]}
+	if len(v.runs) == 0 {
+		return mem
+	}
+	its := []entryIter{mem}
+	for _, r := range v.runs {
+		its = append(its, r.iter(start))
+	}
+	return &mergedIter{its: its}
+}
+
+// reverseIter returns an iterator over the entries of v in reverse order.
+func (v *view) reverseIter() entryIter {
+	mem := &sliceIter{recs: v.records, reverse: true}
+	if len(v.runs) == 0 {
+		return mem
+	}
+	its := []entryIter{mem}
+	for _, r := range v.runs {
+		its = append(its, &reverseRunIter{r: r, block: len(r.index) - 1})
+	}
+	return &mergedIter{its: its, reverse: true}
+}
+
+// release releases the runs of v.
+func (v *view) release() {
+	for _, r := range v.runs {
+		r.release()
+	}
+}
+
+// retainRuns returns a copy of the store's runs, each retained.  s.mu must be
+// held.
+func (s *store) retainRuns() []*run {
+	runs := append([]*run(nil), s.runs...)
+	for _, r := range runs {
+		r.retain()
+	}
+	return runs
+}
+
+// releaseRuns releases each of the store's runs.  s.mu must be held.
+func (s *store) releaseRuns() {
+	for _, r := range s.runs {
+		r.release()
+	}
+	s.runs = nil
+}
+
+// spilling reports whether the store spills its entries to disk.
+func (s *store) spilling() bool { return s.opts.SpillBytes > 0 && s.lru == nil }
+
+// spill writes the store's in-memory records to a new run if adding size
+// bytes of records would exceed its SpillBytes, merging the store's runs once
+// it has spillMaxRuns.  s.mu must be held.
+func (s *store) spill(size int64) error {
+	if !s.spilling() || s.memBytes == 0 || s.memBytes+size <= s.opts.SpillBytes {
+		return nil
+	}
+	s.merge()
+	r, err := writeRun(s.opts.SpillDir, &sliceIter{recs: s.records})
+	if err != nil {
+		return err
+	}
+	s.runs = append([]*run{r}, s.runs...)
+	s.records, s.memBytes = nil, 0
+	if len(s.runs) < spillMaxRuns {
+		return nil
+	}
+	return s.compact(nil)
+}
+
+// compact replaces the store's runs and in-memory records with a single run of
+// their entries, omitting those for which drop (if non-nil) returns true.
+// s.mu must be held.
+func (s *store) compact(drop func(*spb.Entry) bool) error {
+	s.merge()
+	v := &view{records: s.records, runs: s.runs}
+	var entries, size int64 // of the dropped entries
+	r, err := writeRun(s.opts.SpillDir, &dropIter{v.iter(nil), func(rec compare.KeyedEntry) bool {
+		if drop == nil || !drop(rec.Entry) {
+			return false
+		}
+		entries++
+		size += recordSize(rec)
+		return true
+	}})
+	if err != nil {
+		return err
+	}
+	s.releaseRuns()
+	s.runs = []*run{r}
+	s.records, s.memBytes = nil, 0
+	s.entries -= entries
+	s.bytes -= size
+	return nil
+}
+
+// A dropIter is an iterator over the records of it for which drop returns
+// false.
+type dropIter struct {
+	it   entryIter
+	drop func(compare.KeyedEntry) bool
+}
+
+func (d *dropIter) next() (compare.KeyedEntry, error) {
+	for {
+		rec, err := d.it.next()
+		if err != nil || !d.drop(rec) {
+			return rec, err
+		}
+	}
+}
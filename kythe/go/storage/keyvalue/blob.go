@@ -0,0 +1,106 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keyvalue
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// BeginFact implements part of the graphstore.BlobWriter interface.  The value
+// is buffered in memory as it is written and stored as a single key-value
+// entry, like any other fact, when the WriteCloser is closed.  Nothing is
+// written to the DB by an abandoned writer.
+func (s *Store) BeginFact(ctx context.Context, source *spb.VName, factName string) (io.WriteCloser, error) {
+	if factName == "" {
+		return nil, errors.New("missing fact name")
+	}
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return nil, err
+	}
+	key, err := kf.encodeKey(source, factName, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("encoding error: %v", err)
+	}
+	return &blobWriter{ctx: ctx, s: s, source: source, key: key}, nil
+}
+
+type blobWriter struct {
+	ctx    context.Context
+	s      *Store
+	source *spb.VName
+	key    []byte
+
+	buf    bytes.Buffer
+	closed bool
+}
+
+// Write implements the io.Writer interface.
+func (b *blobWriter) Write(p []byte) (int, error) {
+	if b.closed {
+		return 0, errors.New("fact value writer is closed")
+	}
+	return b.buf.Write(p)
+}
+
+// Close implements the io.Closer interface by writing the fact's value.
+func (b *blobWriter) Close() (err error) {
+	if b.closed {
+		return errors.New("fact value writer is closed")
+	}
+	b.closed = true
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
+
+	counted, unlock, err := b.s.lockCounts(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	deltas := make(countDeltas)
+	if len(counted) > 0 {
+		if _, err := b.s.db.Get(b.key, nil); err == io.EOF {
+			if err := b.s.addCounts(deltas, counted, b.source, 1); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return fmt.Errorf("db get error: %v", err)
+		}
+	}
+
+	wr, err := b.s.db.Writer()
+	if err != nil {
+		return fmt.Errorf("db writer error: %v", err)
+	}
+	defer func() {
+		if cErr := wr.Close(); err == nil && cErr != nil {
+			err = fmt.Errorf("db writer close error: %v", cErr)
+		}
+	}()
+	if err := wr.Write(b.key, b.buf.Bytes()); err != nil {
+		return fmt.Errorf("db write error: %v", err)
+	}
+	return b.s.writeCounts(wr, deltas)
+}
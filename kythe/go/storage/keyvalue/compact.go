@@ -0,0 +1,160 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keyvalue
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrUnsupported is returned by a Store whose DB does not support a
+// maintenance operation.
+var ErrUnsupported = errors.New("operation not supported by DB")
+
+// Compactor is an optional interface for a DB that can compact the storage of
+// a range of keys, discarding the space used by deleted or overwritten values.
+// Compaction must be safe while the DB is being read.
+type Compactor interface {
+	// CompactRange compacts the storage of the keys within the given Range, or
+	// of every key if the Range is nil.
+	CompactRange(*Range) error
+}
+
+// StatsReporter is an optional interface for a DB that reports statistics of
+// its internal storage.
+type StatsReporter interface {
+	// DBStats returns the current statistics of the DB's storage.
+	DBStats() (*DBStats, error)
+}
+
+// Backuper is an optional interface for a DB that can write a consistent copy
+// of itself while it is being read and written.
+type Backuper interface {
+	// Backup writes a copy of the DB, as of the time of the call, to the given
+	// directory, which must not exist.
+	Backup(ctx context.Context, destDir string) error
+}
+
+// DBStats are statistics of the internal storage of a DB organized as a
+// log-structured merge tree (e.g. LevelDB).
+type DBStats struct {
+	// Levels are the statistics of each level of the tree holding any files.
+	Levels []LevelStats
+
+	// ReadAmplification is the maximum number of files consulted to read a key.
+	ReadAmplification float64
+
+	// WriteAmplification is the ratio of the bytes written by compactions to
+	// the bytes written to the DB.
+	WriteAmplification float64
+}
+
+// LevelStats are statistics of a single level of a DB's storage.
+type LevelStats struct {
+	Level int
+	Files int
+	Bytes int64
+
+	// CompactionTime, CompactionReadBytes, and CompactionWriteBytes are the
+	// totals of the compactions into the level since the DB was opened.
+	CompactionTime       time.Duration
+	CompactionReadBytes  int64
+	CompactionWriteBytes int64
+}
+
+// Compact compacts the storage of the keys within r, or of the entire DB if r
+// is nil.  It returns ErrUnsupported if the Store's DB is not a Compactor.
+// Reads may continue during compaction.
+func (s *Store) Compact(ctx context.Context, r *Range) error {
+	c, ok := s.db.(Compactor)
+	if !ok {
+		return ErrUnsupported
+	}
+	return c.CompactRange(r)
+}
+
+// CompactCorpus compacts the storage of the entries whose source is in the
+// given corpus by compacting the corpus' range of keys (see
+// NewCorpusGraphStore).  As legacy entry keys begin with the source's signature
+// (see EncodeKey), a corpus' entries are then interleaved with those of every
+// other corpus, so it returns ErrUnsupported if the Store's keys do not have the
+// per-corpus layout (see MigrateKeys); use Compact instead.  It also returns
+// ErrUnsupported if the Store's DB is not a Compactor.
+func (s *Store) CompactCorpus(ctx context.Context, corpus string) error {
+	c, ok := s.db.(Compactor)
+	if !ok {
+		return ErrUnsupported
+	}
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	} else if !kf.byCorpus {
+		return ErrUnsupported
+	}
+	r, err := kf.corpusRange(corpus)
+	if err != nil {
+		return err
+	}
+	return c.CompactRange(r)
+}
+
+// keyCorpus returns the source corpus of an encoded entry key.
+func keyCorpus(key []byte) string {
+	head, src, err := splitEntryKey(key)
+	if err != nil {
+		return ""
+	} else if bytes.HasPrefix(head, corpusEntryKeyPrefixBytes) {
+		return string(head[len(corpusEntryKeyPrefixBytes) : len(head)-1])
+	}
+	if i := bytes.IndexByte(src, entryKeySep); i >= 0 {
+		src = src[:i]
+	}
+	return string(vNameCorpus(src))
+}
+
+// vNameCorpus returns the corpus of an encoded VName.
+func vNameCorpus(enc []byte) []byte {
+	parts := bytes.SplitN(enc, []byte(vNameFieldSep), 3)
+	if len(parts) < 2 {
+		return nil
+	}
+	return parts[1]
+}
+
+// Backup writes a consistent copy of the Store's DB to destDir, which must not
+// exist, while the Store may continue to be read and written.  It returns
+// ErrUnsupported if the DB is not a Backuper.
+func (s *Store) Backup(ctx context.Context, destDir string) error {
+	b, ok := s.db.(Backuper)
+	if !ok {
+		return ErrUnsupported
+	}
+	return b.Backup(ctx, destDir)
+}
+
+// DBStats returns the statistics of the Store's DB.  It returns ErrUnsupported
+// if the DB is not a StatsReporter.
+func (s *Store) DBStats(ctx context.Context) (*DBStats, error) {
+	sr, ok := s.db.(StatsReporter)
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	return sr.DBStats()
+}
@@ -0,0 +1,253 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keyvalue
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Shard counts are persisted outside of the entry key space as
+//   "meta:counted_shards" == "<shards>,<shards>,..."
+//   "meta:shard_count:<shards>:<index>" == "<count>"
+// where each counted number of shards has a count for each of its indices.
+const (
+	countedShardsKey    = "meta:counted_shards"
+	shardCountKeyPrefix = "meta:shard_count:"
+)
+
+func shardCountKey(shards, index int64) []byte {
+	return []byte(fmt.Sprintf("%s%d:%d", shardCountKeyPrefix, shards, index))
+}
+
+// recordedCountedShards returns the numbers of shards whose counts are
+// maintained in db.
+func recordedCountedShards(db DB) ([]int64, error) {
+	val, err := db.Get([]byte(countedShardsKey), nil)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("db get error: %v", err)
+	}
+	var shards []int64
+	for _, s := range strings.Split(string(val), ",") {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s record %q: %v", countedShardsKey, val, err)
+		}
+		shards = append(shards, n)
+	}
+	return shards, nil
+}
+
+// lockCounts locks the Store's shard counts for a write of its entries.  If
+// the Store maintains any shard counts, or exclusive is set (as for a write
+// that checks its keys before writing them), they are returned and s.countMu
+// is held exclusively so that the written keys may be checked and counted;
+// otherwise, s.countMu is only held for reading so that writes may proceed
+// concurrently.  The returned function releases the lock.
+func (s *Store) lockCounts(exclusive bool) ([]int64, func(), error) {
+	s.countOnce.Do(func() { s.counted, s.countErr = recordedCountedShards(s.db) })
+	s.countMu.RLock()
+	if s.countErr != nil {
+		s.countMu.RUnlock()
+		return nil, nil, s.countErr
+	} else if len(s.counted) == 0 && !exclusive {
+		return nil, s.countMu.RUnlock, nil
+	}
+	s.countMu.RUnlock()
+	s.countMu.Lock()
+	return s.counted, s.countMu.Unlock, nil
+}
+
+// countDeltas are pending changes to a Store's shard counts, keyed by the
+// counts' DB keys.
+type countDeltas map[string]int64
+
+// addCounts records n new entries (or removed entries, if n < 0) for src in each of
+// the given numbers of shards.
+func (s *Store) addCounts(d countDeltas, shards []int64, src *spb.VName, n int64) error {
+	sf, _, err := s.loadShardFunc()
+	if err != nil {
+		return err
+	}
+	for _, num := range shards {
+		var index int64
+		if num > 1 {
+			index = int64(sf(src, int(num)))
+		}
+		d[string(shardCountKey(num, index))] += n
+	}
+	return nil
+}
+
+// writeCounts adds the updated shard counts for d to wr.  s.countMu must be
+// held exclusively.
+func (s *Store) writeCounts(wr Writer, d countDeltas) error {
+	for key, n := range d {
+		if n == 0 {
+			continue
+		}
+		count, err := s.readCount([]byte(key))
+		if err != nil {
+			return err
+		}
+		if err := wr.Write([]byte(key), []byte(strconv.FormatInt(count+n, 10))); err != nil {
+			return fmt.Errorf("db write error: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) readCount(key []byte) (int64, error) {
+	val, err := s.db.Get(key, nil)
+	if err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("db get error: %v", err)
+	}
+	n, err := strconv.ParseInt(string(val), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid shard count %q: %v", val, err)
+	}
+	return n, nil
+}
+
+// storedCount returns the maintained count of the given shard, if any.
+func (s *Store) storedCount(req *spb.CountRequest) (int64, bool, error) {
+	s.countOnce.Do(func() { s.counted, s.countErr = recordedCountedShards(s.db) })
+	s.countMu.RLock()
+	defer s.countMu.RUnlock()
+	if s.countErr != nil {
+		return 0, false, s.countErr
+	}
+	for _, num := range s.counted {
+		if num == req.Shards {
+			n, err := s.readCount(shardCountKey(req.Shards, req.Index))
+			return n, err == nil, err
+		}
+	}
+	return 0, false, nil
+}
+
+// Recount implements the graphstore.Recounter interface.  The counts are
+// rebuilt from a scan of the Store's entries while writes are blocked, and
+// they are then persisted in the DB alongside the entries.  Counts of more
+// than 1 shard require the Store to have a ShardFunc.
+func (s *Store) Recount(ctx context.Context, shards ...int64) (err error) {
+	sf, _, err := s.loadShardFunc()
+	if err != nil {
+		return err
+	}
+	for _, num := range shards {
+		if num < 1 {
+			return fmt.Errorf("invalid number of shards: %d", num)
+		} else if num > 1 && sf == nil {
+			return errors.New("counts of more than 1 shard require a ShardFunc")
+		}
+	}
+
+	s.countOnce.Do(func() { s.counted, s.countErr = recordedCountedShards(s.db) })
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+	if s.countErr != nil {
+		return s.countErr
+	}
+	counted := mergeShards(s.counted, shards)
+	if len(counted) == 0 {
+		return nil
+	}
+
+	counts := make(map[int64][]int64)
+	for _, num := range counted {
+		counts[num] = make([]int64, num)
+	}
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	iter, err := s.db.ScanPrefix(kf.prefix, &Options{LargeRead: true})
+	if err != nil {
+		return fmt.Errorf("db seek error: %v", err)
+	}
+	if err := streamEntries(ctx, iter, func(e *spb.Entry) error {
+		for _, num := range counted {
+			var index int
+			if num > 1 {
+				index = sf(e.Source, int(num))
+			}
+			counts[num][index]++
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	wr, err := s.db.Writer()
+	if err != nil {
+		return fmt.Errorf("db writer error: %v", err)
+	}
+	defer func() {
+		if cErr := wr.Close(); err == nil && cErr != nil {
+			err = fmt.Errorf("db writer close error: %v", cErr)
+		}
+		if err == nil {
+			s.counted = counted
+		}
+	}()
+	var nums []string
+	for _, num := range counted {
+		nums = append(nums, strconv.FormatInt(num, 10))
+		for i, n := range counts[num] {
+			if err := wr.Write(shardCountKey(num, int64(i)), []byte(strconv.FormatInt(n, 10))); err != nil {
+				return fmt.Errorf("db write error: %v", err)
+			}
+		}
+	}
+	if err := wr.Write([]byte(countedShardsKey), []byte(strings.Join(nums, ","))); err != nil {
+		return fmt.Errorf("db write error: %v", err)
+	}
+	return nil
+}
+
+// mergeShards returns the sorted union of the numbers of shards in a and b.
+func mergeShards(a, b []int64) []int64 {
+	set := make(map[int64]bool)
+	for _, n := range append(append([]int64(nil), a...), b...) {
+		set[n] = true
+	}
+	merged := make(int64s, 0, len(set))
+	for n := range set {
+		merged = append(merged, n)
+	}
+	sort.Sort(merged)
+	return merged
+}
+
+type int64s []int64
+
+func (s int64s) Len() int           { return len(s) }
+func (s int64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,468 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keyvalue
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/util/datasize"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// Per-corpus key layout:
+//   The legacy entry keys (see EncodeKey) begin with the source's encoded
+//   VName, and so the entries of every corpus are interleaved by their
+//   signatures.  In the per-corpus layout, each key instead begins with a
+//   distinct prefix and the source's corpus:
+//     "centry:<corpus>_<source>_<edgeKind>_<factName>_<target>" == "<factValue>"
+//   so that each corpus' entries are a contiguous range of keys, which may be
+//   scanned, sized, compacted, and deleted without reading the entries of any
+//   other corpus.  Entries are then ordered first by their corpora, and so the
+//   Scans of a per-corpus Store are not in the compare.Entries order required
+//   by, e.g., graphstore.CollectGarbage.
+//
+//   A DB records the version of the per-corpus layout in its keyFormatKey; a
+//   DB with no record has the legacy layout.  Since the layouts' prefixes differ, a DB
+//   having entries in both (e.g. one whose migration was interrupted, or one
+//   written by an older binary after its migration) is found with a seek to
+//   each prefix and rejected with ErrMixedKeyFormats.
+
+const (
+	corpusEntryKeyPrefix = "centry:"
+
+	// keyFormatKey is the DB key recording the version of the layout of the
+	// Store's entry keys, if it is not the legacy layout (version 1).  It lies
+	// outside of the entry key space.
+	keyFormatKey = "meta:key_format_version"
+
+	// corpusKeyFormat is the version of the per-corpus layout.
+	corpusKeyFormat = "2"
+)
+
+var corpusEntryKeyPrefixBytes = []byte(corpusEntryKeyPrefix)
+
+// ErrMixedKeyFormats is returned by a Store whose DB has entries in both the
+// legacy and per-corpus key layouts.
+var ErrMixedKeyFormats = errors.New("db has entries in both the legacy and per-corpus key layouts; finish migrating it with MigrateKeys (gstool migrate_keys)")
+
+// A keyFormat is a layout of a Store's entry keys.
+type keyFormat struct {
+	prefix   []byte // the prefix of every entry key
+	end      []byte // the end of the Range of entry keys
+	byCorpus bool   // whether each key is prefixed by its source's corpus
+}
+
+var (
+	legacyKeys = &keyFormat{prefix: entryKeyPrefixBytes, end: entryKeyPrefixEndRange}
+	corpusKeys = &keyFormat{prefix: corpusEntryKeyPrefixBytes, end: prefixEnd(corpusEntryKeyPrefixBytes), byCorpus: true}
+)
+
+// appendHead appends the part of an entry key in the layout f preceding its
+// source, for a source in the given corpus, to buf.
+func (f *keyFormat) appendHead(buf []byte, corpus string) []byte {
+	buf = append(buf, f.prefix...)
+	if f.byCorpus {
+		buf = append(append(buf, corpus...), entryKeySep)
+	}
+	return buf
+}
+
+// corpusRange returns the Range of the keys of the entries whose source is in
+// the given corpus.  f must have the per-corpus layout.
+func (f *keyFormat) corpusRange(corpus string) (*Range, error) {
+	if strings.ContainsAny(corpus, entryKeySepStr+vNameFieldSep) {
+		return nil, fmt.Errorf("invalid corpus: %q", corpus)
+	}
+	start := f.appendHead(nil, corpus)
+	return &Range{Start: start, End: prefixEnd(start)}, nil
+}
+
+// prefixEnd returns the first key following every key with the given prefix,
+// whose last byte must not be 0xff.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	end[len(end)-1]++
+	return end
+}
+
+// splitEntryKey splits an entry key in either layout into the part preceding
+// its source and the rest, which is laid out as the legacy key following its
+// prefix.
+func splitEntryKey(key []byte) (head, rest []byte, err error) {
+	if bytes.HasPrefix(key, entryKeyPrefixBytes) {
+		return key[:len(entryKeyPrefixBytes)], key[len(entryKeyPrefixBytes):], nil
+	} else if bytes.HasPrefix(key, corpusEntryKeyPrefixBytes) {
+		if i := bytes.IndexByte(key[len(corpusEntryKeyPrefixBytes):], entryKeySep); i >= 0 {
+			n := len(corpusEntryKeyPrefixBytes) + i + 1
+			return key[:n], key[n:], nil
+		}
+		return nil, nil, fmt.Errorf("key is missing its corpus: %q", key)
+	}
+	return nil, nil, fmt.Errorf("key is not prefixed with entry prefix %q or %q", entryKeyPrefix, corpusEntryKeyPrefix)
+}
+
+// recordedKeyFormat returns the layout of db's entry keys.  It returns
+// ErrMixedKeyFormats if db has entries in both layouts.
+func recordedKeyFormat(db DB) (*keyFormat, error) {
+	val, err := db.Get([]byte(keyFormatKey), nil)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("db get error: %v", err)
+	} else if err == nil && string(val) != corpusKeyFormat {
+		return nil, fmt.Errorf("unknown key format version: %q", val)
+	}
+	legacy, err := hasKeys(db, entryKeyPrefixBytes)
+	if err != nil {
+		return nil, err
+	}
+	corpus, err := hasKeys(db, corpusEntryKeyPrefixBytes)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case legacy && (corpus || val != nil):
+		return nil, ErrMixedKeyFormats
+	case corpus || val != nil:
+		return corpusKeys, nil
+	default:
+		return legacyKeys, nil
+	}
+}
+
+// hasKeys reports whether db has any key with the given prefix.
+func hasKeys(db DB, prefix []byte) (bool, error) {
+	iter, err := db.ScanPrefix(prefix, nil)
+	if err != nil {
+		return false, fmt.Errorf("db seek error: %v", err)
+	}
+	defer iter.Close()
+	if _, _, err := iter.Next(); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("db iteration error: %v", err)
+	}
+	return true, nil
+}
+
+// recordCorpusKeys records in db that its entry keys have the per-corpus
+// layout.
+func recordCorpusKeys(db DB) error {
+	wr, err := db.Writer()
+	if err == graphstore.ErrReadOnly {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("db writer error: %v", err)
+	}
+	if err := wr.Write([]byte(keyFormatKey), []byte(corpusKeyFormat)); err != nil {
+		wr.Close()
+		return fmt.Errorf("db write error: %v", err)
+	} else if err := wr.Close(); err != nil {
+		return fmt.Errorf("db writer close error: %v", err)
+	}
+	return nil
+}
+
+// loadKeyFormat returns the layout of the Store's entry keys.
+func (s *Store) loadKeyFormat() (*keyFormat, error) {
+	s.formatOnce.Do(func() { s.format, s.formatErr = recordedKeyFormat(s.db) })
+	return s.format, s.formatErr
+}
+
+// NewCorpusGraphStore returns a graphstore.Service backed by the given
+// keyvalue DB whose entry keys have the per-corpus layout.  The layout is
+// recorded in db so that every later Store for db, including those from
+// NewGraphStore, uses it.  It is an error if db has entries in the legacy
+// layout; they must first be rewritten by MigrateKeys.
+func NewCorpusGraphStore(db DB) (*Store, error) {
+	f, err := recordedKeyFormat(db)
+	if err != nil {
+		return nil, err
+	} else if f != corpusKeys {
+		if legacy, err := hasKeys(db, entryKeyPrefixBytes); err != nil {
+			return nil, err
+		} else if legacy {
+			return nil, errors.New("db has entries in the legacy key layout; migrate them with MigrateKeys (gstool migrate_keys)")
+		}
+		if err := recordCorpusKeys(db); err != nil {
+			return nil, err
+		}
+	}
+
+	s := NewGraphStore(db)
+	s.formatOnce.Do(func() { s.format = corpusKeys })
+	return s, nil
+}
+
+// CorpusKeyed reports whether the Store's entry keys have the per-corpus
+// layout, by which each corpus' entries are a contiguous range of keys.  It
+// returns ErrMixedKeyFormats if the Store's DB has entries in both layouts.
+func (s *Store) CorpusKeyed() (bool, error) {
+	f, err := s.loadKeyFormat()
+	if err != nil {
+		return false, err
+	}
+	return f.byCorpus, nil
+}
+
+// MigrateProgress reports the progress of MigrateKeys.
+type MigrateProgress struct {
+	// Entries is the number of entries rewritten so far.
+	Entries int64
+}
+
+// Limits of each batch of entries rewritten by MigrateKeys or removed by
+// DeleteCorpus.
+const (
+	corpusBatchEntries = 32000
+	corpusBatchSize    = 64 * datasize.Mebibyte
+)
+
+// MigrateKeys rewrites each of db's entries in the legacy key layout into the
+// per-corpus layout and records that db's keys have the per-corpus layout.
+// The target index and shard counts do not depend on the layout and are kept.
+// It must not be called while db is used by any Store.
+//
+// Entries are moved in batches, each applied atomically by a single Writer.
+// Until every batch is moved, db has entries in both layouts and so Stores
+// reject it with ErrMixedKeyFormats; an interrupted migration is finished by
+// calling MigrateKeys again.  If progress != nil, it is called after each
+// batch.
+func MigrateKeys(ctx context.Context, db DB, progress func(*MigrateProgress)) error {
+	if val, err := db.Get([]byte(keyFormatKey), nil); err == io.EOF {
+		if err := recordCorpusKeys(db); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("db get error: %v", err)
+	} else if string(val) != corpusKeyFormat {
+		return fmt.Errorf("unknown key format version: %q", val)
+	}
+
+	p := new(MigrateProgress)
+	for {
+		n, err := migrateBatch(ctx, db)
+		if err != nil {
+			return err
+		} else if n == 0 {
+			return nil
+		}
+		p.Entries += int64(n)
+		if progress != nil {
+			progress(p)
+		}
+	}
+}
+
+// migrateBatch moves the first batch of db's remaining legacy entries into the
+// per-corpus layout and returns the number moved.
+func migrateBatch(ctx context.Context, db DB) (int, error) {
+	iter, err := db.ScanPrefix(entryKeyPrefixBytes, &Options{LargeRead: true})
+	if err != nil {
+		return 0, fmt.Errorf("db seek error: %v", err)
+	}
+	var kvs []keyValue
+	var size datasize.Size
+	for len(kvs) < corpusBatchEntries && size < corpusBatchSize {
+		if err := ctx.Err(); err != nil {
+			iter.Close()
+			return 0, err
+		}
+		key, val, err := iter.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			iter.Close()
+			return 0, fmt.Errorf("db iteration error: %v", err)
+		}
+		kvs = append(kvs, keyValue{key: append([]byte(nil), key...), val: append([]byte(nil), val...)})
+		size += datasize.Size(len(key) + len(val))
+	}
+	iter.Close()
+	if len(kvs) == 0 {
+		return 0, nil
+	}
+
+	wr, err := db.Writer()
+	if err == graphstore.ErrReadOnly {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("db writer error: %v", err)
+	}
+	for _, kv := range kvs {
+		key := append(corpusKeys.appendHead(nil, keyCorpus(kv.key)), kv.key[len(entryKeyPrefixBytes):]...)
+		if err := wr.Write(key, kv.val); err != nil {
+			wr.Close()
+			return 0, fmt.Errorf("db write error: %v", err)
+		} else if err := wr.Delete(kv.key); err != nil {
+			wr.Close()
+			return 0, fmt.Errorf("db delete error: %v", err)
+		}
+	}
+	if err := wr.Close(); err != nil {
+		return 0, fmt.Errorf("db writer close error: %v", err)
+	}
+	return len(kvs), nil
+}
+
+// ScanCorpus calls f with each entry matching req whose source is in the
+// given corpus.  If the Store's keys have the per-corpus layout, only the
+// corpus' range of keys is read; otherwise, every entry is scanned.
+func (s *Store) ScanCorpus(ctx context.Context, corpus string, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	var iter Iterator
+	if kf.byCorpus {
+		r, err := kf.corpusRange(corpus)
+		if err != nil {
+			return err
+		}
+		iter, err = s.db.ScanRange(r, &Options{LargeRead: true})
+	} else {
+		iter, err = s.db.ScanPrefix(kf.prefix, &Options{LargeRead: true})
+	}
+	if err != nil {
+		return fmt.Errorf("db seek error: %v", err)
+	}
+	return decodeEntries(ctx, iter, &entryDecoder{unsafe: s.unsafeRead}, func(e *spb.Entry) error {
+		if e.Source == nil || e.Source.Corpus != corpus || !graphstore.EntryMatchesScan(req, e) {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+// CorpusSize returns the approximate number of bytes used to store the
+// entries whose source is in the given corpus.  It returns ErrUnsupported if
+// the Store's keys do not have the per-corpus layout and
+// graphstore.ErrDiskSizeUnknown if its DB is not a SizeEstimator.
+func (s *Store) CorpusSize(ctx context.Context, corpus string) (int64, error) {
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return 0, err
+	} else if !kf.byCorpus {
+		return 0, ErrUnsupported
+	}
+	se, ok := s.db.(SizeEstimator)
+	if !ok {
+		return 0, graphstore.ErrDiskSizeUnknown
+	}
+	r, err := kf.corpusRange(corpus)
+	if err != nil {
+		return 0, err
+	}
+	return se.ApproximateSize(r)
+}
+
+// DeleteCorpus removes every entry whose source is in the given corpus by
+// deleting the corpus' range of keys, which does not read the entries of any
+// other corpus.  The entries are removed in batches, each applied atomically;
+// the storage they used is reclaimed by a later compaction (see
+// CompactCorpus).  It returns ErrUnsupported if the Store's keys do not have
+// the per-corpus layout.
+func (s *Store) DeleteCorpus(ctx context.Context, corpus string) error {
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	} else if !kf.byCorpus {
+		return ErrUnsupported
+	}
+	r, err := kf.corpusRange(corpus)
+	if err != nil {
+		return err
+	}
+	for {
+		if n, err := s.deleteBatch(ctx, r); err != nil {
+			return err
+		} else if n == 0 {
+			return nil
+		}
+	}
+}
+
+// deleteBatch removes the first batch of the entries in r and returns the
+// number removed.
+func (s *Store) deleteBatch(ctx context.Context, r *Range) (n int, err error) {
+	s.loadTargetIndexed()
+	counted, unlock, err := s.lockCounts(false)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	indexed := s.indexed || s.indexing
+	if s.indexErr != nil {
+		return 0, s.indexErr
+	}
+
+	iter, err := s.db.ScanRange(r, &Options{LargeRead: true})
+	if err != nil {
+		return 0, fmt.Errorf("db seek error: %v", err)
+	}
+	var keys [][]byte
+	deltas := make(countDeltas)
+	var dec entryDecoder
+	if err := streamKeys(ctx, iter, func(key []byte) error {
+		if len(keys) == corpusBatchEntries {
+			return io.EOF
+		}
+		if len(counted) > 0 {
+			e, err := dec.decode(key, nil)
+			if err != nil {
+				return fmt.Errorf("invalid key/value entry: %v", err)
+			} else if err := s.addCounts(deltas, counted, e.Source, -1); err != nil {
+				return err
+			}
+		}
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	}); err != nil && err != io.EOF {
+		return 0, err
+	} else if len(keys) == 0 {
+		return 0, nil
+	}
+
+	wr, err := s.db.Writer()
+	if err == graphstore.ErrReadOnly {
+		return 0, err
+	} else if err != nil {
+		return 0, fmt.Errorf("db writer error: %v", err)
+	}
+	defer func() {
+		cErr := wr.Close()
+		if err == nil && cErr != nil {
+			err = fmt.Errorf("db writer close error: %v", cErr)
+		}
+	}()
+	for _, key := range keys {
+		if err := wr.Delete(key); err != nil {
+			return 0, fmt.Errorf("db delete error: %v", err)
+		} else if indexed {
+			if err := deleteIndexed(wr, key); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(keys), s.writeCounts(wr, deltas)
+}
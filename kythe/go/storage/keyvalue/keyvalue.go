@@ -22,12 +22,15 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"sort"
 	"strings"
 	"sync"
 
 	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
 	"kythe.io/kythe/go/util/datasize"
 
 	"golang.org/x/net/context"
@@ -42,11 +45,40 @@ const debug = false
 type Store struct {
 	db DB
 
-	shardMu        sync.Mutex // guards shardTables/shardSnapshots during construction
+	shardMu        sync.Mutex // guards shardTables/shardCounts/shardSnapshots during construction
 	shardTables    map[int64][]shard
+	shardCounts    map[int64][]int64
 	shardSnapshots map[int64]Snapshot
+
+	shardFuncOnce sync.Once
+	shardFuncName string
+	shardFunc     graphstore.ShardFunc
+	shardFuncErr  error
+
+	formatOnce sync.Once
+	format     *keyFormat // the layout of the entry keys (see keyformat.go)
+	formatErr  error
+
+	casLocks [casLockStripes]sync.Mutex // serializes CompareAndSwap calls, by source
+
+	countOnce sync.Once
+	countMu   sync.RWMutex // guards counted, indexed, and indexing; held while writing entries (see lockCounts)
+	counted   []int64      // numbers of shards whose counts are maintained
+	countErr  error
+
+	reindexMu sync.Mutex // serializes ReindexTargets calls
+	indexOnce sync.Once
+	indexed   bool // whether the target index is maintained (see ReindexTargets)
+	indexing  bool // whether the target index is being built, and so maintained, by ReindexTargets
+	indexErr  error
+
+	unsafeRead bool // whether Read, ReadFacts, and Scan reuse entries (see SetUnsafeRead)
 }
 
+// casLockStripes is the number of locks shared by the sources of a Store's
+// CompareAndSwap calls.
+const casLockStripes = 64
+
 // Range is section of contiguous keys, including Start and excluding End.
 type Range struct {
 	Start, End []byte
@@ -54,14 +86,97 @@ type Range struct {
 
 type shard struct {
 	Range
-	count int64
+	count int64 // -1 if not yet counted
 }
 
 // NewGraphStore returns a graphstore.Service backed by the given keyvalue DB.
+// If db records a ShardFunc (see NewShardedGraphStore), the Store's shards are
+// assigned by it; otherwise, each shard is a contiguous range of keys, chosen
+// by the DB's size estimates if it is a SizeEstimator.
 func NewGraphStore(db DB) *Store {
 	return &Store{db: db}
 }
 
+// SetUnsafeRead sets whether the Store's Read, ReadFacts, and Scan methods
+// decode every entry into the same reused Entry (and VNames), instead of
+// allocating a new one for each.  If set, an entry passed to an EntryFunc is
+// only valid until the EntryFunc returns; it must be copied (e.g. with
+// proto.Clone) to be retained.  This reduces the allocations of reads whose
+// callers only inspect each entry, but must not be used with callers, such as
+// graphstore.NewCachingService, that retain them.  It should be set before the
+// Store is used.
+func (s *Store) SetUnsafeRead(unsafe bool) { s.unsafeRead = unsafe }
+
+// shardFuncKey is the DB key recording the name of the Store's ShardFunc.  It
+// lies outside of the entry key space.
+const shardFuncKey = "meta:shard_func"
+
+// NewShardedGraphStore returns a graphstore.Service backed by the given
+// keyvalue DB whose shards are assigned by the registered graphstore.ShardFunc
+// with the given name.  The name is recorded in db so that every later Store
+// for db, including those from NewGraphStore, shards its entries the same way.
+// It is an error if db already records a different ShardFunc.
+func NewShardedGraphStore(db DB, shardFunc string) (*Store, error) {
+	f, err := graphstore.LookupShardFunc(shardFunc)
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := recordedShardFunc(db)
+	if err != nil {
+		return nil, err
+	}
+	if recorded == "" {
+		wr, err := db.Writer()
+		if err != nil {
+			return nil, fmt.Errorf("db writer error: %v", err)
+		}
+		if err := wr.Write([]byte(shardFuncKey), []byte(shardFunc)); err != nil {
+			wr.Close()
+			return nil, fmt.Errorf("db write error: %v", err)
+		}
+		if err := wr.Close(); err != nil {
+			return nil, fmt.Errorf("db write error: %v", err)
+		}
+	} else if recorded != shardFunc {
+		return nil, fmt.Errorf("db is sharded by ShardFunc %q, not %q", recorded, shardFunc)
+	}
+
+	s := NewGraphStore(db)
+	s.shardFuncOnce.Do(func() { s.shardFuncName, s.shardFunc = shardFunc, f })
+	return s, nil
+}
+
+// recordedShardFunc returns the name of the ShardFunc recorded in db, or "" if
+// there is none.
+func recordedShardFunc(db DB) (string, error) {
+	val, err := db.Get([]byte(shardFuncKey), nil)
+	if err == io.EOF {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("db get error: %v", err)
+	}
+	return string(val), nil
+}
+
+// loadShardFunc returns the Store's ShardFunc and its name, or a nil ShardFunc
+// if the Store's shards are key ranges.
+func (s *Store) loadShardFunc() (graphstore.ShardFunc, string, error) {
+	s.shardFuncOnce.Do(func() {
+		s.shardFuncName, s.shardFuncErr = recordedShardFunc(s.db)
+		if s.shardFuncErr == nil && s.shardFuncName != "" {
+			s.shardFunc, s.shardFuncErr = graphstore.LookupShardFunc(s.shardFuncName)
+		}
+	})
+	return s.shardFunc, s.shardFuncName, s.shardFuncErr
+}
+
+// ShardFunc implements part of the graphstore.FuncSharded interface.  It
+// returns "" if the Store's shards are contiguous key ranges.
+func (s *Store) ShardFunc() string {
+	_, name, _ := s.loadShardFunc()
+	return name
+}
+
 // A DB is a sorted key-value store with read/write access. DBs must be Closed
 // when no longer used to ensure resources are not leaked.
 type DB interface {
@@ -87,6 +202,23 @@ type DB interface {
 	NewSnapshot() Snapshot
 }
 
+// SizeEstimator is an optional interface for a DB that can estimate the
+// storage used by a range of keys.
+type SizeEstimator interface {
+	// ApproximateSize returns the approximate number of bytes used to store the
+	// keys within the given Range.
+	ApproximateSize(*Range) (int64, error)
+}
+
+// HealthChecker is an optional interface for a DB that can check its health
+// beyond whether it can be read, such as whether its disk has space for
+// writes.
+type HealthChecker interface {
+	// CheckHealth returns nil if the DB is healthy, and otherwise an error
+	// describing why it is not.
+	CheckHealth(ctx context.Context) error
+}
+
 // Snapshot is a consistent view of the DB.
 type Snapshot io.Closer
 
@@ -100,6 +232,10 @@ type Options struct {
 	// Snapshot causes the iterator to view the DB as it was at the Snapshot's
 	// creation.
 	Snapshot
+
+	// Reverse causes the iterator to visit key-values in descending key order.
+	// Defaults to false.
+	Reverse bool
 }
 
 // IsLargeRead returns the LargeRead option or the default of false when o==nil.
@@ -107,6 +243,11 @@ func (o *Options) IsLargeRead() bool {
 	return o != nil && o.LargeRead
 }
 
+// IsReverse returns the Reverse option or the default of false when o==nil.
+func (o *Options) IsReverse() bool {
+	return o != nil && o.Reverse
+}
+
 // GetSnapshot returns the Snapshot option or the default of nil when o==nil.
 func (o *Options) GetSnapshot() Snapshot {
 	if o == nil {
@@ -124,6 +265,12 @@ type Iterator interface {
 	// entry. If there is no key-value entry to return, an io.EOF error is
 	// returned.
 	Next() (key, val []byte, err error)
+
+	// Seek positions the Iterator at the first key-value entry with a key
+	// greater than or equal to the given key (or, for a reverse Iterator, the
+	// last key-value entry with a key less than or equal to the given key).  The
+	// Iterator's original bounds (prefix or range) are still respected by Next.
+	Seek(key []byte) error
 }
 
 // Writer provides write access to a DB. Writes must be Closed when no longer
@@ -134,6 +281,10 @@ type Writer interface {
 	// Write writes a key-value entry to the DB. Writes may be batched until the
 	// Writer is Closed.
 	Write(key, val []byte) error
+
+	// Delete removes the key-value entry with the given key from the DB, if it
+	// exists.  Deletes may be batched until the Writer is Closed.
+	Delete(key []byte) error
 }
 
 // WritePool is a wrapper around a DB that automatically creates and flushes
@@ -216,20 +367,90 @@ func (p *WritePool) Flush() error {
 
 // Read implements part of the graphstore.Service interface.
 func (s *Store) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
-	keyPrefix, err := KeyPrefix(req.Source, req.EdgeKind)
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	rs := readStates.Get().(*readState)
+	defer readStates.Put(rs)
+	keyPrefix, err := kf.appendKeyPrefix(rs.prefix[:0], req.Source, req.EdgeKind)
 	if err != nil {
 		return fmt.Errorf("invalid ReadRequest: %v", err)
 	}
+	rs.prefix = keyPrefix
 	iter, err := s.db.ScanPrefix(keyPrefix, nil)
 	if err != nil {
 		return fmt.Errorf("db seek error: %v", err)
 	}
-	return streamEntries(iter, f)
+	rs.dec.unsafe = s.unsafeRead
+	return decodeEntries(ctx, iter, &rs.dec, f)
+}
+
+// A readState holds the buffers reused by successive Reads: the key prefix
+// and the entryDecoder.  They are only used while the Read's Iterator is open.
+type readState struct {
+	prefix []byte
+	dec    entryDecoder
 }
 
-func streamEntries(iter Iterator, f graphstore.EntryFunc) error {
+var readStates = sync.Pool{New: func() interface{} { return new(readState) }}
+
+// ReadFacts implements the graphstore.FactReader interface.  Each fact prefix
+// is read by seeking directly to its keys, skipping the source's other facts.
+func (s *Store) ReadFacts(ctx context.Context, src *spb.VName, factPrefixes []string, f graphstore.EntryFunc) error {
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	keyPrefix, err := kf.appendKeyPrefix(nil, src, "")
+	if err != nil {
+		return fmt.Errorf("invalid source: %v", err)
+	}
+	prefixes := []string{""}
+	if len(factPrefixes) > 0 {
+		// Read the prefixes in key order, dropping those subsumed by another.
+		sorted := append([]string(nil), factPrefixes...)
+		sort.Strings(sorted)
+		prefixes = sorted[:1]
+		for _, p := range sorted[1:] {
+			if !strings.HasPrefix(p, prefixes[len(prefixes)-1]) {
+				prefixes = append(prefixes, p)
+			}
+		}
+	}
+
+	dec := entryDecoder{unsafe: s.unsafeRead}
+	var stopped bool // whether f returned io.EOF
+	stop := func(e *spb.Entry) error {
+		err := f(e)
+		stopped = err == io.EOF
+		return err
+	}
+	for _, p := range prefixes {
+		iter, err := s.db.ScanPrefix(append(keyPrefix[:len(keyPrefix):len(keyPrefix)], p...), nil)
+		if err != nil {
+			return fmt.Errorf("db seek error: %v", err)
+		}
+		if err := decodeEntries(ctx, iter, &dec, stop); err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamEntries decodes each key-value from iter and passes the resulting
+// entry to f, stopping early if ctx is cancelled.
+func streamEntries(ctx context.Context, iter Iterator, f graphstore.EntryFunc) error {
+	return decodeEntries(ctx, iter, new(entryDecoder), f)
+}
+
+// decodeEntries is streamEntries, decoding each entry with d.
+func decodeEntries(ctx context.Context, iter Iterator, d *entryDecoder, f graphstore.EntryFunc) error {
 	defer iter.Close()
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		key, val, err := iter.Next()
 		if err == io.EOF {
 			break
@@ -237,7 +458,7 @@ func streamEntries(iter Iterator, f graphstore.EntryFunc) error {
 			return fmt.Errorf("db iteration error: %v", err)
 		}
 
-		entry, err := Entry(key, val)
+		entry, err := d.decode(key, val)
 		if err != nil {
 			return fmt.Errorf("encoding error: %v", err)
 		}
@@ -251,11 +472,148 @@ func streamEntries(iter Iterator, f graphstore.EntryFunc) error {
 }
 
 // Write implements part of the GraphStore interface.
-func (s *Store) Write(ctx context.Context, req *spb.WriteRequest) (err error) {
-	// TODO(schroederc): fix shardTables to include new entries
+func (s *Store) Write(ctx context.Context, req *spb.WriteRequest) error {
+	return s.write(ctx, []*spb.WriteRequest{req}, nil, nil)
+}
+
+// WriteBatch implements part of the graphstore.Transactional interface.  All of
+// the updates are applied using a single Writer and so are atomic iff the DB's
+// Writers are (as is the case for LevelDB).
+func (s *Store) WriteBatch(ctx context.Context, reqs []*spb.WriteRequest) error {
+	return s.write(ctx, reqs, nil, nil)
+}
+
+// WriteWithStats implements part of the graphstore.StatsWriter interface.
+// Each update's key is looked up before writing to classify it.
+func (s *Store) WriteWithStats(ctx context.Context, req *spb.WriteRequest) (*graphstore.WriteStats, error) {
+	return s.WriteOpts(ctx, req, nil)
+}
+
+// WriteOpts implements part of the graphstore.OptionsWriter interface.
+func (s *Store) WriteOpts(ctx context.Context, req *spb.WriteRequest, opts *graphstore.WriteOptions) (*graphstore.WriteStats, error) {
+	stats := new(graphstore.WriteStats)
+	if err := s.write(ctx, []*spb.WriteRequest{req}, opts, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// CompareAndSwap implements part of the graphstore.CAS interface.  The fact
+// is read and written while holding a lock for its source, so the swap is
+// atomic with respect to other CompareAndSwap calls on s, but not to other
+// writes.
+func (s *Store) CompareAndSwap(ctx context.Context, source *spb.VName, factName string, oldValue, newValue []byte) (swapped bool, err error) {
+	if factName == "" {
+		return false, errors.New("missing fact name")
+	}
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return false, err
+	}
+	key, err := kf.encodeKey(source, factName, "", nil)
+	if err != nil {
+		return false, fmt.Errorf("encoding error: %v", err)
+	}
+	prefix, err := kf.appendKeyPrefix(nil, source, "*")
+	if err != nil {
+		return false, fmt.Errorf("encoding error: %v", err)
+	}
+	h := fnv.New32a()
+	h.Write(prefix)
+	mu := &s.casLocks[h.Sum32()%casLockStripes]
+	mu.Lock()
+	defer mu.Unlock()
+	counted, unlock, err := s.lockCounts(false)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	cur, err := s.db.Get(key, nil)
+	exists := err == nil
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("db get error: %v", err)
+	} else if oldValue == nil && exists || oldValue != nil && (!exists || !bytes.Equal(cur, oldValue)) {
+		return false, nil
+	} else if err := ctx.Err(); err != nil {
+		return false, err
+	}
 
 	wr, err := s.db.Writer()
+	if err == graphstore.ErrReadOnly {
+		return false, err
+	} else if err != nil {
+		return false, fmt.Errorf("db writer error: %v", err)
+	}
+	defer func() {
+		if cErr := wr.Close(); err == nil && cErr != nil {
+			swapped, err = false, fmt.Errorf("db writer close error: %v", cErr)
+		}
+	}()
+	if err := wr.Write(key, newValue); err != nil {
+		return false, fmt.Errorf("db write error: %v", err)
+	}
+	if !exists {
+		deltas := make(countDeltas)
+		if err := s.addCounts(deltas, counted, source, 1); err != nil {
+			return false, err
+		} else if err := s.writeCounts(wr, deltas); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// write applies reqs to the DB using a single Writer.  If stats != nil, each
+// update is classified as an insertion, update, or no-op; unchanged entries are
+// not rewritten.  If opts.IfAbsent is set, stats must be non-nil and updates to
+// existing keys are skipped.
+func (s *Store) write(ctx context.Context, reqs []*spb.WriteRequest, opts *graphstore.WriteOptions, stats *graphstore.WriteStats) (err error) {
+	// TODO(schroederc): fix shardTables to include new entries
+
+	kf, err := s.loadKeyFormat()
 	if err != nil {
+		return err
+	}
+
+	// Encode every update before any are buffered so that an invalid update
+	// cannot result in a partial write.
+	var updates []keyValue
+	for _, req := range reqs {
+		for _, update := range req.Update {
+			if update.FactName == "" {
+				return errors.New("invalid WriteRequest: Update missing FactName")
+			}
+			updateKey, err := kf.encodeKey(req.Source, update.FactName, update.EdgeKind, update.Target)
+			if err != nil {
+				return fmt.Errorf("encoding error: %v", err)
+			}
+			updates = append(updates, keyValue{updateKey, update.FactValue, req.Source})
+		}
+	}
+
+	// Writes are applied atomically when the Writer is closed, so a cancelled
+	// context can only be honored before any updates are buffered.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// An IfAbsent write holds the lock exclusively, so that concurrent writes of
+	// the same key cannot both find it absent.
+	ifAbsent := opts != nil && opts.IfAbsent
+	s.loadTargetIndexed()
+	counted, unlock, err := s.lockCounts(ifAbsent)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	indexed := s.indexed || s.indexing
+	if s.indexErr != nil {
+		return s.indexErr
+	}
+	wr, err := s.db.Writer()
+	if err == graphstore.ErrReadOnly {
+		return err
+	} else if err != nil {
 		return fmt.Errorf("db writer error: %v", err)
 	}
 	defer func() {
@@ -264,35 +622,356 @@ func (s *Store) Write(ctx context.Context, req *spb.WriteRequest) (err error) {
 			err = fmt.Errorf("db writer close error: %v", cErr)
 		}
 	}()
-	for _, update := range req.Update {
-		if update.FactName == "" {
-			return errors.New("invalid WriteRequest: Update missing FactName")
+
+	// Counting the written entries requires classifying each update.
+	deltas := make(countDeltas)
+	if stats == nil && len(counted) > 0 {
+		stats = new(graphstore.WriteStats)
+	}
+
+	var written map[string][]byte // values written so far in this request
+	if stats != nil {
+		written = make(map[string][]byte, len(updates))
+	}
+	for _, update := range updates {
+		if stats != nil {
+			old, ok := written[string(update.key)]
+			if !ok {
+				old, err = s.db.Get(update.key, nil)
+				if err == io.EOF {
+					old, err = nil, nil
+				} else if err != nil {
+					return fmt.Errorf("db get error: %v", err)
+				} else {
+					ok = true
+				}
+			}
+			switch {
+			case !ok:
+				stats.Inserted++
+				if err := s.addCounts(deltas, counted, update.src, 1); err != nil {
+					return err
+				}
+			case ifAbsent:
+				stats.Skipped++
+				continue
+			case bytes.Equal(old, update.val):
+				stats.Unchanged++
+				continue
+			default:
+				stats.Updated++
+			}
+			written[string(update.key)] = update.val
+		}
+		if err := wr.Write(update.key, update.val); err != nil {
+			return fmt.Errorf("db write error: %v", err)
+		} else if indexed {
+			if err := writeIndexed(wr, update.key, update.val); err != nil {
+				return err
+			}
 		}
-		updateKey, err := EncodeKey(req.Source, update.FactName, update.EdgeKind, update.Target)
+	}
+	return s.writeCounts(wr, deltas)
+}
+
+type keyValue struct {
+	key, val []byte
+	src      *spb.VName
+}
+
+// ReadMultiple implements part of the graphstore.MultiReader interface.  The
+// requests are satisfied in key order using a single Iterator.
+func (s *Store) ReadMultiple(ctx context.Context, reqs []*spb.ReadRequest, f graphstore.EntryFunc) error {
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	var errs graphstore.MultiError
+	var prefixes [][]byte
+	for _, req := range reqs {
+		keyPrefix, err := kf.appendKeyPrefix(nil, req.Source, req.EdgeKind)
 		if err != nil {
-			return fmt.Errorf("encoding error: %v", err)
+			errs = append(errs, fmt.Errorf("invalid ReadRequest: %v", err))
+			continue
 		}
-		if err := wr.Write(updateKey, update.FactValue); err != nil {
-			return fmt.Errorf("db write error: %v", err)
+		prefixes = append(prefixes, keyPrefix)
+	}
+	if len(prefixes) == 0 {
+		return multiErr(errs)
+	}
+	sort.Sort(byteSlices(prefixes))
+
+	iter, err := s.db.ScanPrefix(kf.prefix, nil)
+	if err != nil {
+		return fmt.Errorf("db seek error: %v", err)
+	}
+	defer iter.Close()
+	for _, prefix := range prefixes {
+		if err := iter.Seek(prefix); err != nil {
+			errs = append(errs, fmt.Errorf("db seek error: %v", err))
+			continue
+		}
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			key, val, err := iter.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				errs = append(errs, fmt.Errorf("db iteration error: %v", err))
+				break
+			} else if !bytes.HasPrefix(key, prefix) {
+				break
+			}
+
+			entry, err := Entry(key, val)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("encoding error: %v", err))
+				break
+			}
+			if err := f(entry); err == io.EOF {
+				return multiErr(errs)
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return multiErr(errs)
+}
+
+func multiErr(errs graphstore.MultiError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+type byteSlices [][]byte
+
+func (b byteSlices) Len() int           { return len(b) }
+func (b byteSlices) Less(i, j int) bool { return bytes.Compare(b[i], b[j]) < 0 }
+func (b byteSlices) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Delete implements part of the graphstore.Deleter interface.
+func (s *Store) Delete(ctx context.Context, req *graphstore.DeleteRequest) (err error) {
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	kind := req.EdgeKind
+	if kind == "" {
+		kind = "*"
+	}
+	keyPrefix, err := kf.appendKeyPrefix(nil, req.Source, kind)
+	if err != nil {
+		return fmt.Errorf("invalid DeleteRequest: %v", err)
+	}
+	if req.EdgeKind != "" && req.FactName != "" {
+		keyPrefix = append(append(keyPrefix, req.FactName...), entryKeySep)
+	}
+
+	s.loadTargetIndexed()
+	counted, unlock, err := s.lockCounts(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	indexed := s.indexed || s.indexing
+	if s.indexErr != nil {
+		return s.indexErr
+	}
+
+	// Collect the matching keys before deleting any so that the deletion is
+	// applied atomically by a single Writer.
+	iter, err := s.db.ScanPrefix(keyPrefix, nil)
+	if err != nil {
+		return fmt.Errorf("db seek error: %v", err)
+	}
+	var keys [][]byte
+	err = streamKeys(ctx, iter, func(key []byte) error {
+		if req.FactName != "" && factName(key) != req.FactName {
+			return nil
+		} else if req.Target != nil {
+			e, err := Entry(key, nil)
+			if err != nil {
+				return fmt.Errorf("invalid key/value entry: %v", err)
+			} else if !graphstore.EntryMatchesDelete(req, e) {
+				return nil
+			}
+		}
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	wr, err := s.db.Writer()
+	if err == graphstore.ErrReadOnly {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("db writer error: %v", err)
+	}
+	defer func() {
+		cErr := wr.Close()
+		if err == nil && cErr != nil {
+			err = fmt.Errorf("db writer close error: %v", cErr)
+		}
+	}()
+	for _, key := range keys {
+		if err := wr.Delete(key); err != nil {
+			return fmt.Errorf("db delete error: %v", err)
+		} else if indexed {
+			if err := deleteIndexed(wr, key); err != nil {
+				return err
+			}
+		}
+	}
+	deltas := make(countDeltas)
+	if err := s.addCounts(deltas, counted, req.Source, -int64(len(keys))); err != nil {
+		return err
+	}
+	return s.writeCounts(wr, deltas)
+}
+
+// streamKeys passes each key from iter to f, stopping early if ctx is
+// cancelled.
+func streamKeys(ctx context.Context, iter Iterator, f func(key []byte) error) error {
+	defer iter.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key, _, err := iter.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("db iteration error: %v", err)
+		}
+		if err := f(key); err != nil {
+			return err
 		}
 	}
-	return nil
 }
 
 // Scan implements part of the graphstore.Service interface.
 func (s *Store) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
-	iter, err := s.db.ScanPrefix(entryKeyPrefixBytes, &Options{LargeRead: true})
+	return s.ScanOpts(ctx, req, nil, f)
+}
+
+// ScanOpts implements part of the graphstore.OptionsScanner interface.  Since
+// keys are ordered by source, entries cannot be pruned by their targets and
+// the entire store is scanned, unless the Store has a target index (see
+// ReindexTargets) and req has a non-empty Target.  A Target matched exactly is
+// found by its index keys, and a partial or prefix Target (such as one with
+// only a Corpus) by a scan of the index limited to its Signature, if any, which
+// skips every node fact.  The entries found by the index are delivered in the
+// order of their targets and then of their legacy entry keys, so with the
+// per-corpus key layout, they are not grouped by corpus.
+func (s *Store) ScanOpts(ctx context.Context, req *spb.ScanRequest, opts *graphstore.ScanOptions, f graphstore.EntryFunc) error {
+	if ok, err := s.targetIndexUsable(req, opts); err != nil {
+		return err
+	} else if ok {
+		if prefix, ok := targetIndexScanPrefix(req.Target, opts); ok {
+			return s.scanTargetIndex(ctx, prefix, req, opts, f)
+		}
+	}
+
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	iter, err := s.db.ScanPrefix(kf.prefix, &Options{LargeRead: true})
 	if err != nil {
 		return fmt.Errorf("db seek error: %v", err)
 	}
 	defer iter.Close()
+	dec := entryDecoder{unsafe: s.unsafeRead}
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		key, val, err := iter.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return fmt.Errorf("db iteration error: %v", err)
 		}
+		entry, err := dec.decode(key, val)
+		if err != nil {
+			return fmt.Errorf("invalid key/value entry: %v", err)
+		}
+		if !graphstore.EntryMatchesScanOpts(req, opts, entry) {
+			continue
+		} else if err := f(entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReverseScan implements part of the graphstore.ReverseScanner interface.
+func (s *Store) ReverseScan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	iter, err := s.db.ScanPrefix(kf.prefix, &Options{LargeRead: true, Reverse: true})
+	if err != nil {
+		return fmt.Errorf("db seek error: %v", err)
+	}
+	return streamEntries(ctx, iter, func(e *spb.Entry) error {
+		if !graphstore.EntryMatchesScan(req, e) {
+			return nil
+		}
+		return f(e)
+	})
+}
+
+// ScanFrom implements part of the graphstore.ResumableScanner interface.  The
+// scan begins by seeking to the key of after, and so resumes in the order of
+// the Store's keys: compare.Entries order in the legacy key layout, or the
+// order of the corpus key layout (see ScansOrdered), where entries are ordered
+// first by their sources' corpora.
+func (s *Store) ScanFrom(ctx context.Context, req *spb.ScanRequest, after *spb.Entry, f graphstore.EntryFunc) error {
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	var afterKey []byte
+	if after != nil {
+		afterKey, err = kf.encodeKey(after.Source, after.FactName, after.EdgeKind, after.Target)
+		if err != nil {
+			return fmt.Errorf("invalid entry: %v", err)
+		}
+	}
+
+	iter, err := s.db.ScanPrefix(kf.prefix, &Options{LargeRead: true})
+	if err != nil {
+		return fmt.Errorf("db seek error: %v", err)
+	}
+	defer iter.Close()
+	if afterKey != nil {
+		if err := iter.Seek(afterKey); err != nil {
+			return fmt.Errorf("db seek error: %v", err)
+		}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key, val, err := iter.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("db iteration error: %v", err)
+		} else if afterKey != nil && bytes.Equal(key, afterKey) {
+			continue
+		}
 		entry, err := Entry(key, val)
 		if err != nil {
 			return fmt.Errorf("invalid key/value entry: %v", err)
@@ -305,13 +984,117 @@ func (s *Store) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.Ent
 			return err
 		}
 	}
+}
+
+// ScanPage implements part of the graphstore.PagedScanner interface.  Page
+// tokens encode the last key of the previous page and so remain valid after the
+// DB is reopened.
+func (s *Store) ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	after, err := graphstore.ParsePageToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return nil, "", err
+	}
+	var afterKey []byte
+	if after != nil {
+		afterKey, err = kf.encodeKey(after.Source, after.FactName, after.EdgeKind, after.Target)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid page token: %v", err)
+		}
+	}
+
+	iter, err := s.db.ScanPrefix(kf.prefix, &Options{LargeRead: true})
+	if err != nil {
+		return nil, "", fmt.Errorf("db seek error: %v", err)
+	}
+	defer iter.Close()
+	if afterKey != nil {
+		if err := iter.Seek(afterKey); err != nil {
+			return nil, "", fmt.Errorf("db seek error: %v", err)
+		}
+	}
+
+	var page []*spb.Entry
+	for len(page) <= pageSize {
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		key, val, err := iter.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", fmt.Errorf("db iteration error: %v", err)
+		} else if afterKey != nil && bytes.Equal(key, afterKey) {
+			continue
+		}
+		entry, err := Entry(key, val)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid key/value entry: %v", err)
+		}
+		if graphstore.EntryMatchesScan(req, entry) {
+			page = append(page, entry)
+		}
+	}
+	return graphstore.Page(page, pageSize)
+}
+
+// DiskSize implements part of the graphstore.DiskSizer interface.  It returns
+// graphstore.ErrDiskSizeUnknown if the Store's DB is not a SizeEstimator.
+func (s *Store) DiskSize(ctx context.Context) (int64, error) {
+	se, ok := s.db.(SizeEstimator)
+	if !ok {
+		return 0, graphstore.ErrDiskSizeUnknown
+	}
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return 0, err
+	}
+	return se.ApproximateSize(&Range{Start: kf.prefix, End: kf.end})
+}
+
+// CheckHealth implements the graphstore.HealthChecker interface.  The Store is
+// healthy if a trial read of its DB succeeds and, if the DB is a
+// HealthChecker, the DB reports itself healthy.
+func (s *Store) CheckHealth(ctx context.Context) error {
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	it, err := s.db.ScanPrefix(kf.prefix, nil)
+	if err != nil {
+		return fmt.Errorf("trial read failed: %v", err)
+	}
+	_, _, err = it.Next()
+	it.Close()
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("trial read failed: %v", err)
+	}
+	if hc, ok := s.db.(HealthChecker); ok {
+		return hc.CheckHealth(ctx)
+	}
 	return nil
 }
 
 // Close implements part of the graphstore.Service interface.
 func (s *Store) Close(ctx context.Context) error { return s.db.Close() }
 
-// Count implements part of the graphstore.Sharded interface.
+// ScansOrdered implements the graphstore.OrderedScanner interface.  Entries
+// in the legacy key layout are stored in keys sorting in compare.Entries
+// order; the per-corpus layout orders them first by their sources' corpora.
+func (s *Store) ScansOrdered() bool {
+	kf, err := s.loadKeyFormat()
+	return err == nil && !kf.byCorpus
+}
+
+// Count implements part of the graphstore.Sharded interface.  If the Store
+// maintains counts for req.Shards (see Recount), the count is read from the DB;
+// otherwise, the entries are counted with a scan.
 func (s *Store) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
 	if req.Shards < 1 {
 		return 0, fmt.Errorf("invalid number of shards: %d", req.Shards)
@@ -319,37 +1102,133 @@ func (s *Store) Count(ctx context.Context, req *spb.CountRequest) (int64, error)
 		return 0, fmt.Errorf("invalid index for %d shards: %d", req.Shards, req.Index)
 	}
 
-	tbl, _, err := s.constructShards(req.Shards)
+	if n, ok, err := s.storedCount(req); err != nil {
+		return 0, err
+	} else if ok {
+		return n, nil
+	}
+
+	if sf, _, err := s.loadShardFunc(); err != nil {
+		return 0, err
+	} else if sf != nil {
+		counts, _, err := s.countShards(sf, req.Shards)
+		if err != nil {
+			return 0, err
+		}
+		return counts[req.Index], nil
+	}
+
+	tbl, snapshot, err := s.constructShards(req.Shards)
 	if err != nil {
 		return 0, err
 	}
-	return tbl[req.Index].count, nil
+	return s.shardCount(tbl, snapshot, req.Index)
 }
 
 // Shard implements part of the graphstore.Sharded interface.
 func (s *Store) Shard(ctx context.Context, req *spb.ShardRequest, f graphstore.EntryFunc) error {
+	return s.shard(ctx, req, false, f)
+}
+
+// ReverseShard implements part of the graphstore.ReverseSharded interface.
+func (s *Store) ReverseShard(ctx context.Context, req *spb.ShardRequest, f graphstore.EntryFunc) error {
+	return s.shard(ctx, req, true, f)
+}
+
+func (s *Store) shard(ctx context.Context, req *spb.ShardRequest, reverse bool, f graphstore.EntryFunc) error {
 	if req.Shards < 1 {
 		return fmt.Errorf("invalid number of shards: %d", req.Shards)
 	} else if req.Index < 0 || req.Index >= req.Shards {
 		return fmt.Errorf("invalid index for %d shards: %d", req.Shards, req.Index)
 	}
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+
+	if sf, _, err := s.loadShardFunc(); err != nil {
+		return err
+	} else if sf != nil {
+		// Maintained counts are always current, so the shard need not be read
+		// from the snapshot in which it was counted.
+		var snapshot Snapshot
+		if _, ok, err := s.storedCount(&spb.CountRequest{Index: req.Index, Shards: req.Shards}); err != nil {
+			return err
+		} else if !ok {
+			if _, snapshot, err = s.countShards(sf, req.Shards); err != nil {
+				return err
+			}
+		}
+		iter, err := s.db.ScanPrefix(kf.prefix, &Options{
+			LargeRead: true,
+			Snapshot:  snapshot,
+			Reverse:   reverse,
+		})
+		if err != nil {
+			return err
+		}
+		index, shards := int(req.Index), int(req.Shards)
+		return streamEntries(ctx, iter, func(e *spb.Entry) error {
+			if sf(e.Source, shards) != index {
+				return nil
+			}
+			return f(e)
+		})
+	}
 
 	tbl, snapshot, err := s.constructShards(req.Shards)
 	if err != nil {
 		return err
 	}
-	if tbl[req.Index].count == 0 {
-		return nil
-	}
 	shard := tbl[req.Index]
 	iter, err := s.db.ScanRange(&shard.Range, &Options{
 		LargeRead: true,
 		Snapshot:  snapshot,
+		Reverse:   reverse,
 	})
 	if err != nil {
 		return err
 	}
-	return streamEntries(iter, f)
+	return streamEntries(ctx, iter, f)
+}
+
+// countShards returns the number of entries in each of num shards assigned by
+// sf, along with the snapshot from which they were counted.
+func (s *Store) countShards(sf graphstore.ShardFunc, num int64) ([]int64, Snapshot, error) {
+	s.shardMu.Lock()
+	defer s.shardMu.Unlock()
+	if s.shardCounts == nil {
+		s.shardCounts = make(map[int64][]int64)
+		s.shardSnapshots = make(map[int64]Snapshot)
+	}
+	if counts, ok := s.shardCounts[num]; ok {
+		return counts, s.shardSnapshots[num], nil
+	}
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot := s.db.NewSnapshot()
+	iter, err := s.db.ScanPrefix(kf.prefix, &Options{
+		LargeRead: true,
+		Snapshot:  snapshot,
+	})
+	if err != nil {
+		snapshot.Close()
+		return nil, nil, fmt.Errorf("error creating iterator: %v", err)
+	}
+	counts := make([]int64, num)
+	if err := streamEntries(context.Background(), iter, func(e *spb.Entry) error {
+		counts[sf(e.Source, int(num))]++
+		return nil
+	}); err != nil {
+		snapshot.Close()
+		return nil, nil, err
+	}
+
+	s.shardCounts[num] = counts
+	s.shardSnapshots[num] = snapshot
+	return counts, snapshot, nil
 }
 
 func (s *Store) constructShards(num int64) ([]shard, Snapshot, error) {
@@ -362,11 +1241,26 @@ func (s *Store) constructShards(num int64) ([]shard, Snapshot, error) {
 	if tbl, ok := s.shardTables[num]; ok {
 		return tbl, s.shardSnapshots[num], nil
 	}
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return nil, nil, err
+	}
 	snapshot := s.db.NewSnapshot()
+	if se, ok := s.db.(SizeEstimator); ok {
+		tbl, err := s.sizedShards(se, kf, snapshot, num)
+		if err != nil {
+			snapshot.Close()
+			return nil, nil, err
+		} else if tbl != nil {
+			s.shardTables[num] = tbl
+			s.shardSnapshots[num] = snapshot
+			return tbl, snapshot, nil
+		}
+	}
 	iters := make([]Iterator, num)
 	for i := range iters {
 		var err error
-		iters[i], err = s.db.ScanPrefix(entryKeyPrefixBytes, &Options{
+		iters[i], err = s.db.ScanPrefix(kf.prefix, &Options{
 			LargeRead: true,
 			Snapshot:  snapshot,
 		})
@@ -423,8 +1317,8 @@ loop:
 	}
 
 	// Fix up the border shards
-	tbl[0].Start = entryKeyPrefixBytes
-	tbl[num-1].End = entryKeyPrefixEndRange
+	tbl[0].Start = kf.prefix
+	tbl[num-1].End = kf.end
 	tbl[0].count--
 	tbl[num-1].count++
 
@@ -442,9 +1336,158 @@ loop:
 	return tbl, snapshot, nil
 }
 
+// sizedShardSearchSteps is the maximum number of bisections of the key space
+// made by sizedShards to find each boundary between shards.
+const sizedShardSearchSteps = 48
+
+// sizedShards divides the entry keys (in the layout kf) of se into num contiguous shards of about
+// the same size, as estimated by se, without reading each entry.  The entries
+// of each shard are counted lazily (see shardCount).  As with constructShards,
+// no node/edge crosses a shard boundary.  If se cannot estimate the size of the
+// entries or estimates that they use no space (e.g. when they have all been
+// recently written), nil is returned.
+func (s *Store) sizedShards(se SizeEstimator, kf *keyFormat, snapshot Snapshot, num int64) ([]shard, error) {
+	total, err := se.ApproximateSize(&Range{Start: kf.prefix, End: kf.end})
+	if err == graphstore.ErrDiskSizeUnknown {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error estimating size: %v", err)
+	} else if total <= 0 {
+		return nil, nil
+	}
+
+	tbl := make([]shard, num)
+	tbl[0].Start = kf.prefix
+	for i := int64(1); i < num; i++ {
+		// Bisect the keys after the previous boundary for the first key before
+		// which the entries use at least i/num of the total size.
+		target := total * i / num
+		lo, hi := tbl[i-1].Start, kf.end
+		for step := 0; step < sizedShardSearchSteps; step++ {
+			mid := midKey(lo, hi)
+			if bytes.Compare(mid, lo) <= 0 || bytes.Compare(mid, hi) >= 0 {
+				break
+			}
+			size, err := se.ApproximateSize(&Range{Start: kf.prefix, End: mid})
+			if err != nil {
+				return nil, fmt.Errorf("error estimating size: %v", err)
+			}
+			if size < target {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+
+		// Move the boundary back to the start of the node/edge into which it falls.
+		boundary := kf.end
+		iter, err := s.db.ScanRange(&Range{Start: hi, End: kf.end}, &Options{Snapshot: snapshot})
+		if err != nil {
+			return nil, fmt.Errorf("error creating iterator: %v", err)
+		}
+		k, _, err := iter.Next()
+		iter.Close()
+		if err == nil {
+			boundary = sourceKindPrefix(k)
+		} else if err != io.EOF {
+			return nil, fmt.Errorf("db iteration error: %v", err)
+		}
+		if bytes.Compare(boundary, tbl[i-1].Start) < 0 {
+			boundary = tbl[i-1].Start
+		}
+		tbl[i-1].End = boundary
+		tbl[i].Start = boundary
+	}
+	tbl[num-1].End = kf.end
+	for i := range tbl {
+		tbl[i].count = -1
+	}
+	return tbl, nil
+}
+
+// shardCount returns the number of entries in tbl[index], counting them in the
+// given snapshot if they have not yet been counted.
+func (s *Store) shardCount(tbl []shard, snapshot Snapshot, index int64) (int64, error) {
+	s.shardMu.Lock()
+	count := tbl[index].count
+	s.shardMu.Unlock()
+	if count >= 0 {
+		return count, nil
+	}
+
+	iter, err := s.db.ScanRange(&tbl[index].Range, &Options{
+		LargeRead: true,
+		Snapshot:  snapshot,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error creating iterator: %v", err)
+	}
+	defer iter.Close()
+	for count = 0; ; count++ {
+		if _, _, err := iter.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("db iteration error: %v", err)
+		}
+	}
+
+	s.shardMu.Lock()
+	tbl[index].count = count
+	s.shardMu.Unlock()
+	return count, nil
+}
+
+// midKey returns a key about halfway between a and b (where a < b), treating
+// each as a base-256 fraction.
+func midKey(a, b []byte) []byte {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	n++
+	mid := make([]byte, n)
+	// Sum a and b, shifting the sum right by one bit as it is computed from the
+	// least significant byte.
+	var carry int
+	for i := n - 1; i >= 0; i-- {
+		sum := carry
+		if i < len(a) {
+			sum += int(a[i])
+		}
+		if i < len(b) {
+			sum += int(b[i])
+		}
+		mid[i] = byte(sum)
+		carry = sum >> 8
+	}
+	for i := n - 1; i >= 0; i-- {
+		mid[i] >>= 1
+		if i > 0 {
+			mid[i] |= mid[i-1] << 7
+		} else {
+			mid[i] |= byte(carry << 7)
+		}
+	}
+	return mid
+}
+
+// factName returns the fact name portion of an encoded entry key.
+func factName(key []byte) string {
+	_, rest, err := splitEntryKey(key)
+	if err != nil {
+		return ""
+	}
+	parts := bytes.SplitN(rest, entryKeySepBytes, 4)
+	if len(parts) != 4 {
+		return ""
+	}
+	return string(parts[2])
+}
+
 func sourceKindPrefix(key []byte) []byte {
-	idx := bytes.IndexRune(key, entryKeySep)
-	return key[:bytes.IndexRune(key[idx+1:], entryKeySep)+idx+2]
+	head, rest, _ := splitEntryKey(key)
+	idx := bytes.IndexRune(rest, entryKeySep)
+	return key[:len(head)+bytes.IndexRune(rest[idx+1:], entryKeySep)+idx+2]
 }
 
 // GraphStore Implementation Details:
@@ -466,6 +1509,18 @@ func sourceKindPrefix(key []byte) []byte {
 //     <signature>-<corpus>-<root>-<path>-<language>
 //   where:
 //     "-"      == vNameFieldSep
+//
+//   This legacy format predates the canonical key encoding of
+//   compare.EncodeEntryKey and is kept so that existing on-disk stores remain
+//   readable.  Unlike the canonical encoding, it cannot represent VNames or
+//   edge kinds containing its separators.  Tools comparing keys across
+//   backends should convert legacy keys with CanonicalKey; a store may be
+//   rewritten into any other GraphStore (re-encoding its keys) with
+//   "gstool copy --from <store> --to <spec>".
+//
+//   A Store may instead use the per-corpus key layout, which prefixes each
+//   legacy key (after a distinct "centry:" prefix) with its source's corpus;
+//   see keyformat.go.
 
 const (
 	entryKeyPrefix = "entry:"
@@ -487,6 +1542,11 @@ var (
 
 // EncodeKey returns a canonical encoding of an Entry (minus its value).
 func EncodeKey(source *spb.VName, factName string, edgeKind string, target *spb.VName) ([]byte, error) {
+	return legacyKeys.encodeKey(source, factName, edgeKind, target)
+}
+
+// encodeKey returns the encoding of an Entry (minus its value) in the layout f.
+func (f *keyFormat) encodeKey(source *spb.VName, factName string, edgeKind string, target *spb.VName) ([]byte, error) {
 	if source == nil {
 		return nil, errors.New("invalid Entry: missing source VName for key encoding")
 	} else if (edgeKind == "" || target == nil) && (edgeKind != "" || target != nil) {
@@ -513,7 +1573,7 @@ func EncodeKey(source *spb.VName, factName string, edgeKind string, target *spb.
 	}
 
 	return bytes.Join([][]byte{
-		entryKeyPrefixBytes,
+		f.appendHead(nil, source.Corpus),
 		srcEncoding,
 		keySuffix,
 		targetEncoding,
@@ -523,70 +1583,154 @@ func EncodeKey(source *spb.VName, factName string, edgeKind string, target *spb.
 // KeyPrefix returns a prefix to every encoded key for the given source VName and exact
 // edgeKind. If edgeKind is "*", the prefix will match any edgeKind.
 func KeyPrefix(source *spb.VName, edgeKind string) ([]byte, error) {
+	return legacyKeys.appendKeyPrefix(nil, source, edgeKind)
+}
+
+// appendKeyPrefix appends the KeyPrefix for the given source VName and
+// edgeKind, in the layout f, to buf.
+func (f *keyFormat) appendKeyPrefix(buf []byte, source *spb.VName, edgeKind string) ([]byte, error) {
 	if source == nil {
 		return nil, errors.New("missing source VName")
-	}
-	srcEncoding, err := encodeVName(source)
-	if err != nil {
+	} else if err := checkVName(source); err != nil {
 		return nil, fmt.Errorf("error encoding source VName: %v", err)
 	}
 
-	prefix := bytes.Join([][]byte{entryKeyPrefixBytes, append(srcEncoding, entryKeySep)}, nil)
+	buf = append(appendVName(f.appendHead(buf, source.Corpus), source), entryKeySep)
 	if edgeKind == "*" {
-		return prefix, nil
+		return buf, nil
 	}
-
-	return bytes.Join([][]byte{prefix, append([]byte(edgeKind), entryKeySep)}, nil), nil
+	return append(append(buf, edgeKind...), entryKeySep), nil
 }
 
-// Entry decodes the key (assuming it was encoded by EncodeKey) into an Entry
-// and populates its value field.
+// Entry decodes the key (assuming it was encoded by EncodeKey, or in the
+// per-corpus layout) into an Entry and populates its value field.
 func Entry(key []byte, val []byte) (*spb.Entry, error) {
-	if !bytes.HasPrefix(key, entryKeyPrefixBytes) {
-		return nil, fmt.Errorf("key is not prefixed with entry prefix %q", entryKeyPrefix)
-	}
-	keyStr := string(bytes.TrimPrefix(key, entryKeyPrefixBytes))
-	keyParts := strings.SplitN(keyStr, entryKeySepStr, 4)
-	if len(keyParts) != 4 {
-		return nil, fmt.Errorf("invalid key[%d]: %q", len(keyParts), string(key))
-	}
+	var d entryDecoder
+	return d.decode(key, val)
+}
+
+// An entryDecoder decodes keys encoded by EncodeKey into Entries.  It keeps the
+// most recently decoded source, which is shared by the consecutive keys of a
+// Read, and only decodes a key's source if its encoding differs; the encoding
+// is compared in place, without copying the key.  If unsafe, every decoded
+// Entry is the same reused message (see Store.SetUnsafeRead).
+type entryDecoder struct {
+	unsafe bool
+
+	srcEnc string    // the encoding of src
+	src    spb.VName // nil VName if srcEnc == ""
+
+	out *decodedEntry // the reused result, if unsafe
+}
+
+// A decodedEntry is an Entry allocated together with its VNames.
+type decodedEntry struct {
+	entry          spb.Entry
+	source, target spb.VName
+}
 
-	srcVName, err := decodeVName(keyParts[0])
+func (d *entryDecoder) decode(key, val []byte) (*spb.Entry, error) {
+	_, rest, err := splitEntryKey(key)
 	if err != nil {
-		return nil, fmt.Errorf("error decoding source VName: %v", err)
+		return nil, err
 	}
-	targetVName, err := decodeVName(keyParts[3])
-	if err != nil {
-		return nil, fmt.Errorf("error decoding target VName: %v", err)
+	i := bytes.IndexByte(rest, entryKeySep)
+	if i < 0 {
+		return nil, invalidKey(key)
+	}
+	if src := rest[:i]; string(src) != d.srcEnc {
+		enc := string(src)
+		if err := decodeVNameInto(&d.src, enc); err != nil {
+			d.srcEnc = ""
+			return nil, fmt.Errorf("error decoding source VName: %v", err)
+		}
+		d.srcEnc = enc
 	}
 
-	return &spb.Entry{
-		Source:    srcVName,
-		FactName:  keyParts[2],
-		EdgeKind:  keyParts[1],
-		Target:    targetVName,
+	// The edge kind, fact name, and target share a single copy of the rest of
+	// the key.
+	suffix := string(rest[i+1:])
+	i = strings.IndexByte(suffix, entryKeySep)
+	if i < 0 {
+		return nil, invalidKey(key)
+	}
+	edgeKind, suffix := suffix[:i], suffix[i+1:]
+	i = strings.IndexByte(suffix, entryKeySep)
+	if i < 0 {
+		return nil, invalidKey(key)
+	}
+	factName, target := suffix[:i], suffix[i+1:]
+
+	de := d.out
+	if !d.unsafe {
+		de = new(decodedEntry)
+	} else if de == nil {
+		de = new(decodedEntry)
+		d.out = de
+	}
+	de.entry = spb.Entry{
+		FactName:  factName,
+		EdgeKind:  edgeKind,
 		FactValue: val,
-	}, nil
+	}
+	if d.srcEnc != "" {
+		de.source = d.src
+		de.entry.Source = &de.source
+	}
+	if target != "" {
+		if err := decodeVNameInto(&de.target, target); err != nil {
+			return nil, fmt.Errorf("error decoding target VName: %v", err)
+		}
+		de.entry.Target = &de.target
+	}
+	return &de.entry, nil
+}
+
+// invalidKey returns the error for an entry key with too few parts.
+func invalidKey(key []byte) error {
+	_, rest, _ := splitEntryKey(key)
+	return fmt.Errorf("invalid key[%d]: %q", bytes.Count(rest, entryKeySepBytes)+1, string(key))
+}
+
+// CanonicalKey converts an entry key in the legacy keyvalue format (see
+// EncodeKey) into its canonical encoding (see compare.EncodeEntryKey).
+func CanonicalKey(key []byte) ([]byte, error) {
+	e, err := Entry(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return compare.EncodeEntryKey(e), nil
 }
 
 // encodeVName returns a canonical byte array for the given VName. Returns nil if given nil.
 func encodeVName(v *spb.VName) ([]byte, error) {
 	if v == nil {
 		return nil, nil
-	} else if strings.Contains(v.Signature, vNameFieldSep) ||
+	} else if err := checkVName(v); err != nil {
+		return nil, err
+	}
+	return appendVName(nil, v), nil
+}
+
+// checkVName returns an error if v cannot be encoded by encodeVName.
+func checkVName(v *spb.VName) error {
+	if strings.Contains(v.Signature, vNameFieldSep) ||
 		strings.Contains(v.Corpus, vNameFieldSep) ||
 		strings.Contains(v.Root, vNameFieldSep) ||
 		strings.Contains(v.Path, vNameFieldSep) ||
 		strings.Contains(v.Language, vNameFieldSep) {
-		return nil, fmt.Errorf("VName contains invalid rune: %q", vNameFieldSep)
+		return fmt.Errorf("VName contains invalid rune: %q", vNameFieldSep)
 	}
-	return []byte(strings.Join([]string{
-		v.Signature,
-		v.Corpus,
-		v.Root,
-		v.Path,
-		v.Language,
-	}, vNameFieldSep)), nil
+	return nil
+}
+
+// appendVName appends the encoding of v to buf.
+func appendVName(buf []byte, v *spb.VName) []byte {
+	buf = append(append(buf, v.Signature...), vNameFieldSep...)
+	buf = append(append(buf, v.Corpus...), vNameFieldSep...)
+	buf = append(append(buf, v.Root...), vNameFieldSep...)
+	buf = append(append(buf, v.Path...), vNameFieldSep...)
+	return append(buf, v.Language...)
 }
 
 // decodeVName returns the VName coded in the given string. Returns nil, if len(data) == 0.
@@ -594,15 +1738,31 @@ func decodeVName(data string) (*spb.VName, error) {
 	if len(data) == 0 {
 		return nil, nil
 	}
-	parts := strings.SplitN(data, vNameFieldSep, 5)
-	if len(parts) != 5 {
-		return nil, fmt.Errorf("invalid VName encoding: %q", data)
-	}
-	return &spb.VName{
-		Signature: parts[0],
-		Corpus:    parts[1],
-		Root:      parts[2],
-		Path:      parts[3],
-		Language:  parts[4],
-	}, nil
+	v := new(spb.VName)
+	if err := decodeVNameInto(v, data); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// decodeVNameInto sets v to the VName coded in the given non-empty string.  The
+// fields of v share the data string.
+func decodeVNameInto(v *spb.VName, data string) error {
+	var fields [4]string
+	rest := data
+	for i := range fields {
+		j := strings.Index(rest, vNameFieldSep)
+		if j < 0 {
+			return fmt.Errorf("invalid VName encoding: %q", data)
+		}
+		fields[i], rest = rest[:j], rest[j+len(vNameFieldSep):]
+	}
+	*v = spb.VName{
+		Signature: fields[0],
+		Corpus:    fields[1],
+		Root:      fields[2],
+		Path:      fields[3],
+		Language:  rest,
+	}
+	return nil
 }
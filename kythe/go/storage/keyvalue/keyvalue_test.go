@@ -21,6 +21,8 @@ import (
 	"strings"
 	"testing"
 
+	"kythe.io/kythe/go/services/graphstore/compare"
+
 	"github.com/golang/protobuf/proto"
 
 	spb "kythe.io/kythe/proto/storage_proto"
@@ -129,6 +131,134 @@ func TestKeyEncoding(t *testing.T) {
 	}
 }
 
+func TestCanonicalKey(t *testing.T) {
+	tests := []*spb.Entry{
+		entry(vname("sig", "corpus", "root", "path", "language"), "", nil, "fact", "value"),
+		entry(vname("sig", "corpus", "root", "path", "language"), "someEdge", vname("anotherVName", "", "", "", ""), "/", ""),
+		entry(vname("a", "", "", "", ""), "", nil, "/", ""),
+		entry(vname("a", "b", "", "", ""), "", nil, "/", ""),
+		entry(vname("ab", "", "", "", ""), "", nil, "/", ""),
+	}
+
+	var keys [][]byte
+	for _, test := range tests {
+		key, err := EncodeKey(test.Source, test.FactName, test.EdgeKind, test.Target)
+		fatalOnErr(t, "Error encoding key: %v", err)
+		canonical, err := CanonicalKey(key)
+		fatalOnErr(t, "Error converting key: %v", err)
+
+		if want := compare.EncodeEntryKey(test); !bytes.Equal(canonical, want) {
+			t.Errorf("CanonicalKey(%q) = %q; want %q", key, canonical, want)
+		}
+		keys = append(keys, canonical)
+	}
+	for i, k1 := range keys {
+		for j, k2 := range keys {
+			if got, want := compare.Order(bytes.Compare(k1, k2)), compare.Entries(tests[i], tests[j]); got != want {
+				t.Errorf("Canonical order of %v and %v is %v; want %v", tests[i], tests[j], got, want)
+			}
+		}
+	}
+
+	if key, err := CanonicalKey([]byte("meta:shard_func")); err == nil {
+		t.Errorf("CanonicalKey of a non-entry key = %q; want error", key)
+	}
+}
+
+func TestCorpusKeyEncoding(t *testing.T) {
+	tests := []*spb.Entry{
+		entry(vname("sig", "corpus", "root", "path", "language"), "", nil, "fact", "value"),
+		entry(vname("sig", "corpus", "root", "path", "language"),
+			"someEdge", vname("anotherVName", "other", "", "", ""),
+			"/", ""),
+		entry(vname(corpusEntryKeyPrefix, "", "", "", ""), "", nil, "/", ""),
+	}
+
+	for _, test := range tests {
+		key, err := corpusKeys.encodeKey(test.Source, test.FactName, test.EdgeKind, test.Target)
+		fatalOnErr(t, "Error encoding key: %v", err)
+
+		r, err := corpusKeys.corpusRange(test.Source.Corpus)
+		fatalOnErr(t, "Error creating corpus range: %v", err)
+		if bytes.Compare(key, r.Start) < 0 || bytes.Compare(key, r.End) >= 0 {
+			t.Errorf("Key %q outside of its corpus range [%q, %q)", key, r.Start, r.End)
+		}
+		if corpus := keyCorpus(key); corpus != test.Source.Corpus {
+			t.Errorf("keyCorpus(%q) = %q; want %q", key, corpus, test.Source.Corpus)
+		}
+		if name := factName(key); name != test.FactName {
+			t.Errorf("factName(%q) = %q; want %q", key, name, test.FactName)
+		}
+
+		prefix, err := corpusKeys.appendKeyPrefix(nil, test.Source, test.EdgeKind)
+		fatalOnErr(t, "Error creating key prefix: %v", err)
+		if !bytes.HasPrefix(key, prefix) {
+			t.Fatalf("Key missing key prefix: %q %q", string(key), string(prefix))
+		}
+
+		entry, err := Entry(key, test.FactValue)
+		fatalOnErr(t, "Error creating Entry from key: %v", err)
+		if !proto.Equal(entry, test) {
+			t.Errorf("Expected Entry: {%+v}; Got: {%+v}", test, entry)
+		}
+
+		if ik := indexKey(key); ik != nil {
+			ek, err := indexedEntryKey(corpusKeys, ik)
+			fatalOnErr(t, "Error converting index key: %v", err)
+			if !bytes.Equal(ek, key) {
+				t.Errorf("indexedEntryKey(%q) = %q; want %q", ik, ek, key)
+			}
+		} else if test.Target != nil {
+			t.Errorf("Missing index key for edge %q", key)
+		}
+	}
+
+	if _, err := corpusKeys.corpusRange("a" + entryKeySepStr); err == nil {
+		t.Error("Missing error for corpus containing key separator")
+	}
+}
+
+func TestTargetIndexKeyOrder(t *testing.T) {
+	target := vname("target", "c", "", "", "")
+	sources := []*spb.VName{
+		vname("a", "", "", "", ""),
+		vname("a", "c", "", "", ""),
+		vname("b", "", "", "", ""),
+	}
+	var keys, indexKeys [][]byte
+	for _, src := range sources {
+		for _, kind := range []string{"/kythe/edge/childof", "/kythe/edge/ref"} {
+			key, err := EncodeKey(src, "/", kind, target)
+			fatalOnErr(t, "Error encoding key: %v", err)
+			ik := indexKey(key)
+			if ik == nil {
+				t.Fatalf("No index key for edge key %q", key)
+			}
+			if back, err := indexedEntryKey(legacyKeys, ik); err != nil {
+				t.Errorf("indexedEntryKey(%q): %v", ik, err)
+			} else if !bytes.Equal(back, key) {
+				t.Errorf("indexedEntryKey(%q) = %q; want %q", ik, back, key)
+			}
+			keys = append(keys, key)
+			indexKeys = append(indexKeys, ik)
+		}
+	}
+	// The index keys of a target's edges are ordered as the edges' entry keys.
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			t.Fatalf("Test keys are not in order: %q, %q", keys[i-1], keys[i])
+		} else if bytes.Compare(indexKeys[i-1], indexKeys[i]) >= 0 {
+			t.Errorf("Index keys %q and %q are out of entry order", indexKeys[i-1], indexKeys[i])
+		}
+	}
+
+	if key, err := EncodeKey(sources[0], "/kythe/node/kind", "", nil); err != nil {
+		t.Fatal(err)
+	} else if ik := indexKey(key); ik != nil {
+		t.Errorf("indexKey(%q) = %q; want nil for a node fact", key, ik)
+	}
+}
+
 func fatalOnErr(t *testing.T, msg string, err error) {
 	if err != nil {
 		t.Fatalf(msg, err)
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keyvalue
+
+import "kythe.io/kythe/go/services/graphstore"
+
+// Snapshot implements the graphstore.Snapshotter interface.  The returned
+// Service is a read-only *Store viewing a DB snapshot; closing it releases the
+// snapshot but leaves s open.
+func (s *Store) Snapshot() (graphstore.Service, error) {
+	return NewGraphStore(&snapshotDB{DB: s.db, snap: s.db.NewSnapshot()}), nil
+}
+
+// snapshotDB is a read-only DB whose reads are all pinned to snap.
+type snapshotDB struct {
+	DB
+	snap Snapshot
+}
+
+// options returns a copy of opts that reads from the pinned snapshot.
+func (s *snapshotDB) options(opts *Options) *Options {
+	o := &Options{Snapshot: s.snap}
+	if opts != nil {
+		o.LargeRead, o.Reverse = opts.LargeRead, opts.Reverse
+	}
+	return o
+}
+
+// Get implements part of the DB interface.
+func (s *snapshotDB) Get(key []byte, opts *Options) ([]byte, error) {
+	return s.DB.Get(key, s.options(opts))
+}
+
+// ScanPrefix implements part of the DB interface.
+func (s *snapshotDB) ScanPrefix(prefix []byte, opts *Options) (Iterator, error) {
+	return s.DB.ScanPrefix(prefix, s.options(opts))
+}
+
+// ScanRange implements part of the DB interface.
+func (s *snapshotDB) ScanRange(r *Range, opts *Options) (Iterator, error) {
+	return s.DB.ScanRange(r, s.options(opts))
+}
+
+// ApproximateSize implements the SizeEstimator interface if the underlying DB
+// does.  The estimate is of the current DB, not the snapshot.
+func (s *snapshotDB) ApproximateSize(r *Range) (int64, error) {
+	se, ok := s.DB.(SizeEstimator)
+	if !ok {
+		return 0, graphstore.ErrDiskSizeUnknown
+	}
+	return se.ApproximateSize(r)
+}
+
+// Writer implements part of the DB interface.  Snapshots cannot be written.
+func (s *snapshotDB) Writer() (Writer, error) { return nil, graphstore.ErrReadOnly }
+
+// NewSnapshot implements part of the DB interface.  Every read from s already
+// views the pinned snapshot, so the returned Snapshot is only a placeholder.
+func (s *snapshotDB) NewSnapshot() Snapshot { return nopSnapshot{} }
+
+// Close implements part of the DB interface by releasing the pinned snapshot.
+// The underlying DB is left open.
+func (s *snapshotDB) Close() error { return s.snap.Close() }
+
+type nopSnapshot struct{}
+
+// Close implements part of the Snapshot interface.
+func (nopSnapshot) Close() error { return nil }
@@ -0,0 +1,446 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package keyvalue
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// The optional target index of a Store's edges is persisted outside of the
+// entry key space as
+//   "tindex:<target>_<source>_<edgeKind>_<factName>" == "<factValue>"
+// for each edge entry, using the encodings of entry keys (see EncodeKey), so
+// that the index keys of a target's edges are in the order of their legacy
+// entry keys.  The index is maintained by each write of entries iff
+// "meta:target_index" is recorded; until then, the index is ignored.
+//
+// Keeping the index writes each edge entry twice, once under its index key
+// (see BenchmarkGSWriteEdgesIndexed of the leveldb package).  Node facts, which
+// include the typically large file contents, are not indexed.
+const (
+	targetIndexedKey     = "meta:target_index"
+	targetIndexKeyPrefix = "tindex:"
+)
+
+var targetIndexKeyPrefixBytes = []byte(targetIndexKeyPrefix)
+
+// indexKey returns the target index key of the given encoded entry key, or nil
+// if the entry is not an edge.
+func indexKey(key []byte) []byte {
+	_, rest, err := splitEntryKey(key)
+	if err != nil {
+		return nil
+	}
+	parts := bytes.SplitN(rest, entryKeySepBytes, 4)
+	if len(parts) != 4 || len(parts[1]) == 0 || bytes.Contains(parts[3], entryKeySepBytes) {
+		return nil
+	}
+	src, kind, fact, target := parts[0], parts[1], parts[2], parts[3]
+	return bytes.Join([][]byte{
+		append(targetIndexKeyPrefixBytes[:len(targetIndexKeyPrefixBytes):len(targetIndexKeyPrefixBytes)], target...),
+		src, kind, fact,
+	}, entryKeySepBytes)
+}
+
+// indexedEntryKey returns the encoded entry key, in the layout kf, of the given
+// target index key.
+func indexedEntryKey(kf *keyFormat, key []byte) ([]byte, error) {
+	parts := bytes.SplitN(bytes.TrimPrefix(key, targetIndexKeyPrefixBytes), entryKeySepBytes, 4)
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid target index key: %q", key)
+	}
+	target, src, kind, fact := parts[0], parts[1], parts[2], parts[3]
+	return bytes.Join([][]byte{
+		append(kf.appendHead(nil, string(vNameCorpus(src))), src...),
+		kind, fact, target,
+	}, entryKeySepBytes), nil
+}
+
+// targetIndexPrefix returns the prefix of the target index keys of the edges
+// to target.
+func targetIndexPrefix(target *spb.VName) ([]byte, error) {
+	enc, err := encodeVName(target)
+	if err != nil {
+		return nil, err
+	} else if bytes.Contains(enc, entryKeySepBytes) {
+		return nil, fmt.Errorf("target VName contains key separator %v", target)
+	}
+	return append(append([]byte(targetIndexKeyPrefix), enc...), entryKeySep), nil
+}
+
+// recordedTargetIndexed reports whether db records that its target index is
+// maintained.
+func recordedTargetIndexed(db DB) (bool, error) {
+	_, err := db.Get([]byte(targetIndexedKey), nil)
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("db get error: %v", err)
+	}
+	return true, nil
+}
+
+func (s *Store) loadTargetIndexed() {
+	s.indexOnce.Do(func() { s.indexed, s.indexErr = recordedTargetIndexed(s.db) })
+}
+
+// HasTargetIndex reports whether the Store maintains an index of its edges by
+// their targets (see ReindexTargets).
+func (s *Store) HasTargetIndex() (bool, error) {
+	s.loadTargetIndexed()
+	s.countMu.RLock()
+	defer s.countMu.RUnlock()
+	return s.indexed, s.indexErr
+}
+
+// ReindexProgress reports the progress of ReindexTargets.
+type ReindexProgress struct {
+	// Entries is the number of entries scanned so far.
+	Entries int64
+
+	// Edges is the number of edges indexed so far.
+	Edges int64
+}
+
+// reindexBatchEntries is the number of entries scanned by each batch of
+// ReindexTargets.
+const reindexBatchEntries = 1 << 16
+
+// ReindexTargets builds the Store's index of its edges by their targets from a
+// scan of its entries, and records in the DB that the index is maintained by
+// every later write, including by later Stores for the DB.  Any existing index
+// is rebuilt.  If progress != nil, it is called after each batch of the scan
+// and once after it completes.
+//
+// The entries are indexed in batches, each while writes are blocked; between
+// batches, writes proceed and maintain the index themselves.  Until the index
+// is complete, Scans do not use it.  Once indexed, Scans with an exactly
+// matched Target and ReverseEdges read the index rather than every entry of
+// the Store.
+func (s *Store) ReindexTargets(ctx context.Context, progress func(*ReindexProgress)) error {
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	s.reindexMu.Lock()
+	defer s.reindexMu.Unlock()
+	if err := s.stopTargetIndex(); err != nil {
+		return err
+	}
+	// No write touches the index keys until the index is being built.
+	if err := s.deleteTargetIndex(ctx); err != nil {
+		return err
+	}
+	s.setIndexing(true)
+	defer s.setIndexing(false)
+
+	p := new(ReindexProgress)
+	var after []byte // the last key indexed; nil before the first batch
+	for {
+		n, last, edges, err := s.reindexBatch(ctx, kf, after)
+		if err != nil {
+			return err
+		}
+		p.Entries += int64(n)
+		p.Edges += edges
+		if n < reindexBatchEntries {
+			break
+		}
+		after = last
+		if progress != nil {
+			progress(p)
+		}
+	}
+
+	if err := s.finishTargetIndex(); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(p)
+	}
+	return nil
+}
+
+// reindexBatch writes the index keys of the edges among the first
+// reindexBatchEntries entries following after (or from the first entry, if
+// after is nil) while writes are blocked.  It returns the number of entries
+// scanned, the last of their keys, and the number of edges indexed.
+func (s *Store) reindexBatch(ctx context.Context, kf *keyFormat, after []byte) (n int, last []byte, edges int64, err error) {
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+	iter, err := s.db.ScanPrefix(kf.prefix, &Options{LargeRead: true})
+	if err != nil {
+		return 0, nil, 0, fmt.Errorf("db seek error: %v", err)
+	}
+	defer iter.Close()
+	if after != nil {
+		if err := iter.Seek(append(append([]byte(nil), after...), 0)); err != nil {
+			return 0, nil, 0, fmt.Errorf("db seek error: %v", err)
+		}
+	}
+
+	pool := NewPool(s.db, nil)
+	for n < reindexBatchEntries {
+		if err := ctx.Err(); err != nil {
+			return 0, nil, 0, err
+		}
+		key, val, err := iter.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, nil, 0, fmt.Errorf("db iteration error: %v", err)
+		}
+		n++
+		last = append(last[:0], key...)
+		if ik := indexKey(key); ik != nil {
+			if err := pool.Write(ik, val); err != nil {
+				return 0, nil, 0, fmt.Errorf("db write error: %v", err)
+			}
+			edges++
+		}
+	}
+	if err := pool.Flush(); err != nil {
+		return 0, nil, 0, fmt.Errorf("db write error: %v", err)
+	}
+	return n, last, edges, nil
+}
+
+// stopTargetIndex stops maintaining the Store's existing target index (which
+// may have been only partially built), and removes its record from the DB.
+func (s *Store) stopTargetIndex() error {
+	s.loadTargetIndexed()
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+	if s.indexErr != nil {
+		return s.indexErr
+	}
+	wr, err := s.db.Writer()
+	if err == graphstore.ErrReadOnly {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("db writer error: %v", err)
+	}
+	if err := wr.Delete([]byte(targetIndexedKey)); err != nil {
+		wr.Close()
+		return fmt.Errorf("db delete error: %v", err)
+	} else if err := wr.Close(); err != nil {
+		return fmt.Errorf("db writer close error: %v", err)
+	}
+	s.indexed = false
+	return nil
+}
+
+// finishTargetIndex records in the DB that the Store's completed target index
+// is maintained, so that Scans may use it.
+func (s *Store) finishTargetIndex() error {
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+	wr, err := s.db.Writer()
+	if err != nil {
+		return fmt.Errorf("db writer error: %v", err)
+	} else if err := wr.Write([]byte(targetIndexedKey), nil); err != nil {
+		wr.Close()
+		return fmt.Errorf("db write error: %v", err)
+	} else if err := wr.Close(); err != nil {
+		return fmt.Errorf("db writer close error: %v", err)
+	}
+	s.indexed = true
+	return nil
+}
+
+// setIndexing records whether writes must maintain the target index while
+// ReindexTargets builds it.
+func (s *Store) setIndexing(indexing bool) {
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+	s.indexing = indexing
+}
+
+// deleteTargetIndexBatchSize is the number of stale target index keys deleted
+// by each Writer of ReindexTargets.
+const deleteTargetIndexBatchSize = 32000
+
+// deleteTargetIndex removes every target index key from the DB.
+func (s *Store) deleteTargetIndex(ctx context.Context) error {
+	iter, err := s.db.ScanPrefix(targetIndexKeyPrefixBytes, &Options{LargeRead: true})
+	if err != nil {
+		return fmt.Errorf("db seek error: %v", err)
+	}
+	var keys [][]byte
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		wr, err := s.db.Writer()
+		if err != nil {
+			return fmt.Errorf("db writer error: %v", err)
+		}
+		for _, key := range keys {
+			if err := wr.Delete(key); err != nil {
+				wr.Close()
+				return fmt.Errorf("db delete error: %v", err)
+			}
+		}
+		keys = keys[:0]
+		if err := wr.Close(); err != nil {
+			return fmt.Errorf("db writer close error: %v", err)
+		}
+		return nil
+	}
+	if err := streamKeys(ctx, iter, func(key []byte) error {
+		keys = append(keys, append([]byte(nil), key...))
+		if len(keys) < deleteTargetIndexBatchSize {
+			return nil
+		}
+		return flush()
+	}); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// writeIndexed adds the write of key's target index entry (if key is an edge)
+// to wr.
+func writeIndexed(wr Writer, key, val []byte) error {
+	if ik := indexKey(key); ik != nil {
+		if err := wr.Write(ik, val); err != nil {
+			return fmt.Errorf("db write error: %v", err)
+		}
+	}
+	return nil
+}
+
+// deleteIndexed adds the removal of key's target index entry (if key is an
+// edge) to wr.
+func deleteIndexed(wr Writer, key []byte) error {
+	if ik := indexKey(key); ik != nil {
+		if err := wr.Delete(ik); err != nil {
+			return fmt.Errorf("db delete error: %v", err)
+		}
+	}
+	return nil
+}
+
+// targetIndexUsable reports whether the entries matching req and opts may be
+// found using the Store's target index.
+func (s *Store) targetIndexUsable(req *spb.ScanRequest, opts *graphstore.ScanOptions) (bool, error) {
+	// An empty Target also matches node facts, which have no target.
+	if req.Target == nil || compare.VNamesEqual(req.Target, nil) {
+		return false, nil
+	}
+	return s.HasTargetIndex()
+}
+
+// targetIndexScanPrefix returns the prefix of the target index keys that may
+// match target according to opts, which is false if target cannot be matched
+// using the index.  A target with a non-empty field matches only edges, even
+// if its other fields match any value, so a partial or prefix target is matched
+// by the index keys of its Signature (or of every edge, without one).
+func targetIndexScanPrefix(target *spb.VName, opts *graphstore.ScanOptions) ([]byte, bool) {
+	if opts == nil || !opts.PartialTarget && !opts.PrefixTarget {
+		prefix, err := targetIndexPrefix(target)
+		return prefix, err == nil
+	}
+	prefix := append([]byte(nil), targetIndexKeyPrefixBytes...)
+	if target.Signature == "" {
+		return prefix, true
+	} else if strings.Contains(target.Signature, vNameFieldSep) || strings.Contains(target.Signature, entryKeySepStr) {
+		return nil, false
+	}
+	prefix = append(prefix, target.Signature...)
+	if !opts.PrefixTarget {
+		prefix = append(prefix, vNameFieldSep...)
+	}
+	return prefix, true
+}
+
+// scanTargetIndex calls f with each entry matching req and opts whose index
+// key has the given prefix, read from the Store's target index.  The entries
+// are delivered in the order of their index keys, which for the edges of one
+// target is entry order in the legacy key layout.
+func (s *Store) scanTargetIndex(ctx context.Context, prefix []byte, req *spb.ScanRequest, opts *graphstore.ScanOptions, f graphstore.EntryFunc) error {
+	kf, err := s.loadKeyFormat()
+	if err != nil {
+		return err
+	}
+	iter, err := s.db.ScanPrefix(prefix, nil)
+	if err != nil {
+		return fmt.Errorf("db seek error: %v", err)
+	}
+	defer iter.Close()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ik, val, err := iter.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("db iteration error: %v", err)
+		}
+		key, err := indexedEntryKey(kf, ik)
+		if err != nil {
+			return err
+		}
+		entry, err := Entry(key, val)
+		if err != nil {
+			return fmt.Errorf("invalid key/value entry: %v", err)
+		} else if !graphstore.EntryMatchesScanOpts(req, opts, entry) {
+			continue
+		}
+		if err := f(entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// ReverseEdges implements the graphstore.TargetIndexed interface.  If the
+// Store has no target index (see ReindexTargets), its entries are scanned.
+// The edges are delivered in order of their sources, kinds, and fact names.
+func (s *Store) ReverseEdges(ctx context.Context, target *spb.VName, kinds []string, f graphstore.EntryFunc) error {
+	req := &spb.ScanRequest{Target: target}
+	opts := &graphstore.ScanOptions{EdgeKinds: kinds}
+	edges := func(e *spb.Entry) error {
+		if e.EdgeKind == "" {
+			return nil
+		}
+		return f(e)
+	}
+	if ok, err := s.targetIndexUsable(req, nil); err != nil {
+		return err
+	} else if !ok {
+		return s.ScanOpts(ctx, req, opts, edges)
+	}
+
+	prefix, err := targetIndexPrefix(target)
+	if err != nil {
+		return s.ScanOpts(ctx, req, opts, edges)
+	}
+	return s.scanTargetIndex(ctx, prefix, req, opts, edges)
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package leveldb
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"kythe.io/kythe/go/storage/keyvalue"
+
+	"golang.org/x/net/context"
+)
+
+// A backup directory holds a LevelDB database (in its "db" subdirectory),
+// which is never opened in place, and a manifest recording the size and
+// SHA-256 checksum of each of the database's files.  The manifest is written
+// last, so a backup without one is incomplete.
+const (
+	backupDBDir    = "db"
+	backupManifest = "MANIFEST.backup"
+
+	// manifestHeader is the first line of a backup manifest.  Each following
+	// line is "<sha256> <size> <file name>".
+	manifestHeader = "kythe leveldb backup v1"
+)
+
+// ErrCorruptBackup is returned by Restore when a backup's files do not match
+// its manifest.
+var ErrCorruptBackup = errors.New("corrupt backup")
+
+// Backup implements the keyvalue.Backuper interface.  The backup is a copy of
+// the database as of a snapshot taken when Backup is called: writes after
+// that are not included, and reads and writes may continue throughout.
+//
+// The live database's files are not copied, as LevelDB may delete a table
+// file at any time once it has been compacted and keeps its most recent writes
+// only in its log.  Instead, the snapshot is written to a new database in
+// destDir, which must not exist, whose files are immutable once it is closed.
+// The files are then recorded in the backup's manifest.
+func (s *levelDB) Backup(ctx context.Context, destDir string) (err error) {
+	if _, err := os.Stat(destDir); err == nil {
+		return fmt.Errorf("backup directory %q already exists", destDir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(destDir)
+		}
+	}()
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	snap := s.NewSnapshot()
+	defer snap.Close()
+	iter, err := s.ScanPrefix(nil, &keyvalue.Options{LargeRead: true, Snapshot: snap})
+	if err != nil {
+		return fmt.Errorf("db seek error: %v", err)
+	}
+	defer iter.Close()
+
+	dbDir := filepath.Join(destDir, backupDBDir)
+	db, err := Open(dbDir, BulkLoadOptions())
+	if err != nil {
+		return err
+	}
+	pool := keyvalue.NewPool(db, nil)
+	for {
+		if err := ctx.Err(); err != nil {
+			db.Close()
+			return err
+		}
+		key, val, err := iter.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			db.Close()
+			return fmt.Errorf("db iteration error: %v", err)
+		}
+		if err := pool.Write(key, val); err != nil {
+			db.Close()
+			return fmt.Errorf("backup write error: %v", err)
+		}
+	}
+	if err := pool.Flush(); err != nil {
+		db.Close()
+		return fmt.Errorf("backup write error: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	return writeManifest(destDir)
+}
+
+// A backupFile is a file listed in a backup manifest.
+type backupFile struct {
+	name   string
+	size   int64
+	sha256 string
+}
+
+// writeManifest records the files of the backup database in destDir in its
+// manifest.
+func writeManifest(destDir string) error {
+	infos, err := ioutil.ReadDir(filepath.Join(destDir, backupDBDir))
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(destDir, backupDBDir, info.Name()))
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		lines = append(lines, fmt.Sprintf("%s %d %s", hex.EncodeToString(h.Sum(nil)), n, info.Name()))
+	}
+	sort.Strings(lines)
+
+	// Write the manifest atomically, so that it is only present once complete.
+	tmp := filepath.Join(destDir, backupManifest+".tmp")
+	data := manifestHeader + "\n" + strings.Join(lines, "\n") + "\n"
+	if err := ioutil.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(destDir, backupManifest))
+}
+
+// readManifest returns the files listed in the manifest of the backup in dir.
+func readManifest(dir string) ([]backupFile, error) {
+	f, err := os.Open(filepath.Join(dir, backupManifest))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%v: %q has no manifest (it is not a backup or is incomplete)", ErrCorruptBackup, dir)
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	if !s.Scan() || s.Text() != manifestHeader {
+		return nil, fmt.Errorf("%v: invalid manifest header in %q", ErrCorruptBackup, dir)
+	}
+	var files []backupFile
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), " ", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%v: invalid manifest line: %q", ErrCorruptBackup, s.Text())
+		}
+		size, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || parts[2] != filepath.Base(parts[2]) {
+			return nil, fmt.Errorf("%v: invalid manifest line: %q", ErrCorruptBackup, s.Text())
+		}
+		files = append(files, backupFile{name: parts[2], size: size, sha256: parts[0]})
+	}
+	return files, s.Err()
+}
+
+// Restore restores the backup in backupDir (written by Backup) to a new
+// database at path, which must not exist, and which may then be opened with
+// Open or OpenGraphStore.  Each of the backup's files is checked against the
+// size and checksum recorded in its manifest as it is copied; if any differs
+// (or is missing), ErrCorruptBackup is returned and nothing is left at path.
+func Restore(ctx context.Context, backupDir, path string) (err error) {
+	files, err := readManifest(backupDir)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("restore destination %q already exists", path)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(path)
+		}
+	}()
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := restoreFile(filepath.Join(backupDir, backupDBDir), path, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFile copies the given backup file from srcDir to destDir, checking
+// its size and checksum.
+func restoreFile(srcDir, destDir string, file backupFile) error {
+	src, err := os.Open(filepath.Join(srcDir, file.name))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%v: missing file %q", ErrCorruptBackup, file.name)
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := os.Create(filepath.Join(destDir, file.name))
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dest, h), src)
+	if cerr := dest.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	} else if n != file.size || hex.EncodeToString(h.Sum(nil)) != file.sha256 {
+		return fmt.Errorf("%v: file %q does not match its checksum", ErrCorruptBackup, file.name)
+	}
+	return nil
+}
@@ -20,33 +20,51 @@ package leveldb
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"kythe.io/kythe/go/services/graphstore"
 	"kythe.io/kythe/go/storage/gsutil"
 	"kythe.io/kythe/go/storage/keyvalue"
+	"kythe.io/kythe/go/util/datasize"
 
 	"github.com/jmhodges/levigo"
+	"golang.org/x/net/context"
 )
 
 func init() {
-	gsutil.Register("leveldb", func(spec string) (graphstore.Service, error) { return OpenGraphStore(spec, nil) })
+	graphstore.Register("leveldb", func(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+		return OpenGraphStore(graphstore.SpecLocation(u), nil)
+	})
 	gsutil.RegisterDefault("leveldb")
 }
 
 // levelDB is a wrapper around a levigo.DB that implements keyvalue.DB
 type levelDB struct {
-	db    *levigo.DB
-	cache *levigo.Cache
+	db     *levigo.DB
+	cache  *levigo.Cache
+	filter *levigo.FilterPolicy // nil if the database has no Bloom filters
 
 	// save options to reduce number of allocations during high load
 	readOpts      *levigo.ReadOptions
 	largeReadOpts *levigo.ReadOptions
 	writeOpts     *levigo.WriteOptions
+
+	path    string
+	minFree int64 // the free disk bytes required by CheckHealth; if < 0, none
 }
 
+// DefaultMinFreeDiskBytes is the free disk space required for a database to be
+// healthy if its Options.MinFreeDiskBytes is 0.
+const DefaultMinFreeDiskBytes = 64 * 1024 * 1024 // 64mb
+
 // DefaultOptions is the default Options struct passed to Open when not
 // otherwise given one.
 var DefaultOptions = &Options{
@@ -68,9 +86,133 @@ type Options struct {
 	// (backed by a disk log) before writing to the on-disk table.
 	WriteBufferSize int
 
+	// BloomFilterBitsPerKey, if positive, is the number of bits per key of the
+	// Bloom filter kept for each table, by which most reads of keys absent from
+	// a table skip reading the table.  10 bits per key gives a false positive
+	// rate of about 1%.
+	BloomFilterBitsPerKey int
+
+	// DisableCompression disables the Snappy compression of each table block.
+	DisableCompression bool
+
+	// MaxOpenFiles, if positive, is the maximum number of files kept open by
+	// the database (LevelDB's default is 1000).  Tables beyond the limit must be
+	// reopened for each read.
+	MaxOpenFiles int
+
 	// MustExist ensures that the given database exists before opening it.  If
 	// false and the database does not exist, it will be created.
 	MustExist bool
+
+	// ShardFunc, if non-empty, names the registered graphstore.ShardFunc used to
+	// assign the GraphStore's entries to shards.  It is recorded in the database
+	// so that it continues to be used when reopened without it.  See
+	// keyvalue.NewShardedGraphStore.
+	ShardFunc string
+
+	// TargetIndex causes the GraphStore to maintain an index of its edges by
+	// their targets, by which Scans for a given target and
+	// graphstore.ReverseEdges need not read every entry.  If the database has
+	// no index, it is built when the database is opened (see
+	// keyvalue.Store.ReindexTargets); once built, it continues to be
+	// maintained when reopened without TargetIndex.
+	TargetIndex bool
+
+	// UnsafeRead causes the GraphStore to reuse a single Entry for each Read
+	// and Scan: an entry passed to an EntryFunc is only valid until it returns
+	// and must be copied to be retained.  See keyvalue.Store.SetUnsafeRead.
+	UnsafeRead bool
+
+	// CorpusKeys causes a new database's entry keys to be prefixed by their
+	// sources' corpora, so that each corpus may be scanned, sized, and deleted
+	// without reading the others (see keyvalue.NewCorpusGraphStore).  The
+	// layout is recorded in the database, and continues to be used when
+	// reopened without CorpusKeys.  An existing database with entries in the
+	// legacy layout must first be migrated with keyvalue.MigrateKeys.
+	CorpusKeys bool
+
+	// MinFreeDiskBytes is the free space that the filesystem holding the
+	// database must have for the database to be healthy (see
+	// graphstore.CheckHealth), so that a store whose disk is nearly full is
+	// reported before its writes fail.  If 0, DefaultMinFreeDiskBytes is used;
+	// if negative, the free space is not checked.
+	MinFreeDiskBytes int64
+}
+
+// BulkLoadOptions returns Options suited to loading a large number of entries
+// into a database: a large write buffer, so that each compaction merges fewer,
+// larger tables, and a small cache, as few reads are expected.
+func BulkLoadOptions() *Options {
+	return &Options{
+		CacheCapacity:         64 * 1024 * 1024,  // 64mb
+		WriteBufferSize:       256 * 1024 * 1024, // 256mb
+		BloomFilterBitsPerKey: 10,
+		MaxOpenFiles:          4096,
+	}
+}
+
+// ServingOptions returns Options suited to serving reads from a database that
+// is rarely written: a large cache and Bloom filters.
+func ServingOptions() *Options {
+	return &Options{
+		CacheCapacity:         1024 * 1024 * 1024, // 1gb
+		WriteBufferSize:       4 * 1024 * 1024,    // 4mb
+		BloomFilterBitsPerKey: 10,
+		MaxOpenFiles:          4096,
+	}
+}
+
+// presets are the named Options selectable by the flags of FlagOptions.
+var presets = map[string]func() *Options{
+	"default": func() *Options {
+		opts := *DefaultOptions
+		return &opts
+	},
+	"bulk_load": BulkLoadOptions,
+	"serving":   ServingOptions,
+}
+
+// FlagOptions defines flags (each prefixed by "leveldb_") for tuning the
+// Options of a LevelDB database and returns a function that returns the
+// Options given by the flags once they are parsed: those of the named preset
+// (one of "default", "bulk_load", or "serving"; see --leveldb_preset), with
+// each field given by its own flag overridden.
+func FlagOptions(preset string) func() (*Options, error) {
+	name := flag.String("leveldb_preset", preset, "Preset LevelDB tuning options (default, bulk_load, or serving), overridden by the other --leveldb flags")
+	writeBuffer := datasize.Flag("leveldb_write_buffer_size", "0", "Size of LevelDB's in-memory write buffer (0 for the preset's)")
+	cache := datasize.Flag("leveldb_cache_size", "0", "Size of LevelDB's block cache (0 for the preset's)")
+	bloomBits := flag.Int("leveldb_bloom_bits_per_key", -1, "Bits per key of LevelDB's Bloom filters (0 for none; -1 for the preset's)")
+	compression := flag.String("leveldb_compression", "", `Compression of LevelDB's tables ("snappy" or "none"; empty for the preset's)`)
+	maxOpenFiles := flag.Int("leveldb_max_open_files", 0, "Maximum number of files kept open by LevelDB (0 for the preset's)")
+	return func() (*Options, error) {
+		p, ok := presets[*name]
+		if !ok {
+			return nil, fmt.Errorf("unknown LevelDB preset: %q", *name)
+		}
+		opts := p()
+		if writeBuffer.Bytes() > 0 {
+			opts.WriteBufferSize = int(writeBuffer.Bytes())
+		}
+		if cache.Bytes() > 0 {
+			opts.CacheCapacity = int(cache.Bytes())
+		}
+		if *bloomBits >= 0 {
+			opts.BloomFilterBitsPerKey = *bloomBits
+		}
+		switch *compression {
+		case "":
+		case "snappy":
+			opts.DisableCompression = false
+		case "none":
+			opts.DisableCompression = true
+		default:
+			return nil, fmt.Errorf("unknown LevelDB compression: %q", *compression)
+		}
+		if *maxOpenFiles > 0 {
+			opts.MaxOpenFiles = *maxOpenFiles
+		}
+		return opts, nil
+	}
 }
 
 // ValidDB determines if the given path could be a LevelDB database.
@@ -80,13 +222,47 @@ func ValidDB(path string) bool {
 }
 
 // OpenGraphStore returns a graphstore.Service backed by a LevelDB database at
-// the given filepath.  If opts==nil, the DefaultOptions are used.
+// the given filepath.  If opts==nil, the DefaultOptions are used.  It returns
+// keyvalue.ErrMixedKeyFormats if the database has entries in both the legacy
+// and per-corpus key layouts.
 func OpenGraphStore(path string, opts *Options) (graphstore.Service, error) {
 	db, err := Open(path, opts)
 	if err != nil {
 		return nil, err
 	}
-	return keyvalue.NewGraphStore(db), nil
+	gs := keyvalue.NewGraphStore(db)
+	if opts != nil && opts.CorpusKeys {
+		if gs, err = keyvalue.NewCorpusGraphStore(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if opts != nil && opts.ShardFunc != "" {
+		if gs, err = keyvalue.NewShardedGraphStore(db, opts.ShardFunc); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	// Reject a database with entries in both key layouts before it is used.
+	if _, err := gs.CorpusKeyed(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if opts != nil && opts.UnsafeRead {
+		gs.SetUnsafeRead(true)
+	}
+	if opts != nil && opts.TargetIndex {
+		if ok, err := gs.HasTargetIndex(); err != nil {
+			db.Close()
+			return nil, err
+		} else if !ok {
+			if err := gs.ReindexTargets(context.Background(), nil); err != nil {
+				db.Close()
+				return nil, fmt.Errorf("error indexing targets: %v", err)
+			}
+		}
+	}
+	return gs, nil
 }
 
 // Open returns a keyvalue DB backed by a LevelDB database at the given
@@ -104,25 +280,66 @@ func Open(path string, opts *Options) (keyvalue.DB, error) {
 	if opts.WriteBufferSize > 0 {
 		options.SetWriteBufferSize(opts.WriteBufferSize)
 	}
+	var filter *levigo.FilterPolicy
+	if opts.BloomFilterBitsPerKey > 0 {
+		filter = levigo.NewBloomFilter(opts.BloomFilterBitsPerKey)
+		options.SetFilterPolicy(filter)
+	}
+	if opts.DisableCompression {
+		options.SetCompression(levigo.NoCompression)
+	}
+	if opts.MaxOpenFiles > 0 {
+		options.SetMaxOpenFiles(opts.MaxOpenFiles)
+	}
 	db, err := levigo.Open(path, options)
 	if err != nil {
+		cache.Close()
+		if filter != nil {
+			filter.Close()
+		}
 		return nil, fmt.Errorf("could not open LevelDB at %q: %v", path, err)
 	}
 	largeReadOpts := levigo.NewReadOptions()
 	largeReadOpts.SetFillCache(opts.CacheLargeReads)
+	minFree := opts.MinFreeDiskBytes
+	if minFree == 0 {
+		minFree = DefaultMinFreeDiskBytes
+	}
 	return &levelDB{
 		db:            db,
 		cache:         cache,
+		filter:        filter,
 		readOpts:      levigo.NewReadOptions(),
 		largeReadOpts: largeReadOpts,
 		writeOpts:     levigo.NewWriteOptions(),
+		path:          path,
+		minFree:       minFree,
 	}, nil
 }
 
+// CheckHealth implements the keyvalue.HealthChecker interface.  The database
+// is unhealthy if its filesystem has less than its minimum free space.
+func (s *levelDB) CheckHealth(ctx context.Context) error {
+	if s.minFree < 0 {
+		return nil
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(s.path, &st); err != nil {
+		return fmt.Errorf("checking free space of %q: %v", s.path, err)
+	}
+	if free := int64(st.Bavail) * int64(st.Bsize); free < s.minFree {
+		return fmt.Errorf("LevelDB at %q has %d bytes of free disk space; at least %d required", s.path, free, s.minFree)
+	}
+	return nil
+}
+
 // Close will close the underlying LevelDB database.
 func (s *levelDB) Close() error {
 	s.db.Close()
 	s.cache.Close()
+	if s.filter != nil {
+		s.filter.Close()
+	}
 	s.readOpts.Close()
 	s.largeReadOpts.Close()
 	s.writeOpts.Close()
@@ -165,22 +382,133 @@ func (s *levelDB) Get(key []byte, opts *keyvalue.Options) ([]byte, error) {
 	return v, nil
 }
 
+// ApproximateSize implements the keyvalue.SizeEstimator interface using
+// LevelDB's estimate of the file system space used by the range.  Recently
+// written data may not yet be reflected in the estimate.
+func (s *levelDB) ApproximateSize(r *keyvalue.Range) (int64, error) {
+	sizes := s.db.GetApproximateSizes([]levigo.Range{{Start: r.Start, Limit: r.End}})
+	return int64(sizes[0]), nil
+}
+
+// CompactRange implements the keyvalue.Compactor interface.  LevelDB allows
+// concurrent reads and writes during a compaction.
+func (s *levelDB) CompactRange(r *keyvalue.Range) error {
+	var lr levigo.Range
+	if r != nil {
+		lr = levigo.Range{Start: r.Start, Limit: r.End}
+	}
+	s.db.CompactRange(lr)
+	return nil
+}
+
+// DBStats implements the keyvalue.StatsReporter interface using LevelDB's
+// "leveldb.stats" property.
+func (s *levelDB) DBStats() (*keyvalue.DBStats, error) {
+	return parseStats(s.db.PropertyValue("leveldb.stats"))
+}
+
+// parseStats parses the value of LevelDB's "leveldb.stats" property: a table
+// with a row for each non-empty level of its number of files, its size, and the
+// time spent, bytes read, and bytes written by compactions into the level.  The
+// sizes are in megabytes.
+//
+// The read amplification is the number of level 0 files (which may overlap)
+// plus the number of deeper levels, each of which has at most one file
+// containing a given key.  The write amplification is the ratio of the bytes
+// written to all levels to those written to level 0, which are the memtables
+// flushed from the log.
+func parseStats(s string) (*keyvalue.DBStats, error) {
+	const mb = 1 << 20
+	lines := strings.Split(s, "\n")
+	// Skip the table's header rows.
+	for len(lines) > 0 && !strings.HasPrefix(lines[0], "---") {
+		lines = lines[1:]
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("malformed LevelDB stats: %q", s)
+	}
+
+	stats := &keyvalue.DBStats{}
+	var level0Writes, totalWrites int64
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		} else if len(fields) != 6 {
+			return nil, fmt.Errorf("malformed LevelDB stats row: %q", line)
+		}
+		var (
+			ls   keyvalue.LevelStats
+			nums [4]float64
+			err  error
+		)
+		if ls.Level, err = strconv.Atoi(fields[0]); err != nil {
+			return nil, fmt.Errorf("malformed LevelDB stats row: %q", line)
+		} else if ls.Files, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, fmt.Errorf("malformed LevelDB stats row: %q", line)
+		}
+		for i := range nums {
+			if nums[i], err = strconv.ParseFloat(fields[i+2], 64); err != nil {
+				return nil, fmt.Errorf("malformed LevelDB stats row: %q", line)
+			}
+		}
+		ls.Bytes = int64(nums[0] * mb)
+		ls.CompactionTime = time.Duration(nums[1] * float64(time.Second))
+		ls.CompactionReadBytes = int64(nums[2] * mb)
+		ls.CompactionWriteBytes = int64(nums[3] * mb)
+		stats.Levels = append(stats.Levels, ls)
+
+		totalWrites += ls.CompactionWriteBytes
+		if ls.Level == 0 {
+			level0Writes = ls.CompactionWriteBytes
+			stats.ReadAmplification += float64(ls.Files)
+		} else if ls.Files > 0 {
+			stats.ReadAmplification++
+		}
+	}
+	if level0Writes > 0 {
+		stats.WriteAmplification = float64(totalWrites) / float64(level0Writes)
+	}
+	return stats, nil
+}
+
 // ScanPrefix implements part of the keyvalue.DB interface.
 func (s *levelDB) ScanPrefix(prefix []byte, opts *keyvalue.Options) (keyvalue.Iterator, error) {
 	iter, ro := s.iterator(opts)
-	if len(prefix) == 0 {
+	it := &iterator{it: iter, opts: ro, prefix: prefix, reverse: opts.IsReverse()}
+	if it.reverse {
+		it.seekBefore(prefixEnd(prefix))
+	} else if len(prefix) == 0 {
 		iter.SeekToFirst()
 	} else {
 		iter.Seek(prefix)
 	}
-	return &iterator{iter, ro, prefix, nil}, nil
+	return it, nil
 }
 
 // ScanRange implements part of the keyvalue.DB interface.
 func (s *levelDB) ScanRange(r *keyvalue.Range, opts *keyvalue.Options) (keyvalue.Iterator, error) {
 	iter, ro := s.iterator(opts)
-	iter.Seek(r.Start)
-	return &iterator{iter, ro, nil, r}, nil
+	it := &iterator{it: iter, opts: ro, r: r, reverse: opts.IsReverse()}
+	if it.reverse {
+		it.seekBefore(r.End)
+	} else {
+		iter.Seek(r.Start)
+	}
+	return it, nil
+}
+
+// prefixEnd returns the smallest key greater than every key with the given
+// prefix, or nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
 }
 
 func (s *levelDB) readOptions(opts *keyvalue.Options) *levigo.ReadOptions {
@@ -218,6 +546,12 @@ func (w *writer) Write(key, val []byte) error {
 	return nil
 }
 
+// Delete implements part of the keyvalue.Writer interface.
+func (w *writer) Delete(key []byte) error {
+	w.WriteBatch.Delete(key)
+	return nil
+}
+
 // Close implements part of the keyvalue.Writer interface.
 func (w *writer) Close() error {
 	if err := w.s.db.Write(w.s.writeOpts, w.WriteBatch); err != nil {
@@ -231,21 +565,56 @@ type iterator struct {
 	it   *levigo.Iterator
 	opts *levigo.ReadOptions
 
-	prefix []byte
-	r      *keyvalue.Range
+	prefix  []byte
+	r       *keyvalue.Range
+	reverse bool
+}
+
+// seekBefore positions the iterator at the last key strictly less than end.  If
+// end is nil, the iterator is positioned at the last key.
+func (i *iterator) seekBefore(end []byte) {
+	if end == nil {
+		i.it.SeekToLast()
+		return
+	}
+	i.it.Seek(end)
+	if i.it.Valid() {
+		i.it.Prev()
+	} else {
+		i.it.SeekToLast()
+	}
 }
 
 // Close implements part of the keyvalue.Iterator interface.
-func (i iterator) Close() error {
+func (i *iterator) Close() error {
+	if i.it == nil {
+		return nil // already Closed
+	}
 	if i.opts != nil {
 		i.opts.Close()
 	}
 	i.it.Close()
+	i.it, i.opts = nil, nil
+	return nil
+}
+
+// Seek implements part of the keyvalue.Iterator interface.
+func (i *iterator) Seek(key []byte) error {
+	if !i.reverse {
+		i.it.Seek(key)
+		return nil
+	}
+	i.it.Seek(key)
+	if !i.it.Valid() {
+		i.it.SeekToLast()
+	} else if !bytes.Equal(i.it.Key(), key) {
+		i.it.Prev()
+	}
 	return nil
 }
 
 // Next implements part of the keyvalue.Iterator interface.
-func (i iterator) Next() ([]byte, []byte, error) {
+func (i *iterator) Next() ([]byte, []byte, error) {
 	if !i.it.Valid() {
 		if err := i.it.GetError(); err != nil {
 			return nil, nil, err
@@ -253,9 +622,15 @@ func (i iterator) Next() ([]byte, []byte, error) {
 		return nil, nil, io.EOF
 	}
 	key, val := i.it.Key(), i.it.Value()
-	if (i.r == nil && !bytes.HasPrefix(key, i.prefix)) || (i.r != nil && bytes.Compare(key, i.r.End) >= 0) {
+	if i.r == nil && !bytes.HasPrefix(key, i.prefix) {
+		return nil, nil, io.EOF
+	} else if i.r != nil && ((!i.reverse && bytes.Compare(key, i.r.End) >= 0) || (i.reverse && bytes.Compare(key, i.r.Start) < 0)) {
 		return nil, nil, io.EOF
 	}
-	i.it.Next()
+	if i.reverse {
+		i.it.Prev()
+	} else {
+		i.it.Next()
+	}
 	return key, val, nil
 }
@@ -17,13 +17,29 @@
 package leveldb
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	gspkg "kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	kvpkg "kythe.io/kythe/go/storage/keyvalue"
 	"kythe.io/kythe/go/test/services/graphstore"
 	"kythe.io/kythe/go/test/storage/keyvalue"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
 )
 
 const (
@@ -49,6 +65,16 @@ func tempGS() (graphstore.Service, graphstore.DestroyFunc, error) {
 	return keyvalue.NewGraphStore(db), graphstore.DestroyFunc(destroy), err
 }
 
+func tempIndexedGS() (graphstore.Service, graphstore.DestroyFunc, error) {
+	path, err := ioutil.TempDir("", "levelDB.tindex")
+	if err != nil {
+		return nil, graphstore.NullDestroy, err
+	}
+	destroy := func() error { return os.RemoveAll(path) }
+	gs, err := OpenGraphStore(path, &Options{TargetIndex: true})
+	return gs, destroy, err
+}
+
 func destroy(i interface{}) error { return os.RemoveAll(i.(string)) }
 
 func BenchmarkWriteSingle(b *testing.B) { keyvalue.BatchWriteBenchmark(b, tempDB, 1) }
@@ -79,6 +105,1562 @@ func BenchmarkGSWriteBatchLrg(b *testing.B) {
 	graphstore.BatchWriteBenchmark(b, tempGS, largeBatchSize)
 }
 
+func BenchmarkGSReadAllFacts(b *testing.B) {
+	graphstore.ReadFactsBenchmark(b, tempGS, nil)
+}
+func BenchmarkGSReadFactsNodeKind(b *testing.B) {
+	graphstore.ReadFactsBenchmark(b, tempGS, []string{"/kythe/node/kind"})
+}
+
+func BenchmarkGSSequentialScan(b *testing.B) {
+	graphstore.ShardedScanBenchmark(b, tempGS, 0)
+}
+func BenchmarkGSParallelShards4(b *testing.B) {
+	graphstore.ShardedScanBenchmark(b, tempGS, 4)
+}
+func BenchmarkGSParallelShards16(b *testing.B) {
+	graphstore.ShardedScanBenchmark(b, tempGS, 16)
+}
+
+func BenchmarkGSZipfRead(b *testing.B) {
+	graphstore.ZipfReadBenchmark(b, tempGS, nil)
+}
+func BenchmarkGSZipfReadCached(b *testing.B) {
+	graphstore.ZipfReadBenchmark(b, tempGS, func(s gspkg.Service) gspkg.Service {
+		return gspkg.NewCachingService(s, 1<<20)
+	})
+}
+
+// bulkLoadSources is the number of sources, each of 8 entries, written by each
+// iteration of the bulk load benchmarks: a load of about 2 million entries.
+const bulkLoadSources = 1 << 18
+
+// benchmarkBulkLoad measures loading bulkLoadSources sources, in a random
+// order and in transactions of 1000 sources, into a new database opened with
+// the given options.
+func benchmarkBulkLoad(b *testing.B, opts *Options) {
+	order := rand.New(rand.NewSource(0)).Perm(bulkLoadSources)
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		path, err := ioutil.TempDir("", "levelDB.bulkload")
+		if err != nil {
+			b.Fatal(err)
+		}
+		gs, err := OpenGraphStore(path, opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		var reqs []*spb.WriteRequest
+		for j, n := range order {
+			req := &spb.WriteRequest{Source: &spb.VName{Signature: fmt.Sprintf("node%d", n), Corpus: "bench"}}
+			for k := 0; k < 4; k++ {
+				req.Update = append(req.Update, &spb.WriteRequest_Update{
+					FactName:  fmt.Sprintf("/fact/%d", k),
+					FactValue: []byte(fmt.Sprintf("value%d-%d", n, k)),
+				}, &spb.WriteRequest_Update{
+					EdgeKind: fmt.Sprintf("/edge/%d", k),
+					Target:   &spb.VName{Signature: fmt.Sprintf("node%d", (n*7+k)%bulkLoadSources), Corpus: "bench"},
+					FactName: "/",
+				})
+			}
+			reqs = append(reqs, req)
+			if len(reqs) == 1000 || j == len(order)-1 {
+				if err := gs.(gspkg.Transactional).WriteBatch(ctx, reqs); err != nil {
+					b.Fatal(err)
+				}
+				reqs = reqs[:0]
+			}
+		}
+		if err := gs.Close(ctx); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		os.RemoveAll(path)
+		b.StartTimer()
+	}
+}
+
+// BenchmarkBulkLoadDefault and BenchmarkBulkLoadPreset compare the
+// DefaultOptions with the BulkLoadOptions for a load of millions of entries.
+func BenchmarkBulkLoadDefault(b *testing.B) { benchmarkBulkLoad(b, DefaultOptions) }
+func BenchmarkBulkLoadPreset(b *testing.B)  { benchmarkBulkLoad(b, BulkLoadOptions()) }
+
+func TestFlagOptions(t *testing.T) {
+	flags := FlagOptions("default")
+	if opts, err := flags(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(opts, DefaultOptions) {
+		t.Errorf("Unflagged options are %+v; want %+v", opts, DefaultOptions)
+	}
+
+	if err := flag.CommandLine.Parse([]string{
+		"--leveldb_preset=bulk_load",
+		"--leveldb_cache_size=1MiB",
+		"--leveldb_bloom_bits_per_key=0",
+		"--leveldb_compression=none",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := BulkLoadOptions()
+	want.CacheCapacity = 1 << 20
+	want.BloomFilterBitsPerKey = 0
+	want.DisableCompression = true
+	if opts, err := flags(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(opts, want) {
+		t.Errorf("Flagged options are %+v; want %+v", opts, want)
+	}
+
+	for _, args := range [][]string{
+		{"--leveldb_preset=fast"},
+		{"--leveldb_preset=default", "--leveldb_compression=zlib"},
+	} {
+		if err := flag.CommandLine.Parse(args); err != nil {
+			t.Fatal(err)
+		} else if _, err := flags(); err == nil {
+			t.Errorf("Options with %v returned no error", args)
+		}
+	}
+}
+
 func TestOrder(t *testing.T) {
 	graphstore.OrderTest(t, tempGS, largeBatchSize)
 }
+
+func TestDelete(t *testing.T) {
+	graphstore.DeleteTest(t, tempGS)
+}
+
+func TestCAS(t *testing.T) {
+	graphstore.CASTest(t, tempGS)
+}
+
+func TestGarbageCollection(t *testing.T) {
+	graphstore.GarbageCollectionTest(t, tempGS)
+}
+
+func TestReadMultiple(t *testing.T) {
+	graphstore.ReadMultipleTest(t, tempGS)
+}
+
+func TestPagedScan(t *testing.T) {
+	graphstore.PagedScanTest(t, tempGS)
+}
+
+func TestScanFrom(t *testing.T) {
+	graphstore.ScanFromTest(t, tempGS)
+}
+
+func TestReverseOrder(t *testing.T) {
+	graphstore.ReverseOrderTest(t, tempGS, mediumBatchSize)
+}
+
+func TestWriteStats(t *testing.T) {
+	graphstore.WriteStatsTest(t, tempGS)
+}
+
+func TestWriteIfAbsent(t *testing.T) {
+	graphstore.WriteIfAbsentTest(t, tempGS)
+}
+
+func TestWriteIfAbsentRace(t *testing.T) {
+	graphstore.WriteIfAbsentRaceTest(t, tempGS)
+}
+
+func TestSnapshot(t *testing.T) {
+	graphstore.SnapshotTest(t, tempGS)
+}
+
+func TestTransaction(t *testing.T) {
+	graphstore.TransactionTest(t, tempGS)
+}
+
+func TestScanOptions(t *testing.T) {
+	graphstore.ScanOptionsTest(t, tempGS)
+}
+
+func TestHealthCheck(t *testing.T) {
+	graphstore.HealthCheckTest(t, tempGS)
+}
+
+func TestReadFacts(t *testing.T) {
+	graphstore.ReadFactsTest(t, tempGS)
+}
+
+func TestBlobWrite(t *testing.T) {
+	graphstore.BlobWriteTest(t, tempGS)
+}
+
+func TestBlobWriteAbandoned(t *testing.T) {
+	db, destroy, err := tempDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroy()
+	ctx := context.Background()
+	gs := kvpkg.NewGraphStore(db)
+	defer gs.Close(ctx)
+
+	keys := func() int {
+		iter, err := db.ScanPrefix(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iter.Close()
+		var n int
+		for {
+			if _, _, err := iter.Next(); err == io.EOF {
+				return n
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			n++
+		}
+	}
+
+	before := keys()
+	w, err := gs.BeginFact(ctx, &spb.VName{Signature: "file"}, "/kythe/text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 3<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if n := keys(); n != before {
+		t.Errorf("Found %d keys for an abandoned writer; want %d", n, before)
+	}
+}
+
+func TestShardFuncReopen(t *testing.T) {
+	path, err := ioutil.TempDir("", "levelDB.shardfunc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	ctx := context.Background()
+	gs, err := OpenGraphStore(path, &Options{ShardFunc: gspkg.CorpusShardFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, corpus := range []string{"a", "b", "c", "d", "e"} {
+		for _, sig := range []string{"x", "y"} {
+			if err := gs.Write(ctx, &spb.WriteRequest{
+				Source: &spb.VName{Signature: sig, Corpus: corpus},
+				Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("test")}},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening without a ShardFunc must keep using the recorded one.
+	gs, err = OpenGraphStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+	fs, ok := gs.(gspkg.FuncSharded)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.FuncSharded", gs)
+	}
+	if name := fs.ShardFunc(); name != gspkg.CorpusShardFunc {
+		t.Fatalf("ShardFunc() = %q; want %q", name, gspkg.CorpusShardFunc)
+	}
+
+	const shards = 3
+	var total int64
+	for i := int64(0); i < shards; i++ {
+		count, err := fs.Count(ctx, &spb.CountRequest{Index: i, Shards: shards})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found int64
+		if err := fs.Shard(ctx, &spb.ShardRequest{Index: i, Shards: shards}, func(e *spb.Entry) error {
+			if s := gspkg.CorpusShards(e.Source, shards); int64(s) != i {
+				t.Errorf("entry %v found in shard %d; ShardFunc assigns it to %d", e, i, s)
+			}
+			found++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if found != count {
+			t.Errorf("Shard %d has %d entries; Count reported %d", i, found, count)
+		}
+		total += found
+	}
+	if total != 10 {
+		t.Errorf("Found %d total entries across shards; want 10", total)
+	}
+
+	if _, err := OpenGraphStore(path, &Options{ShardFunc: gspkg.HashShardFunc}); err == nil {
+		t.Error("Reopening with a different ShardFunc succeeded; expected an error")
+	}
+}
+
+func TestShardCounts(t *testing.T) {
+	path, err := ioutil.TempDir("", "levelDB.shardcounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	ctx := context.Background()
+	gs, err := OpenGraphStore(path, &Options{ShardFunc: gspkg.HashShardFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := func(r *rand.Rand) *spb.VName { return &spb.VName{Signature: fmt.Sprint(r.Intn(32))} }
+	workload := func(seed int64, ops int) error {
+		r := rand.New(rand.NewSource(seed))
+		for i := 0; i < ops; i++ {
+			var err error
+			switch r.Intn(4) {
+			case 0, 1:
+				req := &spb.WriteRequest{Source: src(r)}
+				for j := r.Intn(4); j >= 0; j-- {
+					req.Update = append(req.Update, &spb.WriteRequest_Update{
+						FactName:  fmt.Sprintf("/fact/%d", r.Intn(8)),
+						FactValue: []byte(fmt.Sprint(r.Int())),
+					})
+				}
+				err = gs.Write(ctx, req)
+			case 2:
+				err = gs.(gspkg.Deleter).Delete(ctx, &gspkg.DeleteRequest{
+					Source:   src(r),
+					FactName: fmt.Sprintf("/fact/%d", r.Intn(8)),
+				})
+			case 3:
+				_, err = gs.(gspkg.CAS).CompareAndSwap(ctx, src(r), "/fact/cas", nil, []byte("v"))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	check := func(desc string, shards int64) {
+		fs := gs.(gspkg.FuncSharded)
+		brute := make([]int64, shards)
+		if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+			brute[gspkg.HashShards(e.Source, int(shards))]++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < shards; i++ {
+			n, err := fs.Count(ctx, &spb.CountRequest{Index: i, Shards: shards})
+			if err != nil {
+				t.Fatal(err)
+			} else if n != brute[i] {
+				t.Errorf("%s: Count of shard %d/%d is %d; found %d entries", desc, i, shards, n, brute[i])
+			}
+		}
+	}
+
+	// Recount a store with existing entries, as after upgrading.
+	if err := workload(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.(gspkg.Recounter).Recount(ctx, 1, 4); err != nil {
+		t.Fatal(err)
+	}
+	check("after Recount", 4)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = workload(int64(i+2), 200)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("after concurrent writes", 1)
+	check("after concurrent writes", 4)
+
+	// The counts are persisted with the entries.
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	gs, err = OpenGraphStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+	check("after reopening", 4)
+	if err := workload(6, 50); err != nil {
+		t.Fatal(err)
+	}
+	check("after reopening and writing", 4)
+}
+
+func TestShardRanges(t *testing.T) {
+	path, err := ioutil.TempDir("", "levelDB.shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	ctx := context.Background()
+	gs, err := OpenGraphStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const sources = 1000
+	for i := 0; i < sources; i++ {
+		src := &spb.VName{Signature: fmt.Sprintf("sig%04d", i), Corpus: "corpus"}
+		if err := gs.Write(ctx, &spb.WriteRequest{
+			Source: src,
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/node/kind", FactValue: []byte("test")},
+				{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))},
+				{EdgeKind: "/kythe/edge/childof", Target: &spb.VName{Signature: "parent"}, FactName: "/"},
+				{EdgeKind: "/kythe/edge/childof", Target: &spb.VName{Signature: "other"}, FactName: "/"},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reopen the database so that its entries are flushed to tables, whose
+	// sizes LevelDB can estimate.
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	gs, err = OpenGraphStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+
+	var all []*spb.Entry
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		all = append(all, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := gs.(gspkg.Sharded)
+	read := func(shards int64) ([]*spb.Entry, []int) {
+		var (
+			found []*spb.Entry
+			sizes []int
+		)
+		for i := int64(0); i < shards; i++ {
+			count, err := sh.Count(ctx, &spb.CountRequest{Index: i, Shards: shards})
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := len(found)
+			if err := sh.Shard(ctx, &spb.ShardRequest{Index: i, Shards: shards}, func(e *spb.Entry) error {
+				found = append(found, e)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if n := int64(len(found) - start); n != count {
+				t.Errorf("Shard %d/%d has %d entries; Count reported %d", i, shards, n, count)
+			}
+			sizes = append(sizes, len(found)-start)
+		}
+		return found, sizes
+	}
+	for _, shards := range []int64{1, 3, 7, 32} {
+		found, sizes := read(shards)
+		if len(found) != len(all) {
+			t.Errorf("Found %d entries across %d shards; Scan found %d", len(found), shards, len(all))
+		} else {
+			for i, e := range found {
+				if !proto.Equal(e, all[i]) {
+					t.Errorf("Entry %d across %d shards is %v; Scan found %v", i, shards, e, all[i])
+					break
+				}
+			}
+		}
+		for i, n := range sizes {
+			if max := 2 * len(all) / int(shards); shards > 1 && n > max {
+				t.Errorf("Shard %d/%d has %d entries; want at most %d", i, shards, n, max)
+			}
+		}
+
+		// The shards are unchanged while the store is not written.
+		if _, again := read(shards); !reflect.DeepEqual(sizes, again) {
+			t.Errorf("Shard sizes for %d shards changed from %v to %v", shards, sizes, again)
+		}
+	}
+}
+
+func TestParseStats(t *testing.T) {
+	const stats = `                               Compactions
+Level  Files Size(MB) Time(sec) Read(MB) Write(MB)
+--------------------------------------------------
+  0        2        3         1        0        12
+  1        5       10         2       20        18
+  2       40      100         6      110       102
+`
+	got, err := parseStats(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const mb = 1 << 20
+	want := &kvpkg.DBStats{
+		Levels: []kvpkg.LevelStats{
+			{Level: 0, Files: 2, Bytes: 3 * mb, CompactionTime: time.Second, CompactionWriteBytes: 12 * mb},
+			{Level: 1, Files: 5, Bytes: 10 * mb, CompactionTime: 2 * time.Second, CompactionReadBytes: 20 * mb, CompactionWriteBytes: 18 * mb},
+			{Level: 2, Files: 40, Bytes: 100 * mb, CompactionTime: 6 * time.Second, CompactionReadBytes: 110 * mb, CompactionWriteBytes: 102 * mb},
+		},
+		ReadAmplification:  4,
+		WriteAmplification: 11,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStats(%q) = %+v; want %+v", stats, got, want)
+	}
+
+	for _, bad := range []string{"", "---\n 0 1 2\n", "---\n a 1 2 3 4 5\n"} {
+		if stats, err := parseStats(bad); err == nil {
+			t.Errorf("parseStats(%q) = %+v; expected an error", bad, stats)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path, err := ioutil.TempDir("", "levelDB.compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	ctx := context.Background()
+	gs, err := OpenGraphStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+	for i := 0; i < 200; i++ {
+		for _, corpus := range []string{"kept", "removed"} {
+			if err := gs.Write(ctx, &spb.WriteRequest{
+				Source: &spb.VName{Signature: fmt.Sprintf("sig%03d", i), Corpus: corpus},
+				Update: []*spb.WriteRequest_Update{{FactName: "/kythe/text", FactValue: make([]byte, 1024)}},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := gs.(gspkg.Deleter).Delete(ctx, &gspkg.DeleteRequest{
+			Source: &spb.VName{Signature: fmt.Sprintf("sig%03d", i), Corpus: "removed"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := gs.(*kvpkg.Store)
+	if _, err := store.DBStats(ctx); err != nil {
+		t.Fatalf("DBStats error: %v", err)
+	}
+
+	// Readers may continue during compaction.
+	stop, errc := make(chan struct{}), make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				errc <- nil
+				return
+			default:
+			}
+			var n int
+			if err := gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+				n++
+				return nil
+			}); err != nil {
+				errc <- err
+				return
+			} else if n != 200 {
+				errc <- fmt.Errorf("scan during compaction found %d entries; want 200", n)
+				return
+			}
+		}
+	}()
+	// The legacy key layout interleaves the corpora's keys.
+	if err := store.CompactCorpus(ctx, "removed"); err != kvpkg.ErrUnsupported {
+		t.Errorf("CompactCorpus error: %v; want %v", err, kvpkg.ErrUnsupported)
+	}
+	if err := store.Compact(ctx, nil); err != nil {
+		t.Errorf("Compact error: %v", err)
+	}
+	close(stop)
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+
+	var n int
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		if e.Source.Corpus != "kept" {
+			t.Errorf("Found entry of deleted corpus: %v", e)
+		}
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if n != 200 {
+		t.Errorf("Found %d entries after compaction; want 200", n)
+	}
+	if _, err := store.DBStats(ctx); err != nil {
+		t.Errorf("DBStats error after compaction: %v", err)
+	}
+}
+
+func TestTargetIndexConformance(t *testing.T) {
+	graphstore.OrderTest(t, tempIndexedGS, largeBatchSize)
+	graphstore.DeleteTest(t, tempIndexedGS)
+	graphstore.GarbageCollectionTest(t, tempIndexedGS)
+	graphstore.SnapshotTest(t, tempIndexedGS)
+	graphstore.TransactionTest(t, tempIndexedGS)
+	graphstore.ScanOptionsTest(t, tempIndexedGS)
+}
+
+func TestTargetIndex(t *testing.T) {
+	path, err := ioutil.TempDir("", "levelDB.tindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	ctx := context.Background()
+	gs, err := OpenGraphStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := []*spb.VName{{Signature: "t0"}, {Signature: "t1", Corpus: "c"}, {Signature: "t2"}}
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			src := &spb.VName{Signature: fmt.Sprintf("sig%03d", i)}
+			req := &spb.WriteRequest{
+				Source: src,
+				Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("test")}},
+			}
+			for j, target := range targets {
+				if i%(j+1) == 0 {
+					req.Update = append(req.Update,
+						&spb.WriteRequest_Update{EdgeKind: "/kythe/edge/ref", Target: target, FactName: "/"},
+						&spb.WriteRequest_Update{EdgeKind: "/kythe/edge/childof", Target: target, FactName: "/", FactValue: []byte{byte(i)}})
+				}
+			}
+			if err := gs.Write(ctx, req); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// sweep returns the entries matching req, found by checking every entry.
+	sweep := func(req *spb.ScanRequest) (found []*spb.Entry) {
+		if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+			if gspkg.EntryMatchesScan(req, e) {
+				found = append(found, e)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+	check := func(desc string) {
+		for _, target := range append(targets, &spb.VName{Signature: "missing"}) {
+			for _, kind := range []string{"", "/kythe/edge/ref"} {
+				req := &spb.ScanRequest{Target: target, EdgeKind: kind}
+				var found []*spb.Entry
+				if err := gs.Scan(ctx, req, func(e *spb.Entry) error {
+					found = append(found, e)
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if want := sweep(req); !entriesEqual(found, want) {
+					t.Errorf("%s: Scan(%v) found %d entries; want %d", desc, req, len(found), len(want))
+				}
+
+				var kinds []string
+				if kind != "" {
+					kinds = []string{kind}
+				}
+				var edges int
+				if err := gspkg.ReverseEdges(ctx, gs, target, kinds, func(e *spb.Entry) error {
+					if !gspkg.EntryMatchesScan(req, e) {
+						t.Errorf("%s: ReverseEdges(%v, %q) found %v", desc, target, kinds, e)
+					}
+					edges++
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if want := len(sweep(req)); edges != want {
+					t.Errorf("%s: ReverseEdges(%v, %q) found %d edges; want %d", desc, target, kinds, edges, want)
+				}
+			}
+		}
+
+		// Partial and prefix targets are matched by a scan of the index.
+		for _, test := range []struct {
+			target *spb.VName
+			opts   *gspkg.ScanOptions
+		}{
+			{&spb.VName{Corpus: "c"}, &gspkg.ScanOptions{PartialTarget: true}},
+			{&spb.VName{Signature: "t1"}, &gspkg.ScanOptions{PartialTarget: true}},
+			{&spb.VName{Signature: "t"}, &gspkg.ScanOptions{PartialTarget: true}},
+			{&spb.VName{Signature: "t"}, &gspkg.ScanOptions{PartialTarget: true, PrefixTarget: true}},
+			{&spb.VName{Signature: "t", Corpus: "c"}, &gspkg.ScanOptions{PrefixTarget: true}},
+		} {
+			req := &spb.ScanRequest{Target: test.target}
+			found := make(map[string]bool)
+			if err := gs.(gspkg.OptionsScanner).ScanOpts(ctx, req, test.opts, func(e *spb.Entry) error {
+				found[e.String()] = true
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			var want int
+			if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+				if gspkg.EntryMatchesScanOpts(req, test.opts, e) {
+					if !found[e.String()] {
+						t.Errorf("%s: ScanOpts(%v, %+v) did not find %v", desc, test.target, test.opts, e)
+					}
+					want++
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(found) != want {
+				t.Errorf("%s: ScanOpts(%v, %+v) found %d entries; want %d", desc, test.target, test.opts, len(found), want)
+			}
+		}
+	}
+
+	store := gs.(*kvpkg.Store)
+	write(0, 50)
+	if ok, err := store.HasTargetIndex(); err != nil || ok {
+		t.Fatalf("HasTargetIndex() = %v, %v; want false, nil", ok, err)
+	}
+	check("unindexed")
+
+	var last *kvpkg.ReindexProgress
+	if err := store.ReindexTargets(ctx, func(p *kvpkg.ReindexProgress) {
+		cp := *p
+		last = &cp
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if last == nil || last.Entries != int64(len(sweep(new(spb.ScanRequest)))) || last.Edges != last.Entries-50 {
+		t.Errorf("Final ReindexTargets progress: %+v", last)
+	}
+	check("after ReindexTargets")
+
+	write(50, 100)
+	if err := store.Delete(ctx, &gspkg.DeleteRequest{Source: &spb.VName{Signature: "sig000"}}); err != nil {
+		t.Fatal(err)
+	} else if err := store.Delete(ctx, &gspkg.DeleteRequest{
+		Source:   &spb.VName{Signature: "sig002"},
+		EdgeKind: "/kythe/edge/ref",
+		Target:   targets[1],
+		FactName: "/",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check("after writes")
+
+	// The index continues to be maintained after reopening.
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if gs, err = OpenGraphStore(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+	if ok, err := gs.(*kvpkg.Store).HasTargetIndex(); err != nil || !ok {
+		t.Fatalf("HasTargetIndex() after reopening = %v, %v; want true, nil", ok, err)
+	}
+	write(100, 120)
+	check("after reopening")
+
+	// Rebuilding the index leaves it unchanged.
+	if err := gs.(*kvpkg.Store).ReindexTargets(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	check("after rebuilding")
+}
+
+func TestReindexTargetsDuringWrites(t *testing.T) {
+	path, err := ioutil.TempDir("", "levelDB.reindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	ctx := context.Background()
+	gs, err := OpenGraphStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+	target := &spb.VName{Signature: "target"}
+	edges := func(sig string, n int) *spb.WriteRequest {
+		req := &spb.WriteRequest{Source: &spb.VName{Signature: sig}}
+		for i := 0; i < n; i++ {
+			req.Update = append(req.Update, &spb.WriteRequest_Update{
+				EdgeKind: fmt.Sprintf("/kythe/edge/e%04d", i),
+				Target:   target,
+				FactName: "/",
+			})
+		}
+		return req
+	}
+	// Enough entries for several batches of ReindexTargets.
+	for i := 0; i < 30; i++ {
+		if err := gs.Write(ctx, edges(fmt.Sprintf("old%02d", i), 5000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Write and delete edges on either side of the progress of each batch.
+	store := gs.(*kvpkg.Store)
+	var batches int
+	if err := store.ReindexTargets(ctx, func(p *kvpkg.ReindexProgress) {
+		batches++
+		for _, sig := range []string{fmt.Sprintf("new%02d", batches), fmt.Sprintf("aaa%02d", batches)} {
+			if err := gs.Write(ctx, edges(sig, 10)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, sig := range []string{"old00", "old29"} {
+			if err := store.Delete(ctx, &gspkg.DeleteRequest{
+				Source:   &spb.VName{Signature: sig},
+				EdgeKind: fmt.Sprintf("/kythe/edge/e%04d", batches),
+				Target:   target,
+				FactName: "/",
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if batches < 3 {
+		t.Fatalf("ReindexTargets reported %d batches; want at least 3", batches)
+	}
+
+	var want []*spb.Entry
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		want = append(want, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var found []*spb.Entry
+	if err := gs.Scan(ctx, &spb.ScanRequest{Target: target}, func(e *spb.Entry) error {
+		found = append(found, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !entriesEqual(found, want) {
+		t.Errorf("Indexed Scan found %d entries; want %d", len(found), len(want))
+	}
+}
+
+func entriesEqual(a, b []*spb.Entry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func BenchmarkGSWriteEdges(b *testing.B)        { benchmarkWriteEdges(b, tempGS) }
+func BenchmarkGSWriteEdgesIndexed(b *testing.B) { benchmarkWriteEdges(b, tempIndexedGS) }
+
+// benchmarkWriteEdges measures the cost of writing a node with a fact and 4
+// edges, to compare the cost of maintaining a target index.
+func benchmarkWriteEdges(b *testing.B, create graphstore.CreateFunc) {
+	gs, destroy, err := create()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer destroy()
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &spb.WriteRequest{
+			Source: &spb.VName{Signature: fmt.Sprintf("sig%08d", i), Corpus: "corpus", Path: "some/file.go"},
+			Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("anchor")}},
+		}
+		for j := 0; j < 4; j++ {
+			req.Update = append(req.Update, &spb.WriteRequest_Update{
+				EdgeKind: "/kythe/edge/ref",
+				Target:   &spb.VName{Signature: fmt.Sprintf("target%04d", (i*4+j)%1000), Corpus: "corpus", Language: "go"},
+				FactName: "/",
+			})
+		}
+		if err := gs.Write(ctx, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDiskSize(t *testing.T) {
+	gs, destroy, err := tempGS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroy()
+	defer gs.Close(context.Background())
+
+	ds, ok := gs.(gspkg.DiskSizer)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.DiskSizer", gs)
+	}
+	if _, err := ds.DiskSize(context.Background()); err != nil {
+		t.Errorf("DiskSize error: %v", err)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	ctx := context.Background()
+	path, err := ioutil.TempDir("", "levelDB.health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	for _, test := range []struct {
+		minFree int64
+		healthy bool
+	}{
+		{0, true},
+		{-1, true},
+		{1 << 62, false}, // more than any disk has free
+	} {
+		gs, err := OpenGraphStore(path, &Options{MinFreeDiskBytes: test.minFree})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := gs.(gspkg.HealthChecker); !ok {
+			t.Fatalf("%T does not implement graphstore.HealthChecker", gs)
+		}
+		if err := gspkg.CheckHealth(ctx, gs); test.healthy && err != nil {
+			t.Errorf("CheckHealth with MinFreeDiskBytes %d: unexpected error: %v", test.minFree, err)
+		} else if !test.healthy && err == nil {
+			t.Errorf("CheckHealth with MinFreeDiskBytes %d succeeded; expected an error", test.minFree)
+		}
+		if err := gs.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnsafeRead(t *testing.T) {
+	path, err := ioutil.TempDir("", "levelDB.unsafe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	gs, err := OpenGraphStore(path, &Options{UnsafeRead: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	var want []*spb.Entry
+	for _, sig := range []string{"a", "b"} {
+		src := &spb.VName{Signature: sig, Corpus: "corpus", Language: "go"}
+		req := &spb.WriteRequest{Source: src, Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+			{EdgeKind: "/kythe/edge/childof", Target: &spb.VName{Signature: sig + "parent"}, FactName: "/"},
+			{EdgeKind: "/kythe/edge/ref", Target: &spb.VName{Signature: sig + "ref", Path: "file"}, FactName: "/"},
+		}}
+		if err := gs.Write(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range req.Update {
+			want = append(want, &spb.Entry{
+				Source:    src,
+				EdgeKind:  u.EdgeKind,
+				Target:    u.Target,
+				FactName:  u.FactName,
+				FactValue: u.FactValue,
+			})
+		}
+	}
+	// Each Read or Scan passes the same reused entry to each call of its
+	// EntryFunc.
+	var got []*spb.Entry
+	var reused *spb.Entry
+	collect := func(e *spb.Entry) error {
+		if reused == nil {
+			reused = e
+		} else if e != reused {
+			t.Errorf("UnsafeRead entry %v was not reused", e)
+		}
+		got = append(got, proto.Clone(e).(*spb.Entry))
+		return nil
+	}
+	for _, i := range []int{0, 3} {
+		reused = nil
+		if err := gs.Read(ctx, &spb.ReadRequest{Source: want[i].Source, EdgeKind: "*"}, collect); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !entriesEqual(got, want) {
+		t.Errorf("Read entries: got %v; want %v", got, want)
+	}
+
+	got, reused = nil, nil
+	if err := gs.Scan(ctx, new(spb.ScanRequest), collect); err != nil {
+		t.Fatal(err)
+	}
+	if !entriesEqual(got, want) {
+		t.Errorf("Scan entries: got %v; want %v", got, want)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelDB.backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gs, err := OpenGraphStore(filepath.Join(dir, "live"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	// Each write atomically writes both facts of a new source, in order, so a
+	// consistent copy holds both facts of each of sources 0 to n-1, for some n.
+	write := func(i int) error {
+		return gs.Write(ctx, &spb.WriteRequest{
+			Source: &spb.VName{Signature: fmt.Sprintf("node%06d", i)},
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/a", FactValue: []byte("a")},
+				{FactName: "/b", FactValue: []byte("b")},
+			},
+		})
+	}
+	const initial = 100
+	for i := 0; i < initial; i++ {
+		if err := write(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Write concurrently with the backup.
+	started, stop, done := make(chan bool), make(chan bool), make(chan error)
+	go func() {
+		for i := initial; ; i++ {
+			if err := write(i); err != nil {
+				done <- err
+				return
+			}
+			if i == initial {
+				close(started)
+			}
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+		}
+	}()
+	<-started
+	backup := filepath.Join(dir, "backup")
+	if err := gs.(*kvpkg.Store).Backup(ctx, backup); err != nil {
+		t.Fatalf("Backup error: %v", err)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := Restore(ctx, backup, restored); err != nil {
+		t.Fatalf("Restore error: %v", err)
+	}
+	rs, err := OpenGraphStore(restored, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close(ctx)
+	facts := make(map[string]int)
+	if err := rs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		facts[e.Source.Signature]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(facts) < initial {
+		t.Errorf("Restored %d sources; want at least %d", len(facts), initial)
+	}
+	for i := 0; i < len(facts); i++ {
+		if n := facts[fmt.Sprintf("node%06d", i)]; n != 2 {
+			t.Errorf("Restored source %d has %d facts; want 2", i, n)
+		}
+	}
+
+	if err := gs.(*kvpkg.Store).Backup(ctx, backup); err == nil {
+		t.Error("Backup to an existing directory succeeded")
+	}
+}
+
+func TestRestoreCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "levelDB.backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gs, err := OpenGraphStore(filepath.Join(dir, "live"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	defer gs.Close(ctx)
+	if err := gs.Write(ctx, &spb.WriteRequest{
+		Source: &spb.VName{Signature: "node"},
+		Update: []*spb.WriteRequest_Update{{FactName: "/a", FactValue: []byte("a")}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	backup := filepath.Join(dir, "backup")
+	if err := gs.(*kvpkg.Store).Backup(ctx, backup); err != nil {
+		t.Fatalf("Backup error: %v", err)
+	}
+
+	files, err := readManifest(backup)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) == 0 {
+		t.Fatal("Backup manifest lists no files")
+	}
+	f, err := os.OpenFile(filepath.Join(backup, backupDBDir, files[0].name), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	restored := filepath.Join(dir, "restored")
+	if err := Restore(ctx, backup, restored); err == nil || !strings.Contains(err.Error(), ErrCorruptBackup.Error()) {
+		t.Errorf("Restore of a corrupt backup: got error %v; want %v", err, ErrCorruptBackup)
+	}
+	if _, err := os.Stat(restored); !os.IsNotExist(err) {
+		t.Errorf("Failed Restore left %q behind: %v", restored, err)
+	}
+
+	if err := os.Remove(filepath.Join(backup, backupManifest)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(ctx, backup, restored); err == nil || !strings.Contains(err.Error(), ErrCorruptBackup.Error()) {
+		t.Errorf("Restore of an incomplete backup: got error %v; want %v", err, ErrCorruptBackup)
+	}
+}
+
+func BenchmarkGSRead(b *testing.B)       { benchmarkRead(b, nil) }
+func BenchmarkGSUnsafeRead(b *testing.B) { benchmarkRead(b, &Options{UnsafeRead: true}) }
+
+// benchmarkRead measures the time and allocations of a Read of a node with 8
+// facts and 8 edges.
+func benchmarkRead(b *testing.B, opts *Options) {
+	path, err := ioutil.TempDir("", "levelDB.read")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	gs, err := OpenGraphStore(path, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	src := &spb.VName{Signature: "sig", Corpus: "corpus", Path: "some/file.go", Language: "go"}
+	req := &spb.WriteRequest{Source: src}
+	for i := 0; i < 8; i++ {
+		req.Update = append(req.Update, &spb.WriteRequest_Update{
+			FactName:  fmt.Sprintf("/kythe/fact/%d", i),
+			FactValue: []byte("value"),
+		}, &spb.WriteRequest_Update{
+			EdgeKind: "/kythe/edge/ref",
+			Target:   &spb.VName{Signature: fmt.Sprintf("target%d", i), Corpus: "corpus", Language: "go"},
+			FactName: "/",
+		})
+	}
+	if err := gs.Write(ctx, req); err != nil {
+		b.Fatal(err)
+	}
+
+	read := &spb.ReadRequest{Source: src, EdgeKind: "*"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		if err := gs.Read(ctx, read, func(*spb.Entry) error {
+			n++
+			return nil
+		}); err != nil {
+			b.Fatal(err)
+		} else if n != len(req.Update) {
+			b.Fatalf("Read found %d entries; want %d", n, len(req.Update))
+		}
+	}
+}
+
+func tempCorpusGS() (graphstore.Service, graphstore.DestroyFunc, error) {
+	path, err := ioutil.TempDir("", "levelDB.corpus")
+	if err != nil {
+		return nil, graphstore.NullDestroy, err
+	}
+	destroy := func() error { return os.RemoveAll(path) }
+	gs, err := OpenGraphStore(path, &Options{CorpusKeys: true})
+	return gs, destroy, err
+}
+
+func TestCorpusKeysConformance(t *testing.T) {
+	graphstore.DeleteTest(t, tempCorpusGS)
+	graphstore.CASTest(t, tempCorpusGS)
+	graphstore.ReadMultipleTest(t, tempCorpusGS)
+	graphstore.PagedScanTest(t, tempCorpusGS)
+	graphstore.ScanFromTest(t, tempCorpusGS)
+	graphstore.WriteStatsTest(t, tempCorpusGS)
+	graphstore.SnapshotTest(t, tempCorpusGS)
+	graphstore.TransactionTest(t, tempCorpusGS)
+	graphstore.ScanOptionsTest(t, tempCorpusGS)
+	graphstore.ReadFactsTest(t, tempCorpusGS)
+	graphstore.BlobWriteTest(t, tempCorpusGS)
+}
+
+// writeCorpora writes n sources to each of the given corpora, each with a
+// fact and an edge to a node in the first corpus.
+func writeCorpora(t *testing.T, gs gspkg.Service, n int, corpora ...string) {
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		for _, corpus := range corpora {
+			if err := gs.Write(ctx, &spb.WriteRequest{
+				Source: &spb.VName{Signature: fmt.Sprintf("sig%03d", i), Corpus: corpus},
+				Update: []*spb.WriteRequest_Update{
+					{FactName: "/kythe/text", FactValue: make([]byte, 256)},
+					{EdgeKind: "/kythe/edge/ref", Target: &spb.VName{Signature: "target", Corpus: corpora[0]}, FactName: "/"},
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// corpusCounts returns the number of entries of gs in each corpus.
+func corpusCounts(t *testing.T, gs gspkg.Service) map[string]int {
+	counts := make(map[string]int)
+	if err := gs.Scan(context.Background(), new(spb.ScanRequest), func(e *spb.Entry) error {
+		counts[e.Source.Corpus]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return counts
+}
+
+func TestCorpusKeys(t *testing.T) {
+	path, err := ioutil.TempDir("", "levelDB.corpus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	ctx := context.Background()
+	gs, err := OpenGraphStore(path, &Options{CorpusKeys: true, TargetIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCorpora(t, gs, 50, "kept", "removed", "other")
+	store := gs.(*kvpkg.Store)
+	if ok, err := store.CorpusKeyed(); err != nil || !ok {
+		t.Fatalf("CorpusKeyed() = %v, %v; want true", ok, err)
+	}
+
+	var n int
+	if err := store.ScanCorpus(ctx, "removed", &spb.ScanRequest{EdgeKind: "/kythe/edge/ref"}, func(e *spb.Entry) error {
+		if e.Source.Corpus != "removed" || e.EdgeKind != "/kythe/edge/ref" {
+			t.Errorf("ScanCorpus found %v", e)
+		}
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if n != 50 {
+		t.Errorf("ScanCorpus found %d entries; want 50", n)
+	}
+
+	kept, err := store.CorpusSize(ctx, "kept")
+	if err != nil {
+		t.Fatalf("CorpusSize error: %v", err)
+	}
+	total, err := store.DiskSize(ctx)
+	if err != nil {
+		t.Fatalf("DiskSize error: %v", err)
+	}
+	if kept <= 0 || kept*2 >= total {
+		t.Errorf("CorpusSize(kept) = %d; want about a third of %d", kept, total)
+	}
+	if size, err := store.CorpusSize(ctx, "missing"); err != nil || size != 0 {
+		t.Errorf("CorpusSize(missing) = %d, %v; want 0", size, err)
+	}
+
+	if err := store.DeleteCorpus(ctx, "removed"); err != nil {
+		t.Fatalf("DeleteCorpus error: %v", err)
+	}
+	if counts := corpusCounts(t, gs); !reflect.DeepEqual(counts, map[string]int{"kept": 100, "other": 100}) {
+		t.Errorf("Entries by corpus after DeleteCorpus: %v", counts)
+	}
+	var edges int
+	if err := gspkg.ReverseEdges(ctx, gs, &spb.VName{Signature: "target", Corpus: "kept"}, nil, func(e *spb.Entry) error {
+		if e.Source.Corpus == "removed" {
+			t.Errorf("ReverseEdges found deleted edge: %v", e)
+		}
+		edges++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if edges != 100 {
+		t.Errorf("ReverseEdges found %d edges; want 100", edges)
+	}
+	if err := store.CompactCorpus(ctx, "removed"); err != nil {
+		t.Errorf("CompactCorpus error: %v", err)
+	}
+	if err := store.CompactCorpus(ctx, "missing"); err != nil {
+		t.Errorf("CompactCorpus error for an absent corpus: %v", err)
+	}
+
+	// The layout is kept when reopened without CorpusKeys.
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	gs, err = OpenGraphStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+	if ok, err := gs.(*kvpkg.Store).CorpusKeyed(); err != nil || !ok {
+		t.Errorf("CorpusKeyed() after reopening = %v, %v; want true", ok, err)
+	}
+	if counts := corpusCounts(t, gs); !reflect.DeepEqual(counts, map[string]int{"kept": 100, "other": 100}) {
+		t.Errorf("Entries by corpus after reopening: %v", counts)
+	}
+}
+
+func TestCorpusKeysScanFrom(t *testing.T) {
+	gs, destroy, err := tempCorpusGS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroy()
+	defer gs.Close(context.Background())
+	writeCorpora(t, gs, 3, "b", "a", "c")
+
+	ctx := context.Background()
+	scan := func(after *spb.Entry) []*spb.Entry {
+		var found []*spb.Entry
+		if err := gspkg.ScanFrom(ctx, gs, new(spb.ScanRequest), after, func(e *spb.Entry) error {
+			found = append(found, e)
+			return nil
+		}); err != nil {
+			t.Fatalf("ScanFrom error: %v", err)
+		}
+		return found
+	}
+	equal := func(got, want []*spb.Entry) bool {
+		if len(got) != len(want) {
+			return false
+		}
+		for i := range want {
+			if !compare.EntriesEqual(got[i], want[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	all := scan(nil)
+	if len(all) != 18 {
+		t.Fatalf("Scan found %d entries; want 18", len(all))
+	}
+	// Entries are scanned corpus-major, rather than in compare.Entries order.
+	var corpora []string
+	for _, e := range all {
+		if n := len(corpora); n == 0 || corpora[n-1] != e.Source.Corpus {
+			corpora = append(corpora, e.Source.Corpus)
+		}
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(corpora, want) {
+		t.Fatalf("Scan found corpora %v; want %v", corpora, want)
+	}
+
+	// Resuming after each entry continues the Scan, across corpora.
+	for i, e := range all {
+		if got := scan(e); !equal(got, all[i+1:]) {
+			t.Errorf("ScanFrom entry %d {%v} found %d entries; want %d", i, e, len(got), len(all)-i-1)
+		}
+	}
+	// Resuming after a missing entry continues at the next entry in its
+	// corpus, or in the next corpus.
+	missing := &spb.Entry{Source: &spb.VName{Signature: "zzz", Corpus: "a"}, FactName: "/"}
+	if got := scan(missing); !equal(got, all[6:]) {
+		t.Errorf("ScanFrom missing entry found %d entries; want %d", len(got), len(all)-6)
+	}
+	missing.Source.Corpus = "bb"
+	if got := scan(missing); !equal(got, all[12:]) {
+		t.Errorf("ScanFrom missing corpus found %d entries; want %d", len(got), len(all)-12)
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	path, err := ioutil.TempDir("", "levelDB.migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	ctx := context.Background()
+	gs, err := OpenGraphStore(path, &Options{TargetIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCorpora(t, gs, 20, "a", "b")
+	var want []*spb.Entry
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		want = append(want, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.(*kvpkg.Store).DeleteCorpus(ctx, "a"); err != kvpkg.ErrUnsupported {
+		t.Errorf("DeleteCorpus of a legacy store: got error %v; want %v", err, kvpkg.ErrUnsupported)
+	}
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenGraphStore(path, &Options{CorpusKeys: true}); err == nil {
+		t.Error("Opened a legacy store with CorpusKeys")
+	}
+
+	// An interrupted migration leaves a store that cannot be opened.
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := kvpkg.MigrateKeys(cancelled, db, nil); err != context.Canceled {
+		t.Errorf("Cancelled MigrateKeys error: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenGraphStore(path, nil); err != kvpkg.ErrMixedKeyFormats {
+		t.Errorf("Opening a partially migrated store: got error %v; want %v", err, kvpkg.ErrMixedKeyFormats)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var migrated int64
+	if err := kvpkg.MigrateKeys(ctx, db, func(p *kvpkg.MigrateProgress) { migrated = p.Entries }); err != nil {
+		t.Fatalf("MigrateKeys error: %v", err)
+	} else if migrated != int64(len(want)) {
+		t.Errorf("MigrateKeys reported %d entries; want %d", migrated, len(want))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gs, err = OpenGraphStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := gs.(*kvpkg.Store)
+	if ok, err := store.CorpusKeyed(); err != nil || !ok {
+		t.Errorf("CorpusKeyed() after migration = %v, %v; want true", ok, err)
+	}
+	var got []*spb.Entry
+	if err := gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		got = append(got, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	compare.SortEntries(got)
+	if !entriesEqual(got, want) {
+		t.Errorf("Migrated store has %d entries; want %d", len(got), len(want))
+	}
+	var edges int
+	if err := gspkg.ReverseEdges(ctx, gs, &spb.VName{Signature: "target", Corpus: "a"}, nil, func(e *spb.Entry) error {
+		if err := gs.Read(ctx, &spb.ReadRequest{Source: e.Source, EdgeKind: e.EdgeKind}, func(*spb.Entry) error {
+			edges++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if edges != 40 {
+		t.Errorf("ReverseEdges found %d readable edges after migration; want 40", edges)
+	}
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A legacy key written by an older binary after the migration is rejected.
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := kvpkg.EncodeKey(&spb.VName{Signature: "late"}, "/kythe/text", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wr, err := db.Writer()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := wr.Write(key, nil); err != nil {
+		t.Fatal(err)
+	} else if err := wr.Close(); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenGraphStore(path, nil); err != kvpkg.ErrMixedKeyFormats {
+		t.Errorf("Opening a mixed store: got error %v; want %v", err, kvpkg.ErrMixedKeyFormats)
+	}
+}
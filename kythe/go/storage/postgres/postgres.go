@@ -0,0 +1,672 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package postgres implements a graphstore.Service using a PostgreSQL
+// database.
+//
+// Each entry is a row of the entries table keyed by its canonical entry key
+// (see compare.EncodeEntryKey), so Reads are range scans of the primary key.
+// Each row also records its source's hash bucket (see graphstore.HashShards),
+// by which the store is Sharded, and the encoded target of each edge, which is
+// indexed for Scans with a Target and for ReverseEdges.  Scans read their
+// results through a server-side cursor, a batch of rows at a time.
+package postgres
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"github.com/lib/pq"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func init() {
+	graphstore.Register("postgres", func(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+		// A postgres:// URL is itself a connection string; otherwise the spec
+		// following the scheme is.
+		if u.Opaque == "" && u.Host != "" {
+			return OpenGraphStore(u.String(), nil)
+		}
+		return OpenGraphStore(graphstore.SpecLocation(u), nil)
+	})
+}
+
+// Defaults for the fields of Options.
+const (
+	DefaultTable         = "kythe_entries"
+	DefaultBuckets       = 1024
+	DefaultFetchSize     = 1000
+	DefaultCopyThreshold = 1000
+	DefaultMaxOpenConns  = 16
+)
+
+// DefaultOptions is the default Options struct passed to OpenGraphStore when
+// not otherwise given one.
+var DefaultOptions = &Options{}
+
+// Options for customizing a PostgreSQL backend.
+type Options struct {
+	// Table is the name of the entries table, which is created if it does not
+	// exist along with a table of its metadata (named with a "_meta" suffix).
+	// If empty, DefaultTable is used.
+	Table string
+
+	// Buckets is the number of hash buckets into which sources are divided for
+	// Sharding.  It is fixed when the table is created; if zero, the existing
+	// table's number (or DefaultBuckets for a new table) is used.
+	Buckets int
+
+	// FetchSize is the number of rows fetched from a Scan's cursor at a time.
+	// If zero, DefaultFetchSize is used.
+	FetchSize int
+
+	// CopyThreshold is the number of updates of the smallest Write loaded with
+	// COPY rather than INSERT statements.  If zero, DefaultCopyThreshold is
+	// used.
+	CopyThreshold int
+
+	// MaxOpenConns is the maximum number of open connections to the database.
+	// If zero, DefaultMaxOpenConns is used; if negative, there is no limit.
+	MaxOpenConns int
+
+	// MaxIdleConns is the maximum number of idle connections kept open.  If
+	// zero, the database/sql default is used.
+	MaxIdleConns int
+
+	// ConnMaxLifetime is the maximum amount of time a connection is reused.  If
+	// zero, connections are reused indefinitely.
+	ConnMaxLifetime time.Duration
+}
+
+// insertBatchSize is the maximum number of rows inserted by a single INSERT
+// statement.  Each row has 4 parameters, and PostgreSQL limits a statement to
+// 65535 parameters.
+const insertBatchSize = 500
+
+var tableNameRE = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// OpenGraphStore returns a graphstore.Service backed by the PostgreSQL database
+// given by spec, a lib/pq connection string (such as
+// "postgres://user@host/dbname?sslmode=disable").  If opts==nil, the
+// DefaultOptions are used.  The returned Service is Sharded by source hash
+// buckets and implements graphstore.TargetIndexed.
+func OpenGraphStore(spec string, opts *Options) (graphstore.Service, error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	table := opts.Table
+	if table == "" {
+		table = DefaultTable
+	} else if !tableNameRE.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name: %q", table)
+	}
+	if opts.Buckets < 0 {
+		return nil, fmt.Errorf("invalid number of buckets: %d", opts.Buckets)
+	}
+
+	db, err := sql.Open("postgres", spec)
+	if err != nil {
+		return nil, fmt.Errorf("could not open postgres database: %v", err)
+	}
+	switch {
+	case opts.MaxOpenConns == 0:
+		db.SetMaxOpenConns(DefaultMaxOpenConns)
+	case opts.MaxOpenConns > 0:
+		db.SetMaxOpenConns(opts.MaxOpenConns)
+	}
+	if opts.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error pinging db: %v", err)
+	}
+
+	s := &store{
+		db:            db,
+		table:         table,
+		fetchSize:     opts.FetchSize,
+		copyThreshold: opts.CopyThreshold,
+		inserts:       make(map[int]*sql.Stmt),
+	}
+	if s.fetchSize <= 0 {
+		s.fetchSize = DefaultFetchSize
+	}
+	if s.copyThreshold <= 0 {
+		s.copyThreshold = DefaultCopyThreshold
+	}
+	if err := s.init(opts.Buckets); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+type store struct {
+	db            *sql.DB
+	table         string
+	buckets       int
+	fetchSize     int
+	copyThreshold int
+
+	// Statements prepared once for the pool's connections.
+	readRange, readFrom, deleteEntry, countBuckets *sql.Stmt
+
+	insertsMu sync.Mutex
+	inserts   map[int]*sql.Stmt // INSERT statements by number of rows
+}
+
+// init creates the store's tables (if necessary), records or checks its number
+// of buckets, and prepares its statements.
+func (s *store) init(buckets int) error {
+	t := s.table
+	if _, err := s.db.Exec(`
+CREATE TABLE IF NOT EXISTS ` + t + ` (
+key bytea NOT NULL,
+bucket int NOT NULL,
+target bytea,
+value bytea NOT NULL,
+PRIMARY KEY (key));
+CREATE INDEX IF NOT EXISTS ` + t + `_buckets ON ` + t + ` (bucket, key);
+CREATE INDEX IF NOT EXISTS ` + t + `_targets ON ` + t + ` (target, key) WHERE target IS NOT NULL;
+CREATE TABLE IF NOT EXISTS ` + t + `_meta (
+name text NOT NULL,
+value text NOT NULL,
+PRIMARY KEY (name));`); err != nil {
+		return fmt.Errorf("error creating tables: %v", err)
+	}
+
+	// The number of buckets of a new table is recorded so that every later
+	// Open uses the same sharding.
+	initial := buckets
+	if initial == 0 {
+		initial = DefaultBuckets
+	}
+	if _, err := s.db.Exec(`INSERT INTO `+t+`_meta (name, value) VALUES ('buckets', $1) ON CONFLICT (name) DO NOTHING`, strconv.Itoa(initial)); err != nil {
+		return fmt.Errorf("error recording buckets: %v", err)
+	}
+	var recorded string
+	if err := s.db.QueryRow(`SELECT value FROM ` + t + `_meta WHERE name = 'buckets'`).Scan(&recorded); err != nil {
+		return fmt.Errorf("error reading buckets: %v", err)
+	}
+	n, err := strconv.Atoi(recorded)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid recorded number of buckets: %q", recorded)
+	} else if buckets != 0 && buckets != n {
+		return fmt.Errorf("table %s has %d buckets; requested %d", t, n, buckets)
+	}
+	s.buckets = n
+
+	for _, p := range []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&s.readRange, `SELECT key, value FROM ` + t + ` WHERE key >= $1 AND key < $2 ORDER BY key`},
+		{&s.readFrom, `SELECT key, value FROM ` + t + ` WHERE key >= $1 ORDER BY key`},
+		{&s.deleteEntry, `DELETE FROM ` + t + ` WHERE key = $1`},
+		{&s.countBuckets, `SELECT count(*) FROM ` + t + ` WHERE bucket >= $1 AND bucket < $2`},
+	} {
+		stmt, err := s.db.Prepare(p.query)
+		if err != nil {
+			return fmt.Errorf("error preparing statement: %v", err)
+		}
+		*p.stmt = stmt
+	}
+	return nil
+}
+
+// decodeRow returns the entry with the given key and value.
+func decodeRow(key, val []byte) (*spb.Entry, error) {
+	e, err := compare.DecodeEntryKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid entry key %q: %v", key, err)
+	} else if len(val) > 0 {
+		e.FactValue = val
+	}
+	return e, nil
+}
+
+// deliver calls f with each entry of rows (of keys and values) that satisfies
+// match (or every entry if match is nil), reporting whether f stopped the
+// delivery by returning io.EOF or another error.  It returns the number of
+// rows read.
+func deliver(ctx context.Context, rows *sql.Rows, match func(*spb.Entry) bool, f graphstore.EntryFunc) (n int, stop bool, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		n++
+		if err := ctx.Err(); err != nil {
+			return n, true, err
+		}
+		var key, val []byte
+		if err := rows.Scan(&key, &val); err != nil {
+			return n, true, err
+		}
+		e, err := decodeRow(key, val)
+		if err != nil {
+			return n, true, err
+		} else if match != nil && !match(e) {
+			continue
+		} else if err := f(e); err == io.EOF {
+			return n, true, nil
+		} else if err != nil {
+			return n, true, err
+		}
+	}
+	return n, false, rows.Err()
+}
+
+// cursor calls f with each entry of the rows of the given query (of keys and
+// values) that satisfies match, fetching them from a server-side cursor in
+// batches of s.fetchSize rows.
+func (s *store) cursor(ctx context.Context, match func(*spb.Entry) bool, f graphstore.EntryFunc, query string, args ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	// The transaction only reads, so it is always rolled back.
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DECLARE entries_cursor NO SCROLL CURSOR FOR `+query, args...); err != nil {
+		return fmt.Errorf("error declaring cursor: %v", err)
+	}
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM entries_cursor", s.fetchSize)
+	for {
+		rows, err := tx.Query(fetch)
+		if err != nil {
+			return err
+		}
+		n, stop, err := deliver(ctx, rows, match, f)
+		if stop || err != nil || n < s.fetchSize {
+			return err
+		}
+	}
+}
+
+// prefixEnd returns the least key greater than every key with the given
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Read implements part of the graphstore.Service interface.
+func (s *store) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	prefix := compare.EncodeKeyPrefix(req.Source, req.EdgeKind)
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if end := prefixEnd(prefix); end != nil {
+		rows, err = s.readRange.Query(prefix, end)
+	} else {
+		rows, err = s.readFrom.Query(prefix)
+	}
+	if err != nil {
+		return err
+	}
+	_, _, err = deliver(ctx, rows, nil, f)
+	return err
+}
+
+// Scan implements part of the graphstore.Service interface.  A Scan with a
+// Target reads only the edges to that target, using the target index.
+func (s *store) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return s.ScanFrom(ctx, req, nil, f)
+}
+
+// ScanFrom implements part of the graphstore.ResumableScanner interface.
+func (s *store) ScanFrom(ctx context.Context, req *spb.ScanRequest, after *spb.Entry, f graphstore.EntryFunc) error {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if req.Target != nil {
+		args = append(args, compare.EncodeVName(req.Target))
+		conds = append(conds, fmt.Sprintf("target = $%d", len(args)))
+	}
+	if after != nil {
+		args = append(args, compare.EncodeEntryKey(after))
+		conds = append(conds, fmt.Sprintf("key > $%d", len(args)))
+	}
+	query := `SELECT key, value FROM ` + s.table
+	if len(conds) > 0 {
+		query += ` WHERE ` + strings.Join(conds, " AND ")
+	}
+	return s.cursor(ctx, func(e *spb.Entry) bool {
+		return graphstore.EntryMatchesScan(req, e)
+	}, f, query+` ORDER BY key`, args...)
+}
+
+// ScanPage implements part of the graphstore.PagedScanner interface.
+func (s *store) ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	after, err := graphstore.ParsePageToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	var page []*spb.Entry
+	if err := s.ScanFrom(ctx, req, after, func(e *spb.Entry) error {
+		page = append(page, e)
+		if len(page) > pageSize {
+			return io.EOF
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	return graphstore.Page(page, pageSize)
+}
+
+// ScansOrdered implements the graphstore.OrderedScanner interface.
+func (s *store) ScansOrdered() bool { return true }
+
+// ReverseEdges implements the graphstore.TargetIndexed interface.
+func (s *store) ReverseEdges(ctx context.Context, target *spb.VName, kinds []string, f graphstore.EntryFunc) error {
+	return s.cursor(ctx, func(e *spb.Entry) bool {
+		if e.EdgeKind == "" {
+			return false
+		} else if len(kinds) == 0 {
+			return true
+		}
+		for _, kind := range kinds {
+			if e.EdgeKind == kind {
+				return true
+			}
+		}
+		return false
+	}, f, `SELECT key, value FROM `+s.table+` WHERE target = $1 ORDER BY key`, compare.EncodeVName(target))
+}
+
+// A row of the entries table.
+type row struct {
+	key    []byte
+	bucket int
+	target []byte // nil for facts
+	value  []byte
+}
+
+// rows returns the rows written by reqs.  If several updates have the same
+// key, only the last is kept.
+func (s *store) rows(reqs []*spb.WriteRequest) []row {
+	var (
+		rows  []row
+		index = make(map[string]int)
+	)
+	for _, req := range reqs {
+		bucket := graphstore.HashShards(req.Source, s.buckets)
+		for _, u := range req.Update {
+			r := row{
+				key: compare.EncodeEntryKey(&spb.Entry{
+					Source:   req.Source,
+					EdgeKind: u.EdgeKind,
+					Target:   u.Target,
+					FactName: u.FactName,
+				}),
+				bucket: bucket,
+				value:  u.FactValue,
+			}
+			if u.EdgeKind != "" {
+				r.target = compare.EncodeVName(u.Target)
+			}
+			if r.value == nil {
+				r.value = []byte{}
+			}
+			if i, ok := index[string(r.key)]; ok {
+				rows[i] = r
+				continue
+			}
+			index[string(r.key)] = len(rows)
+			rows = append(rows, r)
+		}
+	}
+	return rows
+}
+
+// Write implements part of the graphstore.Service interface.  Each request is
+// applied in a single transaction.
+func (s *store) Write(ctx context.Context, req *spb.WriteRequest) error {
+	return s.WriteBatch(ctx, []*spb.WriteRequest{req})
+}
+
+// WriteBatch implements part of the graphstore.Transactional interface.  All of
+// the requests are applied in a single transaction.  A batch of at least
+// Options.CopyThreshold updates is loaded with COPY.
+func (s *store) WriteBatch(ctx context.Context, reqs []*spb.WriteRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rows := s.rows(reqs)
+	if len(rows) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if len(rows) >= s.copyThreshold {
+		err = s.copyRows(tx, rows)
+	} else {
+		err = s.insertRows(tx, rows)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertRows inserts or replaces the given rows with multi-row INSERT
+// statements.
+func (s *store) insertRows(tx *sql.Tx, rows []row) error {
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > insertBatchSize {
+			n = insertBatchSize
+		}
+		stmt, err := s.insert(n)
+		if err != nil {
+			return err
+		}
+		args := make([]interface{}, 0, 4*n)
+		for _, r := range rows[:n] {
+			args = append(args, r.key, r.bucket, r.target, r.value)
+		}
+		if _, err := tx.Stmt(stmt).Exec(args...); err != nil {
+			return fmt.Errorf("error inserting entries: %v", err)
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
+
+// insert returns the prepared statement inserting or replacing n rows.
+func (s *store) insert(n int) (*sql.Stmt, error) {
+	s.insertsMu.Lock()
+	defer s.insertsMu.Unlock()
+	if stmt, ok := s.inserts[n]; ok {
+		return stmt, nil
+	}
+	values := make([]string, n)
+	for i := range values {
+		values[i] = fmt.Sprintf("($%d, $%d, $%d, $%d)", 4*i+1, 4*i+2, 4*i+3, 4*i+4)
+	}
+	stmt, err := s.db.Prepare(`INSERT INTO ` + s.table + ` (key, bucket, target, value) VALUES ` +
+		strings.Join(values, ", ") +
+		` ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`)
+	if err != nil {
+		return nil, fmt.Errorf("error preparing insert: %v", err)
+	}
+	s.inserts[n] = stmt
+	return stmt, nil
+}
+
+// copyRows inserts or replaces the given rows by COPYing them to a temporary
+// table and merging that into the entries table.  (COPY cannot itself replace
+// existing rows.)  The temporary table is kept for the session of the
+// transaction's connection and emptied by each commit.
+func (s *store) copyRows(tx *sql.Tx, rows []row) error {
+	const load = "kythe_entries_load"
+	if _, err := tx.Exec(`CREATE TEMPORARY TABLE IF NOT EXISTS ` + load + ` (
+key bytea NOT NULL,
+bucket int NOT NULL,
+target bytea,
+value bytea NOT NULL) ON COMMIT DELETE ROWS`); err != nil {
+		return fmt.Errorf("error creating load table: %v", err)
+	}
+	cp, err := tx.Prepare(pq.CopyIn(load, "key", "bucket", "target", "value"))
+	if err != nil {
+		return fmt.Errorf("error preparing copy: %v", err)
+	}
+	for _, r := range rows {
+		if _, err := cp.Exec(r.key, r.bucket, r.target, r.value); err != nil {
+			cp.Close()
+			return fmt.Errorf("error copying entries: %v", err)
+		}
+	}
+	if _, err := cp.Exec(); err != nil {
+		cp.Close()
+		return fmt.Errorf("error copying entries: %v", err)
+	} else if err := cp.Close(); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO ` + s.table + ` (key, bucket, target, value)
+SELECT key, bucket, target, value FROM ` + load + `
+ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value`); err != nil {
+		return fmt.Errorf("error merging copied entries: %v", err)
+	}
+	return nil
+}
+
+// Delete implements part of the graphstore.Deleter interface.
+func (s *store) Delete(ctx context.Context, req *graphstore.DeleteRequest) error {
+	if req.Source == nil {
+		return errors.New("invalid DeleteRequest: missing Source")
+	}
+	kind := req.EdgeKind
+	if kind == "" {
+		kind = "*"
+	}
+	var keys [][]byte
+	if err := s.Read(ctx, &spb.ReadRequest{Source: req.Source, EdgeKind: kind}, func(e *spb.Entry) error {
+		if graphstore.EntryMatchesDelete(req, e) {
+			keys = append(keys, compare.EncodeEntryKey(e))
+		}
+		return nil
+	}); err != nil {
+		return err
+	} else if len(keys) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt := tx.Stmt(s.deleteEntry)
+	for _, key := range keys {
+		if _, err := stmt.Exec(key); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DiskSize implements the graphstore.DiskSizer interface using the total size
+// of the entries table and its indexes.
+func (s *store) DiskSize(ctx context.Context) (int64, error) {
+	var size int64
+	err := s.db.QueryRow(`SELECT pg_total_relation_size($1)`, s.table).Scan(&size)
+	return size, err
+}
+
+// CheckHealth implements the graphstore.HealthChecker interface by pinging the
+// database.
+func (s *store) CheckHealth(ctx context.Context) error {
+	if err := s.db.Ping(); err != nil {
+		return fmt.Errorf("database ping failed: %v", err)
+	}
+	return nil
+}
+
+// Close implements part of the graphstore.Service interface.
+func (s *store) Close(ctx context.Context) error { return s.db.Close() }
+
+// bucketRange returns the range of buckets [start, end) of the given shard.
+func (s *store) bucketRange(index, shards int64) (start, end int64) {
+	b := int64(s.buckets)
+	return index * b / shards, (index + 1) * b / shards
+}
+
+// checkShard returns an error if index is not a valid shard of shards.
+func checkShard(index, shards int64) error {
+	if shards < 1 {
+		return fmt.Errorf("invalid number of shards: %d", shards)
+	} else if index < 0 || index >= shards {
+		return fmt.Errorf("invalid index for %d shards: %d", shards, index)
+	}
+	return nil
+}
+
+// Count implements part of the graphstore.Sharded interface.  Each shard is a
+// contiguous range of hash buckets, so a number of shards that does not divide
+// the number of buckets gives somewhat uneven shards, and shards beyond the
+// number of buckets are empty.
+func (s *store) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	if err := checkShard(req.Index, req.Shards); err != nil {
+		return 0, err
+	}
+	start, end := s.bucketRange(req.Index, req.Shards)
+	var count int64
+	err := s.countBuckets.QueryRow(start, end).Scan(&count)
+	return count, err
+}
+
+// Shard implements part of the graphstore.Sharded interface.  The entries of a
+// shard are delivered in order of their buckets and then of their keys.
+func (s *store) Shard(ctx context.Context, req *spb.ShardRequest, f graphstore.EntryFunc) error {
+	if err := checkShard(req.Index, req.Shards); err != nil {
+		return err
+	}
+	start, end := s.bucketRange(req.Index, req.Shards)
+	if start == end {
+		return nil
+	}
+	return s.cursor(ctx, nil, f, `SELECT key, value FROM `+s.table+` WHERE bucket >= $1 AND bucket < $2 ORDER BY bucket, key`, start, end)
+}
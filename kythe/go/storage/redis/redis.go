@@ -0,0 +1,460 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package redis implements a graphstore.Service using a Redis server.
+//
+// Each source node is a hash keyed by its encoded VName (see
+// compare.EncodeVName) whose fields encode the edge kind, fact name, and
+// target of each of the source's entries (so that the encoded source followed
+// by a field is the entry's canonical key; see compare.EncodeEntryKey) and
+// whose values are the entries' fact values.  A Read is then an HGETALL of a
+// single hash, and each Write is a batch of HMSETs applied atomically in a
+// MULTI transaction.  The encoded source of each hash is also a member of a
+// sorted set (the store's index), which Scans read in lexicographic order in
+// batches.  Each key is prefixed by the store's Prefix, so that several stores
+// may share a Redis database.
+//
+// The whole store is kept in the server's memory, so it is only suitable for
+// small stores (e.g. for demos and tests).  A Read fetches every entry of its
+// source in a single reply, even if most are filtered out; Redis limits each
+// fact value to 512MB and each source to 2^32-1 entries, but sources much
+// smaller than that can stall a server that is shared with other clients.
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func init() {
+	graphstore.Register("redis", func(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+		spec := graphstore.SpecLocation(u)
+		opts := *DefaultOptions
+		if i := strings.Index(spec, "/"); i >= 0 {
+			spec, opts.Prefix = spec[:i], spec[i+1:]
+		}
+		return OpenGraphStore(spec, &opts)
+	})
+}
+
+// Defaults for the fields of Options.
+const (
+	DefaultMaxIdle       = 4
+	DefaultScanBatchSize = 256
+)
+
+// DefaultOptions is the default Options struct passed to OpenGraphStore when
+// not otherwise given one.
+var DefaultOptions = &Options{}
+
+// Options for customizing a Redis backend.
+type Options struct {
+	// Prefix is prepended to each of the store's Redis keys.
+	Prefix string
+
+	// Database is the number of the Redis database to select.
+	Database int
+
+	// Password, if non-empty, is used to authenticate each connection.
+	Password string
+
+	// MaxIdle is the maximum number of idle connections kept open to the
+	// server.  If zero, DefaultMaxIdle is used.
+	MaxIdle int
+
+	// ScanBatchSize is the number of sources read together by each step of a
+	// Scan.  If zero, DefaultScanBatchSize is used.
+	ScanBatchSize int
+}
+
+// OpenGraphStore returns a graphstore.Service backed by the Redis server at
+// the given address ("host:port").  If opts==nil, the DefaultOptions are
+// used.
+func OpenGraphStore(addr string, opts *Options) (graphstore.Service, error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	maxIdle := opts.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = DefaultMaxIdle
+	}
+	batchSize := opts.ScanBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultScanBatchSize
+	}
+	dialOpts := []redis.DialOption{redis.DialDatabase(opts.Database)}
+	if opts.Password != "" {
+		dialOpts = append(dialOpts, redis.DialPassword(opts.Password))
+	}
+	pool := &redis.Pool{
+		MaxIdle:     maxIdle,
+		IdleTimeout: 5 * time.Minute,
+		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", addr, dialOpts...) },
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("could not connect to redis server at %q: %v", addr, err)
+	}
+	return &store{
+		pool:      pool,
+		prefix:    opts.Prefix,
+		index:     opts.Prefix + "index",
+		batchSize: batchSize,
+	}, nil
+}
+
+type store struct {
+	pool      *redis.Pool
+	prefix    string
+	index     string // the key of the sorted set of encoded sources
+	batchSize int
+}
+
+// key returns the key of the hash of the source with the given encoding.
+func (s *store) key(src string) string { return s.prefix + "s:" + src }
+
+// field returns the hash field of e, the suffix of its canonical key following
+// its encoded source.
+func field(e *spb.Entry) string {
+	return string(compare.EncodeEntryKey(e)[len(compare.EncodeVName(e.Source)):])
+}
+
+// readSource returns the entries of the given hash reply (of fields and
+// values) of the source with the given encoding, in order.
+func readSource(src string, reply interface{}) ([]*spb.Entry, error) {
+	vals, err := redis.ByteSlices(reply, nil)
+	if err != nil {
+		return nil, err
+	} else if len(vals)%2 != 0 {
+		return nil, fmt.Errorf("invalid hash reply of %d values", len(vals))
+	}
+	keys := make([][]byte, 0, len(vals)/2)
+	values := make(map[string][]byte, len(vals)/2)
+	for i := 0; i < len(vals); i += 2 {
+		key := append([]byte(src), vals[i]...)
+		keys = append(keys, key)
+		values[string(key)] = vals[i+1]
+	}
+	sort.Sort(byBytes(keys))
+	entries := make([]*spb.Entry, len(keys))
+	for i, key := range keys {
+		e, err := compare.DecodeEntryKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry key %q: %v", key, err)
+		} else if val := values[string(key)]; len(val) > 0 {
+			e.FactValue = val
+		}
+		entries[i] = e
+	}
+	return entries, nil
+}
+
+type byBytes [][]byte
+
+func (b byBytes) Len() int           { return len(b) }
+func (b byBytes) Less(i, j int) bool { return bytes.Compare(b[i], b[j]) < 0 }
+func (b byBytes) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// deliver calls f with each of entries that satisfies match (or every entry if
+// match is nil).  It returns false if f returned io.EOF.
+func deliver(entries []*spb.Entry, match func(*spb.Entry) bool, f graphstore.EntryFunc) (bool, error) {
+	for _, e := range entries {
+		if match != nil && !match(e) {
+			continue
+		} else if err := f(e); err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Read implements part of the graphstore.Service interface.  The source's
+// entries are filtered by edge kind after they are read.
+func (s *store) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	src := string(compare.EncodeVName(req.Source))
+	reply, err := conn.Do("HGETALL", s.key(src))
+	if err != nil {
+		return err
+	}
+	entries, err := readSource(src, reply)
+	if err != nil {
+		return err
+	}
+	var match func(*spb.Entry) bool
+	if req.EdgeKind != "*" {
+		match = func(e *spb.Entry) bool { return e.EdgeKind == req.EdgeKind }
+	}
+	_, err = deliver(entries, match, f)
+	return err
+}
+
+// Scan implements part of the graphstore.Service interface.
+func (s *store) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return s.ScanFrom(ctx, req, nil, f)
+}
+
+// ScanFrom implements part of the graphstore.ResumableScanner interface.  The
+// store's index of sources is read in batches, and the hashes of each batch
+// are read together in a single pipeline.
+func (s *store) ScanFrom(ctx context.Context, req *spb.ScanRequest, after *spb.Entry, f graphstore.EntryFunc) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	match := func(e *spb.Entry) bool { return graphstore.EntryMatchesScan(req, e) }
+	start := "-"
+	if after != nil {
+		afterKey := compare.EncodeEntryKey(after)
+		start = "[" + string(compare.EncodeVName(after.Source))
+		match = func(e *spb.Entry) bool {
+			return bytes.Compare(compare.EncodeEntryKey(e), afterKey) > 0 && graphstore.EntryMatchesScan(req, e)
+		}
+	}
+	var prev string // the last source of the previous batch
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		srcs, err := redis.Strings(conn.Do("ZRANGEBYLEX", s.index, start, "+", "LIMIT", 0, s.batchSize))
+		if err != nil {
+			return err
+		}
+		full := len(srcs) == s.batchSize
+		// Some servers (e.g. miniredis) ignore an exclusive start bound past the
+		// last member; drop any source not following the previous batch so the
+		// scan cannot repeat itself.
+		for prev != "" && len(srcs) > 0 && srcs[0] <= prev {
+			srcs = srcs[1:]
+		}
+		if len(srcs) == 0 {
+			return nil
+		}
+		for _, src := range srcs {
+			if err := conn.Send("HGETALL", s.key(src)); err != nil {
+				return err
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		for i, src := range srcs {
+			reply, err := conn.Receive()
+			if err != nil {
+				return err
+			}
+			entries, err := readSource(src, reply)
+			if err != nil {
+				return err
+			}
+			if more, err := deliver(entries, match, f); err != nil || !more {
+				// Drain the replies of the remainder of the batch before the
+				// connection is reused.
+				for j := i + 1; j < len(srcs); j++ {
+					if _, rerr := conn.Receive(); rerr != nil && err == nil {
+						err = rerr
+					}
+				}
+				return err
+			}
+		}
+		if !full {
+			return nil
+		}
+		prev = srcs[len(srcs)-1]
+		start = "(" + prev
+	}
+}
+
+// ScanPage implements part of the graphstore.PagedScanner interface.
+func (s *store) ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	after, err := graphstore.ParsePageToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	var page []*spb.Entry
+	if err := s.ScanFrom(ctx, req, after, func(e *spb.Entry) error {
+		page = append(page, e)
+		if len(page) > pageSize {
+			return io.EOF
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	return graphstore.Page(page, pageSize)
+}
+
+// ScansOrdered implements the graphstore.OrderedScanner interface.  Sources
+// are read in the order of the index, and the entries of each source are
+// sorted after they are read.
+func (s *store) ScansOrdered() bool { return true }
+
+// Write implements part of the graphstore.Service interface.  Each request is
+// applied in a single MULTI transaction, pipelined with its HMSETs.
+func (s *store) Write(ctx context.Context, req *spb.WriteRequest) error {
+	if len(req.Update) == 0 {
+		return nil
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	src := string(compare.EncodeVName(req.Source))
+	key := s.key(src)
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	args := redis.Args{key}
+	for _, u := range req.Update {
+		args = append(args, field(&spb.Entry{
+			EdgeKind: u.EdgeKind,
+			Target:   u.Target,
+			FactName: u.FactName,
+		}), u.FactValue)
+		if len(args) > 2*writeBatchSize {
+			if err := conn.Send("HMSET", args...); err != nil {
+				return err
+			}
+			args = redis.Args{key}
+		}
+	}
+	if len(args) > 1 {
+		if err := conn.Send("HMSET", args...); err != nil {
+			return err
+		}
+	}
+	if err := conn.Send("ZADD", s.index, 0, src); err != nil {
+		return err
+	}
+	return exec(conn)
+}
+
+// exec executes the MULTI transaction begun on conn, returning the first error
+// of its commands.  A server reports the failure of a queued command only in
+// its reply to EXEC; the transaction's other commands are still applied.
+func exec(conn redis.Conn) error {
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBatchSize is the maximum number of hash fields given to each HMSET (or
+// HDEL) command.
+const writeBatchSize = 512
+
+// unindexScript removes a source (ARGV[1]) from the index KEYS[2] if its hash
+// KEYS[1] is empty.  The check and removal are atomic, so a source cannot be
+// unindexed by a Delete concurrent with a Write to the source.
+var unindexScript = redis.NewScript(2, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+  redis.call("ZREM", KEYS[2], ARGV[1])
+end
+return 0
+`)
+
+// Delete implements part of the graphstore.Deleter interface.  The matching
+// entries are deleted in a single MULTI transaction, after which the source is
+// removed from the index if it has no remaining entries.
+func (s *store) Delete(ctx context.Context, req *graphstore.DeleteRequest) error {
+	if req.Source == nil {
+		return errors.New("invalid DeleteRequest: missing Source")
+	}
+	kind := req.EdgeKind
+	if kind == "" {
+		kind = "*"
+	}
+	src := string(compare.EncodeVName(req.Source))
+	key := s.key(src)
+	var fields []string
+	if err := s.Read(ctx, &spb.ReadRequest{Source: req.Source, EdgeKind: kind}, func(e *spb.Entry) error {
+		if graphstore.EntryMatchesDelete(req, e) {
+			fields = append(fields, field(e))
+		}
+		return nil
+	}); err != nil {
+		return err
+	} else if len(fields) == 0 {
+		return nil
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	for len(fields) > 0 {
+		n := len(fields)
+		if n > writeBatchSize {
+			n = writeBatchSize
+		}
+		if err := conn.Send("HDEL", redis.Args{key}.AddFlat(fields[:n])...); err != nil {
+			return err
+		}
+		fields = fields[n:]
+	}
+	if err := exec(conn); err != nil {
+		return err
+	}
+	_, err := unindexScript.Do(conn, key, s.index, src)
+	return err
+}
+
+// CheckHealth implements the graphstore.HealthChecker interface by pinging the
+// server.
+func (s *store) CheckHealth(ctx context.Context) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		return fmt.Errorf("redis ping failed: %v", err)
+	}
+	return nil
+}
+
+// Close implements part of the graphstore.Service interface.
+func (s *store) Close(ctx context.Context) error { return s.pool.Close() }
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redis
+
+import (
+	"fmt"
+	"testing"
+
+	gspkg "kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/test/services/graphstore"
+
+	"github.com/alicebob/miniredis"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+const largeBatchSize = 64
+
+// tempGSOpts returns a GraphStore backed by a new in-memory miniredis server.
+func tempGSOpts(opts *Options) (graphstore.Service, graphstore.DestroyFunc, error) {
+	srv, err := miniredis.Run()
+	if err != nil {
+		return nil, graphstore.NullDestroy, fmt.Errorf("error starting miniredis: %v", err)
+	}
+	destroy := func() error {
+		srv.Close()
+		return nil
+	}
+	gs, err := OpenGraphStore(srv.Addr(), opts)
+	if err != nil {
+		return nil, destroy, fmt.Errorf("error opening GraphStore: %v", err)
+	}
+	return gs, destroy, nil
+}
+
+func tempGS() (graphstore.Service, graphstore.DestroyFunc, error) {
+	return tempGSOpts(&Options{Prefix: "test:", ScanBatchSize: 3})
+}
+
+func BenchmarkWriteSingleEntry(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, 1)
+}
+func BenchmarkWriteBatchLrg(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, largeBatchSize)
+}
+
+func BenchmarkReadAllFacts(b *testing.B) {
+	graphstore.ReadFactsBenchmark(b, tempGS, nil)
+}
+
+func TestOrder(t *testing.T) {
+	graphstore.OrderTest(t, tempGS, largeBatchSize)
+}
+
+func TestDelete(t *testing.T) {
+	graphstore.DeleteTest(t, tempGS)
+}
+
+func TestGarbageCollection(t *testing.T) {
+	graphstore.GarbageCollectionTest(t, tempGS)
+}
+
+func TestPagedScan(t *testing.T) {
+	graphstore.PagedScanTest(t, tempGS)
+}
+
+func TestScanFrom(t *testing.T) {
+	graphstore.ScanFromTest(t, tempGS)
+}
+
+func TestHealthCheck(t *testing.T) {
+	graphstore.HealthCheckTest(t, tempGS)
+}
+
+func TestReadFacts(t *testing.T) {
+	graphstore.ReadFactsTest(t, tempGS)
+}
+
+func TestBlobWrite(t *testing.T) {
+	graphstore.BlobWriteTest(t, tempGS)
+}
+
+// TestWriteError checks that the failure of a command within a Write's
+// transaction is returned.
+func TestWriteError(t *testing.T) {
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ctx := context.Background()
+	gs, err := OpenGraphStore(srv.Addr(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+
+	// A source whose hash key holds a string fails its HMSET.
+	src := &spb.VName{Signature: "sig"}
+	if err := srv.Set(gs.(*store).key(string(compare.EncodeVName(src))), "not a hash"); err != nil {
+		t.Fatal(err)
+	}
+	req := &spb.WriteRequest{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/text", FactValue: []byte("text")}},
+	}
+	if err := gs.Write(ctx, req); err == nil {
+		t.Error("Write to a string key succeeded; expected an error")
+	}
+	req.Source = &spb.VName{Signature: "other"}
+	if err := gs.Write(ctx, req); err != nil {
+		t.Errorf("Write error: %v", err)
+	}
+}
+
+// TestPrefix checks that stores with distinct prefixes share a server without
+// seeing each other's entries, and that deleting every entry of a source
+// removes it from the store's index.
+func TestPrefix(t *testing.T) {
+	srv, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	ctx := context.Background()
+
+	open := func(prefix string) gspkg.Service {
+		gs, err := OpenGraphStore(srv.Addr(), &Options{Prefix: prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gs
+	}
+	a, b := open("a:"), open("b:")
+	defer a.Close(ctx)
+	defer b.Close(ctx)
+
+	src := &spb.VName{Signature: "sig"}
+	for i, gs := range []gspkg.Service{a, b} {
+		if err := gs.Write(ctx, &spb.WriteRequest{
+			Source: src,
+			Update: []*spb.WriteRequest_Update{{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scan := func(gs gspkg.Service) []*spb.Entry {
+		var entries []*spb.Entry
+		if err := gs.Scan(ctx, &spb.ScanRequest{}, func(e *spb.Entry) error {
+			entries = append(entries, e)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	for i, gs := range []gspkg.Service{a, b} {
+		entries := scan(gs)
+		if len(entries) != 1 {
+			t.Fatalf("Store %d has %d entries; want 1", i, len(entries))
+		} else if got, want := string(entries[0].FactValue), fmt.Sprint(i); got != want {
+			t.Errorf("Store %d has fact value %q; want %q", i, got, want)
+		}
+	}
+
+	if err := a.(gspkg.Deleter).Delete(ctx, &gspkg.DeleteRequest{Source: src}); err != nil {
+		t.Fatal(err)
+	}
+	if entries := scan(a); len(entries) != 0 {
+		t.Errorf("Store a has %d entries after Delete; want 0", len(entries))
+	} else if n := len(scan(b)); n != 1 {
+		t.Errorf("Store b has %d entries after Delete of a; want 1", n)
+	}
+	if srv.Exists("a:index") {
+		t.Errorf("Index of store a remains after its only source was deleted: %v", srv.Keys())
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package servingtable implements a read-only graphstore.Service over the
+// combined serving tables written by write_tables (see
+// kythe.io/kythe/go/serving/xrefs), so that graph tools can be used where only
+// the serving tables are kept.
+//
+// Each source's entries are reconstructed from its srvpb.PagedEdgeSet (and
+// EdgePages): its node facts from the set's source Node and its edges from the
+// set's edge groups.  The serving tables do not preserve every entry exactly:
+//   - Edges keep only their kind, ordinal, and target.  Each edge is read as a
+//     single entry with the fact name "/" and an empty value; any other edge
+//     facts are absent.
+//   - An ordinal of 0 is not distinguished from no ordinal, so an edge kind
+//     with the ordinal suffix ".0" (e.g. "/kythe/edge/param.0") is read
+//     without it.
+//   - The reverse edges ("%"-prefixed kinds) added by write_tables are not
+//     read, as a GraphStore only holds forward edges.
+//   - Sources and targets are decoded from their tickets, so their VName
+//     paths are cleaned (see kytheuri.FromVName).
+//   - Sources without a PagedEdgeSet (such as those only the targets of
+//     edges) have no entries.
+package servingtable
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/storage/keyvalue"
+	"kythe.io/kythe/go/storage/leveldb"
+	"kythe.io/kythe/go/storage/table"
+	"kythe.io/kythe/go/util/kytheuri"
+	"kythe.io/kythe/go/util/schema"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	srvpb "kythe.io/kythe/proto/serving_proto"
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func init() {
+	graphstore.Register("serving", func(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+		return Open(graphstore.SpecLocation(u))
+	})
+}
+
+// The key prefixes of the PagedEdgeSets and EdgePages in combined serving
+// tables (see the EdgeSetKey and EdgePageKey functions of
+// kythe.io/kythe/go/serving/xrefs).
+const (
+	edgeSetsTablePrefix  = "edgeSets:"
+	edgePagesTablePrefix = "edgePages:"
+)
+
+// edgeFactName is the fact name of each edge entry.
+const edgeFactName = "/"
+
+// GraphStore is a read-only graphstore.Service over combined serving tables.
+type GraphStore struct {
+	db  keyvalue.DB
+	tbl table.Proto
+}
+
+// New returns a GraphStore over the combined serving tables in db.
+func New(db keyvalue.DB) *GraphStore {
+	return &GraphStore{db: db, tbl: &table.KVProto{DB: db}}
+}
+
+// Open returns a GraphStore over the combined serving tables in the existing
+// LevelDB database at the given path.
+func Open(path string) (*GraphStore, error) {
+	db, err := leveldb.Open(path, &leveldb.Options{MustExist: true})
+	if err != nil {
+		return nil, err
+	}
+	return New(db), nil
+}
+
+// Read implements part of the graphstore.Service interface.  The source's
+// EdgePages are only read if edges are requested.
+func (s *GraphStore) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	if req.Source == nil {
+		return fmt.Errorf("invalid ReadRequest: missing source VName")
+	}
+	var pes srvpb.PagedEdgeSet
+	if err := s.tbl.Lookup(ctx, []byte(edgeSetsTablePrefix+kytheuri.ToString(req.Source)), &pes); err == table.ErrNoSuchKey {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("edge set lookup error: %v", err)
+	}
+	entries, err := s.entries(ctx, &pes, req.EdgeKind)
+	if err != nil {
+		return err
+	}
+	return sendEntries(ctx, entries, nil, f)
+}
+
+// Scan implements part of the graphstore.Service interface.  Sources are
+// scanned in the order of their tickets, not in entry order.
+func (s *GraphStore) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	iter, err := s.db.ScanPrefix([]byte(edgeSetsTablePrefix), &keyvalue.Options{LargeRead: true})
+	if err != nil {
+		return fmt.Errorf("db seek error: %v", err)
+	}
+	defer iter.Close()
+	edgeKind := "*"
+	if req.EdgeKind != "" {
+		edgeKind = req.EdgeKind
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		_, val, err := iter.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("db iteration error: %v", err)
+		}
+		var pes srvpb.PagedEdgeSet
+		if err := proto.Unmarshal(val, &pes); err != nil {
+			return fmt.Errorf("invalid edge set: %v", err)
+		}
+		entries, err := s.entries(ctx, &pes, edgeKind)
+		if err != nil {
+			return err
+		}
+		var stopped bool
+		if err := sendEntries(ctx, entries, req, func(e *spb.Entry) error {
+			err := f(e)
+			stopped = err == io.EOF
+			return err
+		}); err != nil || stopped {
+			return err
+		}
+	}
+}
+
+// sendEntries passes each of the entries matching req (if non-nil) to f,
+// stopping early if ctx is cancelled or f returns io.EOF.
+func sendEntries(ctx context.Context, entries []*spb.Entry, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		} else if req != nil && !graphstore.EntryMatchesScan(req, e) {
+			continue
+		} else if err := f(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entries returns the entries of the given edge set, in entry order, selected
+// by edgeKind as in a ReadRequest.
+func (s *GraphStore) entries(ctx context.Context, pes *srvpb.PagedEdgeSet, edgeKind string) ([]*spb.Entry, error) {
+	if pes.Source == nil {
+		return nil, fmt.Errorf("invalid edge set: missing source")
+	}
+	src, err := kytheuri.ToVName(pes.Source.Ticket)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source ticket %q: %v", pes.Source.Ticket, err)
+	}
+
+	var entries []*spb.Entry
+	if edgeKind == "" || edgeKind == "*" {
+		for _, fact := range pes.Source.Fact {
+			entries = append(entries, &spb.Entry{
+				Source:    src,
+				FactName:  fact.Name,
+				FactValue: fact.Value,
+			})
+		}
+		if edgeKind == "" {
+			compare.SortEntries(entries)
+			return entries, nil
+		}
+	}
+
+	// Each group (and page) holds the edges of a kind without its ordinal.
+	kind, _, _ := schema.ParseOrdinal(edgeKind)
+	wanted := func(groupKind string) bool {
+		return schema.EdgeDirection(groupKind) == schema.Forward && (edgeKind == "*" || groupKind == kind)
+	}
+	groups := pes.Group
+	for _, idx := range pes.PageIndex {
+		if !wanted(idx.EdgeKind) {
+			continue
+		}
+		var ep srvpb.EdgePage
+		if err := s.tbl.Lookup(ctx, []byte(edgePagesTablePrefix+idx.PageKey), &ep); err != nil {
+			return nil, fmt.Errorf("edge page %q lookup error: %v", idx.PageKey, err)
+		}
+		groups = append(groups, ep.EdgesGroup)
+	}
+	for _, g := range groups {
+		if !wanted(g.Kind) {
+			continue
+		}
+		for _, e := range g.Edge {
+			k := g.Kind
+			if e.Ordinal != 0 {
+				k = fmt.Sprintf("%s.%d", g.Kind, e.Ordinal)
+			}
+			if (edgeKind != "*" && k != edgeKind) || e.Target == nil {
+				continue
+			}
+			target, err := kytheuri.ToVName(e.Target.Ticket)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target ticket %q: %v", e.Target.Ticket, err)
+			}
+			entries = append(entries, &spb.Entry{
+				Source:   src,
+				EdgeKind: k,
+				Target:   target,
+				FactName: edgeFactName,
+			})
+		}
+	}
+	compare.SortEntries(entries)
+	return entries, nil
+}
+
+// Write implements part of the graphstore.Service interface.  The
+// GraphStore is read-only, so it returns graphstore.ErrReadOnly.
+func (s *GraphStore) Write(ctx context.Context, req *spb.WriteRequest) error {
+	return graphstore.ErrReadOnly
+}
+
+// Close implements part of the graphstore.Service interface.
+func (s *GraphStore) Close(ctx context.Context) error { return s.db.Close() }
@@ -0,0 +1,237 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package servingtable
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/storage/leveldb"
+	"kythe.io/kythe/go/storage/table"
+	"kythe.io/kythe/go/util/kytheuri"
+	"kythe.io/kythe/go/util/schema"
+
+	"golang.org/x/net/context"
+
+	cpb "kythe.io/kythe/proto/common_proto"
+	srvpb "kythe.io/kythe/proto/serving_proto"
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func vname(sig string) *spb.VName {
+	return &spb.VName{Signature: sig, Corpus: "corpus", Path: "file.go", Language: "go"}
+}
+
+func fact(src, name, value string) *spb.Entry {
+	return &spb.Entry{Source: vname(src), FactName: name, FactValue: []byte(value)}
+}
+
+func edge(src, kind, tgt string) *spb.Entry {
+	return &spb.Entry{Source: vname(src), EdgeKind: kind, Target: vname(tgt), FactName: "/"}
+}
+
+var testEntries = []*spb.Entry{
+	fact("a", "/kythe/node/kind", "function"),
+	fact("a", "/kythe/complete", "definition"),
+	edge("a", "/kythe/edge/childof", "b"),
+	edge("a", "/kythe/edge/param.1", "c"),
+	edge("a", "/kythe/edge/param.2", "d"),
+	edge("a", "/kythe/edge/ref", "b"),
+	edge("a", "/kythe/edge/ref", "c"),
+	edge("a", "/kythe/edge/ref", "d"),
+	fact("b", "/kythe/node/kind", "record"),
+	fact("c", "/kythe/node/kind", "variable"),
+	edge("c", "/kythe/edge/childof", "a"),
+	fact("d", "/kythe/node/kind", "variable"),
+	edge("d", "/kythe/edge/childof", "a"),
+}
+
+// testStore returns a GraphStore over serving tables holding testEntries as
+// write_tables would: each edge is mirrored by a reverse edge from its target
+// and each source's /kythe/edge/ref edges are on a separate EdgePage.
+func testStore(t *testing.T) (*GraphStore, func()) {
+	path, err := ioutil.TempDir("", "servingtable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := leveldb.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := make(map[string]*srvpb.PagedEdgeSet)
+	var tickets []string // in order of their first source
+	set := func(v *spb.VName) *srvpb.PagedEdgeSet {
+		ticket := kytheuri.ToString(v)
+		pes, ok := sets[ticket]
+		if !ok {
+			pes = &srvpb.PagedEdgeSet{Source: &srvpb.Node{Ticket: ticket}}
+			sets[ticket] = pes
+			tickets = append(tickets, ticket)
+		}
+		return pes
+	}
+	addEdge := func(src *spb.VName, kind string, tgt *spb.VName, ordinal int) {
+		pes := set(src)
+		var g *srvpb.EdgeGroup
+		for _, grp := range pes.Group {
+			if grp.Kind == kind {
+				g = grp
+			}
+		}
+		if g == nil {
+			g = &srvpb.EdgeGroup{Kind: kind}
+			pes.Group = append(pes.Group, g)
+		}
+		g.Edge = append(g.Edge, &srvpb.EdgeGroup_Edge{
+			Target:  &srvpb.Node{Ticket: kytheuri.ToString(tgt)},
+			Ordinal: int32(ordinal),
+		})
+		pes.TotalEdges++
+	}
+	for _, e := range testEntries {
+		if graphstore.IsNodeFact(e) {
+			pes := set(e.Source)
+			pes.Source.Fact = append(pes.Source.Fact, &cpb.Fact{Name: e.FactName, Value: e.FactValue})
+			continue
+		}
+		kind, ordinal, _ := schema.ParseOrdinal(e.EdgeKind)
+		addEdge(e.Source, kind, e.Target, ordinal)
+		addEdge(e.Target, schema.MirrorEdge(kind), e.Source, ordinal)
+	}
+
+	tbl := &table.KVProto{DB: db}
+	ctx := context.Background()
+	for _, ticket := range tickets {
+		pes := sets[ticket]
+		var groups []*srvpb.EdgeGroup
+		for _, g := range pes.Group {
+			if g.Kind != "/kythe/edge/ref" {
+				groups = append(groups, g)
+				continue
+			}
+			key := ticket + ".ref"
+			pes.PageIndex = append(pes.PageIndex, &srvpb.PageIndex{
+				EdgeKind:  g.Kind,
+				EdgeCount: int32(len(g.Edge)),
+				PageKey:   key,
+			})
+			if err := tbl.Put(ctx, []byte(edgePagesTablePrefix+key), &srvpb.EdgePage{
+				PageKey:      key,
+				SourceTicket: ticket,
+				EdgesGroup:   g,
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pes.Group = groups
+		if err := tbl.Put(ctx, []byte(edgeSetsTablePrefix+ticket), pes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return New(db), func() { os.RemoveAll(path) }
+}
+
+func collect(t *testing.T, read func(graphstore.EntryFunc) error) []*spb.Entry {
+	var entries []*spb.Entry
+	if err := read(func(e *spb.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func checkEntries(t *testing.T, desc string, got, want []*spb.Entry) {
+	compare.SortEntries(want)
+	if len(got) != len(want) {
+		t.Errorf("%s: got %d entries %v; want %d %v", desc, len(got), got, len(want), want)
+		return
+	}
+	for i := range got {
+		if !compare.EntriesEqual(got[i], want[i]) {
+			t.Errorf("%s: entry %d: got %v; want %v", desc, i, got[i], want[i])
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	gs, cleanup := testStore(t)
+	defer cleanup()
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	read := func(src, kind string) []*spb.Entry {
+		return collect(t, func(f graphstore.EntryFunc) error {
+			return gs.Read(ctx, &spb.ReadRequest{Source: vname(src), EdgeKind: kind}, f)
+		})
+	}
+	filter := func(src, kind string) []*spb.Entry {
+		var want []*spb.Entry
+		for _, e := range testEntries {
+			if compare.VNamesEqual(e.Source, vname(src)) && (kind == "*" || e.EdgeKind == kind) {
+				want = append(want, e)
+			}
+		}
+		return want
+	}
+
+	for _, test := range []struct{ src, kind string }{
+		{"a", "*"},
+		{"a", ""},
+		{"a", "/kythe/edge/ref"},
+		{"a", "/kythe/edge/param.2"},
+		{"a", "/kythe/edge/param"},
+		{"b", "*"}, // the mirrored %/kythe/edge/childof edges are not read
+		{"c", "*"},
+		{"missing", "*"},
+	} {
+		checkEntries(t, "Read("+test.src+", "+test.kind+")", read(test.src, test.kind), filter(test.src, test.kind))
+	}
+}
+
+func TestScan(t *testing.T) {
+	gs, cleanup := testStore(t)
+	defer cleanup()
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	for _, req := range []*spb.ScanRequest{
+		{},
+		{EdgeKind: "/kythe/edge/childof"},
+		{Target: vname("a")},
+		{FactPrefix: "/kythe/node/"},
+	} {
+		var want []*spb.Entry
+		for _, e := range testEntries {
+			if graphstore.EntryMatchesScan(req, e) {
+				want = append(want, e)
+			}
+		}
+		got := collect(t, func(f graphstore.EntryFunc) error { return gs.Scan(ctx, req, f) })
+		compare.SortEntries(got)
+		checkEntries(t, "Scan("+req.String()+")", got, want)
+	}
+
+	if err := gs.Write(ctx, &spb.WriteRequest{Source: vname("a")}); err != graphstore.ErrReadOnly {
+		t.Errorf("Write error: got %v; want %v", err, graphstore.ErrReadOnly)
+	}
+}
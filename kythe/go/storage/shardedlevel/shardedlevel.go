@@ -0,0 +1,295 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package shardedlevel implements a graphstore.Service spread over several
+// LevelDB databases.
+//
+// Each source is assigned to one of the databases by its fingerprint (see
+// graphstore.HashShards), so every entry of a source is in the same database.
+// Reads and Writes are made to the source's database; Scans merge the ordered
+// Scans of every database.  Each database records its index and the number of
+// databases in a shard file, so that it is never opened as part of a store with
+// a different number of shards.  A store may be copied to a new store with a
+// different number of shards using Reshard (or the reshard operation of
+// gstool).
+package shardedlevel
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/proxy"
+	"kythe.io/kythe/go/storage/leveldb"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func init() {
+	graphstore.Register("shardedlevel", func(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+		spec := graphstore.SpecLocation(u)
+		return OpenGraphStore(strings.Split(spec, ","), nil)
+	})
+}
+
+// shardFile is the name of the file in each database's directory recording its
+// place in the store.
+const shardFile = "KYTHE_SHARD"
+
+// shardFormat is the format of the contents of a shard file: the index of the
+// database and the number of databases in the store.
+const shardFormat = "shard %d of %d\n"
+
+// checkShard returns whether the database at dir exists, and an error if it is
+// not shard index of n.
+func checkShard(dir string, index, n int) (bool, error) {
+	rec, err := ioutil.ReadFile(filepath.Join(dir, shardFile))
+	if os.IsNotExist(err) {
+		// A directory without a shard file must not hold another database.
+		if names, err := ioutil.ReadDir(dir); err == nil && len(names) > 0 {
+			return false, fmt.Errorf("%s is not empty but is not a shard of a sharded store", dir)
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var gotIndex, gotN int
+	if _, err := fmt.Sscanf(string(rec), shardFormat, &gotIndex, &gotN); err != nil {
+		return true, fmt.Errorf("invalid shard file in %s: %q", dir, rec)
+	} else if gotIndex != index || gotN != n {
+		return true, fmt.Errorf("%s was created as shard %d of %d; cannot open it as shard %d of %d (see shardedlevel.Reshard)", dir, gotIndex, gotN, index, n)
+	}
+	return true, nil
+}
+
+// OpenGraphStore returns a graphstore.Service spread over a LevelDB database in
+// each of the given directories, each opened with the given options (or the
+// leveldb.DefaultOptions if opts==nil).  The databases are created if none of
+// them exists.  Otherwise, each must have been created as the shard with the
+// same index of a store with the same number of shards.  The returned Service
+// is Sharded, with each database's entries in the same shard when the number of
+// shards equals the number of databases.
+func OpenGraphStore(dirs []string, opts *leveldb.Options) (graphstore.Service, error) {
+	if len(dirs) == 0 {
+		return nil, errors.New("no shard directories given")
+	}
+	var existing int
+	for i, dir := range dirs {
+		ok, err := checkShard(dir, i, len(dirs))
+		if err != nil {
+			return nil, err
+		} else if ok {
+			existing++
+		}
+	}
+	if existing > 0 && existing < len(dirs) {
+		return nil, fmt.Errorf("only %d of the %d shard directories hold a shard; a store's number of shards cannot change (see shardedlevel.Reshard)", existing, len(dirs))
+	} else if existing == 0 && opts != nil && opts.MustExist {
+		return nil, fmt.Errorf("sharded store in %s does not exist", strings.Join(dirs, ","))
+	}
+
+	s := &store{shards: make([]graphstore.Service, len(dirs))}
+	for i, dir := range dirs {
+		gs, err := leveldb.OpenGraphStore(dir, opts)
+		if err == nil && existing == 0 {
+			err = ioutil.WriteFile(filepath.Join(dir, shardFile), []byte(fmt.Sprintf(shardFormat, i, len(dirs))), 0644)
+		}
+		if err == nil {
+			if _, ok := gs.(graphstore.Sharded); !ok {
+				err = fmt.Errorf("LevelDB GraphStore %T is not Sharded", gs)
+			}
+		}
+		if err != nil {
+			if gs != nil {
+				gs.Close(context.Background())
+			}
+			for _, gs := range s.shards[:i] {
+				gs.Close(context.Background())
+			}
+			return nil, fmt.Errorf("error opening shard %s: %v", dir, err)
+		}
+		s.shards[i] = gs
+	}
+	s.merged = proxy.New(s.shards...)
+	return s, nil
+}
+
+type store struct {
+	shards []graphstore.Service
+	merged graphstore.Service // a proxy merging the Scans of the shards
+}
+
+// shard returns the database holding the entries of the given source.
+func (s *store) shard(src *spb.VName) graphstore.Service {
+	return s.shards[graphstore.HashShards(src, len(s.shards))]
+}
+
+// Read implements part of the graphstore.Service interface.
+func (s *store) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	return s.shard(req.Source).Read(ctx, req, f)
+}
+
+// Scan implements part of the graphstore.Service interface.  The entries of
+// every database are merged, in order if every database Scans in order.
+func (s *store) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return s.merged.Scan(ctx, req, f)
+}
+
+// ScansOrdered implements the graphstore.OrderedScanner interface.  A store
+// whose databases have the CorpusKeys layout does not Scan in order.
+func (s *store) ScansOrdered() bool { return graphstore.ScansOrdered(s.merged) }
+
+// Write implements part of the graphstore.Service interface.
+func (s *store) Write(ctx context.Context, req *spb.WriteRequest) error {
+	return s.shard(req.Source).Write(ctx, req)
+}
+
+// Delete implements part of the graphstore.Deleter interface.
+func (s *store) Delete(ctx context.Context, req *graphstore.DeleteRequest) error {
+	if req.Source == nil {
+		return errors.New("invalid DeleteRequest: missing Source")
+	}
+	d, ok := s.shard(req.Source).(graphstore.Deleter)
+	if !ok {
+		return graphstore.ErrUnsupported
+	}
+	return d.Delete(ctx, req)
+}
+
+// Close implements part of the graphstore.Service interface.  Every database is
+// closed, even in case of error, but only the first error is returned.
+func (s *store) Close(ctx context.Context) error { return s.merged.Close(ctx) }
+
+// A part is a shard of one of a store's databases.
+type part struct {
+	db            graphstore.Sharded
+	index, shards int64
+}
+
+// parts returns the parts of the given shard of the store.  Each of the n
+// databases is divided into the given number of shards, and each shard of the
+// store is n consecutive parts of the resulting list.  So when the number of
+// shards is n, each shard is one database.
+func (s *store) parts(index, shards int64) ([]part, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("invalid number of shards: %d", shards)
+	} else if index < 0 || index >= shards {
+		return nil, fmt.Errorf("invalid index for %d shards: %d", shards, index)
+	}
+	n := int64(len(s.shards))
+	parts := make([]part, n)
+	for i := range parts {
+		p := index*n + int64(i)
+		parts[i] = part{s.shards[p/shards].(graphstore.Sharded), p % shards, shards}
+	}
+	return parts, nil
+}
+
+// Count implements part of the graphstore.Sharded interface.
+func (s *store) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	parts, err := s.parts(req.Index, req.Shards)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, p := range parts {
+		n, err := p.db.Count(ctx, &spb.CountRequest{Index: p.index, Shards: p.shards})
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Shard implements part of the graphstore.Sharded interface.  The entries of a
+// shard are ordered within each of its databases.
+func (s *store) Shard(ctx context.Context, req *spb.ShardRequest, f graphstore.EntryFunc) error {
+	parts, err := s.parts(req.Index, req.Shards)
+	if err != nil {
+		return err
+	}
+	var stopped bool
+	for _, p := range parts {
+		if err := p.db.Shard(ctx, &spb.ShardRequest{Index: p.index, Shards: p.shards}, func(e *spb.Entry) error {
+			err := f(e)
+			stopped = err != nil
+			return err
+		}); stopped || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReshardOptions control the behavior of Reshard.
+type ReshardOptions struct {
+	// LevelDB are the options with which both stores are opened.  If nil, the
+	// leveldb.DefaultOptions are used.
+	LevelDB *leveldb.Options
+
+	// Copy controls the copy of the entries.  If nil, the store's databases are
+	// copied concurrently.
+	Copy *graphstore.CopyOptions
+}
+
+// Reshard copies the entries of the sharded store in the from directories into
+// a new sharded store in the to directories, which must not exist or be empty.
+// The store must not be in use during the copy.
+func Reshard(ctx context.Context, from, to []string, opts *ReshardOptions) error {
+	if opts == nil {
+		opts = &ReshardOptions{}
+	}
+	for _, dir := range to {
+		if names, err := ioutil.ReadDir(dir); err == nil && len(names) > 0 {
+			return fmt.Errorf("resharding destination %s is not empty", dir)
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	srcOpts := *leveldb.DefaultOptions
+	if opts.LevelDB != nil {
+		srcOpts = *opts.LevelDB
+	}
+	srcOpts.MustExist = true
+	src, err := OpenGraphStore(from, &srcOpts)
+	if err != nil {
+		return err
+	}
+	defer src.Close(ctx)
+	dst, err := OpenGraphStore(to, opts.LevelDB)
+	if err != nil {
+		return err
+	}
+
+	copyOpts := opts.Copy
+	if copyOpts == nil {
+		copyOpts = &graphstore.CopyOptions{Workers: len(from)}
+	}
+	if err := graphstore.Copy(ctx, dst, src, copyOpts); err != nil {
+		dst.Close(ctx)
+		return err
+	}
+	return dst.Close(ctx)
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shardedlevel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	gspkg "kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/storage/leveldb"
+	"kythe.io/kythe/go/test/services/graphstore"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+var testOptions = &leveldb.Options{
+	CacheCapacity:   1 << 20,
+	WriteBufferSize: 1 << 20,
+}
+
+// tempDirs returns n shard directories within a new temporary directory.
+func tempDirs(n int) (string, []string, error) {
+	root, err := ioutil.TempDir("", "shardedlevel.test")
+	if err != nil {
+		return "", nil, err
+	}
+	dirs := make([]string, n)
+	for i := range dirs {
+		dirs[i] = filepath.Join(root, fmt.Sprintf("shard%d", i))
+	}
+	return root, dirs, nil
+}
+
+func tempGS() (graphstore.Service, graphstore.DestroyFunc, error) {
+	root, dirs, err := tempDirs(3)
+	if err != nil {
+		return nil, graphstore.NullDestroy, err
+	}
+	destroy := func() error { return os.RemoveAll(root) }
+	gs, err := OpenGraphStore(dirs, testOptions)
+	if err != nil {
+		return nil, destroy, fmt.Errorf("error creating temporary store: %v", err)
+	}
+	return gs, destroy, nil
+}
+
+func TestOrder(t *testing.T) {
+	graphstore.OrderTest(t, tempGS, 16)
+}
+
+func TestDelete(t *testing.T) {
+	graphstore.DeleteTest(t, tempGS)
+}
+
+func TestGarbageCollection(t *testing.T) {
+	graphstore.GarbageCollectionTest(t, tempGS)
+}
+
+func TestReadFacts(t *testing.T) {
+	graphstore.ReadFactsTest(t, tempGS)
+}
+
+// writeSources writes n sources of two facts each to gs.
+func writeSources(t *testing.T, gs gspkg.Service, n int) {
+	for i := 0; i < n; i++ {
+		if err := gs.Write(context.Background(), &spb.WriteRequest{
+			Source: &spb.VName{Signature: fmt.Sprintf("sig%04d", i), Corpus: "test"},
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/node/kind", FactValue: []byte("test")},
+				{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func scanAll(t *testing.T, gs gspkg.Service) []*spb.Entry {
+	var entries []*spb.Entry
+	if err := gs.Scan(context.Background(), new(spb.ScanRequest), func(e *spb.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestShards(t *testing.T) {
+	gs, destroy, err := tempGS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroy()
+	ctx := context.Background()
+	defer gs.Close(ctx)
+	writeSources(t, gs, 200)
+
+	all := scanAll(t, gs)
+	if len(all) != 400 {
+		t.Fatalf("Scan found %d entries; want 400", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if compare.Entries(all[i-1], all[i]) != compare.LT {
+			t.Fatalf("Scan found %v after %v", all[i], all[i-1])
+		}
+	}
+
+	sh := gs.(gspkg.Sharded)
+	for _, shards := range []int64{1, 2, 3, 7} {
+		var found []*spb.Entry
+		for i := int64(0); i < shards; i++ {
+			count, err := sh.Count(ctx, &spb.CountRequest{Index: i, Shards: shards})
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := len(found)
+			if err := sh.Shard(ctx, &spb.ShardRequest{Index: i, Shards: shards}, func(e *spb.Entry) error {
+				// With one shard per database, each shard holds the sources of its
+				// database.
+				if shards == 3 && gspkg.HashShards(e.Source, 3) != int(i) {
+					t.Errorf("Shard %d/%d has entry of database %d: %v", i, shards, gspkg.HashShards(e.Source, 3), e)
+				}
+				found = append(found, e)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if n := int64(len(found) - start); n != count {
+				t.Errorf("Shard %d/%d has %d entries; Count reported %d", i, shards, n, count)
+			}
+		}
+		compare.SortEntries(found)
+		if !reflect.DeepEqual(found, all) {
+			t.Errorf("The %d shards have %d entries differing from the %d scanned entries", shards, len(found), len(all))
+		}
+	}
+}
+
+func TestOpenMismatch(t *testing.T) {
+	root, dirs, err := tempDirs(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+
+	gs, err := OpenGraphStore(dirs[:3], testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSources(t, gs, 10)
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range [][]string{
+		dirs[:2],                          // too few shards
+		dirs,                              // a new directory added
+		{dirs[1], dirs[0], dirs[2]},       // shards reordered
+		{dirs[0], dirs[1], dirs[2], root}, // an unrelated directory
+	} {
+		if gs, err := OpenGraphStore(test, testOptions); err == nil {
+			gs.Close(ctx)
+			t.Errorf("OpenGraphStore(%v) succeeded; expected an error", test)
+		}
+	}
+	plain := filepath.Join(root, "plain")
+	if err := os.Mkdir(plain, 0755); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(plain, "CURRENT"), []byte("MANIFEST-000001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if gs, err := OpenGraphStore([]string{plain}, testOptions); err == nil {
+		gs.Close(ctx)
+		t.Error("OpenGraphStore of a directory that is not a shard succeeded; expected an error")
+	}
+
+	gs, err = OpenGraphStore(dirs[:3], testOptions)
+	if err != nil {
+		t.Fatalf("Reopening the store: %v", err)
+	}
+	defer gs.Close(ctx)
+	if n := len(scanAll(t, gs)); n != 20 {
+		t.Errorf("Reopened store has %d entries; want 20", n)
+	}
+}
+
+func TestScansOrdered(t *testing.T) {
+	root, dirs, err := tempDirs(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		dirs       []string
+		corpusKeys bool
+	}{
+		{dirs[:3], false},
+		{dirs[3:], true},
+	} {
+		opts := *testOptions
+		opts.CorpusKeys = test.corpusKeys
+		gs, err := OpenGraphStore(test.dirs, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := gspkg.ScansOrdered(gs), !test.corpusKeys; got != want {
+			t.Errorf("ScansOrdered with CorpusKeys=%v: got %v; want %v", test.corpusKeys, got, want)
+		}
+		if err := gs.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReshard(t *testing.T) {
+	root, dirs, err := tempDirs(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ctx := context.Background()
+	from, to := dirs[:3], dirs[3:]
+
+	gs, err := OpenGraphStore(from, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSources(t, gs, 100)
+	want := scanAll(t, gs)
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ReshardOptions{LevelDB: testOptions}
+	if err := Reshard(ctx, from, from, opts); err == nil {
+		t.Error("Resharding into an existing store succeeded; expected an error")
+	}
+	if err := Reshard(ctx, from, to, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	gs, err = OpenGraphStore(to, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+	if got := scanAll(t, gs); !reflect.DeepEqual(got, want) {
+		t.Errorf("Resharded store has %d entries differing from the %d original entries", len(got), len(want))
+	}
+	for i := int64(0); i < int64(len(to)); i++ {
+		if err := gs.(gspkg.Sharded).Shard(ctx, &spb.ShardRequest{Index: i, Shards: int64(len(to))}, func(e *spb.Entry) error {
+			if got := gspkg.HashShards(e.Source, len(to)); got != int(i) {
+				t.Errorf("Entry of database %d found in database %d: %v", got, i, e)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
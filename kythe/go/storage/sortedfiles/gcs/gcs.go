@@ -0,0 +1,44 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package gcs implements a sortedfiles.Bucket backed by Google Cloud Storage.
+package gcs
+
+import (
+	"io"
+
+	"kythe.io/kythe/go/storage/sortedfiles"
+
+	"golang.org/x/net/context"
+	"google.golang.org/cloud/storage"
+)
+
+type bucket struct{ bucket *storage.BucketHandle }
+
+// NewBucket returns a sortedfiles.Bucket of the objects of the given Google
+// Cloud Storage bucket.
+func NewBucket(ctx context.Context, name string) (sortedfiles.Bucket, error) {
+	c, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return bucket{c.Bucket(name)}, nil
+}
+
+// ReadRange implements the sortedfiles.Bucket interface.
+func (b bucket) ReadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	return b.bucket.Object(name).NewRangeReader(ctx, offset, length)
+}
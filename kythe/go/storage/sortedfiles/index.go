@@ -0,0 +1,205 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sortedfiles
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"kythe.io/kythe/go/platform/delimited"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+// An index is a delimited stream of records: indexMagic, followed by the
+// records of each shard.  The records of a shard are its header (its size in
+// bytes and number of blocks as uvarints, followed by its name) and then a
+// record of each of its blocks (the offset of the block as a uvarint, followed
+// by the canonical key of its first entry).
+const indexMagic = "kythe sortedfiles index v1"
+
+// DefaultBlockSize is the default approximate size in bytes of each indexed
+// block of a shard.
+const DefaultBlockSize = 64 << 10
+
+// A shard is the index of a single sorted shard.
+type shard struct {
+	name   string
+	size   int64
+	blocks []block
+}
+
+// A block is a contiguous range of a shard's entries, beginning at the given
+// offset with the entry of the given canonical key.
+type block struct {
+	offset int64
+	key    []byte
+}
+
+// span returns the byte range of the blocks of sh that may hold keys at least
+// start (if non-nil) and less than end (if non-nil), or false if there are
+// none.
+func (sh *shard) span(start, end []byte) (offset, length int64, ok bool) {
+	n := len(sh.blocks)
+	if n == 0 {
+		return 0, 0, false
+	}
+	// The first key at least start is in the block before the first block
+	// whose first key is at least start (or the first block): that block's
+	// last key is at least start only if the following block's first key is,
+	// and keys equal to start may straddle the two blocks.
+	i := sort.Search(n, func(i int) bool { return bytes.Compare(sh.blocks[i].key, start) >= 0 }) - 1
+	if i < 0 {
+		i = 0
+	}
+	j := n
+	if end != nil {
+		if j = sort.Search(n, func(j int) bool { return bytes.Compare(sh.blocks[j].key, end) >= 0 }); j <= i {
+			return 0, 0, false
+		}
+	}
+	limit := sh.size
+	if j < n {
+		limit = sh.blocks[j].offset
+	}
+	return sh.blocks[i].offset, limit - sh.blocks[i].offset, true
+}
+
+// BuildIndex writes to w the index of the named shards of bucket, each a
+// delimited stream of entries in canonical key order (see
+// compare.EncodeEntryKey), recording the first key of each block of at least
+// blockSize bytes (but the last) of each shard.  The index refers to the
+// shards by the given names.  If blockSize ≤ 0, DefaultBlockSize is used.  An
+// error is returned if any shard is not sorted.
+func BuildIndex(ctx context.Context, bucket Bucket, shards []string, blockSize int64, w io.Writer) error {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	wr := delimited.NewWriter(w)
+	if err := wr.Put([]byte(indexMagic)); err != nil {
+		return err
+	}
+	for _, name := range shards {
+		sh, err := indexShard(ctx, bucket, name, blockSize)
+		if err != nil {
+			return err
+		}
+		hdr := appendUvarint(appendUvarint(nil, uint64(sh.size)), uint64(len(sh.blocks)))
+		if err := wr.Put(append(hdr, sh.name...)); err != nil {
+			return err
+		}
+		for _, b := range sh.blocks {
+			if err := wr.Put(append(appendUvarint(nil, uint64(b.offset)), b.key...)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexShard reads the named shard of bucket and returns its index.
+func indexShard(ctx context.Context, bucket Bucket, name string, blockSize int64) (*shard, error) {
+	rc, err := bucket.ReadRange(ctx, name, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("error opening shard %q: %v", name, err)
+	}
+	defer rc.Close()
+	rd := delimited.NewReader(rc)
+	sh := &shard{name: name}
+	var last []byte
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rec, err := rd.Next()
+		if err == io.EOF {
+			return sh, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading shard %q: %v", name, err)
+		}
+		var e spb.Entry
+		if err := proto.Unmarshal(rec, &e); err != nil {
+			return nil, fmt.Errorf("error decoding entry %d of shard %q: %v", i, name, err)
+		}
+		key := compare.EncodeEntryKey(&e)
+		if last != nil && bytes.Compare(key, last) < 0 {
+			return nil, fmt.Errorf("shard %q is not sorted: entry %d precedes entry %d", name, i, i-1)
+		}
+		if n := len(sh.blocks); n == 0 || sh.size-sh.blocks[n-1].offset >= blockSize {
+			sh.blocks = append(sh.blocks, block{offset: sh.size, key: key})
+		}
+		sh.size += int64(len(appendUvarint(nil, uint64(len(rec))))) + int64(len(rec))
+		last = key
+	}
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], x)]...)
+}
+
+var errTruncated = errors.New("truncated index record")
+
+// readIndex returns the shards of the index read from r.
+func readIndex(r io.Reader) ([]*shard, error) {
+	rd := delimited.NewReader(r)
+	if rec, err := rd.Next(); err != nil {
+		return nil, err
+	} else if string(rec) != indexMagic {
+		return nil, errors.New("not a sortedfiles index")
+	}
+	var shards []*shard
+	for {
+		rec, err := rd.Next()
+		if err == io.EOF {
+			return shards, nil
+		} else if err != nil {
+			return nil, err
+		}
+		size, n := binary.Uvarint(rec)
+		if n <= 0 {
+			return nil, errTruncated
+		}
+		numBlocks, m := binary.Uvarint(rec[n:])
+		if m <= 0 {
+			return nil, errTruncated
+		}
+		sh := &shard{name: string(rec[n+m:]), size: int64(size), blocks: make([]block, numBlocks)}
+		for i := range sh.blocks {
+			rec, err := rd.Next()
+			if err == io.EOF {
+				return nil, fmt.Errorf("missing blocks of shard %q", sh.name)
+			} else if err != nil {
+				return nil, err
+			}
+			offset, n := binary.Uvarint(rec)
+			if n <= 0 {
+				return nil, errTruncated
+			}
+			sh.blocks[i] = block{offset: int64(offset), key: append([]byte(nil), rec[n:]...)}
+		}
+		shards = append(shards, sh)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sortedfiles implements a read-only graphstore.Service over a set of
+// sorted shards of entries stored as blobs (such as the objects of a GCS or S3
+// bucket).
+//
+// Each shard is a delimited stream of Entry messages (see
+// kythe.io/kythe/go/platform/delimited) in canonical key order.  An index
+// blob, produced offline by BuildIndex, records the first key of each block of
+// (approximately) a fixed number of bytes of each shard.  The index is kept in
+// memory, so each Read binary-searches it for the blocks of each shard that
+// may hold the Read's source and reads only those byte ranges.  Scans are a
+// streaming merge of the sorted shards.
+package sortedfiles
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"kythe.io/kythe/go/platform/delimited"
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+func init() {
+	graphstore.Register("sortedfiles", func(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+		spec := graphstore.SpecLocation(u)
+		return Open(ctx, Dir(filepath.Dir(spec)), filepath.Base(spec))
+	})
+}
+
+// A Bucket is a store of named blobs supporting reads of ranges of bytes.
+type Bucket interface {
+	// ReadRange returns a reader of length bytes of the named blob beginning
+	// at the given offset.  If length < 0, the blob is read to its end.
+	ReadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+}
+
+// Dir is a Bucket of the files of a local directory.
+type Dir string
+
+// ReadRange implements the Bucket interface.
+func (d Dir) ReadRange(_ context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(string(d), filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	} else if _, err := f.Seek(offset, os.SEEK_SET); err != nil {
+		f.Close()
+		return nil, err
+	} else if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// Open returns a read-only graphstore.Service over the shards of bucket
+// described by the named index blob (as written by BuildIndex).  The returned
+// Service is a graphstore.ResumableScanner whose scans are ordered.
+func Open(ctx context.Context, bucket Bucket, index string) (graphstore.Service, error) {
+	rc, err := bucket.ReadRange(ctx, index, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("error opening index %q: %v", index, err)
+	}
+	defer rc.Close()
+	shards, err := readIndex(rc)
+	if err != nil {
+		return nil, fmt.Errorf("error reading index %q: %v", index, err)
+	}
+	return &store{bucket: bucket, shards: shards}, nil
+}
+
+type store struct {
+	bucket Bucket
+	shards []*shard
+}
+
+// Read implements part of the graphstore.Service interface.  Only the blocks
+// of each shard which may hold the source's entries are read.
+func (s *store) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	start := compare.EncodeKeyPrefix(req.Source, req.EdgeKind)
+	return s.merge(ctx, start, prefixEnd(start), nil, f)
+}
+
+// Scan implements part of the graphstore.Service interface.
+func (s *store) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return s.ScanFrom(ctx, req, nil, f)
+}
+
+// ScanFrom implements part of the graphstore.ResumableScanner interface.  A
+// resumed scan reads each shard from the block holding the key of after.
+func (s *store) ScanFrom(ctx context.Context, req *spb.ScanRequest, after *spb.Entry, f graphstore.EntryFunc) error {
+	var start []byte
+	if after != nil {
+		// The least key greater than that of after.
+		start = append(compare.EncodeEntryKey(after), 0)
+	}
+	return s.merge(ctx, start, nil, func(e *spb.Entry) bool { return graphstore.EntryMatchesScan(req, e) }, f)
+}
+
+// ScanPage implements part of the graphstore.PagedScanner interface.
+func (s *store) ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	after, err := graphstore.ParsePageToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	var page []*spb.Entry
+	if err := s.ScanFrom(ctx, req, after, func(e *spb.Entry) error {
+		page = append(page, e)
+		if len(page) > pageSize {
+			return io.EOF
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	return graphstore.Page(page, pageSize)
+}
+
+// ScansOrdered implements the graphstore.OrderedScanner interface.
+func (s *store) ScansOrdered() bool { return true }
+
+// Write implements part of the graphstore.Service interface.  The store is
+// read-only, so it returns graphstore.ErrReadOnly.
+func (s *store) Write(ctx context.Context, req *spb.WriteRequest) error {
+	return graphstore.ErrReadOnly
+}
+
+// Close implements part of the graphstore.Service interface.
+func (s *store) Close(ctx context.Context) error { return nil }
+
+// prefixEnd returns the least key greater than every key with the given
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// merge calls f, in order, with each entry of the shards whose key is at least
+// start (if non-nil) and less than end (if non-nil) that satisfies match (or
+// every such entry if match is nil).  Entries with equal keys in several shards
+// are delivered once.
+func (s *store) merge(ctx context.Context, start, end []byte, match func(*spb.Entry) bool, f graphstore.EntryFunc) error {
+	var h cursorHeap
+	defer func() {
+		for _, c := range h {
+			c.rc.Close()
+		}
+	}()
+	for _, sh := range s.shards {
+		offset, length, ok := sh.span(start, end)
+		if !ok {
+			continue
+		}
+		rc, err := s.bucket.ReadRange(ctx, sh.name, offset, length)
+		if err != nil {
+			return fmt.Errorf("error reading shard %q: %v", sh.name, err)
+		}
+		c := &cursor{name: sh.name, rc: rc, rd: delimited.NewReader(rc)}
+		if err := c.seek(start); err == io.EOF {
+			rc.Close()
+			continue
+		} else if err != nil {
+			rc.Close()
+			return err
+		}
+		h = append(h, c)
+	}
+	heap.Init(&h)
+
+	var last []byte
+	for len(h) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c := h[0]
+		if end != nil && bytes.Compare(c.key, end) >= 0 {
+			return nil
+		}
+		if last == nil || !bytes.Equal(c.key, last) {
+			last = append(last[:0], c.key...)
+			if match == nil || match(c.entry) {
+				if err := f(c.entry); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		if err := c.next(); err == io.EOF {
+			heap.Pop(&h)
+			c.rc.Close()
+		} else if err != nil {
+			return err
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return nil
+}
+
+// A cursor reads the entries of a range of a shard in order.
+type cursor struct {
+	name  string
+	rc    io.ReadCloser
+	rd    *delimited.Reader
+	entry *spb.Entry // the current entry
+	key   []byte     // the canonical key of entry
+}
+
+// next advances c to the shard's next entry, returning io.EOF at the end of its
+// range.
+func (c *cursor) next() error {
+	rec, err := c.rd.Next()
+	if err == io.EOF {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("error reading shard %q: %v", c.name, err)
+	}
+	var e spb.Entry
+	if err := proto.Unmarshal(rec, &e); err != nil {
+		return fmt.Errorf("error decoding entry of shard %q: %v", c.name, err)
+	}
+	c.entry, c.key = &e, compare.EncodeEntryKey(&e)
+	return nil
+}
+
+// seek advances c to the first entry whose key is at least start.
+func (c *cursor) seek(start []byte) error {
+	for {
+		if err := c.next(); err != nil {
+			return err
+		} else if bytes.Compare(c.key, start) >= 0 {
+			return nil
+		}
+	}
+}
+
+type cursorHeap []*cursor
+
+func (h cursorHeap) Len() int            { return len(h) }
+func (h cursorHeap) Less(i, j int) bool  { return bytes.Compare(h[i].key, h[j].key) < 0 }
+func (h cursorHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x interface{}) { *h = append(*h, x.(*cursor)) }
+func (h *cursorHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
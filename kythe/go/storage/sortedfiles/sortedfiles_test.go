@@ -0,0 +1,322 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sortedfiles
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"kythe.io/kythe/go/platform/delimited"
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+const (
+	testShards    = 3
+	testBlockSize = 256
+)
+
+// countingBucket is a Bucket that counts the bytes read from its blobs.
+type countingBucket struct {
+	Bucket
+	read int64
+}
+
+func (b *countingBucket) ReadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	rc, err := b.Bucket.ReadRange(ctx, name, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&countingReader{rc, &b.read}, rc}, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	*r.n += int64(n)
+	return n, err
+}
+
+// testEntries returns the sorted entries of a small graph.
+func testEntries() []*spb.Entry {
+	var entries []*spb.Entry
+	for i := 0; i < 50; i++ {
+		src := &spb.VName{Signature: fmt.Sprintf("sig%02d", i), Corpus: "test"}
+		entries = append(entries,
+			&spb.Entry{Source: src, FactName: "/kythe/node/kind", FactValue: []byte("record")},
+			&spb.Entry{Source: src, FactName: "/kythe/text", FactValue: []byte(strings.Repeat("text", i))},
+			&spb.Entry{Source: src, EdgeKind: "/kythe/edge/childof", FactName: "/",
+				Target: &spb.VName{Signature: fmt.Sprintf("sig%02d", i/2), Corpus: "test"}},
+			&spb.Entry{Source: src, EdgeKind: "/kythe/edge/ref", FactName: "/",
+				Target: &spb.VName{Signature: fmt.Sprintf("sig%02d", (i*7)%50), Corpus: "test"}},
+		)
+	}
+	sort.Sort(compare.ByEntries(entries))
+	return entries
+}
+
+// writeShards writes entries to sorted shards in dir, dividing them by a hash
+// of their sources, and returns the shards' names.  The first entry is also
+// written to every other shard.
+func writeShards(t *testing.T, dir string, entries []*spb.Entry) []string {
+	var names []string
+	var writers []*delimited.Writer
+	for i := 0; i < testShards; i++ {
+		name := fmt.Sprintf("entries-%05d-of-%05d", i, testShards)
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		names = append(names, name)
+		writers = append(writers, delimited.NewWriter(f))
+	}
+	for i, e := range entries {
+		h := fnv.New32()
+		h.Write(compare.EncodeVName(e.Source))
+		for j, w := range writers {
+			if i == 0 || uint32(j) == h.Sum32()%testShards {
+				if err := w.PutProto(e); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	return names
+}
+
+// testStore writes entries to sorted shards in a new temporary directory,
+// indexes them, and returns a store over them.
+func testStore(t *testing.T, entries []*spb.Entry) (graphstore.Service, *countingBucket, func()) {
+	dir, err := ioutil.TempDir("", "sortedfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	names := writeShards(t, dir, entries)
+
+	ctx := context.Background()
+	var index bytes.Buffer
+	if err := BuildIndex(ctx, Dir(dir), names, testBlockSize, &index); err != nil {
+		cleanup()
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(dir, "index"), index.Bytes(), 0644); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	bucket := &countingBucket{Bucket: Dir(dir)}
+	gs, err := Open(ctx, bucket, "index")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return gs, bucket, cleanup
+}
+
+func collect(t *testing.T, read func(graphstore.EntryFunc) error) []*spb.Entry {
+	var entries []*spb.Entry
+	if err := read(func(e *spb.Entry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func checkEntries(t *testing.T, desc string, got, want []*spb.Entry) {
+	if len(got) != len(want) {
+		t.Errorf("%s: found %d entries; want %d", desc, len(got), len(want))
+		return
+	}
+	for i, e := range got {
+		if !compare.EntriesEqual(e, want[i]) {
+			t.Errorf("%s: entry %d is %v; want %v", desc, i, e, want[i])
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	entries := testEntries()
+	gs, bucket, cleanup := testStore(t, entries)
+	defer cleanup()
+	ctx := context.Background()
+
+	var total int64
+	for _, size := range shardSizes(t, gs) {
+		total += size
+	}
+	for i := 0; i < 50; i++ {
+		src := &spb.VName{Signature: fmt.Sprintf("sig%02d", i), Corpus: "test"}
+		for _, kind := range []string{"", "*", "/kythe/edge/ref", "/kythe/edge/none"} {
+			req := &spb.ReadRequest{Source: src, EdgeKind: kind}
+			var want []*spb.Entry
+			for _, e := range entries {
+				if compare.VNamesEqual(e.Source, src) && (kind == "*" || e.EdgeKind == kind) {
+					want = append(want, e)
+				}
+			}
+			bucket.read = 0
+			got := collect(t, func(f graphstore.EntryFunc) error { return gs.Read(ctx, req, f) })
+			checkEntries(t, fmt.Sprintf("Read(%v)", req), got, want)
+
+			// Each Read should read at most about two blocks of each shard.
+			if max := int64(testShards * 3 * testBlockSize); bucket.read > max {
+				t.Errorf("Read(%v) read %d bytes of %d; want at most %d", req, bucket.read, total, max)
+			}
+		}
+	}
+}
+
+// shardSizes returns the sizes of the shards of gs.
+func shardSizes(t *testing.T, gs graphstore.Service) []int64 {
+	var sizes []int64
+	for _, sh := range gs.(*store).shards {
+		sizes = append(sizes, sh.size)
+	}
+	if len(sizes) != testShards {
+		t.Fatalf("Found %d shards; want %d", len(sizes), testShards)
+	}
+	return sizes
+}
+
+func TestScan(t *testing.T) {
+	entries := testEntries()
+	gs, _, cleanup := testStore(t, entries)
+	defer cleanup()
+	ctx := context.Background()
+
+	for _, req := range []*spb.ScanRequest{
+		{},
+		{EdgeKind: "/kythe/edge/childof"},
+		{FactPrefix: "/kythe/t"},
+		{Target: &spb.VName{Signature: "sig07", Corpus: "test"}},
+	} {
+		var want []*spb.Entry
+		for _, e := range entries {
+			if graphstore.EntryMatchesScan(req, e) {
+				want = append(want, e)
+			}
+		}
+		got := collect(t, func(f graphstore.EntryFunc) error { return gs.Scan(ctx, req, f) })
+		checkEntries(t, fmt.Sprintf("Scan(%v)", req), got, want)
+
+		// Pages of the scan should resume where the previous page ended.
+		var paged []*spb.Entry
+		var token string
+		for {
+			page, next, err := gs.(graphstore.PagedScanner).ScanPage(ctx, req, 7, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paged = append(paged, page...)
+			if next == "" {
+				break
+			}
+			token = next
+		}
+		checkEntries(t, fmt.Sprintf("ScanPage(%v)", req), paged, want)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	gs, _, cleanup := testStore(t, testEntries())
+	defer cleanup()
+	if err := gs.Write(context.Background(), &spb.WriteRequest{
+		Source: &spb.VName{Signature: "sig"},
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("test")}},
+	}); err != graphstore.ErrReadOnly {
+		t.Errorf("Write returned error %v; want %v", err, graphstore.ErrReadOnly)
+	}
+}
+
+func TestBuildIndexUnsorted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sortedfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entries := testEntries()
+	entries[0], entries[1] = entries[1], entries[0]
+	names := writeShards(t, dir, entries)
+	if err := BuildIndex(context.Background(), Dir(dir), names, testBlockSize, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "not sorted") {
+		t.Errorf("BuildIndex of unsorted shards returned error %v; want a sorting error", err)
+	}
+}
+
+func TestSpan(t *testing.T) {
+	// Each block of the shard is 100 bytes; the first block ends with keys
+	// "b", which also begin the second block.
+	sh := &shard{name: "test", size: 400, blocks: []block{
+		{0, []byte("a")},
+		{100, []byte("b")},
+		{200, []byte("d")},
+		{300, []byte("d")},
+	}}
+	tests := []struct {
+		start, end     string
+		offset, length int64
+		ok             bool
+	}{
+		{"", "", 0, 400, true},
+		{"a", "", 0, 400, true},
+		{"b", "", 0, 400, true},
+		{"c", "", 100, 300, true},
+		{"d", "", 100, 300, true},
+		{"e", "", 300, 100, true},
+		{"", "a", 0, 0, false},
+		{"a", "b", 0, 100, true},
+		{"b", "c", 0, 200, true},
+		{"d", "e", 100, 300, true},
+		{"c", "d", 100, 100, true},
+	}
+	for _, test := range tests {
+		var start, end []byte
+		if test.start != "" {
+			start = []byte(test.start)
+		}
+		if test.end != "" {
+			end = []byte(test.end)
+		}
+		offset, length, ok := sh.span(start, end)
+		if ok != test.ok || ok && (offset != test.offset || length != test.length) {
+			t.Errorf("span(%q, %q): got (%d, %d, %v); want (%d, %d, %v)",
+				test.start, test.end, offset, length, ok, test.offset, test.length, test.ok)
+		}
+	}
+}
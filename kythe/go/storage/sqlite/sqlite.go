@@ -0,0 +1,631 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sqlite implements a graphstore.Service using a SQLite database.
+//
+// Each entry is a row of the entries table keyed by its canonical entry key
+// (see compare.EncodeEntryKey), so Reads are range scans of the primary key.
+// The encoded target of each edge is indexed along with its key and value, so
+// Scans with a Target filter (and ReverseEdges) read only the matching edges
+// from the index.  The database is kept in WAL mode, so readers do not block
+// the writer.  The schema of a database written by an earlier version of the
+// package is migrated when it is opened (unless read-only).
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+
+	// Register the sqlite3 database/sql driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	graphstore.Register("sqlite", func(ctx context.Context, u *url.URL) (graphstore.Service, error) {
+		return OpenGraphStore(graphstore.SpecLocation(u), nil)
+	})
+}
+
+// DefaultOptions is the default Options struct passed to OpenGraphStore when
+// not otherwise given one.
+var DefaultOptions = &Options{
+	CacheSize:   64 << 20,
+	Synchronous: "NORMAL",
+	BusyTimeout: 5 * time.Second,
+}
+
+// Options for customizing a SQLite backend.
+type Options struct {
+	// ReadOnly opens the database read-only.  Each write to the GraphStore fails
+	// with graphstore.ErrReadOnly.  The database must already exist.
+	ReadOnly bool
+
+	// CacheSize is the approximate size in bytes of each connection's page
+	// cache (PRAGMA cache_size).  If zero, SQLite's default is used.
+	CacheSize int
+
+	// Synchronous is the level of syncing of writes to disk (PRAGMA
+	// synchronous): one of "OFF", "NORMAL", "FULL", or "EXTRA".  In WAL mode,
+	// "NORMAL" preserves the database's consistency but may lose the most
+	// recent writes on a power failure.  If empty, SQLite's default ("FULL")
+	// is used.
+	Synchronous string
+
+	// BusyTimeout is the amount of time to wait for a lock held by another
+	// connection (such as another process's write) before failing.
+	BusyTimeout time.Duration
+
+	// BatchSize is the maximum number of rows in each INSERT statement of a
+	// Write.  If zero, DefaultBatchSize is used.
+	BatchSize int
+}
+
+// DefaultBatchSize is the default maximum number of rows inserted by a single
+// statement.  Each row has 3 parameters, and SQLite limits a statement to 999
+// parameters by default.
+const DefaultBatchSize = 300
+
+// schemaVersion is the version of the schema, recorded as the database's
+// user_version.  A database created before versions were recorded has version
+// 0, which is otherwise equivalent to version 1.
+//
+//   1: the entries table, with the entries_target index of edge targets
+//   2: entries_target is replaced by entries_by_target, covering Scans by target
+const schemaVersion = 2
+
+const schema = `
+CREATE TABLE IF NOT EXISTS entries (
+  key BLOB PRIMARY KEY NOT NULL,
+  target BLOB,
+  value BLOB NOT NULL
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS entries_by_target ON entries (target, key, value) WHERE target IS NOT NULL;
+DROP INDEX IF EXISTS entries_target;
+`
+
+// The entries table holds each entry's canonical key, its encoded target (NULL
+// for facts), and its fact value.  The entries_by_target index holds each
+// edge's row in key order for each target, so a query by target need not read
+// the table.
+const (
+	selectEntries       = `SELECT key, value FROM entries ORDER BY key`
+	selectEntriesAfter  = `SELECT key, value FROM entries WHERE key > ? ORDER BY key`
+	selectRange         = `SELECT key, value FROM entries WHERE key >= ? AND key < ? ORDER BY key`
+	selectFrom          = `SELECT key, value FROM entries WHERE key >= ? ORDER BY key`
+	selectTarget        = `SELECT key, value FROM entries WHERE target = ? ORDER BY key`
+	selectTargetAfter   = `SELECT key, value FROM entries WHERE target = ? AND key > ? ORDER BY key`
+	selectKeys          = `SELECT key FROM entries ORDER BY key`
+	countEntries        = `SELECT count(*) FROM entries`
+	deleteEntry         = `DELETE FROM entries WHERE key = ?`
+	insertEntriesPrefix = `INSERT INTO entries (key, target, value) VALUES `
+	insertRow           = `(?, ?, ?)`
+	insertEntriesSuffix = ` ON CONFLICT (key) DO UPDATE SET value = excluded.value`
+)
+
+// queries are the statements prepared when a store is opened.
+var queries = []string{
+	selectEntries, selectEntriesAfter, selectRange, selectFrom,
+	selectTarget, selectTargetAfter, selectKeys, countEntries, deleteEntry,
+}
+
+// OpenGraphStore returns a graphstore.Service backed by a SQLite database at
+// the given file path, which is created if it does not exist (unless
+// opts.ReadOnly).  If opts==nil, the DefaultOptions are used.  The returned
+// Service is Sharded by contiguous key ranges and implements
+// graphstore.TargetIndexed.
+func OpenGraphStore(path string, opts *Options) (graphstore.Service, error) {
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	dsn, err := dataSourceName(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open sqlite database at %q: %v", path, err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not open sqlite database at %q: %v", path, err)
+	}
+	if !opts.ReadOnly {
+		if err := migrate(db); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error initializing sqlite database: %v", err)
+		}
+	}
+	s := &store{
+		db:        db,
+		readOnly:  opts.ReadOnly,
+		batchSize: opts.BatchSize,
+		stmts:     make(map[string]*sql.Stmt),
+		inserts:   make(map[int]*sql.Stmt),
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = DefaultBatchSize
+	}
+	for _, q := range queries {
+		stmt, err := db.Prepare(q)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error preparing statement: %v", err)
+		}
+		s.stmts[q] = stmt
+	}
+	return s, nil
+}
+
+// migrate creates or updates the schema of db to schemaVersion.
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	} else if version == schemaVersion {
+		return nil
+	} else if version > schemaVersion {
+		return fmt.Errorf("database has schema version %d; at most %d is supported", version, schemaVersion)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(schema); err != nil {
+		tx.Rollback()
+		return err
+	} else if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// dataSourceName returns the sqlite3 driver's data source name for the
+// database at path with the given options.  Pragmas are given in the name so
+// that they apply to each of the pool's connections.
+func dataSourceName(path string, opts *Options) (string, error) {
+	params := []string{fmt.Sprintf("_busy_timeout=%d", opts.BusyTimeout/time.Millisecond)}
+	if opts.ReadOnly {
+		params = append(params, "mode=ro")
+	} else {
+		params = append(params, "_journal_mode=WAL")
+	}
+	switch sync := strings.ToUpper(opts.Synchronous); sync {
+	case "":
+	case "OFF", "NORMAL", "FULL", "EXTRA":
+		params = append(params, "_synchronous="+sync)
+	default:
+		return "", fmt.Errorf("invalid synchronous setting: %q", opts.Synchronous)
+	}
+	if opts.CacheSize > 0 {
+		// A negative cache_size is a number of KiB rather than of pages.
+		params = append(params, fmt.Sprintf("_cache_size=%d", -(opts.CacheSize+1023)/1024))
+	}
+	escaper := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23")
+	return "file:" + escaper.Replace(path) + "?" + strings.Join(params, "&"), nil
+}
+
+type store struct {
+	db        *sql.DB
+	readOnly  bool
+	batchSize int
+
+	// Statements prepared for the pool's connections, by query.  The database
+	// driver prepares each statement once per connection on first use.
+	stmts map[string]*sql.Stmt
+
+	insertsMu sync.Mutex
+	inserts   map[int]*sql.Stmt // INSERT statements by number of rows
+
+	shardMu     sync.Mutex
+	generation  uint64 // incremented by each write, invalidating shardTables
+	shardTables map[int64]*shardTable
+}
+
+// query calls f with each entry of the rows of the given query (of keys and
+// values) that satisfies match (or every entry if match is nil).
+func (s *store) query(ctx context.Context, match func(*spb.Entry) bool, f graphstore.EntryFunc, query string, args ...interface{}) error {
+	rows, err := s.stmts[query].Query(args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var key, val []byte
+		if err := rows.Scan(&key, &val); err != nil {
+			return err
+		}
+		e, err := compare.DecodeEntryKey(key)
+		if err != nil {
+			return fmt.Errorf("invalid entry key %q: %v", key, err)
+		} else if len(val) > 0 {
+			e.FactValue = val
+		}
+		if match != nil && !match(e) {
+			continue
+		} else if err := f(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// prefixEnd returns the least key greater than every key with the given
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// queryPrefix calls f with each entry whose key has the given prefix.
+func (s *store) queryPrefix(ctx context.Context, prefix []byte, f graphstore.EntryFunc) error {
+	if end := prefixEnd(prefix); end != nil {
+		return s.query(ctx, nil, f, selectRange, prefix, end)
+	}
+	return s.query(ctx, nil, f, selectFrom, prefix)
+}
+
+// Read implements part of the graphstore.Service interface.
+func (s *store) Read(ctx context.Context, req *spb.ReadRequest, f graphstore.EntryFunc) error {
+	return s.queryPrefix(ctx, compare.EncodeKeyPrefix(req.Source, req.EdgeKind), f)
+}
+
+// Scan implements part of the graphstore.Service interface.  A Scan with a
+// Target reads only the edges to that target, using the target index.
+func (s *store) Scan(ctx context.Context, req *spb.ScanRequest, f graphstore.EntryFunc) error {
+	return s.ScanFrom(ctx, req, nil, f)
+}
+
+// ScanFrom implements part of the graphstore.ResumableScanner interface.
+func (s *store) ScanFrom(ctx context.Context, req *spb.ScanRequest, after *spb.Entry, f graphstore.EntryFunc) error {
+	match := func(e *spb.Entry) bool { return graphstore.EntryMatchesScan(req, e) }
+	// An empty Target also matches node facts, which are not in the target
+	// index, so it is matched by a scan of the table.
+	byTarget := req.Target != nil && !compare.VNamesEqual(req.Target, nil)
+	switch {
+	case byTarget && after != nil:
+		return s.query(ctx, match, f, selectTargetAfter, compare.EncodeVName(req.Target), compare.EncodeEntryKey(after))
+	case byTarget:
+		return s.query(ctx, match, f, selectTarget, compare.EncodeVName(req.Target))
+	case after != nil:
+		return s.query(ctx, match, f, selectEntriesAfter, compare.EncodeEntryKey(after))
+	default:
+		return s.query(ctx, match, f, selectEntries)
+	}
+}
+
+// ScanPage implements part of the graphstore.PagedScanner interface.
+func (s *store) ScanPage(ctx context.Context, req *spb.ScanRequest, pageSize int, token string) ([]*spb.Entry, string, error) {
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("invalid page size: %d", pageSize)
+	}
+	after, err := graphstore.ParsePageToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	var page []*spb.Entry
+	if err := s.ScanFrom(ctx, req, after, func(e *spb.Entry) error {
+		page = append(page, e)
+		if len(page) > pageSize {
+			return io.EOF
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	return graphstore.Page(page, pageSize)
+}
+
+// ScansOrdered implements the graphstore.OrderedScanner interface.
+func (s *store) ScansOrdered() bool { return true }
+
+// ReverseEdges implements the graphstore.TargetIndexed interface.
+func (s *store) ReverseEdges(ctx context.Context, target *spb.VName, kinds []string, f graphstore.EntryFunc) error {
+	return s.query(ctx, func(e *spb.Entry) bool {
+		if e.EdgeKind == "" {
+			return false
+		} else if len(kinds) == 0 {
+			return true
+		}
+		for _, kind := range kinds {
+			if e.EdgeKind == kind {
+				return true
+			}
+		}
+		return false
+	}, f, selectTarget, compare.EncodeVName(target))
+}
+
+// Write implements part of the graphstore.Service interface.  Each request is
+// applied in a single transaction.
+func (s *store) Write(ctx context.Context, req *spb.WriteRequest) error {
+	return s.WriteBatch(ctx, []*spb.WriteRequest{req})
+}
+
+// WriteBatch implements part of the graphstore.Transactional interface.  All of
+// the requests are applied in a single transaction.
+func (s *store) WriteBatch(ctx context.Context, reqs []*spb.WriteRequest) error {
+	return s.update(ctx, func(tx *sql.Tx) error {
+		var args []interface{}
+		for _, req := range reqs {
+			for _, u := range req.Update {
+				key := compare.EncodeEntryKey(&spb.Entry{
+					Source:   req.Source,
+					EdgeKind: u.EdgeKind,
+					Target:   u.Target,
+					FactName: u.FactName,
+				})
+				var target []byte
+				if u.EdgeKind != "" {
+					target = compare.EncodeVName(u.Target)
+				}
+				val := u.FactValue
+				if val == nil {
+					val = []byte{}
+				}
+				args = append(args, key, target, val)
+				if len(args) == 3*s.batchSize {
+					if err := s.insertRows(tx, args); err != nil {
+						return err
+					}
+					args = args[:0]
+				}
+			}
+		}
+		return s.insertRows(tx, args)
+	})
+}
+
+// insertRows inserts or replaces the rows of args, each given as its key,
+// target, and value, in a single statement.
+func (s *store) insertRows(tx *sql.Tx, args []interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	stmt, err := s.insert(len(args) / 3)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Stmt(stmt).Exec(args...)
+	return err
+}
+
+// insert returns the prepared statement inserting or replacing n rows.
+func (s *store) insert(n int) (*sql.Stmt, error) {
+	s.insertsMu.Lock()
+	defer s.insertsMu.Unlock()
+	if stmt, ok := s.inserts[n]; ok {
+		return stmt, nil
+	}
+	rows := make([]string, n)
+	for i := range rows {
+		rows[i] = insertRow
+	}
+	stmt, err := s.db.Prepare(insertEntriesPrefix + strings.Join(rows, ", ") + insertEntriesSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("error preparing insert: %v", err)
+	}
+	s.inserts[n] = stmt
+	return stmt, nil
+}
+
+// update calls f with a new transaction, which is committed unless f returns an
+// error.
+func (s *store) update(ctx context.Context, f func(*sql.Tx) error) error {
+	if s.readOnly {
+		return graphstore.ErrReadOnly
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		s.shardMu.Lock()
+		s.generation++
+		s.shardMu.Unlock()
+	}()
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete implements part of the graphstore.Deleter interface.
+func (s *store) Delete(ctx context.Context, req *graphstore.DeleteRequest) error {
+	if req.Source == nil {
+		return errors.New("invalid DeleteRequest: missing Source")
+	}
+	kind := req.EdgeKind
+	if kind == "" {
+		kind = "*"
+	}
+	var keys [][]byte
+	if err := s.queryPrefix(ctx, compare.EncodeKeyPrefix(req.Source, kind), func(e *spb.Entry) error {
+		if graphstore.EntryMatchesDelete(req, e) {
+			keys = append(keys, compare.EncodeEntryKey(e))
+		}
+		return nil
+	}); err != nil {
+		return err
+	} else if len(keys) == 0 {
+		return nil
+	}
+	return s.update(ctx, func(tx *sql.Tx) error {
+		stmt := tx.Stmt(s.stmts[deleteEntry])
+		for _, key := range keys {
+			if _, err := stmt.Exec(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DiskSize implements the graphstore.DiskSizer interface using the size of the
+// database's pages, excluding its write-ahead log.
+func (s *store) DiskSize(ctx context.Context) (int64, error) {
+	var pages, pageSize int64
+	if err := s.db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, err
+	} else if err := s.db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return pages * pageSize, nil
+}
+
+// CheckHealth implements the graphstore.HealthChecker interface by pinging the
+// database.
+func (s *store) CheckHealth(ctx context.Context) error {
+	if err := s.db.Ping(); err != nil {
+		return fmt.Errorf("database ping failed: %v", err)
+	}
+	return nil
+}
+
+// Close implements part of the graphstore.Service interface.
+func (s *store) Close(ctx context.Context) error { return s.db.Close() }
+
+// A shardTable divides the keys of a store into contiguous ranges with nearly
+// equal numbers of entries, as of a given generation of the store.
+type shardTable struct {
+	generation uint64
+	starts     [][]byte // the first key of each non-empty shard
+	counts     []int64
+}
+
+// shardRange returns the range of keys of the given shard: keys at least start
+// and, if end is non-nil, less than end.
+func (t *shardTable) shardRange(index int64) (start, end []byte) {
+	start = t.starts[index]
+	for i := index + 1; i < int64(len(t.starts)); i++ {
+		if t.counts[i] > 0 {
+			return start, t.starts[i]
+		}
+	}
+	return start, nil
+}
+
+// shards returns the current shardTable for the given number of shards,
+// computing it if the store has been written since it was last used.
+func (s *store) shards(num int64) (*shardTable, error) {
+	s.shardMu.Lock()
+	defer s.shardMu.Unlock()
+	if t, ok := s.shardTables[num]; ok && t.generation == s.generation {
+		return t, nil
+	}
+	t := &shardTable{
+		generation: s.generation,
+		starts:     make([][]byte, num),
+		counts:     make([]int64, num),
+	}
+	var total int64
+	if err := s.stmts[countEntries].QueryRow().Scan(&total); err != nil {
+		return nil, err
+	}
+	rows, err := s.stmts[selectKeys].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var i, shard int64
+	for rows.Next() {
+		var key []byte
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		// Key i belongs to the shard containing index i of an even division of
+		// total keys into num shards.
+		for (shard+1)*total <= i*num && shard < num-1 {
+			shard++
+		}
+		if t.counts[shard] == 0 {
+			t.starts[shard] = key
+		}
+		t.counts[shard]++
+		i++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if s.shardTables == nil {
+		s.shardTables = make(map[int64]*shardTable)
+	}
+	s.shardTables[num] = t
+	return t, nil
+}
+
+// Count implements part of the graphstore.Sharded interface.  Shards are
+// contiguous ranges of keys, computed by a scan of the store's keys after each
+// write, so Counts and Shards agree only while the store is not written.
+func (s *store) Count(ctx context.Context, req *spb.CountRequest) (int64, error) {
+	if req.Shards < 1 {
+		return 0, fmt.Errorf("invalid number of shards: %d", req.Shards)
+	} else if req.Index < 0 || req.Index >= req.Shards {
+		return 0, fmt.Errorf("invalid index for %d shards: %d", req.Shards, req.Index)
+	}
+	t, err := s.shards(req.Shards)
+	if err != nil {
+		return 0, err
+	}
+	return t.counts[req.Index], nil
+}
+
+// Shard implements part of the graphstore.Sharded interface.
+func (s *store) Shard(ctx context.Context, req *spb.ShardRequest, f graphstore.EntryFunc) error {
+	if req.Shards < 1 {
+		return fmt.Errorf("invalid number of shards: %d", req.Shards)
+	} else if req.Index < 0 || req.Index >= req.Shards {
+		return fmt.Errorf("invalid index for %d shards: %d", req.Shards, req.Index)
+	}
+	t, err := s.shards(req.Shards)
+	if err != nil {
+		return err
+	} else if t.counts[req.Index] == 0 {
+		return nil
+	}
+	start, end := t.shardRange(req.Index)
+	if end == nil {
+		return s.query(ctx, nil, f, selectFrom, start)
+	}
+	return s.query(ctx, nil, f, selectRange, start, end)
+}
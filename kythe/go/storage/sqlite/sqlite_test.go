@@ -0,0 +1,516 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gspkg "kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/test/services/graphstore"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+const (
+	smallBatchSize  = 4
+	mediumBatchSize = 16
+	largeBatchSize  = 64
+)
+
+func tempGS() (graphstore.Service, graphstore.DestroyFunc, error) {
+	dir, err := ioutil.TempDir("", "sqlite.test")
+	if err != nil {
+		return nil, graphstore.NullDestroy, err
+	}
+	destroy := func() error { return os.RemoveAll(dir) }
+	gs, err := OpenGraphStore(filepath.Join(dir, "gs.db"), nil)
+	if err != nil {
+		return nil, destroy, fmt.Errorf("error creating temporary DB: %v", err)
+	}
+	return gs, destroy, nil
+}
+
+func BenchmarkGSWriteSingleEntry(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, 1)
+}
+func BenchmarkGSWriteBatchSml(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, smallBatchSize)
+}
+func BenchmarkGSWriteBatchLrg(b *testing.B) {
+	graphstore.BatchWriteBenchmark(b, tempGS, largeBatchSize)
+}
+
+func BenchmarkGSReadAllFacts(b *testing.B) {
+	graphstore.ReadFactsBenchmark(b, tempGS, nil)
+}
+
+func BenchmarkGSZipfRead(b *testing.B) {
+	graphstore.ZipfReadBenchmark(b, tempGS, nil)
+}
+
+// BenchmarkBulkLoad measures the throughput of loading nodes of 4 facts and 4
+// edges in transactions of 1000 requests.
+func BenchmarkBulkLoad(b *testing.B) { bulkLoadBenchmark(b, DefaultBatchSize) }
+
+// BenchmarkBulkLoadSingleRow is BenchmarkBulkLoad with an INSERT statement per
+// update, as a baseline for multi-row INSERTs.
+func BenchmarkBulkLoadSingleRow(b *testing.B) { bulkLoadBenchmark(b, 1) }
+
+func bulkLoadBenchmark(b *testing.B, batchSize int) {
+	dir, err := ioutil.TempDir("", "sqlite.bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := *DefaultOptions
+	opts.BatchSize = batchSize
+	gs, err := OpenGraphStore(filepath.Join(dir, "gs.db"), &opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	const requests = 1000
+	tx := gs.(gspkg.Transactional)
+	var reqs []*spb.WriteRequest
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := &spb.WriteRequest{Source: &spb.VName{Signature: fmt.Sprintf("node%d", i), Corpus: "bench"}}
+		for j := 0; j < 4; j++ {
+			req.Update = append(req.Update, &spb.WriteRequest_Update{
+				FactName:  fmt.Sprintf("/fact/%d", j),
+				FactValue: []byte(strings.Repeat("value", j+1)),
+			}, &spb.WriteRequest_Update{
+				EdgeKind: fmt.Sprintf("/edge/%d", j),
+				Target:   &spb.VName{Signature: fmt.Sprintf("node%d", (i*7+j)%(b.N+1)), Corpus: "bench"},
+				FactName: "/",
+			})
+		}
+		reqs = append(reqs, req)
+		if len(reqs) == requests || i == b.N-1 {
+			if err := tx.WriteBatch(ctx, reqs); err != nil {
+				b.Fatal(err)
+			}
+			reqs = reqs[:0]
+		}
+	}
+}
+
+func TestOrder(t *testing.T) {
+	graphstore.OrderTest(t, tempGS, largeBatchSize)
+}
+
+func TestDelete(t *testing.T) {
+	graphstore.DeleteTest(t, tempGS)
+}
+
+func TestGarbageCollection(t *testing.T) {
+	graphstore.GarbageCollectionTest(t, tempGS)
+}
+
+func TestPagedScan(t *testing.T) {
+	graphstore.PagedScanTest(t, tempGS)
+}
+
+func TestScanFrom(t *testing.T) {
+	graphstore.ScanFromTest(t, tempGS)
+}
+
+func TestTransaction(t *testing.T) {
+	graphstore.TransactionTest(t, tempGS)
+}
+
+func TestHealthCheck(t *testing.T) {
+	graphstore.HealthCheckTest(t, tempGS)
+}
+
+func TestReadFacts(t *testing.T) {
+	graphstore.ReadFactsTest(t, tempGS)
+}
+
+func TestBlobWrite(t *testing.T) {
+	graphstore.BlobWriteTest(t, tempGS)
+}
+
+func TestTargetScan(t *testing.T) {
+	gs, destroy, err := tempGS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroy()
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	target := &spb.VName{Signature: "target"}
+	for _, src := range []string{"a", "b", "c"} {
+		if err := gs.Write(ctx, &spb.WriteRequest{
+			Source: &spb.VName{Signature: src},
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+				{EdgeKind: "/kythe/edge/ref", Target: target, FactName: "/"},
+				{EdgeKind: "/kythe/edge/childof", Target: target, FactName: "/"},
+				{EdgeKind: "/kythe/edge/ref", Target: &spb.VName{Signature: "other"}, FactName: "/"},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var found []*spb.Entry
+	if err := gs.Scan(ctx, &spb.ScanRequest{Target: target, EdgeKind: "/kythe/edge/ref"}, func(e *spb.Entry) error {
+		found = append(found, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 {
+		t.Errorf("Scan found %d edges; want 3: %v", len(found), found)
+	}
+	for i, e := range found {
+		if !compare.VNamesEqual(e.Target, target) || e.EdgeKind != "/kythe/edge/ref" {
+			t.Errorf("Scan found unexpected entry: %v", e)
+		} else if i > 0 && compare.Entries(found[i-1], e) != compare.LT {
+			t.Errorf("Scan found %v after %v", e, found[i-1])
+		}
+	}
+
+	var reverse int
+	if err := gspkg.ReverseEdges(ctx, gs, target, []string{"/kythe/edge/childof"}, func(e *spb.Entry) error {
+		reverse++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if reverse != 3 {
+		t.Errorf("ReverseEdges found %d edges; want 3", reverse)
+	}
+
+	// The target index must serve target Scans without a read of the table.
+	for _, q := range []string{selectTarget, selectTargetAfter} {
+		if p := queryPlan(t, gs.(*store).db, q); !strings.Contains(p, "USING COVERING INDEX entries_by_target") {
+			t.Errorf("Target Scan query plan does not use the covering target index: %q", p)
+		}
+	}
+}
+
+func TestScanTargets(t *testing.T) {
+	gs, destroy, err := tempGS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroy()
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	target := &spb.VName{Signature: "target"}
+	if err := gs.Write(ctx, &spb.WriteRequest{
+		Source: &spb.VName{Signature: "src"},
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+			{EdgeKind: "/kythe/edge/ref", Target: target, FactName: "/"},
+			{EdgeKind: "/kythe/edge/ref", Target: &spb.VName{}, FactName: "/"},
+			{EdgeKind: "/kythe/edge/ref", Target: &spb.VName{Signature: "other"}, FactName: "/"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	after := &spb.Entry{Source: &spb.VName{Signature: "src"}, FactName: "/kythe/node/kind"}
+
+	tests := []struct {
+		target *spb.VName
+		after  *spb.Entry
+		want   []string // the target signature of each edge, or "fact"
+	}{
+		{target: nil, want: []string{"fact", "", "other", "target"}},
+		{target: nil, after: after, want: []string{"", "other", "target"}},
+		{target: &spb.VName{}, want: []string{"fact", ""}},
+		{target: &spb.VName{}, after: after, want: []string{""}},
+		{target: target, want: []string{"target"}},
+		{target: target, after: after, want: []string{"target"}},
+		{target: &spb.VName{Signature: "missing"}},
+	}
+	for _, test := range tests {
+		var got []string
+		if err := gs.(gspkg.ResumableScanner).ScanFrom(ctx, &spb.ScanRequest{Target: test.target}, test.after, func(e *spb.Entry) error {
+			if e.EdgeKind == "" {
+				got = append(got, "fact")
+			} else if e.Target == nil {
+				got = append(got, "")
+			} else {
+				got = append(got, e.Target.Signature)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("ScanFrom(target: %v, after: %v): got %q; want %q", test.target, test.after, got, test.want)
+		}
+	}
+}
+
+// queryPlan returns the details of SQLite's plan for the given query, whose
+// parameters are all bound to empty blobs.
+func queryPlan(t *testing.T, db *sql.DB, query string) string {
+	args := make([]interface{}, strings.Count(query, "?"))
+	for i := range args {
+		args[i] = []byte{}
+	}
+	rows, err := db.Query("EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		cols, err := rows.Columns()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vals := make([]interface{}, len(cols))
+		for i := range vals {
+			vals[i] = new(sql.RawBytes)
+		}
+		if err := rows.Scan(vals...); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, string(*vals[len(vals)-1].(*sql.RawBytes)))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(plan, "; ")
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite.migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gs.db")
+
+	// Create a store with the version 1 schema, which recorded no version.
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &spb.VName{Signature: "src"}
+	target := &spb.VName{Signature: "target"}
+	edge := &spb.Entry{Source: src, EdgeKind: "/kythe/edge/ref", Target: target, FactName: "/"}
+	fact := &spb.Entry{Source: src, FactName: "/kythe/node/kind", FactValue: []byte("record")}
+	for _, stmt := range []string{
+		`CREATE TABLE entries (key BLOB PRIMARY KEY NOT NULL, target BLOB, value BLOB NOT NULL) WITHOUT ROWID`,
+		`CREATE INDEX entries_target ON entries (target) WHERE target IS NOT NULL`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO entries (key, target, value) VALUES (?, ?, ?), (?, NULL, ?)`,
+		compare.EncodeEntryKey(edge), compare.EncodeVName(target), []byte{},
+		compare.EncodeEntryKey(fact), fact.FactValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	gs, err := OpenGraphStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = gs.(*store).db
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	} else if version != schemaVersion {
+		t.Errorf("Migrated schema version: got %d; want %d", version, schemaVersion)
+	}
+	var indexes []string
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = 'entries' AND sql IS NOT NULL ORDER BY name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		indexes = append(indexes, name)
+	}
+	rows.Close()
+	if got := strings.Join(indexes, ","); got != "entries_by_target" {
+		t.Errorf("Migrated indexes: got %q; want %q", got, "entries_by_target")
+	}
+	if p := queryPlan(t, db, selectTarget); !strings.Contains(p, "USING COVERING INDEX entries_by_target") {
+		t.Errorf("Target Scan query plan does not use the covering target index: %q", p)
+	}
+
+	var found []*spb.Entry
+	if err := gs.Scan(ctx, &spb.ScanRequest{Target: target}, func(e *spb.Entry) error {
+		found = append(found, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if len(found) != 1 || !compare.EntriesEqual(found[0], edge) {
+		t.Errorf("Scan after migration found %v; want %v", found, edge)
+	}
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A store with a newer schema is not opened.
+	db, err = sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion+1)); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gs, err := OpenGraphStore(path, nil); err == nil {
+		gs.Close(ctx)
+		t.Error("Opening a database with a newer schema succeeded; expected an error")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite.readonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gs.db")
+
+	ctx := context.Background()
+	if _, err := OpenGraphStore(path, &Options{ReadOnly: true}); err == nil {
+		t.Error("Opening a missing database read-only succeeded; expected an error")
+	}
+	if _, err := OpenGraphStore(path, &Options{Synchronous: "SOMETIMES"}); err == nil {
+		t.Error("Opening with an invalid synchronous setting succeeded; expected an error")
+	}
+
+	gs, err := OpenGraphStore(path, &Options{CacheSize: 1 << 20, Synchronous: "off"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &spb.WriteRequest{
+		Source: &spb.VName{Signature: "x"},
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("test")}},
+	}
+	if err := gs.Write(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	gs, err = OpenGraphStore(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gs.Close(ctx)
+	if err := gs.Write(ctx, req); err != gspkg.ErrReadOnly {
+		t.Errorf("Write to a read-only store: got error %v; want %v", err, gspkg.ErrReadOnly)
+	}
+	var found int
+	if err := gs.Read(ctx, &spb.ReadRequest{Source: req.Source}, func(e *spb.Entry) error {
+		found++
+		if string(e.FactValue) != "test" {
+			t.Errorf("Read unexpected entry: %v", e)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if found != 1 {
+		t.Errorf("Read %d entries; want 1", found)
+	}
+}
+
+func TestShards(t *testing.T) {
+	gs, destroy, err := tempGS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destroy()
+	ctx := context.Background()
+	defer gs.Close(ctx)
+
+	write := func(n int) {
+		var reqs []*spb.WriteRequest
+		for i := 0; i < n; i++ {
+			reqs = append(reqs, &spb.WriteRequest{
+				Source: &spb.VName{Signature: fmt.Sprintf("sig%04d", i)},
+				Update: []*spb.WriteRequest_Update{
+					{FactName: "/kythe/node/kind", FactValue: []byte("test")},
+					{FactName: "/kythe/text", FactValue: []byte(fmt.Sprint(i))},
+				},
+			})
+		}
+		if err := gs.(gspkg.Transactional).WriteBatch(ctx, reqs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(entries, shards int64) {
+		sh := gs.(gspkg.Sharded)
+		var total int64
+		for i := int64(0); i < shards; i++ {
+			count, err := sh.Count(ctx, &spb.CountRequest{Index: i, Shards: shards})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if max := (entries + shards - 1) / shards; count > max {
+				t.Errorf("Shard %d/%d has %d entries; want at most %d", i, shards, count, max)
+			}
+			var found int64
+			if err := sh.Shard(ctx, &spb.ShardRequest{Index: i, Shards: shards}, func(e *spb.Entry) error {
+				found++
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if found != count {
+				t.Errorf("Shard %d/%d has %d entries; Count reported %d", i, shards, found, count)
+			}
+			total += found
+		}
+		if total != entries {
+			t.Errorf("Found %d total entries across %d shards; want %d", total, shards, entries)
+		}
+	}
+
+	check(0, 3)
+	write(10)
+	check(20, 1)
+	check(20, 3)
+	check(20, 32)
+	write(3000)
+	check(6000, 7)
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Binary buildindex writes the block index of a set of sorted shards of
+// entries, by which a sortedfiles GraphStore serves Reads from the shards (see
+// kythe.io/kythe/go/storage/sortedfiles).  The index refers to each shard by
+// its path relative to --root, which should be the root of the bucket (or
+// directory) from which the shards and index are served.
+//
+// Usage:
+//   buildindex [--block_size size] [--root dir] --output index shard...
+//
+// Example:
+//   read_entries --graphstore gs/leveldb --shards 16 --shards_to_files out/entries
+//   buildindex --root out --output out/index out/entries-*
+//   gsutil cp out/* gs://bucket/
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"path/filepath"
+
+	"kythe.io/kythe/go/platform/vfs"
+	"kythe.io/kythe/go/storage/sortedfiles"
+	"kythe.io/kythe/go/util/datasize"
+	"kythe.io/kythe/go/util/flagutil"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	blockSize = datasize.Flag("block_size", "64KiB", "Approximate size of each indexed block of a shard")
+	root      = flag.String("root", ".", "Directory to which the paths of the shards in the index are relative")
+	output    = flag.String("output", "", "Path of the index file to write")
+)
+
+func init() {
+	flag.Usage = flagutil.SimpleUsage("Write the block index of a set of sorted shards of entries",
+		"[--block_size size] [--root dir] --output index shard...")
+}
+
+func main() {
+	log.SetPrefix("buildindex: ")
+
+	flag.Parse()
+	if *output == "" {
+		flagutil.UsageError("Missing --output")
+	} else if len(flag.Args()) == 0 {
+		flagutil.UsageError("Missing shard paths")
+	} else if blockSize.Bytes() == 0 {
+		flagutil.UsageError("Invalid --block_size 0 (must be > 0)")
+	}
+
+	var shards []string
+	for _, path := range flag.Args() {
+		rel, err := filepath.Rel(*root, path)
+		if err != nil {
+			log.Fatalf("Invalid shard path %q: %v", path, err)
+		}
+		shards = append(shards, filepath.ToSlash(rel))
+	}
+
+	ctx := context.Background()
+	f, err := vfs.Create(ctx, *output)
+	if err != nil {
+		log.Fatalf("Failed to create output file %q: %v", *output, err)
+	}
+	w := bufio.NewWriter(f)
+	if err := sortedfiles.BuildIndex(ctx, sortedfiles.Dir(*root), shards, int64(blockSize.Bytes()), w); err != nil {
+		log.Fatalf("Error building index: %v", err)
+	} else if err := w.Flush(); err != nil {
+		log.Fatalf("Error writing index: %v", err)
+	} else if err := f.Close(); err != nil {
+		log.Fatalf("Error closing index: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	gsgrpc "kythe.io/kythe/go/services/graphstore/grpc"
+	"kythe.io/kythe/go/services/web"
+	"kythe.io/kythe/go/storage/keyvalue"
+)
+
+var (
+	adminTokenFile = flag.String("admin_token_file", "", "File of the bearer tokens, one per line, of which the admin endpoints of --http_listen require one (reread when it changes; requires TLS)")
+	backupRoot     = flag.String("backup_root", "", "Directory in which POST /admin/backup?name=n of --http_listen writes a backup of the LevelDB GraphStore to the new directory n (requires --admin_token_file)")
+)
+
+// backupMethod is the name of the backup endpoint, as passed to its
+// Authorizer.
+const backupMethod = "/admin/backup"
+
+// backupHandler serves POST /admin/backup?name=n, which writes a backup of
+// the store, as of a snapshot taken when the request arrives, to the new
+// directory n of --backup_root while the store continues to serve calls (see
+// keyvalue.Store.Backup).  Each request must carry a bearer token of
+// --admin_token_file.  Only one backup runs at a time; a backup abandoned by
+// its caller is cancelled and removed.
+type backupHandler struct {
+	store   *keyvalue.Store
+	auth    gsgrpc.Authorizer
+	running chan struct{} // holds a value while a backup runs
+}
+
+// newBackupHandler returns a backupHandler of store authorizing requests by
+// the tokens of --admin_token_file.
+func newBackupHandler(store *keyvalue.Store) (*backupHandler, error) {
+	a, err := gsgrpc.NewTokenAuthorizer(*adminTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	return &backupHandler{store: store, auth: a, running: make(chan struct{}, 1)}, nil
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *backupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, r.Method+" not allowed; use POST", http.StatusMethodNotAllowed)
+		return
+	} else if err := gsgrpc.AuthorizeHTTP(h.auth, r, backupMethod); err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	name := web.Arg(r, "name")
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+		http.Error(w, "invalid backup name: "+name, http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case h.running <- struct{}{}:
+		defer func() { <-h.running }()
+	default:
+		http.Error(w, "a backup is already running", http.StatusConflict)
+		return
+	}
+	dir := filepath.Join(*backupRoot, name)
+	start := time.Now()
+	if err := h.store.Backup(r.Context(), dir); err == keyvalue.ErrUnsupported {
+		http.Error(w, "GraphStore database does not support backups", http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		log.Printf("Error backing up to %q: %v", dir, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Backed up to %q in %v", dir, time.Since(start))
+	if err := web.WriteJSONResponse(w, r, struct {
+		Dir string `json:"dir"`
+	}{dir}); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/proxy"
+	"kythe.io/kythe/go/storage/gsutil"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	backends backendsFlag
+
+	corpusRoutes   = flag.String("corpus_routes", "", `JSON file mapping each corpus to the --backend to which its writes are routed, e.g. {"openjdk": "java"} (reread on SIGHUP)`)
+	defaultBackend = flag.String("default_backend", "", "The --backend to which the writes of corpora without a route are routed; if empty, they fail")
+)
+
+func init() {
+	flag.Var(&backends, "backend", "A name=spec of a GraphStore of which to serve the merged Reads and Scans, routing writes by --corpus_routes (repeatable; excludes --graphstore)")
+}
+
+// A backend is a GraphStore served by the frontend, by name.
+type backend struct{ name, spec string }
+
+// backendsFlag is the repeatable --backend flag.
+type backendsFlag []backend
+
+// String implements part of the flag.Value interface.
+func (f *backendsFlag) String() string {
+	var specs []string
+	for _, b := range *f {
+		specs = append(specs, b.name+"="+b.spec)
+	}
+	return strings.Join(specs, ",")
+}
+
+// Set implements part of the flag.Value interface.
+func (f *backendsFlag) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 || i == len(v)-1 {
+		return fmt.Errorf("invalid backend %q; want name=spec", v)
+	}
+	name := v[:i]
+	for _, b := range *f {
+		if b.name == name {
+			return fmt.Errorf("duplicate backend name %q", name)
+		}
+	}
+	*f = append(*f, backend{name, v[i+1:]})
+	return nil
+}
+
+// A frontend is the routed proxy of the --backend GraphStores.  It implements
+// expvar.Var and http.Handler, reporting the health and traffic of each
+// backend as JSON.
+type frontend struct {
+	proxy   proxy.Dynamic
+	router  *proxy.Router
+	metrics map[string]*graphstore.Metrics
+}
+
+// openFrontend opens each --backend, with its traffic metered, as a member of
+// a routed proxy whose routes are those of --corpus_routes and
+// --default_backend, and publishes its status as the "graphstore_backends"
+// expvar.  Given --corpus_routes, it rereads the file on SIGHUP.
+func openFrontend(ctx context.Context) (*frontend, error) {
+	routes, err := loadRoutes()
+	if err != nil {
+		return nil, err
+	}
+	f := &frontend{
+		router:  proxy.NewRouter(routes, *defaultBackend),
+		metrics: make(map[string]*graphstore.Metrics),
+	}
+	f.proxy = proxy.NewRouted(f.router, proxy.RequireAll, new(proxy.HealthOptions))
+	for _, b := range backends {
+		gs, err := gsutil.Open(ctx, b.spec)
+		if err != nil {
+			f.proxy.Close(ctx)
+			return nil, fmt.Errorf("opening backend %q: %v", b.name, err)
+		}
+		f.metrics[b.name] = graphstore.NewMetrics()
+		if err := f.proxy.AddStore(b.name, graphstore.NewMeteredService(gs, f.metrics[b.name])); err != nil {
+			gs.Close(ctx)
+			f.proxy.Close(ctx)
+			return nil, err
+		}
+	}
+	expvar.Publish("graphstore_backends", f)
+
+	if *corpusRoutes != "" {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		go func() {
+			for range c {
+				routes, err := loadRoutes()
+				if err != nil {
+					log.Printf("Error reloading --corpus_routes (keeping the current routes): %v", err)
+					continue
+				}
+				f.router.SetRoutes(routes, *defaultBackend)
+				log.Printf("Reloaded %d corpus routes", len(routes))
+			}
+		}()
+	}
+	return f, nil
+}
+
+// loadRoutes returns the routes of --corpus_routes, if given, checking that
+// they and --default_backend name backends.
+func loadRoutes() (map[string]string, error) {
+	var routes map[string]string
+	if *corpusRoutes != "" {
+		var err error
+		if routes, err = proxy.LoadRoutes(*corpusRoutes); err != nil {
+			return nil, err
+		}
+	}
+	known := make(map[string]bool)
+	for _, b := range backends {
+		known[b.name] = true
+	}
+	if *defaultBackend != "" && !known[*defaultBackend] {
+		return nil, fmt.Errorf("unknown --default_backend %q", *defaultBackend)
+	}
+	for corpus, name := range routes {
+		if !known[name] {
+			return nil, fmt.Errorf("corpus %q routed to unknown backend %q", corpus, name)
+		}
+	}
+	return routes, nil
+}
+
+// backendStatus is the JSON status of a backend.
+type backendStatus struct {
+	Name      string                              `json:"name"`
+	Spec      string                              `json:"spec"`
+	Healthy   bool                                `json:"healthy"`
+	Unhealthy string                              `json:"unhealthy,omitempty"`
+	InFlight  int                                 `json:"in_flight"`
+	Corpora   []string                            `json:"corpora,omitempty"`
+	Default   bool                                `json:"default,omitempty"`
+	Calls     map[string]graphstore.MethodMetrics `json:"calls"`
+}
+
+// status returns the status of each backend, in the order of --backend.
+func (f *frontend) status() []backendStatus {
+	routes, fallback := f.router.Routes()
+	corpora := make(map[string][]string)
+	for corpus, name := range routes {
+		corpora[name] = append(corpora[name], corpus)
+	}
+	specs := make(map[string]string)
+	for _, b := range backends {
+		specs[b.name] = b.spec
+	}
+
+	var status []backendStatus
+	for _, m := range f.proxy.Members() {
+		s := backendStatus{
+			Name:     m.Name,
+			Spec:     specs[m.Name],
+			Healthy:  m.Unhealthy == nil,
+			InFlight: m.InFlight,
+			Corpora:  corpora[m.Name],
+			Default:  m.Name == fallback,
+			Calls:    f.metrics[m.Name].Snapshot(),
+		}
+		if m.Unhealthy != nil {
+			s.Unhealthy = m.Unhealthy.Error()
+		}
+		sort.Strings(s.Corpora)
+		status = append(status, s)
+	}
+	return status
+}
+
+// String implements the expvar.Var interface.
+func (f *frontend) String() string {
+	rec, err := json.Marshal(f.status())
+	if err != nil {
+		// A backendStatus cannot fail to marshal.
+		panic(err)
+	}
+	return string(rec)
+}
+
+// ServeHTTP implements the http.Handler interface, serving the backends'
+// status.
+func (f *frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec, err := json.MarshalIndent(f.status(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(append(rec, '\n'))
+}
@@ -0,0 +1,471 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Binary graphstore_server serves a GraphStore over gRPC, optionally with TLS
+// and mutual TLS.  Clients open it with a "grpc://host:port" spec, or with a
+// "grpcs://host:port?ca=..." spec if it is serving TLS.  Given a --listen of
+// "unix:///path/to.sock", it serves on that Unix domain socket instead, with
+// the mode of --socket_mode, and local clients open it with a
+// "grpc+unix:///path/to.sock" spec; a stale socket file left there by a server
+// that exited abnormally is removed first.  Given --http_listen,
+// it also serves the GraphStore's HTTP/JSON handlers, which an
+// "http://host:port/graphstore" spec opens, including paged scans by GET
+// /scan, whose page tokens are signed with a key of the process and so do not
+// outlive it.  It serves the standard gRPC health service, reporting
+// NOT_SERVING while the GraphStore is unhealthy and, given --drain_delay, for
+// that long before it stops once interrupted.  It then lets the calls in
+// progress continue for up to --drain_deadline, aborting those that remain
+// with UNAVAILABLE "server draining", before it closes the GraphStore.  Given
+// --reflection, it also serves gRPC server reflection.  Given limits, by flag
+// or by --limits_file, it refuses streaming calls exceeding them with
+// RESOURCE_EXHAUSTED and a retry-after trailer, and reports each peer's usage
+// as the "graphstore_limits" expvar, served at /debug/vars of --http_listen.
+// Given --metrics_addr, it serves Prometheus metrics at /metrics of that
+// address: the counts, codes, and latencies of its GraphStore calls by method,
+// the entries they deliver and bytes they write, the GraphStore's health, and
+// the Go runtime's metrics.  LevelDB GraphStores are opened with the Options of
+// the --leveldb flags (see leveldb.FlagOptions).
+//
+// Given --backup_root, a LevelDB GraphStore may be backed up while it is
+// served: POST /admin/backup?name=n of --http_listen, with a bearer token of
+// --admin_token_file, writes a consistent copy of the open database, as of the
+// request, to the new directory n of --backup_root (see gstool restore).
+//
+// Given --backend flags instead of --graphstore, it serves a frontend of those
+// GraphStores: its Reads and Scans merge theirs, in order and without
+// duplicates, while each Write goes only to the backend to which
+// --corpus_routes routes the corpus of its source, or else to
+// --default_backend; without either, the write fails.  It rereads
+// --corpus_routes on SIGHUP, and reports each backend's health, routes, and
+// calls as the "graphstore_backends" expvar and at /debug/backends of
+// --http_listen.
+//
+// Usage:
+//   graphstore_server --graphstore spec --listen addr [--compression gzip] \
+//     [--tls_cert_file cert.pem --tls_key_file key.pem [--tls_client_ca_file ca.pem]]
+//
+// Example:
+//   graphstore_server --graphstore gs/leveldb --listen localhost:9999 &
+//   zcat entries.gz | write_entries --graphstore grpc://localhost:9999
+//
+// Example:
+//   graphstore_server --graphstore gs/leveldb --listen unix:///run/kythe/gs.sock --socket_mode 0660 &
+//   read_entries --graphstore grpc+unix:///run/kythe/gs.sock
+//
+// Example:
+//   graphstore_server --graphstore gs/leveldb --listen :9999 \
+//     --tls_cert_file server.pem --tls_key_file server.key \
+//     --tls_client_ca_file ca.pem &
+//   read_entries --graphstore 'grpcs://host:9999?ca=ca.pem&cert=client.pem&key=client.key'
+//
+// Example:
+//   graphstore_server --graphstore gs/leveldb --listen :9999 \
+//     --tls_cert_file server.pem --tls_key_file server.key \
+//     --write_token_file tokens &
+//   write_entries --graphstore 'grpcs://host:9999?ca=ca.pem&token_file=token' < entries
+//
+// Example:
+//   graphstore_server --graphstore gs/leveldb --listen :9999 --leveldb_preset serving --leveldb_cache_size 4GiB &
+//
+// Example:
+//   graphstore_server --graphstore gs/leveldb --listen :9999 --compression snappy &
+//   read_entries --graphstore 'grpc://host:9999?compression=snappy'
+//
+// Example:
+//   echo '{"max_streams_per_peer": 4, "entries_per_second_per_peer": 100000}' > limits.json
+//   graphstore_server --graphstore gs/leveldb --listen :9999 --limits_file limits.json \
+//     --http_listen :9998 &
+//   curl http://localhost:9998/debug/vars
+//   kill -HUP %1  # after editing limits.json
+//
+// Example:
+//   graphstore_server --graphstore gs/leveldb --listen :9999 --http_listen :9998 &
+//   curl 'http://localhost:9998/graphstore/scan?fact_prefix=/kythe/node/kind&page_size=100'
+//
+// Example:
+//   graphstore_server --graphstore leveldb:gs/leveldb --listen :9999 --http_listen :9998 \
+//     --tls_cert_file server.pem --tls_key_file server.key \
+//     --admin_token_file admin_tokens --backup_root backups &
+//   curl --cacert ca.pem -X POST -H "Authorization: Bearer $(cat admin_token)" \
+//     'https://localhost:9998/admin/backup?name=today'
+//   gstool restore --backup_dir backups/today --restore_to gs/restored
+//
+// Example:
+//   echo '{"openjdk": "java", "kythe": "go"}' > routes.json
+//   graphstore_server --listen :9999 --http_listen :9998 \
+//     --backend java=grpc://java-gs:9999 --backend go=grpc://go-gs:9999 \
+//     --corpus_routes routes.json --default_backend go &
+//   curl http://localhost:9998/debug/backends
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	gsgrpc "kythe.io/kythe/go/services/graphstore/grpc"
+	gshttp "kythe.io/kythe/go/services/graphstore/http"
+	"kythe.io/kythe/go/services/graphstore/prometheus"
+	"kythe.io/kythe/go/storage/gsflag"
+	"kythe.io/kythe/go/storage/gsutil"
+	"kythe.io/kythe/go/storage/keyvalue"
+	"kythe.io/kythe/go/storage/leveldb"
+	"kythe.io/kythe/go/util/flagutil"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	grpcreflection "google.golang.org/grpc/reflection"
+	spb "kythe.io/kythe/proto/storage_proto"
+)
+
+var (
+	listen = flag.String("listen", "localhost:8080", "Address on which to serve the GraphStore: a host:port, or unix:///path of a Unix domain socket (a stale socket file there is removed)")
+
+	socketMode fileModeFlag
+
+	tlsCertFile     = flag.String("tls_cert_file", "", "PEM file of the server's TLS certificate (enables TLS; requires --tls_key_file)")
+	tlsKeyFile      = flag.String("tls_key_file", "", "PEM file of the private key of --tls_cert_file")
+	tlsClientCAFile = flag.String("tls_client_ca_file", "", "PEM file of the CAs trusted to sign client certificates (enables mutual TLS)")
+
+	writeTokenFile = flag.String("write_token_file", "", "File of the bearer tokens, one per line, of which writes require one (reread when it changes; requires TLS)")
+
+	compression     = flag.String("compression", gsgrpc.NoCompression, "Compression of the server's responses (none, gzip, or snappy); clients compressing their requests must name the same one")
+	maxMessageBytes = flag.Int("max_message_bytes", gsgrpc.DefaultServerMaxMessageBytes, "Maximum size of a request, after decompression")
+
+	reflection    = flag.Bool("reflection", false, "Whether to serve gRPC server reflection, for tools such as grpcurl")
+	drainDelay    = flag.Duration("drain_delay", 0, "Time for which the server reports NOT_SERVING to health checks before it stops, once interrupted, so that load balancers stop sending it calls")
+	drainDeadline = flag.Duration("drain_deadline", 30*time.Second, "Time, after --drain_delay, for which reads, scans, and write streams in progress may continue once the server stops; those remaining are aborted with UNAVAILABLE \"server draining\" (0 waits for them)")
+	healthTimeout = flag.Duration("health_check_timeout", gsgrpc.DefaultHealthCheckTimeout, "Bound on each check of the GraphStore's health by the gRPC health service")
+
+	maxStreams              = flag.Int("max_streams", 0, "Maximum number of concurrent Reads, Scans, and WriteStreams (0 is unlimited)")
+	maxStreamsPerPeer       = flag.Int("max_streams_per_peer", 0, "Maximum number of concurrent Reads, Scans, and WriteStreams of each peer, identified by its bearer token or IP address (0 is unlimited)")
+	entriesPerSecond        = flag.Float64("entries_per_second", 0, "Maximum rate at which the entries of Reads and Scans are sent (0 is unlimited)")
+	entriesPerSecondPerPeer = flag.Float64("entries_per_second_per_peer", 0, "Maximum rate at which the entries of Reads and Scans are sent to each peer (0 is unlimited)")
+	limitsFile              = flag.String("limits_file", "", "JSON file of the limits, overriding the limit flags (reread on SIGHUP)")
+
+	metricsAddr = flag.String("metrics_addr", "", "Address on which to serve Prometheus metrics of the GraphStore's calls, health, and Go runtime at /metrics (without TLS)")
+
+	httpListen = flag.String("http_listen", "", "Address on which to also serve the GraphStore's HTTP/JSON handlers, with the same TLS (read-only if --write_token_file is given)")
+	httpPrefix = flag.String("http_prefix", "/graphstore", "Path prefix of the HTTP/JSON handlers")
+
+	// The --graphstore (or each --backend) is opened once the flags are parsed,
+	// so that the LevelDB options apply regardless of the order of the flags.
+	leveldbOptions = leveldb.FlagOptions("default")
+)
+
+func init() {
+	flag.Var(&socketMode, "socket_mode", "Octal mode of the socket files of unix: addresses, e.g. 0660 so that only their owner and group may connect (by default, as set by the umask)")
+	flag.Usage = flagutil.SimpleUsage("Serve a GraphStore over gRPC",
+		"[--listen addr] [--socket_mode mode] [--reflection] [--max_streams_per_peer n] [--entries_per_second_per_peer n] [--limits_file file] [--metrics_addr addr] [--drain_delay duration] [--drain_deadline duration] [--compression name] [--max_message_bytes n] [--http_listen addr [--http_prefix path]] [--tls_cert_file file --tls_key_file file [--tls_client_ca_file file] [--write_token_file file] [--admin_token_file file [--backup_root dir]]] [--leveldb_preset name] (--graphstore spec | --backend name=spec... [--corpus_routes file] [--default_backend name])")
+}
+
+func main() {
+	log.SetPrefix("graphstore_server: ")
+
+	flag.Parse()
+	if gsflag.Spec() == "" && len(backends) == 0 {
+		flagutil.UsageError("Missing --graphstore")
+	} else if gsflag.Spec() != "" && len(backends) > 0 {
+		flagutil.UsageError("--graphstore and --backend are exclusive")
+	} else if (*corpusRoutes != "" || *defaultBackend != "") && len(backends) == 0 {
+		flagutil.UsageError("--corpus_routes and --default_backend require --backend")
+	} else if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		flagutil.UsageError("--tls_cert_file and --tls_key_file must be given together")
+	} else if *tlsClientCAFile != "" && *tlsCertFile == "" {
+		flagutil.UsageError("--tls_client_ca_file requires --tls_cert_file")
+	} else if *writeTokenFile != "" && *tlsCertFile == "" {
+		flagutil.UsageError("--write_token_file requires --tls_cert_file")
+	} else if *adminTokenFile != "" && *tlsCertFile == "" {
+		flagutil.UsageError("--admin_token_file requires --tls_cert_file")
+	} else if *backupRoot != "" && (*adminTokenFile == "" || *httpListen == "") {
+		flagutil.UsageError("--backup_root requires --admin_token_file and --http_listen")
+	} else if *backupRoot != "" && len(backends) > 0 {
+		flagutil.UsageError("--backup_root requires --graphstore")
+	}
+
+	dbOpts, err := leveldbOptions()
+	if err != nil {
+		flagutil.UsageError(err.Error())
+	}
+	leveldb.DefaultOptions = dbOpts
+
+	opts, err := gsgrpc.ServerCompressionOptions(*compression, *maxMessageBytes)
+	if err != nil {
+		flagutil.UsageError(err.Error())
+	}
+	if *tlsCertFile != "" {
+		creds, err := gsgrpc.ServerCredentials(&gsgrpc.TLSOptions{
+			CertFile: *tlsCertFile,
+			KeyFile:  *tlsKeyFile,
+			CAFile:   *tlsClientCAFile,
+		})
+		if err != nil {
+			log.Fatalf("Error loading TLS credentials: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	if *writeTokenFile != "" {
+		a, err := gsgrpc.NewTokenAuthorizer(*writeTokenFile, gsgrpc.WriteMethods...)
+		if err != nil {
+			log.Fatalf("Error loading --write_token_file: %v", err)
+		}
+		opts = append(opts, gsgrpc.AuthServerOptions(a)...)
+	}
+
+	ctx := context.Background()
+	var (
+		gs    graphstore.Service
+		front *frontend
+		spec  = gsflag.Spec()
+	)
+	if len(backends) > 0 {
+		spec = backends.String()
+		front, err = openFrontend(ctx)
+		if err != nil {
+			log.Fatalf("Error opening backends: %v", err)
+		}
+		gs = front.proxy
+	} else if gs, err = gsflag.Open(ctx); err != nil {
+		log.Fatalf("Error opening GraphStore %q: %v", spec, err)
+	}
+	defer gsutil.LogClose(ctx, gs)
+
+	// Backups are taken of the open database, so that they need not wait for
+	// the server to stop.
+	var backup *backupHandler
+	if *backupRoot != "" {
+		store, ok := gs.(*keyvalue.Store)
+		if !ok {
+			log.Fatalf("GraphStore %T does not support backups", gs)
+		}
+		if backup, err = newBackupHandler(store); err != nil {
+			log.Fatalf("Error loading --admin_token_file: %v", err)
+		}
+	}
+
+	// Health checks go to the unmetered GraphStore; the calls it serves are
+	// metered, if --metrics_addr is given.
+	served := gs
+	if *metricsAddr != "" {
+		exporter := prometheus.NewExporter(&prometheus.Options{
+			Health:        gs,
+			HealthTimeout: *healthTimeout,
+		})
+		if err := serveMetrics(exporter); err != nil {
+			log.Fatalf("Error serving metrics: %v", err)
+		}
+		served = graphstore.NewMeteredService(gs, exporter)
+	}
+
+	l, err := gsgrpc.Listen(*listen, os.FileMode(socketMode))
+	if err != nil {
+		log.Fatal(err)
+	}
+	limiter, err := newLimiter()
+	if err != nil {
+		log.Fatalf("Error loading limits: %v", err)
+	}
+
+	s := grpc.NewServer(opts...)
+	drainer := gsgrpc.NewDrainer()
+	spb.RegisterGraphStoreServer(s, gsgrpc.NewServer(served, &gsgrpc.ServerOptions{
+		Limiter: limiter,
+		Drainer: drainer,
+	}))
+	health := gsgrpc.NewHealthServer(gs, *healthTimeout)
+	healthpb.RegisterHealthServer(s, health)
+	if *reflection {
+		grpcreflection.Register(s)
+	}
+
+	if *httpListen != "" {
+		if err := serveHTTP(served, front, backup); err != nil {
+			log.Fatalf("Error serving HTTP: %v", err)
+		}
+	}
+
+	// Stop serving when interrupted, once load balancers have seen the server
+	// go NOT_SERVING, and close the GraphStore only once the calls in progress
+	// have ended or been aborted.
+	stopped := gsutil.SignalContext(ctx)
+	drained := make(chan struct{})
+	go func() {
+		<-stopped.Done()
+		gsgrpc.DrainStop(s, health, drainer, *drainDelay, *drainDeadline)
+		close(drained)
+	}()
+
+	log.Printf("Serving GraphStore %q on %s", spec, l.Addr())
+	if err := s.Serve(l); err != nil && stopped.Err() == nil {
+		log.Printf("Error serving: %v", err)
+	}
+	if stopped.Err() != nil {
+		<-drained
+	}
+}
+
+// fileModeFlag is an octal file permission mode flag.
+type fileModeFlag os.FileMode
+
+// String implements part of the flag.Value interface.
+func (m *fileModeFlag) String() string { return fmt.Sprintf("%#o", uint32(*m)) }
+
+// Set implements part of the flag.Value interface.
+func (m *fileModeFlag) Set(v string) error {
+	n, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || os.FileMode(n)&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid file mode %q", v)
+	}
+	*m = fileModeFlag(n)
+	return nil
+}
+
+// newLimiter returns a Limiter enforcing the limits of the flags or of
+// --limits_file, publishing its usage as the "graphstore_limits" expvar, or nil
+// if no limit is given.  Given --limits_file, it rereads the file on SIGHUP.
+func newLimiter() (*gsgrpc.Limiter, error) {
+	limits := gsgrpc.Limits{
+		MaxStreams:              *maxStreams,
+		MaxStreamsPerPeer:       *maxStreamsPerPeer,
+		EntriesPerSecond:        *entriesPerSecond,
+		EntriesPerSecondPerPeer: *entriesPerSecondPerPeer,
+	}
+	if *limitsFile != "" {
+		var err error
+		if limits, err = gsgrpc.LoadLimits(*limitsFile); err != nil {
+			return nil, err
+		}
+	} else if limits == (gsgrpc.Limits{}) {
+		return nil, nil
+	}
+	l := gsgrpc.NewLimiter(limits)
+	expvar.Publish("graphstore_limits", l)
+
+	if *limitsFile != "" {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		go func() {
+			for range c {
+				limits, err := gsgrpc.LoadLimits(*limitsFile)
+				if err != nil {
+					log.Printf("Error reloading limits (keeping %+v): %v", l.Limits(), err)
+					continue
+				}
+				l.SetLimits(limits)
+				log.Printf("Reloaded limits: %+v", limits)
+			}
+		}()
+	}
+	return l, nil
+}
+
+// serveMetrics starts serving the metrics of exporter at /metrics of
+// --metrics_addr.
+func serveMetrics(exporter *prometheus.Exporter) error {
+	l, err := gsgrpc.Listen(*metricsAddr, os.FileMode(socketMode))
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	log.Printf("Serving metrics on %s/metrics", l.Addr())
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("Error serving metrics: %v", err)
+		}
+	}()
+	return nil
+}
+
+// serveHTTP starts serving the HTTP/JSON handlers of gs on --http_listen, with
+// the TLS of the gRPC server.  The tokens of --write_token_file apply only to
+// gRPC calls, so the handlers do not allow writes if it is given.  The page
+// tokens of GET /scan are signed with a random key.  If front is non-nil, its
+// status is served at /debug/backends, and if backup is non-nil, it serves
+// /admin/backup.
+func serveHTTP(gs graphstore.Service, front *frontend, backup *backupHandler) error {
+	if *writeTokenFile != "" {
+		gs = graphstore.ReadOnly(gs)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("generating page token key: %v", err)
+	}
+	mux := http.NewServeMux()
+	gshttp.RegisterHTTPHandlersWithOptions(gs, *httpPrefix, mux, &gshttp.HandlerOptions{PageTokenKey: key})
+	mux.Handle("/debug/vars", expvar.Handler())
+	if front != nil {
+		mux.Handle("/debug/backends", front)
+	}
+	if backup != nil {
+		mux.Handle(backupMethod, backup)
+	}
+
+	l, err := gsgrpc.Listen(*httpListen, os.FileMode(socketMode))
+	if err != nil {
+		return err
+	}
+	if *tlsCertFile != "" {
+		cfg, err := httpTLSConfig()
+		if err != nil {
+			return err
+		}
+		l = tls.NewListener(l, cfg)
+	}
+	log.Printf("Serving GraphStore HTTP handlers on %s%s", l.Addr(), *httpPrefix)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("Error serving HTTP: %v", err)
+		}
+	}()
+	return nil
+}
+
+// httpTLSConfig returns the TLS configuration of the HTTP server, which
+// requires client certificates as the gRPC server does.
+func httpTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if *tlsClientCAFile != "" {
+		pem, err := ioutil.ReadFile(*tlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%q holds no PEM certificates", *tlsClientCAFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
@@ -0,0 +1,582 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Binary gstool performs maintenance operations on GraphStores.
+//
+// Usage:
+//   gstool copy --from spec --to spec [--workers n] [--corpora c1,c2] [--edge_kinds k1,k2] [--fact_prefix str] [--resume token]
+//   gstool diff --from spec --to spec [--dump]
+//   gstool gc --from spec --build_versions v1,v2 [--prune_dangling_edges] [--prune_all_dangling_edges] [--batch_size n] [--resume token]
+//   gstool collisions --from spec [--fold_case] [--dump]
+//   gstool compact --from spec [--corpora c1,c2]
+//   gstool reindex_targets --from spec
+//   gstool backup --from spec --backup_dir dir
+//   gstool restore --backup_dir dir --restore_to path
+//   gstool migrate_keys --migrate_path path
+//   gstool delete_corpora --from spec --corpora c1,c2
+//   gstool reshard --reshard_from dir1,dir2 --reshard_to dir1,dir2,dir3 [--workers n]
+//
+// Example:
+//   gstool copy --from gs/old --to leveldb:gs/new --workers 8
+//   gstool diff --from gs/before --to gs/after --dump
+//   gstool gc --from gs/leveldb --build_versions 2016-05-01,2016-05-02 --prune_dangling_edges
+//   gstool collisions --from gs/leveldb --fold_case --dump
+//   gstool compact --from leveldb:gs/leveldb --corpora kythe
+//   gstool reindex_targets --from leveldb:gs/leveldb
+//   gstool backup --from leveldb:gs/leveldb --backup_dir backups/today
+//   gstool restore --backup_dir backups/today --restore_to gs/restored
+//   gstool migrate_keys --migrate_path gs/leveldb
+//   gstool delete_corpora --from leveldb:gs/leveldb --corpora old_corpus
+//   gstool reshard --reshard_from gs/0,gs/1 --reshard_to gs2/0,gs2/1,gs2/2,gs2/3 --workers 2
+//
+// The collisions operation reports how many source VNames of a GraphStore
+// would be merged by normalizing their paths (see compare.NormalizeVName),
+// which should be checked before writing to the store through
+// graphstore.Normalized.
+//
+// The compact operation compacts the storage of a LevelDB GraphStore (or only
+// that of the given corpora, if its keys are prefixed by corpus; see
+// migrate_keys), reclaiming the space of deleted entries, and prints the
+// database's statistics before and after.
+//
+// The reindex_targets operation builds (or rebuilds) the index of a LevelDB
+// GraphStore's edges by their targets, which is then maintained by each write
+// to the GraphStore.  The index speeds Scans for the edges into a node.
+//
+// The backup operation writes a consistent copy of a LevelDB GraphStore, as of
+// when it starts, to a new directory.  LevelDB allows a database to be open in
+// only one process, so a GraphStore being served is instead backed up by the
+// /admin/backup endpoint of its graphstore_server (see --backup_root).  The
+// restore operation checks a backup against the checksums recorded when it was
+// written and restores it to a new LevelDB database.
+//
+// The migrate_keys operation rewrites the entry keys of a LevelDB GraphStore,
+// which must not be in use, so that they are prefixed by their sources'
+// corpora (see keyvalue.MigrateKeys).  An interrupted migration leaves the
+// database with keys in both layouts, which is refused when opened until the
+// migration is finished by running migrate_keys again.  The delete_corpora
+// operation removes every entry of the given corpora from a migrated LevelDB
+// GraphStore, reading only the corpora's own keys, and reports the
+// approximate size of each before it is removed.
+//
+// The reshard operation copies a sharded LevelDB GraphStore (see shardedlevel),
+// which must not be in use, to a new sharded GraphStore with a different number
+// of databases (see shardedlevel.Reshard).  The new databases' directories must
+// not exist or be empty.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	"kythe.io/kythe/go/storage/gsutil"
+	"kythe.io/kythe/go/storage/keyvalue"
+	"kythe.io/kythe/go/storage/leveldb"
+	"kythe.io/kythe/go/storage/shardedlevel"
+	"kythe.io/kythe/go/util/datasize"
+	"kythe.io/kythe/go/util/flagutil"
+	"kythe.io/kythe/go/util/kytheuri"
+
+	"golang.org/x/net/context"
+
+	spb "kythe.io/kythe/proto/storage_proto"
+
+	_ "kythe.io/kythe/go/services/graphstore/grpc"
+	_ "kythe.io/kythe/go/services/graphstore/proxy"
+	_ "kythe.io/kythe/go/storage/badger"
+	_ "kythe.io/kythe/go/storage/bigtable"
+	_ "kythe.io/kythe/go/storage/bolt"
+	_ "kythe.io/kythe/go/storage/postgres"
+	_ "kythe.io/kythe/go/storage/redis"
+	_ "kythe.io/kythe/go/storage/servingtable"
+	_ "kythe.io/kythe/go/storage/sortedfiles"
+	_ "kythe.io/kythe/go/storage/sqlite"
+)
+
+var (
+	from, to graphstore.Service
+
+	workers    = flag.Int("workers", 1, "Number of shards of a sharded --from GraphStore to copy (or reshard) concurrently")
+	corpora    = flag.String("corpora", "", "Comma-separated list of corpora to copy or compact (default: all)")
+	edgeKinds  = flag.String("edge_kinds", "", `Comma-separated list of edge kinds to copy, with "" for node facts (default: all)`)
+	factPrefix = flag.String("fact_prefix", "", "Only copy entries whose fact name has the given prefix")
+	resume     = flag.String("resume", "", "Resume token logged by an interrupted copy or gc")
+	interval   = flag.Duration("progress_interval", 10*time.Second, "Period between progress reports")
+
+	dump     = flag.Bool("dump", false, "Print each differing entry found by diff (or each set of colliding sources found by collisions)")
+	foldCase = flag.Bool("fold_case", false, "Lowercase VName paths and roots when checking collisions")
+
+	buildVersions         = flag.String("build_versions", "", "Comma-separated list of build versions kept by gc; sources with another "+buildVersionFact+" fact are removed")
+	pruneDanglingEdges    = flag.Bool("prune_dangling_edges", false, "Also remove each edge targeting a source removed by gc")
+	pruneAllDanglingEdges = flag.Bool("prune_all_dangling_edges", false, "Also remove every edge in the store whose target has no entries after gc")
+	batchSize             = flag.Int("batch_size", graphstore.DefaultGCBatchSize, "Maximum number of sources removed by gc after each scan")
+
+	backupDir = flag.String("backup_dir", "", "New directory written by backup (or the backup read by restore)")
+	restoreTo = flag.String("restore_to", "", "Path of the new LevelDB database written by restore")
+
+	migratePath = flag.String("migrate_path", "", "Path of the LevelDB database whose keys are rewritten by migrate_keys")
+
+	reshardFrom = flag.String("reshard_from", "", "Comma-separated list of the database directories of the sharded LevelDB GraphStore copied by reshard")
+	reshardTo   = flag.String("reshard_to", "", "Comma-separated list of the database directories of the new sharded LevelDB GraphStore written by reshard")
+)
+
+// buildVersionFact is the node fact recording the indexing run that produced
+// each source.
+const buildVersionFact = "/kythe/build/version"
+
+func init() {
+	gsutil.Flag(&from, "from", "GraphStore from which to copy (or the old GraphStore for diff, or the GraphStore to collect for gc or check for collisions)")
+	gsutil.Flag(&to, "to", "GraphStore to which to copy (or the new GraphStore for diff)")
+	flag.Usage = flagutil.SimpleUsage("Perform an operation on a GraphStore",
+		"copy --from spec --to spec [--workers n] [--corpora list] [--edge_kinds list] [--fact_prefix str] [--resume token]",
+		"diff --from spec --to spec [--dump]",
+		"gc --from spec --build_versions list [--prune_dangling_edges] [--prune_all_dangling_edges] [--batch_size n] [--resume token]",
+		"collisions --from spec [--fold_case] [--dump]",
+		"compact --from spec [--corpora list]",
+		"reindex_targets --from spec",
+		"backup --from spec --backup_dir dir",
+		"restore --backup_dir dir --restore_to path",
+		"migrate_keys --migrate_path path",
+		"delete_corpora --from spec --corpora list",
+		"reshard --reshard_from list --reshard_to list [--workers n]")
+}
+
+func main() {
+	log.SetPrefix("gstool: ")
+	flag.Parse()
+	if len(flag.Args()) == 0 {
+		flagutil.UsageError("missing operation")
+	}
+
+	op := flag.Arg(0)
+	// Allow the operation's flags to follow its name.
+	if err := flag.CommandLine.Parse(flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if op == "restore" {
+		if *backupDir == "" {
+			flagutil.UsageError("missing --backup_dir")
+		} else if *restoreTo == "" {
+			flagutil.UsageError("missing --restore_to")
+		}
+		restoreBackup()
+		return
+	} else if op == "migrate_keys" {
+		if *migratePath == "" {
+			flagutil.UsageError("missing --migrate_path")
+		}
+		migrateKeys()
+		return
+	} else if op == "reshard" {
+		if *reshardFrom == "" {
+			flagutil.UsageError("missing --reshard_from")
+		} else if *reshardTo == "" {
+			flagutil.UsageError("missing --reshard_to")
+		}
+		reshardStore()
+		return
+	}
+	if from == nil {
+		flagutil.UsageError("missing --from")
+	} else if to == nil && op != "gc" && op != "collisions" && op != "compact" && op != "reindex_targets" && op != "backup" && op != "delete_corpora" {
+		flagutil.UsageError("missing --to")
+	}
+
+	switch op {
+	case "copy":
+		copyStore()
+	case "diff":
+		diffStores()
+	case "gc":
+		if *buildVersions == "" {
+			flagutil.UsageError("missing --build_versions")
+		}
+		collectGarbage()
+	case "collisions":
+		findCollisions()
+	case "compact":
+		compactStore()
+	case "reindex_targets":
+		reindexTargets()
+	case "backup":
+		if *backupDir == "" {
+			flagutil.UsageError("missing --backup_dir")
+		}
+		backupStore()
+	case "delete_corpora":
+		if *corpora == "" {
+			flagutil.UsageError("missing --corpora")
+		}
+		deleteCorpora()
+	default:
+		flagutil.UsageErrorf("unknown operation: %q", op)
+	}
+}
+
+func copyStore() {
+	var interrupted bool
+	defer func() {
+		if interrupted {
+			os.Exit(1)
+		}
+	}()
+
+	ctx := context.Background()
+	defer gsutil.LogClose(ctx, from)
+	defer gsutil.LogClose(ctx, to)
+	ctx = gsutil.SignalContext(ctx)
+
+	var last *graphstore.CopyProgress
+	err := graphstore.Copy(ctx, to, from, &graphstore.CopyOptions{
+		Corpora:          splitList(*corpora),
+		EdgeKinds:        splitList(*edgeKinds),
+		FactPrefix:       *factPrefix,
+		Workers:          *workers,
+		ResumeToken:      *resume,
+		ProgressInterval: *interval,
+		Progress: func(p *graphstore.CopyProgress) {
+			last = p
+			msg := "Copied %d entries (%s of facts) in %v: %.1f entries/sec"
+			args := []interface{}{p.Entries, datasize.Size(p.Bytes), p.Elapsed, p.EntriesPerSec}
+			if p.ETA > 0 {
+				msg += "; ETA %v"
+				args = append(args, p.ETA)
+			}
+			log.Printf(msg, args...)
+		},
+	})
+	if err != nil {
+		log.Printf("Copy stopped early: %v", err)
+		if last != nil && last.ResumeToken != "" {
+			log.Printf("Resume with --resume=%s", last.ResumeToken)
+		}
+		interrupted = true
+	}
+}
+
+func collectGarbage() {
+	var interrupted bool
+	defer func() {
+		if interrupted {
+			os.Exit(1)
+		}
+	}()
+
+	ctx := context.Background()
+	defer gsutil.LogClose(ctx, from)
+	ctx = gsutil.SignalContext(ctx)
+
+	keep := make(map[string]bool)
+	for _, v := range splitList(*buildVersions) {
+		keep[v] = true
+	}
+	var last *graphstore.GCProgress
+	removed, err := graphstore.CollectGarbage(ctx, from, func(_ *spb.VName, facts map[string][]byte) bool {
+		v, ok := facts[buildVersionFact]
+		return !ok || keep[string(v)]
+	}, &graphstore.GCOptions{
+		BatchSize:             *batchSize,
+		PruneDanglingEdges:    *pruneDanglingEdges,
+		PruneAllDanglingEdges: *pruneAllDanglingEdges,
+		ResumeToken:           *resume,
+		Progress: func(p *graphstore.GCProgress) {
+			last = p
+			log.Printf("Removed %d entries (%d sources and %d dangling edges)", p.Removed, p.Sources, p.Edges)
+		},
+	})
+	if err != nil {
+		log.Printf("Garbage collection stopped early after removing %d entries: %v", removed, err)
+		if last != nil {
+			log.Printf("Resume with --resume=%s", last.ResumeToken)
+		}
+		interrupted = true
+		return
+	}
+	log.Printf("Removed %d entries", removed)
+}
+
+func findCollisions() {
+	ctx := context.Background()
+	defer gsutil.LogClose(ctx, from)
+	ctx = gsutil.SignalContext(ctx)
+
+	var f func(*spb.VName, []*spb.VName) error
+	if *dump {
+		f = func(norm *spb.VName, srcs []*spb.VName) error {
+			fmt.Println(kytheuri.FromVName(norm))
+			for _, src := range srcs {
+				fmt.Printf("  %s\n", kytheuri.FromVName(src))
+			}
+			return nil
+		}
+	}
+	report, err := graphstore.NormalizationCollisions(ctx, from, compare.NormalizeOptions{FoldCase: *foldCase}, f)
+	if err != nil {
+		log.Fatalf("Collision check error: %v", err)
+	}
+	fmt.Printf("%d sources (%d changed by normalization); %d would be merged into %d\n",
+		report.Sources, report.Changed, report.Colliding, report.Groups)
+}
+
+func compactStore() {
+	ctx := context.Background()
+	defer gsutil.LogClose(ctx, from)
+
+	store, ok := from.(*keyvalue.Store)
+	if !ok {
+		log.Fatalf("GraphStore %T does not support compaction", from)
+	}
+	printDBStats(ctx, store, "Before compaction")
+	start := time.Now()
+	if cs := splitList(*corpora); len(cs) > 0 {
+		for _, corpus := range cs {
+			log.Printf("Compacting corpus %q", corpus)
+			if err := store.CompactCorpus(ctx, corpus); err == keyvalue.ErrUnsupported {
+				log.Fatalf("GraphStore does not support compacting corpora; its keys must be prefixed by corpus (see gstool migrate_keys)")
+			} else if err != nil {
+				log.Fatalf("Compaction error: %v", err)
+			}
+		}
+	} else if err := store.Compact(ctx, nil); err != nil {
+		log.Fatalf("Compaction error: %v", err)
+	}
+	log.Printf("Compacted in %v", time.Since(start))
+	printDBStats(ctx, store, "After compaction")
+}
+
+func reindexTargets() {
+	ctx := context.Background()
+	defer gsutil.LogClose(ctx, from)
+	ctx = gsutil.SignalContext(ctx)
+
+	store, ok := from.(*keyvalue.Store)
+	if !ok {
+		log.Fatalf("GraphStore %T does not support a target index", from)
+	}
+	start := time.Now()
+	last := start
+	var final keyvalue.ReindexProgress
+	if err := store.ReindexTargets(ctx, func(p *keyvalue.ReindexProgress) {
+		final = *p
+		if time.Since(last) < *interval {
+			return
+		}
+		last = time.Now()
+		log.Printf("Scanned %d entries (indexed %d edges) in %v", p.Entries, p.Edges, time.Since(start))
+	}); err != nil {
+		log.Fatalf("Indexing error: %v", err)
+	}
+	log.Printf("Indexed %d edges of %d entries in %v", final.Edges, final.Entries, time.Since(start))
+}
+
+func backupStore() {
+	ctx := context.Background()
+	defer gsutil.LogClose(ctx, from)
+	ctx = gsutil.SignalContext(ctx)
+
+	store, ok := from.(*keyvalue.Store)
+	if !ok {
+		log.Fatalf("GraphStore %T does not support backups", from)
+	}
+	start := time.Now()
+	if err := store.Backup(ctx, *backupDir); err == keyvalue.ErrUnsupported {
+		log.Fatalf("GraphStore database does not support backups")
+	} else if err != nil {
+		log.Fatalf("Backup error: %v", err)
+	}
+	log.Printf("Backed up to %q in %v", *backupDir, time.Since(start))
+}
+
+func restoreBackup() {
+	ctx := gsutil.SignalContext(context.Background())
+	start := time.Now()
+	if err := leveldb.Restore(ctx, *backupDir, *restoreTo); err != nil {
+		log.Fatalf("Restore error: %v", err)
+	}
+	log.Printf("Restored %q to %q in %v", *backupDir, *restoreTo, time.Since(start))
+}
+
+func migrateKeys() {
+	ctx := gsutil.SignalContext(context.Background())
+	opts := leveldb.BulkLoadOptions()
+	opts.MustExist = true
+	db, err := leveldb.Open(*migratePath, opts)
+	if err != nil {
+		log.Fatalf("Error opening %q: %v", *migratePath, err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			log.Printf("Error closing %q: %v", *migratePath, err)
+		}
+	}()
+
+	start := time.Now()
+	last := start
+	var final keyvalue.MigrateProgress
+	if err := keyvalue.MigrateKeys(ctx, db, func(p *keyvalue.MigrateProgress) {
+		final = *p
+		if time.Since(last) < *interval {
+			return
+		}
+		last = time.Now()
+		log.Printf("Migrated %d entries in %v", p.Entries, time.Since(start))
+	}); err != nil {
+		log.Fatalf("Migration error (rerun migrate_keys to finish): %v", err)
+	}
+	log.Printf("Migrated %d entries of %q in %v", final.Entries, *migratePath, time.Since(start))
+}
+
+func reshardStore() {
+	ctx := gsutil.SignalContext(context.Background())
+	src, dst := splitList(*reshardFrom), splitList(*reshardTo)
+	start := time.Now()
+	var final graphstore.CopyProgress
+	if err := shardedlevel.Reshard(ctx, src, dst, &shardedlevel.ReshardOptions{
+		Copy: &graphstore.CopyOptions{
+			Workers:          *workers,
+			ProgressInterval: *interval,
+			Progress: func(p *graphstore.CopyProgress) {
+				final = *p
+				log.Printf("Copied %d entries (%s of facts) in %v: %.1f entries/sec",
+					p.Entries, datasize.Size(p.Bytes), p.Elapsed, p.EntriesPerSec)
+			},
+		},
+	}); err != nil {
+		log.Fatalf("Reshard error: %v", err)
+	}
+	log.Printf("Resharded %d entries from %d to %d databases in %v", final.Entries, len(src), len(dst), time.Since(start))
+}
+
+func deleteCorpora() {
+	ctx := context.Background()
+	defer gsutil.LogClose(ctx, from)
+	ctx = gsutil.SignalContext(ctx)
+
+	store, ok := from.(*keyvalue.Store)
+	if !ok {
+		log.Fatalf("GraphStore %T does not support deleting corpora", from)
+	}
+	start := time.Now()
+	for _, corpus := range splitList(*corpora) {
+		if size, err := store.CorpusSize(ctx, corpus); err == keyvalue.ErrUnsupported {
+			log.Fatalf("GraphStore keys are not prefixed by corpus; migrate them with gstool migrate_keys")
+		} else if err == nil {
+			log.Printf("Deleting corpus %q (about %s)", corpus, datasize.Size(size))
+		} else if err == graphstore.ErrDiskSizeUnknown {
+			log.Printf("Deleting corpus %q", corpus)
+		} else {
+			log.Fatalf("Error sizing corpus %q: %v", corpus, err)
+		}
+		if err := store.DeleteCorpus(ctx, corpus); err != nil {
+			log.Fatalf("Error deleting corpus %q: %v", corpus, err)
+		}
+	}
+	log.Printf("Deleted %d corpora in %v", len(splitList(*corpora)), time.Since(start))
+}
+
+// printDBStats prints the statistics of store's database under the given
+// heading.
+func printDBStats(ctx context.Context, store *keyvalue.Store, heading string) {
+	stats, err := store.DBStats(ctx)
+	if err == keyvalue.ErrUnsupported {
+		fmt.Printf("%s: no statistics available\n", heading)
+		return
+	} else if err != nil {
+		log.Fatalf("Error reading database statistics: %v", err)
+	}
+	fmt.Printf("%s:\n", heading)
+	fmt.Printf("  %5s %7s %10s %12s %12s %12s\n", "Level", "Files", "Size", "Time", "Read", "Written")
+	for _, l := range stats.Levels {
+		fmt.Printf("  %5d %7d %10s %12v %12s %12s\n", l.Level, l.Files, datasize.Size(l.Bytes),
+			l.CompactionTime, datasize.Size(l.CompactionReadBytes), datasize.Size(l.CompactionWriteBytes))
+	}
+	fmt.Printf("  Read amplification: %.1f; write amplification: %.1f\n", stats.ReadAmplification, stats.WriteAmplification)
+}
+
+func diffStores() {
+	var differ bool
+	defer func() {
+		if differ {
+			os.Exit(1)
+		}
+	}()
+
+	ctx := context.Background()
+	defer gsutil.LogClose(ctx, from)
+	defer gsutil.LogClose(ctx, to)
+
+	counts := make(map[graphstore.DiffKind]int)
+	if err := graphstore.Diff(ctx, from, to, func(d graphstore.DiffEntry) error {
+		counts[d.Kind]++
+		if !*dump {
+			return nil
+		}
+		switch d.Kind {
+		case graphstore.OnlyInA:
+			fmt.Printf("- %s\n", entryString(d.A))
+		case graphstore.OnlyInB:
+			fmt.Printf("+ %s\n", entryString(d.B))
+		case graphstore.ValueChanged:
+			fmt.Printf("~ %s: %q -> %q\n", entryKeyString(d.A), d.A.FactValue, d.B.FactValue)
+		}
+		return nil
+	}); err != nil {
+		log.Fatalf("Diff error: %v", err)
+	}
+
+	fmt.Printf("%d entries only in --from, %d entries only in --to, %d entries with changed values\n",
+		counts[graphstore.OnlyInA], counts[graphstore.OnlyInB], counts[graphstore.ValueChanged])
+	// Exit with a failure status if the stores differ, as diff(1) does.
+	differ = len(counts) > 0
+}
+
+// entryKeyString returns a readable representation of e's key.
+func entryKeyString(e *spb.Entry) string {
+	src := kytheuri.FromVName(e.Source).String()
+	if e.EdgeKind == "" {
+		return fmt.Sprintf("%s %s", src, e.FactName)
+	}
+	return fmt.Sprintf("%s %s %s %s", src, e.EdgeKind, kytheuri.FromVName(e.Target), e.FactName)
+}
+
+// entryString returns a readable representation of e.
+func entryString(e *spb.Entry) string {
+	if len(e.FactValue) == 0 {
+		return entryKeyString(e)
+	}
+	return fmt.Sprintf("%s %q", entryKeyString(e), e.FactValue)
+}
+
+// splitList returns the comma-separated values in s, or nil if s is empty.  A
+// value of `""` denotes the empty string.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	vals := strings.Split(s, ",")
+	for i, v := range vals {
+		if v == `""` {
+			vals[i] = ""
+		}
+	}
+	return vals
+}
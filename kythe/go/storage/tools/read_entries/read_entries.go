@@ -19,71 +19,152 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"sync"
+	"text/tabwriter"
 
 	"kythe.io/kythe/go/platform/delimited"
 	"kythe.io/kythe/go/platform/vfs"
 	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/entryfn"
+	"kythe.io/kythe/go/storage/gsflag"
 	"kythe.io/kythe/go/storage/gsutil"
+	"kythe.io/kythe/go/util/datasize"
 	"kythe.io/kythe/go/util/flagutil"
 	"kythe.io/kythe/go/util/kytheuri"
 
 	"golang.org/x/net/context"
 
 	spb "kythe.io/kythe/proto/storage_proto"
-
-	_ "kythe.io/kythe/go/services/graphstore/grpc"
-	_ "kythe.io/kythe/go/services/graphstore/proxy"
-	_ "kythe.io/kythe/go/storage/leveldb"
 )
 
 var (
 	gs graphstore.Service
 
 	count = flag.Bool("count", false, "Only print the number of entries scanned")
+	stats = flag.Bool("stats", false, "Only print summary statistics for the GraphStore (with --count, only the number of entries and disk size); --shards sets the number of shards read concurrently")
+
+	profile        = flag.Bool("profile", false, "Only print a breakdown of the GraphStore's size by corpus, fact name, edge kind, and largest source")
+	profileJSON    = flag.Bool("profile_json", false, "Print the --profile report as JSON rather than tables")
+	topSources     = flag.Int("top_sources", graphstore.DefaultProfileTopSources, "Number of largest sources reported by --profile")
+	profileMaxKeys = flag.Int("profile_max_keys", graphstore.DefaultProfileMaxKeys, "Maximum number of distinct corpora, fact names, and edge kinds each reported separately by --profile")
 
 	shardsToFiles = flag.String("sharded_file", "", "If given, scan the entire GraphStore, storing each shard in a separate file instead of stdout (requires --shards)")
 	shardIndex    = flag.Int64("shard_index", 0, "Index of a single shard to emit (requires --shards)")
 	shards        = flag.Int64("shards", 0, "Number of shards to split the GraphStore")
+	recount       = flag.Bool("recount", false, "Rebuild the GraphStore's persisted count of each of the --shards by scanning it (needed once for existing GraphStores), so that later counts need not scan")
 
 	edgeKind     = flag.String("edge_kind", "", "Edge kind by which to filter a read/scan")
 	targetTicket = flag.String("target", "", "Ticket of target by which to filter a scan")
 	factPrefix   = flag.String("fact_prefix", "", "Fact prefix by which to filter a scan")
+
+	nodeKind = flag.String("node_kind", "", "If given, emit every fact of each node with the given /kythe/node/kind (or only the node kind facts with --count)")
+	subkind  = flag.String("subkind", "", "Subkind by which to filter the nodes emitted by --node_kind")
 )
 
 func init() {
-	gsutil.Flag(&gs, "graphstore", "GraphStore to read")
 	flag.Usage = flagutil.SimpleUsage("Scans/reads the entries from a GraphStore, emitting a delimited entry stream to stdout",
-		"--graphstore spec [--count] [--shards N [--shard_index I] --sharded_file path] [--edge_kind] ([--fact_prefix str] [--target ticket] | [ticket...])")
+		"--graphstore spec [--count] [--stats] [--profile [--profile_json]] [--shards N [--shard_index I] --sharded_file path | --recount] ([--edge_kind] ([--fact_prefix str] [--target ticket] | [ticket...]) | --node_kind kind [--subkind kind])")
 }
 
 func main() {
 	flag.Parse()
-	if gs == nil {
+	if gsflag.Spec() == "" {
 		flagutil.UsageError("missing --graphstore")
 	} else if *shardsToFiles != "" && *shards <= 0 {
 		flagutil.UsageError("--sharded_file and --shards must be given together")
 	} else if *shards > 0 && len(flag.Args()) > 0 {
 		flagutil.UsageError("--shards and giving tickets for reads are mutually exclusive")
+	} else if *stats && (len(flag.Args()) > 0 || *shardsToFiles != "") {
+		flagutil.UsageError("--stats cannot be combined with tickets or --sharded_file")
+	} else if *nodeKind != "" && (len(flag.Args()) > 0 || *shards > 0 || *stats || *edgeKind != "" || *targetTicket != "" || *factPrefix != "") {
+		flagutil.UsageError("--node_kind cannot be combined with tickets, --shards, --stats, --edge_kind, --target, or --fact_prefix")
+	} else if *subkind != "" && *nodeKind == "" {
+		flagutil.UsageError("--subkind requires --node_kind")
+	} else if *profile && (len(flag.Args()) > 0 || *shards > 0 || *stats || *count || *nodeKind != "") {
+		flagutil.UsageError("--profile cannot be combined with tickets, --shards, --stats, --count, or --node_kind")
+	} else if *profileJSON && !*profile {
+		flagutil.UsageError("--profile_json requires --profile")
+	} else if *recount && *shards <= 0 {
+		flagutil.UsageError("--recount requires --shards")
 	}
 
 	ctx := context.Background()
+	var err error
+	if gs, err = gsflag.Open(ctx); err != nil {
+		log.Fatalf("Error opening GraphStore %q: %v", gsflag.Spec(), err)
+	}
+	defer gsutil.LogClose(ctx, gs)
+
+	if *recount {
+		r, ok := gs.(graphstore.Recounter)
+		if !ok {
+			log.Fatalf("--recount unsupported for given GraphStore type: %T", gs)
+		} else if err := r.Recount(ctx, *shards); err != nil {
+			log.Fatalf("GraphStore recount error: %v", err)
+		}
+	}
+
+	if ss, ok := gs.(graphstore.Snapshotter); ok {
+		// Read from a consistent view of the GraphStore in case it is being
+		// concurrently written.
+		snap, err := ss.Snapshot()
+		if err != nil {
+			log.Fatalf("GraphStore snapshot error: %v", err)
+		}
+		defer gsutil.LogClose(ctx, snap)
+		gs = snap
+	}
+
+	if *stats {
+		st, err := graphstore.Stats(ctx, gs, &graphstore.StatsOptions{
+			EntriesOnly: *count,
+			Workers:     int(*shards),
+		})
+		if err != nil {
+			log.Fatalf("GraphStore stats error: %v", err)
+		}
+		printStats(st)
+		return
+	} else if *profile {
+		p, err := graphstore.NewProfile(ctx, gs, &graphstore.ProfileOptions{
+			TopSources: *topSources,
+			MaxKeys:    *profileMaxKeys,
+		})
+		if err != nil {
+			log.Fatalf("GraphStore profile error: %v", err)
+		}
+		if *profileJSON {
+			if err := json.NewEncoder(os.Stdout).Encode(p); err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			printProfile(p)
+		}
+		return
+	}
 
 	wr := delimited.NewWriter(os.Stdout)
-	var total int64
 	if *shards <= 0 {
-		entryFunc := func(entry *spb.Entry) error {
-			if *count {
-				total++
-				return nil
-			}
-			return wr.PutProto(entry)
+		var counter *entryfn.Counting
+		entryFunc := func(entry *spb.Entry) error { return wr.PutProto(entry) }
+		if *count {
+			counter = entryfn.Counter(nil)
+			entryFunc = counter.Entry
 		}
-		if len(flag.Args()) > 0 {
+		if *nodeKind != "" {
+			if err := graphstore.ScanNodesOfKind(ctx, gs, *nodeKind, &graphstore.NodeKindOptions{
+				Subkind:  *subkind,
+				AllFacts: !*count,
+			}, entryFunc); err != nil {
+				log.Fatalf("GraphStore node scan error: %v", err)
+			}
+		} else if len(flag.Args()) > 0 {
 			if *targetTicket != "" || *factPrefix != "" {
 				log.Fatal("--target and --fact_prefix are unsupported when given tickets")
 			}
@@ -95,8 +176,8 @@ func main() {
 				log.Fatal(err)
 			}
 		}
-		if *count {
-			fmt.Println(total)
+		if counter != nil {
+			fmt.Println(counter.Count())
 		}
 		return
 	}
@@ -152,6 +233,73 @@ func main() {
 	}
 }
 
+func printStats(st *graphstore.StoreStats) {
+	fmt.Printf("Entries:    %d\n", st.Entries)
+	if st.DiskBytes > 0 {
+		fmt.Printf("Disk size:  %s\n", datasize.Size(st.DiskBytes))
+	}
+	if *count {
+		return
+	}
+	fmt.Printf("Sources:    ~%d\n", st.Sources)
+	fmt.Printf("Fact bytes: %s\n", datasize.Size(st.FactBytes))
+
+	corpora := make([]string, 0, len(st.Corpora))
+	for corpus := range st.Corpora {
+		corpora = append(corpora, corpus)
+	}
+	sort.Strings(corpora)
+	for _, corpus := range corpora {
+		fmt.Printf("Corpus %q: %d entries\n", corpus, st.Corpora[corpus])
+	}
+}
+
+func printProfile(p *graphstore.Profile) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	row := func(name string, st graphstore.ProfileStats) {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t\n", name, st.Entries, datasize.Size(st.Bytes), datasize.Size(st.FactBytes))
+	}
+	table := func(title string, m map[string]*graphstore.ProfileStats) {
+		fmt.Fprintf(w, "\n%s\tEntries\tBytes\tFact bytes\t\n", title)
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Sort(byBytes{keys, m})
+		for _, k := range keys {
+			row(fmt.Sprintf("%q", k), *m[k])
+		}
+	}
+
+	fmt.Fprint(w, "\tEntries\tBytes\tFact bytes\t\n")
+	row("Total", p.Total)
+	table("Corpus", p.Corpora)
+	table("Fact name", p.FactNames)
+	table("Edge kind", p.EdgeKinds)
+	fmt.Fprint(w, "\nSource\tEntries\tBytes\tFact bytes\t\n")
+	for _, s := range p.TopSources {
+		row(kytheuri.FromVName(s.Source).String(), s.ProfileStats)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if p.Truncated {
+		fmt.Printf("\nSome keys are aggregated under %q (see --profile_max_keys)\n", graphstore.ProfileOtherKey)
+	}
+}
+
+// byBytes sorts keys by the descending size of their ProfileStats.
+type byBytes struct {
+	keys  []string
+	stats map[string]*graphstore.ProfileStats
+}
+
+func (s byBytes) Len() int      { return len(s.keys) }
+func (s byBytes) Swap(i, j int) { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+func (s byBytes) Less(i, j int) bool {
+	return s.stats[s.keys[i]].Bytes > s.stats[s.keys[j]].Bytes
+}
+
 func readEntries(ctx context.Context, gs graphstore.Service, entryFunc graphstore.EntryFunc, edgeKind string, tickets []string) error {
 	for _, ticket := range tickets {
 		src, err := kytheuri.ToVName(ticket)
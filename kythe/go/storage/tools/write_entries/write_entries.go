@@ -28,41 +28,79 @@
 //
 // Example:
 //   zcat entries.gz | write_entries --graphstore gs/leveldb
+//
+// Example:
+//   zcat entries.gz | write_entries --graphstore sqlite:///tmp/gs.db
+//
+// Example:
+//   zcat entries.gz | write_entries --leveldb_preset bulk_load --graphstore gs/leveldb
+//
+// Example:
+//   zcat entries.gz | write_entries --unordered --dedup --graphstore gs/leveldb
+//
+// Example:
+//   zcat entries.gz | write_entries --remote_upload --graphstore http://host:8080/graphstore
 package main
 
 import (
 	"flag"
 	"log"
+	"net/url"
 	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 
 	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/compare"
+	gshttp "kythe.io/kythe/go/services/graphstore/http"
+	"kythe.io/kythe/go/services/graphstore/proxy"
+	"kythe.io/kythe/go/storage/gsflag"
 	"kythe.io/kythe/go/storage/gsutil"
+	"kythe.io/kythe/go/storage/leveldb"
 	"kythe.io/kythe/go/storage/stream"
+	"kythe.io/kythe/go/util/datasize"
 	"kythe.io/kythe/go/util/flagutil"
+	"kythe.io/kythe/go/util/kytheuri"
 	"kythe.io/kythe/go/util/profile"
 
 	"golang.org/x/net/context"
 
 	spb "kythe.io/kythe/proto/storage_proto"
-
-	_ "kythe.io/kythe/go/services/graphstore/grpc"
-	_ "kythe.io/kythe/go/services/graphstore/proxy"
-	_ "kythe.io/kythe/go/storage/leveldb"
 )
 
 var (
 	batchSize  = flag.Int("batch_size", 1024, "Maximum entries per write for consecutive entries with the same source")
+	batchBytes = datasize.Flag("batch_bytes", "3MiB", "Approximate maximum size of each write (0 for no limit); larger entries are written alone")
 	numWorkers = flag.Int("workers", 1, "Number of concurrent workers writing to the GraphStore")
+	replace    = flag.Bool("replace", false, "Delete all existing entries for each source before writing its new entries (requires a GraphStore supporting deletion)")
+	dedup      = flag.Bool("dedup", false, "Drop consecutive duplicate entries for each source before writing (with --unordered, every duplicate entry)")
+	ifAbsent   = flag.Bool("if_absent", false, "Skip entries whose key already exists in the GraphStore rather than overwriting their values")
+	validate   = flag.Bool("validate", false, "Skip entries that are structurally invalid for the Kythe schema, reporting the number of violations of each rule")
+
+	unordered        = flag.Bool("unordered", false, "Batch a stream whose entries are not grouped by source, keeping a write open for each of the --unordered_sources most recent sources; with --dedup, every duplicate entry is dropped (--batch_bytes does not apply)")
+	unorderedSources = flag.Int("unordered_sources", 256, "Maximum number of sources with an open write (requires --unordered)")
+	dedupMemory      = datasize.Flag("dedup_memory", "1GiB", "Approximate memory budget of the entry hashes kept by --unordered --dedup, beyond which they are spilled to --temp_dir")
+	tempDir          = flag.String("temp_dir", "", "Directory for the entry hashes spilled by --unordered --dedup (default: the system temporary directory)")
+
+	reportStats = flag.Bool("report_stats", false, "Report the number of entries inserted, updated, and left unchanged (requires a GraphStore reporting write statistics; each write first reads the existing entries)")
+	storeStats  = flag.Bool("store_stats", false, "Once written, report the total number of entries in the GraphStore and its approximate disk size (scanning the GraphStore unless it is sharded)")
+
+	maxWriteQPS       = flag.Float64("max_write_qps", 0, "Maximum number of writes per second (0 for no limit)")
+	maxWriteBandwidth = datasize.Flag("max_write_bandwidth", "0", "Maximum size of writes per second (0 for no limit)")
+
+	remoteUpload = flag.Bool("remote_upload", false, "Stream stdin, gzip encoded, to the upload handler of the --graphstore (an http or https spec), which batches and writes it itself; supports --batch_size, --batch_bytes, --dedup, and --validate")
+
+	// The --graphstore (see gsflag) is opened once the flags are parsed, so
+	// that the LevelDB options apply regardless of the order of the flags.
+	leveldbOptions = leveldb.FlagOptions("default")
 
 	gs graphstore.Service
 )
 
 func init() {
 	flag.Usage = flagutil.SimpleUsage("Write a delimited stream of entries from stdin to a GraphStore",
-		"[--batch_size entries] [--workers n] --graphstore spec")
-	gsutil.Flag(&gs, "graphstore", "GraphStore to which to write the entry stream")
+		"[--batch_size entries] [--batch_bytes size] [--workers n] [--dedup] [--unordered [--unordered_sources n] [--dedup_memory size] [--temp_dir dir]] [--replace] [--if_absent] [--validate] [--report_stats] [--store_stats] [--max_write_qps n] [--max_write_bandwidth size] [--leveldb_preset name] [--remote_upload] --graphstore spec")
 }
 
 func main() {
@@ -73,52 +111,340 @@ func main() {
 		flagutil.UsageErrorf("Invalid number of --workers %d (must be ≥ 1)", *numWorkers)
 	} else if *batchSize < 1 {
 		flagutil.UsageErrorf("Invalid --batch_size %d (must be ≥ 1)", *batchSize)
-	} else if gs == nil {
+	} else if gsflag.Spec() == "" {
 		flagutil.UsageError("Missing --graphstore")
+	} else if *replace && *ifAbsent {
+		flagutil.UsageError("--replace and --if_absent are mutually exclusive")
+	} else if *unorderedSources < 1 {
+		flagutil.UsageErrorf("Invalid --unordered_sources %d (must be ≥ 1)", *unorderedSources)
+	} else if *maxWriteQPS < 0 {
+		flagutil.UsageErrorf("Invalid --max_write_qps %v (must be ≥ 0)", *maxWriteQPS)
+	} else if *remoteUpload && (*replace || *ifAbsent || *reportStats || *storeStats || *unordered || *maxWriteQPS > 0 || maxWriteBandwidth.Bytes() > 0) {
+		flagutil.UsageError("--remote_upload does not support --replace, --if_absent, --report_stats, --store_stats, --unordered, --max_write_qps, or --max_write_bandwidth")
 	}
 
-	ctx := context.Background()
+	if *remoteUpload {
+		uploadEntries()
+		return
+	}
+
+	opts, err := leveldbOptions()
+	if err != nil {
+		flagutil.UsageError(err.Error())
+	}
+	leveldb.DefaultOptions = opts
+	if gs, err = gsflag.Open(context.Background()); err != nil {
+		log.Fatalf("Error opening GraphStore %q: %v", gsflag.Spec(), err)
+	}
+
+	var interrupted bool
+	defer func() {
+		if interrupted {
+			os.Exit(1)
+		}
+	}()
 
+	ctx := context.Background()
 	defer gsutil.LogClose(ctx, gs)
-	gsutil.EnsureGracefulExit(gs)
+
+	// Stop writing when interrupted, but still close the GraphStore cleanly.
+	ctx = gsutil.SignalContext(ctx)
 
 	if err := profile.Start(ctx); err != nil {
 		log.Fatal(err)
 	}
 	defer profile.Stop()
 
-	writes := graphstore.BatchWrites(stream.ReadEntries(os.Stdin), *batchSize)
+	// The stages feeding the workers stop once the workers are done, so that
+	// none is left blocked sending to a worker that has stopped early.
+	feed, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var (
+		writes   <-chan *spb.WriteRequest
+		batchErr <-chan error
+	)
+	if *unordered {
+		var set *compare.EntrySet
+		if *dedup {
+			set = compare.NewEntrySet(compare.EntrySetOptions{
+				MaxBytes: int(dedupMemory.Bytes()),
+				WorkDir:  *tempDir,
+			})
+			defer func() {
+				if err := set.Finish(); err != nil {
+					log.Printf("Error removing temporary files: %v", err)
+				}
+			}()
+		}
+		writes, batchErr = graphstore.BatchWritesUnordered(feed, stream.ReadEntries(os.Stdin), *batchSize, *unorderedSources, set)
+	} else {
+		writes, batchErr = graphstore.BatchWritesContext(feed, stream.ReadEntries(os.Stdin), &graphstore.BatchOptions{
+			MaxUpdates: *batchSize,
+			MaxBytes:   int(batchBytes.Bytes()),
+			Dedup:      *dedup,
+		})
+	}
+	var validator *graphstore.ValidatingWriter
+	if *validate {
+		validator = graphstore.NewValidatingWriter(gs, true)
+		writes = validateWrites(feed, validator, writes)
+	}
+	if *replace {
+		d, ok := gs.(graphstore.Deleter)
+		if !ok {
+			log.Fatalf("--replace unsupported for given GraphStore type: %T", gs)
+		}
+		writes = replaceSources(feed, d, writes)
+	}
+	if *maxWriteQPS > 0 || maxWriteBandwidth.Bytes() > 0 {
+		writes = throttleWrites(feed, graphstore.NewThrottledService(gs, graphstore.Throttle{
+			WritesPerSec: *maxWriteQPS,
+			BytesPerSec:  float64(maxWriteBandwidth.Bytes()),
+		}), writes)
+	}
 
 	var (
 		wg         sync.WaitGroup
 		numEntries uint64
+
+		statsMu sync.Mutex
+		stats   *graphstore.WriteStats
 	)
+	var write func(context.Context, *spb.WriteRequest) (*graphstore.WriteStats, error)
+	if *ifAbsent {
+		opts := &graphstore.WriteOptions{IfAbsent: true}
+		write = func(ctx context.Context, req *spb.WriteRequest) (*graphstore.WriteStats, error) {
+			return graphstore.WriteWithOptions(ctx, gs, req, opts)
+		}
+	} else if *reportStats {
+		sw, ok := gs.(graphstore.StatsWriter)
+		if !ok {
+			log.Fatalf("--report_stats unsupported for given GraphStore type: %T", gs)
+		}
+		write = sw.WriteWithStats
+	}
+	hasStats := write != nil
+	if hasStats {
+		stats = new(graphstore.WriteStats)
+	}
 	wg.Add(*numWorkers)
 	for i := 0; i < *numWorkers; i++ {
 		go func() {
 			defer wg.Done()
-			num, err := writeEntries(ctx, gs, writes)
-			if err != nil {
+			var (
+				num uint64
+				ws  *graphstore.WriteStats
+				err error
+			)
+			if hasStats {
+				num, ws, err = writeEntriesWithStats(ctx, write, writes)
+			} else {
+				num, err = writeEntries(ctx, gs, writes)
+			}
+			if err != nil && ctx.Err() == nil {
 				log.Fatal(err)
 			}
-
 			atomic.AddUint64(&numEntries, num)
+			if ws != nil {
+				statsMu.Lock()
+				stats.Add(ws)
+				statsMu.Unlock()
+			}
 		}()
 	}
 	wg.Wait()
+	stop()
+	if err := <-batchErr; err != nil {
+		log.Printf("Stopped writing early: %v", err)
+		interrupted = true
+	}
 
 	log.Printf("Wrote %d entries", numEntries)
+	if stats != nil {
+		log.Printf("Inserted %d entries, updated %d entries, and left %d entries unchanged",
+			stats.Inserted, stats.Updated, stats.Unchanged)
+		if *ifAbsent {
+			log.Printf("Skipped %d entries with existing keys", stats.Skipped)
+		}
+	}
+	if validator != nil {
+		logViolations(validator.Violations())
+	}
+	if *storeStats && !interrupted {
+		logStoreStats(ctx, gs)
+	}
+}
+
+// logStoreStats logs the total number of entries in gs and its disk size.
+func logStoreStats(ctx context.Context, gs graphstore.Service) {
+	st, err := graphstore.Stats(ctx, gs, &graphstore.StatsOptions{EntriesOnly: true})
+	if err != nil {
+		log.Printf("Error reading GraphStore stats: %v", err)
+		return
+	}
+	log.Printf("GraphStore holds %d entries", st.Entries)
+	if st.DiskBytes > 0 {
+		log.Printf("GraphStore disk size: %s", datasize.Size(st.DiskBytes))
+	}
+}
+
+// uploadEntries streams os.Stdin to the upload handler of the --graphstore.
+func uploadEntries() {
+	if u, err := url.Parse(gsflag.Spec()); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		flagutil.UsageErrorf("--remote_upload requires an http or https --graphstore, not %q", gsflag.Spec())
+	}
+	maxBytes := int(batchBytes.Bytes())
+	if maxBytes == 0 {
+		maxBytes = -1 // no limit
+	}
+	ctx := gsutil.SignalContext(context.Background())
+	s, err := gshttp.Upload(ctx, gsflag.Spec(), nil, os.Stdin, &gshttp.UploadOptions{
+		Validate:   *validate,
+		Dedup:      *dedup,
+		BatchSize:  *batchSize,
+		BatchBytes: maxBytes,
+		Gzip:       true,
+	})
+	if s != nil {
+		log.Printf("Uploaded %d entries; the server wrote %d entries", s.Received, s.Written)
+		if *validate {
+			logViolations(s.Violations)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// validateWrites forwards each WriteRequest in reqs to the returned channel
+// after removing its invalid updates, as determined by v, until ctx is done.
+func validateWrites(ctx context.Context, v *graphstore.ValidatingWriter, reqs <-chan *spb.WriteRequest) <-chan *spb.WriteRequest {
+	ch := make(chan *spb.WriteRequest)
+	go func() {
+		defer close(ch)
+		for req := range reqs {
+			req, err := v.Validate(req)
+			if err != nil {
+				log.Fatalf("Error validating entries: %v", err)
+			} else if len(req.Update) == 0 {
+				continue
+			}
+			select {
+			case ch <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func logViolations(violations map[graphstore.ValidationRule]int64) {
+	if len(violations) == 0 {
+		log.Println("Found no invalid entries")
+		return
+	}
+	rules := make([]string, 0, len(violations))
+	for rule := range violations {
+		rules = append(rules, string(rule))
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		log.Printf("Skipped %d invalid entries (%s)", violations[graphstore.ValidationRule(rule)], rule)
+	}
+}
+
+// throttleWrites forwards each WriteRequest in reqs to the returned channel
+// once it is allowed by the write budget of t.
+func throttleWrites(ctx context.Context, t *graphstore.ThrottledService, reqs <-chan *spb.WriteRequest) <-chan *spb.WriteRequest {
+	ch := make(chan *spb.WriteRequest)
+	go func() {
+		defer close(ch)
+		for req := range reqs {
+			if err := t.WaitWrite(ctx, req); err != nil {
+				return
+			}
+			select {
+			case ch <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// replaceSources deletes the existing entries of each source in reqs (once per
+// source) before forwarding its WriteRequests to the returned channel.
+func replaceSources(ctx context.Context, d graphstore.Deleter, reqs <-chan *spb.WriteRequest) <-chan *spb.WriteRequest {
+	ch := make(chan *spb.WriteRequest)
+	go func() {
+		defer close(ch)
+		deleted := make(map[string]bool)
+		for req := range reqs {
+			src := kytheuri.FromVName(req.Source).String()
+			if !deleted[src] {
+				if err := d.Delete(ctx, &graphstore.DeleteRequest{Source: req.Source}); err != nil && ctx.Err() != nil {
+					return
+				} else if err != nil {
+					log.Fatalf("Error deleting entries for %q: %v", src, err)
+				}
+				deleted[src] = true
+			}
+			select {
+			case ch <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// logPartialWrite logs which stores of a proxy GraphStore may be missing the
+// entries of req, if err reports that it was only written to some of them.
+// Those stores can be repaired by rewriting the source's entries from one of
+// the others.
+func logPartialWrite(req *spb.WriteRequest, err error) {
+	werr, ok := err.(*proxy.WriteError)
+	if !ok {
+		return
+	}
+	src := kytheuri.FromVName(req.Source).String()
+	log.Printf("Partial write of %q: written to %d of %d stores", src, len(werr.Succeeded), len(werr.Succeeded)+len(werr.Failed))
+	for _, f := range werr.Failed {
+		log.Printf("Store %q may be missing entries of %q: %v", f.Name, src, f.Err)
+	}
 }
 
 func writeEntries(ctx context.Context, s graphstore.Service, reqs <-chan *spb.WriteRequest) (uint64, error) {
 	var num uint64
 
 	for req := range reqs {
-		num += uint64(len(req.Update))
 		if err := s.Write(ctx, req); err != nil {
-			return 0, err
+			logPartialWrite(req, err)
+			return num, err
 		}
+		num += uint64(len(req.Update))
 	}
 
 	return num, nil
 }
+
+func writeEntriesWithStats(ctx context.Context, write func(context.Context, *spb.WriteRequest) (*graphstore.WriteStats, error), reqs <-chan *spb.WriteRequest) (uint64, *graphstore.WriteStats, error) {
+	var num uint64
+	stats := new(graphstore.WriteStats)
+
+	for req := range reqs {
+		ws, err := write(ctx, req)
+		if err != nil {
+			logPartialWrite(req, err)
+			return num, stats, err
+		}
+		num += uint64(len(req.Update))
+		stats.Add(ws)
+	}
+
+	return num, stats, nil
+}
@@ -21,7 +21,6 @@ package xrefs
 import (
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"regexp"
 	"sort"
@@ -29,6 +28,7 @@ import (
 	"time"
 
 	"kythe.io/kythe/go/services/graphstore"
+	"kythe.io/kythe/go/services/graphstore/entryfn"
 	"kythe.io/kythe/go/services/xrefs"
 	"kythe.io/kythe/go/util/encoding/text"
 	"kythe.io/kythe/go/util/kytheuri"
@@ -46,13 +46,10 @@ import (
 // GraphStore.  This is necessary for a GraphStoreService to work properly.
 func EnsureReverseEdges(ctx context.Context, gs graphstore.Service) error {
 	var edge *spb.Entry
-	if err := gs.Scan(ctx, &spb.ScanRequest{}, func(e *spb.Entry) error {
-		if graphstore.IsEdge(e) {
-			edge = e
-			return io.EOF
-		}
+	if err := gs.Scan(ctx, &spb.ScanRequest{}, entryfn.Filter(graphstore.IsEdge, entryfn.Limit(1, func(e *spb.Entry) error {
+		edge = e
 		return nil
-	}); err != nil {
+	}))); err != nil {
 		return err
 	}
 
@@ -19,8 +19,15 @@
 package graphstore
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"kythe.io/kythe/go/services/graphstore"
 	"kythe.io/kythe/go/services/graphstore/compare"
@@ -78,6 +85,131 @@ func BatchWriteBenchmark(b *testing.B, create CreateFunc, batchSize int) {
 	}
 }
 
+// ReadFactsBenchmark benchmarks reading the given fact prefixes of a node with
+// a large text fact using graphstore.ReadFacts.  The total size of the facts
+// read by each operation is logged.
+func ReadFactsBenchmark(b *testing.B, create CreateFunc, factPrefixes []string) {
+	b.StopTimer()
+	gs, destroy, err := create()
+	testutil.FatalOnErr(b, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErr(b, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErr(b, "DestroyFunc error: %v", destroy())
+	}()
+
+	src := &spb.VName{Signature: "file", Path: "some/file.go"}
+	testutil.FatalOnErr(b, "write error: %v", gs.Write(ctx, &spb.WriteRequest{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("file")},
+			{FactName: "/kythe/text", FactValue: make([]byte, 1<<20)},
+			{FactName: "/kythe/text/encoding", FactValue: []byte("utf-8")},
+		},
+	}))
+
+	var size int
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		size = 0
+		testutil.FatalOnErr(b, "ReadFacts error: %v", graphstore.ReadFacts(ctx, gs, src, factPrefixes, func(e *spb.Entry) error {
+			size += len(e.FactName) + len(e.FactValue)
+			return nil
+		}))
+	}
+	b.StopTimer()
+	b.Logf("Read %d bytes of facts per operation", size)
+}
+
+// ShardedScanBenchmark benchmarks reading every entry of a Service created by
+// the given CreateFunc.  If workers > 0, the entries are read with
+// graphstore.ParallelShards using that many workers, requiring the Service to
+// be graphstore.Sharded; otherwise, a sequential Scan is used.
+func ShardedScanBenchmark(b *testing.B, create CreateFunc, workers int) {
+	b.StopTimer()
+	gs, destroy, err := create()
+	testutil.FatalOnErr(b, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErr(b, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErr(b, "DestroyFunc error: %v", destroy())
+	}()
+
+	const numSources = 10000
+	for i := 0; i < numSources; i++ {
+		testutil.FatalOnErr(b, "write error: %v", gs.Write(ctx, &spb.WriteRequest{
+			Source: &spb.VName{Signature: fmt.Sprintf("sig%d", i), Corpus: "corpus"},
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+				{FactName: "/kythe/text", FactValue: make([]byte, 64)},
+			},
+		}))
+	}
+
+	var read func(graphstore.EntryFunc) error
+	if workers > 0 {
+		s, ok := gs.(graphstore.Sharded)
+		if !ok {
+			b.Fatalf("%T does not implement graphstore.Sharded", gs)
+		}
+		read = func(f graphstore.EntryFunc) error { return graphstore.ParallelShards(ctx, s, workers, f) }
+	} else {
+		read = func(f graphstore.EntryFunc) error { return gs.Scan(ctx, new(spb.ScanRequest), f) }
+	}
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		var num int
+		testutil.FatalOnErr(b, "read error: %v", read(func(*spb.Entry) error {
+			num++
+			return nil
+		}))
+		if num != 2*numSources {
+			b.Fatalf("Read %d entries; expected %d", num, 2*numSources)
+		}
+	}
+}
+
+// ZipfReadBenchmark benchmarks Reads of random nodes with a Zipfian
+// distribution from the CreateFunc created graphstore.Service, optionally
+// wrapped by the given function (e.g. to add a cache).
+func ZipfReadBenchmark(b *testing.B, create CreateFunc, wrap func(graphstore.Service) graphstore.Service) {
+	b.StopTimer()
+	gs, destroy, err := create()
+	testutil.FatalOnErr(b, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErr(b, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErr(b, "DestroyFunc error: %v", destroy())
+	}()
+
+	const numSources = 10000
+	for i := 0; i < numSources; i++ {
+		testutil.FatalOnErr(b, "write error: %v", gs.Write(ctx, &spb.WriteRequest{
+			Source: &spb.VName{Signature: fmt.Sprintf("sig%d", i), Corpus: "corpus"},
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+				{FactName: "/kythe/text", FactValue: make([]byte, 64)},
+			},
+		}))
+	}
+	if wrap != nil {
+		gs = wrap(gs)
+	}
+
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 1, numSources-1)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		var num int
+		testutil.FatalOnErr(b, "read error: %v", gs.Read(ctx, &spb.ReadRequest{
+			Source: &spb.VName{Signature: fmt.Sprintf("sig%d", zipf.Uint64()), Corpus: "corpus"},
+		}, func(*spb.Entry) error {
+			num++
+			return nil
+		}))
+		if num != 2 {
+			b.Fatalf("Read %d entries; expected 2", num)
+		}
+	}
+}
+
 // OrderTest tests the ordering of the streamed entries while reading from the
 // CreateFunc created graphstore.Service.
 func OrderTest(t *testing.T, create CreateFunc, batchSize int) {
@@ -114,6 +246,1140 @@ func OrderTest(t *testing.T, create CreateFunc, batchSize int) {
 		}))
 }
 
+// DeleteTest tests the Delete method of the CreateFunc created
+// graphstore.Service, which must implement graphstore.Deleter.
+func DeleteTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	d, ok := gs.(graphstore.Deleter)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.Deleter", gs)
+	}
+
+	src := &spb.VName{Signature: "src"}
+	other := &spb.VName{Signature: "other"}
+	target := &spb.VName{Signature: "target"}
+	for _, req := range []*spb.WriteRequest{{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+			{FactName: "/kythe/text", FactValue: []byte("text")},
+			{EdgeKind: "/kythe/edge/childof", Target: target, FactName: "/"},
+			{EdgeKind: "/kythe/edge/ref", Target: target, FactName: "/"},
+			{EdgeKind: "/kythe/edge/ref", Target: other, FactName: "/"},
+		},
+	}, {
+		Source: other,
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+		},
+	}} {
+		testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, req))
+	}
+
+	count := func(src *spb.VName) (n int) {
+		testutil.FatalOnErrT(t, "read error: %v", gs.Read(ctx, &spb.ReadRequest{
+			Source:   src,
+			EdgeKind: "*",
+		}, func(*spb.Entry) error { n++; return nil }))
+		return
+	}
+
+	tests := []struct {
+		req  *graphstore.DeleteRequest
+		want int // entries remaining for src
+	}{
+		{&graphstore.DeleteRequest{Source: &spb.VName{Signature: "missing"}}, 5},
+		{&graphstore.DeleteRequest{Source: src, FactName: "/kythe/text"}, 4},
+		{&graphstore.DeleteRequest{Source: src, EdgeKind: "/kythe/edge/ref", Target: other}, 3},
+		{&graphstore.DeleteRequest{Source: src, EdgeKind: "/kythe/edge/ref"}, 2},
+		{&graphstore.DeleteRequest{Source: src}, 0},
+		{&graphstore.DeleteRequest{Source: src}, 0},
+	}
+	for _, test := range tests {
+		testutil.FatalOnErrT(t, "delete error: %v", d.Delete(ctx, test.req))
+		if got := count(src); got != test.want {
+			t.Errorf("After Delete(%+v): found %d entries; want %d", test.req, got, test.want)
+		}
+	}
+	if got := count(other); got != 1 {
+		t.Errorf("Unrelated source has %d entries after Delete; want 1", got)
+	}
+}
+
+// GarbageCollectionTest tests graphstore.CollectGarbage against the CreateFunc
+// created graphstore.Service, which must implement graphstore.Deleter, by
+// removing sources by their build version fact in batches of a single source,
+// interrupting and resuming the collection, and then pruning the edges
+// targeting the removed sources and every other dangling edge.
+func GarbageCollectionTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+
+	node := func(sig, version string, edges ...string) *spb.WriteRequest {
+		req := &spb.WriteRequest{
+			Source: &spb.VName{Signature: sig},
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+				{FactName: "/kythe/build/version", FactValue: []byte(version)},
+			},
+		}
+		for _, tgt := range edges {
+			req.Update = append(req.Update, &spb.WriteRequest_Update{
+				EdgeKind: "/kythe/edge/ref",
+				Target:   &spb.VName{Signature: tgt},
+				FactName: "/",
+			})
+		}
+		return req
+	}
+	for _, req := range []*spb.WriteRequest{
+		node("a", "1", "b"),
+		node("b", "2", "a"),
+		node("c", "1"),
+		node("d", "2", "c", "missing"),
+		node("e", "1"),
+	} {
+		testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, req))
+	}
+	sources := func() map[string]int {
+		found := make(map[string]int)
+		testutil.FatalOnErrT(t, "scan error: %v", gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+			found[e.Source.Signature]++
+			return nil
+		}))
+		return found
+	}
+	keepVersion := func(_ *spb.VName, facts map[string][]byte) bool {
+		return string(facts["/kythe/build/version"]) == "2"
+	}
+
+	// Interrupt the collection after its first batch.
+	cctx, cancel := context.WithCancel(ctx)
+	var token string
+	removed, err := graphstore.CollectGarbage(cctx, gs, keepVersion, &graphstore.GCOptions{
+		BatchSize: 1,
+		Progress: func(p *graphstore.GCProgress) {
+			token = p.ResumeToken
+			cancel()
+		},
+	})
+	if err == nil {
+		t.Fatal("Cancelled CollectGarbage succeeded; expected an error")
+	} else if removed != 3 {
+		t.Errorf("Interrupted CollectGarbage removed %d entries; want 3", removed)
+	}
+
+	resumed, err := graphstore.CollectGarbage(ctx, gs, keepVersion, &graphstore.GCOptions{
+		BatchSize:   1,
+		ResumeToken: token,
+	})
+	testutil.FatalOnErrT(t, "CollectGarbage error: %v", err)
+	if resumed != 4 {
+		t.Errorf("Resumed CollectGarbage removed %d entries; want 4", resumed)
+	}
+	if found := sources(); len(found) != 2 || found["b"] != 3 || found["d"] != 4 {
+		t.Errorf("Found entries for sources %v after collection; want map[b:3 d:4]", found)
+	}
+
+	// Only the edge targeting the newly removed source is pruned; the edges
+	// targeting sources removed earlier (or never written) are kept.
+	for _, req := range []*spb.WriteRequest{
+		node("f", "1"),
+		node("g", "2", "f"),
+	} {
+		testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, req))
+	}
+	var last *graphstore.GCProgress
+	removed, err = graphstore.CollectGarbage(ctx, gs, keepVersion, &graphstore.GCOptions{
+		PruneDanglingEdges: true,
+		Progress:           func(p *graphstore.GCProgress) { last = p },
+	})
+	testutil.FatalOnErrT(t, "CollectGarbage error: %v", err)
+	if removed != 3 || last == nil || last.Sources != 1 || last.Edges != 1 {
+		t.Errorf("Pruning CollectGarbage removed %d entries with final progress %+v; want 1 source and 1 edge", removed, last)
+	}
+	if found := sources(); len(found) != 3 || found["b"] != 3 || found["d"] != 4 || found["g"] != 2 {
+		t.Errorf("Found entries for sources %v after pruning; want map[b:3 d:4 g:2]", found)
+	}
+
+	last = nil
+	removed, err = graphstore.CollectGarbage(ctx, gs, keepVersion, &graphstore.GCOptions{
+		PruneAllDanglingEdges: true,
+		Progress:              func(p *graphstore.GCProgress) { last = p },
+	})
+	testutil.FatalOnErrT(t, "CollectGarbage error: %v", err)
+	if removed != 3 || last == nil || last.Sources != 0 || last.Edges != 3 {
+		t.Errorf("Pruning CollectGarbage removed %d entries with final progress %+v; want 3 dangling edges", removed, last)
+	}
+	if found := sources(); len(found) != 3 || found["b"] != 2 || found["d"] != 2 || found["g"] != 2 {
+		t.Errorf("Found entries for sources %v after pruning all; want map[b:2 d:2 g:2]", found)
+	}
+
+	if _, err := graphstore.CollectGarbage(ctx, gs, keepVersion, &graphstore.GCOptions{ResumeToken: "invalid"}); err == nil {
+		t.Error("CollectGarbage succeeded with an invalid resume token")
+	}
+}
+
+// CASTest tests the CompareAndSwap method of the CreateFunc created
+// graphstore.Service, which must implement graphstore.CAS, including its
+// atomicity as concurrent callers increment a shared counter fact.
+func CASTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	c, ok := gs.(graphstore.CAS)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.CAS", gs)
+	}
+
+	src := &spb.VName{Signature: "counter"}
+	const fact = "/count"
+	tests := []struct {
+		old, new []byte
+		want     bool
+	}{
+		{[]byte("0"), []byte("1"), false}, // the fact does not exist
+		{nil, []byte("0"), true},
+		{nil, []byte("1"), false}, // the fact exists
+		{[]byte("1"), []byte("2"), false},
+		{[]byte("0"), []byte("1"), true},
+	}
+	for _, test := range tests {
+		swapped, err := c.CompareAndSwap(ctx, src, fact, test.old, test.new)
+		testutil.FatalOnErrT(t, "CompareAndSwap error: %v", err)
+		if swapped != test.want {
+			t.Errorf("CompareAndSwap(%q, %q) = %v; want %v", test.old, test.new, swapped, test.want)
+		}
+	}
+
+	read := func() []byte {
+		var val []byte
+		testutil.FatalOnErrT(t, "read error: %v", gs.Read(ctx, &spb.ReadRequest{Source: src}, func(e *spb.Entry) error {
+			if e.FactName == fact {
+				val = e.FactValue
+			}
+			return nil
+		}))
+		return val
+	}
+	const workers, increments = 8, 25
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; {
+				old := read()
+				n, err := strconv.Atoi(string(old))
+				if err != nil {
+					t.Errorf("Invalid counter value %q: %v", old, err)
+					return
+				}
+				swapped, err := c.CompareAndSwap(ctx, src, fact, old, []byte(strconv.Itoa(n+1)))
+				if err != nil {
+					t.Errorf("CompareAndSwap error: %v", err)
+					return
+				} else if swapped {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := string(read()), strconv.Itoa(1+workers*increments); got != want {
+		t.Errorf("Counter is %s after concurrent increments; want %s", got, want)
+	}
+}
+
+// ReadMultipleTest tests the ReadMultiple method of the CreateFunc created
+// graphstore.Service, which must implement graphstore.MultiReader.
+func ReadMultipleTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	mr, ok := gs.(graphstore.MultiReader)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.MultiReader", gs)
+	}
+
+	sources := []*spb.VName{{Signature: "c"}, {Signature: "a"}, {Signature: "b"}}
+	for _, src := range sources {
+		testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, &spb.WriteRequest{
+			Source: src,
+			Update: []*spb.WriteRequest_Update{
+				{FactName: "/kythe/node/kind", FactValue: []byte("record")},
+				{EdgeKind: "/kythe/edge/childof", Target: sources[0], FactName: "/"},
+			},
+		}))
+	}
+
+	counts := make(map[string]int)
+	var last *spb.VName
+	testutil.FatalOnErrT(t, "ReadMultiple error: %v", mr.ReadMultiple(ctx, []*spb.ReadRequest{
+		{Source: sources[0], EdgeKind: "*"},
+		{Source: sources[1]},
+		{Source: &spb.VName{Signature: "missing"}},
+		{Source: sources[2], EdgeKind: "/kythe/edge/childof"},
+	}, func(e *spb.Entry) error {
+		if last != nil && !compare.VNamesEqual(last, e.Source) && counts[e.Source.Signature] > 0 {
+			return fmt.Errorf("results for %v are not contiguous", e.Source)
+		}
+		last = e.Source
+		counts[e.Source.Signature]++
+		return nil
+	}))
+	for sig, want := range map[string]int{"a": 1, "b": 1, "c": 2, "missing": 0} {
+		if got := counts[sig]; got != want {
+			t.Errorf("ReadMultiple returned %d entries for %q; want %d", got, sig, want)
+		}
+	}
+}
+
+// PagedScanTest tests that paging through a Scan of the CreateFunc created
+// graphstore.Service with graphstore.ScanPage returns each matching entry
+// exactly once and in order.
+func PagedScanTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+
+	updates := make([]spb.WriteRequest_Update, 8)
+	req := &spb.WriteRequest{
+		Source: &spb.VName{},
+		Update: make([]*spb.WriteRequest_Update, len(updates)),
+	}
+	for i := 0; i < 16; i++ {
+		randVName(req.Source, keySize)
+		for j := range updates {
+			randUpdate(&updates[j], keySize)
+			req.Update[j] = &updates[j]
+		}
+		testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, req))
+	}
+
+	for _, scan := range []*spb.ScanRequest{{}, {FactPrefix: "a"}} {
+		var want []*spb.Entry
+		testutil.FatalOnErrT(t, "scan error: %v", gs.Scan(ctx, scan, func(e *spb.Entry) error {
+			want = append(want, e)
+			return nil
+		}))
+
+		for _, pageSize := range []int{1, 7, len(want), len(want) + 1} {
+			if pageSize < 1 {
+				continue
+			}
+			var got []*spb.Entry
+			var token string
+			for {
+				page, next, err := graphstore.ScanPage(ctx, gs, scan, pageSize, token)
+				testutil.FatalOnErrT(t, "ScanPage error: %v", err)
+				if len(page) > pageSize {
+					t.Fatalf("ScanPage returned %d entries; page size is %d", len(page), pageSize)
+				}
+				got = append(got, page...)
+				if next == "" {
+					break
+				}
+				token = next
+			}
+			if len(got) != len(want) {
+				t.Errorf("Paged scan with page size %d found %d entries; want %d", pageSize, len(got), len(want))
+				continue
+			}
+			for i := range want {
+				if !compare.EntriesEqual(got[i], want[i]) {
+					t.Errorf("Paged scan with page size %d: entry %d is {%v}; want {%v}", pageSize, i, got[i], want[i])
+					break
+				}
+			}
+		}
+	}
+}
+
+// ScanFromTest tests that graphstore.ScanFrom resumes a Scan of the CreateFunc
+// created graphstore.Service strictly after a given entry, including after an
+// entry that has since been deleted (if the store is a graphstore.Deleter).
+func ScanFromTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+
+	updates := make([]spb.WriteRequest_Update, 4)
+	req := &spb.WriteRequest{
+		Source: &spb.VName{},
+		Update: make([]*spb.WriteRequest_Update, len(updates)),
+	}
+	for i := 0; i < 8; i++ {
+		randVName(req.Source, keySize)
+		for j := range updates {
+			randUpdate(&updates[j], keySize)
+			req.Update[j] = &updates[j]
+		}
+		testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, req))
+	}
+
+	scan := func(after *spb.Entry) []*spb.Entry {
+		var found []*spb.Entry
+		testutil.FatalOnErrT(t, "ScanFrom error: %v", graphstore.ScanFrom(ctx, gs, new(spb.ScanRequest), after, func(e *spb.Entry) error {
+			found = append(found, e)
+			return nil
+		}))
+		return found
+	}
+	check := func(desc string, got, want []*spb.Entry) {
+		if len(got) != len(want) {
+			t.Errorf("ScanFrom %s found %d entries; want %d", desc, len(got), len(want))
+			return
+		}
+		for i := range want {
+			if !compare.EntriesEqual(got[i], want[i]) {
+				t.Errorf("ScanFrom %s: entry %d is {%v}; want {%v}", desc, i, got[i], want[i])
+				return
+			}
+		}
+	}
+
+	var all []*spb.Entry
+	testutil.FatalOnErrT(t, "scan error: %v", gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+		all = append(all, e)
+		return nil
+	}))
+	check("the beginning", scan(nil), all)
+	for _, i := range []int{0, len(all) / 2, len(all) - 1} {
+		after := &spb.Entry{
+			Source:   all[i].Source,
+			EdgeKind: all[i].EdgeKind,
+			FactName: all[i].FactName,
+			Target:   all[i].Target,
+		}
+		check(fmt.Sprintf("entry %d", i), scan(after), all[i+1:])
+	}
+
+	d, ok := gs.(graphstore.Deleter)
+	if !ok {
+		return
+	}
+	i := len(all) / 2
+	del := &graphstore.DeleteRequest{
+		Source:   all[i].Source,
+		EdgeKind: all[i].EdgeKind,
+		FactName: all[i].FactName,
+	}
+	testutil.FatalOnErrT(t, "delete error: %v", d.Delete(ctx, del))
+	var want []*spb.Entry
+	for _, e := range all[i+1:] {
+		if !graphstore.EntryMatchesDelete(del, e) {
+			want = append(want, e)
+		}
+	}
+	check("a deleted entry", scan(all[i]), want)
+}
+
+// ReverseOrderTest tests that the ReverseScan method of the CreateFunc created
+// graphstore.Service, which must implement graphstore.ReverseScanner, delivers
+// the same entries as Scan but in descending order.  If the store also
+// implements graphstore.ReverseSharded, each ReverseShard is checked against
+// its corresponding Shard.
+func ReverseOrderTest(t *testing.T, create CreateFunc, batchSize int) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	rs, ok := gs.(graphstore.ReverseScanner)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.ReverseScanner", gs)
+	}
+
+	updates := make([]spb.WriteRequest_Update, batchSize)
+	req := &spb.WriteRequest{
+		Source: &spb.VName{},
+		Update: make([]*spb.WriteRequest_Update, batchSize),
+	}
+	for i := 0; i < 64; i++ {
+		randVName(req.Source, keySize)
+		for j := 0; j < batchSize; j++ {
+			randUpdate(&updates[j], keySize)
+			req.Update[j] = &updates[j]
+		}
+		testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, req))
+	}
+
+	collect := func(scan func(graphstore.EntryFunc) error) (es []*spb.Entry) {
+		testutil.FatalOnErrT(t, "scan error: %v", scan(func(e *spb.Entry) error {
+			es = append(es, e)
+			return nil
+		}))
+		return
+	}
+	checkReversed := func(tag string, forward, reverse []*spb.Entry) {
+		if len(forward) != len(reverse) {
+			t.Errorf("%s: found %d entries in reverse; want %d", tag, len(reverse), len(forward))
+			return
+		}
+		for i, e := range reverse {
+			if !compare.EntriesEqual(e, forward[len(forward)-1-i]) {
+				t.Errorf("%s: reverse entry %d is {%v}; want {%v}", tag, i, e, forward[len(forward)-1-i])
+				return
+			}
+		}
+	}
+
+	for _, scan := range []*spb.ScanRequest{{}, {FactPrefix: "a"}} {
+		checkReversed("ReverseScan",
+			collect(func(f graphstore.EntryFunc) error { return gs.Scan(ctx, scan, f) }),
+			collect(func(f graphstore.EntryFunc) error { return rs.ReverseScan(ctx, scan, f) }))
+	}
+
+	if rs, ok := gs.(graphstore.ReverseSharded); ok {
+		const shards = 4
+		for i := int64(0); i < shards; i++ {
+			shard := &spb.ShardRequest{Index: i, Shards: shards}
+			checkReversed(fmt.Sprintf("ReverseShard %d", i),
+				collect(func(f graphstore.EntryFunc) error { return rs.Shard(ctx, shard, f) }),
+				collect(func(f graphstore.EntryFunc) error { return rs.ReverseShard(ctx, shard, f) }))
+		}
+	}
+}
+
+// WriteStatsTest tests the WriteWithStats method of the CreateFunc created
+// graphstore.Service, which must implement graphstore.StatsWriter.
+func WriteStatsTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	sw, ok := gs.(graphstore.StatsWriter)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.StatsWriter", gs)
+	}
+
+	src := &spb.VName{Signature: "src"}
+	update := func(fact, value string) *spb.WriteRequest_Update {
+		return &spb.WriteRequest_Update{FactName: fact, FactValue: []byte(value)}
+	}
+	tests := []struct {
+		updates []*spb.WriteRequest_Update
+		want    graphstore.WriteStats
+	}{
+		{[]*spb.WriteRequest_Update{update("/a", "1"), update("/b", "2")}, graphstore.WriteStats{Inserted: 2}},
+		{[]*spb.WriteRequest_Update{update("/a", "1"), update("/b", "3"), update("/c", "4")},
+			graphstore.WriteStats{Inserted: 1, Updated: 1, Unchanged: 1}},
+		{[]*spb.WriteRequest_Update{update("/d", "5"), update("/d", "5"), update("/d", "6")},
+			graphstore.WriteStats{Inserted: 1, Updated: 1, Unchanged: 1}},
+	}
+	for i, test := range tests {
+		stats, err := sw.WriteWithStats(ctx, &spb.WriteRequest{Source: src, Update: test.updates})
+		testutil.FatalOnErrT(t, "write error: %v", err)
+		if *stats != test.want {
+			t.Errorf("Write %d: got stats %+v; want %+v", i, *stats, test.want)
+		}
+	}
+
+	var got int
+	testutil.FatalOnErrT(t, "read error: %v", gs.Read(ctx, &spb.ReadRequest{Source: src}, func(e *spb.Entry) error {
+		got++
+		return nil
+	}))
+	if got != 4 {
+		t.Errorf("Found %d entries after writes; want 4", got)
+	}
+}
+
+// WriteIfAbsentTest tests the WriteOpts method of the CreateFunc created
+// graphstore.Service, which must implement graphstore.OptionsWriter.
+func WriteIfAbsentTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	ow, ok := gs.(graphstore.OptionsWriter)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.OptionsWriter", gs)
+	}
+	CheckWriteIfAbsent(t, gs, func(req *spb.WriteRequest, opts *graphstore.WriteOptions) (*graphstore.WriteStats, error) {
+		return ow.WriteOpts(ctx, req, opts)
+	})
+}
+
+// CheckWriteIfAbsent checks that write, which must apply its WriteRequest to
+// the empty store gs, implements the IfAbsent write option.
+func CheckWriteIfAbsent(t *testing.T, gs graphstore.Service, write func(*spb.WriteRequest, *graphstore.WriteOptions) (*graphstore.WriteStats, error)) {
+	src := &spb.VName{Signature: "src"}
+	update := func(fact, value string) *spb.WriteRequest_Update {
+		return &spb.WriteRequest_Update{FactName: fact, FactValue: []byte(value)}
+	}
+	opts := &graphstore.WriteOptions{IfAbsent: true}
+	tests := []struct {
+		updates []*spb.WriteRequest_Update
+		want    graphstore.WriteStats
+	}{
+		{[]*spb.WriteRequest_Update{update("/a", "1"), update("/b", "2")}, graphstore.WriteStats{Inserted: 2}},
+		{[]*spb.WriteRequest_Update{update("/a", "9"), update("/c", "3"), update("/c", "4")},
+			graphstore.WriteStats{Inserted: 1, Skipped: 2}},
+	}
+	for i, test := range tests {
+		stats, err := write(&spb.WriteRequest{Source: src, Update: test.updates}, opts)
+		testutil.FatalOnErrT(t, "write error: %v", err)
+		if *stats != test.want {
+			t.Errorf("Write %d: got stats %+v; want %+v", i, *stats, test.want)
+		}
+	}
+
+	want := map[string]string{"/a": "1", "/b": "2", "/c": "3"}
+	got := make(map[string]string)
+	testutil.FatalOnErrT(t, "read error: %v", gs.Read(ctx, &spb.ReadRequest{Source: src}, func(e *spb.Entry) error {
+		got[e.FactName] = string(e.FactValue)
+		return nil
+	}))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Facts after writes: got %v; want %v", got, want)
+	}
+}
+
+// WriteIfAbsentRaceTest tests that when concurrent IfAbsent writes of the
+// CreateFunc created graphstore.Service, which must implement
+// graphstore.OptionsWriter, race to insert the same keys, exactly one of them
+// wins each key.
+func WriteIfAbsentRaceTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	ow, ok := gs.(graphstore.OptionsWriter)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.OptionsWriter", gs)
+	}
+
+	const writers, keys = 16, 64
+	src := &spb.VName{Signature: "src"}
+	start := make(chan struct{})
+	stats := make([]*graphstore.WriteStats, writers)
+	errs := make([]error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		req := &spb.WriteRequest{Source: src}
+		for k := 0; k < keys; k++ {
+			req.Update = append(req.Update, &spb.WriteRequest_Update{
+				FactName:  "/fact/" + strconv.Itoa(k),
+				FactValue: []byte(strconv.Itoa(i)),
+			})
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			stats[i], errs[i] = ow.WriteOpts(ctx, req, &graphstore.WriteOptions{IfAbsent: true})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	var inserted int64
+	for i := 0; i < writers; i++ {
+		testutil.FatalOnErrT(t, "write error: %v", errs[i])
+		if stats[i].Inserted+stats[i].Skipped != keys || stats[i].Updated != 0 || stats[i].Unchanged != 0 {
+			t.Errorf("Writer %d: got stats %+v; want %d insertions or skips", i, *stats[i], keys)
+		}
+		inserted += stats[i].Inserted
+	}
+	if inserted != keys {
+		t.Errorf("Racing writers inserted %d keys; want each of the %d once", inserted, keys)
+	}
+	var got int
+	testutil.FatalOnErrT(t, "read error: %v", gs.Read(ctx, &spb.ReadRequest{Source: src}, func(e *spb.Entry) error {
+		got++
+		return nil
+	}))
+	if got != keys {
+		t.Errorf("Found %d facts after racing writes; want %d", got, keys)
+	}
+}
+
+// SnapshotTest tests that the Snapshot of a CreateFunc created
+// graphstore.Service, which must implement graphstore.Snapshotter, is
+// unaffected by later writes to the store.
+func SnapshotTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	ss, ok := gs.(graphstore.Snapshotter)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.Snapshotter", gs)
+	}
+
+	src := &spb.VName{Signature: "src"}
+	write := func(gs graphstore.Service, fact, value string) error {
+		return gs.Write(ctx, &spb.WriteRequest{
+			Source: src,
+			Update: []*spb.WriteRequest_Update{{FactName: fact, FactValue: []byte(value)}},
+		})
+	}
+	facts := func(gs graphstore.Service) map[string]string {
+		m := make(map[string]string)
+		testutil.FatalOnErrT(t, "scan error: %v", gs.Scan(ctx, new(spb.ScanRequest), func(e *spb.Entry) error {
+			m[e.FactName] = string(e.FactValue)
+			return nil
+		}))
+		return m
+	}
+
+	testutil.FatalOnErrT(t, "write error: %v", write(gs, "/a", "1"))
+	testutil.FatalOnErrT(t, "write error: %v", write(gs, "/b", "2"))
+	snap, err := ss.Snapshot()
+	testutil.FatalOnErrT(t, "snapshot error: %v", err)
+	testutil.FatalOnErrT(t, "write error: %v", write(gs, "/a", "3"))
+	testutil.FatalOnErrT(t, "write error: %v", write(gs, "/c", "4"))
+
+	if got, want := facts(snap), map[string]string{"/a": "1", "/b": "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshot facts: got %v; want %v", got, want)
+	}
+	if err := write(snap, "/d", "5"); err != graphstore.ErrReadOnly {
+		t.Errorf("Snapshot write: got error %v; want %v", err, graphstore.ErrReadOnly)
+	}
+	testutil.FatalOnErrT(t, "snapshot close error: %v", snap.Close(ctx))
+
+	testutil.FatalOnErrT(t, "write error: %v", write(gs, "/d", "5"))
+	if got, want := facts(gs), map[string]string{"/a": "3", "/b": "2", "/c": "4", "/d": "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Store facts: got %v; want %v", got, want)
+	}
+}
+
+// WatchTest tests the Watch method of the CreateFunc created
+// graphstore.Service, which must implement graphstore.Watcher.
+func WatchTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	w, ok := gs.(graphstore.Watcher)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.Watcher", gs)
+	}
+
+	src := &spb.VName{Signature: "src"}
+	write := func(fact string) {
+		testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, &spb.WriteRequest{
+			Source: src,
+			Update: []*spb.WriteRequest_Update{{FactName: fact, FactValue: factValue}},
+		}))
+	}
+	write("/before")
+
+	const numWatched = 3
+	var got []string
+	done := make(chan error)
+	go func() {
+		done <- w.Watch(ctx, func(e *spb.Entry) error {
+			got = append(got, e.FactName)
+			if len(got) == numWatched {
+				return io.EOF
+			}
+			return nil
+		})
+	}()
+
+	// The watch may begin at any point during the writes; keep writing until
+	// the watcher has seen enough entries.
+	var werr error
+	for i := 0; ; i++ {
+		select {
+		case werr = <-done:
+		case <-time.After(time.Millisecond):
+			write(fmt.Sprintf("/%05d", i))
+			continue
+		}
+		break
+	}
+	if werr != nil {
+		t.Fatalf("Watch error: %v", werr)
+	}
+	if len(got) != numWatched {
+		t.Fatalf("Watched %d entries; want %d", len(got), numWatched)
+	}
+	var first int
+	if _, err := fmt.Sscanf(got[0], "/%05d", &first); err != nil {
+		t.Fatalf("Watched unexpected entry %q", got[0])
+	}
+	for i, fact := range got {
+		if want := fmt.Sprintf("/%05d", first+i); fact != want {
+			t.Errorf("Watched entry %d: got %q; want %q", i, fact, want)
+		}
+	}
+
+	// A watcher with a cancelled context must stop without blocking writes.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := w.Watch(cctx, func(e *spb.Entry) error {
+		t.Errorf("Unexpected entry after cancellation: %v", e)
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("Watch: got error %v; want %v", err, context.Canceled)
+	}
+	write("/after")
+}
+
+// TransactionTest tests the WriteBatch method of the CreateFunc created
+// graphstore.Service, which must implement graphstore.Transactional.
+func TransactionTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	tx, ok := gs.(graphstore.Transactional)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.Transactional", gs)
+	}
+
+	node := &spb.VName{Signature: "node"}
+	ref := &spb.VName{Signature: "ref"}
+	count := func(src *spb.VName) (n int) {
+		testutil.FatalOnErrT(t, "read error: %v", gs.Read(ctx, &spb.ReadRequest{Source: src, EdgeKind: "*"}, func(*spb.Entry) error {
+			n++
+			return nil
+		}))
+		return
+	}
+
+	testutil.FatalOnErrT(t, "WriteBatch error: %v", tx.WriteBatch(ctx, []*spb.WriteRequest{{
+		Source: node,
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("record")}},
+	}, {
+		Source: ref,
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("anchor")},
+			{EdgeKind: "/kythe/edge/ref", Target: node, FactName: "/"},
+		},
+	}}))
+	if n := count(node); n != 1 {
+		t.Errorf("Found %d entries for %v; want 1", n, node)
+	}
+	if n := count(ref); n != 2 {
+		t.Errorf("Found %d entries for %v; want 2", n, ref)
+	}
+
+	// If a batch fails, none of it may be applied.
+	other := &spb.VName{Signature: "other"}
+	if err := tx.WriteBatch(ctx, []*spb.WriteRequest{{
+		Source: other,
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("file")}},
+	}, {
+		Source: node,
+		Update: []*spb.WriteRequest_Update{{FactValue: []byte("missing fact name")}},
+	}}); err != nil {
+		if n := count(other); n != 0 {
+			t.Errorf("Found %d entries for %v after failed WriteBatch; want 0", n, other)
+		}
+	}
+}
+
+// ScanOptionsTest tests the ScanOpts method of the CreateFunc created
+// graphstore.Service, which must implement graphstore.OptionsScanner.
+func ScanOptionsTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	o, ok := gs.(graphstore.OptionsScanner)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.OptionsScanner", gs)
+	}
+
+	targets := []*spb.VName{
+		{Corpus: "x", Path: "src/foo/a"},
+		{Corpus: "x", Path: "src/bar/b"},
+		{Corpus: "y", Path: "src/foo/c"},
+	}
+	req := &spb.WriteRequest{Source: &spb.VName{Signature: "src"}}
+	for _, target := range targets {
+		req.Update = append(req.Update, &spb.WriteRequest_Update{
+			EdgeKind: "/kythe/edge/ref",
+			Target:   target,
+			FactName: "/",
+		})
+	}
+	testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, req))
+
+	tests := []struct {
+		target *spb.VName
+		opts   *graphstore.ScanOptions
+		want   []string // target paths
+	}{
+		{&spb.VName{Corpus: "x"}, nil, nil},
+		{&spb.VName{Corpus: "x", Path: "src/foo/a"}, nil, []string{"src/foo/a"}},
+		{&spb.VName{Corpus: "x"}, &graphstore.ScanOptions{PartialTarget: true}, []string{"src/bar/b", "src/foo/a"}},
+		{&spb.VName{Path: "src/foo/"}, &graphstore.ScanOptions{PartialTarget: true, PrefixTarget: true}, []string{"src/foo/a", "src/foo/c"}},
+		{&spb.VName{Corpus: "y", Path: "src/"}, &graphstore.ScanOptions{PrefixTarget: true}, []string{"src/foo/c"}},
+	}
+	for _, test := range tests {
+		var got []string
+		testutil.FatalOnErrT(t, "scan error: %v", o.ScanOpts(ctx, &spb.ScanRequest{Target: test.target}, test.opts, func(e *spb.Entry) error {
+			got = append(got, e.Target.Path)
+			return nil
+		}))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ScanOpts(%v, %+v): got %v; want %v", test.target, test.opts, got, test.want)
+		}
+	}
+
+	testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, &spb.WriteRequest{
+		Source: &spb.VName{Signature: "other"},
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("function")},
+			{EdgeKind: "/kythe/edge/childof", Target: targets[0], FactName: "/"},
+			{EdgeKind: "/kythe/edge/defines", Target: targets[1], FactName: "/"},
+		},
+	}))
+	kindTests := []struct {
+		kinds []string
+		want  int
+	}{
+		{nil, 6},
+		{[]string{"/kythe/edge/ref"}, 3},
+		{[]string{"/kythe/edge/ref", "/kythe/edge/defines"}, 4},
+		{[]string{"/kythe/edge/defines", "/kythe/edge/childof", "/kythe/edge/missing"}, 2},
+	}
+	for _, test := range kindTests {
+		var got int
+		testutil.FatalOnErrT(t, "scan error: %v", o.ScanOpts(ctx, new(spb.ScanRequest), &graphstore.ScanOptions{EdgeKinds: test.kinds}, func(e *spb.Entry) error {
+			got++
+			return nil
+		}))
+		if got != test.want {
+			t.Errorf("ScanOpts(EdgeKinds: %v): got %d entries; want %d", test.kinds, got, test.want)
+		}
+	}
+}
+
+// ReadFactsTest tests graphstore.ReadFacts against the CreateFunc created
+// graphstore.Service.
+func ReadFactsTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+
+	src := &spb.VName{Signature: "src"}
+	testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, &spb.WriteRequest{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/loc/end", FactValue: []byte("2")},
+			{FactName: "/kythe/loc/start", FactValue: []byte("1")},
+			{FactName: "/kythe/node/kind", FactValue: []byte("file")},
+			{FactName: "/kythe/text", FactValue: []byte("text")},
+			{EdgeKind: "/kythe/edge/childof", Target: &spb.VName{Signature: "tgt"}, FactName: "/kythe/node/kind"},
+		},
+	}))
+	testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, &spb.WriteRequest{
+		Source: &spb.VName{Signature: "other"},
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("file")}},
+	}))
+
+	tests := []struct {
+		prefixes []string
+		limit    int // if > 0, stop after this many facts
+		want     []string
+	}{
+		{nil, 0, []string{"/kythe/loc/end", "/kythe/loc/start", "/kythe/node/kind", "/kythe/text"}},
+		{[]string{"/kythe/node/kind"}, 0, []string{"/kythe/node/kind"}},
+		{[]string{"/kythe/text", "/kythe/loc/"}, 0, []string{"/kythe/loc/end", "/kythe/loc/start", "/kythe/text"}},
+		{[]string{"/kythe/loc/start", "/kythe/loc"}, 0, []string{"/kythe/loc/end", "/kythe/loc/start"}},
+		{[]string{"/kythe/loc/", "/kythe/node/"}, 2, []string{"/kythe/loc/end", "/kythe/loc/start"}},
+		{[]string{"/missing"}, 0, nil},
+	}
+	for _, test := range tests {
+		var got []string
+		testutil.FatalOnErrT(t, "ReadFacts error: %v", graphstore.ReadFacts(ctx, gs, src, test.prefixes, func(e *spb.Entry) error {
+			if e.EdgeKind != "" {
+				t.Errorf("ReadFacts returned edge entry: %v", e)
+			}
+			got = append(got, e.FactName)
+			if len(got) == test.limit {
+				return io.EOF
+			}
+			return nil
+		}))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ReadFacts(%q): got %v; want %v", test.prefixes, got, test.want)
+		}
+	}
+}
+
+// BlobWriteTest tests graphstore.BeginFact against the CreateFunc created
+// graphstore.Service with a value larger than a typical WriteRequest.
+func BlobWriteTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+
+	src := &spb.VName{Signature: "file", Path: "gen/big.cc"}
+	testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, &spb.WriteRequest{
+		Source: src,
+		Update: []*spb.WriteRequest_Update{
+			{FactName: "/kythe/node/kind", FactValue: []byte("file")},
+			{FactName: "/kythe/text", FactValue: []byte("old text")},
+		},
+	}))
+
+	// An abandoned writer writes nothing.
+	_, err = graphstore.BeginFact(ctx, gs, src, "/kythe/text/encoding")
+	testutil.FatalOnErrT(t, "BeginFact error: %v", err)
+
+	w, err := graphstore.BeginFact(ctx, gs, src, "/kythe/text")
+	testutil.FatalOnErrT(t, "BeginFact error: %v", err)
+	var expected []byte
+	for i := 0; len(expected) < 5<<20; i++ {
+		chunk := []byte(fmt.Sprintf("line %d: %s\n", i, testutil.RandStr(1+i%4096)))
+		expected = append(expected, chunk...)
+		_, err := w.Write(chunk)
+		testutil.FatalOnErrT(t, "chunk write error: %v", err)
+	}
+	testutil.FatalOnErrT(t, "fact value close error: %v", w.Close())
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Error("Write after Close succeeded; expected an error")
+	}
+
+	var facts []*spb.Entry
+	testutil.FatalOnErrT(t, "read error: %v", gs.Read(ctx, &spb.ReadRequest{Source: src}, func(e *spb.Entry) error {
+		facts = append(facts, e)
+		return nil
+	}))
+	if len(facts) != 2 {
+		t.Fatalf("Read %d facts; want 2: %v", len(facts), facts)
+	} else if facts[1].FactName != "/kythe/text" || !bytes.Equal(facts[1].FactValue, expected) {
+		t.Errorf("Read %q fact of %d bytes; want /kythe/text of %d bytes", facts[1].FactName, len(facts[1].FactValue), len(expected))
+	}
+
+	var n int
+	testutil.FatalOnErrT(t, "scan error: %v", gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		n++
+		return nil
+	}))
+	if n != 2 {
+		t.Errorf("Scanned %d entries; want 2", n)
+	}
+}
+
+// StoreFullTest tests that the CreateFunc created graphstore.Service, which
+// must implement graphstore.Deleter and hold no more than a few megabytes of
+// entries, fails writes with errFull once it is full without applying them.
+func StoreFullTest(t *testing.T, create CreateFunc, errFull error) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	d, ok := gs.(graphstore.Deleter)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.Deleter", gs)
+	}
+
+	// Every entry written is the same size, so a full store has room for less
+	// than one more.
+	value := bytes.Repeat([]byte("v"), 64)
+	vname := func(i int) *spb.VName { return &spb.VName{Signature: fmt.Sprintf("src%06d", i)} }
+	write := func(src *spb.VName, facts ...string) error {
+		req := &spb.WriteRequest{Source: src}
+		for _, fact := range facts {
+			req.Update = append(req.Update, &spb.WriteRequest_Update{FactName: fact, FactValue: value})
+		}
+		return gs.Write(ctx, req)
+	}
+	read := func(src *spb.VName) int {
+		var n int
+		testutil.FatalOnErrT(t, "read error: %v", gs.Read(ctx, &spb.ReadRequest{Source: src}, func(*spb.Entry) error {
+			n++
+			return nil
+		}))
+		return n
+	}
+
+	var written int
+	for ; ; written++ {
+		if written == 1<<20 {
+			t.Fatalf("Wrote %d entries without filling the store", written)
+		} else if err := write(vname(written), "/kythe/text"); err == errFull {
+			break
+		} else if err != nil {
+			t.Fatalf("Write %d error: %v; want nil or %v", written, err, errFull)
+		}
+	}
+	if written == 0 {
+		t.Fatal("The first write failed; the store must hold at least one entry")
+	}
+	if n := read(vname(written)); n != 0 {
+		t.Errorf("Read %d entries of the failed write; want 0", n)
+	}
+	if n := read(vname(0)); n != 1 {
+		t.Errorf("Read %d entries of the first write in a full store; want 1", n)
+	}
+	var n int
+	testutil.FatalOnErrT(t, "scan error: %v", gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		n++
+		return nil
+	}))
+	if n != written {
+		t.Errorf("Scanned %d entries of a full store; want %d", n, written)
+	}
+
+	// Once an entry is deleted, a write of one entry fits but a write of two
+	// must fail without applying either.
+	testutil.FatalOnErrT(t, "delete error: %v", d.Delete(ctx, &graphstore.DeleteRequest{Source: vname(0)}))
+	src := vname(written)
+	if err := write(src, "/kythe/text", "/kythe/code"); err != errFull {
+		t.Errorf("Write of two entries: got error %v; want %v", err, errFull)
+	} else if n := read(src); n != 0 {
+		t.Errorf("Read %d entries of the failed write; want 0", n)
+	}
+	testutil.FatalOnErrT(t, "write error: %v", write(src, "/kythe/code"))
+	if n := read(src); n != 1 {
+		t.Errorf("Read %d entries after a write to a store with room; want 1", n)
+	}
+}
+
 var factValue = []byte("factValue")
 
 func randUpdate(u *spb.WriteRequest_Update, size int) {
@@ -131,3 +1397,35 @@ func randVName(v *spb.VName, size int) {
 	v.Path = testutil.RandStr(size)
 	v.Language = testutil.RandStr(size)
 }
+
+// HealthCheckTest tests that the Service is a graphstore.HealthChecker that is
+// healthy both empty and once written, and that the health check is not
+// itself a write.
+func HealthCheckTest(t *testing.T, create CreateFunc) {
+	gs, destroy, err := create()
+	testutil.FatalOnErrT(t, "CreateFunc error: %v", err)
+	defer func() {
+		testutil.FatalOnErrT(t, "gs close error: %v", gs.Close(ctx))
+		testutil.FatalOnErrT(t, "DestroyFunc error: %v", destroy())
+	}()
+	hc, ok := gs.(graphstore.HealthChecker)
+	if !ok {
+		t.Fatalf("%T does not implement graphstore.HealthChecker", gs)
+	}
+
+	testutil.FatalOnErrT(t, "CheckHealth of an empty store: %v", hc.CheckHealth(ctx))
+	testutil.FatalOnErrT(t, "write error: %v", gs.Write(ctx, &spb.WriteRequest{
+		Source: &spb.VName{Signature: "src"},
+		Update: []*spb.WriteRequest_Update{{FactName: "/kythe/node/kind", FactValue: []byte("test")}},
+	}))
+	testutil.FatalOnErrT(t, "CheckHealth of a written store: %v", hc.CheckHealth(ctx))
+
+	var n int
+	testutil.FatalOnErrT(t, "scan error: %v", gs.Scan(ctx, new(spb.ScanRequest), func(*spb.Entry) error {
+		n++
+		return nil
+	}))
+	if n != 1 {
+		t.Errorf("Scanned %d entries after CheckHealth; want 1", n)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package hll implements the HyperLogLog algorithm for estimating the number of
+// distinct elements in a stream using a small, fixed amount of memory.
+package hll
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// Precision bounds for New.
+const (
+	MinPrecision = 4
+	MaxPrecision = 16
+
+	// DefaultPrecision uses 16KiB of registers for a typical relative error of
+	// under 1%.
+	DefaultPrecision = 14
+)
+
+// A Sketch estimates the number of distinct values added to it.
+type Sketch struct {
+	p   uint
+	reg []uint8
+}
+
+// New returns an empty Sketch with 2^precision registers.  Its typical
+// relative error is 1.04/sqrt(2^precision).
+func New(precision int) (*Sketch, error) {
+	if precision < MinPrecision || precision > MaxPrecision {
+		return nil, fmt.Errorf("precision out of range [%d, %d]: %d", MinPrecision, MaxPrecision, precision)
+	}
+	return &Sketch{p: uint(precision), reg: make([]uint8, 1<<uint(precision))}, nil
+}
+
+// Add records the given value in the Sketch.
+func (s *Sketch) Add(val []byte) {
+	h := fnv.New64a()
+	h.Write(val)
+	x := mix(h.Sum64())
+
+	idx := x >> (64 - s.p)
+	// The rank is the position of the first set bit in the remaining bits.
+	rank := uint8(1)
+	for w := x << s.p; rank <= uint8(64-s.p) && w&(1<<63) == 0; w <<= 1 {
+		rank++
+	}
+	if rank > s.reg[idx] {
+		s.reg[idx] = rank
+	}
+}
+
+// AddString records the given value in the Sketch.
+func (s *Sketch) AddString(val string) { s.Add([]byte(val)) }
+
+// Merge adds every value recorded in o to s.  Both Sketches must have the same
+// precision.
+func (s *Sketch) Merge(o *Sketch) error {
+	if s.p != o.p {
+		return fmt.Errorf("mismatched precisions: %d vs. %d", s.p, o.p)
+	}
+	for i, r := range o.reg {
+		if r > s.reg[i] {
+			s.reg[i] = r
+		}
+	}
+	return nil
+}
+
+// Count returns the estimated number of distinct values added to the Sketch.
+func (s *Sketch) Count() uint64 {
+	m := float64(len(s.reg))
+	var (
+		sum   float64
+		zeros int
+	)
+	for _, r := range s.reg {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := alpha(len(s.reg)) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// Use linear counting for small cardinalities.
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+func alpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	default:
+		return 0.7213 / (1 + 1.079/float64(m))
+	}
+}
+
+// mix spreads the bits of an FNV hash so that its high bits are well
+// distributed (the finalizer of SplitMix64).
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2016 Google Inc. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package hll
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestCount(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 50000, 200000} {
+		s, err := New(DefaultPrecision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			val := fmt.Sprintf("value%d", i)
+			s.AddString(val)
+			s.AddString(val) // duplicates must not be counted
+		}
+		if est := s.Count(); math.Abs(float64(est)-float64(n)) > 0.03*float64(n)+1 {
+			t.Errorf("Count() = %d; want ~%d", est, n)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, _ := New(10)
+	b, _ := New(10)
+	for i := 0; i < 1000; i++ {
+		a.AddString(fmt.Sprintf("a%d", i))
+		b.AddString(fmt.Sprintf("b%d", i))
+		b.AddString(fmt.Sprintf("a%d", i))
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	if est := a.Count(); est < 1800 || est > 2200 {
+		t.Errorf("Merged Count() = %d; want ~2000", est)
+	}
+
+	c, _ := New(12)
+	if err := a.Merge(c); err == nil {
+		t.Error("Merge of mismatched precisions succeeded; expected error")
+	}
+}
+
+func TestPrecisionBounds(t *testing.T) {
+	for _, p := range []int{MinPrecision - 1, MaxPrecision + 1} {
+		if _, err := New(p); err == nil {
+			t.Errorf("New(%d) succeeded; expected error", p)
+		}
+	}
+}
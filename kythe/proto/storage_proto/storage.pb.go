@@ -22,6 +22,7 @@
 		ShardRequest
 		SearchRequest
 		SearchReply
+		WriteAck
 */
 package storage_proto
 
@@ -365,6 +366,39 @@ func (m *SearchReply) String() string            { return proto.CompactTextStrin
 func (*SearchReply) ProtoMessage()               {}
 func (*SearchReply) Descriptor() ([]byte, []int) { return fileDescriptorStorage, []int{12} }
 
+// Acknowledgement of a run of the requests of a WriteStream
+type WriteAck struct {
+	// The number of requests acknowledged, which immediately follow those
+	// acknowledged by the stream's previous WriteAcks.
+	Count int64 `protobuf:"varint,1,opt,name=count,proto3" json:"count,omitempty"`
+	// The acknowledged requests that failed; the others succeeded.
+	Failure []*WriteAck_Failure `protobuf:"bytes,2,rep,name=failure" json:"failure,omitempty"`
+}
+
+func (m *WriteAck) Reset()                    { *m = WriteAck{} }
+func (m *WriteAck) String() string            { return proto.CompactTextString(m) }
+func (*WriteAck) ProtoMessage()               {}
+func (*WriteAck) Descriptor() ([]byte, []int) { return fileDescriptorStorage, []int{13} }
+
+func (m *WriteAck) GetFailure() []*WriteAck_Failure {
+	if m != nil {
+		return m.Failure
+	}
+	return nil
+}
+
+type WriteAck_Failure struct {
+	// The index of the failed request among those acknowledged.
+	Index int64 `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	// The error of the failed request.
+	Error string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (m *WriteAck_Failure) Reset()                    { *m = WriteAck_Failure{} }
+func (m *WriteAck_Failure) String() string            { return proto.CompactTextString(m) }
+func (*WriteAck_Failure) ProtoMessage()               {}
+func (*WriteAck_Failure) Descriptor() ([]byte, []int) { return fileDescriptorStorage, []int{13, 0} }
+
 func init() {
 	proto.RegisterType((*VName)(nil), "kythe.proto.VName")
 	proto.RegisterType((*VNameMask)(nil), "kythe.proto.VNameMask")
@@ -381,6 +415,8 @@ func init() {
 	proto.RegisterType((*SearchRequest)(nil), "kythe.proto.SearchRequest")
 	proto.RegisterType((*SearchRequest_Fact)(nil), "kythe.proto.SearchRequest.Fact")
 	proto.RegisterType((*SearchReply)(nil), "kythe.proto.SearchReply")
+	proto.RegisterType((*WriteAck)(nil), "kythe.proto.WriteAck")
+	proto.RegisterType((*WriteAck_Failure)(nil), "kythe.proto.WriteAck.Failure")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -411,6 +447,11 @@ type GraphStoreClient interface {
 	// from the store; entries are only ever inserted or updated.  Apart from
 	// acting atomically, no other constraints are placed on the implementation.
 	Write(ctx context.Context, in *WriteRequest, opts ...grpc.CallOption) (*WriteReply, error)
+	// WriteStream applies each WriteRequest sent on the stream, in order, as if
+	// by Write.  The server acknowledges the requests it has applied with
+	// periodic WriteAcks; a request that fails does not end the stream.  This
+	// lets a client pipeline its writes without paying for an RPC per request.
+	WriteStream(ctx context.Context, opts ...grpc.CallOption) (GraphStore_WriteStreamClient, error)
 }
 
 type graphStoreClient struct {
@@ -494,6 +535,37 @@ func (c *graphStoreClient) Write(ctx context.Context, in *WriteRequest, opts ...
 	return out, nil
 }
 
+func (c *graphStoreClient) WriteStream(ctx context.Context, opts ...grpc.CallOption) (GraphStore_WriteStreamClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_GraphStore_serviceDesc.Streams[2], c.cc, "/kythe.proto.GraphStore/WriteStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &graphStoreWriteStreamClient{stream}
+	return x, nil
+}
+
+type GraphStore_WriteStreamClient interface {
+	Send(*WriteRequest) error
+	Recv() (*WriteAck, error)
+	grpc.ClientStream
+}
+
+type graphStoreWriteStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *graphStoreWriteStreamClient) Send(m *WriteRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *graphStoreWriteStreamClient) Recv() (*WriteAck, error) {
+	m := new(WriteAck)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Server API for GraphStore service
 
 type GraphStoreServer interface {
@@ -514,6 +586,11 @@ type GraphStoreServer interface {
 	// from the store; entries are only ever inserted or updated.  Apart from
 	// acting atomically, no other constraints are placed on the implementation.
 	Write(context.Context, *WriteRequest) (*WriteReply, error)
+	// WriteStream applies each WriteRequest sent on the stream, in order, as if
+	// by Write.  The server acknowledges the requests it has applied with
+	// periodic WriteAcks; a request that fails does not end the stream.  This
+	// lets a client pipeline its writes without paying for an RPC per request.
+	WriteStream(GraphStore_WriteStreamServer) error
 }
 
 func RegisterGraphStoreServer(s *grpc.Server, srv GraphStoreServer) {
@@ -580,6 +657,32 @@ func _GraphStore_Write_Handler(srv interface{}, ctx context.Context, dec func(in
 	return interceptor(ctx, in, info, handler)
 }
 
+func _GraphStore_WriteStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(GraphStoreServer).WriteStream(&graphStoreWriteStreamServer{stream})
+}
+
+type GraphStore_WriteStreamServer interface {
+	Send(*WriteAck) error
+	Recv() (*WriteRequest, error)
+	grpc.ServerStream
+}
+
+type graphStoreWriteStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *graphStoreWriteStreamServer) Send(m *WriteAck) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *graphStoreWriteStreamServer) Recv() (*WriteRequest, error) {
+	m := new(WriteRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var _GraphStore_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "kythe.proto.GraphStore",
 	HandlerType: (*GraphStoreServer)(nil),
@@ -600,6 +703,12 @@ var _GraphStore_serviceDesc = grpc.ServiceDesc{
 			Handler:       _GraphStore_Scan_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "WriteStream",
+			Handler:       _GraphStore_WriteStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 }
 
@@ -1380,6 +1489,70 @@ func (m *SearchReply) MarshalTo(data []byte) (int, error) {
 	return i, nil
 }
 
+func (m *WriteAck) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *WriteAck) MarshalTo(data []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.Count != 0 {
+		data[i] = 0x8
+		i++
+		i = encodeVarintStorage(data, i, uint64(m.Count))
+	}
+	if len(m.Failure) > 0 {
+		for _, msg := range m.Failure {
+			data[i] = 0x12
+			i++
+			i = encodeVarintStorage(data, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(data[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	return i, nil
+}
+
+func (m *WriteAck_Failure) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *WriteAck_Failure) MarshalTo(data []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.Index != 0 {
+		data[i] = 0x8
+		i++
+		i = encodeVarintStorage(data, i, uint64(m.Index))
+	}
+	if len(m.Error) > 0 {
+		data[i] = 0x12
+		i++
+		i = encodeVarintStorage(data, i, uint64(len(m.Error)))
+		i += copy(data[i:], m.Error)
+	}
+	return i, nil
+}
+
 func encodeFixed64Storage(data []byte, offset int, v uint64) int {
 	data[offset] = uint8(v)
 	data[offset+1] = uint8(v >> 8)
@@ -1650,6 +1823,34 @@ func (m *SearchReply) Size() (n int) {
 	return n
 }
 
+func (m *WriteAck) Size() (n int) {
+	var l int
+	_ = l
+	if m.Count != 0 {
+		n += 1 + sovStorage(uint64(m.Count))
+	}
+	if len(m.Failure) > 0 {
+		for _, e := range m.Failure {
+			l = e.Size()
+			n += 1 + l + sovStorage(uint64(l))
+		}
+	}
+	return n
+}
+
+func (m *WriteAck_Failure) Size() (n int) {
+	var l int
+	_ = l
+	if m.Index != 0 {
+		n += 1 + sovStorage(uint64(m.Index))
+	}
+	l = len(m.Error)
+	if l > 0 {
+		n += 1 + l + sovStorage(uint64(l))
+	}
+	return n
+}
+
 func sovStorage(x uint64) (n int) {
 	for {
 		n++
@@ -3484,6 +3685,204 @@ func (m *SearchReply) Unmarshal(data []byte) error {
 	}
 	return nil
 }
+func (m *WriteAck) Unmarshal(data []byte) error {
+	l := len(data)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowStorage
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: WriteAck: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: WriteAck: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Count", wireType)
+			}
+			m.Count = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStorage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.Count |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Failure", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStorage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthStorage
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Failure = append(m.Failure, &WriteAck_Failure{})
+			if err := m.Failure[len(m.Failure)-1].Unmarshal(data[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipStorage(data[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthStorage
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *WriteAck_Failure) Unmarshal(data []byte) error {
+	l := len(data)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowStorage
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: WriteAck_Failure: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: WriteAck_Failure: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Index", wireType)
+			}
+			m.Index = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStorage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.Index |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Error", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStorage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthStorage
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Error = string(data[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipStorage(data[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthStorage
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipStorage(data []byte) (n int, err error) {
 	l := len(data)
 	iNdEx := 0
@@ -3590,46 +3989,51 @@ var (
 )
 
 var fileDescriptorStorage = []byte{
-	// 651 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x9c, 0x94, 0xcd, 0x6e, 0xd3, 0x4c,
-	0x14, 0x86, 0xe3, 0x26, 0x71, 0x9d, 0x63, 0xb7, 0xdf, 0xd7, 0x41, 0x02, 0xd7, 0x12, 0x6d, 0x65,
-	0x36, 0xdd, 0xd4, 0x2d, 0xe9, 0x06, 0x21, 0x21, 0x21, 0x7e, 0x57, 0x20, 0xd1, 0x88, 0x3f, 0x09,
-	0xa9, 0x1a, 0xec, 0xa9, 0x63, 0xc5, 0xf5, 0x98, 0xf1, 0xb8, 0x6a, 0x2e, 0x81, 0x0d, 0x6b, 0xee,
-	0x86, 0x6d, 0x17, 0x2c, 0xb8, 0x04, 0x04, 0x37, 0xc2, 0xcc, 0xd8, 0x81, 0xb1, 0x93, 0xa0, 0x96,
-	0x85, 0x15, 0x8f, 0x67, 0xce, 0x73, 0xce, 0x7b, 0xce, 0x3b, 0x81, 0xcd, 0xc9, 0x94, 0x8f, 0xc9,
-	0x7e, 0xce, 0x28, 0xa7, 0xfb, 0x05, 0xa7, 0x0c, 0xc7, 0x24, 0x50, 0x2b, 0x64, 0xab, 0xad, 0x6a,
-	0xe1, 0xbf, 0x81, 0xfe, 0xab, 0xe7, 0xf8, 0x94, 0xa0, 0x0d, 0x18, 0x14, 0x49, 0x9c, 0x61, 0x5e,
-	0x32, 0xe2, 0x1a, 0x3b, 0xc6, 0xee, 0x00, 0xad, 0x83, 0x19, 0x52, 0x96, 0x97, 0x85, 0xbb, 0xa2,
-	0xd6, 0x0e, 0xf4, 0x18, 0xa5, 0xdc, 0xed, 0xce, 0x56, 0x39, 0xe6, 0x63, 0xb7, 0xa7, 0x56, 0xff,
-	0x83, 0x95, 0xe2, 0x2c, 0x2e, 0x45, 0x1a, 0xb7, 0x2f, 0xbf, 0xf8, 0xef, 0x60, 0xa0, 0xc8, 0xcf,
-	0x70, 0x31, 0x99, 0xa7, 0x5b, 0x2d, 0xba, 0xd5, 0xa0, 0x5b, 0x0d, 0xba, 0x35, 0x47, 0xb7, 0xfc,
-	0x8f, 0x06, 0xf4, 0x1f, 0x67, 0x9c, 0x4d, 0x91, 0x0f, 0x66, 0x41, 0x4b, 0x16, 0x56, 0x5c, 0x7b,
-	0x88, 0x02, 0x4d, 0x5f, 0xf0, 0x5b, 0x1c, 0x89, 0x62, 0x72, 0x3c, 0x49, 0xb2, 0xa8, 0x16, 0x23,
-	0xc2, 0x38, 0x66, 0x31, 0xa9, 0x12, 0x2e, 0x0d, 0x3b, 0xc1, 0x21, 0x3f, 0xce, 0xc4, 0xa2, 0xd6,
-	0x89, 0x00, 0xd4, 0xa7, 0x33, 0x9c, 0x96, 0x55, 0x2d, 0x8e, 0x1f, 0xc0, 0xaa, 0x2c, 0x25, 0x21,
-	0x05, 0xba, 0x05, 0xab, 0xa4, 0x7a, 0x15, 0xd5, 0x74, 0xe7, 0xb0, 0xaa, 0x62, 0xff, 0x11, 0xd8,
-	0x47, 0x04, 0x47, 0x47, 0xe4, 0x43, 0x49, 0x0a, 0xfe, 0x8f, 0x02, 0xfc, 0xaf, 0x06, 0x38, 0xaf,
-	0x59, 0xc2, 0xc9, 0x55, 0x38, 0x07, 0x60, 0x96, 0x79, 0x84, 0x39, 0x11, 0x10, 0x59, 0xde, 0x4e,
-	0xe3, 0x8c, 0x8e, 0x0b, 0x5e, 0xaa, 0x73, 0xde, 0x09, 0x98, 0xd5, 0x5b, 0xb3, 0x06, 0xa3, 0xd5,
-	0xc4, 0x95, 0xcb, 0x35, 0xb1, 0xbb, 0xa0, 0x89, 0x3d, 0xd5, 0x44, 0x07, 0xa0, 0x4e, 0x9f, 0xa7,
-	0x53, 0xff, 0x2d, 0xd8, 0xa3, 0x10, 0x67, 0x9a, 0xb4, 0x3a, 0xcf, 0x95, 0x66, 0x7c, 0x0d, 0x6c,
-	0x95, 0x27, 0x67, 0xe4, 0x24, 0x39, 0xaf, 0x92, 0xfb, 0x7b, 0xe0, 0x3c, 0xa4, 0x65, 0xc6, 0x67,
-	0xec, 0x35, 0xe8, 0x8b, 0x08, 0x72, 0xae, 0xd0, 0x5d, 0x69, 0xcb, 0x62, 0x8c, 0x59, 0x54, 0xd9,
-	0xb2, 0xeb, 0xdf, 0x04, 0xa8, 0x8f, 0x8b, 0xba, 0xd0, 0x7f, 0xfa, 0x7c, 0xe5, 0xb6, 0xa0, 0x8d,
-	0xe4, 0xf1, 0x4b, 0xd2, 0x2e, 0x0c, 0x58, 0x1b, 0x11, 0xcc, 0xc2, 0xf1, 0x2c, 0x40, 0x38, 0x26,
-	0xc7, 0x8c, 0x27, 0x38, 0xfd, 0x8b, 0xb6, 0x3d, 0xe8, 0x49, 0x21, 0xf5, 0xd0, 0xb6, 0x1b, 0x27,
-	0x1a, 0xb8, 0xe0, 0x89, 0x38, 0x86, 0x02, 0x58, 0xaf, 0x99, 0xba, 0x74, 0x7b, 0x78, 0x7d, 0x1e,
-	0x2d, 0x6f, 0xa7, 0x77, 0x08, 0x3d, 0x15, 0x27, 0x2e, 0x9d, 0x9a, 0x52, 0x35, 0x5c, 0x21, 0xa5,
-	0x1a, 0x90, 0x2c, 0xdd, 0x91, 0x52, 0x34, 0x98, 0x25, 0x1a, 0x63, 0xcf, 0x52, 0xcb, 0xce, 0x88,
-	0x6d, 0x9e, 0x84, 0x13, 0x35, 0xa2, 0xee, 0xee, 0x60, 0xf8, 0xc5, 0x00, 0x78, 0xca, 0x70, 0x3e,
-	0x1e, 0x89, 0x3f, 0x1f, 0x82, 0xee, 0x40, 0x4f, 0x7a, 0x1e, 0xb9, 0x8d, 0x12, 0xb4, 0x6b, 0xe0,
-	0x2d, 0xba, 0x29, 0x9d, 0x03, 0x43, 0x46, 0x4a, 0x2b, 0xb4, 0x22, 0x35, 0x77, 0x2c, 0x8d, 0xbc,
-	0x07, 0x7d, 0x65, 0x29, 0xb4, 0xb9, 0xd4, 0xe5, 0xde, 0x8d, 0x45, 0x5b, 0xd2, 0x81, 0x9d, 0xe1,
-	0x27, 0x03, 0x36, 0xd4, 0x6c, 0x49, 0xa4, 0x09, 0x11, 0x50, 0xe5, 0x87, 0x16, 0x54, 0xb7, 0x54,
-	0x0b, 0xfa, 0xc7, 0x3e, 0x7e, 0x07, 0xdd, 0x85, 0xbe, 0x62, 0xb6, 0xc2, 0x75, 0x0f, 0x2d, 0xd3,
-	0x33, 0x7c, 0x31, 0xf3, 0xce, 0x88, 0xb0, 0xb3, 0x24, 0x24, 0xe8, 0x3e, 0x98, 0xd5, 0x07, 0xe4,
-	0x2d, 0xb7, 0x84, 0xe7, 0x2e, 0xdc, 0x53, 0xe5, 0x3c, 0xb8, 0x7d, 0xf1, 0x63, 0xcb, 0xf8, 0x26,
-	0x9e, 0xef, 0xe2, 0xf9, 0xfc, 0x73, 0xab, 0x03, 0xdb, 0x21, 0x3d, 0x0d, 0x62, 0x4a, 0xe3, 0x94,
-	0x04, 0x11, 0x39, 0xe3, 0x94, 0xa6, 0x85, 0x0e, 0x78, 0x6f, 0xaa, 0x9f, 0xc3, 0x5f, 0x01, 0x00,
-	0x00, 0xff, 0xff, 0x97, 0xdf, 0x8f, 0x89, 0x62, 0x06, 0x00, 0x00,
+	// 722 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x9c, 0x94, 0xcd, 0x4e, 0xdb, 0x4a,
+	0x14, 0xc7, 0xe3, 0x24, 0x76, 0x9c, 0x63, 0x87, 0x7b, 0x99, 0xab, 0x7b, 0x31, 0x96, 0x08, 0xc8,
+	0x2c, 0x2e, 0x1b, 0x0c, 0x37, 0x6c, 0xae, 0x2a, 0x21, 0x95, 0xb6, 0xd0, 0x55, 0x2b, 0x95, 0xa8,
+	0x5f, 0x52, 0x25, 0x34, 0xb5, 0x27, 0x8e, 0x15, 0xc7, 0xe3, 0x8e, 0xc7, 0x88, 0xbc, 0x40, 0xa5,
+	0x6e, 0xba, 0xee, 0x23, 0xb1, 0xe8, 0xa2, 0x8f, 0x50, 0xd1, 0x17, 0xa9, 0x66, 0xc6, 0xa9, 0x9c,
+	0x2f, 0x04, 0x5d, 0xc5, 0x33, 0x73, 0xce, 0xef, 0x7c, 0xfd, 0x4f, 0x60, 0x73, 0x34, 0xe1, 0x43,
+	0x72, 0x90, 0x31, 0xca, 0xe9, 0x41, 0xce, 0x29, 0xc3, 0x11, 0xf1, 0xe5, 0x09, 0x59, 0xf2, 0x49,
+	0x1d, 0xbc, 0x37, 0xa0, 0xbf, 0x7a, 0x8e, 0xc7, 0x04, 0xad, 0x43, 0x3b, 0x8f, 0xa3, 0x14, 0xf3,
+	0x82, 0x11, 0x47, 0xdb, 0xd1, 0xf6, 0xda, 0x68, 0x0d, 0x8c, 0x80, 0xb2, 0xac, 0xc8, 0x9d, 0xba,
+	0x3c, 0xdb, 0xd0, 0x64, 0x94, 0x72, 0xa7, 0x31, 0x3d, 0x65, 0x98, 0x0f, 0x9d, 0xa6, 0x3c, 0xfd,
+	0x09, 0x66, 0x82, 0xd3, 0xa8, 0xc0, 0x11, 0x71, 0x74, 0x71, 0xe3, 0xbd, 0x83, 0xb6, 0x24, 0x3f,
+	0xc3, 0xf9, 0x68, 0x91, 0x6e, 0xce, 0xd1, 0xcd, 0x19, 0xba, 0x39, 0x43, 0x37, 0x17, 0xe8, 0xa6,
+	0xf7, 0x49, 0x03, 0xfd, 0x34, 0xe5, 0x6c, 0x82, 0x3c, 0x30, 0x72, 0x5a, 0xb0, 0x40, 0x71, 0xad,
+	0x1e, 0xf2, 0x2b, 0xf5, 0xf9, 0xbf, 0x8a, 0x23, 0x61, 0x44, 0x2e, 0x46, 0x71, 0x1a, 0x96, 0xc5,
+	0x78, 0x60, 0x70, 0xcc, 0x22, 0xa2, 0x02, 0xae, 0x74, 0x1b, 0xe0, 0x80, 0x5f, 0xa4, 0x78, 0x4c,
+	0xca, 0x3a, 0x11, 0x80, 0xbc, 0xba, 0xc4, 0x49, 0xa1, 0x72, 0xb1, 0x3d, 0x1f, 0x5a, 0x22, 0x95,
+	0x98, 0xe4, 0x68, 0x17, 0x5a, 0x44, 0x7d, 0x3a, 0xda, 0x4e, 0x63, 0x01, 0x2b, 0x33, 0xf6, 0x9e,
+	0x80, 0x75, 0x4e, 0x70, 0x78, 0x4e, 0x3e, 0x14, 0x24, 0xe7, 0xbf, 0x59, 0x80, 0xf7, 0x55, 0x03,
+	0xfb, 0x35, 0x8b, 0x39, 0xb9, 0x0f, 0xe7, 0x10, 0x8c, 0x22, 0x0b, 0x31, 0x27, 0x4e, 0x5d, 0xa6,
+	0xb7, 0x33, 0x63, 0x53, 0xc5, 0xf9, 0x2f, 0xa5, 0x9d, 0x3b, 0x00, 0x43, 0x7d, 0xcd, 0xe6, 0xa0,
+	0xcd, 0x35, 0xb1, 0x7e, 0xb7, 0x26, 0x36, 0x96, 0x34, 0xb1, 0x29, 0x9b, 0x68, 0x03, 0x94, 0xe1,
+	0xb3, 0x64, 0xe2, 0xbd, 0x05, 0xab, 0x1f, 0xe0, 0xb4, 0x52, 0x5a, 0x19, 0xe7, 0x5e, 0x33, 0xfe,
+	0x0b, 0x2c, 0x19, 0x27, 0x63, 0x64, 0x10, 0x5f, 0xa9, 0xe0, 0xde, 0x3e, 0xd8, 0x8f, 0x69, 0x91,
+	0xf2, 0x29, 0xbb, 0x03, 0x7a, 0x9c, 0x86, 0xe4, 0x4a, 0xa2, 0x1b, 0x42, 0x96, 0xf9, 0x10, 0xb3,
+	0x50, 0xc9, 0xb2, 0xe1, 0x6d, 0x01, 0x94, 0xe6, 0x59, 0x32, 0x41, 0x7f, 0x54, 0xe7, 0x2b, 0x9e,
+	0xf7, 0xc1, 0xee, 0x0b, 0xf3, 0x3b, 0xd2, 0xae, 0x35, 0xe8, 0xf4, 0x09, 0x66, 0xc1, 0x70, 0xea,
+	0xb0, 0x0b, 0xad, 0x0c, 0x33, 0x1e, 0xe3, 0xe4, 0x96, 0xda, 0xf6, 0xa1, 0x29, 0x0a, 0x29, 0x87,
+	0xb6, 0x3d, 0x63, 0x31, 0x83, 0xf3, 0xcf, 0x70, 0xc0, 0x91, 0x0f, 0x6b, 0x25, 0xb3, 0x5a, 0xba,
+	0xd5, 0xfb, 0x67, 0x11, 0x2d, 0xb6, 0xd3, 0x3d, 0x82, 0xa6, 0xf4, 0xb3, 0xa1, 0x29, 0xa7, 0xa4,
+	0x86, 0xdb, 0x01, 0x5d, 0x0d, 0x48, 0xa4, 0x6e, 0x8b, 0x52, 0x2a, 0x30, 0xd3, 0xdb, 0x02, 0x6b,
+	0x1a, 0x5a, 0x74, 0x66, 0x0d, 0x0c, 0x1e, 0x07, 0x23, 0x39, 0xa2, 0xc6, 0x5e, 0xdb, 0x63, 0x60,
+	0xca, 0x79, 0x9e, 0x04, 0x23, 0x41, 0x0a, 0x44, 0x0f, 0xcb, 0xa6, 0xf8, 0xd0, 0x1a, 0xe0, 0x38,
+	0x11, 0x7f, 0x05, 0xaa, 0xa0, 0xad, 0x45, 0x15, 0x9e, 0x04, 0x23, 0xff, 0x4c, 0x19, 0xb9, 0xff,
+	0x42, 0xab, 0xfc, 0x9c, 0x6f, 0x6f, 0x07, 0x74, 0xc2, 0x18, 0x65, 0x6a, 0xde, 0xbd, 0x8f, 0x75,
+	0x80, 0xa7, 0x0c, 0x67, 0xc3, 0x3e, 0xa7, 0x8c, 0xa0, 0xff, 0xa1, 0x29, 0xf6, 0x0c, 0x39, 0x33,
+	0xf8, 0xca, 0xea, 0xb9, 0xcb, 0xb6, 0xb3, 0x76, 0xa8, 0x09, 0x4f, 0x21, 0xbf, 0x39, 0xcf, 0x8a,
+	0x22, 0x57, 0x7a, 0x1e, 0x83, 0x2e, 0xf3, 0x47, 0x9b, 0x2b, 0x37, 0xcb, 0xdd, 0x58, 0xf6, 0x24,
+	0x54, 0x5f, 0x43, 0xa7, 0x60, 0xc9, 0x73, 0x9f, 0x33, 0x82, 0xc7, 0xb7, 0x41, 0xfe, 0x5e, 0xda,
+	0x33, 0xaf, 0xb6, 0xa7, 0x1d, 0x6a, 0xbd, 0xcf, 0x1a, 0xac, 0x4b, 0x59, 0x92, 0xb0, 0xd2, 0x8f,
+	0x63, 0xd0, 0xa5, 0x94, 0xe7, 0xb0, 0xd5, 0x6d, 0x70, 0x37, 0x96, 0x3d, 0xa9, 0xdc, 0x1e, 0x80,
+	0x2e, 0x99, 0x73, 0xee, 0x55, 0xf9, 0xaf, 0x6a, 0x4b, 0xef, 0xc5, 0x54, 0xf6, 0x7d, 0xc2, 0x2e,
+	0xe3, 0x80, 0xa0, 0x87, 0x60, 0xa8, 0x0b, 0xe4, 0xae, 0x56, 0xb3, 0xeb, 0x2c, 0x7d, 0x93, 0xe9,
+	0x3c, 0xfa, 0xef, 0xfa, 0xa6, 0xab, 0x7d, 0xbb, 0xe9, 0x6a, 0xdf, 0x6f, 0xba, 0xda, 0x97, 0x1f,
+	0xdd, 0x1a, 0x6c, 0x07, 0x74, 0xec, 0x47, 0x94, 0x46, 0x09, 0xf1, 0x43, 0x72, 0xc9, 0x29, 0x4d,
+	0xf2, 0x2a, 0xe0, 0xbd, 0x21, 0x7f, 0x8e, 0x7e, 0x0e, 0x00, 0xc3, 0x33, 0xc0, 0xc0, 0x1d, 0x07,
+	0x00, 0x00,
 }